@@ -0,0 +1,186 @@
+// Package aggregate shapes readings for charts: it averages them into fixed
+// time buckets, filling the buckets a sleeping or offline sensor left empty
+// so lines aren't drawn straight across the gaps, and downsamples long
+// ranges to a few points that still look like the full series. Daily
+// summarizes them per calendar day.
+package aggregate
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+// Fill modes of empty buckets.
+const (
+	// FillNone leaves empty buckets out.
+	FillNone = "none"
+	// FillNull includes empty buckets with null values, which charts draw
+	// as a break in the line.
+	FillNull = "null"
+	// FillPrevious repeats the last bucket with readings.
+	FillPrevious = "previous"
+	// FillLinear interpolates between the buckets around the gap. Empty
+	// buckets before the first or after the last bucket with readings stay
+	// null.
+	FillLinear = "linear"
+)
+
+// Fills lists the valid fill modes.
+var Fills = []string{FillNone, FillNull, FillPrevious, FillLinear}
+
+// Bucket holds the averages of the readings stamped in [Timestamp,
+// Timestamp+step). Count is 0 for filled buckets.
+type Bucket struct {
+	Timestamp int64    `json:"timestamp"`
+	Count     int      `json:"count"`
+	TempCo    *float64 `json:"tempCo"`
+	TempRoom  *float64 `json:"tempRoom"`
+	Humidity  *float64 `json:"humidity"`
+}
+
+// ValidateFill checks a fill mode, empty being FillNone.
+func ValidateFill(fill string) error {
+	for _, f := range Fills {
+		if fill == f || fill == "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("fill must be one of none, null, previous or linear, not %q", fill)
+}
+
+// Buckets averages readings stamped in [from, to) into buckets of step
+// seconds aligned to multiples of step, oldest first, and fills the empty
+// ones. Readings without a timestamp are skipped.
+func Buckets(readings []store.TemperatureReading, from, to, step int64, fill string) []Bucket {
+	if step <= 0 || to <= from {
+		return make([]Bucket, 0)
+	}
+	start := from - mod(from, step)
+	n := int((to - start + step - 1) / step)
+	type sums struct{ co, room, humidity float64 }
+	counts, totals := make([]int, n), make([]sums, n)
+	for _, r := range readings {
+		if r.Timestamp == nil || *r.Timestamp < from || *r.Timestamp >= to {
+			continue
+		}
+		i := int((*r.Timestamp - start) / step)
+		counts[i]++
+		totals[i].co += r.TempCo
+		totals[i].room += r.TempRoom
+		totals[i].humidity += r.Humidity
+	}
+
+	buckets := make([]Bucket, n)
+	for i := range buckets {
+		b := &buckets[i]
+		b.Timestamp = start + int64(i)*step
+		if c := counts[i]; c > 0 {
+			b.Count = c
+			b.TempCo = ptr(totals[i].co / float64(c))
+			b.TempRoom = ptr(totals[i].room / float64(c))
+			b.Humidity = ptr(totals[i].humidity / float64(c))
+		}
+	}
+
+	switch fill {
+	case FillNull:
+		return buckets
+	case FillPrevious:
+		for i := 1; i < n; i++ {
+			if buckets[i].Count == 0 && buckets[i-1].TempCo != nil {
+				buckets[i].TempCo, buckets[i].TempRoom, buckets[i].Humidity = buckets[i-1].TempCo, buckets[i-1].TempRoom, buckets[i-1].Humidity
+			}
+		}
+		return buckets
+	case FillLinear:
+		prev := -1
+		for i := range buckets {
+			if buckets[i].Count == 0 {
+				continue
+			}
+			if prev >= 0 {
+				a, b := buckets[prev], buckets[i]
+				for j := prev + 1; j < i; j++ {
+					t := float64(j-prev) / float64(i-prev)
+					buckets[j].TempCo = ptr(lerp(*a.TempCo, *b.TempCo, t))
+					buckets[j].TempRoom = ptr(lerp(*a.TempRoom, *b.TempRoom, t))
+					buckets[j].Humidity = ptr(lerp(*a.Humidity, *b.Humidity, t))
+				}
+			}
+			prev = i
+		}
+		return buckets
+	}
+	filled := make([]Bucket, 0, n)
+	for _, b := range buckets {
+		if b.Count > 0 {
+			filled = append(filled, b)
+		}
+	}
+	return filled
+}
+
+// mod is the remainder of a / b, non-negative for timestamps before 1970.
+func mod(a, b int64) int64 {
+	return (a%b + b) % b
+}
+
+func lerp(a, b, t float64) float64 { return a + (b-a)*t }
+
+func ptr(v float64) *float64 { return &v }
+
+// LTTB downsamples readings, oldest first, to n with Largest-Triangle-Three-
+// Buckets: the first and last readings are kept and of every bucket in
+// between the one forming the largest triangle with the reading kept
+// before it and the average of the next bucket, so peaks and dips survive.
+// Areas are summed over tempCo, tempRoom and humidity. Readings must have
+// timestamps; fewer than n, or n below 3, are returned as they are.
+func LTTB(readings []store.TemperatureReading, n int) []store.TemperatureReading {
+	if n < 3 || len(readings) <= n {
+		return readings
+	}
+	x := func(r store.TemperatureReading) float64 { return float64(*r.Timestamp) }
+	sampled := make([]store.TemperatureReading, 0, n)
+	sampled = append(sampled, readings[0])
+	every := float64(len(readings)-2) / float64(n-2)
+	a := readings[0]
+	for i := 0; i < n-2; i++ {
+		start, end := int(float64(i)*every)+1, int(float64(i+1)*every)+1
+		nextStart, nextEnd := end, min(int(float64(i+2)*every)+1, len(readings))
+		if i == n-3 {
+			nextStart, nextEnd = len(readings)-1, len(readings)
+		}
+
+		var avg store.TemperatureReading
+		var avgX float64
+		for _, r := range readings[nextStart:nextEnd] {
+			avgX += x(r)
+			avg.TempCo += r.TempCo
+			avg.TempRoom += r.TempRoom
+			avg.Humidity += r.Humidity
+		}
+		count := float64(nextEnd - nextStart)
+		avgX /= count
+		avg.TempCo, avg.TempRoom, avg.Humidity = avg.TempCo/count, avg.TempRoom/count, avg.Humidity/count
+
+		best, bestArea := start, -1.0
+		for j, r := range readings[start:end] {
+			var area float64
+			for _, y := range [][3]float64{
+				{a.TempCo, r.TempCo, avg.TempCo},
+				{a.TempRoom, r.TempRoom, avg.TempRoom},
+				{a.Humidity, r.Humidity, avg.Humidity},
+			} {
+				area += math.Abs((x(a)-avgX)*(y[1]-y[0]) - (x(a)-x(r))*(y[2]-y[0]))
+			}
+			if area > bestArea {
+				best, bestArea = start+j, area
+			}
+		}
+		a = readings[best]
+		sampled = append(sampled, a)
+	}
+	return append(sampled, readings[len(readings)-1])
+}
@@ -0,0 +1,136 @@
+package aggregate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ts(v int64) *int64 { return &v }
+
+func values(buckets []Bucket) []*float64 {
+	var vs []*float64
+	for _, b := range buckets {
+		vs = append(vs, b.TempRoom)
+	}
+	return vs
+}
+
+func TestBuckets(t *testing.T) {
+	readings := []store.TemperatureReading{
+		{TempRoom: 20, Timestamp: ts(60)},
+		{TempRoom: 22, Timestamp: ts(90)},
+		{TempRoom: 99},
+		// the sensor slept for two buckets
+		{TempRoom: 24, Timestamp: ts(400)},
+		{TempRoom: 99, Timestamp: ts(600)},
+	}
+	// buckets at 0, 100, 200, 300 and 400 up to 500
+	none := Buckets(readings, 50, 500, 100, FillNone)
+	assert.Equal(t, []Bucket{
+		{Timestamp: 0, Count: 2, TempCo: ptr(0), TempRoom: ptr(21), Humidity: ptr(0)},
+		{Timestamp: 400, Count: 1, TempCo: ptr(0), TempRoom: ptr(24), Humidity: ptr(0)},
+	}, none)
+
+	// the reading at 60 is before from
+	assert.Equal(t, []*float64{ptr(22), nil, nil, nil, ptr(24)}, values(Buckets(readings, 70, 500, 100, FillNull)))
+	assert.Equal(t, []*float64{ptr(21), ptr(21), ptr(21), ptr(21), ptr(24)}, values(Buckets(readings, 0, 500, 100, FillPrevious)))
+	assert.Equal(t, []*float64{ptr(21), ptr(21.75), ptr(22.5), ptr(23.25), ptr(24)}, values(Buckets(readings, 0, 500, 100, FillLinear)))
+	// gaps at the ends can't be interpolated
+	assert.Equal(t, []*float64{ptr(21), ptr(21.75), ptr(22.5), ptr(23.25), ptr(24), nil}, values(Buckets(readings[:4], 0, 600, 100, FillLinear)))
+
+	filled := Buckets(readings, 0, 500, 100, FillLinear)
+	assert.Equal(t, 0, filled[1].Count)
+	assert.Empty(t, Buckets(readings, 500, 500, 100, FillNull))
+}
+
+func TestValidateFill(t *testing.T) {
+	for _, fill := range append(Fills, "") {
+		assert.NoError(t, ValidateFill(fill))
+	}
+	assert.Error(t, ValidateFill("spline"))
+}
+
+func TestLTTB(t *testing.T) {
+	var readings []store.TemperatureReading
+	for i := range 100 {
+		r := store.TemperatureReading{TempCo: 40, TempRoom: 21, Humidity: 50, Timestamp: ts(int64(i * 60))}
+		switch i {
+		case 30:
+			r.TempCo = 80
+		case 70:
+			r.Humidity = 10
+		}
+		readings = append(readings, r)
+	}
+
+	sampled := LTTB(readings, 10)
+	require.Len(t, sampled, 10)
+	assert.Equal(t, readings[0], sampled[0])
+	assert.Equal(t, readings[99], sampled[9])
+	// the spike and the dip are kept
+	assert.Contains(t, sampled, readings[30])
+	assert.Contains(t, sampled, readings[70])
+	for i := 1; i < len(sampled); i++ {
+		assert.Greater(t, *sampled[i].Timestamp, *sampled[i-1].Timestamp)
+	}
+
+	assert.Equal(t, readings[:5], LTTB(readings[:5], 10))
+	assert.Equal(t, readings, LTTB(readings, 2))
+}
+
+func TestInterpolate(t *testing.T) {
+	readings := []store.TemperatureReading{
+		{Id: 1, TempRoom: 20, Humidity: 40, Timestamp: ts(30), Device: "a"},
+		{Id: 2, TempRoom: 22, Humidity: 50, Timestamp: ts(120), Device: "a"},
+		{Id: 3, TempRoom: 26, Humidity: 50, Timestamp: ts(160), Device: "b"},
+	}
+	series := Interpolate(readings, 0, 200, 60)
+	// the tick at 0 is before the first reading and the one at 180 after
+	// the last
+	require.Len(t, series, 2)
+	assert.Equal(t, store.TemperatureReading{TempRoom: 20 + 2*30.0/90, Humidity: 40 + 10*30.0/90, Timestamp: ts(60), Device: "a", Quality: store.QualityInterpolated}, series[0])
+	assert.Equal(t, readings[1], series[1])
+
+	series = Interpolate(readings, 130, 150, 10)
+	require.Len(t, series, 3)
+	assert.Equal(t, []int64{130, 140, 150}, []int64{*series[0].Timestamp, *series[1].Timestamp, *series[2].Timestamp})
+	assert.InDelta(t, 24, series[1].TempRoom, 1e-9)
+	// readings of different devices
+	assert.Empty(t, series[1].Device)
+
+	assert.Empty(t, Interpolate(nil, 0, 200, 60))
+	assert.Empty(t, Interpolate(readings, 200, 100, 60))
+}
+
+func TestDaily(t *testing.T) {
+	loc := time.FixedZone("CEST", 2*60*60)
+	readings := []store.TemperatureReading{
+		{TempCo: 40, TempRoom: 20, Humidity: 50, Timestamp: ts(1761343200)}, // 2025-10-25 00:00 CEST
+		{TempCo: 60, TempRoom: 22, Humidity: 40, Timestamp: ts(1761386400)},
+		{TempCo: 99, TempRoom: 99, Humidity: 99},
+		{TempCo: 50, TempRoom: 21, Humidity: 45, Timestamp: ts(1761429600)}, // 2025-10-26 00:00 CEST
+	}
+
+	days := Daily(readings, loc)
+	require.Len(t, days, 2)
+	assert.Equal(t, Day{
+		Date:     "2025-10-25",
+		Count:    2,
+		TempCo:   Stats{Min: 40, Max: 60, Mean: 50},
+		TempRoom: Stats{Min: 20, Max: 22, Mean: 21},
+		Humidity: Stats{Min: 40, Max: 50, Mean: 45},
+	}, days[0])
+	assert.Equal(t, "2025-10-26", days[1].Date)
+	assert.Equal(t, Stats{Min: 50, Max: 50, Mean: 50}, days[1].TempCo)
+
+	// midnight in CEST is the evening before in UTC
+	days = Daily(readings, time.UTC)
+	require.Len(t, days, 2)
+	assert.Equal(t, "2025-10-24", days[0].Date)
+	assert.Equal(t, 2, days[1].Count)
+	assert.Empty(t, Daily(nil, loc))
+}
@@ -0,0 +1,53 @@
+package aggregate
+
+import (
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+// Stats are the lowest, highest and mean value of a field.
+type Stats struct {
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+}
+
+// Day summarizes the readings stamped on one calendar day.
+type Day struct {
+	// Date is the day in loc, formatted 2006-01-02.
+	Date     string `json:"date"`
+	Count    int    `json:"count"`
+	TempCo   Stats  `json:"tempCo"`
+	TempRoom Stats  `json:"tempRoom"`
+	Humidity Stats  `json:"humidity"`
+}
+
+// Daily summarizes readings, which must be oldest first, per calendar day
+// in loc. Days without readings are left out, as are readings without a
+// timestamp.
+func Daily(readings []store.TemperatureReading, loc *time.Location) []Day {
+	days := make([]Day, 0)
+	add := func(s *Stats, v float64, n int) {
+		if n == 1 {
+			*s = Stats{Min: v, Max: v}
+		}
+		s.Min, s.Max = min(s.Min, v), max(s.Max, v)
+		s.Mean += (v - s.Mean) / float64(n)
+	}
+	for _, r := range readings {
+		if r.Timestamp == nil {
+			continue
+		}
+		date := time.Unix(*r.Timestamp, 0).In(loc).Format(time.DateOnly)
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			days = append(days, Day{Date: date})
+		}
+		d := &days[len(days)-1]
+		d.Count++
+		add(&d.TempCo, r.TempCo, d.Count)
+		add(&d.TempRoom, r.TempRoom, d.Count)
+		add(&d.Humidity, r.Humidity, d.Count)
+	}
+	return days
+}
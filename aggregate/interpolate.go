@@ -0,0 +1,45 @@
+package aggregate
+
+import "github.com/bartosz121/esp8266-web/store"
+
+// Interpolate resamples readings, oldest first with timestamps, to one
+// reading every step seconds in [from, to], aligned to multiples of step,
+// oldest first, for consumers that expect a uniform series. A reading
+// stamped on a tick is kept as it is; every other tick is a virtual
+// reading interpolated linearly between the readings around it, without
+// an id and flagged store.QualityInterpolated. Its device is theirs when
+// they share one. Ticks before the first or after the last reading are
+// left out.
+func Interpolate(readings []store.TemperatureReading, from, to, step int64) []store.TemperatureReading {
+	series := make([]store.TemperatureReading, 0)
+	if step <= 0 || to < from || len(readings) == 0 {
+		return series
+	}
+	i := 0
+	for t := from + mod(-from, step); t <= to; t += step {
+		for i < len(readings) && *readings[i].Timestamp < t {
+			i++
+		}
+		switch {
+		case i == len(readings):
+			return series
+		case *readings[i].Timestamp == t:
+			series = append(series, readings[i])
+		case i > 0:
+			a, b := readings[i-1], readings[i]
+			f := float64(t-*a.Timestamp) / float64(*b.Timestamp-*a.Timestamp)
+			v := store.TemperatureReading{
+				TempCo:    lerp(a.TempCo, b.TempCo, f),
+				TempRoom:  lerp(a.TempRoom, b.TempRoom, f),
+				Humidity:  lerp(a.Humidity, b.Humidity, f),
+				Timestamp: &t,
+				Quality:   store.QualityInterpolated,
+			}
+			if a.Device == b.Device {
+				v.Device = a.Device
+			}
+			series = append(series, v)
+		}
+	}
+	return series
+}
@@ -0,0 +1,280 @@
+// Package alert evaluates alert rules against incoming readings and keeps
+// their firing state in a store.AlertStore.
+package alert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/notify"
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+const (
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+const (
+	ChannelTelegram = "telegram"
+	ChannelEmail    = "email"
+	// ChannelSMS is reserved for critical rules.
+	ChannelSMS = "sms"
+)
+
+// Channels are the notification channels escalation steps may use.
+var Channels = []string{ChannelTelegram, ChannelEmail, ChannelSMS}
+
+var (
+	fields     = []string{"tempCo", "tempRoom", "humidity", FieldReboots}
+	ops        = []string{"gt", "gte", "lt", "lte"}
+	severities = []string{SeverityWarning, SeverityCritical}
+)
+
+// Validate checks r and fills in the default severity.
+func Validate(r *store.AlertRule) error {
+	var errs []error
+	if strings.TrimSpace(r.Name) == "" {
+		errs = append(errs, errors.New("name is required"))
+	}
+	if !contains(fields, r.Field) {
+		errs = append(errs, fmt.Errorf("field must be one of %s", strings.Join(fields, ", ")))
+	}
+	if !contains(ops, r.Op) {
+		errs = append(errs, fmt.Errorf("op must be one of %s", strings.Join(ops, ", ")))
+	}
+	if r.Severity == "" {
+		r.Severity = SeverityWarning
+	}
+	if !contains(severities, r.Severity) {
+		errs = append(errs, fmt.Errorf("severity must be one of %s", strings.Join(severities, ", ")))
+	}
+	if r.Escalation == nil {
+		r.Escalation = []store.EscalationStep{}
+	}
+	if r.Templates == nil {
+		r.Templates = map[string]string{}
+	}
+	if _, err := ParseTemplates(r.Templates); err != nil {
+		errs = append(errs, err)
+	}
+	for i, step := range r.Escalation {
+		if !contains(Channels, step.Channel) {
+			errs = append(errs, fmt.Errorf("escalation channel must be one of %s", strings.Join(Channels, ", ")))
+		}
+		if step.Channel == ChannelSMS && r.Severity != SeverityCritical {
+			errs = append(errs, errors.New("sms escalation is only allowed for critical rules"))
+		}
+		if step.AfterSeconds < 0 || (i > 0 && step.AfterSeconds < r.Escalation[i-1].AfterSeconds) {
+			errs = append(errs, errors.New("escalation steps must be in increasing afterSeconds order"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func contains(values []string, v string) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Value returns the reading's value for a rule field.
+func Value(r store.TemperatureReading, field string) float64 {
+	switch field {
+	case "tempCo":
+		return r.TempCo
+	case "tempRoom":
+		return r.TempRoom
+	default:
+		return r.Humidity
+	}
+}
+
+// Matches reports whether the rule's condition holds for v.
+func Matches(rule store.AlertRule, v float64) bool {
+	switch rule.Op {
+	case "gt":
+		return v > rule.Threshold
+	case "gte":
+		return v >= rule.Threshold
+	case "lt":
+		return v < rule.Threshold
+	case "lte":
+		return v <= rule.Threshold
+	}
+	return false
+}
+
+// Config configures an Engine; the zero value logs alerts without notifying
+// anyone.
+type Config struct {
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+	// Notifiers are the channels escalation steps refer to, by name.
+	Notifiers map[string]notify.Notifier
+	// AckURL is the public base URL of the server, e.g.
+	// https://temp.example.com. Notifications link to its acknowledge
+	// endpoint; without it they carry no link.
+	AckURL string
+	// Templates override the built-in notification text; rule templates
+	// take precedence.
+	Templates Templates
+	// Readings, when set, provides the newest reading and recent stats to
+	// templates.
+	Readings ReadingLister
+	// OnEvent, when set, is called with every firing, acknowledged and
+	// resolved transition, e.g. events.Publisher.Alert. It must not block.
+	OnEvent func(store.AlertEvent)
+	// Away, when set, returns the away mode in effect, if any. Meanwhile
+	// low-temperature rules only fire below its frost-protection setpoint,
+	// e.g. control.Controller.Away.
+	Away func(ctx context.Context) (*store.AwayMode, error)
+	// Enabled, when set, reports whether alerting is on, e.g. the
+	// features.Alerts flag. While it is off Evaluate and Escalate do
+	// nothing.
+	Enabled func() bool
+	// Reboots, when set, counts the crash reports of device since a unix
+	// time, e.g. store.CrashStore.CountCrashReports. Escalate resolves the
+	// reboots alerts of devices that stopped crashing with it.
+	Reboots func(ctx context.Context, device string, since int64) (int, error)
+}
+
+type ReadingLister interface {
+	ListReadings(ctx context.Context, limit, offset int) ([]store.TemperatureReading, error)
+}
+
+// Engine fires and resolves alerts as readings arrive and escalates
+// unacknowledged ones.
+type Engine struct {
+	mu     sync.Mutex
+	store  store.AlertStore
+	cfg    Config
+	logger *slog.Logger
+	now    func() time.Time
+}
+
+func NewEngine(st store.AlertStore, cfg Config) *Engine {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return &Engine{store: st, cfg: cfg, logger: cfg.Logger, now: time.Now}
+}
+
+func (e *Engine) enabled() bool {
+	return e.cfg.Enabled == nil || e.cfg.Enabled()
+}
+
+// Store returns the store the engine keeps alert state in.
+func (e *Engine) Store() store.AlertStore {
+	return e.store
+}
+
+// Channels returns the names of the configured notification channels,
+// sorted.
+func (e *Engine) Channels() []string {
+	return slices.Sorted(maps.Keys(e.cfg.Notifiers))
+}
+
+// Evaluate checks every enabled rule against r, sent by device when known,
+// firing rules whose condition now holds and resolving firing rules whose
+// condition no longer does. Newly fired alerts are notified right away.
+func (e *Engine) Evaluate(ctx context.Context, device string, r store.TemperatureReading) error {
+	if !e.enabled() {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	rules, err := e.store.ListAlertRules(ctx)
+	if err != nil {
+		return fmt.Errorf("list alert rules: %w", err)
+	}
+	firing, err := e.store.ListFiringAlerts(ctx)
+	if err != nil {
+		return fmt.Errorf("list firing alerts: %w", err)
+	}
+	isFiring := make(map[int]bool, len(firing))
+	for _, a := range firing {
+		isFiring[a.RuleId] = true
+	}
+	var away *store.AwayMode
+	if e.cfg.Away != nil {
+		if away, err = e.cfg.Away(ctx); err != nil {
+			return fmt.Errorf("away mode: %w", err)
+		}
+	}
+
+	var ts int64
+	if r.Timestamp != nil {
+		ts = *r.Timestamp
+	}
+	fired := false
+	for _, rule := range rules {
+		// reboots rules are evaluated as crash reports arrive
+		if rule.Field == FieldReboots {
+			continue
+		}
+		v := Value(r, rule.Field)
+		f, err := e.transition(ctx, rule, rule.Enabled && Matches(AwayRule(rule, away), v), isFiring[rule.Id], device, v, ts)
+		if err != nil {
+			return err
+		}
+		fired = fired || f
+	}
+	if fired {
+		return e.escalate(ctx)
+	}
+	return nil
+}
+
+// transition fires rule when match newly holds and resolves it when it no
+// longer does, reporting whether it fired. It must be called with mu held.
+func (e *Engine) transition(ctx context.Context, rule store.AlertRule, match, firing bool, device string, v float64, ts int64) (bool, error) {
+	switch {
+	case match && !firing:
+		token, err := newAckToken()
+		if err != nil {
+			return false, err
+		}
+		a := store.Alert{RuleId: rule.Id, Since: ts, Value: v, Device: device, FiredAt: e.now().Unix(), AckToken: token}
+		if err := e.store.FireAlert(ctx, a); err != nil {
+			return false, fmt.Errorf("fire alert %d: %w", rule.Id, err)
+		}
+		e.logger.Warn("alert firing", "rule", rule.Name, "severity", rule.Severity, "value", v)
+		e.emit(rule, store.AlertFiring, v, ts)
+		return true, nil
+	case !match && firing:
+		if err := e.store.ResolveAlert(ctx, rule.Id, v, ts); err != nil {
+			return false, fmt.Errorf("resolve alert %d: %w", rule.Id, err)
+		}
+		e.logger.Info("alert resolved", "rule", rule.Name, "value", v)
+		e.emit(rule, store.AlertResolved, v, ts)
+	}
+	return false, nil
+}
+
+// AwayRule returns rule as it applies in away mode m: a temperature rule
+// firing below a threshold above the setpoint fires below the setpoint
+// instead. Without away mode rule is returned unchanged.
+func AwayRule(rule store.AlertRule, m *store.AwayMode) store.AlertRule {
+	if m != nil && (rule.Field == "tempCo" || rule.Field == "tempRoom") && (rule.Op == "lt" || rule.Op == "lte") && rule.Threshold > m.Setpoint {
+		rule.Threshold = m.Setpoint
+	}
+	return rule
+}
+
+func (e *Engine) emit(rule store.AlertRule, state string, v float64, ts int64) {
+	if e.cfg.OnEvent != nil {
+		e.cfg.OnEvent(store.AlertEvent{RuleId: rule.Id, RuleName: rule.Name, State: state, Value: v, Timestamp: ts})
+	}
+}
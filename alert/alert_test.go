@@ -0,0 +1,422 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/notify"
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	r := store.AlertRule{Name: "boiler hot", Field: "tempCo", Op: "gt", Threshold: 70}
+	require.NoError(t, Validate(&r))
+	assert.Equal(t, SeverityWarning, r.Severity)
+
+	err := Validate(&store.AlertRule{Field: "pressure", Op: "eq", Severity: "info"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "name is required")
+	assert.Contains(t, err.Error(), "field must be one of")
+	assert.Contains(t, err.Error(), "op must be one of")
+	assert.Contains(t, err.Error(), "severity must be one of")
+}
+
+func TestEngineEvaluate(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	rule, err := st.CreateAlertRule(ctx, store.AlertRule{Name: "boiler hot", Field: "tempCo", Op: "gte", Threshold: 70, Severity: SeverityCritical, Enabled: true})
+	require.NoError(t, err)
+	_, err = st.CreateAlertRule(ctx, store.AlertRule{Name: "disabled", Field: "tempCo", Op: "gt", Threshold: 0, Enabled: false})
+	require.NoError(t, err)
+
+	e := NewEngine(st, Config{})
+	e.now = func() time.Time { return time.Unix(1000, 0) }
+	reading := func(tempCo float64, ts int64) store.TemperatureReading {
+		return store.TemperatureReading{TempCo: tempCo, Timestamp: &ts}
+	}
+
+	require.NoError(t, e.Evaluate(ctx, "", reading(65, 100)))
+	firing, err := st.ListFiringAlerts(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, firing)
+
+	require.NoError(t, e.Evaluate(ctx, "", reading(70, 200)))
+	require.NoError(t, e.Evaluate(ctx, "", reading(75, 300)))
+	firing, err = st.ListFiringAlerts(ctx)
+	require.NoError(t, err)
+	require.Len(t, firing, 1)
+	assert.NotEmpty(t, firing[0].AckToken)
+	firing[0].AckToken = ""
+	assert.Equal(t, []store.Alert{{RuleId: rule.Id, RuleName: "boiler hot", Severity: SeverityCritical, Since: 200, Value: 70, FiredAt: 1000}}, firing)
+
+	require.NoError(t, e.Evaluate(ctx, "", reading(60, 400)))
+	firing, err = st.ListFiringAlerts(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, firing)
+
+	history, err := st.ListAlertHistory(ctx, store.AlertHistoryFilter{Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, store.AlertResolved, history[0].State)
+	assert.Equal(t, int64(400), history[0].Timestamp)
+	assert.Equal(t, store.AlertFiring, history[1].State)
+	assert.Equal(t, int64(200), history[1].Timestamp)
+}
+
+func TestSilenceMatches(t *testing.T) {
+	s := store.Silence{
+		Matchers: []store.SilenceMatcher{{Name: "rule", Value: "boiler.*", IsRegex: true}, {Name: "severity", Value: "warning"}},
+		StartsAt: 100,
+		EndsAt:   200,
+	}
+	require.NoError(t, ValidateSilence(s))
+
+	assert.True(t, SilenceMatches(s, "boiler hot", "warning", 150))
+	assert.False(t, SilenceMatches(s, "boiler hot", "critical", 150))
+	assert.False(t, SilenceMatches(s, "attic boiler", "warning", 150), "regex must match the whole label")
+	assert.False(t, SilenceMatches(s, "boiler hot", "warning", 99))
+	assert.False(t, SilenceMatches(s, "boiler hot", "warning", 200))
+
+	err := ValidateSilence(store.Silence{Matchers: []store.SilenceMatcher{{Name: "device", Value: "("}, {Name: "rule", Value: "(", IsRegex: true}}, StartsAt: 100, EndsAt: 100})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "matcher name must be one of")
+	assert.Contains(t, err.Error(), "matcher rule")
+	assert.Contains(t, err.Error(), "must end after it starts")
+}
+
+type fakeNotifier struct {
+	messages []notify.Message
+	// err fails every send while set
+	err error
+}
+
+func (f *fakeNotifier) Notify(ctx context.Context, m notify.Message) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.messages = append(f.messages, m)
+	return nil
+}
+
+func TestEngineEscalate(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	_, err := st.CreateAlertRule(ctx, store.AlertRule{Name: "boiler hot", Field: "tempCo", Op: "gt", Threshold: 70, Severity: SeverityCritical, Enabled: true,
+		Escalation: []store.EscalationStep{{Channel: "telegram"}, {Channel: "email", AfterSeconds: 900}, {Channel: "sms", AfterSeconds: 1800}},
+	})
+	require.NoError(t, err)
+
+	telegram, email, sms := &fakeNotifier{}, &fakeNotifier{}, &fakeNotifier{}
+	e := NewEngine(st, Config{
+		Notifiers: map[string]notify.Notifier{"telegram": telegram, "email": email, "sms": sms},
+		AckURL:    "https://temp.example.com/",
+	})
+	now := time.Unix(1000, 0)
+	e.now = func() time.Time { return now }
+
+	ts := int64(990)
+	require.NoError(t, e.Evaluate(ctx, "", store.TemperatureReading{TempCo: 75, Timestamp: &ts}))
+	require.Len(t, telegram.messages, 1)
+	assert.Equal(t, "[critical] boiler hot firing", telegram.messages[0].Subject)
+	assert.Regexp(t, `^https://temp\.example\.com/alerts/ack/[0-9a-f]{32}$`, telegram.messages[0].AckURL)
+	assert.Empty(t, email.messages)
+
+	now = now.Add(15 * time.Minute)
+	require.NoError(t, e.Escalate(ctx))
+	require.NoError(t, e.Escalate(ctx))
+	assert.Len(t, telegram.messages, 1)
+	assert.Len(t, email.messages, 1)
+	assert.Empty(t, sms.messages)
+
+	token := telegram.messages[0].AckURL[len("https://temp.example.com/alerts/ack/"):]
+	_, err = st.AckAlert(ctx, token, now.Unix())
+	require.NoError(t, err)
+
+	now = now.Add(time.Hour)
+	require.NoError(t, e.Escalate(ctx))
+	assert.Empty(t, sms.messages, "acknowledged alerts don't escalate")
+}
+
+func TestDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	_, err := st.CreateAlertRule(ctx, store.AlertRule{Name: "boiler hot", Field: "tempCo", Op: "gt", Threshold: 70, Severity: SeverityCritical, Enabled: true,
+		Escalation: []store.EscalationStep{{Channel: "telegram"}, {Channel: "email"}},
+	})
+	require.NoError(t, err)
+
+	attempts, failures := testutil.ToFloat64(notificationAttempts.WithLabelValues("telegram")), testutil.ToFloat64(notificationFailures.WithLabelValues("telegram"))
+	telegram := &fakeNotifier{err: errors.New("telegram send: unexpected status 502 Bad Gateway")}
+	e := NewEngine(st, Config{Notifiers: map[string]notify.Notifier{"telegram": telegram}})
+	ts := int64(990)
+	require.NoError(t, e.Evaluate(ctx, "", store.TemperatureReading{TempCo: 75, Timestamp: &ts}))
+	assert.Equal(t, failures+1, testutil.ToFloat64(notificationFailures.WithLabelValues("telegram")))
+
+	// the failed step and the unconfigured one
+	letters, err := st.ListDeadLetters(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, letters, 2)
+	assert.Equal(t, "email", letters[0].Channel)
+	assert.Equal(t, 0, letters[0].Attempts)
+	assert.Equal(t, "telegram", letters[1].Channel)
+	assert.Equal(t, "[critical] boiler hot firing", letters[1].Subject)
+	assert.Equal(t, 1, letters[1].Attempts)
+
+	_, err = e.Replay(ctx, letters[0].Id)
+	assert.ErrorIs(t, err, ErrNotConfigured)
+	d, err := e.Replay(ctx, letters[1].Id)
+	var sendErr *SendError
+	require.ErrorAs(t, err, &sendErr)
+	assert.Equal(t, 2, d.Attempts)
+
+	telegram.err = nil
+	_, err = e.Replay(ctx, letters[1].Id)
+	require.NoError(t, err)
+	require.Len(t, telegram.messages, 1)
+	assert.Equal(t, "[critical] boiler hot firing", telegram.messages[0].Subject)
+	_, err = e.Replay(ctx, letters[1].Id)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	assert.Equal(t, attempts+3, testutil.ToFloat64(notificationAttempts.WithLabelValues("telegram")))
+}
+
+func TestValidateEscalation(t *testing.T) {
+	r := store.AlertRule{Name: "boiler hot", Field: "tempCo", Op: "gt",
+		Escalation: []store.EscalationStep{{Channel: "email", AfterSeconds: 900}, {Channel: "pager", AfterSeconds: 60}},
+	}
+	err := Validate(&r)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "escalation channel must be one of")
+	assert.Contains(t, err.Error(), "increasing afterSeconds order")
+
+	r = store.AlertRule{Name: "humid", Field: "humidity", Op: "gt", Severity: SeverityWarning,
+		Escalation: []store.EscalationStep{{Channel: ChannelSMS}},
+	}
+	assert.ErrorContains(t, Validate(&r), "sms escalation is only allowed for critical rules")
+	r.Severity = SeverityCritical
+	assert.NoError(t, Validate(&r))
+}
+
+func TestNotificationTemplates(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	ts, old, recent := int64(1000), int64(1000-2*3600), int64(1000-600)
+	_, err := st.InsertReadings(ctx, []store.TemperatureReading{
+		{TempCo: 60, Timestamp: &old}, // outside the stats window
+		{TempCo: 66, Timestamp: &recent},
+		{TempCo: 72, Timestamp: &ts},
+	})
+	require.NoError(t, err)
+	_, err = st.CreateAlertRule(ctx, store.AlertRule{Name: "boiler hot", Field: "tempCo", Op: "gt", Threshold: 70, Severity: SeverityCritical, Enabled: true,
+		Escalation: []store.EscalationStep{{Channel: ChannelTelegram}, {Channel: ChannelSMS}},
+		Templates:  map[string]string{ChannelSMS: `{{define "subject"}}{{.Rule.Name}} {{.Alert.Value}} on {{.Device}}{{end}}ignored body`},
+	})
+	require.NoError(t, err)
+
+	global, err := ParseTemplates(map[string]string{
+		DefaultTemplate: `{{.Device}} {{.Rule.Field}}={{.Reading.TempCo}} avg {{printf "%.0f" .Stats.Avg}} over {{.Stats.Count}} since {{(unixTime .Alert.Since).Format "15:04"}}`,
+	})
+	require.NoError(t, err)
+
+	telegram, sms := &fakeNotifier{}, &fakeNotifier{}
+	e := NewEngine(st, Config{
+		Notifiers: map[string]notify.Notifier{ChannelTelegram: telegram, ChannelSMS: sms},
+		Templates: global,
+		Readings:  st,
+	})
+	e.now = func() time.Time { return time.Unix(1000, 0) }
+
+	require.NoError(t, e.Evaluate(ctx, "boiler", store.TemperatureReading{TempCo: 72, Timestamp: &ts}))
+	require.Len(t, telegram.messages, 1)
+	assert.Equal(t, "[critical] boiler hot firing", telegram.messages[0].Subject)
+	assert.Equal(t, "boiler tempCo=72 avg 69 over 2 since 00:16", telegram.messages[0].Text)
+	require.Len(t, sms.messages, 1)
+	assert.Equal(t, "boiler hot 72 on boiler", sms.messages[0].Subject)
+
+	_, err = ParseTemplates(map[string]string{"pager": "x"})
+	assert.Error(t, err)
+}
+
+func TestEngineOnEvent(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	rule, err := st.CreateAlertRule(ctx, store.AlertRule{Name: "boiler hot", Field: "tempCo", Op: "gte", Threshold: 70, Enabled: true})
+	require.NoError(t, err)
+
+	var events []store.AlertEvent
+	e := NewEngine(st, Config{OnEvent: func(ev store.AlertEvent) { events = append(events, ev) }})
+	e.now = func() time.Time { return time.Unix(1000, 0) }
+	ts := func(v int64) *int64 { return &v }
+
+	require.NoError(t, e.Evaluate(ctx, "", store.TemperatureReading{TempCo: 75, Timestamp: ts(100)}))
+	firing, err := st.ListFiringAlerts(ctx)
+	require.NoError(t, err)
+	require.Len(t, firing, 1)
+	_, err = e.Ack(ctx, firing[0].AckToken)
+	require.NoError(t, err)
+	_, err = e.Ack(ctx, firing[0].AckToken)
+	require.NoError(t, err)
+	require.NoError(t, e.Evaluate(ctx, "", store.TemperatureReading{TempCo: 60, Timestamp: ts(200)}))
+
+	assert.Equal(t, []store.AlertEvent{
+		{RuleId: rule.Id, RuleName: "boiler hot", State: store.AlertFiring, Value: 75, Timestamp: 100},
+		{RuleId: rule.Id, RuleName: "boiler hot", State: store.AlertAcknowledged, Value: 75, Timestamp: 1000},
+		{RuleId: rule.Id, RuleName: "boiler hot", State: store.AlertResolved, Value: 60, Timestamp: 200},
+	}, events)
+}
+
+func TestEngineAwayMode(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	_, err := st.CreateAlertRule(ctx, store.AlertRule{Name: "house cold", Field: "tempRoom", Op: "lt", Threshold: 18, Enabled: true})
+	require.NoError(t, err)
+	_, err = st.CreateAlertRule(ctx, store.AlertRule{Name: "dry", Field: "humidity", Op: "lt", Threshold: 30, Enabled: true})
+	require.NoError(t, err)
+
+	var away *store.AwayMode
+	e := NewEngine(st, Config{Away: func(context.Context) (*store.AwayMode, error) { return away, nil }})
+	firing := func(tempRoom float64) []string {
+		t.Helper()
+		ts := int64(100)
+		require.NoError(t, e.Evaluate(ctx, "", store.TemperatureReading{TempRoom: tempRoom, Humidity: 20, Timestamp: &ts}))
+		alerts, err := st.ListFiringAlerts(ctx)
+		require.NoError(t, err)
+		var names []string
+		for _, a := range alerts {
+			names = append(names, a.RuleName)
+		}
+		return names
+	}
+
+	away = &store.AwayMode{Setpoint: 7, Until: 1000}
+	assert.Equal(t, []string{"dry"}, firing(10))
+	assert.ElementsMatch(t, []string{"dry", "house cold"}, firing(6))
+	away = nil
+	assert.ElementsMatch(t, []string{"dry", "house cold"}, firing(10))
+
+	assert.Equal(t, 18.0, AwayRule(store.AlertRule{Field: "tempRoom", Op: "gt", Threshold: 18}, &store.AwayMode{Setpoint: 7}).Threshold)
+	assert.Equal(t, 5.0, AwayRule(store.AlertRule{Field: "tempCo", Op: "lte", Threshold: 5}, &store.AwayMode{Setpoint: 7}).Threshold)
+}
+
+func TestPrometheusRules(t *testing.T) {
+	rules := []store.AlertRule{
+		{Id: 1, Name: "boiler hot", Field: "tempCo", Op: "gt", Threshold: 70.5, Severity: SeverityCritical, Enabled: true,
+			Escalation: []store.EscalationStep{{Channel: ChannelTelegram}, {Channel: ChannelSMS, AfterSeconds: 600}}},
+		{Id: 2, Name: "2nd floor damp!", Field: "humidity", Op: "gte", Threshold: 80, Severity: SeverityWarning, Enabled: true},
+		{Id: 3, Name: "freezing", Field: "tempRoom", Op: "lt", Threshold: 5, Severity: SeverityWarning},
+		{Id: 4, Name: "crash loop", Field: FieldReboots, Op: "gt", Threshold: 3, Severity: SeverityWarning, Enabled: true},
+	}
+
+	out, err := PrometheusRules(rules)
+	require.NoError(t, err)
+	assert.Equal(t, `groups:
+  - name: esp8266-web
+    rules:
+      - alert: boiler_hot
+        expr: esp8266_temp_co_celsius > 70.5
+        labels:
+          rule_id: "1"
+          severity: critical
+        annotations:
+          description: tempCo of {{ $labels.device }} is {{ $value }}, > 70.5
+          summary: boiler hot
+      - alert: rule_2nd_floor_damp
+        expr: esp8266_humidity_percent >= 80
+        labels:
+          rule_id: "2"
+          severity: warning
+        annotations:
+          description: humidity of {{ $labels.device }} is {{ $value }}, >= 80
+          summary: 2nd floor damp!
+      - alert: crash_loop
+        expr: sum by (device) (increase(esp8266_device_crashes_total[1h])) > 3
+        labels:
+          rule_id: "4"
+          severity: warning
+        annotations:
+          description: reboots of {{ $labels.device }} is {{ $value }}, > 3
+          summary: crash loop
+`, string(out))
+
+	out, err = AlertmanagerRoutes(rules)
+	require.NoError(t, err)
+	assert.Equal(t, `route:
+  receiver: default
+  group_by:
+    - alertname
+    - device
+  routes:
+    - receiver: telegram
+      matchers:
+        - rule_id="1"
+      continue: true
+    - receiver: sms
+      matchers:
+        - rule_id="1"
+      continue: true
+receivers:
+  - name: default
+  - name: telegram
+  - name: sms
+`, string(out))
+}
+
+func TestEngineReboots(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	_, err := st.CreateAlertRule(ctx, store.AlertRule{Name: "crash loop", Field: FieldReboots, Op: "gt", Threshold: 2, Severity: SeverityWarning, Enabled: true,
+		Escalation: []store.EscalationStep{{Channel: "telegram"}},
+	})
+	require.NoError(t, err)
+	// readings never fire or resolve reboots rules
+	_, err = st.CreateAlertRule(ctx, store.AlertRule{Name: "damp", Field: "humidity", Op: "gt", Threshold: 80, Enabled: true})
+	require.NoError(t, err)
+
+	now := time.Unix(1761388000, 0)
+	reboots := 3
+	telegram := &fakeNotifier{}
+	e := NewEngine(st, Config{
+		Notifiers: map[string]notify.Notifier{"telegram": telegram},
+		Reboots: func(ctx context.Context, device string, since int64) (int, error) {
+			assert.Equal(t, "attic", device)
+			assert.Equal(t, now.Add(-RebootWindow).Unix(), since)
+			return reboots, nil
+		},
+	})
+	e.now = func() time.Time { return now }
+
+	require.NoError(t, e.EvaluateReboots(ctx, "attic", 2, now.Unix()))
+	firing, err := st.ListFiringAlerts(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, firing)
+
+	require.NoError(t, e.EvaluateReboots(ctx, "attic", 3, now.Unix()))
+	require.NoError(t, e.Evaluate(ctx, "attic", store.TemperatureReading{Humidity: 50}))
+	firing, err = st.ListFiringAlerts(ctx)
+	require.NoError(t, err)
+	require.Len(t, firing, 1)
+	assert.Equal(t, "attic", firing[0].Device)
+	assert.Equal(t, 3.0, firing[0].Value)
+	require.Len(t, telegram.messages, 1)
+	assert.Equal(t, "attic: reboots is 3 (gt 2) since 2025-10-25T10:26:40Z", telegram.messages[0].Text)
+
+	// another device's report doesn't resolve it
+	require.NoError(t, e.EvaluateReboots(ctx, "garage", 1, now.Unix()))
+	require.NoError(t, e.Escalate(ctx))
+	firing, err = st.ListFiringAlerts(ctx)
+	require.NoError(t, err)
+	assert.Len(t, firing, 1)
+
+	// resolved once the crashes age out of the window
+	now = now.Add(RebootWindow)
+	reboots = 0
+	require.NoError(t, e.Escalate(ctx))
+	firing, err = st.ListFiringAlerts(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, firing)
+}
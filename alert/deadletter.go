@@ -0,0 +1,115 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/notify"
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	notificationAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "esp8266_notification_attempts_total",
+		Help: "Attempts to send an alert notification, replays included, by channel.",
+	}, []string{"channel"})
+	notificationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "esp8266_notification_failures_total",
+		Help: "Alert notifications that failed to send, by channel.",
+	}, []string{"channel"})
+	notificationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "esp8266_notification_duration_seconds",
+		Help: "Time to send an alert notification, by channel.",
+	}, []string{"channel"})
+	deadLettersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "esp8266_notification_dead_letters_total",
+		Help: "Alert notifications kept as dead letters after failing, by channel.",
+	}, []string{"channel"})
+)
+
+// ErrNotConfigured rejects replaying a dead letter over a channel that
+// isn't configured.
+var ErrNotConfigured = errors.New("notification channel not configured")
+
+// SendError is a replayed dead letter failing to send again.
+type SendError struct {
+	Err error
+}
+
+func (e *SendError) Error() string { return e.Err.Error() }
+
+func (e *SendError) Unwrap() error { return e.Err }
+
+// send sends m over channel, recording the attempt on /metrics.
+func (e *Engine) send(ctx context.Context, channel string, n notify.Notifier, m notify.Message) error {
+	start := time.Now()
+	err := n.Notify(ctx, m)
+	notificationDuration.WithLabelValues(channel).Observe(time.Since(start).Seconds())
+	notificationAttempts.WithLabelValues(channel).Inc()
+	if err != nil {
+		notificationFailures.WithLabelValues(channel).Inc()
+	}
+	return err
+}
+
+// deadLetter keeps the notification of rule that failed with err after
+// attempts sends, when the store supports it. Escalation moves on to the
+// next step either way.
+func (e *Engine) deadLetter(ctx context.Context, channel string, rule store.AlertRule, m notify.Message, attempts int, err error) {
+	ds, ok := e.store.(store.DeadLetterStore)
+	if !ok {
+		return
+	}
+	d := store.DeadLetter{
+		RuleId:   rule.Id,
+		RuleName: rule.Name,
+		Channel:  channel,
+		Subject:  m.Subject,
+		Text:     m.Text,
+		AckURL:   m.AckURL,
+		Error:    err.Error(),
+		Attempts: attempts,
+		FailedAt: e.now().Unix(),
+	}
+	if _, err := ds.AddDeadLetter(ctx, d); err != nil {
+		e.logger.Error("failed to keep dead letter", "rule", rule.Name, "channel", channel, "error", err)
+		return
+	}
+	deadLettersTotal.WithLabelValues(channel).Inc()
+}
+
+// Replay sends the dead letter with id again and deletes it once sent. A
+// failed attempt is recorded on the dead letter and returned as a
+// *SendError.
+func (e *Engine) Replay(ctx context.Context, id int) (store.DeadLetter, error) {
+	ds, ok := e.store.(store.DeadLetterStore)
+	if !ok {
+		return store.DeadLetter{}, errors.ErrUnsupported
+	}
+	d, err := ds.GetDeadLetter(ctx, id)
+	if err != nil {
+		return d, err
+	}
+	n, ok := e.cfg.Notifiers[d.Channel]
+	if !ok {
+		return d, fmt.Errorf("%w: %s", ErrNotConfigured, d.Channel)
+	}
+	if err := e.send(ctx, d.Channel, n, notify.Message{Subject: d.Subject, Text: d.Text, AckURL: d.AckURL}); err != nil {
+		d.Error = err.Error()
+		d.Attempts++
+		d.FailedAt = e.now().Unix()
+		if err := ds.UpdateDeadLetter(ctx, d); err != nil {
+			return d, fmt.Errorf("update dead letter %d: %w", id, err)
+		}
+		return d, &SendError{err}
+	}
+	if err := ds.DeleteDeadLetter(ctx, id); err != nil {
+		return d, fmt.Errorf("delete dead letter %d: %w", id, err)
+	}
+	e.logger.Info("dead letter replayed", "id", id, "rule", d.RuleName, "channel", d.Channel)
+	return d, nil
+}
@@ -0,0 +1,181 @@
+package alert
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/notify"
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+// EscalationInterval is how often Run checks for due escalation steps.
+const EscalationInterval = 30 * time.Second
+
+func newAckToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate ack token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Run escalates unacknowledged alerts every interval until ctx is done.
+func (e *Engine) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.Escalate(ctx); err != nil {
+				e.logger.Error("failed to escalate alerts", "error", err)
+			}
+		}
+	}
+}
+
+// Ack acknowledges the firing alert with the ack token, which stops its
+// escalation.
+func (e *Engine) Ack(ctx context.Context, token string) (store.Alert, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// acknowledging again keeps the first time and isn't a transition
+	firing, err := e.store.ListFiringAlerts(ctx)
+	if err != nil {
+		return store.Alert{}, fmt.Errorf("list firing alerts: %w", err)
+	}
+	acked := slices.ContainsFunc(firing, func(a store.Alert) bool { return a.AckToken == token && a.AckedAt != nil })
+
+	now := e.now().Unix()
+	a, err := e.store.AckAlert(ctx, token, now)
+	if err != nil {
+		return store.Alert{}, err
+	}
+	if !acked {
+		e.emit(store.AlertRule{Id: a.RuleId, Name: a.RuleName}, store.AlertAcknowledged, a.Value, now)
+	}
+	return a, nil
+}
+
+// Escalate notifies the escalation steps that are due for every firing,
+// unacknowledged and unsilenced alert. A step that fails to send is logged,
+// kept as a dead letter and skipped so the next channel still gets
+// notified.
+func (e *Engine) Escalate(ctx context.Context) error {
+	if !e.enabled() {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.resolveReboots(ctx); err != nil {
+		return err
+	}
+	return e.escalate(ctx)
+}
+
+// escalate must be called with mu held.
+func (e *Engine) escalate(ctx context.Context) error {
+	firing, err := e.store.ListFiringAlerts(ctx)
+	if err != nil {
+		return fmt.Errorf("list firing alerts: %w", err)
+	}
+	if len(firing) == 0 {
+		return nil
+	}
+	rules, err := e.store.ListAlertRules(ctx)
+	if err != nil {
+		return fmt.Errorf("list alert rules: %w", err)
+	}
+	byId := make(map[int]store.AlertRule, len(rules))
+	for _, r := range rules {
+		byId[r.Id] = r
+	}
+
+	now := e.now().Unix()
+	for _, a := range firing {
+		rule, ok := byId[a.RuleId]
+		if !ok || a.AckedAt != nil || a.Notified >= len(rule.Escalation) {
+			continue
+		}
+		silenced, err := e.Silenced(ctx, rule.Name, rule.Severity, now)
+		if err != nil {
+			return err
+		}
+		if silenced {
+			continue
+		}
+
+		notified := a.Notified
+		for ; notified < len(rule.Escalation); notified++ {
+			step := rule.Escalation[notified]
+			if a.FiredAt+step.AfterSeconds > now {
+				break
+			}
+			e.notify(ctx, step.Channel, rule, a)
+		}
+		if notified != a.Notified {
+			if err := e.store.SetAlertNotified(ctx, a.RuleId, notified); err != nil {
+				return fmt.Errorf("set alert %d notified: %w", a.RuleId, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (e *Engine) notify(ctx context.Context, channel string, rule store.AlertRule, a store.Alert) {
+	if channel == ChannelSMS && rule.Severity != SeverityCritical {
+		e.logger.Warn("sms notifications are only sent for critical rules", "rule", rule.Name)
+		return
+	}
+	n, ok := e.cfg.Notifiers[channel]
+	defaultSubject := fmt.Sprintf("[%s] %s firing", rule.Severity, rule.Name)
+	defaultText := fmt.Sprintf("%s is %g (%s %g) since %s",
+		rule.Field, a.Value, rule.Op, rule.Threshold, time.Unix(a.Since, 0).UTC().Format(time.RFC3339))
+	if a.Device != "" {
+		defaultText = a.Device + ": " + defaultText
+	}
+	m := notify.Message{Subject: defaultSubject, Text: defaultText}
+	if e.cfg.AckURL != "" && a.AckToken != "" {
+		m.AckURL = strings.TrimRight(e.cfg.AckURL, "/") + "/alerts/ack/" + a.AckToken
+	}
+	if tmpl := e.template(rule, channel); tmpl != nil {
+		data := e.templateData(ctx, channel, rule, a)
+		if err := render(tmpl, data, &m.Subject, &m.Text); err != nil {
+			// the built-in message still goes out
+			e.logger.Error("failed to render notification template", "rule", rule.Name, "channel", channel, "error", err)
+			m.Subject, m.Text = defaultSubject, defaultText
+		}
+	}
+	if !ok {
+		e.logger.Error("alert notification channel not configured", "rule", rule.Name, "channel", channel)
+		e.deadLetter(ctx, channel, rule, m, 0, ErrNotConfigured)
+		return
+	}
+	if err := e.send(ctx, channel, n, m); err != nil {
+		e.logger.Error("failed to send alert notification", "rule", rule.Name, "channel", channel, "error", err)
+		e.deadLetter(ctx, channel, rule, m, 1, err)
+		return
+	}
+	e.logger.Info("alert notification sent", "rule", rule.Name, "channel", channel)
+}
+
+// template returns the rule's template for channel, else the global one, or
+// nil for the built-in message.
+func (e *Engine) template(rule store.AlertRule, channel string) *template.Template {
+	if len(rule.Templates) > 0 {
+		t, err := ParseTemplates(rule.Templates)
+		if err != nil {
+			e.logger.Error("invalid rule notification templates", "rule", rule.Name, "error", err)
+		} else if tmpl := t.lookup(channel); tmpl != nil {
+			return tmpl
+		}
+	}
+	return e.cfg.Templates.lookup(channel)
+}
@@ -0,0 +1,157 @@
+package alert
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"gopkg.in/yaml.v3"
+)
+
+// Metrics are the Prometheus gauges holding the newest reading of every
+// device, by rule field. The ingest pipeline exports them.
+var Metrics = map[string]string{
+	"tempCo":   "esp8266_temp_co_celsius",
+	"tempRoom": "esp8266_temp_room_celsius",
+	"humidity": "esp8266_humidity_percent",
+}
+
+// rebootsExpr is FieldReboots in PromQL, over the crash reports counted
+// by the server.
+const rebootsExpr = "sum by (device) (increase(esp8266_device_crashes_total[1h]))"
+
+var promOps = map[string]string{"gt": ">", "gte": ">=", "lt": "<", "lte": "<="}
+
+// defaultReceiver gets the alerts of rules without escalation steps.
+const defaultReceiver = "default"
+
+type promRuleFile struct {
+	Groups []promRuleGroup `yaml:"groups"`
+}
+
+type promRuleGroup struct {
+	Name  string     `yaml:"name"`
+	Rules []promRule `yaml:"rules"`
+}
+
+type promRule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+// PrometheusRules renders the enabled rules as a Prometheus rules file
+// over Metrics. Like the rules here, they fire per device on the newest
+// reading. Alert names are the rule names made valid metric names; the
+// rule_id label tells rules of the same name apart.
+func PrometheusRules(rules []store.AlertRule) ([]byte, error) {
+	group := promRuleGroup{Name: "esp8266-web", Rules: []promRule{}}
+	for _, r := range rules {
+		if !r.Enabled {
+			continue
+		}
+		metric, op := Metrics[r.Field], promOps[r.Op]
+		if r.Field == FieldReboots {
+			metric = rebootsExpr
+		}
+		if metric == "" || op == "" {
+			return nil, fmt.Errorf("rule %d: can't express %s %s in PromQL", r.Id, r.Field, r.Op)
+		}
+		group.Rules = append(group.Rules, promRule{
+			Alert: alertName(r),
+			Expr:  fmt.Sprintf("%s %s %s", metric, op, strconv.FormatFloat(r.Threshold, 'f', -1, 64)),
+			Labels: map[string]string{
+				"severity": r.Severity,
+				"rule_id":  strconv.Itoa(r.Id),
+			},
+			Annotations: map[string]string{
+				"summary":     r.Name,
+				"description": fmt.Sprintf("%s of {{ $labels.device }} is {{ $value }}, %s %s", r.Field, op, strconv.FormatFloat(r.Threshold, 'f', -1, 64)),
+			},
+		})
+	}
+	return marshalYAML(promRuleFile{Groups: []promRuleGroup{group}})
+}
+
+// alertName returns the rule's name as a valid Prometheus alert name,
+// e.g. boiler_hot for "boiler hot".
+func alertName(r store.AlertRule) string {
+	var b strings.Builder
+	for _, c := range r.Name {
+		switch {
+		case c <= unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c)):
+			b.WriteRune(c)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	name := strings.Trim(b.String(), "_")
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		name = "rule_" + name
+	}
+	return name
+}
+
+type amConfig struct {
+	Route     amRoute      `yaml:"route"`
+	Receivers []amReceiver `yaml:"receivers"`
+}
+
+type amRoute struct {
+	Receiver string    `yaml:"receiver"`
+	GroupBy  []string  `yaml:"group_by,omitempty"`
+	Matchers []string  `yaml:"matchers,omitempty"`
+	Continue bool      `yaml:"continue,omitempty"`
+	Routes   []amRoute `yaml:"routes,omitempty"`
+}
+
+type amReceiver struct {
+	Name string `yaml:"name"`
+}
+
+// AlertmanagerRoutes renders an Alertmanager configuration routing the
+// alerts of PrometheusRules to a receiver per escalation channel. Every
+// step of a rule is notified at once, Alertmanager has no escalation
+// delays, and the receivers are left for the user to configure.
+func AlertmanagerRoutes(rules []store.AlertRule) ([]byte, error) {
+	cfg := amConfig{Route: amRoute{Receiver: defaultReceiver, GroupBy: []string{"alertname", "device"}}}
+	receivers := []string{defaultReceiver}
+	for _, r := range rules {
+		if !r.Enabled {
+			continue
+		}
+		for _, step := range r.Escalation {
+			cfg.Route.Routes = append(cfg.Route.Routes, amRoute{
+				Receiver: step.Channel,
+				Matchers: []string{fmt.Sprintf("rule_id=%q", strconv.Itoa(r.Id))},
+				Continue: true,
+			})
+			if !contains(receivers, step.Channel) {
+				receivers = append(receivers, step.Channel)
+			}
+		}
+	}
+	for _, name := range receivers {
+		cfg.Receivers = append(cfg.Receivers, amReceiver{Name: name})
+	}
+	return marshalYAML(cfg)
+}
+
+// marshalYAML encodes v indented by two spaces, like Prometheus' own
+// examples.
+func marshalYAML(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,100 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// FieldReboots is the rule field counting a device's crash reports over
+// the last RebootWindow, e.g. {"field": "reboots", "op": "gt",
+// "threshold": 3} for more than three reboots an hour.
+const FieldReboots = "reboots"
+
+// RebootWindow is the window FieldReboots counts crash reports over.
+const RebootWindow = time.Hour
+
+// EvaluateReboots checks the reboots rules against count, device's crash
+// reports over the last RebootWindow, as a report arrives at ts. Newly
+// fired alerts are notified right away.
+func (e *Engine) EvaluateReboots(ctx context.Context, device string, count int, ts int64) error {
+	if !e.enabled() {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	rules, err := e.store.ListAlertRules(ctx)
+	if err != nil {
+		return fmt.Errorf("list alert rules: %w", err)
+	}
+	firing, err := e.store.ListFiringAlerts(ctx)
+	if err != nil {
+		return fmt.Errorf("list firing alerts: %w", err)
+	}
+	firingDevice := make(map[int]string, len(firing))
+	for _, a := range firing {
+		firingDevice[a.RuleId] = a.Device
+	}
+
+	v := float64(count)
+	fired := false
+	for _, rule := range rules {
+		if rule.Field != FieldReboots {
+			continue
+		}
+		prev, isFiring := firingDevice[rule.Id]
+		// an alert started by another device resolves once that one
+		// stops crashing, in resolveReboots
+		if isFiring && prev != device {
+			continue
+		}
+		f, err := e.transition(ctx, rule, rule.Enabled && Matches(rule, v), isFiring, device, v, ts)
+		if err != nil {
+			return err
+		}
+		fired = fired || f
+	}
+	if fired {
+		return e.escalate(ctx)
+	}
+	return nil
+}
+
+// resolveReboots resolves the reboots alerts of devices whose crash
+// reports over the last RebootWindow no longer match, as no report
+// arrives to do so once a device stops crashing. It must be called with mu
+// held.
+func (e *Engine) resolveReboots(ctx context.Context) error {
+	if e.cfg.Reboots == nil {
+		return nil
+	}
+	firing, err := e.store.ListFiringAlerts(ctx)
+	if err != nil {
+		return fmt.Errorf("list firing alerts: %w", err)
+	}
+	if len(firing) == 0 {
+		return nil
+	}
+	rules, err := e.store.ListAlertRules(ctx)
+	if err != nil {
+		return fmt.Errorf("list alert rules: %w", err)
+	}
+	now := e.now()
+	for _, a := range firing {
+		for _, rule := range rules {
+			if rule.Id != a.RuleId || rule.Field != FieldReboots {
+				continue
+			}
+			count, err := e.cfg.Reboots(ctx, a.Device, now.Add(-RebootWindow).Unix())
+			if err != nil {
+				return fmt.Errorf("count reboots of %s: %w", a.Device, err)
+			}
+			v := float64(count)
+			if _, err := e.transition(ctx, rule, rule.Enabled && Matches(rule, v), true, a.Device, v, now.Unix()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var matcherNames = []string{"rule", "severity"}
+
+// ValidateSilence checks that s has at least one valid matcher and ends after
+// it starts.
+func ValidateSilence(s store.Silence) error {
+	var errs []error
+	if len(s.Matchers) == 0 {
+		errs = append(errs, errors.New("at least one matcher is required"))
+	}
+	for _, m := range s.Matchers {
+		if !contains(matcherNames, m.Name) {
+			errs = append(errs, fmt.Errorf("matcher name must be one of %s", strings.Join(matcherNames, ", ")))
+		}
+		if m.IsRegex {
+			if _, err := regexp.Compile(m.Value); err != nil {
+				errs = append(errs, fmt.Errorf("matcher %s: %w", m.Name, err))
+			}
+		}
+	}
+	if s.EndsAt <= s.StartsAt {
+		errs = append(errs, errors.New("silence must end after it starts"))
+	}
+	return errors.Join(errs...)
+}
+
+func labels(ruleName, severity string) map[string]string {
+	return map[string]string{"rule": ruleName, "severity": severity}
+}
+
+// SilenceMatches reports whether s mutes an alert of the named rule at now.
+func SilenceMatches(s store.Silence, ruleName, severity string, now int64) bool {
+	if now < s.StartsAt || now >= s.EndsAt {
+		return false
+	}
+	l := labels(ruleName, severity)
+	for _, m := range s.Matchers {
+		v := l[m.Name]
+		if m.IsRegex {
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil || !re.MatchString(v) {
+				return false
+			}
+		} else if v != m.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// Silenced reports whether an active silence mutes alerts of the named rule.
+func (e *Engine) Silenced(ctx context.Context, ruleName, severity string, now int64) (bool, error) {
+	silences, err := e.store.ListActiveSilences(ctx, now)
+	if err != nil {
+		return false, fmt.Errorf("list silences: %w", err)
+	}
+	for _, s := range silences {
+		if SilenceMatches(s, ruleName, severity, now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,147 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+// DefaultTemplate is the template key applying to every channel without its
+// own template.
+const DefaultTemplate = "default"
+
+// statsWindow is the period TemplateData.Stats cover.
+const statsWindow = time.Hour
+
+// maxStatsReadings caps the readings loaded for TemplateData.Stats.
+const maxStatsReadings = 5000
+
+// Templates are parsed notification templates keyed by channel name or
+// DefaultTemplate. A template renders the message body; it may also
+// {{define "subject"}} to replace the subject, which SMS sends on its own.
+type Templates map[string]*template.Template
+
+// TemplateData is what notification templates are executed with.
+type TemplateData struct {
+	Channel string
+	Rule    store.AlertRule
+	Alert   store.Alert
+	// Device sent the reading that started the alert, when known.
+	Device string
+	// Reading is the newest stored reading, nil when unknown.
+	Reading *store.TemperatureReading
+	// Stats summarize the rule's field over the last hour.
+	Stats Stats
+}
+
+type Stats struct {
+	Window time.Duration
+	Count  int
+	Min    float64
+	Max    float64
+	Avg    float64
+}
+
+var templateFuncs = template.FuncMap{
+	// unixTime turns a unix timestamp into a time.Time, e.g.
+	// {{(unixTime .Alert.Since).Format "15:04"}}
+	"unixTime": func(ts int64) time.Time { return time.Unix(ts, 0).UTC() },
+}
+
+// ParseTemplates parses notification template sources by key, checking the
+// keys are channel names or DefaultTemplate.
+func ParseTemplates(src map[string]string) (Templates, error) {
+	t := make(Templates, len(src))
+	for _, key := range slices.Sorted(maps.Keys(src)) {
+		if key != DefaultTemplate && !contains(Channels, key) {
+			return nil, fmt.Errorf("template %q: key must be %s or one of %s", key, DefaultTemplate, strings.Join(Channels, ", "))
+		}
+		tmpl, err := template.New(key).Funcs(templateFuncs).Option("missingkey=error").Parse(src[key])
+		if err != nil {
+			return nil, fmt.Errorf("template %q: %w", key, err)
+		}
+		t[key] = tmpl
+	}
+	return t, nil
+}
+
+// lookup returns the template for channel, falling back to DefaultTemplate.
+func (t Templates) lookup(channel string) *template.Template {
+	if tmpl, ok := t[channel]; ok {
+		return tmpl
+	}
+	return t[DefaultTemplate]
+}
+
+// SetTemplates replaces the global notification templates, which rule
+// templates take precedence over.
+func (e *Engine) SetTemplates(t Templates) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cfg.Templates = t
+}
+
+// templateData gathers the context available to templates. Readings that
+// can't be loaded leave Reading and Stats empty.
+func (e *Engine) templateData(ctx context.Context, channel string, rule store.AlertRule, a store.Alert) TemplateData {
+	data := TemplateData{Channel: channel, Rule: rule, Alert: a, Device: a.Device, Stats: Stats{Window: statsWindow}}
+	if e.cfg.Readings == nil {
+		return data
+	}
+	readings, err := e.cfg.Readings.ListReadings(ctx, maxStatsReadings, 0)
+	if err != nil {
+		e.logger.Error("failed to load readings for notification", "rule", rule.Name, "error", err)
+		return data
+	}
+	if len(readings) == 0 {
+		return data
+	}
+	data.Reading = &readings[0]
+	if rule.Field == FieldReboots {
+		return data
+	}
+
+	cutoff := e.now().Add(-statsWindow).Unix()
+	var sum float64
+	for _, r := range readings {
+		if r.Timestamp == nil || *r.Timestamp < cutoff {
+			continue
+		}
+		v := Value(r, rule.Field)
+		if data.Stats.Count == 0 || v < data.Stats.Min {
+			data.Stats.Min = v
+		}
+		if data.Stats.Count == 0 || v > data.Stats.Max {
+			data.Stats.Max = v
+		}
+		sum += v
+		data.Stats.Count++
+	}
+	if data.Stats.Count > 0 {
+		data.Stats.Avg = sum / float64(data.Stats.Count)
+	}
+	return data
+}
+
+// render executes tmpl into the message subject and text.
+func render(tmpl *template.Template, data TemplateData, subject *string, text *string) error {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return err
+	}
+	*text = strings.TrimSpace(b.String())
+	if s := tmpl.Lookup("subject"); s != nil {
+		b.Reset()
+		if err := s.Execute(&b, data); err != nil {
+			return err
+		}
+		*subject = strings.TrimSpace(b.String())
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+//go:build bacnet
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/bartosz121/esp8266-web/bacnet"
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+// serveBACnet serves the temperatures of the locations as BACnet/IP analog
+// inputs until ctx is done.
+func (c *config) serveBACnet(ctx context.Context, logger *slog.Logger, db store.Store, socks *sockets) error {
+	bs, ok := db.(bacnet.Store)
+	if !ok {
+		return fmt.Errorf("bacnet is not supported by db driver %q", c.dbDriver)
+	}
+	if c.bacnetDeviceID == 0 || c.bacnetDeviceID >= 0x3fffff {
+		return fmt.Errorf("bacnet device id %d out of range, want 1 to 4194302", c.bacnetDeviceID)
+	}
+	server := bacnet.New(bs, bacnet.Config{DeviceInstance: uint32(c.bacnetDeviceID), Logger: logger})
+	conn, err := socks.ListenPacket("udp", c.bacnetAddr)
+	if err != nil {
+		return fmt.Errorf("bacnet listen: %w", err)
+	}
+	go func() {
+		if err := server.Serve(ctx, conn); err != nil {
+			logger.Error("bacnet server stopped", "error", err)
+		}
+	}()
+	logger.Info("serving location temperatures over bacnet/ip", "addr", c.bacnetAddr, "device", c.bacnetDeviceID)
+	return nil
+}
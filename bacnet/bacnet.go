@@ -0,0 +1,799 @@
+// Package bacnet serves the average temperature of every location as a
+// read-only BACnet/IP analog-input object, for HVAC controllers that
+// consume BACnet and nothing else.
+//
+// The server is a BACnet device whose analog inputs are the locations, the
+// instance of each being the location's id and its name the path of
+// location names, e.g. "Home/Ground floor/Kitchen". The present value is
+// the average tempRoom, in degrees Celsius, of the latest readings no older
+// than Config.MaxAge of the devices placed in the location or its
+// descendants, refreshed every Config.Interval. A location without such
+// readings reports the fault status flag.
+//
+// Who-Is, ReadProperty and ReadPropertyMultiple are answered; writes are
+// denied and segmentation isn't supported.
+package bacnet
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// DefaultPort is the BACnet/IP UDP port, 0xBAC0.
+	DefaultPort = 47808
+	// DefaultDeviceInstance is the device instance unless configured; it
+	// must be unique on the BACnet network.
+	DefaultDeviceInstance = 8266
+	// DefaultInterval between refreshes of the present values.
+	DefaultInterval = 30 * time.Second
+	// DefaultMaxAge is how old a reading may be to count towards an
+	// average, as for location summaries.
+	DefaultMaxAge = time.Hour
+
+	// maxInstance is the largest object instance, which addresses the
+	// device object of whoever is asked when its type is device.
+	maxInstance = 0x3fffff
+	// vendorID isn't a vendor registered with ASHRAE.
+	vendorID = 999
+	// maxAPDU is the largest APDU accepted and sent.
+	maxAPDU = 1476
+
+	objectAnalogInput = 0
+	objectDevice      = 8
+
+	bvlcType            = 0x81
+	bvlcForwardedNPDU   = 0x04
+	bvlcUnicastNPDU     = 0x0a
+	bvlcBroadcastNPDU   = 0x0b
+	npduVersion         = 0x01
+	pduConfirmed        = 0x0
+	pduUnconfirmed      = 0x1
+	pduComplexAck       = 0x3
+	pduError            = 0x5
+	pduReject           = 0x6
+	pduAbort            = 0x7
+	serviceIAm          = 0
+	serviceWhoIs        = 8
+	serviceReadProperty = 12
+	serviceReadMultiple = 14
+	serviceWrite        = 15
+	serviceWriteMulti   = 16
+
+	rejectInvalidTag       = 4
+	rejectMissingParameter = 5
+	rejectUnrecognized     = 9
+	abortSegmentation      = 4
+
+	errClassObject        = 1
+	errClassProperty      = 2
+	errUnknownObject      = 31
+	errUnknownProperty    = 32
+	errWriteAccessDenied  = 40
+	errInvalidArrayIndex  = 42
+	errPropertyNotAnArray = 50
+)
+
+// Property identifiers.
+const (
+	propAll                   = 8
+	propAPDUTimeout           = 11
+	propSoftwareVersion       = 12
+	propDescription           = 28
+	propDeviceAddressBinding  = 30
+	propEventState            = 36
+	propFirmwareRevision      = 44
+	propMaxAPDU               = 62
+	propModelName             = 70
+	propAPDURetries           = 73
+	propObjectIdentifier      = 75
+	propObjectList            = 76
+	propObjectName            = 77
+	propObjectType            = 79
+	propOptional              = 80
+	propOutOfService          = 81
+	propPresentValue          = 85
+	propObjectTypesSupported  = 96
+	propServicesSupported     = 97
+	propProtocolVersion       = 98
+	propReliability           = 103
+	propRequired              = 105
+	propSegmentationSupported = 107
+	propStatusFlags           = 111
+	propSystemStatus          = 112
+	propUnits                 = 117
+	propVendorIdentifier      = 120
+	propVendorName            = 121
+	propProtocolRevision      = 139
+	propDatabaseRevision      = 155
+	propPropertyList          = 371
+)
+
+// Values of enumerated and bit string properties.
+const (
+	unitsDegreesCelsius      = 62
+	reliabilityNoFault       = 0
+	reliabilityNoSensor      = 1
+	reliabilityCommunication = 12
+	segmentationNotSupported = 3
+	statusFlagFault          = 1
+	statusFlagsBits          = 4
+	// services are bits of the services supported by their number among
+	// all services, confirmed and unconfirmed
+	servicesSupportedBits = 41
+	supportsReadProperty  = 12
+	supportsReadMultiple  = 14
+	supportsIAm           = 26
+	supportsWhoIs         = 34
+	objectTypesSupported  = 60
+	protocolRevision      = 14
+)
+
+// apduSizes are the maximum APDU sizes a request may accept, by the code it
+// sends.
+var apduSizes = []int{50, 128, 206, 480, 1024, 1476}
+
+var requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "esp8266_bacnet_requests_total",
+	Help: "BACnet requests by result: ok, error, reject, abort or invalid.",
+}, []string{"result"})
+
+// Store is what the server reads locations and readings from.
+type Store interface {
+	store.LocationStore
+	store.FilterStore
+}
+
+type Config struct {
+	// DeviceInstance defaults to DefaultDeviceInstance.
+	DeviceInstance uint32
+	// DeviceName defaults to esp8266-web-<instance>.
+	DeviceName string
+	// Interval defaults to DefaultInterval.
+	Interval time.Duration
+	// MaxAge defaults to DefaultMaxAge.
+	MaxAge time.Duration
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// ObjectID identifies a BACnet object.
+type ObjectID struct {
+	Type     uint16
+	Instance uint32
+}
+
+func (id ObjectID) bytes() []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(id.Type)<<22|id.Instance&maxInstance)
+}
+
+// Input is the analog input of a location.
+type Input struct {
+	Location int
+	Name     string
+	Kind     string
+	// Devices is how many devices are in the location, Readings how many
+	// of their readings Value averages.
+	Devices  int
+	Readings int
+	Value    float32
+}
+
+// Server answers BACnet/IP requests from the inputs of the last refresh.
+type Server struct {
+	store  Store
+	cfg    Config
+	logger *slog.Logger
+	now    func() time.Time
+
+	mu       sync.RWMutex
+	inputs   []Input
+	revision uint32
+}
+
+// property is a value of an object; array is set for array properties,
+// whose value is the concatenation of its elements.
+type property struct {
+	id       uint32
+	optional bool
+	value    []byte
+	array    [][]byte
+}
+
+type object struct {
+	id    ObjectID
+	props []property
+}
+
+// serviceError is the error class and code a confirmed request fails with.
+type serviceError struct {
+	class, code uint32
+}
+
+func New(st Store, cfg Config) *Server {
+	if cfg.DeviceInstance == 0 {
+		cfg.DeviceInstance = DefaultDeviceInstance
+	}
+	if cfg.DeviceName == "" {
+		cfg.DeviceName = fmt.Sprintf("esp8266-web-%d", cfg.DeviceInstance)
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = DefaultMaxAge
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return &Server{store: st, cfg: cfg, logger: cfg.Logger, now: time.Now}
+}
+
+// Refresh recomputes the inputs from the locations and their devices'
+// latest readings.
+func (s *Server) Refresh(ctx context.Context) error {
+	locations, err := s.store.ListLocations(ctx)
+	if err != nil {
+		return fmt.Errorf("list locations: %w", err)
+	}
+	since := s.now().Add(-s.cfg.MaxAge).Unix()
+	latest := make(map[string]*store.TemperatureReading)
+	inputs := make([]Input, 0, len(locations))
+	for _, l := range locations {
+		if l.Id < 0 || l.Id >= maxInstance {
+			continue
+		}
+		in := Input{Location: l.Id, Name: locationPath(locations, l), Kind: l.Kind}
+		var sum float64
+		for _, device := range subtreeDevices(locations, l.Id) {
+			in.Devices++
+			r, ok := latest[device]
+			if !ok {
+				readings, err := s.store.ListFilteredReadings(ctx, store.ReadingQuery{Devices: []string{device}}, 1, 0)
+				if err != nil {
+					return fmt.Errorf("latest reading of %s: %w", device, err)
+				}
+				if len(readings) > 0 && readings[0].Timestamp != nil && *readings[0].Timestamp >= since {
+					r = &readings[0]
+				}
+				latest[device] = r
+			}
+			if r != nil {
+				in.Readings++
+				sum += r.TempRoom
+			}
+		}
+		if in.Readings > 0 {
+			in.Value = float32(sum / float64(in.Readings))
+		}
+		inputs = append(inputs, in)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// controllers cache the object list until the database revision changes
+	same := slices.EqualFunc(s.inputs, inputs, func(a, b Input) bool {
+		return a.Location == b.Location && a.Name == b.Name && a.Kind == b.Kind
+	})
+	if !same {
+		s.revision++
+	}
+	s.inputs = inputs
+	return nil
+}
+
+// Inputs returns the inputs of the last refresh.
+func (s *Server) Inputs() []Input {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.inputs)
+}
+
+// locationPath returns the names of l and its ancestors, outermost first,
+// joined by slashes.
+func locationPath(locations []store.Location, l store.Location) string {
+	names := []string{l.Name}
+	for seen := 0; l.ParentId != nil && seen < len(locations); seen++ {
+		i := slices.IndexFunc(locations, func(p store.Location) bool { return p.Id == *l.ParentId })
+		if i < 0 {
+			break
+		}
+		l = locations[i]
+		names = append(names, l.Name)
+	}
+	slices.Reverse(names)
+	return strings.Join(names, "/")
+}
+
+// subtreeDevices returns the devices placed in the location id and its
+// descendants.
+func subtreeDevices(locations []store.Location, id int) []string {
+	var devices []string
+	ids := []int{id}
+	for seen := 0; len(ids) > 0 && seen <= len(locations); seen++ {
+		id, ids = ids[0], ids[1:]
+		for _, l := range locations {
+			if l.Id == id {
+				devices = append(devices, l.Devices...)
+			}
+			if l.ParentId != nil && *l.ParentId == id {
+				ids = append(ids, l.Id)
+			}
+		}
+	}
+	slices.Sort(devices)
+	return slices.Compact(devices)
+}
+
+// ListenAndServe serves BACnet/IP over UDP on addr until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("bacnet listen: %w", err)
+	}
+	return s.Serve(ctx, conn)
+}
+
+// Serve answers the requests received on conn and refreshes the inputs
+// every Config.Interval until ctx is done.
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	go s.refreshLoop(ctx)
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("bacnet read: %w", err)
+		}
+		to, resp, err := s.respond(buf[:n], addr)
+		if err != nil {
+			requestsTotal.WithLabelValues("invalid").Inc()
+			s.logger.Debug("invalid bacnet request", "remote", addr.String(), "error", err)
+			continue
+		}
+		if resp == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(resp, to); err != nil {
+			s.logger.Debug("failed to answer bacnet request", "remote", to.String(), "error", err)
+		}
+	}
+}
+
+func (s *Server) refreshLoop(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Refresh(ctx); err != nil && ctx.Err() == nil {
+			s.logger.Error("failed to refresh bacnet inputs", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// respond returns the response to a BACnet/IP message from addr and where
+// to send it, nil when there is none.
+func (s *Server) respond(msg []byte, addr net.Addr) (net.Addr, []byte, error) {
+	if len(msg) < 4 || msg[0] != bvlcType || int(binary.BigEndian.Uint16(msg[2:])) != len(msg) {
+		return nil, nil, errors.New("not a BACnet/IP message")
+	}
+	npdu := msg[4:]
+	switch msg[1] {
+	case bvlcUnicastNPDU, bvlcBroadcastNPDU:
+	case bvlcForwardedNPDU:
+		// a broadcast forwarded by a BBMD, answered to the original sender
+		if len(npdu) < 6 {
+			return nil, nil, errors.New("truncated forwarded NPDU")
+		}
+		ip, _ := netip.AddrFromSlice(npdu[:4])
+		addr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(npdu[4:])))
+		npdu = npdu[6:]
+	default:
+		// BVLC control functions are left to a BBMD
+		return nil, nil, nil
+	}
+
+	apdu, route, ok, err := readNPDU(npdu)
+	if err != nil || !ok {
+		return nil, nil, err
+	}
+	resp, err := s.apdu(apdu)
+	if err != nil || resp == nil {
+		return nil, nil, err
+	}
+	out := slices.Concat([]byte{bvlcType, bvlcUnicastNPDU, 0, 0}, encodeNPDU(route), resp)
+	binary.BigEndian.PutUint16(out[2:], uint16(len(out)))
+	return addr, out, nil
+}
+
+// route is the remote network and address of a routed request, which its
+// response is sent back to.
+type route struct {
+	network uint16
+	address []byte
+}
+
+// readNPDU returns the APDU of an NPDU and the route of its sender when it
+// came through a router. ok is false for network layer messages and ones
+// for other networks.
+func readNPDU(b []byte) (apdu []byte, r *route, ok bool, err error) {
+	if len(b) < 2 || b[0] != npduVersion {
+		return nil, nil, false, errors.New("invalid NPDU")
+	}
+	control, b := b[1], b[2:]
+	if control&0x80 != 0 {
+		return nil, nil, false, nil
+	}
+	readAddress := func() (uint16, []byte, error) {
+		if len(b) < 3 || len(b) < 3+int(b[2]) {
+			return 0, nil, errors.New("truncated NPDU address")
+		}
+		network, address := binary.BigEndian.Uint16(b), b[3:3+int(b[2])]
+		b = b[3+int(b[2]):]
+		return network, address, nil
+	}
+	destination := uint16(0)
+	if control&0x20 != 0 {
+		if destination, _, err = readAddress(); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	if control&0x08 != 0 {
+		network, address, err := readAddress()
+		if err != nil {
+			return nil, nil, false, err
+		}
+		r = &route{network: network, address: slices.Clone(address)}
+	}
+	if control&0x20 != 0 {
+		if len(b) == 0 {
+			return nil, nil, false, errors.New("truncated NPDU hop count")
+		}
+		b = b[1:]
+	}
+	if destination != 0 && destination != 0xffff {
+		return nil, nil, false, nil
+	}
+	return b, r, true, nil
+}
+
+// encodeNPDU returns the NPDU header of a message to r, on the local
+// network when nil.
+func encodeNPDU(r *route) []byte {
+	if r == nil {
+		return []byte{npduVersion, 0}
+	}
+	b := binary.BigEndian.AppendUint16([]byte{npduVersion, 0x20}, r.network)
+	b = append(b, byte(len(r.address)))
+	b = append(b, r.address...)
+	return append(b, 0xff)
+}
+
+// apdu returns the response APDU to a request APDU, nil when there is none.
+func (s *Server) apdu(b []byte) ([]byte, error) {
+	if len(b) < 2 {
+		return nil, errors.New("truncated APDU")
+	}
+	switch b[0] >> 4 {
+	case pduUnconfirmed:
+		if b[1] != serviceWhoIs {
+			return nil, nil
+		}
+		return s.whoIs(b[2:])
+	case pduConfirmed:
+	default:
+		return nil, nil
+	}
+	if len(b) < 4 {
+		return nil, errors.New("truncated APDU")
+	}
+	invokeID := b[2]
+	if b[0]&0x08 != 0 {
+		requestsTotal.WithLabelValues("abort").Inc()
+		return []byte{pduAbort<<4 | 1, invokeID, abortSegmentation}, nil
+	}
+	service, params := b[3], b[4:]
+	var (
+		resp   []byte
+		reject byte
+		svcErr *serviceError
+	)
+	switch service {
+	case serviceReadProperty:
+		resp, svcErr, reject = s.readProperty(params)
+	case serviceReadMultiple:
+		resp, reject = s.readPropertyMultiple(params)
+	case serviceWrite, serviceWriteMulti:
+		svcErr = &serviceError{errClassProperty, errWriteAccessDenied}
+	default:
+		reject = rejectUnrecognized
+	}
+	switch {
+	case reject != 0:
+		requestsTotal.WithLabelValues("reject").Inc()
+		return []byte{pduReject << 4, invokeID, reject}, nil
+	case svcErr != nil:
+		requestsTotal.WithLabelValues("error").Inc()
+		return slices.Concat([]byte{pduError << 4, invokeID, service}, encodeEnumerated(svcErr.class), encodeEnumerated(svcErr.code)), nil
+	}
+	resp = append([]byte{pduComplexAck << 4, invokeID, service}, resp...)
+	if size := int(b[1] & 0x0f); size >= len(apduSizes) || len(resp) > apduSizes[size] {
+		requestsTotal.WithLabelValues("abort").Inc()
+		return []byte{pduAbort<<4 | 1, invokeID, abortSegmentation}, nil
+	}
+	requestsTotal.WithLabelValues("ok").Inc()
+	return resp, nil
+}
+
+// whoIs returns an I-Am when the device instance is within the request's
+// range, or it has none.
+func (s *Server) whoIs(params []byte) ([]byte, error) {
+	if len(params) > 0 {
+		low, rest, err := readTag(params)
+		if err != nil {
+			return nil, err
+		}
+		high, _, err := readTag(rest)
+		if err != nil {
+			return nil, err
+		}
+		lo, err1 := low.unsigned()
+		hi, err2 := high.unsigned()
+		if err := errors.Join(err1, err2); err != nil {
+			return nil, err
+		}
+		if s.cfg.DeviceInstance < lo || s.cfg.DeviceInstance > hi {
+			return nil, nil
+		}
+	}
+	requestsTotal.WithLabelValues("ok").Inc()
+	return slices.Concat(
+		[]byte{pduUnconfirmed << 4, serviceIAm},
+		encodeObjectID(ObjectID{objectDevice, s.cfg.DeviceInstance}),
+		encodeUnsigned(maxAPDU),
+		encodeEnumerated(segmentationNotSupported),
+		encodeUnsigned(vendorID),
+	), nil
+}
+
+// readProperty answers a ReadProperty request.
+func (s *Server) readProperty(params []byte) ([]byte, *serviceError, byte) {
+	id, prop, index, rest, reject := readPropertyReference(params, true)
+	if reject != 0 {
+		return nil, nil, reject
+	}
+	if len(rest) > 0 {
+		return nil, nil, rejectInvalidTag
+	}
+	value, svcErr := s.read(id, prop, index)
+	if svcErr != nil {
+		return nil, svcErr, 0
+	}
+	resp := slices.Concat(encodeTag(0, true, id.bytes()), encodeTag(1, true, unsignedBytes(prop)))
+	if index != nil {
+		resp = append(resp, encodeTag(2, true, unsignedBytes(*index))...)
+	}
+	return slices.Concat(resp, openingTag(3), value, closingTag(3)), nil, 0
+}
+
+// readPropertyMultiple answers a ReadPropertyMultiple request, the errors
+// of properties that can't be read among the results.
+func (s *Server) readPropertyMultiple(params []byte) ([]byte, byte) {
+	var resp []byte
+	if len(params) == 0 {
+		return nil, rejectMissingParameter
+	}
+	for len(params) > 0 {
+		t, rest, err := readTag(params)
+		if err != nil || !t.context || t.number != 0 {
+			return nil, rejectInvalidTag
+		}
+		id, err := t.objectID()
+		if err != nil {
+			return nil, rejectInvalidTag
+		}
+		if t, rest, err = readTag(rest); err != nil || !t.opening || t.number != 1 {
+			return nil, rejectInvalidTag
+		}
+		resp = slices.Concat(resp, encodeTag(0, true, id.bytes()), openingTag(1))
+		obj, found := s.object(id)
+		for {
+			t, after, err := readTag(rest)
+			if err != nil {
+				return nil, rejectInvalidTag
+			}
+			if t.closing && t.number == 1 {
+				rest = after
+				break
+			}
+			_, prop, index, after, reject := readPropertyReference(rest, false)
+			if reject != 0 {
+				return nil, reject
+			}
+			rest = after
+
+			props := []uint32{prop}
+			if found && (prop == propAll || prop == propRequired || prop == propOptional) {
+				props = props[:0]
+				for _, p := range obj.props {
+					if prop == propAll || p.optional == (prop == propOptional) {
+						props = append(props, p.id)
+					}
+				}
+			}
+			for _, prop := range props {
+				resp = append(resp, encodeTag(2, true, unsignedBytes(prop))...)
+				if index != nil {
+					resp = append(resp, encodeTag(3, true, unsignedBytes(*index))...)
+				}
+				value, svcErr := s.read(id, prop, index)
+				if svcErr != nil {
+					resp = slices.Concat(resp, openingTag(5), encodeEnumerated(svcErr.class), encodeEnumerated(svcErr.code), closingTag(5))
+				} else {
+					resp = slices.Concat(resp, openingTag(4), value, closingTag(4))
+				}
+			}
+		}
+		resp = append(resp, closingTag(1)...)
+		params = rest
+	}
+	return resp, 0
+}
+
+// readPropertyReference decodes an object identifier, when withObject, a
+// property identifier and an optional array index, the context tags of a
+// ReadProperty request and of the property references of a
+// ReadPropertyMultiple one.
+func readPropertyReference(b []byte, withObject bool) (id ObjectID, prop uint32, index *uint32, rest []byte, reject byte) {
+	var number byte
+	if withObject {
+		t, after, err := readTag(b)
+		if err != nil || !t.context || t.number != 0 {
+			return id, 0, nil, nil, rejectMissingParameter
+		}
+		if id, err = t.objectID(); err != nil {
+			return id, 0, nil, nil, rejectInvalidTag
+		}
+		b, number = after, 1
+	}
+	t, rest, err := readTag(b)
+	if err != nil || !t.context || t.number != number {
+		return id, 0, nil, nil, rejectMissingParameter
+	}
+	if prop, err = t.unsigned(); err != nil {
+		return id, 0, nil, nil, rejectInvalidTag
+	}
+	if len(rest) > 0 {
+		if t, after, err := readTag(rest); err == nil && t.context && !t.closing && t.number == number+1 {
+			i, err := t.unsigned()
+			if err != nil {
+				return id, 0, nil, nil, rejectInvalidTag
+			}
+			index, rest = &i, after
+		}
+	}
+	return id, prop, index, rest, 0
+}
+
+// read returns the encoded value of a property, the element at index of an
+// array one unless nil.
+func (s *Server) read(id ObjectID, prop uint32, index *uint32) ([]byte, *serviceError) {
+	obj, ok := s.object(id)
+	if !ok {
+		return nil, &serviceError{errClassObject, errUnknownObject}
+	}
+	i := slices.IndexFunc(obj.props, func(p property) bool { return p.id == prop })
+	if i < 0 {
+		return nil, &serviceError{errClassProperty, errUnknownProperty}
+	}
+	p := obj.props[i]
+	switch {
+	case index == nil:
+		return p.value, nil
+	case p.array == nil:
+		return nil, &serviceError{errClassProperty, errPropertyNotAnArray}
+	case *index == 0:
+		return encodeUnsigned(uint32(len(p.array))), nil
+	case int(*index) > len(p.array):
+		return nil, &serviceError{errClassProperty, errInvalidArrayIndex}
+	}
+	return p.array[*index-1], nil
+}
+
+// object returns the object id, with its current property values.
+func (s *Server) object(id ObjectID) (object, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if id.Type == objectDevice && (id.Instance == s.cfg.DeviceInstance || id.Instance == maxInstance) {
+		return s.device(), true
+	}
+	if id.Type != objectAnalogInput {
+		return object{}, false
+	}
+	i := slices.IndexFunc(s.inputs, func(in Input) bool { return uint32(in.Location) == id.Instance })
+	if i < 0 {
+		return object{}, false
+	}
+	in := s.inputs[i]
+	reliability, flags := uint32(reliabilityNoFault), []int(nil)
+	switch {
+	case in.Devices == 0:
+		reliability, flags = reliabilityNoSensor, []int{statusFlagFault}
+	case in.Readings == 0:
+		reliability, flags = reliabilityCommunication, []int{statusFlagFault}
+	}
+	return newObject(ObjectID{objectAnalogInput, uint32(in.Location)}, in.Name,
+		property{id: propPresentValue, value: encodeReal(in.Value)},
+		property{id: propDescription, optional: true, value: encodeString(in.Kind)},
+		property{id: propStatusFlags, value: encodeBits(statusFlagsBits, flags...)},
+		property{id: propEventState, value: encodeEnumerated(0)},
+		property{id: propReliability, optional: true, value: encodeEnumerated(reliability)},
+		property{id: propOutOfService, value: encodeBoolean(false)},
+		property{id: propUnits, value: encodeEnumerated(unitsDegreesCelsius)},
+	), true
+}
+
+// device returns the device object; s.mu must be held.
+func (s *Server) device() object {
+	id := ObjectID{objectDevice, s.cfg.DeviceInstance}
+	objects := [][]byte{encodeObjectID(id)}
+	for _, in := range s.inputs {
+		objects = append(objects, encodeObjectID(ObjectID{objectAnalogInput, uint32(in.Location)}))
+	}
+	return newObject(id, s.cfg.DeviceName,
+		property{id: propSystemStatus, value: encodeEnumerated(0)},
+		property{id: propVendorName, value: encodeString("esp8266-web")},
+		property{id: propVendorIdentifier, value: encodeUnsigned(vendorID)},
+		property{id: propModelName, value: encodeString("esp8266-web")},
+		property{id: propFirmwareRevision, value: encodeString("1")},
+		property{id: propSoftwareVersion, value: encodeString("1")},
+		property{id: propProtocolVersion, value: encodeUnsigned(1)},
+		property{id: propProtocolRevision, value: encodeUnsigned(protocolRevision)},
+		property{id: propServicesSupported, value: encodeBits(servicesSupportedBits, supportsReadProperty, supportsReadMultiple, supportsIAm, supportsWhoIs)},
+		property{id: propObjectTypesSupported, value: encodeBits(objectTypesSupported, objectAnalogInput, objectDevice)},
+		property{id: propObjectList, value: slices.Concat(objects...), array: objects},
+		property{id: propMaxAPDU, value: encodeUnsigned(maxAPDU)},
+		property{id: propSegmentationSupported, value: encodeEnumerated(segmentationNotSupported)},
+		property{id: propAPDUTimeout, value: encodeUnsigned(3000)},
+		property{id: propAPDURetries, value: encodeUnsigned(3)},
+		property{id: propDeviceAddressBinding, value: []byte{}},
+		property{id: propDatabaseRevision, value: encodeUnsigned(s.revision)},
+	)
+}
+
+// newObject returns the object with the properties every object has
+// followed by props.
+func newObject(id ObjectID, name string, props ...property) object {
+	list := make([][]byte, len(props))
+	for i, p := range props {
+		list[i] = encodeEnumerated(p.id)
+	}
+	return object{id: id, props: append([]property{
+		{id: propObjectIdentifier, value: encodeObjectID(id)},
+		{id: propObjectName, value: encodeString(name)},
+		{id: propObjectType, value: encodeEnumerated(uint32(id.Type))},
+		{id: propPropertyList, value: slices.Concat(list...), array: list},
+	}, props...)}
+}
@@ -0,0 +1,152 @@
+package bacnet
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	house, err := st.CreateLocation(ctx, store.Location{Name: "Home", Kind: store.LocationHouse})
+	require.NoError(t, err)
+	kitchen, err := st.CreateLocation(ctx, store.Location{Name: "Kitchen", Kind: store.LocationRoom, ParentId: &house.Id, Devices: []string{"k1", "k2"}})
+	require.NoError(t, err)
+	attic, err := st.CreateLocation(ctx, store.Location{Name: "Attic", Kind: store.LocationRoom, ParentId: &house.Id, Devices: []string{"a1"}})
+	require.NoError(t, err)
+	empty, err := st.CreateLocation(ctx, store.Location{Name: "Shed", Kind: store.LocationHouse})
+	require.NoError(t, err)
+	now := time.Now().Unix()
+	for _, r := range []store.TemperatureReading{
+		{Device: "k1", TempRoom: 20, Timestamp: &now},
+		{Device: "k2", TempRoom: 22.5, Timestamp: &now},
+		// too old to count
+		{Device: "a1", TempRoom: 5, Timestamp: ptr(now - 7200)},
+	} {
+		_, err := st.InsertReading(ctx, r)
+		require.NoError(t, err)
+	}
+
+	s := New(st, Config{DeviceInstance: 1234})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.Serve(ctx, conn)
+	require.Eventually(t, func() bool { return len(s.Inputs()) == 4 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []Input{
+		{Location: house.Id, Name: "Home", Kind: store.LocationHouse, Devices: 3, Readings: 2, Value: 21.25},
+		{Location: kitchen.Id, Name: "Home/Kitchen", Kind: store.LocationRoom, Devices: 2, Readings: 2, Value: 21.25},
+		{Location: attic.Id, Name: "Home/Attic", Kind: store.LocationRoom, Devices: 1},
+		{Location: empty.Id, Name: "Shed", Kind: store.LocationHouse},
+	}, s.Inputs())
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	request := func(apdu ...byte) []byte {
+		msg := append([]byte{bvlcType, bvlcUnicastNPDU, 0, 0, npduVersion, 0x04}, apdu...)
+		binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+		_, err := client.Write(msg)
+		require.NoError(t, err)
+		require.NoError(t, client.SetReadDeadline(time.Now().Add(time.Second)))
+		buf := make([]byte, 1500)
+		n, err := client.Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, []byte{bvlcType, bvlcUnicastNPDU}, buf[:2])
+		require.Equal(t, []byte{npduVersion, 0}, buf[4:6])
+		return buf[6:n]
+	}
+	readProperty := func(id ObjectID, prop byte) []byte {
+		return request(concat(
+			[]byte{pduConfirmed << 4, 0x05, 0x01, serviceReadProperty},
+			encodeTag(0, true, id.bytes()),
+			encodeTag(1, true, []byte{prop}),
+		)...)
+	}
+
+	// Who-Is without a range, as a controller discovering devices sends it
+	assert.Equal(t, concat(
+		[]byte{pduUnconfirmed << 4, serviceIAm},
+		encodeObjectID(ObjectID{objectDevice, 1234}),
+		encodeUnsigned(maxAPDU), encodeEnumerated(segmentationNotSupported), encodeUnsigned(vendorID),
+	), request(pduUnconfirmed<<4, serviceWhoIs))
+
+	kitchenID := ObjectID{objectAnalogInput, uint32(kitchen.Id)}
+	resp := readProperty(kitchenID, propPresentValue)
+	assert.Equal(t, concat(
+		[]byte{pduComplexAck << 4, 0x01, serviceReadProperty},
+		encodeTag(0, true, kitchenID.bytes()), encodeTag(1, true, []byte{propPresentValue}),
+		openingTag(3), []byte{tagReal<<4 | 4}, binary.BigEndian.AppendUint32(nil, math.Float32bits(21.25)), closingTag(3),
+	), resp)
+
+	resp = readProperty(ObjectID{objectAnalogInput, uint32(attic.Id)}, propStatusFlags)
+	assert.Equal(t, concat(openingTag(3), encodeBits(statusFlagsBits, statusFlagFault), closingTag(3)), resp[len(resp)-5:])
+	resp = readProperty(ObjectID{objectAnalogInput, uint32(kitchen.Id)}, propObjectName)
+	assert.Contains(t, string(resp), "Home/Kitchen")
+
+	// the device object of the wildcard instance lists every object
+	resp = readProperty(ObjectID{objectDevice, maxInstance}, propObjectList)
+	objects := concat(
+		openingTag(3),
+		encodeObjectID(ObjectID{objectDevice, 1234}),
+		encodeObjectID(ObjectID{objectAnalogInput, uint32(house.Id)}),
+		encodeObjectID(kitchenID),
+		encodeObjectID(ObjectID{objectAnalogInput, uint32(attic.Id)}),
+		encodeObjectID(ObjectID{objectAnalogInput, uint32(empty.Id)}),
+		closingTag(3),
+	)
+	assert.Equal(t, objects, resp[len(resp)-len(objects):])
+
+	assert.Equal(t, concat([]byte{pduError << 4, 0x01, serviceReadProperty}, encodeEnumerated(errClassObject), encodeEnumerated(errUnknownObject)),
+		readProperty(ObjectID{objectAnalogInput, 999}, propPresentValue))
+	assert.Equal(t, concat([]byte{pduError << 4, 0x01, serviceReadProperty}, encodeEnumerated(errClassProperty), encodeEnumerated(errUnknownProperty)),
+		readProperty(kitchenID, 200))
+
+	// ReadPropertyMultiple of a property and of all of an object
+	resp = request(concat(
+		[]byte{pduConfirmed << 4, 0x05, 0x02, serviceReadMultiple},
+		encodeTag(0, true, kitchenID.bytes()), openingTag(1), encodeTag(0, true, []byte{propUnits}), encodeTag(0, true, []byte{200}), closingTag(1),
+		encodeTag(0, true, ObjectID{objectAnalogInput, uint32(empty.Id)}.bytes()), openingTag(1), encodeTag(0, true, []byte{propAll}), closingTag(1),
+	)...)
+	require.Equal(t, []byte{pduComplexAck << 4, 0x02, serviceReadMultiple}, resp[:3])
+	prefix := concat(
+		encodeTag(0, true, kitchenID.bytes()), openingTag(1),
+		encodeTag(2, true, []byte{propUnits}), openingTag(4), encodeEnumerated(unitsDegreesCelsius), closingTag(4),
+		encodeTag(2, true, []byte{200}), openingTag(5), encodeEnumerated(errClassProperty), encodeEnumerated(errUnknownProperty), closingTag(5),
+		closingTag(1),
+	)
+	assert.Equal(t, prefix, resp[3:3+len(prefix)])
+	assert.Contains(t, string(resp), "Shed")
+	assert.Contains(t, string(resp), string(concat(openingTag(4), encodeEnumerated(reliabilityNoSensor), closingTag(4))))
+
+	// writes are denied, other services and segmented requests refused
+	assert.Equal(t, concat([]byte{pduError << 4, 0x03, serviceWrite}, encodeEnumerated(errClassProperty), encodeEnumerated(errWriteAccessDenied)),
+		request(pduConfirmed<<4, 0x05, 0x03, serviceWrite))
+	assert.Equal(t, []byte{pduReject << 4, 0x04, rejectUnrecognized}, request(pduConfirmed<<4, 0x05, 0x04, 20))
+	assert.Equal(t, []byte{pduAbort<<4 | 1, 0x05, abortSegmentation}, request(pduConfirmed<<4|0x08, 0x05, 0x05, 0, 4, serviceReadProperty))
+	// a response larger than the requester accepts
+	assert.Equal(t, []byte{pduAbort<<4 | 1, 0x06, abortSegmentation}, request(concat(
+		[]byte{pduConfirmed << 4, 0x00, 0x06, serviceReadMultiple},
+		encodeTag(0, true, ObjectID{objectDevice, 1234}.bytes()), openingTag(1), encodeTag(0, true, []byte{propAll}), closingTag(1),
+	)...))
+}
+
+func ptr(v int64) *int64 { return &v }
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
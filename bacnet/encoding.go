@@ -0,0 +1,165 @@
+package bacnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Application tags of the values served.
+const (
+	tagNull            = 0
+	tagBoolean         = 1
+	tagUnsigned        = 2
+	tagReal            = 4
+	tagCharacterString = 7
+	tagBitString       = 8
+	tagEnumerated      = 9
+	tagObjectID        = 12
+)
+
+var errTruncated = errors.New("truncated BACnet tag")
+
+// tag is a decoded tag, its content undecoded. Opening and closing tags have
+// no content.
+type tag struct {
+	number  byte
+	context bool
+	opening bool
+	closing bool
+	content []byte
+}
+
+// readTag splits the first tag off b.
+func readTag(b []byte) (tag, []byte, error) {
+	if len(b) == 0 {
+		return tag{}, nil, errTruncated
+	}
+	t := tag{number: b[0] >> 4, context: b[0]&0x08 != 0}
+	lvt, n := int(b[0]&0x07), 1
+	if t.number == 0x0f {
+		if len(b) < 2 {
+			return tag{}, nil, errTruncated
+		}
+		t.number, n = b[1], 2
+	}
+	switch {
+	case t.context && lvt == 6:
+		t.opening = true
+		return t, b[n:], nil
+	case t.context && lvt == 7:
+		t.closing = true
+		return t, b[n:], nil
+	case !t.context && t.number == tagBoolean:
+		// the value of an application boolean is its length
+		t.content = []byte{byte(lvt)}
+		return t, b[n:], nil
+	}
+	length := lvt
+	if lvt == 5 {
+		if len(b) < n+1 {
+			return tag{}, nil, errTruncated
+		}
+		length, n = int(b[n]), n+1
+		switch length {
+		case 254:
+			if len(b) < n+2 {
+				return tag{}, nil, errTruncated
+			}
+			length, n = int(binary.BigEndian.Uint16(b[n:])), n+2
+		case 255:
+			return tag{}, nil, errors.New("unsupported BACnet tag length")
+		}
+	}
+	if len(b) < n+length {
+		return tag{}, nil, errTruncated
+	}
+	t.content = b[n : n+length]
+	return t, b[n+length:], nil
+}
+
+// unsigned decodes the content of an unsigned or enumerated tag.
+func (t tag) unsigned() (uint32, error) {
+	if len(t.content) == 0 || len(t.content) > 4 {
+		return 0, errors.New("invalid BACnet unsigned")
+	}
+	var v uint32
+	for _, c := range t.content {
+		v = v<<8 | uint32(c)
+	}
+	return v, nil
+}
+
+// objectID decodes the content of an object identifier tag.
+func (t tag) objectID() (ObjectID, error) {
+	if len(t.content) != 4 {
+		return ObjectID{}, errors.New("invalid BACnet object identifier")
+	}
+	v := binary.BigEndian.Uint32(t.content)
+	return ObjectID{Type: uint16(v >> 22), Instance: v & maxInstance}, nil
+}
+
+// encodeTag returns the tag of number with content, an application tag
+// unless context.
+func encodeTag(number byte, context bool, content []byte) []byte {
+	b := []byte{number << 4}
+	if context {
+		b[0] |= 0x08
+	}
+	switch n := len(content); {
+	case n < 5:
+		b[0] |= byte(n)
+	case n < 254:
+		b[0] |= 5
+		b = append(b, byte(n))
+	default:
+		b[0] |= 5
+		b = append(b, 254, byte(n>>8), byte(n))
+	}
+	return append(b, content...)
+}
+
+func openingTag(number byte) []byte { return []byte{number<<4 | 0x0e} }
+func closingTag(number byte) []byte { return []byte{number<<4 | 0x0f} }
+
+// unsignedBytes returns v in as few bytes as it takes, at least one.
+func unsignedBytes(v uint32) []byte {
+	b := binary.BigEndian.AppendUint32(nil, v)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+func encodeUnsigned(v uint32) []byte   { return encodeTag(tagUnsigned, false, unsignedBytes(v)) }
+func encodeEnumerated(v uint32) []byte { return encodeTag(tagEnumerated, false, unsignedBytes(v)) }
+
+func encodeReal(v float32) []byte {
+	return encodeTag(tagReal, false, binary.BigEndian.AppendUint32(nil, math.Float32bits(v)))
+}
+
+func encodeBoolean(v bool) []byte {
+	if v {
+		return []byte{tagBoolean<<4 | 1}
+	}
+	return []byte{tagBoolean << 4}
+}
+
+// encodeString returns s as a UTF-8 character string.
+func encodeString(s string) []byte {
+	return encodeTag(tagCharacterString, false, append([]byte{0}, s...))
+}
+
+// encodeBits returns a bit string of n bits, set ones listed.
+func encodeBits(n int, set ...int) []byte {
+	b := make([]byte, 1+(n+7)/8)
+	b[0] = byte(len(b)*8 - 8 - n)
+	for _, i := range set {
+		b[1+i/8] |= 0x80 >> (i % 8)
+	}
+	return encodeTag(tagBitString, false, b)
+}
+
+func encodeObjectID(id ObjectID) []byte {
+	return encodeTag(tagObjectID, false, id.bytes())
+}
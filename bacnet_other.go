@@ -0,0 +1,17 @@
+//go:build !bacnet
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+// serveBACnet fails in builds without the bacnet tag, which leave BACnet
+// out of the binary.
+func (c *config) serveBACnet(ctx context.Context, logger *slog.Logger, db store.Store, socks *sockets) error {
+	return errors.New("bacnet is not built in, rebuild with -tags bacnet")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/bench"
+)
+
+// runBench handles `bench [flags]`: it drives a read/write mix against a
+// running instance and prints the latency percentiles and error rates.
+func runBench(logger *slog.Logger, args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	url := fs.String("url", "http://127.0.0.1:8080", "Base URL of the instance to benchmark")
+	concurrency := fs.Int("concurrency", bench.DefaultConcurrency, "Requests in flight at most")
+	rate := fs.Float64("rate", 0, "Requests started per second at most, as many as --concurrency allows when 0")
+	writeRatio := fs.Float64("write-ratio", 0.5, "Fraction of the requests that write readings")
+	batchSize := fs.Int("batch-size", 1, "Readings per write, sent to /data/batch when more than 1")
+	readPaths := fs.String("read-paths", "", "Comma-separated paths read in turn (default /data?limit=10,/data/aggregate)")
+	duration := fs.Duration("duration", 30*time.Second, "How long to run, until --requests or interrupted when 0")
+	requests := fs.Int("requests", 0, "Stop after that many requests, when not 0")
+	randSeed := fs.Uint64("seed", uint64(time.Now().UnixNano()), "Random seed, for reproducible runs")
+	fs.Parse(args)
+	if *duration <= 0 && *requests <= 0 {
+		return errors.New("--duration or --requests is required")
+	}
+	if *batchSize > 10000 {
+		return errors.New("--batch-size must be at most 10000")
+	}
+	key, err := secretEnv("APP_SECRET_KEY")
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	logger.Info("benchmarking", "url", *url, "concurrency", *concurrency, "rate", *rate, "write_ratio", *writeRatio, "batch_size", *batchSize)
+	report, err := bench.Run(ctx, bench.Config{
+		URL:         *url,
+		SecretKey:   key,
+		Concurrency: *concurrency,
+		Rate:        *rate,
+		WriteRatio:  *writeRatio,
+		BatchSize:   *batchSize,
+		ReadPaths:   splitList(*readPaths),
+		Requests:    *requests,
+		Seed:        *randSeed,
+	})
+	if err != nil {
+		return err
+	}
+	report.Print(os.Stdout)
+	return nil
+}
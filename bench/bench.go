@@ -0,0 +1,295 @@
+// Package bench drives a mix of reads and writes against a running
+// esp8266-web instance and reports the latencies and error rates, to
+// validate write batching and pool settings on the hardware it runs on.
+package bench
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/simulate"
+)
+
+// Operations.
+const (
+	OpRead  = "read"
+	OpWrite = "write"
+)
+
+const DefaultConcurrency = 8
+
+// DefaultReadPaths are read, in turn, unless Config.ReadPaths is set.
+var DefaultReadPaths = []string{"/data?limit=10", "/data/aggregate"}
+
+type Config struct {
+	// URL is the instance's base URL, e.g. http://127.0.0.1:8080.
+	URL string
+	// SecretKey is sent in X-Secret-Key.
+	SecretKey string
+	// Concurrency is how many requests are in flight at most, defaults to
+	// DefaultConcurrency.
+	Concurrency int
+	// Rate is how many requests are started per second at most, as many as
+	// Concurrency allows when 0.
+	Rate float64
+	// WriteRatio is the fraction of the requests that write, between 0
+	// and 1.
+	WriteRatio float64
+	// BatchSize is how many readings a write sends: one to POST /data, more
+	// to POST /data/batch.
+	BatchSize int
+	// ReadPaths are the paths read, in turn, defaults to DefaultReadPaths.
+	ReadPaths []string
+	// Requests stops the run after that many requests, when not 0.
+	Requests int
+	// Seed makes the written readings reproducible.
+	Seed   uint64
+	Client *http.Client
+}
+
+// Report are the results of a run by operation.
+type Report struct {
+	Duration   time.Duration `json:"duration"`
+	Operations []Operation   `json:"operations"`
+}
+
+// Operation are the results of an operation. Latencies are of every
+// request, failed ones included.
+type Operation struct {
+	Name     string  `json:"name"`
+	Requests int     `json:"requests"`
+	Errors   int     `json:"errors"`
+	Rate     float64 `json:"rate"`
+	// ErrorRate is the fraction of the requests that failed or weren't
+	// answered 2xx.
+	ErrorRate float64        `json:"errorRate"`
+	P50       time.Duration  `json:"p50"`
+	P95       time.Duration  `json:"p95"`
+	P99       time.Duration  `json:"p99"`
+	Max       time.Duration  `json:"max"`
+	Statuses  map[string]int `json:"statuses"`
+}
+
+// result is a finished request.
+type result struct {
+	op      string
+	latency time.Duration
+	// status is the response status code, or "error" without a response.
+	status string
+}
+
+// Run sends requests until ctx is done or Config.Requests were sent and
+// returns the report.
+func Run(ctx context.Context, cfg Config) (Report, error) {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = DefaultConcurrency
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 1
+	}
+	if len(cfg.ReadPaths) == 0 {
+		cfg.ReadPaths = DefaultReadPaths
+	}
+	if cfg.WriteRatio < 0 || cfg.WriteRatio > 1 {
+		return Report{}, fmt.Errorf("bench: write ratio must be between 0 and 1")
+	}
+	client := cfg.Client
+	if client == nil {
+		client = &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{MaxIdleConnsPerHost: cfg.Concurrency},
+		}
+	}
+
+	// one goroutine draws the requests, so a run with a seed sends the same
+	// ones in the same order
+	rng := rand.New(rand.NewPCG(cfg.Seed, 0))
+	jobs := make(chan *http.Request)
+	go func() {
+		defer close(jobs)
+		var tick <-chan time.Time
+		if cfg.Rate > 0 {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.Rate))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		reads := 0
+		for n := 0; cfg.Requests == 0 || n < cfg.Requests; n++ {
+			var req *http.Request
+			var err error
+			if rng.Float64() < cfg.WriteRatio {
+				req, err = writeRequest(ctx, cfg, rng)
+			} else {
+				path := cfg.ReadPaths[reads%len(cfg.ReadPaths)]
+				reads++
+				req, err = http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(cfg.URL, "/")+path, nil)
+			}
+			if err != nil {
+				return
+			}
+			req.Header.Set("X-Secret-Key", cfg.SecretKey)
+			if tick != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-tick:
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case jobs <- req:
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var results []result
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range cfg.Concurrency {
+		wg.Go(func() {
+			for req := range jobs {
+				r := do(client, req)
+				// requests cut off by the end of the run don't count
+				if ctx.Err() != nil && r.status == "error" {
+					continue
+				}
+				mu.Lock()
+				results = append(results, r)
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	return report(results, time.Since(start)), nil
+}
+
+// writeRequest returns a write of cfg.BatchSize readings taken a minute
+// apart up to now.
+func writeRequest(ctx context.Context, cfg Config, rng *rand.Rand) (*http.Request, error) {
+	type payload struct {
+		TempCo    float64 `json:"tempCo"`
+		TempRoom  float64 `json:"tempRoom"`
+		Humidity  float64 `json:"humidity"`
+		Timestamp int64   `json:"timestamp"`
+	}
+	now := time.Now()
+	readings := make([]payload, cfg.BatchSize)
+	for i := range readings {
+		t := now.Add(-time.Duration(cfg.BatchSize-1-i) * time.Minute)
+		tempCo, tempRoom, humidity := simulate.Sample(t, 0.15, rng)
+		readings[i] = payload{
+			TempCo:    math.Round(tempCo*100) / 100,
+			TempRoom:  math.Round(tempRoom*100) / 100,
+			Humidity:  math.Round(math.Max(0, math.Min(100, humidity))*100) / 100,
+			Timestamp: t.Unix(),
+		}
+	}
+	var body any = readings
+	path := "/data/batch"
+	if cfg.BatchSize == 1 {
+		body, path = readings[0], "/data"
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(cfg.URL, "/")+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func do(client *http.Client, req *http.Request) result {
+	op := OpRead
+	if req.Method != http.MethodGet {
+		op = OpWrite
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return result{op: op, latency: time.Since(start), status: "error"}
+	}
+	// the latency includes reading the body, as a client waits for it
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return result{op: op, latency: time.Since(start), status: fmt.Sprint(resp.StatusCode)}
+}
+
+// report summarizes results by operation, reads first.
+func report(results []result, elapsed time.Duration) Report {
+	rep := Report{Duration: elapsed, Operations: []Operation{}}
+	for _, name := range []string{OpRead, OpWrite, "total"} {
+		var latencies []time.Duration
+		op := Operation{Name: name, Statuses: make(map[string]int)}
+		for _, r := range results {
+			if name != "total" && r.op != name {
+				continue
+			}
+			latencies = append(latencies, r.latency)
+			op.Statuses[r.status]++
+			if r.status == "error" || r.status[0] != '2' {
+				op.Errors++
+			}
+		}
+		if len(latencies) == 0 {
+			continue
+		}
+		slices.Sort(latencies)
+		op.Requests = len(latencies)
+		op.Rate = float64(op.Requests) / elapsed.Seconds()
+		op.ErrorRate = float64(op.Errors) / float64(op.Requests)
+		op.P50 = percentile(latencies, 50)
+		op.P95 = percentile(latencies, 95)
+		op.P99 = percentile(latencies, 99)
+		op.Max = latencies[len(latencies)-1]
+		rep.Operations = append(rep.Operations, op)
+	}
+	return rep
+}
+
+// percentile returns the nearest-rank percentile p of sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank-1, 0)]
+}
+
+// Print writes the report as a table.
+func (r Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "%-6s %9s %9s %7s %10s %10s %10s %10s\n", "op", "requests", "req/s", "errors", "p50", "p95", "p99", "max")
+	for _, op := range r.Operations {
+		fmt.Fprintf(w, "%-6s %9d %9.1f %6.2f%% %10s %10s %10s %10s\n", op.Name, op.Requests, op.Rate, op.ErrorRate*100,
+			round(op.P50), round(op.P95), round(op.P99), round(op.Max))
+	}
+	for _, op := range r.Operations {
+		if op.Errors == 0 || op.Name == "total" {
+			continue
+		}
+		var statuses []string
+		for _, status := range slices.Sorted(maps.Keys(op.Statuses)) {
+			statuses = append(statuses, fmt.Sprintf("%s: %d", status, op.Statuses[status]))
+		}
+		fmt.Fprintf(w, "%s statuses: %s\n", op.Name, strings.Join(statuses, ", "))
+	}
+}
+
+func round(d time.Duration) time.Duration {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+	return d.Round(10 * time.Microsecond)
+}
@@ -0,0 +1,65 @@
+package bench
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/server"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	st := memory.New()
+	srv := httptest.NewServer(server.NewServer(server.Config{SecretKey: "secret", Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}, st))
+	defer srv.Close()
+
+	report, err := Run(context.Background(), Config{
+		URL:        srv.URL,
+		SecretKey:  "secret",
+		WriteRatio: 0.5,
+		BatchSize:  5,
+		ReadPaths:  []string{"/data?limit=10", "/data/aggregate?interval=1s"},
+		Requests:   200,
+		Seed:       1,
+	})
+	require.NoError(t, err)
+	require.Len(t, report.Operations, 3)
+	read, write, total := report.Operations[0], report.Operations[1], report.Operations[2]
+	assert.Equal(t, OpRead, read.Name)
+	assert.Equal(t, 200, total.Requests)
+	assert.Equal(t, 200, read.Requests+write.Requests)
+	assert.Zero(t, write.Errors)
+	// every other read is rejected
+	assert.InDelta(t, read.Requests/2, read.Statuses["422"], 1)
+	assert.Equal(t, read.Statuses["422"], read.Errors)
+	assert.InDelta(t, 0.5, read.ErrorRate, 0.01)
+	assert.LessOrEqual(t, total.P50, total.P95)
+	assert.LessOrEqual(t, total.P95, total.P99)
+	assert.LessOrEqual(t, total.P99, total.Max)
+
+	readings, err := st.ListReadings(context.Background(), 10000, 0)
+	require.NoError(t, err)
+	assert.Len(t, readings, 5*write.Requests)
+
+	var out bytes.Buffer
+	report.Print(&out)
+	assert.Contains(t, out.String(), "p99")
+	assert.Contains(t, out.String(), "read statuses: 200: ")
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 50*time.Millisecond, percentile(sorted, 50))
+	assert.Equal(t, 99*time.Millisecond, percentile(sorted, 99))
+	assert.Equal(t, time.Millisecond, percentile(sorted[:1], 99))
+}
@@ -0,0 +1,155 @@
+// Package chart renders readings as PNG line charts for clients that can't
+// run the dashboard's JavaScript, e.g. e-mails, Telegram and e-ink
+// displays.
+package chart
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	gochart "github.com/wcharczuk/go-chart/v2"
+)
+
+const (
+	DefaultWidth  = 800
+	DefaultHeight = 400
+)
+
+// Fields lists the reading fields that can be charted, in legend order.
+var Fields = []string{"tempCo", "tempRoom", "humidity"}
+
+// fieldNames are the legend names, matching the dashboard's.
+var fieldNames = map[string]string{
+	"tempCo":   "CO Temperature",
+	"tempRoom": "Room Temperature",
+	"humidity": "Humidity",
+}
+
+// ErrNoReadings is returned when there is nothing to chart.
+var ErrNoReadings = errors.New("no readings to chart")
+
+// Options shape a chart. Zero values take the defaults: DefaultWidth,
+// DefaultHeight and the temperature fields.
+type Options struct {
+	Width, Height int
+	Fields        []string
+	Title         string
+	// From and To, unix timestamps, are the ends of the time axis.
+	From, To int64
+	// Location is the time zone of the axis labels, defaults to UTC.
+	Location *time.Location
+}
+
+// ValidateFields checks that every field can be charted.
+func ValidateFields(fields []string) error {
+	for _, f := range fields {
+		if !slices.Contains(Fields, f) {
+			return fmt.Errorf("unknown field %q, must be one of %v", f, Fields)
+		}
+	}
+	return nil
+}
+
+func value(r store.TemperatureReading, field string) float64 {
+	switch field {
+	case "tempCo":
+		return r.TempCo
+	case "tempRoom":
+		return r.TempRoom
+	default:
+		return r.Humidity
+	}
+}
+
+// PNG draws readings, oldest first, as one line per field. Humidity is
+// plotted against a secondary axis on the right.
+func PNG(w io.Writer, readings []store.TemperatureReading, opts Options) error {
+	if opts.Width <= 0 {
+		opts.Width = DefaultWidth
+	}
+	if opts.Height <= 0 {
+		opts.Height = DefaultHeight
+	}
+	if len(opts.Fields) == 0 {
+		opts.Fields = []string{"tempCo", "tempRoom"}
+	}
+	if opts.Location == nil {
+		opts.Location = time.UTC
+	}
+	if err := ValidateFields(opts.Fields); err != nil {
+		return err
+	}
+	readings = slices.DeleteFunc(slices.Clone(readings), func(r store.TemperatureReading) bool { return r.Timestamp == nil })
+	if len(readings) == 0 {
+		return ErrNoReadings
+	}
+
+	times := make([]time.Time, len(readings))
+	for i, r := range readings {
+		times[i] = time.Unix(*r.Timestamp, 0).In(opts.Location)
+	}
+	from, to := times[0], times[len(times)-1]
+	if opts.From != 0 {
+		from = time.Unix(opts.From, 0)
+	}
+	if opts.To != 0 {
+		to = time.Unix(opts.To, 0)
+	}
+	if !to.After(from) {
+		to = from.Add(time.Minute)
+	}
+	format := "15:04"
+	if to.Sub(from) > 24*time.Hour {
+		format = "01-02 15:04"
+	}
+
+	graph := gochart.Chart{
+		Title:  opts.Title,
+		Width:  opts.Width,
+		Height: opts.Height,
+		Background: gochart.Style{
+			Padding: gochart.Box{Top: 20, Left: 20, Right: 20, Bottom: 20},
+		},
+		XAxis: gochart.XAxis{
+			ValueFormatter: gochart.TimeValueFormatterWithFormat(format),
+			Range:          &gochart.ContinuousRange{Min: gochart.TimeToFloat64(from), Max: gochart.TimeToFloat64(to)},
+		},
+		YAxis: gochart.YAxis{Name: "°C"},
+	}
+	var primary, secondary []float64
+	for _, field := range opts.Fields {
+		values := make([]float64, len(readings))
+		for i, r := range readings {
+			values[i] = value(r, field)
+		}
+		series := gochart.TimeSeries{Name: fieldNames[field], XValues: times, YValues: values}
+		if field == "humidity" {
+			series.YAxis = gochart.YAxisSecondary
+			secondary = append(secondary, values...)
+		} else {
+			primary = append(primary, values...)
+		}
+		graph.Series = append(graph.Series, series)
+	}
+	if len(primary) > 0 {
+		graph.YAxis.Range = paddedRange(primary)
+	}
+	if len(secondary) > 0 {
+		graph.YAxisSecondary = gochart.YAxis{Name: "%", Range: paddedRange(secondary)}
+	}
+	graph.Elements = []gochart.Renderable{gochart.LegendThin(&graph)}
+	return graph.Render(gochart.PNG, w)
+}
+
+// paddedRange spans values with some headroom, at least one unit either
+// side so flat lines don't make a zero range.
+func paddedRange(values []float64) *gochart.ContinuousRange {
+	lo, hi := slices.Min(values), slices.Max(values)
+	pad := math.Max((hi-lo)*0.1, 1)
+	return &gochart.ContinuousRange{Min: math.Floor(lo - pad), Max: math.Ceil(hi + pad)}
+}
@@ -0,0 +1,62 @@
+package chart
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func reading(ts int64, co, room, humidity float64) store.TemperatureReading {
+	return store.TemperatureReading{TempCo: co, TempRoom: room, Humidity: humidity, Timestamp: &ts}
+}
+
+func TestPNG(t *testing.T) {
+	readings := []store.TemperatureReading{
+		reading(1761386400, 40, 21, 50),
+		reading(1761390000, 45, 21.5, 48),
+		{TempCo: 99},
+		reading(1761393600, 42, 22, 52),
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, PNG(&buf, readings, Options{Width: 300, Height: 200, Fields: []string{"tempRoom", "humidity"}, Title: "Attic"}))
+	img, err := png.Decode(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, 300, img.Bounds().Dx())
+	assert.Equal(t, 200, img.Bounds().Dy())
+
+	// flat and single readings still render
+	buf.Reset()
+	require.NoError(t, PNG(&buf, readings[:1], Options{}))
+	img, err = png.Decode(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultWidth, img.Bounds().Dx())
+
+	assert.ErrorIs(t, PNG(&buf, nil, Options{}), ErrNoReadings)
+	assert.ErrorIs(t, PNG(&buf, readings[2:3], Options{}), ErrNoReadings)
+	assert.Error(t, PNG(&buf, readings, Options{Fields: []string{"pressure"}}))
+}
+
+func TestSparkline(t *testing.T) {
+	readings := []store.TemperatureReading{
+		reading(1761386400, 40, 20, 50),
+		reading(1761390000, 45, 22, 48),
+		reading(1761393600, 42, 21, 52),
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, Sparkline(&buf, readings, "tempRoom", 100, 20))
+	svg := buf.String()
+	assert.Contains(t, svg, `width="100" height="20"`)
+	assert.Contains(t, svg, `points="1.5,18.5 50.0,1.5 98.5,10.0"`)
+	assert.Contains(t, svg, "<title>Room Temperature: 21.0 (20.0–22.0)</title>")
+
+	buf.Reset()
+	require.NoError(t, Sparkline(&buf, nil, "humidity", 100, 20))
+	assert.NotContains(t, buf.String(), "polyline")
+	assert.Error(t, Sparkline(&buf, readings, "pressure", 100, 20))
+}
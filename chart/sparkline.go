@@ -0,0 +1,65 @@
+package chart
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+const (
+	SparklineWidth  = 100
+	SparklineHeight = 20
+)
+
+// Sparkline writes field of readings, oldest first, as a bare SVG line
+// width by height pixels, for inlining next to text. It is stroked with
+// currentColor so it takes the colour of the surrounding text. Without
+// readings the image is empty.
+func Sparkline(w io.Writer, readings []store.TemperatureReading, field string, width, height int) error {
+	if err := ValidateFields([]string{field}); err != nil {
+		return err
+	}
+	readings = slices.DeleteFunc(slices.Clone(readings), func(r store.TemperatureReading) bool { return r.Timestamp == nil })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, width, height, width, height)
+	if len(readings) > 0 {
+		values := make([]float64, len(readings))
+		for i, r := range readings {
+			values[i] = value(r, field)
+		}
+		lo, hi := slices.Min(values), slices.Max(values)
+		first, last := *readings[0].Timestamp, *readings[len(readings)-1].Timestamp
+		// keep the stroke inside the image
+		const pad = 1.5
+		x := func(i int) float64 {
+			if last == first {
+				return float64(width) / 2
+			}
+			return pad + float64(*readings[i].Timestamp-first)/float64(last-first)*(float64(width)-2*pad)
+		}
+		y := func(v float64) float64 {
+			if hi == lo {
+				return float64(height) / 2
+			}
+			return pad + (hi-v)/(hi-lo)*(float64(height)-2*pad)
+		}
+		fmt.Fprintf(&b, `<title>%s: %.1f (%.1f–%.1f)</title>`, html.EscapeString(fieldNames[field]), values[len(values)-1], lo, hi)
+		b.WriteString(`<polyline fill="none" stroke="currentColor" stroke-width="1.5" stroke-linejoin="round" points="`)
+		for i, v := range values {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			fmt.Fprintf(&b, "%.1f,%.1f", x(i), y(v))
+		}
+		b.WriteString(`"/>`)
+		fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="1.5" fill="currentColor"/>`, x(len(values)-1), y(values[len(values)-1]))
+	}
+	b.WriteString("</svg>")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/notify"
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/postgres"
+)
+
+// Self-check outcomes.
+const (
+	checkPass = "PASS"
+	checkFail = "FAIL"
+	checkSkip = "SKIP"
+)
+
+// skipped is the reason a check doesn't apply to the configuration.
+type skipped string
+
+func (s skipped) Error() string { return string(s) }
+
+type checkResult struct {
+	name    string
+	outcome string
+	detail  string
+}
+
+// checkReport collects the outcomes of the self-checks, in order.
+type checkReport struct {
+	results []checkResult
+}
+
+// run records the outcome of fn under name. fn returns a detail for the
+// report, or skipped when the check doesn't apply.
+func (r *checkReport) run(name string, fn func() (string, error)) bool {
+	detail, err := fn()
+	res := checkResult{name: name, outcome: checkPass, detail: detail}
+	var skip skipped
+	switch {
+	case errors.As(err, &skip):
+		res.outcome = checkSkip
+		res.detail = err.Error()
+	case err != nil:
+		res.outcome = checkFail
+		res.detail = err.Error()
+	}
+	r.results = append(r.results, res)
+	return err == nil
+}
+
+func (r *checkReport) failed() int {
+	n := 0
+	for _, res := range r.results {
+		if res.outcome == checkFail {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *checkReport) write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, res := range r.results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", res.outcome, res.name, res.detail)
+	}
+	return tw.Flush()
+}
+
+// runCheck handles `check [flags]`: it validates the configuration,
+// connects to the store, reports pending migrations and sends a test
+// message over every notification channel, then prints a report and exits
+// non-zero when any check failed. Unlike serve it applies no migrations.
+func runCheck(logger *slog.Logger, args []string) error {
+	var cfg config
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	timeout := fs.Duration("timeout", 30*time.Second, "How long the checks may take altogether")
+	notifyChannels := fs.Bool("notify", true, "Send a test message over every notification channel")
+	fs.Parse(args)
+
+	report := &checkReport{}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if report.run("config", func() (string, error) { return cfg.checkConfig(ctx, fs, logger) }) {
+		cfg.check(ctx, report, cfg.notifiers(), *notifyChannels)
+	}
+	if err := report.write(os.Stdout); err != nil {
+		return err
+	}
+	if n := report.failed(); n > 0 {
+		return fmt.Errorf("%d of %d checks failed", n, len(report.results))
+	}
+	return nil
+}
+
+// checkConfig applies the profile, env and config file like serve does and
+// fetches the secrets.
+func (c *config) checkConfig(ctx context.Context, fs *flag.FlagSet, logger *slog.Logger) (string, error) {
+	if err := c.applyProfile(fs, logger); err != nil {
+		return "", err
+	}
+	if err := c.applyEnv(logger); err != nil {
+		return "", err
+	}
+	if _, err := c.loadSettings(ctx, logger); err != nil {
+		return "", err
+	}
+	if _, err := c.watchSecrets(ctx, logger); err != nil {
+		return "", err
+	}
+	if c.secretKey == "" {
+		return "", errors.New("APP_SECRET_KEY or APP_SECRET_KEY_FILE environment variable is required")
+	}
+	detail := "db driver " + c.dbDriver
+	if c.profile != "" {
+		detail += ", profile " + c.profile
+	}
+	return detail, nil
+}
+
+// check runs the checks following the config one, adding them to report.
+func (c *config) check(ctx context.Context, report *checkReport, notifiers map[string]notify.Notifier, notifyChannels bool) {
+	var db store.Store
+	report.run("database", func() (string, error) {
+		opened, err := c.openCheckedStore(ctx)
+		if err != nil {
+			return "", err
+		}
+		db = opened
+		if err := db.Ping(ctx); err != nil {
+			return "", err
+		}
+		if c.dbDriver == "postgres" {
+			return fmt.Sprintf("postgres at %s:%d/%s", c.dbHost, c.dbPort, c.dbName), nil
+		}
+		return c.dbDriver, nil
+	})
+	if db != nil {
+		defer db.Close()
+	}
+
+	report.run("migrations", func() (string, error) {
+		if db == nil {
+			return "", skipped("no database connection")
+		}
+		pg, ok := db.(*postgres.Store)
+		if !ok {
+			return "", skipped("only tracked with --db-driver=postgres")
+		}
+		status, err := pg.MigrationStatus(ctx)
+		if err != nil {
+			return "", err
+		}
+		pending := 0
+		for _, s := range status {
+			if s.AppliedAt == nil {
+				pending++
+			}
+		}
+		return fmt.Sprintf("%d applied, %d pending, serve applies pending ones", len(status)-pending, pending), nil
+	})
+
+	names := make([]string, 0, len(notifiers))
+	for name := range notifiers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	if len(names) == 0 {
+		report.run("notify", func() (string, error) {
+			return "", skipped("no notification channels configured")
+		})
+	}
+	for _, name := range names {
+		report.run("notify "+name, func() (string, error) {
+			if !notifyChannels {
+				return "", skipped("--notify=false")
+			}
+			err := notifiers[name].Notify(ctx, notify.Message{
+				Subject: "esp8266-web check",
+				Text:    "Test notification sent by `esp8266-web check`, no action is needed.",
+			})
+			if err != nil {
+				return "", err
+			}
+			return "test message sent", nil
+		})
+	}
+}
+
+// openCheckedStore opens the configured store like openStore, except that
+// Postgres is left unmigrated.
+func (c *config) openCheckedStore(ctx context.Context) (store.Store, error) {
+	if c.dbDriver != "postgres" {
+		return openStore(ctx, c)
+	}
+	db, err := c.openPostgres(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
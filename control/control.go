@@ -0,0 +1,249 @@
+// Package control runs thermostat zones: it evaluates incoming readings
+// against every zone's target and queues relay commands for the device
+// switching the heating or cooling.
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/alert"
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+const (
+	ModeHeat = "heat"
+	ModeCool = "cool"
+)
+
+// CommandRelay is the command type of relay switches, valued "on" or "off".
+const CommandRelay = "relay"
+
+// DefaultFrostSetpoint is the away mode setpoint when none is given.
+const DefaultFrostSetpoint = 7.0
+
+var (
+	fields = []string{"tempCo", "tempRoom", "humidity"}
+	modes  = []string{ModeHeat, ModeCool}
+)
+
+// Store is what the controller needs from a store.
+type Store interface {
+	store.ZoneStore
+	store.CommandStore
+}
+
+// Validate checks z and fills in the defaults: tempRoom, heat and the
+// zone's own device as the relay.
+func Validate(z *store.Zone) error {
+	var errs []error
+	if strings.TrimSpace(z.Name) == "" {
+		errs = append(errs, errors.New("name is required"))
+	}
+	if z.Field == "" {
+		z.Field = "tempRoom"
+	}
+	if !contains(fields, z.Field) {
+		errs = append(errs, fmt.Errorf("field must be one of %s", strings.Join(fields, ", ")))
+	}
+	if z.Mode == "" {
+		z.Mode = ModeHeat
+	}
+	if !contains(modes, z.Mode) {
+		errs = append(errs, fmt.Errorf("mode must be one of %s", strings.Join(modes, ", ")))
+	}
+	if z.Hysteresis < 0 {
+		errs = append(errs, errors.New("hysteresis must not be negative"))
+	}
+	if z.RelayDevice == "" {
+		z.RelayDevice = z.Device
+	}
+	if z.RelayDevice == "" {
+		errs = append(errs, errors.New("relayDevice is required for zones following readings sent without a device"))
+	}
+	return errors.Join(errs...)
+}
+
+func contains(values []string, v string) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Decide returns whether the zone's relay should be on at value v. Within
+// the hysteresis band the relay keeps its state, or, before the first
+// command, follows the target.
+func Decide(z store.Zone, v float64) bool {
+	low, high := z.Target-z.Hysteresis, z.Target+z.Hysteresis
+	switch {
+	case v < low:
+		return z.Mode == ModeHeat
+	case v > high:
+		return z.Mode == ModeCool
+	case z.Relay != nil:
+		return *z.Relay
+	case z.Mode == ModeHeat:
+		return v < z.Target
+	default:
+		return v > z.Target
+	}
+}
+
+type Config struct {
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// Controller evaluates zones and switches their relays.
+type Controller struct {
+	store  Store
+	logger *slog.Logger
+	now    func() time.Time
+	// mu serializes evaluations so concurrent readings don't queue the
+	// same command twice.
+	mu sync.Mutex
+}
+
+func New(st Store, cfg Config) *Controller {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return &Controller{store: st, logger: cfg.Logger, now: time.Now}
+}
+
+func (c *Controller) Store() Store { return c.store }
+
+// Away returns the away mode in effect, nil when there is none. An expired
+// one is cleared.
+func (c *Controller) Away(ctx context.Context) (*store.AwayMode, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.away(ctx, c.now().Unix())
+}
+
+// away must be called with mu held.
+func (c *Controller) away(ctx context.Context, now int64) (*store.AwayMode, error) {
+	m, err := c.store.GetAwayMode(ctx)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	if now >= m.Until {
+		if err := c.store.SetAwayMode(ctx, nil); err != nil {
+			return nil, err
+		}
+		c.logger.Info("away mode ended", "until", m.Until)
+		return nil, nil
+	}
+	if now < m.Since {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// SetAway sets the away mode, with a nil m clearing it. Zones follow it
+// from their next reading.
+func (c *Controller) SetAway(ctx context.Context, m *store.AwayMode) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.store.SetAwayMode(ctx, m); err != nil {
+		return err
+	}
+	if m != nil {
+		c.logger.Info("away mode set", "setpoint", m.Setpoint, "since", m.Since, "until", m.Until)
+	} else {
+		c.logger.Info("away mode cleared")
+	}
+	return nil
+}
+
+// Evaluate applies a reading sent by device to the enabled zones following
+// it. Expired overrides are cleared first. In away mode heating zones hold
+// the frost-protection setpoint and cooling zones are off; manual
+// overrides still win.
+func (c *Controller) Evaluate(ctx context.Context, device string, r store.TemperatureReading) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	zones, err := c.store.ListZones(ctx)
+	if err != nil {
+		return err
+	}
+	now := c.now().Unix()
+	away, err := c.away(ctx, now)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, z := range zones {
+		if !z.Enabled || z.Device != device {
+			continue
+		}
+		if z.Override != nil && z.OverrideUntil != 0 && now >= z.OverrideUntil {
+			if z, err = c.store.SetZoneOverride(ctx, z.Id, nil, 0, now); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			c.logger.Info("zone override expired", "zone", z.Name)
+		}
+		v := alert.Value(r, z.Field)
+		if away != nil {
+			z.Target = away.Setpoint
+		}
+		on := Decide(z, v)
+		switch {
+		case z.Override != nil:
+			on = *z.Override
+		case away != nil && z.Mode == ModeCool:
+			on = false
+		}
+		if err := c.switchRelay(ctx, z, on, v, now); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Override forces the zone's relay on or off until until, a unix time or 0
+// for until cleared, and switches it right away. A nil on clears the
+// override; the next reading decides the relay again.
+func (c *Controller) Override(ctx context.Context, id int, on *bool, until int64) (store.Zone, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now().Unix()
+	z, err := c.store.SetZoneOverride(ctx, id, on, until, now)
+	if err != nil || on == nil {
+		return z, err
+	}
+	if err := c.switchRelay(ctx, z, *on, 0, now); err != nil {
+		return z, err
+	}
+	return c.store.GetZone(ctx, id)
+}
+
+// switchRelay queues a command when the relay isn't already in state on.
+func (c *Controller) switchRelay(ctx context.Context, z store.Zone, on bool, v float64, now int64) error {
+	if z.Relay != nil && *z.Relay == on {
+		return nil
+	}
+	state := "off"
+	if on {
+		state = "on"
+	}
+	if _, err := c.store.EnqueueCommand(ctx, store.Command{Device: z.RelayDevice, Type: CommandRelay, Value: state, CreatedAt: now}); err != nil {
+		return fmt.Errorf("zone %s: %w", z.Name, err)
+	}
+	if err := c.store.SetZoneRelay(ctx, store.ZoneEvent{ZoneId: z.Id, State: state, Value: v, Target: z.Target, Timestamp: now}); err != nil {
+		return fmt.Errorf("zone %s: %w", z.Name, err)
+	}
+	c.logger.Info("zone relay switched", "zone", z.Name, "relay_device", z.RelayDevice, "state", state, "value", v, "target", z.Target)
+	return nil
+}
@@ -0,0 +1,140 @@
+package control
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	z := store.Zone{Name: "living room", Device: "attic"}
+	require.NoError(t, Validate(&z))
+	assert.Equal(t, "tempRoom", z.Field)
+	assert.Equal(t, ModeHeat, z.Mode)
+	assert.Equal(t, "attic", z.RelayDevice)
+
+	assert.Error(t, Validate(&store.Zone{Name: "no relay"}))
+	assert.Error(t, Validate(&store.Zone{Name: "x", Device: "a", Mode: "dry"}))
+	assert.Error(t, Validate(&store.Zone{Name: "x", Device: "a", Hysteresis: -1}))
+	assert.Error(t, Validate(&store.Zone{Device: "a"}))
+}
+
+func TestDecide(t *testing.T) {
+	on, off := true, false
+	heat := store.Zone{Target: 21, Hysteresis: 0.5, Mode: ModeHeat}
+	assert.True(t, Decide(heat, 20.4))
+	assert.False(t, Decide(heat, 21.6))
+	assert.True(t, Decide(heat, 20.9))
+	heat.Relay = &off
+	assert.False(t, Decide(heat, 20.9))
+	heat.Relay = &on
+	assert.True(t, Decide(heat, 21.4))
+
+	cool := store.Zone{Target: 24, Hysteresis: 1, Mode: ModeCool}
+	assert.True(t, Decide(cool, 25.5))
+	assert.False(t, Decide(cool, 22.5))
+}
+
+func pending(t *testing.T, st *memory.Store, device string) []string {
+	t.Helper()
+	commands, err := st.PendingCommands(context.Background(), device)
+	require.NoError(t, err)
+	var values []string
+	for _, c := range commands {
+		assert.Equal(t, CommandRelay, c.Type)
+		values = append(values, c.Value)
+	}
+	return values
+}
+
+func TestController(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	c := New(st, Config{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	now := time.Unix(1761388101, 0)
+	c.now = func() time.Time { return now }
+
+	z, err := st.CreateZone(ctx, store.Zone{Name: "living room", Device: "attic", RelayDevice: "boiler", Field: "tempRoom", Target: 21, Hysteresis: 0.5, Mode: ModeHeat, Enabled: true})
+	require.NoError(t, err)
+	_, err = st.CreateZone(ctx, store.Zone{Name: "disabled", Device: "attic", RelayDevice: "fan", Field: "tempRoom", Target: 30, Mode: ModeHeat})
+	require.NoError(t, err)
+
+	reading := func(v float64) {
+		t.Helper()
+		require.NoError(t, c.Evaluate(ctx, "attic", store.TemperatureReading{TempRoom: v}))
+	}
+	reading(20)
+	assert.Equal(t, []string{"on"}, pending(t, st, "boiler"))
+	// within the band and other devices change nothing
+	reading(21.3)
+	require.NoError(t, c.Evaluate(ctx, "garage", store.TemperatureReading{TempRoom: 30}))
+	assert.Equal(t, []string{"on"}, pending(t, st, "boiler"))
+	// an undelivered command is superseded
+	reading(21.6)
+	assert.Equal(t, []string{"off"}, pending(t, st, "boiler"))
+	assert.Empty(t, pending(t, st, "fan"))
+
+	on := true
+	z, err = c.Override(ctx, z.Id, &on, now.Add(time.Hour).Unix())
+	require.NoError(t, err)
+	require.NotNil(t, z.Relay)
+	assert.True(t, *z.Relay)
+	reading(23)
+	assert.Equal(t, []string{"on"}, pending(t, st, "boiler"))
+
+	// the override expires with the next reading after it
+	now = now.Add(2 * time.Hour)
+	reading(23)
+	assert.Equal(t, []string{"off"}, pending(t, st, "boiler"))
+	z, err = st.GetZone(ctx, z.Id)
+	require.NoError(t, err)
+	assert.Nil(t, z.Override)
+
+	history, err := st.ListZoneHistory(ctx, z.Id, 10, 0)
+	require.NoError(t, err)
+	var states []string
+	for _, e := range history {
+		states = append(states, e.Kind+":"+e.State)
+	}
+	assert.Equal(t, []string{"relay:off", "override:auto", "relay:on", "override:on", "relay:off", "relay:on"}, states)
+}
+
+func TestControllerAwayMode(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	c := New(st, Config{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	now := time.Unix(1761388101, 0)
+	c.now = func() time.Time { return now }
+
+	_, err := st.CreateZone(ctx, store.Zone{Name: "living room", Device: "attic", RelayDevice: "boiler", Field: "tempRoom", Target: 21, Hysteresis: 0.5, Mode: ModeHeat, Enabled: true})
+	require.NoError(t, err)
+	_, err = st.CreateZone(ctx, store.Zone{Name: "ac", Device: "attic", RelayDevice: "ac", Field: "tempRoom", Target: 10, Mode: ModeCool, Enabled: true})
+	require.NoError(t, err)
+
+	require.NoError(t, c.SetAway(ctx, &store.AwayMode{Setpoint: 7, Since: now.Unix(), Until: now.Add(24 * time.Hour).Unix()}))
+	require.NoError(t, c.Evaluate(ctx, "attic", store.TemperatureReading{TempRoom: 15}))
+	assert.Equal(t, []string{"off"}, pending(t, st, "boiler"))
+	assert.Equal(t, []string{"off"}, pending(t, st, "ac"))
+	require.NoError(t, c.Evaluate(ctx, "attic", store.TemperatureReading{TempRoom: 6}))
+	assert.Equal(t, []string{"on"}, pending(t, st, "boiler"))
+
+	history, err := st.ListZoneHistory(ctx, 1, 1, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 7.0, history[0].Target)
+
+	// back home the zone follows its own target again
+	now = now.Add(25 * time.Hour)
+	m, err := c.Away(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, m)
+	require.NoError(t, c.Evaluate(ctx, "attic", store.TemperatureReading{TempRoom: 15}))
+	assert.Equal(t, []string{"on"}, pending(t, st, "boiler"))
+	assert.Equal(t, []string{"on"}, pending(t, st, "ac"))
+}
@@ -0,0 +1,266 @@
+// Package events publishes reading and alert events to a message broker,
+// Kafka or NATS JetStream, for downstream analytics pipelines.
+//
+// Every event carries the payload schema version, both in the payload and
+// in the schema-version message header. The version is bumped on changes
+// that aren't backwards compatible; adding fields isn't one.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SchemaVersion is the version of the Event payload.
+const SchemaVersion = 1
+
+const (
+	TypeReading = "reading"
+	TypeAlert   = "alert"
+)
+
+const (
+	DefaultMaxBuffer     = 100000
+	DefaultBatchSize     = 500
+	DefaultReadingsTopic = "esp8266.readings"
+	DefaultAlertsTopic   = "esp8266.alerts"
+	// maxBackoff caps the wait between failed publishes.
+	maxBackoff = 5 * time.Minute
+)
+
+// Event is the payload of every published message.
+type Event struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	// Time is the server time the event happened, unix seconds.
+	Time    int64                     `json:"time"`
+	Reading *store.TemperatureReading `json:"reading,omitempty"`
+	Alert   *store.AlertEvent         `json:"alert,omitempty"`
+}
+
+// Message is an encoded event ready for a broker.
+type Message struct {
+	Topic   string
+	Key     []byte
+	Value   []byte
+	Headers map[string]string
+}
+
+// Broker delivers messages, e.g. Kafka or NATS.
+type Broker interface {
+	// Publish delivers msgs; on error the whole batch is retried.
+	Publish(ctx context.Context, msgs []Message) error
+	Close() error
+}
+
+var (
+	publishedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "esp8266_events_published_total",
+		Help: "Events delivered to the broker, by type.",
+	}, []string{"type"})
+	publishErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "esp8266_events_publish_errors_total",
+		Help: "Failed attempts to deliver a batch of events.",
+	})
+	droppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "esp8266_events_dropped_total",
+		Help: "Events dropped because the buffer was full.",
+	})
+	pendingEvents = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "esp8266_events_pending",
+		Help: "Events buffered for delivery.",
+	})
+	publishDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "esp8266_events_publish_duration_seconds",
+		Help: "Time to deliver a batch of events.",
+	})
+)
+
+type Config struct {
+	Broker Broker
+	// ReadingsTopic and AlertsTopic default to DefaultReadingsTopic and
+	// DefaultAlertsTopic. With NATS they are subjects.
+	ReadingsTopic string
+	AlertsTopic   string
+	// MaxBuffer caps buffered events; the oldest are dropped when the broker
+	// is unreachable for too long. Defaults to DefaultMaxBuffer.
+	MaxBuffer int
+	// BatchSize defaults to DefaultBatchSize.
+	BatchSize int
+	// RetryInterval is the first wait after a failed publish, doubled up to
+	// five minutes while it keeps failing. Defaults to a second.
+	RetryInterval time.Duration
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// Publisher buffers events in memory and publishes them in the background,
+// so a slow broker never holds back ingest or alerting.
+type Publisher struct {
+	cfg    Config
+	logger *slog.Logger
+	now    func() time.Time
+	notify chan struct{}
+
+	mu      sync.Mutex
+	buf     []Event
+	dropped int64
+}
+
+func NewPublisher(cfg Config) *Publisher {
+	if cfg.ReadingsTopic == "" {
+		cfg.ReadingsTopic = DefaultReadingsTopic
+	}
+	if cfg.AlertsTopic == "" {
+		cfg.AlertsTopic = DefaultAlertsTopic
+	}
+	if cfg.MaxBuffer <= 0 {
+		cfg.MaxBuffer = DefaultMaxBuffer
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = time.Second
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	return &Publisher{cfg: cfg, logger: cfg.Logger, now: time.Now, notify: make(chan struct{}, 1)}
+}
+
+// Enqueue buffers events for publishing. It never blocks on the broker.
+func (p *Publisher) Enqueue(events ...Event) {
+	p.mu.Lock()
+	p.buf = append(p.buf, events...)
+	if over := len(p.buf) - p.cfg.MaxBuffer; over > 0 {
+		p.buf = append(p.buf[:0], p.buf[over:]...)
+		p.dropped += int64(over)
+		droppedTotal.Add(float64(over))
+		p.logger.Warn("event buffer full, dropped oldest events", "dropped", over, "dropped_total", p.dropped)
+	}
+	pendingEvents.Set(float64(len(p.buf)))
+	p.mu.Unlock()
+
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Name and Write make the publisher a sink.Sink. Write only buffers, the
+// publisher retries on its own.
+func (p *Publisher) Name() string { return "events" }
+
+func (p *Publisher) Write(ctx context.Context, readings []store.TemperatureReading) error {
+	now := p.now().Unix()
+	events := make([]Event, len(readings))
+	for i := range readings {
+		events[i] = Event{Version: SchemaVersion, Type: TypeReading, Time: now, Reading: &readings[i]}
+	}
+	p.Enqueue(events...)
+	return nil
+}
+
+// Alert publishes an alert transition; it matches alert.Config.OnEvent.
+func (p *Publisher) Alert(ev store.AlertEvent) {
+	p.Enqueue(Event{Version: SchemaVersion, Type: TypeAlert, Time: p.now().Unix(), Alert: &ev})
+}
+
+// Pending returns the number of buffered events.
+func (p *Publisher) Pending() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.buf)
+}
+
+// Run publishes buffered events until ctx is done, backing off
+// exponentially while the broker fails. It closes the broker on return.
+func (p *Publisher) Run(ctx context.Context) {
+	defer p.cfg.Broker.Close()
+	wait := p.cfg.RetryInterval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.notify:
+		}
+		for {
+			p.mu.Lock()
+			batch := append([]Event(nil), p.buf[:min(len(p.buf), p.cfg.BatchSize)]...)
+			dropped := p.dropped
+			p.mu.Unlock()
+			if len(batch) == 0 {
+				break
+			}
+
+			if err := p.publish(ctx, batch); err != nil {
+				publishErrorsTotal.Inc()
+				p.logger.Error("failed to publish events", "error", err, "pending", p.Pending(), "retry_in", wait)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+				wait = min(wait*2, maxBackoff)
+				continue
+			}
+			wait = p.cfg.RetryInterval
+
+			p.mu.Lock()
+			// events dropped for space while publishing were the front of
+			// this batch and are gone already
+			n := max(len(batch)-int(p.dropped-dropped), 0)
+			p.buf = append(p.buf[:0], p.buf[n:]...)
+			pendingEvents.Set(float64(len(p.buf)))
+			p.mu.Unlock()
+		}
+	}
+}
+
+func (p *Publisher) publish(ctx context.Context, batch []Event) error {
+	msgs := make([]Message, 0, len(batch))
+	for _, ev := range batch {
+		msg, err := p.message(ev)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, msg)
+	}
+	start := time.Now()
+	if err := p.cfg.Broker.Publish(ctx, msgs); err != nil {
+		return err
+	}
+	publishDuration.Observe(time.Since(start).Seconds())
+	for _, ev := range batch {
+		publishedTotal.WithLabelValues(ev.Type).Inc()
+	}
+	return nil
+}
+
+func (p *Publisher) message(ev Event) (Message, error) {
+	value, err := json.Marshal(ev)
+	if err != nil {
+		return Message{}, err
+	}
+	msg := Message{
+		Value:   value,
+		Headers: map[string]string{"schema-version": strconv.Itoa(ev.Version), "event-type": ev.Type},
+	}
+	switch ev.Type {
+	case TypeAlert:
+		// keep the transitions of a rule in order on one partition
+		msg.Topic, msg.Key = p.cfg.AlertsTopic, []byte(strconv.Itoa(ev.Alert.RuleId))
+	default:
+		msg.Topic = p.cfg.ReadingsTopic
+	}
+	return msg, nil
+}
@@ -0,0 +1,88 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeBroker struct {
+	mu    sync.Mutex
+	fail  int
+	msgs  []Message
+	calls int
+}
+
+func (b *fakeBroker) Publish(ctx context.Context, msgs []Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls++
+	if b.fail > 0 {
+		b.fail--
+		return errors.New("broker down")
+	}
+	b.msgs = append(b.msgs, msgs...)
+	return nil
+}
+
+func (b *fakeBroker) Close() error { return nil }
+
+func (b *fakeBroker) published() []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Message(nil), b.msgs...)
+}
+
+func TestPublisher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := &fakeBroker{fail: 1}
+	p := NewPublisher(Config{
+		Broker:        broker,
+		RetryInterval: 10 * time.Millisecond,
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	p.now = func() time.Time { return time.Unix(1761388200, 0) }
+	go p.Run(ctx)
+
+	ts := int64(1761388101)
+	require.NoError(t, p.Write(ctx, []store.TemperatureReading{{TempCo: 40.5, Timestamp: &ts}}))
+	p.Alert(store.AlertEvent{RuleId: 3, RuleName: "boiler hot", State: store.AlertFiring, Value: 80, Timestamp: ts})
+
+	require.Eventually(t, func() bool { return len(broker.published()) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 0, p.Pending())
+
+	msgs := broker.published()
+	assert.Equal(t, DefaultReadingsTopic, msgs[0].Topic)
+	assert.Nil(t, msgs[0].Key)
+	assert.Equal(t, map[string]string{"schema-version": "1", "event-type": TypeReading}, msgs[0].Headers)
+	assert.JSONEq(t, `{"version": 1, "type": "reading", "time": 1761388200,
+		"reading": {"id": 0, "tempCo": 40.5, "tempRoom": 0, "humidity": 0, "timestamp": 1761388101}}`, string(msgs[0].Value))
+
+	assert.Equal(t, DefaultAlertsTopic, msgs[1].Topic)
+	assert.Equal(t, []byte("3"), msgs[1].Key)
+	var ev Event
+	require.NoError(t, json.Unmarshal(msgs[1].Value, &ev))
+	assert.Equal(t, SchemaVersion, ev.Version)
+	assert.Equal(t, "boiler hot", ev.Alert.RuleName)
+	assert.Equal(t, store.AlertFiring, ev.Alert.State)
+}
+
+func TestPublisherMaxBuffer(t *testing.T) {
+	p := NewPublisher(Config{Broker: &fakeBroker{}, MaxBuffer: 2, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	for i := range 3 {
+		p.Alert(store.AlertEvent{RuleId: i})
+	}
+	assert.Equal(t, 2, p.Pending())
+	assert.Equal(t, 1, p.buf[0].Alert.RuleId)
+}
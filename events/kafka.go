@@ -0,0 +1,47 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Kafka publishes to a Kafka cluster, creating missing topics.
+type Kafka struct {
+	w *kafka.Writer
+}
+
+var _ Broker = (*Kafka)(nil)
+
+// NewKafka connects lazily to brokers, host:port addresses of the cluster.
+func NewKafka(brokers []string) *Kafka {
+	return &Kafka{w: &kafka.Writer{
+		Addr: kafka.TCP(brokers...),
+		// messages with the same key, i.e. the same alert rule, keep their
+		// order on one partition
+		Balancer:               &kafka.Hash{},
+		RequiredAcks:           kafka.RequireAll,
+		AllowAutoTopicCreation: true,
+		WriteTimeout:           10 * time.Second,
+	}}
+}
+
+func (k *Kafka) Publish(ctx context.Context, msgs []Message) error {
+	kmsgs := make([]kafka.Message, len(msgs))
+	for i, m := range msgs {
+		kmsgs[i] = kafka.Message{Topic: m.Topic, Key: m.Key, Value: m.Value}
+		for k, v := range m.Headers {
+			kmsgs[i].Headers = append(kmsgs[i].Headers, kafka.Header{Key: k, Value: []byte(v)})
+		}
+	}
+	if err := k.w.WriteMessages(ctx, kmsgs...); err != nil {
+		return fmt.Errorf("kafka publish: %w", err)
+	}
+	return nil
+}
+
+func (k *Kafka) Close() error {
+	return k.w.Close()
+}
@@ -0,0 +1,94 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NATS publishes to NATS JetStream and waits for every message to be
+// stored.
+type NATS struct {
+	// URL is the server URL, e.g. nats://nats:4222.
+	URL string
+	// Stream, when set, is created or updated on connect to capture
+	// Subjects. Leave it empty when the stream is managed elsewhere.
+	Stream   string
+	Subjects []string
+	Options  []nats.Option
+
+	mu sync.Mutex
+	nc *nats.Conn
+	js jetstream.JetStream
+}
+
+var _ Broker = (*NATS)(nil)
+
+func (n *NATS) connect(ctx context.Context) (jetstream.JetStream, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.js != nil {
+		return n.js, nil
+	}
+	nc, err := nats.Connect(n.URL, append([]nats.Option{nats.Name("esp8266-web"), nats.Timeout(10 * time.Second)}, n.Options...)...)
+	if err != nil {
+		return nil, fmt.Errorf("nats connect %s: %w", n.URL, err)
+	}
+	js, err := jetstream.New(nc, jetstream.WithPublishAsyncTimeout(10*time.Second))
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("nats jetstream: %w", err)
+	}
+	if n.Stream != "" {
+		if _, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{Name: n.Stream, Subjects: n.Subjects}); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("nats stream %s: %w", n.Stream, err)
+		}
+	}
+	n.nc, n.js = nc, js
+	return js, nil
+}
+
+func (n *NATS) Publish(ctx context.Context, msgs []Message) error {
+	js, err := n.connect(ctx)
+	if err != nil {
+		return err
+	}
+	acks := make([]jetstream.PubAckFuture, 0, len(msgs))
+	for _, m := range msgs {
+		msg := nats.NewMsg(m.Topic)
+		msg.Data = m.Value
+		for k, v := range m.Headers {
+			msg.Header.Set(k, v)
+		}
+		ack, err := js.PublishMsgAsync(msg)
+		if err != nil {
+			return fmt.Errorf("nats publish %s: %w", m.Topic, err)
+		}
+		acks = append(acks, ack)
+	}
+	for _, ack := range acks {
+		select {
+		case <-ack.Ok():
+		case err := <-ack.Err():
+			return fmt.Errorf("nats publish %s: %w", ack.Msg().Subject, err)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (n *NATS) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.nc != nil {
+		n.nc.Close()
+		n.nc, n.js = nil, nil
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package export
+
+import (
+	"io"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+// ReadingSchema is the Arrow schema of readings in the columnar exports.
+// Device is null when unknown and timestamp when the reading has none.
+var ReadingSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "id", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "device", Type: arrow.BinaryTypes.String, Nullable: true},
+	{Name: "timestamp", Type: &arrow.TimestampType{Unit: arrow.Second, TimeZone: "UTC"}, Nullable: true},
+	{Name: "tempCo", Type: arrow.PrimitiveTypes.Float64},
+	{Name: "tempRoom", Type: arrow.PrimitiveTypes.Float64},
+	{Name: "humidity", Type: arrow.PrimitiveTypes.Float64},
+}, nil)
+
+// record returns readings as a record of ReadingSchema; the caller releases
+// it.
+func record(readings []store.TemperatureReading) arrow.Record {
+	b := array.NewRecordBuilder(memory.DefaultAllocator, ReadingSchema)
+	defer b.Release()
+	b.Reserve(len(readings))
+	ids := b.Field(0).(*array.Int64Builder)
+	devices := b.Field(1).(*array.StringBuilder)
+	timestamps := b.Field(2).(*array.TimestampBuilder)
+	tempCo := b.Field(3).(*array.Float64Builder)
+	tempRoom := b.Field(4).(*array.Float64Builder)
+	humidity := b.Field(5).(*array.Float64Builder)
+	for _, r := range readings {
+		ids.Append(int64(r.Id))
+		if r.Device == "" {
+			devices.AppendNull()
+		} else {
+			devices.Append(r.Device)
+		}
+		if r.Timestamp == nil {
+			timestamps.AppendNull()
+		} else {
+			timestamps.Append(arrow.Timestamp(*r.Timestamp))
+		}
+		tempCo.Append(r.TempCo)
+		tempRoom.Append(r.TempRoom)
+		humidity.Append(r.Humidity)
+	}
+	return b.NewRecord()
+}
+
+// ArrowWriter writes readings as an Arrow IPC stream of ReadingSchema, a
+// record batch per Write, which clients read batch by batch as it arrives.
+type ArrowWriter struct {
+	w *ipc.Writer
+}
+
+func NewArrowWriter(w io.Writer) *ArrowWriter {
+	return &ArrowWriter{w: ipc.NewWriter(w, ipc.WithSchema(ReadingSchema))}
+}
+
+// Write writes readings as a record batch.
+func (a *ArrowWriter) Write(readings []store.TemperatureReading) error {
+	rec := record(readings)
+	defer rec.Release()
+	return a.w.Write(rec)
+}
+
+// Close ends the stream.
+func (a *ArrowWriter) Close() error {
+	return a.w.Close()
+}
@@ -0,0 +1,141 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet/file"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xuri/excelize/v2"
+)
+
+func reading(device string, ts int64, co, room, humidity float64) store.TemperatureReading {
+	return store.TemperatureReading{Device: device, TempCo: co, TempRoom: room, Humidity: humidity, Timestamp: &ts}
+}
+
+func TestXLSX(t *testing.T) {
+	loc := time.FixedZone("CEST", 2*60*60)
+	readings := []store.TemperatureReading{
+		reading("boiler", 1761386400, 40, 21, 50), // 2025-10-25 12:00 CEST
+		reading("attic", 1761386460, 20, 18, 60),
+		reading("boiler", 1761390000, 60, 23, 40),
+		{Device: "boiler", TempCo: 99},
+		reading("", 1761393600, 30, 20, 55),
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, XLSX(&buf, readings, loc))
+	f, err := excelize.OpenReader(&buf)
+	require.NoError(t, err)
+	defer f.Close()
+	assert.Equal(t, []string{"Summary", "Readings", "attic", "boiler"}, f.GetSheetList())
+
+	rows, err := f.GetRows("Summary", excelize.Options{RawCellValue: true})
+	require.NoError(t, err)
+	require.Len(t, rows, 4)
+	assert.Equal(t, []string{"Device", "Date", "Readings"}, rows[0][:3])
+	assert.Equal(t, "boiler", rows[3][0])
+	assert.Equal(t, []string{"2", "40", "60", "50"}, rows[3][2:6])
+	date, err := f.GetCellValue("Summary", "B4")
+	require.NoError(t, err)
+	assert.Equal(t, "10-25-25", date)
+
+	rows, err = f.GetRows("boiler")
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	assert.Equal(t, []string{"Time", "CO (°C)", "Room (°C)", "Humidity (%)"}, rows[0])
+	// local wall clock time, not a unix timestamp
+	assert.Equal(t, []string{"10/25/25 13:00", "60", "23", "40"}, rows[2])
+
+	// no readings still make a workbook
+	buf.Reset()
+	require.NoError(t, XLSX(&buf, nil, loc))
+	f, err = excelize.OpenReader(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Summary"}, f.GetSheetList())
+}
+
+func TestSheetName(t *testing.T) {
+	used := make(map[string]bool)
+	assert.Equal(t, "attic", sheetName("attic", used))
+	assert.Equal(t, "Attic (2)", sheetName("Attic", used))
+	assert.Equal(t, "summary (2)", sheetName("summary", used))
+	assert.Equal(t, "Readings", sheetName("", used))
+	assert.Equal(t, "floor_1_room_2", sheetName("floor/1:room?2", used))
+	assert.Equal(t, "_", sheetName("''", used))
+	assert.Equal(t, "a-very-long-device-name-that-go", sheetName("a-very-long-device-name-that-goes-on", used))
+	assert.Equal(t, "a-very-long-device-name-tha (2)", sheetName("a-very-long-device-name-that-goes-on-and-on", used))
+}
+
+func TestParquetWriter(t *testing.T) {
+	var buf bytes.Buffer
+	pw, err := NewParquetWriter(&buf)
+	require.NoError(t, err)
+	require.NoError(t, pw.Write([]store.TemperatureReading{
+		reading("boiler", 1761390000, 60, 23, 40),
+		reading("boiler", 1761386400, 40, 21, 50),
+	}))
+	require.NoError(t, pw.Write([]store.TemperatureReading{{TempCo: 99}}))
+	require.NoError(t, pw.Close())
+
+	rdr, err := file.NewParquetReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	defer rdr.Close()
+	assert.Equal(t, 2, rdr.NumRowGroups())
+
+	table, err := pqarrow.ReadTable(context.Background(), bytes.NewReader(buf.Bytes()), nil, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	require.NoError(t, err)
+	defer table.Release()
+	assert.Equal(t, int64(3), table.NumRows())
+	// Parquet has no second timestamps, they are read back in milliseconds
+	for i, f := range table.Schema().Fields() {
+		assert.Equal(t, ReadingSchema.Field(i).Name, f.Name)
+	}
+	ts := table.Column(2).Data().Chunk(0).(*array.Timestamp)
+	assert.Equal(t, arrow.Timestamp(1761390000000), ts.Value(0))
+	assert.True(t, ts.IsNull(2))
+
+	rec := record([]store.TemperatureReading{reading("", 1761386400, 40, 21, 50)})
+	defer rec.Release()
+	assert.True(t, rec.Column(1).IsNull(0))
+	assert.Equal(t, arrow.Timestamp(1761386400), rec.Column(2).(*array.Timestamp).Value(0))
+}
+
+func TestArrowWriter(t *testing.T) {
+	var buf bytes.Buffer
+	aw := NewArrowWriter(&buf)
+	require.NoError(t, aw.Write([]store.TemperatureReading{
+		reading("boiler", 1761390000, 60, 23, 40),
+		reading("boiler", 1761386400, 40, 21, 50),
+	}))
+	require.NoError(t, aw.Write([]store.TemperatureReading{reading("attic", 1761386460, 20, 18, 60)}))
+	require.NoError(t, aw.Close())
+
+	rdr, err := ipc.NewReader(&buf)
+	require.NoError(t, err)
+	defer rdr.Release()
+	assert.True(t, rdr.Schema().Equal(ReadingSchema))
+	var rows []int64
+	for rdr.Next() {
+		rows = append(rows, rdr.Record().NumRows())
+	}
+	require.NoError(t, rdr.Err())
+	assert.Equal(t, []int64{2, 1}, rows)
+
+	// an empty stream still has the schema
+	buf.Reset()
+	require.NoError(t, NewArrowWriter(&buf).Close())
+	rdr, err = ipc.NewReader(&buf)
+	require.NoError(t, err)
+	defer rdr.Release()
+	assert.False(t, rdr.Next())
+}
@@ -0,0 +1,38 @@
+package export
+
+import (
+	"io"
+
+	"github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/compress"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+// ParquetWriter writes readings as a zstd-compressed Parquet file of
+// ReadingSchema, a row group per Write, so long ranges are written without
+// holding them in memory.
+type ParquetWriter struct {
+	fw *pqarrow.FileWriter
+}
+
+func NewParquetWriter(w io.Writer) (*ParquetWriter, error) {
+	props := parquet.NewWriterProperties(parquet.WithCompression(compress.Codecs.Zstd))
+	fw, err := pqarrow.NewFileWriter(ReadingSchema, w, props, pqarrow.NewArrowWriterProperties(pqarrow.WithStoreSchema()))
+	if err != nil {
+		return nil, err
+	}
+	return &ParquetWriter{fw: fw}, nil
+}
+
+// Write writes readings as a row group.
+func (p *ParquetWriter) Write(readings []store.TemperatureReading) error {
+	rec := record(readings)
+	defer rec.Release()
+	return p.fw.Write(rec)
+}
+
+// Close writes the file footer; the file is unreadable without it.
+func (p *ParquetWriter) Close() error {
+	return p.fw.Close()
+}
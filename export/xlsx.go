@@ -0,0 +1,167 @@
+// Package export writes readings as files for people who analyse them
+// elsewhere: Excel workbooks for spreadsheets, Parquet for analytics tools
+// such as DuckDB or pandas and Arrow IPC streams for programs.
+package export
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/aggregate"
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	summarySheet = "Summary"
+	// unnamedSheet holds the readings of devices that didn't say who they
+	// are.
+	unnamedSheet = "Readings"
+	// maxSheetName is the longest sheet name Excel allows.
+	maxSheetName = 31
+)
+
+// XLSX writes readings, oldest first, as a workbook with a sheet of daily
+// stats per device in loc, then a sheet per device of its readings. Times
+// are spreadsheet dates in loc, not unix timestamps, so they need no
+// converting.
+func XLSX(w io.Writer, readings []store.TemperatureReading, loc *time.Location) error {
+	byDevice := make(map[string][]store.TemperatureReading)
+	for _, r := range readings {
+		if r.Timestamp != nil {
+			byDevice[r.Device] = append(byDevice[r.Device], r)
+		}
+	}
+	devices := make([]string, 0, len(byDevice))
+	for device := range byDevice {
+		devices = append(devices, device)
+	}
+	slices.Sort(devices)
+
+	f := excelize.NewFile()
+	defer f.Close()
+	if err := f.SetSheetName("Sheet1", summarySheet); err != nil {
+		return err
+	}
+	dateStyle, err := f.NewStyle(&excelize.Style{NumFmt: 14})
+	if err != nil {
+		return err
+	}
+	timeStyle, err := f.NewStyle(&excelize.Style{NumFmt: 22})
+	if err != nil {
+		return err
+	}
+	headerStyle, err := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		return err
+	}
+	header := func(names ...string) []any {
+		cells := make([]any, len(names))
+		for i, name := range names {
+			cells[i] = excelize.Cell{StyleID: headerStyle, Value: name}
+		}
+		return cells
+	}
+
+	summary, err := f.NewStreamWriter(summarySheet)
+	if err != nil {
+		return err
+	}
+	if err := summary.SetColWidth(1, 2, 16); err != nil {
+		return err
+	}
+	if err := summary.SetRow("A1", header("Device", "Date", "Readings",
+		"CO min (°C)", "CO max (°C)", "CO mean (°C)",
+		"Room min (°C)", "Room max (°C)", "Room mean (°C)",
+		"Humidity min (%)", "Humidity max (%)", "Humidity mean (%)")); err != nil {
+		return err
+	}
+	row := 2
+	used := make(map[string]bool)
+	for _, device := range devices {
+		name := sheetName(device, used)
+		for _, d := range aggregate.Daily(byDevice[device], loc) {
+			date, err := time.ParseInLocation(time.DateOnly, d.Date, loc)
+			if err != nil {
+				return err
+			}
+			cell, _ := excelize.CoordinatesToCellName(1, row)
+			if err := summary.SetRow(cell, []any{
+				name, excelize.Cell{StyleID: dateStyle, Value: date}, d.Count,
+				d.TempCo.Min, d.TempCo.Max, d.TempCo.Mean,
+				d.TempRoom.Min, d.TempRoom.Max, d.TempRoom.Mean,
+				d.Humidity.Min, d.Humidity.Max, d.Humidity.Mean,
+			}); err != nil {
+				return err
+			}
+			row++
+		}
+
+		if _, err := f.NewSheet(name); err != nil {
+			return err
+		}
+		sheet, err := f.NewStreamWriter(name)
+		if err != nil {
+			return err
+		}
+		if err := sheet.SetColWidth(1, 1, 20); err != nil {
+			return err
+		}
+		if err := sheet.SetRow("A1", header("Time", "CO (°C)", "Room (°C)", "Humidity (%)")); err != nil {
+			return err
+		}
+		for i, r := range byDevice[device] {
+			cell, _ := excelize.CoordinatesToCellName(1, i+2)
+			if err := sheet.SetRow(cell, []any{
+				excelize.Cell{StyleID: timeStyle, Value: time.Unix(*r.Timestamp, 0).In(loc)},
+				r.TempCo, r.TempRoom, r.Humidity,
+			}); err != nil {
+				return err
+			}
+		}
+		if err := sheet.Flush(); err != nil {
+			return err
+		}
+	}
+	if err := summary.Flush(); err != nil {
+		return err
+	}
+	_, err = f.WriteTo(w)
+	return err
+}
+
+// sheetName returns a name for the device's sheet that Excel accepts and
+// that isn't used yet, marking it used.
+func sheetName(device string, used map[string]bool) string {
+	name := device
+	if name == "" {
+		name = unnamedSheet
+	}
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, "'")
+	if name == "" {
+		name = "_"
+	}
+	candidate := truncate(name, maxSheetName)
+	for i := 2; used[strings.ToLower(candidate)] || strings.EqualFold(candidate, summarySheet); i++ {
+		suffix := fmt.Sprintf(" (%d)", i)
+		candidate = truncate(name, maxSheetName-len(suffix)) + suffix
+	}
+	used[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
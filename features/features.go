@@ -0,0 +1,209 @@
+// Package features holds the feature flags switched at runtime through
+// PUT /admin/settings, e.g. to pause ingestion during a migration, without
+// a restart.
+package features
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+// The feature flags.
+const (
+	// Alerts evaluates the alert rules against incoming readings and
+	// escalates firing alerts. Switched off, alerts neither fire, resolve
+	// nor notify.
+	Alerts = "alerts"
+	// IngestPaused rejects incoming readings with 503, so devices keep
+	// them and retry.
+	IngestPaused = "ingest_paused"
+	// ReadOnly rejects every request changing data with 503, readings
+	// included, except the admin endpoints and ad-hoc queries.
+	ReadOnly = "read_only"
+)
+
+// Defaults are the values of the flags never set; they also list the flags.
+var Defaults = map[string]bool{Alerts: true, IngestPaused: false, ReadOnly: false}
+
+// RefreshInterval is how long the flags read from the store are used before
+// they're read again, so a flag switched through another replica takes
+// effect here within it.
+const RefreshInterval = 10 * time.Second
+
+// Flags are the feature flags. They're kept in the store when it is a
+// store.FeatureStore, and otherwise in memory until a restart.
+type Flags struct {
+	store  store.FeatureStore
+	logger *slog.Logger
+	now    func() time.Time
+
+	mu     sync.Mutex
+	values map[string]bool
+	readAt time.Time
+	// pinned are the flags set by Pin, whatever the store says.
+	pinned map[string]bool
+	// changes are the changes made without a FeatureStore.
+	changes []store.FeatureChange
+}
+
+// New returns the flags of st, at their stored values or Defaults.
+func New(st store.Store, logger *slog.Logger) *Flags {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	f := &Flags{logger: logger, now: time.Now, values: maps.Clone(Defaults)}
+	f.store, _ = st.(store.FeatureStore)
+	return f
+}
+
+// ErrPinned rejects changing a flag fixed by Pin.
+var ErrPinned = errors.New("set by a command line flag")
+
+// Pin fixes the flag at value, e.g. ReadOnly from --read-only, so it can't
+// be switched at runtime.
+func (f *Flags) Pin(name string, value bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pinned == nil {
+		f.pinned = make(map[string]bool)
+	}
+	f.pinned[name] = value
+	f.values[name] = value
+}
+
+// Enabled reports whether the flag is on. When reading the flags from the
+// store fails, the values read before stay in effect.
+func (f *Flags) Enabled(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.store != nil && f.now().Sub(f.readAt) >= RefreshInterval {
+		f.readAt = f.now()
+		if err := f.read(context.Background()); err != nil {
+			f.logger.Error("Failed to read feature flags", "error", err)
+		}
+	}
+	return f.values[name]
+}
+
+// AlertsEnabled reports whether the Alerts flag is on, for
+// alert.Config.Enabled.
+func (f *Flags) AlertsEnabled() bool {
+	return f.Enabled(Alerts)
+}
+
+// IngestPaused reports whether readings are rejected, as the IngestPaused
+// or ReadOnly flag is on, for ingest.Config.Paused.
+func (f *Flags) IngestPaused() bool {
+	return f.Enabled(IngestPaused) || f.Enabled(ReadOnly)
+}
+
+// read must be called with mu held.
+func (f *Flags) read(ctx context.Context) error {
+	stored, err := f.store.FeatureFlags(ctx)
+	if err != nil {
+		return err
+	}
+	values := maps.Clone(Defaults)
+	for name, v := range stored {
+		if _, known := Defaults[name]; known {
+			values[name] = v
+		}
+	}
+	maps.Copy(values, f.pinned)
+	f.values = values
+	return nil
+}
+
+// All returns every flag, read from the store.
+func (f *Flags) All(ctx context.Context) (map[string]bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.store != nil {
+		if err := f.read(ctx); err != nil {
+			return nil, err
+		}
+		f.readAt = f.now()
+	}
+	return maps.Clone(f.values), nil
+}
+
+// Set switches the flags of changes, recording the changes with actor, and
+// returns every flag. It rejects unknown flags and, with ErrPinned, pinned
+// ones.
+func (f *Flags) Set(ctx context.Context, changes map[string]bool, actor string) (map[string]bool, error) {
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(changes)) {
+		if _, known := Defaults[name]; !known {
+			errs = append(errs, fmt.Errorf("unknown setting %q", name))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, &UnknownError{err}
+	}
+
+	at := f.now().Unix()
+	recorded := make([]store.FeatureChange, 0, len(changes))
+	for _, name := range slices.Sorted(maps.Keys(changes)) {
+		recorded = append(recorded, store.FeatureChange{Name: name, Value: changes[name], Actor: actor, At: at})
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range recorded {
+		if _, pinned := f.pinned[c.Name]; pinned {
+			return nil, fmt.Errorf("setting %q: %w", c.Name, ErrPinned)
+		}
+	}
+	if f.store != nil {
+		if err := f.store.SetFeatureFlags(ctx, recorded); err != nil {
+			return nil, err
+		}
+		if err := f.read(ctx); err != nil {
+			return nil, err
+		}
+		f.readAt = f.now()
+	} else {
+		maps.Copy(f.values, changes)
+		for _, c := range recorded {
+			c.Id = int64(len(f.changes) + 1)
+			f.changes = append(f.changes, c)
+		}
+	}
+	for _, c := range recorded {
+		f.logger.Info("Changed setting", slog.String("name", c.Name), slog.Bool("value", c.Value), slog.String("actor", c.Actor))
+	}
+	return maps.Clone(f.values), nil
+}
+
+// Changes returns the recorded changes, newest first.
+func (f *Flags) Changes(ctx context.Context, limit int) ([]store.FeatureChange, error) {
+	if f.store != nil {
+		return f.store.ListFeatureChanges(ctx, limit)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	changes := make([]store.FeatureChange, 0, min(limit, len(f.changes)))
+	for _, c := range slices.Backward(f.changes) {
+		if len(changes) == limit {
+			break
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// UnknownError rejects changing flags that don't exist.
+type UnknownError struct {
+	Err error
+}
+
+func (e *UnknownError) Error() string { return e.Err.Error() }
+
+func (e *UnknownError) Unwrap() error { return e.Err }
@@ -0,0 +1,75 @@
+package features
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlags(t *testing.T) {
+	st := memory.New()
+	f := New(st, nil)
+	assert.True(t, f.AlertsEnabled())
+	assert.False(t, f.IngestPaused())
+
+	_, err := f.Set(t.Context(), map[string]bool{"maintenance": true, ReadOnly: true}, "ops")
+	var unknownErr *UnknownError
+	require.ErrorAs(t, err, &unknownErr)
+	assert.False(t, f.Enabled(ReadOnly))
+
+	flags, err := f.Set(t.Context(), map[string]bool{ReadOnly: true}, "ops")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{Alerts: true, IngestPaused: false, ReadOnly: true}, flags)
+	assert.True(t, f.IngestPaused())
+
+	changes, err := f.Changes(t.Context(), 10)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, "ops", changes[0].Actor)
+}
+
+func TestFlagsRefresh(t *testing.T) {
+	st := memory.New()
+	now := time.Unix(1761388000, 0)
+	replica := New(st, nil)
+	replica.now = func() time.Time { return now }
+	assert.True(t, replica.Enabled(Alerts))
+
+	// switched through another replica
+	require.NoError(t, st.SetFeatureFlags(t.Context(), []store.FeatureChange{{Name: Alerts, Value: false, Actor: "ops", At: now.Unix()}}))
+	assert.True(t, replica.Enabled(Alerts))
+	now = now.Add(RefreshInterval)
+	assert.False(t, replica.Enabled(Alerts))
+}
+
+func TestFlagsWithoutStore(t *testing.T) {
+	f := New(struct{ store.Store }{memory.New()}, nil)
+	_, err := f.Set(t.Context(), map[string]bool{IngestPaused: true}, "ops")
+	require.NoError(t, err)
+	_, err = f.Set(t.Context(), map[string]bool{IngestPaused: false}, "ops")
+	require.NoError(t, err)
+	assert.False(t, f.IngestPaused())
+
+	changes, err := f.Changes(t.Context(), 1)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, store.FeatureChange{Id: 2, Name: IngestPaused, Value: false, Actor: "ops", At: changes[0].At}, changes[0])
+}
+
+func TestFlagsPinned(t *testing.T) {
+	st := memory.New()
+	require.NoError(t, st.SetFeatureFlags(t.Context(), []store.FeatureChange{{Name: ReadOnly, Value: false, Actor: "ops"}}))
+	f := New(st, nil)
+	f.Pin(ReadOnly, true)
+
+	_, err := f.Set(t.Context(), map[string]bool{ReadOnly: false}, "ops")
+	assert.ErrorIs(t, err, ErrPinned)
+	flags, err := f.All(t.Context())
+	require.NoError(t, err)
+	assert.True(t, flags[ReadOnly])
+	assert.True(t, f.IngestPaused())
+}
@@ -0,0 +1,415 @@
+// Package forward replicates an instance's readings to an upstream
+// esp8266-web instance, so a LAN instance can act as an edge gateway for a
+// cloud one.
+//
+// The edge's store is the copy the upstream converges to. Readings are
+// replicated by device and time range, in buckets of Config.Bucket aligned
+// to multiples of it; pushing a bucket replaces the upstream's readings of
+// the device stamped in it with the edge's, through PUT /sync/range, so a
+// retried push never stores a reading twice. Every Config.Interval the
+// forwarder pushes, for the devices that received readings since the last
+// push, the buckets of those readings and every bucket from the device's
+// upstream high-water mark, the newest timestamp stored upstream, on. After
+// a partition of any length the first successful push therefore catches
+// up.
+//
+// Every Config.ReconcileInterval, and when it starts, the forwarder also
+// compares the content hashes of every bucket within Config.Window of its
+// devices with the upstream's and pushes the buckets that differ. Once a
+// reconciliation succeeds without new readings arriving, the upstream holds
+// exactly the edge's readings of the window.
+package forward
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+const (
+	DefaultInterval          = 10 * time.Second
+	DefaultReconcileInterval = time.Hour
+	DefaultBucket            = time.Hour
+	DefaultWindow            = 7 * 24 * time.Hour
+	// maxBackoff caps the wait between failed pushes.
+	maxBackoff = 5 * time.Minute
+	// pageSize is how many readings are loaded from the store at once.
+	pageSize = 1000
+)
+
+type Config struct {
+	// URL is the upstream base URL, e.g. https://temp.example.com.
+	URL string
+	// SecretKey is the upstream's X-Secret-Key.
+	SecretKey string
+	// Device names readings sent to this instance without a device
+	// upstream.
+	Device string
+	// Store is this instance's store, which readings are replicated from.
+	Store store.FilterStore
+	// Interval between pushes, defaults to DefaultInterval.
+	Interval time.Duration
+	// ReconcileInterval between reconciliations, defaults to
+	// DefaultReconcileInterval.
+	ReconcileInterval time.Duration
+	// Bucket is the width of the ranges pushed and compared, defaults to
+	// DefaultBucket. A bucket's readings must fit one upstream request.
+	Bucket time.Duration
+	// Window is how far back reconciliation compares, defaults to and is at
+	// most DefaultWindow, the most the upstream compares at once.
+	Window time.Duration
+	Client *http.Client
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+type Forwarder struct {
+	cfg    Config
+	client *http.Client
+	logger *slog.Logger
+	now    func() time.Time
+
+	// since is the receive time from which readings haven't been pushed
+	// yet, zero before the first push.
+	since int64
+}
+
+func New(cfg Config) *Forwarder {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.ReconcileInterval <= 0 {
+		cfg.ReconcileInterval = DefaultReconcileInterval
+	}
+	if cfg.Bucket <= 0 {
+		cfg.Bucket = DefaultBucket
+	}
+	if cfg.Window <= 0 || cfg.Window > DefaultWindow {
+		cfg.Window = DefaultWindow
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	client := cfg.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &Forwarder{cfg: cfg, client: client, logger: cfg.Logger, now: time.Now}
+}
+
+// Run reconciles, then pushes every interval and reconciles every
+// reconcile interval until ctx is done, backing off exponentially while
+// the upstream fails.
+func (f *Forwarder) Run(ctx context.Context) {
+	wait, reconciled := time.Duration(0), time.Time{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		var err error
+		if f.now().Sub(reconciled) >= f.cfg.ReconcileInterval {
+			if err = f.Reconcile(ctx); err == nil {
+				reconciled = f.now()
+			}
+		} else {
+			err = f.Push(ctx)
+		}
+		if err != nil {
+			wait = min(max(wait*2, f.cfg.Interval), maxBackoff)
+			f.logger.Error("failed to forward readings", "error", err, "retry_in", wait)
+			continue
+		}
+		wait = f.cfg.Interval
+	}
+}
+
+// Push pushes the buckets of the readings received since the last push or
+// reconciliation and the buckets from their devices' high-water marks on.
+// Before either, readings received within the window count as new.
+func (f *Forwarder) Push(ctx context.Context) error {
+	start := f.now().Unix()
+	since := f.since
+	if since == 0 {
+		since = start - int64(f.cfg.Window/time.Second)
+	}
+	fresh, err := f.list(ctx, store.ReadingQuery{Filters: []store.ReadingFilter{{Field: "receivedAt", Op: "gte", Value: float64(since)}}})
+	if err != nil {
+		return err
+	}
+	touched := make(map[string]map[int64]bool)
+	for _, r := range fresh {
+		if touched[r.Device] == nil {
+			touched[r.Device] = make(map[int64]bool)
+		}
+		touched[r.Device][f.bucket(*r.Timestamp)] = true
+	}
+	if len(touched) > 0 {
+		devices := slices.Sorted(maps.Keys(touched))
+		marks, err := f.marks(ctx, devices)
+		if err != nil {
+			return err
+		}
+		for _, device := range devices {
+			if err := f.pushFrom(ctx, device, f.bucket(marks[device]), touched[device]); err != nil {
+				return err
+			}
+		}
+	}
+	// readings received during the push are pushed again next time, which
+	// is harmless
+	f.since = start
+	return nil
+}
+
+// Reconcile catches up the devices with readings within the window whose
+// high-water marks are before it, then compares the digests of the
+// window's buckets of every such device with the upstream's and pushes
+// those that differ.
+func (f *Forwarder) Reconcile(ctx context.Context) error {
+	start := f.now().Unix()
+	to := f.bucket(start) + f.width()
+	// the buckets within the window, the current one included
+	from := f.bucket(to - int64(f.cfg.Window/time.Second) + f.width() - 1)
+	readings, err := f.list(ctx, store.ReadingQuery{Filters: []store.ReadingFilter{{Field: "timestamp", Op: "gte", Value: float64(from)}}})
+	if err != nil {
+		return err
+	}
+	byDevice := make(map[string][]store.TemperatureReading)
+	for _, r := range readings {
+		byDevice[r.Device] = append(byDevice[r.Device], r)
+	}
+	devices := slices.Sorted(maps.Keys(byDevice))
+	if len(devices) == 0 {
+		f.since = start
+		return nil
+	}
+
+	marks, err := f.marks(ctx, devices)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if mark := f.bucket(marks[device]); mark < from {
+			if err := f.pushFrom(ctx, device, mark, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	var upstream struct {
+		Digests map[string][]store.ReadingDigest `json:"digests"`
+	}
+	req := map[string]any{"devices": f.upstreamNames(devices), "from": from, "to": to, "bucket": f.width()}
+	if err := f.call(ctx, http.MethodPost, "/sync/digests", req, &upstream); err != nil {
+		return err
+	}
+	pushed := 0
+	for _, device := range devices {
+		buckets := f.buckets(byDevice[device])
+		local := make(map[int64]store.ReadingDigest)
+		for _, d := range store.DigestReadings(byDevice[device], f.width()) {
+			local[d.From] = d
+		}
+		remote := make(map[int64]store.ReadingDigest)
+		for _, d := range upstream.Digests[f.upstreamName(device)] {
+			remote[d.From] = d
+		}
+		for _, bucket := range slices.Sorted(maps.Keys(union(local, remote))) {
+			if local[bucket] == remote[bucket] {
+				continue
+			}
+			if err := f.pushBucket(ctx, device, bucket, buckets[bucket]); err != nil {
+				return err
+			}
+			pushed++
+		}
+	}
+	if pushed > 0 {
+		f.logger.Info("reconciled readings upstream", "devices", len(devices), "buckets_pushed", pushed)
+	}
+	f.since = start
+	return nil
+}
+
+// marks returns the upstream high-water marks of devices.
+func (f *Forwarder) marks(ctx context.Context, devices []string) (map[string]int64, error) {
+	var resp struct {
+		Marks map[string]int64 `json:"marks"`
+	}
+	if err := f.call(ctx, http.MethodPost, "/sync/marks", map[string]any{"devices": f.upstreamNames(devices)}, &resp); err != nil {
+		return nil, err
+	}
+	marks := make(map[string]int64, len(devices))
+	for _, device := range devices {
+		marks[device] = resp.Marks[f.upstreamName(device)]
+	}
+	return marks, nil
+}
+
+// pushFrom pushes the buckets of device's readings stamped from from on and
+// the extra buckets, older ones that changed.
+func (f *Forwarder) pushFrom(ctx context.Context, device string, from int64, extra map[int64]bool) error {
+	newer, err := f.list(ctx, store.ReadingQuery{
+		Devices: []string{device},
+		Filters: []store.ReadingFilter{{Field: "timestamp", Op: "gte", Value: float64(from)}},
+	})
+	if err != nil {
+		return err
+	}
+	buckets := f.buckets(newer)
+	for bucket := range extra {
+		if _, ok := buckets[bucket]; ok || bucket >= from {
+			continue
+		}
+		readings, err := f.list(ctx, store.ReadingQuery{
+			Devices: []string{device},
+			Filters: []store.ReadingFilter{
+				{Field: "timestamp", Op: "gte", Value: float64(bucket)},
+				{Field: "timestamp", Op: "lt", Value: float64(bucket + f.width())},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		buckets[bucket] = readings
+	}
+	for _, bucket := range slices.Sorted(maps.Keys(buckets)) {
+		if err := f.pushBucket(ctx, device, bucket, buckets[bucket]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushBucket replaces the upstream's readings of device in the bucket from
+// with readings and checks that the upstream's digest of the bucket then
+// matches.
+func (f *Forwarder) pushBucket(ctx context.Context, device string, from int64, readings []store.TemperatureReading) error {
+	type rangeReading struct {
+		TempCo    float64 `json:"tempCo"`
+		TempRoom  float64 `json:"tempRoom"`
+		Humidity  float64 `json:"humidity"`
+		Timestamp *int64  `json:"timestamp"`
+		Quality   string  `json:"quality,omitempty"`
+	}
+	payload := make([]rangeReading, len(readings))
+	for i, r := range readings {
+		payload[i] = rangeReading{TempCo: r.TempCo, TempRoom: r.TempRoom, Humidity: r.Humidity, Timestamp: r.Timestamp, Quality: r.Quality}
+	}
+	var got store.ReadingDigest
+	req := map[string]any{"device": f.upstreamName(device), "from": from, "to": from + f.width(), "readings": payload}
+	if err := f.call(ctx, http.MethodPut, "/sync/range", req, &got); err != nil {
+		return err
+	}
+	if want := store.Digest(from, readings); got != want {
+		return fmt.Errorf("forward: upstream digest of %s at %d is %s of %d readings, want %s of %d", device, from, got.Hash, got.Count, want.Hash, want.Count)
+	}
+	f.logger.Debug("forwarded readings", "device", device, "from", from, "count", len(readings))
+	return nil
+}
+
+// buckets groups readings by bucket.
+func (f *Forwarder) buckets(readings []store.TemperatureReading) map[int64][]store.TemperatureReading {
+	buckets := make(map[int64][]store.TemperatureReading)
+	for _, r := range readings {
+		bucket := f.bucket(*r.Timestamp)
+		buckets[bucket] = append(buckets[bucket], r)
+	}
+	return buckets
+}
+
+// list returns the readings selected by q, those without a timestamp left
+// out. Every page continues after the last one's last reading, so readings
+// stored meanwhile don't shift the pages.
+func (f *Forwarder) list(ctx context.Context, q store.ReadingQuery) ([]store.TemperatureReading, error) {
+	var readings []store.TemperatureReading
+	for {
+		page, err := f.cfg.Store.ListFilteredReadings(ctx, q, pageSize, 0)
+		if err != nil {
+			return nil, fmt.Errorf("forward: list readings: %w", err)
+		}
+		for _, r := range page {
+			if r.Timestamp != nil {
+				readings = append(readings, r)
+			}
+		}
+		if len(page) < pageSize {
+			return readings, nil
+		}
+		after := store.CursorAfter(page[len(page)-1])
+		q.After = &after
+	}
+}
+
+func (f *Forwarder) call(ctx context.Context, method, path string, body, resp any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimRight(f.cfg.URL, "/") + path
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Secret-Key", f.cfg.SecretKey)
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("forward: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("forward: %s %s: unexpected status %s", method, path, res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(resp); err != nil {
+		return fmt.Errorf("forward: decode response: %w", err)
+	}
+	return nil
+}
+
+func (f *Forwarder) width() int64 { return int64(f.cfg.Bucket / time.Second) }
+
+// bucket returns the start of the bucket ts is in.
+func (f *Forwarder) bucket(ts int64) int64 {
+	return ts - ((ts%f.width())+f.width())%f.width()
+}
+
+// upstreamName returns the upstream name of device.
+func (f *Forwarder) upstreamName(device string) string {
+	if device == "" {
+		return f.cfg.Device
+	}
+	return device
+}
+
+func (f *Forwarder) upstreamNames(devices []string) []string {
+	names := make([]string, len(devices))
+	for i, d := range devices {
+		names[i] = f.upstreamName(d)
+	}
+	return names
+}
+
+// union returns the keys of a and b.
+func union[V any](a, b map[int64]V) map[int64]bool {
+	keys := make(map[int64]bool, len(a)+len(b))
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	return keys
+}
@@ -0,0 +1,154 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/server"
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// now is when the tests run, readings are stamped before it.
+var now = time.Unix(1761388101, 0)
+
+// insert stores n readings of device a minute apart from ts, each received
+// when stamped.
+func insert(t *testing.T, st *memory.Store, device string, ts int64, n int) {
+	t.Helper()
+	for i := range n {
+		ts := ts + int64(i*60)
+		received := ts
+		_, err := st.InsertReading(context.Background(), store.TemperatureReading{
+			Device: device, TempCo: 40, TempRoom: 21, Humidity: 50, Timestamp: &ts, ReceivedAt: &received,
+		})
+		require.NoError(t, err)
+	}
+}
+
+// upstream returns an upstream instance that fails while down is set.
+func upstream(t *testing.T, down *atomic.Bool) (*memory.Store, *httptest.Server) {
+	st := memory.New()
+	handler := server.NewServer(server.Config{SecretKey: "upstream", Logger: discard}, st)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return st, srv
+}
+
+// synced asserts that the upstream holds readings of device exactly like
+// the edge's.
+func synced(t *testing.T, edge, cloud *memory.Store, device, upstreamDevice string) {
+	t.Helper()
+	ctx := context.Background()
+	want, err := edge.ListFilteredReadings(ctx, store.ReadingQuery{Devices: []string{device}}, 1000, 0)
+	require.NoError(t, err)
+	got, err := cloud.ListFilteredReadings(ctx, store.ReadingQuery{Devices: []string{upstreamDevice}}, 1000, 0)
+	require.NoError(t, err)
+	assert.Equal(t, store.Digest(0, want), store.Digest(0, got))
+}
+
+func TestForwarderPush(t *testing.T) {
+	ctx := context.Background()
+	var down atomic.Bool
+	cloud, srv := upstream(t, &down)
+	edge := memory.New()
+	f := New(Config{URL: srv.URL, SecretKey: "upstream", Device: "lan", Store: edge, Logger: discard})
+	clock := now
+	f.now = func() time.Time { return clock }
+
+	insert(t, edge, "", now.Unix()-3*3600, 150)
+	insert(t, edge, "attic", now.Unix()-600, 5)
+	require.NoError(t, f.Push(ctx))
+	synced(t, edge, cloud, "", "lan")
+	synced(t, edge, cloud, "attic", "attic")
+	// pushing again stores nothing twice
+	require.NoError(t, f.Push(ctx))
+	f.since = 0
+	require.NoError(t, f.Push(ctx))
+	synced(t, edge, cloud, "", "lan")
+
+	// a partition longer than the window is caught up from the high-water
+	// mark
+	down.Store(true)
+	clock = clock.Add(10 * 24 * time.Hour)
+	insert(t, edge, "attic", clock.Unix()-9*24*3600, 3)
+	assert.Error(t, f.Push(ctx))
+	insert(t, edge, "attic", clock.Unix()-60, 1)
+	down.Store(false)
+	require.NoError(t, f.Push(ctx))
+	synced(t, edge, cloud, "attic", "attic")
+}
+
+func TestForwarderList(t *testing.T) {
+	edge := memory.New()
+	f := New(Config{URL: "http://upstream.invalid", SecretKey: "upstream", Store: edge, Logger: discard})
+
+	// more readings stamped the same second than fit a page
+	ts := now.Unix()
+	rs := make([]store.TemperatureReading, 2*pageSize+10)
+	for i := range rs {
+		rs[i] = store.TemperatureReading{TempCo: 40, Timestamp: &ts}
+	}
+	_, err := edge.InsertReadings(context.Background(), rs)
+	require.NoError(t, err)
+
+	readings, err := f.list(context.Background(), store.ReadingQuery{})
+	require.NoError(t, err)
+	require.Len(t, readings, len(rs))
+	ids := make(map[int]bool)
+	for _, r := range readings {
+		ids[r.Id] = true
+	}
+	assert.Len(t, ids, len(rs))
+}
+
+func TestForwarderReconcile(t *testing.T) {
+	ctx := context.Background()
+	var down atomic.Bool
+	cloud, srv := upstream(t, &down)
+	edge := memory.New()
+	f := New(Config{URL: srv.URL, SecretKey: "upstream", Device: "lan", Store: edge, Logger: discard})
+	f.now = func() time.Time { return now }
+
+	insert(t, edge, "", now.Unix()-5*3600, 60)
+	insert(t, edge, "attic", now.Unix()-600, 5)
+	require.NoError(t, f.Reconcile(ctx))
+	synced(t, edge, cloud, "", "lan")
+	synced(t, edge, cloud, "attic", "attic")
+
+	// readings only upstream are removed and differing ones replaced
+	insert(t, cloud, "lan", now.Unix()-2*3600+30, 2)
+	ts := now.Unix() - 5*3600
+	require.NoError(t, cloud.ReplaceReadings(ctx, "lan", ts, ts+1, []store.TemperatureReading{{TempCo: 99, Timestamp: &ts}}))
+	require.NoError(t, f.Reconcile(ctx))
+	synced(t, edge, cloud, "", "lan")
+	synced(t, edge, cloud, "attic", "attic")
+}
+
+func TestForwarderWrongSecret(t *testing.T) {
+	srv := httptest.NewServer(server.NewServer(server.Config{SecretKey: "upstream", Logger: discard}, memory.New()))
+	defer srv.Close()
+
+	edge := memory.New()
+	insert(t, edge, "", now.Unix()-60, 1)
+	f := New(Config{URL: srv.URL, SecretKey: "wrong", Device: "lan", Store: edge, Logger: discard})
+	f.now = func() time.Time { return now }
+	assert.ErrorContains(t, f.Push(context.Background()), "403")
+	assert.Zero(t, f.since, "failed pushes are retried")
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// runHealthcheck handles `healthcheck [flags]`: it exits non-zero unless
+// the server at the configured address is ready, for container health
+// checks in images without curl or wget.
+func runHealthcheck(logger *slog.Logger, args []string) error {
+	var cfg config
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	timeout := fs.Duration("timeout", 5*time.Second, "How long to wait for the server to answer")
+	fs.Parse(args)
+	if err := cfg.applyProfile(fs, logger); err != nil {
+		return err
+	}
+	if err := cfg.applyEnv(logger); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	return checkReady(ctx, readyURL(cfg.host, cfg.port))
+}
+
+// readyURL is the readiness endpoint of a server listening on host:port,
+// reached over loopback when it listens on every interface.
+func readyURL(host string, port int) string {
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(port)) + "/readyz"
+}
+
+func checkReady(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("health check: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check: %s answered %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package ingest
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+)
+
+// HTTPAdapter receives readings at POST /ingest/{name}.
+type HTTPAdapter interface {
+	// Name is the path segment and the adapter label of metrics.
+	Name() string
+	// Authorize reports whether r may ingest with key. It is called with
+	// every accepted secret key, the current one first, and r may ingest
+	// if any call returns true.
+	Authorize(r *http.Request, key string) bool
+	// Parse decodes the readings in r.
+	Parse(r *http.Request) (Batch, error)
+}
+
+// MethodsAdapter is an HTTPAdapter accepting other methods than POST.
+type MethodsAdapter interface {
+	HTTPAdapter
+	// Methods are the methods it accepts.
+	Methods() []string
+}
+
+// Listener receives readings on its own, e.g. from a broker subscription,
+// and ingests them until ctx is done.
+type Listener interface {
+	Name() string
+	Run(ctx context.Context, p *Pipeline) error
+}
+
+// SecretKeyHeader authorizes requests carrying the secret key in the
+// X-Secret-Key header, like the built-in endpoints. Adapters embed it
+// unless their platform can't set headers.
+type SecretKeyHeader struct{}
+
+func (SecretKeyHeader) Authorize(r *http.Request, key string) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Secret-Key")), []byte(key)) == 1
+}
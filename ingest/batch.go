@@ -0,0 +1,152 @@
+package ingest
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// When Ingest answers with Config.BatchInterval set.
+const (
+	// AckStored answers once the readings are stored, so a failed insert
+	// fails the request and the device can retry.
+	AckStored = "stored"
+	// AckQueued answers once the readings are queued. A failed insert or a
+	// crash before the next flush loses them.
+	AckQueued = "queued"
+)
+
+// AckModes are the valid Config.Ack values.
+var AckModes = []string{AckStored, AckQueued}
+
+const (
+	// DefaultBatchWorkers is how many workers flush queued readings.
+	DefaultBatchWorkers = 2
+	// queueSize is how many batches may wait for a flush before Ingest
+	// blocks.
+	queueSize = 1024
+)
+
+var flushSize = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "esp8266_ingest_flush_readings",
+	Help:    "Readings stored by one flush of the ingest queue.",
+	Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+})
+
+// queued is a batch waiting to be flushed.
+type queued struct {
+	// ctx carries the request's logger.
+	ctx      context.Context
+	device   string
+	adapter  string
+	readings []store.TemperatureReading
+	// done receives the result of the insert with AckStored; with
+	// AckQueued the worker runs what follows storing the readings.
+	done chan error
+}
+
+// enqueue hands readings to the workers and, with AckStored, waits until
+// they're stored.
+func (p *Pipeline) enqueue(ctx context.Context, adapter, device string, readings []store.TemperatureReading) error {
+	q := queued{ctx: context.WithoutCancel(ctx), device: device, adapter: adapter, readings: readings}
+	if p.cfg.Ack != AckQueued {
+		q.done = make(chan error, 1)
+	}
+	select {
+	case p.queue <- q:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if q.done == nil {
+		return nil
+	}
+	select {
+	case err := <-q.done:
+		return err
+	case <-ctx.Done():
+		// the readings may still be stored
+		return ctx.Err()
+	}
+}
+
+// Run flushes the queued readings every Config.BatchInterval until ctx is
+// done, then flushes what's left. It returns at once without batching, and
+// must be running for Ingest to store readings with it.
+func (p *Pipeline) Run(ctx context.Context) {
+	if p.queue == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for range p.cfg.BatchWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *Pipeline) work(ctx context.Context) {
+	ticker := time.NewTicker(p.cfg.BatchInterval)
+	defer ticker.Stop()
+
+	var pending []queued
+	size := 0
+	for {
+		select {
+		case q := <-p.queue:
+			if size+len(q.readings) > MaxBatchSize {
+				p.flush(pending)
+				pending, size = nil, 0
+			}
+			pending = append(pending, q)
+			size += len(q.readings)
+		case <-ticker.C:
+			p.flush(pending)
+			pending, size = nil, 0
+		case <-ctx.Done():
+			for {
+				select {
+				case q := <-p.queue:
+					pending = append(pending, q)
+				default:
+					p.flush(pending)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush stores the readings of every pending batch with one insert.
+func (p *Pipeline) flush(pending []queued) {
+	if len(pending) == 0 {
+		return
+	}
+	var readings []store.TemperatureReading
+	for _, q := range pending {
+		readings = append(readings, q.readings...)
+	}
+	// the worker's context may be done already, the store times out calls
+	_, err := p.store.InsertReadings(context.Background(), readings)
+	flushSize.Observe(float64(len(readings)))
+	if err != nil {
+		p.logger.Error("Failed to flush queued readings", slog.Int("count", len(readings)), slog.Int("batches", len(pending)), "error", err)
+	}
+	for _, q := range pending {
+		if q.done != nil {
+			q.done <- err
+			continue
+		}
+		if err == nil {
+			readingsTotal.WithLabelValues(q.adapter, "stored").Add(float64(len(q.readings)))
+			p.Accepted(q.ctx, q.device, q.readings...)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package ingest
+
+import (
+	"sync"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+// dedupKey identifies a reading; a device re-sending after a lost response
+// sends the same timestamp and values again.
+type dedupKey struct {
+	device                     string
+	timestamp                  int64
+	tempCo, tempRoom, humidity float64
+}
+
+func newDedupKey(device string, r store.TemperatureReading) dedupKey {
+	return dedupKey{device: device, timestamp: *r.Timestamp, tempCo: r.TempCo, tempRoom: r.TempRoom, humidity: r.Humidity}
+}
+
+// dedup remembers the most recent keys, forgetting the oldest first.
+type dedup struct {
+	mu   sync.Mutex
+	keys map[dedupKey]struct{}
+	ring []dedupKey
+	next int
+}
+
+func newDedup(size int) *dedup {
+	return &dedup{keys: make(map[dedupKey]struct{}, size), ring: make([]dedupKey, 0, size)}
+}
+
+func (d *dedup) seen(key dedupKey) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.keys[key]
+	return ok
+}
+
+func (d *dedup) add(keys ...dedupKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, key := range keys {
+		if _, ok := d.keys[key]; ok {
+			continue
+		}
+		if len(d.ring) < cap(d.ring) {
+			d.ring = append(d.ring, key)
+		} else {
+			delete(d.keys, d.ring[d.next])
+			d.ring[d.next] = key
+			d.next = (d.next + 1) % len(d.ring)
+		}
+		d.keys[key] = struct{}{}
+	}
+}
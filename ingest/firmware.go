@@ -0,0 +1,264 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+const (
+	FormatTasmota = "tasmota"
+	FormatESPHome = "esphome"
+)
+
+// FieldMap maps reading fields, tempCo, tempRoom and humidity, to the names
+// firmware reports values under.
+type FieldMap map[string]string
+
+// ValidateFieldMaps checks field maps, keyed by format and then by device
+// or DefaultDecoder.
+func ValidateFieldMaps(maps map[string]map[string]FieldMap) error {
+	var errs []error
+	for format, devices := range maps {
+		if format != FormatTasmota && format != FormatESPHome {
+			errs = append(errs, fmt.Errorf("format must be %s or %s, not %q", FormatTasmota, FormatESPHome, format))
+			continue
+		}
+		for device, fields := range devices {
+			for field, name := range fields {
+				if !contains(readingFields, field) {
+					errs = append(errs, fmt.Errorf("%s %s: unknown field %q", format, device, field))
+				}
+				if name == "" {
+					errs = append(errs, fmt.Errorf("%s %s: empty name for %s", format, device, field))
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Firmware accepts the JSON off-the-shelf firmware sends, so devices
+// running it need no custom sketch. The device query parameter names the
+// device, e.g. /ingest/tasmota?device=%topic%.
+//
+// Tasmota (FormatTasmota) sends SENSOR telemetry, optionally wrapped in
+// SENSOR or StatusSNS:
+//
+//	{"Time": "2025-10-25T10:28:21", "DS18B20": {"Temperature": 40.5}, "AM2301": {"Temperature": 21.5, "Humidity": 50}, "TempUnit": "C"}
+//
+// Values are named by their sensor and key, e.g. DS18B20.Temperature.
+// Unmapped, tempCo is the first DS18B20 temperature and tempRoom and
+// humidity come from the first sensor reporting both. Fahrenheit is
+// converted. Time is the device's local time without a zone, so the
+// reading is stamped on receipt instead.
+//
+// ESPHome (FormatESPHome) sends an http_request json body of name-value
+// pairs, or web server state objects, {"id": "sensor-temp_co", "value":
+// 40.5}, alone or in an array. Values may be numeric strings. Unmapped
+// names are temp_co, temp_room and humidity.
+type Firmware struct {
+	SecretKeyHeader
+	// Format is FormatTasmota or FormatESPHome, it is also the adapter name.
+	Format string
+
+	mu     sync.RWMutex
+	fields map[string]FieldMap
+}
+
+var _ HTTPAdapter = (*Firmware)(nil)
+
+// NewFirmware returns an adapter for format with field maps keyed by device
+// or DefaultDecoder.
+func NewFirmware(format string, fields map[string]FieldMap) *Firmware {
+	return &Firmware{Format: format, fields: fields}
+}
+
+func (f *Firmware) Name() string { return f.Format }
+
+// SetFields replaces the field maps, e.g. on a settings reload.
+func (f *Firmware) SetFields(fields map[string]FieldMap) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fields = fields
+}
+
+func (f *Firmware) fieldMap(device string) FieldMap {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if m, ok := f.fields[device]; ok && device != "" {
+		return m
+	}
+	return f.fields[DefaultDecoder]
+}
+
+func (f *Firmware) Parse(r *http.Request) (Batch, error) {
+	device := r.URL.Query().Get("device")
+	var (
+		values map[string]float64
+		err    error
+	)
+	switch f.Format {
+	case FormatTasmota:
+		values, err = tasmotaValues(r)
+	case FormatESPHome:
+		values, err = esphomeValues(r)
+	default:
+		return Batch{}, fmt.Errorf("unknown firmware format %q", f.Format)
+	}
+	if err != nil {
+		return Batch{}, err
+	}
+
+	fields := f.fieldMap(device)
+	var (
+		tr    store.TemperatureReading
+		found bool
+	)
+	for _, field := range readingFields {
+		name, ok := fields[field]
+		if !ok {
+			name = f.defaultName(field, values)
+		}
+		v, ok := values[name]
+		if !ok {
+			continue
+		}
+		found = true
+		switch field {
+		case "tempCo":
+			tr.TempCo = v
+		case "tempRoom":
+			tr.TempRoom = v
+		case "humidity":
+			tr.Humidity = v
+		}
+	}
+	if !found {
+		return Batch{}, errors.New("no mapped values in payload")
+	}
+	return Batch{Device: device, Readings: []store.TemperatureReading{tr}}, nil
+}
+
+// defaultName is the name of field when it isn't mapped.
+func (f *Firmware) defaultName(field string, values map[string]float64) string {
+	if f.Format == FormatESPHome {
+		return map[string]string{"tempCo": "temp_co", "tempRoom": "temp_room", "humidity": "humidity"}[field]
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		sensor, key, _ := strings.Cut(name, ".")
+		switch field {
+		case "tempCo":
+			if strings.HasPrefix(sensor, "DS18B20") && key == "Temperature" {
+				return name
+			}
+		case "tempRoom", "humidity":
+			_, hasTemp := values[sensor+".Temperature"]
+			_, hasHumidity := values[sensor+".Humidity"]
+			if hasTemp && hasHumidity {
+				if field == "tempRoom" {
+					return sensor + ".Temperature"
+				}
+				return sensor + ".Humidity"
+			}
+		}
+	}
+	return ""
+}
+
+func tasmotaValues(r *http.Request) (map[string]float64, error) {
+	var msg map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		return nil, err
+	}
+	for _, wrapper := range []string{"SENSOR", "StatusSNS"} {
+		if inner, ok := msg[wrapper].(map[string]any); ok {
+			msg = inner
+		}
+	}
+	fahrenheit := msg["TempUnit"] == "F"
+
+	values := make(map[string]float64)
+	for sensor, v := range msg {
+		readings, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		for key, v := range readings {
+			x, ok := v.(float64)
+			if !ok {
+				continue
+			}
+			if fahrenheit && key == "Temperature" {
+				x = math.Round((x-32)/1.8*100) / 100
+			}
+			values[sensor+"."+key] = x
+		}
+	}
+	return values, nil
+}
+
+func esphomeValues(r *http.Request) (map[string]float64, error) {
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(r.Body); err != nil {
+		return nil, err
+	}
+	data := bytes.TrimSpace(body.Bytes())
+
+	var objects []map[string]any
+	if len(data) > 0 && data[0] == '[' {
+		if err := json.Unmarshal(data, &objects); err != nil {
+			return nil, err
+		}
+	} else {
+		var object map[string]any
+		if err := json.Unmarshal(data, &object); err != nil {
+			return nil, err
+		}
+		objects = []map[string]any{object}
+	}
+
+	values := make(map[string]float64)
+	for _, object := range objects {
+		if id, ok := object["id"].(string); ok {
+			// a web server state, sensor-<name>
+			if v, ok := esphomeNumber(object["value"]); ok {
+				values[strings.TrimPrefix(id, "sensor-")] = v
+			}
+			continue
+		}
+		for name, v := range object {
+			if x, ok := esphomeNumber(v); ok {
+				values[name] = x
+			}
+		}
+	}
+	return values, nil
+}
+
+// esphomeNumber accepts numbers and numeric strings, which is what json
+// values rendered by templates are.
+func esphomeNumber(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		x, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return x, err == nil
+	}
+	return 0, false
+}
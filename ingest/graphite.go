@@ -0,0 +1,297 @@
+package ingest
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+// graphiteFlushDelay is how long a reading waits for more of its fields
+// after the last one arrived.
+const graphiteFlushDelay = time.Second
+
+// MetricPath maps the metrics of a path to a reading field of a device. A *
+// component of Path matches any one component; Device, when empty, is the
+// component the first * matched.
+type MetricPath struct {
+	Path   string `yaml:"path"`
+	Device string `yaml:"device"`
+	Field  string `yaml:"field"`
+}
+
+// match returns the device of path when p matches it.
+func (p MetricPath) match(path string) (string, bool) {
+	want, got := strings.Split(p.Path, "."), strings.Split(path, ".")
+	if len(want) != len(got) {
+		return "", false
+	}
+	device := p.Device
+	for i, c := range want {
+		switch {
+		case c == "*":
+			if device == "" {
+				device = got[i]
+			}
+		case c != got[i]:
+			return "", false
+		}
+	}
+	return device, true
+}
+
+// ValidateMetricPaths checks that every path has a pattern and a reading
+// field.
+func ValidateMetricPaths(paths []MetricPath) error {
+	var errs []error
+	for i, p := range paths {
+		if p.Path == "" {
+			errs = append(errs, fmt.Errorf("path %d: path is required", i))
+		}
+		if !contains(readingFields, p.Field) {
+			errs = append(errs, fmt.Errorf("path %s: unknown field %q", p.Path, p.Field))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Graphite receives graphite plaintext lines over TCP and StatsD gauge
+// lines over UDP, e.g. from collectd's write_graphite plugin:
+//
+//	home.livingroom.temp 21.4 1761388101
+//	home.livingroom.humidity:48|g
+//
+// Metrics are mapped to devices and reading fields by the first matching
+// MetricPath; unmapped ones are skipped. The fields of a device sent with
+// the same timestamp, or for StatsD in the same second, make one reading,
+// ingested once no field arrived for a second. StatsD lines of other types
+// are skipped and gauge values are taken as they are, a sign doesn't make
+// them a delta. Access is controlled by the network.
+type Graphite struct {
+	// Addr is the TCP address for graphite plaintext, e.g. :2003, empty
+	// disables it.
+	Addr string
+	// StatsDAddr is the UDP address for StatsD, e.g. :8125, empty disables
+	// it.
+	StatsDAddr string
+	// Listener and StatsDConn are served instead of listening on Addr and
+	// StatsDAddr when set, e.g. sockets handed over by an upgrade.
+	Listener   net.Listener
+	StatsDConn net.PacketConn
+
+	mu      sync.Mutex
+	paths   []MetricPath
+	pending map[pendingKey]*pendingReading
+}
+
+// pendingKey is a reading waiting for more of its fields.
+type pendingKey struct {
+	device string
+	ts     int64
+}
+
+type pendingReading struct {
+	tr      store.TemperatureReading
+	updated time.Time
+}
+
+var _ Listener = (*Graphite)(nil)
+
+// NewGraphite returns a listener on the addresses mapping metrics by paths.
+func NewGraphite(addr, statsdAddr string, paths []MetricPath) *Graphite {
+	return &Graphite{Addr: addr, StatsDAddr: statsdAddr, paths: paths, pending: make(map[pendingKey]*pendingReading)}
+}
+
+func (g *Graphite) Name() string { return "graphite" }
+
+// SetPaths replaces the metric paths, e.g. on a settings reload.
+func (g *Graphite) SetPaths(paths []MetricPath) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paths = paths
+}
+
+func (g *Graphite) Run(ctx context.Context, p *Pipeline) error {
+	if ln := g.Listener; ln != nil || g.Addr != "" {
+		if ln == nil {
+			var err error
+			if ln, err = net.Listen("tcp", g.Addr); err != nil {
+				return fmt.Errorf("graphite listen %s: %w", g.Addr, err)
+			}
+		}
+		context.AfterFunc(ctx, func() { ln.Close() })
+		go g.serveTCP(ctx, ln, p)
+	}
+	if conn := g.StatsDConn; conn != nil || g.StatsDAddr != "" {
+		if conn == nil {
+			var err error
+			if conn, err = net.ListenPacket("udp", g.StatsDAddr); err != nil {
+				return fmt.Errorf("statsd listen %s: %w", g.StatsDAddr, err)
+			}
+		}
+		context.AfterFunc(ctx, func() { conn.Close() })
+		go g.serveUDP(conn, p)
+	}
+
+	ticker := time.NewTicker(graphiteFlushDelay / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// the pipeline may still be flushing, so use a context of its own
+			g.flush(context.WithoutCancel(ctx), p, time.Time{})
+			return nil
+		case now := <-ticker.C:
+			g.flush(ctx, p, now.Add(-graphiteFlushDelay))
+		}
+	}
+}
+
+func (g *Graphite) serveTCP(ctx context.Context, ln net.Listener, p *Pipeline) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				p.logger.Error("graphite accept failed", "error", err)
+			}
+			return
+		}
+		stop := context.AfterFunc(ctx, func() { conn.Close() })
+		go func() {
+			defer stop()
+			defer conn.Close()
+			sc := bufio.NewScanner(conn)
+			for sc.Scan() {
+				g.line(p, sc.Text(), time.Now())
+			}
+		}()
+	}
+}
+
+func (g *Graphite) serveUDP(conn net.PacketConn, p *Pipeline) {
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		for line := range strings.SplitSeq(string(buf[:n]), "\n") {
+			g.line(p, line, now)
+		}
+	}
+}
+
+// line adds the value of a graphite or StatsD line received at now to its
+// pending reading.
+func (g *Graphite) line(p *Pipeline, line string, now time.Time) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	path, v, ts, ok, err := parseMetricLine(line)
+	if err != nil {
+		p.logger.Error("failed to parse metric line", "line", line, "error", err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, mp := range g.paths {
+		device, ok := mp.match(path)
+		if !ok {
+			continue
+		}
+		key := pendingKey{device: device, ts: now.Unix()}
+		if ts != nil {
+			key.ts = *ts
+		}
+		pr, ok := g.pending[key]
+		if !ok {
+			pr = &pendingReading{tr: store.TemperatureReading{Timestamp: ts}}
+			g.pending[key] = pr
+		}
+		switch mp.Field {
+		case "tempCo":
+			pr.tr.TempCo = v
+		case "tempRoom":
+			pr.tr.TempRoom = v
+		case "humidity":
+			pr.tr.Humidity = v
+		}
+		pr.updated = now
+		return
+	}
+}
+
+// parseMetricLine parses a graphite plaintext line, path value and an
+// optional timestamp, or a StatsD line, path:value|type. ok is false for
+// StatsD lines that aren't gauges.
+func parseMetricLine(line string) (path string, v float64, ts *int64, ok bool, err error) {
+	if path, rest, found := strings.Cut(line, ":"); found && !strings.ContainsAny(path, " \t") {
+		value, typ, _ := strings.Cut(rest, "|")
+		if typ, _, _ = strings.Cut(typ, "|"); typ != "g" {
+			return "", 0, nil, false, nil
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", 0, nil, false, fmt.Errorf("invalid value %q", value)
+		}
+		return path, v, nil, true, nil
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return "", 0, nil, false, errors.New("expected path, value and an optional timestamp")
+	}
+	if v, err = strconv.ParseFloat(fields[1], 64); err != nil {
+		return "", 0, nil, false, fmt.Errorf("invalid value %q", fields[1])
+	}
+	// collectd and others send -1 for now
+	if len(fields) == 3 && fields[2] != "-1" {
+		t, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return "", 0, nil, false, fmt.Errorf("invalid timestamp %q", fields[2])
+		}
+		sec := int64(t)
+		ts = &sec
+	}
+	return fields[0], v, ts, true, nil
+}
+
+// flush ingests the pending readings last updated before cutoff, all of
+// them when it is zero.
+func (g *Graphite) flush(ctx context.Context, p *Pipeline, cutoff time.Time) {
+	g.mu.Lock()
+	var keys []pendingKey
+	for key, pr := range g.pending {
+		if cutoff.IsZero() || pr.updated.Before(cutoff) {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b pendingKey) int { return cmp.Compare(a.ts, b.ts) })
+	batches := make(map[string][]store.TemperatureReading)
+	for _, key := range keys {
+		batches[key.device] = append(batches[key.device], g.pending[key].tr)
+		delete(g.pending, key)
+	}
+	g.mu.Unlock()
+
+	for device, readings := range batches {
+		if _, err := p.Ingest(ctx, g.Name(), Batch{Device: device, Readings: readings}); err != nil {
+			p.logger.Error("failed to ingest metrics", "device", device, "error", err)
+		}
+	}
+}
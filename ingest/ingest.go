@@ -0,0 +1,303 @@
+// Package ingest is the path every reading takes into the server, whatever
+// adapter received it: HTTP JSON, the legacy query-string endpoint, line
+// protocol, MQTT or a third-party webhook.
+//
+// Adapters only parse and authenticate. The Pipeline they hand readings to
+// validates, drops re-sent duplicates, stores and then forwards the
+// readings and evaluates the alert rules, the same way for every adapter.
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/alert"
+	"github.com/bartosz121/esp8266-web/control"
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const (
+	// MaxBatchSize is the most readings accepted in one batch.
+	MaxBatchSize = 10000
+	// DefaultDedupSize is how many recent readings are remembered to
+	// recognize re-sent ones.
+	DefaultDedupSize = 10000
+	// maxClockSkew is how far in the future a reading's timestamp may be.
+	maxClockSkew = 24 * time.Hour
+)
+
+var ErrBatchTooLarge = fmt.Errorf("batch too large, at most %d readings", MaxBatchSize)
+
+// ErrPaused rejects readings while Config.Paused reports ingestion paused.
+var ErrPaused = errors.New("ingestion is paused")
+
+// ValidationError rejects a reading; nothing of its batch is stored.
+type ValidationError struct {
+	// Index is the reading's position in its batch.
+	Index int
+	Err   error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("reading %d: %v", e.Index, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+var readingsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "esp8266_ingest_readings_total",
+	Help: "Readings received by adapter and result: stored, duplicate, invalid or paused.",
+}, []string{"adapter", "result"})
+
+// newestGauges hold the newest reading of every device, by rule field, for
+// Prometheus alerting rules; see alert.PrometheusRules.
+var newestGauges = func() map[string]*prometheus.GaugeVec {
+	gauges := make(map[string]*prometheus.GaugeVec, len(alert.Metrics))
+	for field, name := range alert.Metrics {
+		gauges[field] = promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: name,
+			Help: "Newest " + field + " reading by device.",
+		}, []string{"device"})
+	}
+	return gauges
+}()
+
+// Batch is what an adapter parsed out of one message.
+type Batch struct {
+	// Device sent the readings, when the adapter knows it.
+	Device   string
+	Readings []store.TemperatureReading
+}
+
+type Result struct {
+	// Stored are the readings as persisted. A batch of one is stored with
+	// InsertReading, so its Id is set, unless batching. With AckQueued they
+	// are the readings queued.
+	Stored []store.TemperatureReading
+	// Duplicates is how many readings were re-sent and dropped.
+	Duplicates int
+}
+
+type Config struct {
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+	// Alerts, when set, evaluates the alert rules against the newest
+	// stored reading of every batch.
+	Alerts *alert.Engine
+	// Control, when set, evaluates the thermostat zones against the newest
+	// stored reading of every batch.
+	Control *control.Controller
+	// Forward, when set, is called with every batch of newly stored
+	// readings, e.g. sink.Fanout.Enqueue. It must not block.
+	Forward func([]store.TemperatureReading)
+	// OnNewest, when set, is called with the newest stored reading of
+	// every batch and the device that sent it. It must not block.
+	OnNewest func(device string, r store.TemperatureReading)
+	// DedupSize defaults to DefaultDedupSize.
+	DedupSize int
+	// BatchInterval, when set, makes Ingest queue the readings for the
+	// workers of Run, which store everything queued every interval with
+	// one InsertReadings call. Batched readings are stored without an Id.
+	BatchInterval time.Duration
+	// BatchWorkers defaults to DefaultBatchWorkers.
+	BatchWorkers int
+	// Ack is when Ingest answers with BatchInterval set: AckStored, the
+	// default, or AckQueued.
+	Ack string
+	// Paused, when set, reports whether ingestion is paused, e.g. the
+	// features.IngestPaused flag. Meanwhile Ingest returns ErrPaused.
+	Paused func() bool
+	// MinFirmware, when set, is the oldest firmware version devices should
+	// run; devices reporting an older one are exported as outdated.
+	MinFirmware string
+	// AnomalyDelta, when set, is how many degrees a temperature may change
+	// between a device's readings before one is flagged anomalous.
+	AnomalyDelta float64
+}
+
+// Pipeline validates, deduplicates and stores readings from any adapter.
+type Pipeline struct {
+	store  store.Store
+	cfg    Config
+	logger *slog.Logger
+	dedup  *dedup
+	now    func() time.Time
+	// queue holds the batches waiting for a flush, nil without batching.
+	queue chan queued
+	// firmware are the versions devices reported.
+	firmware firmwareVersions
+	// previous are the readings new ones are checked for anomalies against.
+	previous previousReadings
+}
+
+func New(st store.Store, cfg Config) *Pipeline {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.DedupSize <= 0 {
+		cfg.DedupSize = DefaultDedupSize
+	}
+	if cfg.BatchWorkers <= 0 {
+		cfg.BatchWorkers = DefaultBatchWorkers
+	}
+	p := &Pipeline{store: st, cfg: cfg, logger: cfg.Logger, dedup: newDedup(cfg.DedupSize), now: time.Now}
+	if cfg.BatchInterval > 0 {
+		p.queue = make(chan queued, queueSize)
+	}
+	return p
+}
+
+// Validate checks a reading's values. Readings without a timestamp are
+// valid, they get the server's time.
+func Validate(r store.TemperatureReading, now time.Time) error {
+	for name, v := range map[string]float64{"tempCo": r.TempCo, "tempRoom": r.TempRoom, "humidity": r.Humidity} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("%s must be a finite number", name)
+		}
+	}
+	if r.Humidity < 0 || r.Humidity > 100 {
+		return errors.New("humidity must be between 0 and 100")
+	}
+	if r.Timestamp != nil && (*r.Timestamp <= 0 || *r.Timestamp > now.Add(maxClockSkew).Unix()) {
+		return errors.New("timestamp must be a unix time in seconds, at most a day ahead")
+	}
+	return nil
+}
+
+// Ingest validates b, received by the named adapter, and stores the
+// readings that weren't sent before. An invalid reading rejects the whole
+// batch.
+func (p *Pipeline) Ingest(ctx context.Context, adapter string, b Batch) (Result, error) {
+	if p.cfg.Paused != nil && p.cfg.Paused() {
+		readingsTotal.WithLabelValues(adapter, "paused").Add(float64(len(b.Readings)))
+		return Result{}, ErrPaused
+	}
+	if len(b.Readings) > MaxBatchSize {
+		return Result{}, ErrBatchTooLarge
+	}
+	now := p.now()
+	// measured before validation, a clock far enough ahead is rejected;
+	// readings stamped by the server don't count
+	if sent, ok := newestTimestamp(b.Readings); ok {
+		RecordSkew(b.Device, sent, now)
+	}
+	for i, r := range b.Readings {
+		if err := Validate(r, now); err != nil {
+			readingsTotal.WithLabelValues(adapter, "invalid").Add(float64(len(b.Readings)))
+			return Result{}, &ValidationError{Index: i, Err: err}
+		}
+	}
+
+	ts := now.UTC().Unix()
+	fresh := make([]store.TemperatureReading, 0, len(b.Readings))
+	var keys []dedupKey
+	for _, r := range b.Readings {
+		r.Device = b.Device
+		r.ReceivedAt = &ts
+		// a server timestamp makes every reading unique
+		if r.Timestamp == nil {
+			r.Timestamp = &ts
+		} else {
+			key := newDedupKey(b.Device, r)
+			if p.dedup.seen(key) || containsKey(keys, key) {
+				continue
+			}
+			keys = append(keys, key)
+		}
+		r.Quality = p.Quality(b.Device, r)
+		fresh = append(fresh, r)
+	}
+	result := Result{Duplicates: len(b.Readings) - len(fresh)}
+	readingsTotal.WithLabelValues(adapter, "duplicate").Add(float64(result.Duplicates))
+	if len(fresh) == 0 {
+		return result, nil
+	}
+
+	if p.queue != nil && p.cfg.Ack == AckQueued {
+		// the workers store and forward them later
+		if err := p.enqueue(ctx, adapter, b.Device, fresh); err != nil {
+			return Result{}, err
+		}
+		p.dedup.add(keys...)
+		result.Stored = fresh
+		return result, nil
+	}
+
+	switch {
+	case p.queue != nil:
+		if err := p.enqueue(ctx, adapter, b.Device, fresh); err != nil {
+			return Result{}, err
+		}
+		result.Stored = fresh
+	case len(fresh) == 1:
+		tr, err := p.store.InsertReading(ctx, fresh[0])
+		if err != nil {
+			return Result{}, err
+		}
+		result.Stored = []store.TemperatureReading{tr}
+	default:
+		if _, err := p.store.InsertReadings(ctx, fresh); err != nil {
+			return Result{}, err
+		}
+		result.Stored = fresh
+	}
+	// only remembered once stored, so a failed insert can be retried
+	p.dedup.add(keys...)
+	readingsTotal.WithLabelValues(adapter, "stored").Add(float64(len(result.Stored)))
+
+	p.Accepted(ctx, b.Device, result.Stored...)
+	return result, nil
+}
+
+func containsKey(keys []dedupKey, key dedupKey) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Accepted runs what follows storing readings sent by device, when known:
+// forwarding them, recording the device as seen, passing the newest to
+// OnNewest and evaluating the alert rules and thermostat zones against it.
+// Stores with their own dedup, e.g. the sync protocol, call it directly.
+func (p *Pipeline) Accepted(ctx context.Context, device string, readings ...store.TemperatureReading) {
+	if len(readings) == 0 {
+		return
+	}
+	if p.cfg.Forward != nil {
+		p.cfg.Forward(readings)
+	}
+	newest := readings[0]
+	for _, r := range readings[1:] {
+		if r.Timestamp != nil && (newest.Timestamp == nil || *r.Timestamp >= *newest.Timestamp) {
+			newest = r
+		}
+	}
+	for field, g := range newestGauges {
+		g.WithLabelValues(device).Set(alert.Value(newest, field))
+	}
+	Seen(device, p.now())
+	if p.cfg.OnNewest != nil {
+		p.cfg.OnNewest(device, newest)
+	}
+	// failures are logged; the readings are already stored
+	if p.cfg.Alerts != nil {
+		if err := p.cfg.Alerts.Evaluate(ctx, device, newest); err != nil {
+			slogctx.FromCtx(ctx).Error("Failed to evaluate alert rules", "error", err)
+		}
+	}
+	if p.cfg.Control != nil {
+		if err := p.cfg.Control.Evaluate(ctx, device, newest); err != nil {
+			slogctx.FromCtx(ctx).Error("Failed to evaluate thermostat zones", "error", err)
+		}
+	}
+}
@@ -0,0 +1,595 @@
+package ingest
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ts(v int64) *int64 { return &v }
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1761388101, 0)
+	assert.NoError(t, Validate(store.TemperatureReading{TempCo: 40, Humidity: 50, Timestamp: ts(1761388101)}, now))
+	assert.NoError(t, Validate(store.TemperatureReading{TempCo: -20}, now))
+	assert.Error(t, Validate(store.TemperatureReading{TempCo: math.NaN()}, now))
+	assert.Error(t, Validate(store.TemperatureReading{TempRoom: math.Inf(1)}, now))
+	assert.Error(t, Validate(store.TemperatureReading{Humidity: 101}, now))
+	assert.Error(t, Validate(store.TemperatureReading{Timestamp: ts(1761388101000)}, now))
+	assert.Error(t, Validate(store.TemperatureReading{Timestamp: ts(0)}, now))
+}
+
+func TestPipelineIngest(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	var forwarded []store.TemperatureReading
+	p := New(st, Config{Forward: func(rs []store.TemperatureReading) { forwarded = append(forwarded, rs...) }})
+	p.now = func() time.Time { return time.Unix(1761388200, 0) }
+
+	result, err := p.Ingest(ctx, "test", Batch{Readings: []store.TemperatureReading{{TempCo: 40, Timestamp: ts(1761388101)}}})
+	require.NoError(t, err)
+	require.Len(t, result.Stored, 1)
+	assert.Equal(t, 1, result.Stored[0].Id)
+	assert.Equal(t, int64(1761388200), *result.Stored[0].ReceivedAt)
+
+	// the same reading again, once more within the batch, and one without
+	// a timestamp which is never a duplicate
+	result, err = p.Ingest(ctx, "test", Batch{Readings: []store.TemperatureReading{
+		{TempCo: 40, Timestamp: ts(1761388101)},
+		{TempCo: 41, Timestamp: ts(1761388161)},
+		{TempCo: 41, Timestamp: ts(1761388161)},
+		{TempCo: 42},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Duplicates)
+	require.Len(t, result.Stored, 2)
+	assert.Equal(t, int64(1761388200), *result.Stored[1].Timestamp)
+
+	// other devices may send the same values
+	result, err = p.Ingest(ctx, "test", Batch{Device: "attic", Readings: []store.TemperatureReading{{TempCo: 40, Timestamp: ts(1761388101)}}})
+	require.NoError(t, err)
+	require.Len(t, result.Stored, 1)
+	assert.Equal(t, "attic", result.Stored[0].Device)
+	assert.Equal(t, 40.0, testutil.ToFloat64(newestGauges["tempCo"].WithLabelValues("attic")))
+
+	readings, err := st.ListReadings(ctx, 10, 0)
+	require.NoError(t, err)
+	assert.Len(t, readings, 4)
+	assert.Len(t, forwarded, 4)
+
+	_, err = p.Ingest(ctx, "test", Batch{Readings: []store.TemperatureReading{{TempCo: 43}, {Humidity: -1}}})
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, 1, validationErr.Index)
+
+	_, err = p.Ingest(ctx, "test", Batch{Readings: make([]store.TemperatureReading, MaxBatchSize+1)})
+	assert.ErrorIs(t, err, ErrBatchTooLarge)
+}
+
+// countingStore counts the InsertReadings calls.
+type countingStore struct {
+	store.Store
+	mu      sync.Mutex
+	inserts int
+}
+
+func (s *countingStore) InsertReadings(ctx context.Context, rs []store.TemperatureReading) (int64, error) {
+	s.mu.Lock()
+	s.inserts++
+	s.mu.Unlock()
+	return s.Store.InsertReadings(ctx, rs)
+}
+
+func TestPipelineBatching(t *testing.T) {
+	st := &countingStore{Store: memory.New()}
+	var forwarded atomic.Int64
+	p := New(st, Config{BatchInterval: 50 * time.Millisecond, BatchWorkers: 1, Forward: func(rs []store.TemperatureReading) { forwarded.Add(int64(len(rs))) }})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(stopped)
+	}()
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := p.Ingest(context.Background(), "test", Batch{Device: "attic", Readings: []store.TemperatureReading{{TempCo: float64(i), Timestamp: ts(1761388101 + int64(i))}}})
+			assert.NoError(t, err)
+			assert.Len(t, result.Stored, 1)
+		}()
+	}
+	wg.Wait()
+	readings, err := st.ListReadings(context.Background(), 100, 0)
+	require.NoError(t, err)
+	assert.Len(t, readings, 10)
+	assert.Less(t, st.inserts, 10)
+	assert.Equal(t, int64(10), forwarded.Load())
+
+	// queued readings are flushed when Run stops
+	p.cfg.Ack = AckQueued
+	_, err = p.Ingest(context.Background(), "test", Batch{Device: "attic", Readings: []store.TemperatureReading{{TempCo: 50, Timestamp: ts(1761388200)}}})
+	require.NoError(t, err)
+	cancel()
+	<-stopped
+	readings, err = st.ListReadings(context.Background(), 100, 0)
+	require.NoError(t, err)
+	assert.Len(t, readings, 11)
+	assert.Equal(t, int64(11), forwarded.Load())
+}
+
+func TestDedupForgetsOldest(t *testing.T) {
+	d := newDedup(2)
+	keys := []dedupKey{{timestamp: 1}, {timestamp: 2}, {timestamp: 3}}
+	d.add(keys...)
+	assert.False(t, d.seen(keys[0]))
+	assert.True(t, d.seen(keys[1]))
+	assert.True(t, d.seen(keys[2]))
+}
+
+func TestLineProtocol(t *testing.T) {
+	body := `# comment
+readings,device=attic temp_co=40.5,temp_room=21.5,humidity=50i 1761388101000
+other value=1
+readings,device=attic tempCo=41
+`
+	r := httptest.NewRequest("POST", "/ingest/line?precision=ms", strings.NewReader(body))
+	b, err := (&LineProtocol{Measurement: "readings"}).Parse(r)
+	require.NoError(t, err)
+	assert.Equal(t, Batch{Device: "attic", Readings: []store.TemperatureReading{
+		{TempCo: 40.5, TempRoom: 21.5, Humidity: 50, Timestamp: ts(1761388101)},
+		{TempCo: 41},
+	}}, b)
+
+	for _, body := range []string{"readings temp_co=warm", "readings", "readings temp_co=1 soon"} {
+		_, err := (&LineProtocol{}).Parse(httptest.NewRequest("POST", "/ingest/line", strings.NewReader(body)))
+		assert.Error(t, err, body)
+	}
+	_, err = (&LineProtocol{}).Parse(httptest.NewRequest("POST", "/ingest/line?precision=h", strings.NewReader("")))
+	assert.Error(t, err)
+}
+
+func TestPushgateway(t *testing.T) {
+	body := `# TYPE temp_room gauge
+temp_room 21.5
+# TYPE humidity gauge
+humidity 48
+temp_co 40.5 1761388101000
+# TYPE pushes_total counter
+pushes_total 3
+`
+	r := httptest.NewRequest("PUT", "/metrics/job/cron/instance/attic", strings.NewReader(body))
+	r.SetPathValue("job", "cron")
+	r.SetPathValue("labels", "instance/attic")
+	b, err := (&Pushgateway{}).Parse(r)
+	require.NoError(t, err)
+	assert.Equal(t, Batch{Device: "attic", Readings: []store.TemperatureReading{
+		{TempRoom: 21.5, Humidity: 48},
+		{TempCo: 40.5, Timestamp: ts(1761388101)},
+	}}, b)
+
+	r = httptest.NewRequest("POST", "/metrics/job/cron", strings.NewReader(`temperature{device="shed"} 12`+"\n"))
+	r.SetPathValue("job", "cron")
+	b, err = (&Pushgateway{}).Parse(r)
+	require.NoError(t, err)
+	assert.Equal(t, Batch{Device: "shed", Readings: []store.TemperatureReading{{TempRoom: 12}}}, b)
+
+	for labels, body := range map[string]string{
+		"instance":                 "temp_room 1\n",
+		"device@base64/%%%":        "temp_room 1\n",
+		"":                         "temp_room warm\n",
+		"instance/a/device@base64": "temp_room 1\n",
+	} {
+		r := httptest.NewRequest("POST", "/metrics/job/cron", strings.NewReader(body))
+		r.SetPathValue("job", "cron")
+		r.SetPathValue("labels", labels)
+		_, err := (&Pushgateway{}).Parse(r)
+		assert.Error(t, err, labels)
+	}
+	r = httptest.NewRequest("POST", "/metrics/job/cron", strings.NewReader(`temp_room{device="a"} 1`+"\n"+`humidity{device="b"} 2`+"\n"))
+	r.SetPathValue("job", "cron")
+	_, err = (&Pushgateway{}).Parse(r)
+	assert.Error(t, err)
+
+	r = httptest.NewRequest("POST", "/metrics/job/cron/device@base64/bGl2aW5nIHJvb20", strings.NewReader("temp_room 20\n"))
+	r.SetPathValue("job", "cron")
+	r.SetPathValue("labels", "device@base64/bGl2aW5nIHJvb20")
+	b, err = (&Pushgateway{}).Parse(r)
+	require.NoError(t, err)
+	assert.Equal(t, "living room", b.Device)
+}
+
+func TestGraphite(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	p := New(st, Config{})
+	p.now = func() time.Time { return time.Unix(1761388200, 0) }
+	g := NewGraphite("", "", []MetricPath{
+		{Path: "collectd.boiler.temp", Device: "boiler", Field: "tempCo"},
+		{Path: "home.*.temp", Field: "tempRoom"},
+		{Path: "home.*.humidity", Field: "humidity"},
+	})
+
+	now := time.Unix(1761388150, 0)
+	for _, line := range []string{
+		"home.livingroom.temp 21.4 1761388101",
+		"home.livingroom.humidity 48 1761388101",
+		"home.livingroom.temp 21.6 1761388161",
+		"collectd.boiler.temp 40.5 -1",
+		"home.attic.temp:19.5|g",
+		"home.attic.humidity:55|g|#room:attic",
+		"home.attic.temp:1|c",
+		"home.unmapped.pressure 1013 1761388101",
+		"home.livingroom.temp warm",
+	} {
+		g.line(p, line, now)
+	}
+	g.flush(ctx, p, now)
+	readings, err := st.ListReadings(ctx, 10, 0)
+	require.NoError(t, err)
+	assert.Empty(t, readings, "fields arriving within the flush delay are kept pending")
+
+	g.flush(ctx, p, now.Add(graphiteFlushDelay))
+	readings, err = st.ListReadings(ctx, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 4)
+	byDevice := make(map[string][]store.TemperatureReading)
+	for _, r := range readings {
+		r.Id, r.ReceivedAt, r.Quality = 0, nil, ""
+		byDevice[r.Device] = append(byDevice[r.Device], r)
+	}
+	assert.ElementsMatch(t, []store.TemperatureReading{
+		{Device: "livingroom", TempRoom: 21.4, Humidity: 48, Timestamp: ts(1761388101)},
+		{Device: "livingroom", TempRoom: 21.6, Timestamp: ts(1761388161)},
+	}, byDevice["livingroom"])
+	require.Len(t, byDevice["attic"], 1)
+	assert.Equal(t, 19.5, byDevice["attic"][0].TempRoom)
+	assert.Equal(t, 55.0, byDevice["attic"][0].Humidity)
+	require.Len(t, byDevice["boiler"], 1)
+	assert.Equal(t, 40.5, byDevice["boiler"][0].TempCo)
+
+	assert.Error(t, ValidateMetricPaths([]MetricPath{{Path: "home.*.temp", Field: "pressure"}}))
+	assert.Error(t, ValidateMetricPaths([]MetricPath{{Field: "tempCo"}}))
+}
+
+func TestMQTTParse(t *testing.T) {
+	m := &MQTT{Topic: "esp8266/+/readings"}
+	b, err := m.parse("esp8266/attic/readings", []byte(`{"id": 7, "tempCo": 40.5, "timestamp": 1761388101}`))
+	require.NoError(t, err)
+	assert.Equal(t, Batch{Device: "attic", Readings: []store.TemperatureReading{{TempCo: 40.5, Timestamp: ts(1761388101)}}}, b)
+
+	b, err = m.parse("esp8266/garage/readings", []byte(` [{"tempCo": 1}, {"tempCo": 2}]`))
+	require.NoError(t, err)
+	assert.Equal(t, "garage", b.Device)
+	assert.Len(t, b.Readings, 2)
+
+	_, err = m.parse("esp8266/garage/readings", []byte(`warm`))
+	assert.Error(t, err)
+	assert.Equal(t, "", topicDevice("esp8266/readings", "esp8266/readings"))
+}
+
+func TestZigbee2MQTT(t *testing.T) {
+	ctx := context.Background()
+	st := memory.New()
+	require.NoError(t, st.SetDeviceLabels(ctx, "bathroom", map[string]string{"floor": "1", "vendor": "Aqara"}))
+	p := New(st, Config{})
+	m := &MQTT{Topic: "zigbee2mqtt", Format: FormatZigbee2MQTT}
+
+	devices := `[
+		{"friendly_name": "Coordinator", "ieee_address": "0x00124b0000000000", "type": "Coordinator"},
+		{"friendly_name": "bathroom", "ieee_address": "0x00158d0001a2b3c4", "type": "EndDevice", "definition": {"vendor": "Xiaomi", "model": "WSDCGQ11LM"}}
+	]`
+	require.NoError(t, m.handleZigbee2MQTT(ctx, p, "zigbee2mqtt/bridge/devices", []byte(devices)))
+	for topic, payload := range map[string]string{
+		"zigbee2mqtt/bathroom":              `{"temperature": 22.5, "humidity": 61.2, "battery": 87, "linkquality": 120, "voltage": 3005}`,
+		"zigbee2mqtt/living/room":           `{"temperature": 21}`,
+		"zigbee2mqtt/button":                `{"action": "single", "battery": 40}`,
+		"zigbee2mqtt/bathroom/availability": `{"state": "online"}`,
+		"zigbee2mqtt/bridge/state":          `{"state": "online"}`,
+		"zigbee2mqtt/bathroom/set":          `{"temperature": 99}`,
+	} {
+		require.NoError(t, m.handleZigbee2MQTT(ctx, p, topic, []byte(payload)), topic)
+	}
+	assert.Error(t, m.handleZigbee2MQTT(ctx, p, "zigbee2mqtt/bathroom", []byte("warm")))
+
+	readings, err := st.ListReadings(ctx, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 2)
+	byDevice := map[string]store.TemperatureReading{readings[0].Device: readings[0], readings[1].Device: readings[1]}
+	assert.Equal(t, 22.5, byDevice["bathroom"].TempRoom)
+	assert.Equal(t, 61.2, byDevice["bathroom"].Humidity)
+	assert.Equal(t, 21.0, byDevice["living/room"].TempRoom)
+	assert.Equal(t, 87.0, testutil.ToFloat64(batteryGauge.WithLabelValues("bathroom")))
+	assert.Equal(t, 40.0, testutil.ToFloat64(batteryGauge.WithLabelValues("button")))
+	assert.Equal(t, 120.0, testutil.ToFloat64(linkQualityGauge.WithLabelValues("bathroom")))
+
+	// labels set otherwise are kept
+	labels, err := st.DeviceLabels(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{
+		"bathroom":    {"floor": "1", "vendor": "Aqara", "source": "zigbee2mqtt", "ieee": "0x00158d0001a2b3c4", "model": "WSDCGQ11LM"},
+		"living/room": {"source": "zigbee2mqtt"},
+	}, labels)
+}
+
+func TestLoRaWANTTN(t *testing.T) {
+	l := NewLoRaWAN(FormatTTN, map[string]LoRaDecoder{
+		"garage-1": {Type: DecoderCayenne},
+		"garage-2": {Type: DecoderBytes, Layout: []ByteField{
+			{Field: "tempRoom", Offset: 0, Type: "int16be", Scale: 0.01},
+			{Field: "humidity", Offset: 2, Type: "uint8"},
+		}},
+		DefaultDecoder: {Fields: map[string]string{"tempRoom": "temperature"}},
+	})
+	parse := func(body string) (Batch, error) {
+		return l.Parse(httptest.NewRequest("POST", "/ingest/ttn", strings.NewReader(body)))
+	}
+
+	// 01 67 00 FF: channel 1 temperature 25.5, 02 67 FF EC: channel 2 -2.0,
+	// 03 68 64: channel 3 humidity 50
+	b, err := parse(`{"end_device_ids": {"device_id": "garage-1", "dev_eui": "70B3D57ED0000001"},
+		"received_at": "2025-10-25T10:28:21.123Z",
+		"uplink_message": {"f_port": 1, "frm_payload": "AWcA/wJn/+wDaGQ="}}`)
+	require.NoError(t, err)
+	assert.Equal(t, Batch{Device: "garage-1", Readings: []store.TemperatureReading{
+		{TempCo: 25.5, TempRoom: -2, Humidity: 50, Timestamp: ts(1761388101)},
+	}}, b)
+
+	// 0x0906 = 2310 hundredths, 0x37 = 55
+	b, err = parse(`{"end_device_ids": {"device_id": "garage-2"}, "uplink_message": {"frm_payload": "CQY3"}}`)
+	require.NoError(t, err)
+	assert.Equal(t, []store.TemperatureReading{{TempRoom: 23.1, Humidity: 55}}, b.Readings)
+
+	b, err = parse(`{"end_device_ids": {"device_id": "shed"}, "uplink_message": {"decoded_payload": {"temperature": 12.5, "humidity": 80}}}`)
+	require.NoError(t, err)
+	assert.Equal(t, []store.TemperatureReading{{TempRoom: 12.5, Humidity: 80}}, b.Readings)
+
+	_, err = parse(`{"end_device_ids": {"device_id": "garage-2"}, "uplink_message": {"frm_payload": "CQ=="}}`)
+	assert.Error(t, err)
+
+	// joins and other messages are ignored
+	b, err = parse(`{"end_device_ids": {"device_id": "shed"}, "join_accept": {}}`)
+	require.NoError(t, err)
+	assert.Empty(t, b.Readings)
+}
+
+func TestLoRaWANChirpStack(t *testing.T) {
+	l := NewLoRaWAN(FormatChirpStack, map[string]LoRaDecoder{
+		"70b3d57ed0000001": {Type: DecoderCayenne, Channels: map[string]int{"tempRoom": 1}},
+	})
+	r := httptest.NewRequest("POST", "/ingest/chirpstack?event=up", strings.NewReader(`{
+		"deviceInfo": {"deviceName": "garage", "devEui": "70B3D57ED0000001"},
+		"time": "2025-10-25T10:28:21Z", "fPort": 1, "data": "AWcA/w=="}`))
+	b, err := l.Parse(r)
+	require.NoError(t, err)
+	assert.Equal(t, Batch{Device: "garage", Readings: []store.TemperatureReading{{TempRoom: 25.5, Timestamp: ts(1761388101)}}}, b)
+
+	b, err = l.Parse(httptest.NewRequest("POST", "/ingest/chirpstack?event=join", strings.NewReader(`{}`)))
+	require.NoError(t, err)
+	assert.Empty(t, b.Readings)
+}
+
+func TestValidateDecoders(t *testing.T) {
+	assert.NoError(t, ValidateDecoders(map[string]LoRaDecoder{"a": {}, "b": {Type: DecoderCayenne}}))
+	assert.Error(t, ValidateDecoders(map[string]LoRaDecoder{"a": {Type: "lpp"}}))
+	assert.Error(t, ValidateDecoders(map[string]LoRaDecoder{"a": {Fields: map[string]string{"pressure": "p"}}}))
+	assert.Error(t, ValidateDecoders(map[string]LoRaDecoder{"a": {Type: DecoderBytes}}))
+	assert.Error(t, ValidateDecoders(map[string]LoRaDecoder{"a": {Type: DecoderBytes, Layout: []ByteField{{Field: "tempCo", Type: "float"}}}}))
+}
+
+func TestTasmota(t *testing.T) {
+	f := NewFirmware(FormatTasmota, map[string]FieldMap{"boiler": {"tempCo": "DS18B20-2.Temperature"}})
+	parse := func(url, body string) (Batch, error) {
+		return f.Parse(httptest.NewRequest("POST", url, strings.NewReader(body)))
+	}
+
+	b, err := parse("/ingest/tasmota?device=attic", `{"Time": "2025-10-25T10:28:21",
+		"DS18B20": {"Id": "01144A0CB2AA", "Temperature": 40.5},
+		"AM2301": {"Temperature": 21.5, "Humidity": 50.0, "DewPoint": 10.6}, "TempUnit": "C"}`)
+	require.NoError(t, err)
+	assert.Equal(t, Batch{Device: "attic", Readings: []store.TemperatureReading{{TempCo: 40.5, TempRoom: 21.5, Humidity: 50}}}, b)
+
+	b, err = parse("/ingest/tasmota?device=boiler", `{"StatusSNS": {
+		"DS18B20-1": {"Temperature": 68.0}, "DS18B20-2": {"Temperature": 104.9}, "TempUnit": "F"}}`)
+	require.NoError(t, err)
+	assert.Equal(t, []store.TemperatureReading{{TempCo: 40.5}}, b.Readings)
+
+	_, err = parse("/ingest/tasmota", `{"Time": "2025-10-25T10:28:21", "ENERGY": {"Power": 5}}`)
+	assert.Error(t, err)
+}
+
+func TestESPHome(t *testing.T) {
+	f := NewFirmware(FormatESPHome, map[string]FieldMap{DefaultDecoder: {"tempRoom": "living_room_temperature"}})
+	parse := func(body string) (Batch, error) {
+		return f.Parse(httptest.NewRequest("POST", "/ingest/esphome?device=attic", strings.NewReader(body)))
+	}
+
+	b, err := parse(`{"temp_co": "40.5", "living_room_temperature": 21.5, "humidity": 50}`)
+	require.NoError(t, err)
+	assert.Equal(t, Batch{Device: "attic", Readings: []store.TemperatureReading{{TempCo: 40.5, TempRoom: 21.5, Humidity: 50}}}, b)
+
+	b, err = parse(`[{"id": "sensor-temp_co", "value": 40.5, "state": "40.5 °C"}, {"id": "sensor-humidity", "value": 55, "state": "55 %"}]`)
+	require.NoError(t, err)
+	assert.Equal(t, []store.TemperatureReading{{TempCo: 40.5, Humidity: 55}}, b.Readings)
+
+	_, err = parse(`{"temp_co": "warm"}`)
+	assert.Error(t, err)
+}
+
+func TestValidateFieldMaps(t *testing.T) {
+	assert.NoError(t, ValidateFieldMaps(map[string]map[string]FieldMap{FormatTasmota: {DefaultDecoder: {"tempCo": "DS18B20.Temperature"}}}))
+	assert.Error(t, ValidateFieldMaps(map[string]map[string]FieldMap{"shelly": {}}))
+	assert.Error(t, ValidateFieldMaps(map[string]map[string]FieldMap{FormatESPHome: {"attic": {"pressure": "p"}}}))
+	assert.Error(t, ValidateFieldMaps(map[string]map[string]FieldMap{FormatESPHome: {"attic": {"tempCo": ""}}}))
+}
+
+func TestLastSeen(t *testing.T) {
+	p := New(memory.New(), Config{})
+	p.now = func() time.Time { return time.Unix(1761388200, 0) }
+
+	Seen("cellar", time.Unix(1761388000, 0))
+	_, err := p.Ingest(context.Background(), "test", Batch{Device: "cellar", Readings: []store.TemperatureReading{{TempCo: 40, Timestamp: ts(1761388101)}}})
+	require.NoError(t, err)
+	// an older reading seeded later doesn't go back in time
+	Seen("cellar", time.Unix(1761380000, 0))
+	assert.Equal(t, time.Unix(1761388200, 0), LastSeen()["cellar"])
+
+	assert.Equal(t, len(LastSeen()), testutil.CollectAndCount(lastSeen, "esp8266_device_last_reading_age_seconds"))
+}
+
+func TestWebhook(t *testing.T) {
+	body := `{"end_device_ids":{"device_id":"garage"}}`
+	request := func(header, value string) *http.Request {
+		r := httptest.NewRequest("POST", "/ingest/ttn", strings.NewReader(body))
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		return r
+	}
+
+	secret := Webhook{Secret: "0123456789abcdef", Header: "X-Downlink-Apikey"}
+	ok, err := secret.Verify(request("X-Downlink-Apikey", "0123456789abcdef"))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = secret.Verify(request(DefaultSecretHeader, "0123456789abcdef"))
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	signed := Webhook{Secret: "0123456789abcdef", Signature: SignatureHMACSHA256}
+	mac := hmac.New(sha256.New, []byte(signed.Secret))
+	mac.Write([]byte(body))
+	r := request(DefaultSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	ok, err = signed.Verify(r)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	// the body is left for Parse
+	read, err := io.ReadAll(r.Body)
+	require.NoError(t, err)
+	assert.Equal(t, body, string(read))
+
+	for _, sig := range []string{"sha256=00", "not hex", ""} {
+		ok, err = signed.Verify(request(DefaultSignatureHeader, sig))
+		require.NoError(t, err)
+		assert.False(t, ok, sig)
+	}
+	assert.False(t, signed.Present(request(DefaultSecretHeader, "0123456789abcdef")))
+
+	rejected := rejectedTotal.WithLabelValues("ttn", RejectInvalid)
+	before := testutil.ToFloat64(rejected)
+	Rejected("ttn", RejectInvalid)
+	assert.Equal(t, before+1, testutil.ToFloat64(rejected))
+}
+
+func TestValidateWebhooks(t *testing.T) {
+	assert.NoError(t, ValidateWebhooks(map[string]Webhook{"ttn": {Secret: "0123456789abcdef", Signature: SignatureHMACSHA256}}))
+	assert.Error(t, ValidateWebhooks(map[string]Webhook{"ttn": {Secret: "short"}}))
+	assert.Error(t, ValidateWebhooks(map[string]Webhook{"ttn": {Secret: "0123456789abcdef", Signature: "md5"}}))
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.0", "1.2", 0},
+		{"v1.10.0", "1.9.3", 1},
+		{"1.2.3", "1.2.4", -1},
+		{"2.0.0-rc1", "2.0.0", 0},
+		{"2024.10.1", "2024.9.0", 1},
+		{"1.2.beta", "1.2.alpha", 1},
+	} {
+		assert.Equal(t, tc.want, CompareVersions(tc.a, tc.b), "%s vs %s", tc.a, tc.b)
+	}
+}
+
+func TestFirmware(t *testing.T) {
+	st := memory.New()
+	p := New(st, Config{MinFirmware: "1.2.0"})
+	p.now = func() time.Time { return time.Unix(1761388000, 0) }
+	ctx := context.Background()
+
+	require.NoError(t, p.Firmware(ctx, "attic", "1.1.0"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(firmwareOutdated.WithLabelValues("attic")))
+	p.now = func() time.Time { return time.Unix(1761388060, 0) }
+	require.NoError(t, p.Firmware(ctx, "attic", "1.1.0"))
+	require.NoError(t, p.Firmware(ctx, "", "1.1.0"))
+
+	firmware, err := st.DeviceFirmware(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []store.DeviceFirmware{{Device: "attic", Version: "1.1.0", Since: 1761388000}}, firmware)
+
+	require.NoError(t, p.Firmware(ctx, "attic", "1.2.1"))
+	assert.Equal(t, 0.0, testutil.ToFloat64(firmwareOutdated.WithLabelValues("attic")))
+	assert.Equal(t, 1, testutil.CollectAndCount(firmwareInfo, "esp8266_device_firmware_info"))
+}
+
+func TestClockSkew(t *testing.T) {
+	p := New(memory.New(), Config{})
+	now := time.Unix(1761388200, 0)
+	p.now = func() time.Time { return now }
+
+	_, err := p.Ingest(context.Background(), "test", Batch{Device: "skewed", Readings: []store.TemperatureReading{{TempCo: 40, Timestamp: ts(1761388101)}, {TempCo: 41, Timestamp: ts(1761388140)}, {TempCo: 42}}})
+	require.NoError(t, err)
+	assert.Equal(t, Skew{Seconds: -60, At: now}, ClockSkews()["skewed"])
+	assert.Equal(t, -60.0, testutil.ToFloat64(clockSkewGauge.WithLabelValues("skewed")))
+
+	// a clock far enough ahead to be rejected is still measured
+	_, err = p.Ingest(context.Background(), "test", Batch{Device: "skewed", Readings: []store.TemperatureReading{{TempCo: 40, Timestamp: ts(1761388200 + 3*86400)}}})
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, int64(3*86400), ClockSkews()["skewed"].Seconds)
+
+	// readings stamped by the server don't count
+	_, err = p.Ingest(context.Background(), "test", Batch{Device: "unstamped", Readings: []store.TemperatureReading{{TempCo: 40}}})
+	require.NoError(t, err)
+	assert.NotContains(t, ClockSkews(), "unstamped")
+}
+
+func TestQuality(t *testing.T) {
+	p := New(memory.New(), Config{AnomalyDelta: 10})
+	p.now = func() time.Time { return time.Unix(1761388200, 0) }
+
+	result, err := p.Ingest(context.Background(), "test", Batch{Device: "boiler", Readings: []store.TemperatureReading{
+		{TempCo: 60, TempRoom: 21, Timestamp: ts(1761387600)},
+		// not converted yet, and not compared against
+		{TempCo: 85, TempRoom: 21, Timestamp: ts(1761387660)},
+		{TempCo: 61, TempRoom: 21, Timestamp: ts(1761387720)},
+		{TempCo: 80, TempRoom: 21, Timestamp: ts(1761387780)},
+		// an hour later the boiler may well have cooled down
+		{TempCo: 30, TempRoom: 21, Timestamp: ts(1761391380)},
+		{TempCo: -127, TempRoom: 21, Timestamp: ts(1761391440)},
+		{TempCo: 30, TempRoom: 21, Timestamp: ts(1761391500), Quality: store.QualityCalibrated},
+	}})
+	require.NoError(t, err)
+	var qualities []string
+	for _, r := range result.Stored {
+		qualities = append(qualities, r.Quality)
+	}
+	assert.Equal(t, []string{"ok", "suspect", "ok", "anomalous", "ok", "suspect", "calibrated"}, qualities)
+	assert.Equal(t, 2.0, testutil.ToFloat64(flaggedTotal.WithLabelValues("boiler", "suspect")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(flaggedTotal.WithLabelValues("boiler", "anomalous")))
+
+	// without AnomalyDelta only implausible values are flagged
+	p = New(memory.New(), Config{})
+	assert.Equal(t, store.QualityOK, p.Quality("attic", store.TemperatureReading{TempCo: 20, Timestamp: ts(1761388000)}))
+	assert.Equal(t, store.QualityOK, p.Quality("attic", store.TemperatureReading{TempCo: 80, Timestamp: ts(1761388060)}))
+	assert.Equal(t, store.QualitySuspect, p.Quality("attic", store.TemperatureReading{TempRoom: 95, Timestamp: ts(1761388120)}))
+}
@@ -0,0 +1,59 @@
+package ingest
+
+import (
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// lastSeen is when every device last sent readings, exported as the
+// seconds since on /metrics so Prometheus catches a dead sensor even with
+// the alert rules switched off.
+var lastSeen = func() *seenDevices {
+	d := &seenDevices{
+		at: make(map[string]time.Time),
+		desc: prometheus.NewDesc("esp8266_device_last_reading_age_seconds",
+			"Seconds since the device last sent readings.", []string{"device"}, nil),
+	}
+	prometheus.MustRegister(d)
+	return d
+}()
+
+type seenDevices struct {
+	mu   sync.Mutex
+	at   map[string]time.Time
+	desc *prometheus.Desc
+}
+
+func (d *seenDevices) Describe(ch chan<- *prometheus.Desc) { ch <- d.desc }
+
+// Collect reports the ages at scrape time, so they keep growing while a
+// device is silent.
+func (d *seenDevices) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for device, at := range LastSeen() {
+		ch <- prometheus.MustNewConstMetric(d.desc, prometheus.GaugeValue, now.Sub(at).Seconds(), device)
+	}
+}
+
+// Seen records that device sent readings at t, unless it sent some later.
+// The pipeline records every accepted batch; seed it with the newest stored
+// reading of every device, so devices that went silent before a restart
+// are still reported.
+func Seen(device string, t time.Time) {
+	lastSeen.mu.Lock()
+	defer lastSeen.mu.Unlock()
+	if t.After(lastSeen.at[device]) {
+		lastSeen.at[device] = t
+	}
+}
+
+// LastSeen returns when every device known to this process last sent
+// readings.
+func LastSeen() map[string]time.Time {
+	lastSeen.mu.Lock()
+	defer lastSeen.mu.Unlock()
+	return maps.Clone(lastSeen.at)
+}
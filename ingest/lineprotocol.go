@@ -0,0 +1,106 @@
+package ingest
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+// LineProtocol accepts InfluxDB line protocol, e.g. from Telegraf or
+// firmware already writing to Influx:
+//
+//	readings,device=attic temp_co=40.5,temp_room=21.5,humidity=50 1761388101000000000
+//
+// The precision query parameter sets the timestamp unit, ns (default), us,
+// ms or s. Escaped characters aren't supported.
+type LineProtocol struct {
+	SecretKeyHeader
+	// Measurement, when set, skips lines of other measurements.
+	Measurement string
+}
+
+var _ HTTPAdapter = (*LineProtocol)(nil)
+
+func (l *LineProtocol) Name() string { return "line" }
+
+var lineFields = map[string]string{
+	"temp_co": "tempCo", "tempCo": "tempCo",
+	"temp_room": "tempRoom", "tempRoom": "tempRoom",
+	"humidity": "humidity",
+}
+
+var precisions = map[string]int64{"ns": 1e9, "us": 1e6, "ms": 1e3, "s": 1}
+
+func (l *LineProtocol) Parse(r *http.Request) (Batch, error) {
+	precision := r.URL.Query().Get("precision")
+	if precision == "" {
+		precision = "ns"
+	}
+	div, ok := precisions[precision]
+	if !ok {
+		return Batch{}, fmt.Errorf("precision must be ns, us, ms or s")
+	}
+
+	var b Batch
+	sc := bufio.NewScanner(r.Body)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) < 2 || len(parts) > 3 {
+			return Batch{}, fmt.Errorf("line %d: expected measurement, fields and an optional timestamp", n)
+		}
+		series := strings.Split(parts[0], ",")
+		if l.Measurement != "" && series[0] != l.Measurement {
+			continue
+		}
+		for _, tag := range series[1:] {
+			if k, v, _ := strings.Cut(tag, "="); k == "device" {
+				if b.Device != "" && b.Device != v {
+					return Batch{}, fmt.Errorf("line %d: all lines must be from the same device", n)
+				}
+				b.Device = v
+			}
+		}
+
+		var tr store.TemperatureReading
+		for _, field := range strings.Split(parts[1], ",") {
+			k, v, _ := strings.Cut(field, "=")
+			name, ok := lineFields[k]
+			if !ok {
+				continue
+			}
+			f, err := strconv.ParseFloat(strings.TrimSuffix(v, "i"), 64)
+			if err != nil {
+				return Batch{}, fmt.Errorf("line %d: field %s is not a number", n, k)
+			}
+			switch name {
+			case "tempCo":
+				tr.TempCo = f
+			case "tempRoom":
+				tr.TempRoom = f
+			default:
+				tr.Humidity = f
+			}
+		}
+		if len(parts) == 3 {
+			ts, err := strconv.ParseInt(parts[2], 10, 64)
+			if err != nil {
+				return Batch{}, fmt.Errorf("line %d: invalid timestamp", n)
+			}
+			ts /= div
+			tr.Timestamp = &ts
+		}
+		b.Readings = append(b.Readings, tr)
+	}
+	if err := sc.Err(); err != nil {
+		return Batch{}, err
+	}
+	return b, nil
+}
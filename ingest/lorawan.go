@@ -0,0 +1,354 @@
+package ingest
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+const (
+	FormatTTN        = "ttn"
+	FormatChirpStack = "chirpstack"
+)
+
+const (
+	// DecoderFields reads the payload the network server already decoded,
+	// e.g. with a TTN payload formatter or a ChirpStack codec.
+	DecoderFields = "fields"
+	// DecoderCayenne decodes Cayenne LPP.
+	DecoderCayenne = "cayenne"
+	// DecoderBytes reads values at fixed offsets of the raw payload.
+	DecoderBytes = "bytes"
+)
+
+// DefaultDecoder is the key of the decoder used for devices without their
+// own.
+const DefaultDecoder = "default"
+
+// LoRaDecoder turns an uplink payload into a reading.
+type LoRaDecoder struct {
+	// Type is DecoderFields (default), DecoderCayenne or DecoderBytes.
+	Type string `yaml:"type" json:"type"`
+	// Fields maps reading fields, tempCo, tempRoom and humidity, to keys
+	// of the decoded payload. Defaults to the same names.
+	Fields map[string]string `yaml:"fields" json:"fields"`
+	// Channels maps reading fields to Cayenne LPP channels. Without it the
+	// first temperature is tempCo, the second tempRoom and the first
+	// humidity humidity.
+	Channels map[string]int `yaml:"channels" json:"channels"`
+	// Layout is where every reading field is in the raw payload.
+	Layout []ByteField `yaml:"layout" json:"layout"`
+}
+
+type ByteField struct {
+	Field  string `yaml:"field" json:"field"`
+	Offset int    `yaml:"offset" json:"offset"`
+	// Type is int8, uint8, int16be, uint16be, int16le or uint16le.
+	Type string `yaml:"type" json:"type"`
+	// Scale multiplies the raw value, e.g. 0.01 for hundredths of a
+	// degree. Defaults to 1.
+	Scale float64 `yaml:"scale" json:"scale"`
+}
+
+var (
+	readingFields = []string{"tempCo", "tempRoom", "humidity"}
+	byteSizes     = map[string]int{"int8": 1, "uint8": 1, "int16be": 2, "uint16be": 2, "int16le": 2, "uint16le": 2}
+)
+
+// ValidateDecoders checks decoders, keyed by device id, dev EUI or
+// DefaultDecoder.
+func ValidateDecoders(decoders map[string]LoRaDecoder) error {
+	var errs []error
+	for device, d := range decoders {
+		fail := func(format string, args ...any) {
+			errs = append(errs, fmt.Errorf("decoder %s: %s", device, fmt.Sprintf(format, args...)))
+		}
+		switch d.Type {
+		case "", DecoderFields:
+			for field := range d.Fields {
+				if !contains(readingFields, field) {
+					fail("unknown field %q", field)
+				}
+			}
+		case DecoderCayenne:
+			for field := range d.Channels {
+				if !contains(readingFields, field) {
+					fail("unknown field %q", field)
+				}
+			}
+		case DecoderBytes:
+			if len(d.Layout) == 0 {
+				fail("layout is required")
+			}
+			for _, f := range d.Layout {
+				if !contains(readingFields, f.Field) {
+					fail("unknown field %q", f.Field)
+				}
+				if _, ok := byteSizes[f.Type]; !ok {
+					fail("unknown type %q", f.Type)
+				}
+				if f.Offset < 0 {
+					fail("negative offset")
+				}
+			}
+		default:
+			fail("type must be %s, %s or %s", DecoderFields, DecoderCayenne, DecoderBytes)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func contains(values []string, v string) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// LoRaWAN receives uplink webhooks of The Things Network (v3) or
+// ChirpStack (v4 HTTP integration) and decodes them with the decoder
+// configured for the sending device. Other events, e.g. joins, are
+// acknowledged and ignored.
+type LoRaWAN struct {
+	SecretKeyHeader
+	// Format is FormatTTN or FormatChirpStack, it is also the adapter name.
+	Format string
+
+	mu       sync.RWMutex
+	decoders map[string]LoRaDecoder
+}
+
+var _ HTTPAdapter = (*LoRaWAN)(nil)
+
+func NewLoRaWAN(format string, decoders map[string]LoRaDecoder) *LoRaWAN {
+	return &LoRaWAN{Format: format, decoders: decoders}
+}
+
+func (l *LoRaWAN) Name() string { return l.Format }
+
+// SetDecoders replaces the decoders, e.g. on a settings reload.
+func (l *LoRaWAN) SetDecoders(decoders map[string]LoRaDecoder) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.decoders = decoders
+}
+
+func (l *LoRaWAN) decoder(ids ...string) LoRaDecoder {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, id := range append(ids, DefaultDecoder) {
+		if d, ok := l.decoders[id]; ok && id != "" {
+			return d
+		}
+	}
+	return LoRaDecoder{}
+}
+
+// uplink is what both formats carry.
+type uplink struct {
+	device, devEUI string
+	received       string
+	payload        []byte
+	decoded        map[string]any
+}
+
+func (l *LoRaWAN) Parse(r *http.Request) (Batch, error) {
+	var up uplink
+	switch l.Format {
+	case FormatTTN:
+		var msg struct {
+			EndDeviceIDs struct {
+				DeviceID string `json:"device_id"`
+				DevEUI   string `json:"dev_eui"`
+			} `json:"end_device_ids"`
+			ReceivedAt    string `json:"received_at"`
+			UplinkMessage *struct {
+				FrmPayload     []byte         `json:"frm_payload"`
+				DecodedPayload map[string]any `json:"decoded_payload"`
+			} `json:"uplink_message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			return Batch{}, err
+		}
+		if msg.UplinkMessage == nil {
+			return Batch{}, nil
+		}
+		up = uplink{msg.EndDeviceIDs.DeviceID, msg.EndDeviceIDs.DevEUI, msg.ReceivedAt, msg.UplinkMessage.FrmPayload, msg.UplinkMessage.DecodedPayload}
+	case FormatChirpStack:
+		if event := r.URL.Query().Get("event"); event != "" && event != "up" {
+			return Batch{}, nil
+		}
+		var msg struct {
+			DeviceInfo struct {
+				DeviceName string `json:"deviceName"`
+				DevEUI     string `json:"devEui"`
+			} `json:"deviceInfo"`
+			Time   string         `json:"time"`
+			Data   []byte         `json:"data"`
+			Object map[string]any `json:"object"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			return Batch{}, err
+		}
+		up = uplink{msg.DeviceInfo.DeviceName, msg.DeviceInfo.DevEUI, msg.Time, msg.Data, msg.Object}
+	default:
+		return Batch{}, fmt.Errorf("unknown lorawan format %q", l.Format)
+	}
+
+	tr, err := l.decoder(up.device, strings.ToLower(up.devEUI)).decode(up)
+	if err != nil {
+		return Batch{}, fmt.Errorf("device %s: %w", up.device, err)
+	}
+	if t, err := time.Parse(time.RFC3339Nano, up.received); err == nil {
+		ts := t.Unix()
+		tr.Timestamp = &ts
+	}
+	return Batch{Device: up.device, Readings: []store.TemperatureReading{tr}}, nil
+}
+
+func (d LoRaDecoder) decode(up uplink) (store.TemperatureReading, error) {
+	var tr store.TemperatureReading
+	set := func(field string, v float64) {
+		switch field {
+		case "tempCo":
+			tr.TempCo = v
+		case "tempRoom":
+			tr.TempRoom = v
+		case "humidity":
+			tr.Humidity = v
+		}
+	}
+
+	switch d.Type {
+	case "", DecoderFields:
+		if up.decoded == nil {
+			return tr, errors.New("uplink has no decoded payload")
+		}
+		for _, field := range readingFields {
+			key := field
+			if k, ok := d.Fields[field]; ok {
+				key = k
+			}
+			switch v := up.decoded[key].(type) {
+			case float64:
+				set(field, v)
+			case nil:
+			default:
+				return tr, fmt.Errorf("decoded %s is not a number", key)
+			}
+		}
+	case DecoderCayenne:
+		values, err := decodeCayenne(up.payload)
+		if err != nil {
+			return tr, err
+		}
+		if len(d.Channels) > 0 {
+			for _, v := range values {
+				for field, channel := range d.Channels {
+					if v.channel == channel {
+						set(field, v.value)
+					}
+				}
+			}
+			break
+		}
+		var temps []float64
+		for _, v := range values {
+			switch {
+			case v.typ == lppTemperature:
+				temps = append(temps, v.value)
+			case v.typ == lppHumidity && tr.Humidity == 0:
+				tr.Humidity = v.value
+			}
+		}
+		if len(temps) > 0 {
+			tr.TempCo = temps[0]
+		}
+		if len(temps) > 1 {
+			tr.TempRoom = temps[1]
+		}
+	case DecoderBytes:
+		for _, f := range d.Layout {
+			if f.Offset+byteSizes[f.Type] > len(up.payload) {
+				return tr, fmt.Errorf("payload of %d bytes too short for %s", len(up.payload), f.Field)
+			}
+			b := up.payload[f.Offset:]
+			var v float64
+			switch f.Type {
+			case "int8":
+				v = float64(int8(b[0]))
+			case "uint8":
+				v = float64(b[0])
+			case "int16be":
+				v = float64(int16(binary.BigEndian.Uint16(b)))
+			case "uint16be":
+				v = float64(binary.BigEndian.Uint16(b))
+			case "int16le":
+				v = float64(int16(binary.LittleEndian.Uint16(b)))
+			case "uint16le":
+				v = float64(binary.LittleEndian.Uint16(b))
+			}
+			if f.Scale != 0 {
+				v *= f.Scale
+			}
+			set(f.Field, math.Round(v*1e6)/1e6)
+		}
+	}
+	return tr, nil
+}
+
+const (
+	lppTemperature = 0x67
+	lppHumidity    = 0x68
+)
+
+// lppSizes are the data sizes of the Cayenne LPP types, so unused ones can
+// be skipped.
+var lppSizes = map[byte]int{
+	0x00: 1, 0x01: 1, 0x02: 2, 0x03: 2, 0x65: 2, 0x66: 1, 0x67: 2, 0x68: 1,
+	0x71: 6, 0x73: 2, 0x86: 6, 0x88: 9,
+}
+
+type lppValue struct {
+	channel int
+	typ     byte
+	value   float64
+}
+
+// decodeCayenne returns the temperature and humidity values in payload
+// order.
+func decodeCayenne(payload []byte) ([]lppValue, error) {
+	var values []lppValue
+	for i := 0; i < len(payload); {
+		if i+2 > len(payload) {
+			return nil, errors.New("truncated cayenne lpp payload")
+		}
+		channel, typ := int(payload[i]), payload[i+1]
+		size, ok := lppSizes[typ]
+		if !ok {
+			return nil, fmt.Errorf("unsupported cayenne lpp type 0x%02x", typ)
+		}
+		data := payload[i+2:]
+		if len(data) < size {
+			return nil, errors.New("truncated cayenne lpp payload")
+		}
+		switch typ {
+		case lppTemperature:
+			values = append(values, lppValue{channel, typ, float64(int16(binary.BigEndian.Uint16(data))) / 10})
+		case lppHumidity:
+			values = append(values, lppValue{channel, typ, float64(data[0]) / 2})
+		}
+		i += 2 + size
+	}
+	return values, nil
+}
@@ -0,0 +1,120 @@
+package ingest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT subscribes to Topic and ingests every message, a JSON reading or an
+// array of them in the /data format. Access is controlled by the broker.
+//
+// A single-level wildcard in the topic names the device, e.g. with
+// esp8266/+/readings a message on esp8266/attic/readings is from attic.
+//
+// With Format FormatZigbee2MQTT, Topic is the Zigbee2MQTT base topic and
+// every device publishing a temperature or humidity under it is a device of
+// that friendly name, e.g. an Aqara sensor on zigbee2mqtt/bathroom. The
+// temperature is tempRoom; battery and link quality are exported on
+// /metrics. Devices are labelled with source zigbee2mqtt and, from the
+// bridge's device list, their ieee address, vendor and model, when the
+// store keeps labels.
+type MQTT struct {
+	// Broker is the broker URL, e.g. tcp://mqtt:1883.
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	Topic    string
+	// Format is empty for the /data JSON or FormatZigbee2MQTT.
+	Format string
+
+	registry zigbeeRegistry
+}
+
+var _ Listener = (*MQTT)(nil)
+
+func (m *MQTT) Name() string { return "mqtt" }
+
+const mqttTimeout = 10 * time.Second
+
+func (m *MQTT) Run(ctx context.Context, p *Pipeline) error {
+	handle := func(_ mqtt.Client, msg mqtt.Message) {
+		var err error
+		if m.Format == FormatZigbee2MQTT {
+			err = m.handleZigbee2MQTT(ctx, p, msg.Topic(), msg.Payload())
+		} else {
+			var b Batch
+			if b, err = m.parse(msg.Topic(), msg.Payload()); err == nil {
+				_, err = p.Ingest(ctx, m.Name(), b)
+			}
+		}
+		if err != nil {
+			p.logger.Error("failed to ingest mqtt message", "topic", msg.Topic(), "error", err)
+		}
+	}
+	topic := m.Topic
+	if m.Format == FormatZigbee2MQTT {
+		topic += "/#"
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(m.Broker).
+		SetClientID(m.ClientID).
+		SetUsername(m.Username).
+		SetPassword(m.Password).
+		SetAutoReconnect(true).
+		SetConnectTimeout(mqttTimeout).
+		// resubscribe after every reconnect
+		SetOnConnectHandler(func(c mqtt.Client) {
+			if t := c.Subscribe(topic, 1, handle); t.WaitTimeout(mqttTimeout) && t.Error() != nil {
+				p.logger.Error("failed to subscribe to mqtt topic", "topic", topic, "error", t.Error())
+			}
+		})
+	client := mqtt.NewClient(opts)
+	if t := client.Connect(); !t.WaitTimeout(mqttTimeout) {
+		return fmt.Errorf("mqtt connect %s: timeout", m.Broker)
+	} else if err := t.Error(); err != nil {
+		return fmt.Errorf("mqtt connect %s: %w", m.Broker, err)
+	}
+	<-ctx.Done()
+	client.Disconnect(250)
+	return nil
+}
+
+func (m *MQTT) parse(topic string, payload []byte) (Batch, error) {
+	b := Batch{Device: topicDevice(m.Topic, topic)}
+	payload = bytes.TrimSpace(payload)
+	if len(payload) > 0 && payload[0] == '[' {
+		if err := json.Unmarshal(payload, &b.Readings); err != nil {
+			return Batch{}, err
+		}
+	} else {
+		var r store.TemperatureReading
+		if err := json.Unmarshal(payload, &r); err != nil {
+			return Batch{}, err
+		}
+		b.Readings = []store.TemperatureReading{r}
+	}
+	// ids are assigned by the store
+	for i := range b.Readings {
+		b.Readings[i].Id = 0
+	}
+	return b, nil
+}
+
+// topicDevice returns the level of topic matched by the first + of filter.
+func topicDevice(filter, topic string) string {
+	levels := strings.Split(topic, "/")
+	for i, level := range strings.Split(filter, "/") {
+		if level == "+" && i < len(levels) {
+			return levels[i]
+		}
+	}
+	return ""
+}
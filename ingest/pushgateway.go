@@ -0,0 +1,141 @@
+package ingest
+
+import (
+	"encoding/base64"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/bartosz121/esp8266-web/store"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Pushgateway accepts pushes in the Prometheus text exposition format the
+// way a Pushgateway does, at POST or PUT /metrics/job/{job} followed by
+// label name and value pairs of the grouping key, so scripts and cron jobs
+// can report with curl:
+//
+//	echo "temp_room 21.5" | curl --data-binary @- -H "X-Secret-Key: $KEY" host/metrics/job/attic
+//
+// Gauge and untyped samples named like a reading field become readings,
+// one per timestamp; other metrics are skipped. The device is the device
+// label of the samples or grouping key, else the instance of the grouping
+// key, else the job. Label values ending in @base64 are decoded.
+type Pushgateway struct {
+	SecretKeyHeader
+}
+
+var _ MethodsAdapter = (*Pushgateway)(nil)
+
+func (p *Pushgateway) Name() string { return "pushgateway" }
+
+// Methods are those of pushes adding to a group and replacing it, which
+// store readings alike.
+func (p *Pushgateway) Methods() []string { return []string{http.MethodPost, http.MethodPut} }
+
+// pushFields maps the metric names a push may use to reading fields,
+// including the names /metrics exports readings under.
+var pushFields = map[string]string{
+	"temp_co": "tempCo", "tempCo": "tempCo", "esp8266_temp_co_celsius": "tempCo",
+	"temp_room": "tempRoom", "tempRoom": "tempRoom", "temperature": "tempRoom", "esp8266_temp_room_celsius": "tempRoom",
+	"humidity": "humidity", "esp8266_humidity_percent": "humidity",
+}
+
+func (p *Pushgateway) Parse(r *http.Request) (Batch, error) {
+	grouping, err := groupingKey(r.PathValue("job"), r.PathValue("labels"))
+	if err != nil {
+		return Batch{}, err
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(r.Body)
+	if err != nil {
+		return Batch{}, err
+	}
+
+	var b Batch
+	// readings are keyed by timestamp in milliseconds, 0 for samples
+	// without one
+	readings := make(map[int64]*store.TemperatureReading)
+	for _, name := range slices.Sorted(maps.Keys(families)) {
+		field, ok := pushFields[name]
+		mf := families[name]
+		if !ok || (mf.GetType() != dto.MetricType_GAUGE && mf.GetType() != dto.MetricType_UNTYPED) {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			device := grouping["device"]
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "device" {
+					device = l.GetValue()
+				}
+			}
+			if device == "" {
+				device = grouping["instance"]
+			}
+			if device == "" {
+				device = grouping["job"]
+			}
+			if b.Device != "" && b.Device != device {
+				return Batch{}, fmt.Errorf("metric %s: all samples must be from the same device", name)
+			}
+			b.Device = device
+
+			v := m.GetGauge().GetValue()
+			if mf.GetType() == dto.MetricType_UNTYPED {
+				v = m.GetUntyped().GetValue()
+			}
+			tr, ok := readings[m.GetTimestampMs()]
+			if !ok {
+				tr = &store.TemperatureReading{}
+				if ms := m.GetTimestampMs(); ms != 0 {
+					ts := ms / 1000
+					tr.Timestamp = &ts
+				}
+				readings[m.GetTimestampMs()] = tr
+			}
+			switch field {
+			case "tempCo":
+				tr.TempCo = v
+			case "tempRoom":
+				tr.TempRoom = v
+			default:
+				tr.Humidity = v
+			}
+		}
+	}
+	for _, ms := range slices.Sorted(maps.Keys(readings)) {
+		b.Readings = append(b.Readings, *readings[ms])
+	}
+	return b, nil
+}
+
+// groupingKey returns the labels of a push path, the job and the label
+// name and value pairs after it.
+func groupingKey(job, labels string) (map[string]string, error) {
+	parts := []string{"job", job}
+	if labels = strings.Trim(labels, "/"); labels != "" {
+		parts = append(parts, strings.Split(labels, "/")...)
+	}
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("label %s has no value", parts[len(parts)-1])
+	}
+	key := make(map[string]string, len(parts)/2)
+	for i := 0; i < len(parts); i += 2 {
+		name, value := parts[i], parts[i+1]
+		if n, ok := strings.CutSuffix(name, "@base64"); ok {
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, fmt.Errorf("label %s: invalid base64", n)
+			}
+			name, value = n, string(decoded)
+		}
+		key[name] = value
+	}
+	if key["job"] == "" {
+		return nil, fmt.Errorf("job is required")
+	}
+	return key, nil
+}
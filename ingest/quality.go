@@ -0,0 +1,86 @@
+package ingest
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The ranges the sensors can measure, the DS18B20 on the boiler's flow and
+// the DHT22 in the room. Readings beyond them are stored but flagged
+// suspect.
+const (
+	minTempCo, maxTempCo     = -55, 125
+	minTempRoom, maxTempRoom = -40, 80
+	// ds18b20PowerOn is what a DS18B20 reads before its first conversion,
+	// e.g. after a brown-out; a real 85.0 °C is flagged too.
+	ds18b20PowerOn = 85
+)
+
+// anomalyWindow is how close to the device's previous reading a reading
+// must be stamped to be compared with it.
+const anomalyWindow = 15 * time.Minute
+
+var flaggedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "esp8266_ingest_flagged_total",
+	Help: "Readings flagged on ingest by device and quality: suspect or anomalous.",
+}, []string{"device", "quality"})
+
+// Plausible returns store.QualitySuspect when r's values are beyond what
+// the sensors measure, store.QualityOK otherwise.
+func Plausible(r store.TemperatureReading) string {
+	if r.TempCo < minTempCo || r.TempCo > maxTempCo || r.TempCo == ds18b20PowerOn ||
+		r.TempRoom < minTempRoom || r.TempRoom > maxTempRoom {
+		return store.QualitySuspect
+	}
+	return store.QualityOK
+}
+
+// previousReadings are the newest plausible reading of every device, for
+// anomaly detection.
+type previousReadings struct {
+	mu      sync.Mutex
+	devices map[string]store.TemperatureReading
+}
+
+// Quality flags a valid reading sent by device: suspect when implausible
+// and, with Config.AnomalyDelta set, anomalous when a temperature is more
+// than that off the device's previous reading stamped within
+// anomalyWindow. A reading flagged before keeps its quality.
+func (p *Pipeline) Quality(device string, r store.TemperatureReading) string {
+	if r.Quality != "" {
+		return r.Quality
+	}
+	q := Plausible(r)
+	if q == store.QualityOK && p.cfg.AnomalyDelta > 0 && r.Timestamp != nil {
+		q = p.previous.compare(device, r, p.cfg.AnomalyDelta)
+	}
+	if q != store.QualityOK {
+		flaggedTotal.WithLabelValues(device, q).Inc()
+	}
+	return q
+}
+
+// compare flags r anomalous against device's previous reading and makes it
+// the previous one when it is newer.
+func (pr *previousReadings) compare(device string, r store.TemperatureReading, delta float64) string {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	q := store.QualityOK
+	prev, ok := pr.devices[device]
+	if ok && (time.Duration(*r.Timestamp-*prev.Timestamp)*time.Second).Abs() <= anomalyWindow &&
+		(math.Abs(r.TempCo-prev.TempCo) > delta || math.Abs(r.TempRoom-prev.TempRoom) > delta) {
+		q = store.QualityAnomalous
+	}
+	if !ok || *r.Timestamp > *prev.Timestamp {
+		if pr.devices == nil {
+			pr.devices = make(map[string]store.TemperatureReading)
+		}
+		pr.devices[device] = r
+	}
+	return q
+}
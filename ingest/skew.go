@@ -0,0 +1,66 @@
+package ingest
+
+import (
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var clockSkewGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "esp8266_device_clock_skew_seconds",
+	Help: "Newest reading timestamp the device sent minus the time it was received, positive when its clock is ahead.",
+}, []string{"device"})
+
+// Skew is how far a device's clock was off when it last sent timestamped
+// readings.
+type Skew struct {
+	// Seconds is positive when the device's clock is ahead.
+	Seconds int64
+	// At is when it was measured.
+	At time.Time
+}
+
+var clockSkews = struct {
+	mu sync.Mutex
+	at map[string]Skew
+}{at: make(map[string]Skew)}
+
+// RecordSkew measures device's clock as it sent a reading stamped sent,
+// its newest, received at received. A backlog uploaded late reads as
+// behind by up to its age.
+func RecordSkew(device string, sent int64, received time.Time) {
+	if device == "" {
+		return
+	}
+	s := Skew{Seconds: sent - received.Unix(), At: received}
+	clockSkews.mu.Lock()
+	defer clockSkews.mu.Unlock()
+	clockSkews.at[device] = s
+	clockSkewGauge.WithLabelValues(device).Set(float64(s.Seconds))
+}
+
+// newestTimestamp returns the newest timestamp of readings, false when
+// none has one.
+func newestTimestamp(readings []store.TemperatureReading) (int64, bool) {
+	var newest *int64
+	for _, r := range readings {
+		if r.Timestamp != nil && (newest == nil || *r.Timestamp > *newest) {
+			newest = r.Timestamp
+		}
+	}
+	if newest == nil {
+		return 0, false
+	}
+	return *newest, true
+}
+
+// ClockSkews returns the clock skew of every device known to this process.
+func ClockSkews() map[string]Skew {
+	clockSkews.mu.Lock()
+	defer clockSkews.mu.Unlock()
+	return maps.Clone(clockSkews.at)
+}
@@ -0,0 +1,119 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// FirmwareHeader carries the firmware version of the device sending a
+// request.
+const FirmwareHeader = "X-Firmware-Version"
+
+var (
+	firmwareInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "esp8266_device_firmware_info",
+		Help: "Always 1, the firmware version the device last reported.",
+	}, []string{"device", "version"})
+	firmwareOutdated = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "esp8266_device_firmware_outdated",
+		Help: "1 while the device runs a firmware version older than the minimum, 0 otherwise.",
+	}, []string{"device"})
+)
+
+// CompareVersions compares dotted versions like 1.10.2 by their numeric
+// parts, returning -1, 0 or 1. A leading "v" and anything after a "-" or
+// "+" are ignored; missing parts count as 0 and a part that isn't a
+// number is compared as text.
+func CompareVersions(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := range max(len(pa), len(pb)) {
+		x, y := "0", "0"
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		nx, errX := strconv.ParseUint(x, 10, 64)
+		ny, errY := strconv.ParseUint(y, 10, 64)
+		switch {
+		case errX == nil && errY == nil && nx != ny:
+			if nx < ny {
+				return -1
+			}
+			return 1
+		case (errX != nil || errY != nil) && x != y:
+			return strings.Compare(x, y)
+		}
+	}
+	return 0
+}
+
+func versionParts(v string) []string {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	return strings.Split(v, ".")
+}
+
+// firmwareVersions are the versions recorded by this process, by device,
+// so a version is only stored when it changes.
+type firmwareVersions struct {
+	mu      sync.Mutex
+	devices map[string]string
+}
+
+// Outdated reports whether version is older than Config.MinFirmware.
+func (p *Pipeline) Outdated(version string) bool {
+	return p.cfg.MinFirmware != "" && CompareVersions(version, p.cfg.MinFirmware) < 0
+}
+
+// MinFirmware returns Config.MinFirmware.
+func (p *Pipeline) MinFirmware() string {
+	return p.cfg.MinFirmware
+}
+
+// Firmware records that device runs version, as reported with readings or
+// a command poll, and exports it on /metrics. Versions are stored, when
+// the store keeps them, only as they change; a change to an outdated
+// version is logged.
+func (p *Pipeline) Firmware(ctx context.Context, device, version string) error {
+	if device == "" || version == "" {
+		return nil
+	}
+	p.firmware.mu.Lock()
+	defer p.firmware.mu.Unlock()
+	prev, ok := p.firmware.devices[device]
+	if ok && prev == version {
+		return nil
+	}
+	if fs, ok := p.store.(store.FirmwareStore); ok {
+		if err := fs.SetDeviceFirmware(ctx, device, version, p.now().Unix()); err != nil {
+			return fmt.Errorf("set firmware of %s: %w", device, err)
+		}
+	}
+	if ok {
+		firmwareInfo.DeleteLabelValues(device, prev)
+	}
+	firmwareInfo.WithLabelValues(device, version).Set(1)
+	outdated := p.Outdated(version)
+	if outdated {
+		firmwareOutdated.WithLabelValues(device).Set(1)
+		p.logger.Warn("device runs outdated firmware", "device", device, "version", version, "min_version", p.cfg.MinFirmware)
+	} else {
+		firmwareOutdated.WithLabelValues(device).Set(0)
+	}
+	if p.firmware.devices == nil {
+		p.firmware.devices = make(map[string]string)
+	}
+	p.firmware.devices[device] = version
+	return nil
+}
@@ -0,0 +1,114 @@
+package ingest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SignatureHMACSHA256 signs the request body with HMAC-SHA256, sent hex
+// encoded, optionally prefixed by "sha256=".
+const SignatureHMACSHA256 = "hmac-sha256"
+
+const (
+	// DefaultSecretHeader carries a webhook's shared secret.
+	DefaultSecretHeader = "X-Webhook-Secret"
+	// DefaultSignatureHeader carries a webhook's body signature.
+	DefaultSignatureHeader = "X-Signature"
+)
+
+// Reasons a request to an adapter is rejected, the reason label of
+// esp8266_ingest_rejected_total.
+const (
+	// RejectMissing is a request without a key, secret or signature.
+	RejectMissing = "missing"
+	// RejectInvalid is a request with a wrong key, secret or signature.
+	RejectInvalid = "invalid"
+)
+
+var rejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "esp8266_ingest_rejected_total",
+	Help: "Requests to ingest adapters rejected as unauthorized, by adapter and reason: missing or invalid.",
+}, []string{"adapter", "reason"})
+
+// Rejected counts a request to adapter rejected for reason.
+func Rejected(adapter, reason string) {
+	rejectedTotal.WithLabelValues(adapter, reason).Inc()
+}
+
+// Webhook authorizes the requests of a platform calling an adapter without
+// the secret key, by a shared secret in a header or a signature of the
+// body, whichever the platform supports.
+type Webhook struct {
+	// Secret is the shared secret, or the HMAC key with Signature.
+	Secret string `yaml:"secret" json:"secret"`
+	// Signature is SignatureHMACSHA256 for signed bodies, or empty for a
+	// shared secret sent as is.
+	Signature string `yaml:"signature" json:"signature"`
+	// Header carries the secret or signature. Defaults to
+	// DefaultSecretHeader, or DefaultSignatureHeader with Signature.
+	Header string `yaml:"header" json:"header"`
+}
+
+// ValidateWebhooks checks webhooks, keyed by adapter name.
+func ValidateWebhooks(webhooks map[string]Webhook) error {
+	var errs []error
+	for name, w := range webhooks {
+		if len(w.Secret) < 16 {
+			errs = append(errs, fmt.Errorf("webhook %s: secret must be at least 16 characters", name))
+		}
+		if w.Signature != "" && w.Signature != SignatureHMACSHA256 {
+			errs = append(errs, fmt.Errorf("webhook %s: signature must be %s or empty", name, SignatureHMACSHA256))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (w Webhook) header() string {
+	switch {
+	case w.Header != "":
+		return w.Header
+	case w.Signature != "":
+		return DefaultSignatureHeader
+	}
+	return DefaultSecretHeader
+}
+
+// Present reports whether r carries the webhook's header at all.
+func (w Webhook) Present(r *http.Request) bool {
+	return r.Header.Get(w.header()) != ""
+}
+
+// Verify reports whether r carries the shared secret or a valid signature
+// of its body, which it leaves for Parse to read.
+func (w Webhook) Verify(r *http.Request) (bool, error) {
+	got := r.Header.Get(w.header())
+	if got == "" {
+		return false, nil
+	}
+	if w.Signature == "" {
+		return subtle.ConstantTimeCompare([]byte(got), []byte(w.Secret)) == 1, nil
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(got, "sha256="))
+	if err != nil {
+		return false, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return false, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil)), nil
+}
@@ -0,0 +1,180 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"strings"
+	"sync"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// FormatZigbee2MQTT is the MQTT format of Zigbee2MQTT.
+	FormatZigbee2MQTT = "zigbee2mqtt"
+	// DefaultZigbee2MQTTTopic is the base topic Zigbee2MQTT publishes under
+	// unless configured otherwise.
+	DefaultZigbee2MQTTTopic = "zigbee2mqtt"
+)
+
+var (
+	batteryGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "esp8266_device_battery_percent",
+		Help: "Battery level the device last reported.",
+	}, []string{"device"})
+	linkQualityGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "esp8266_device_link_quality",
+		Help: "Zigbee link quality the device was last received with, 0 to 255.",
+	}, []string{"device"})
+)
+
+// zigbeeState is the part of a Zigbee2MQTT device state message readings
+// are made of.
+type zigbeeState struct {
+	Temperature *float64 `json:"temperature"`
+	Humidity    *float64 `json:"humidity"`
+	Battery     *float64 `json:"battery"`
+	LinkQuality *float64 `json:"linkquality"`
+}
+
+// zigbeeDevice is a device of the bridge/devices message.
+type zigbeeDevice struct {
+	FriendlyName string `json:"friendly_name"`
+	IEEEAddress  string `json:"ieee_address"`
+	Type         string `json:"type"`
+	Definition   *struct {
+		Vendor string `json:"vendor"`
+		Model  string `json:"model"`
+	} `json:"definition"`
+}
+
+// zigbeeRegistry remembers the devices labelled, so each is labelled once
+// per process and bridge/devices message.
+type zigbeeRegistry struct {
+	mu   sync.Mutex
+	done map[string]bool
+}
+
+// parseZigbee2MQTT decodes the message of a Zigbee2MQTT topic under base:
+// the state of the device the rest of the topic names, which has a reading
+// when it reports a temperature or humidity, or with devices set, the
+// bridge's device list. Other bridge topics and the availability, get and
+// set topics of devices are skipped.
+func parseZigbee2MQTT(base, topic string, payload []byte) (b Batch, state zigbeeState, devices []zigbeeDevice, err error) {
+	name, ok := strings.CutPrefix(topic, base+"/")
+	if !ok || name == "" {
+		return Batch{}, state, nil, nil
+	}
+	if name == "bridge/devices" {
+		err = json.Unmarshal(payload, &devices)
+		return Batch{}, state, devices, err
+	}
+	if strings.HasPrefix(name, "bridge/") {
+		return Batch{}, state, nil, nil
+	}
+	for _, suffix := range []string{"/availability", "/get", "/set"} {
+		if strings.HasSuffix(name, suffix) || strings.Contains(name, suffix+"/") {
+			return Batch{}, state, nil, nil
+		}
+	}
+	if err := json.Unmarshal(payload, &state); err != nil {
+		return Batch{}, state, nil, err
+	}
+	b.Device = name
+	if state.Temperature != nil || state.Humidity != nil {
+		var tr store.TemperatureReading
+		if state.Temperature != nil {
+			tr.TempRoom = *state.Temperature
+		}
+		if state.Humidity != nil {
+			tr.Humidity = *state.Humidity
+		}
+		b.Readings = []store.TemperatureReading{tr}
+	}
+	return b, state, nil, nil
+}
+
+// handleZigbee2MQTT ingests a Zigbee2MQTT message, exports the battery and
+// link quality of devices and labels them when the store keeps labels.
+func (m *MQTT) handleZigbee2MQTT(ctx context.Context, p *Pipeline, topic string, payload []byte) error {
+	b, state, devices, err := parseZigbee2MQTT(m.Topic, topic, payload)
+	if err != nil {
+		return err
+	}
+	if devices != nil {
+		m.registry.mu.Lock()
+		m.registry.done = nil
+		m.registry.mu.Unlock()
+		for _, d := range devices {
+			if d.Type == "Coordinator" || d.FriendlyName == "" {
+				continue
+			}
+			labels := map[string]string{"source": FormatZigbee2MQTT, "ieee": d.IEEEAddress}
+			if d.Definition != nil {
+				labels["vendor"], labels["model"] = d.Definition.Vendor, d.Definition.Model
+			}
+			if err := m.register(ctx, p, d.FriendlyName, labels); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if b.Device == "" {
+		return nil
+	}
+	if state.Battery != nil {
+		batteryGauge.WithLabelValues(b.Device).Set(*state.Battery)
+	}
+	if state.LinkQuality != nil {
+		linkQualityGauge.WithLabelValues(b.Device).Set(*state.LinkQuality)
+	}
+	if len(b.Readings) == 0 {
+		return nil
+	}
+	if err := m.register(ctx, p, b.Device, map[string]string{"source": FormatZigbee2MQTT}); err != nil {
+		return err
+	}
+	_, err = p.Ingest(ctx, m.Name(), b)
+	return err
+}
+
+// register adds the labels device doesn't have yet, keeping those set
+// otherwise, once per process unless the bridge lists devices again.
+func (m *MQTT) register(ctx context.Context, p *Pipeline, device string, labels map[string]string) error {
+	ls, ok := p.store.(store.LabelStore)
+	if !ok {
+		return nil
+	}
+	m.registry.mu.Lock()
+	defer m.registry.mu.Unlock()
+	if m.registry.done[device] {
+		return nil
+	}
+	all, err := ls.DeviceLabels(ctx)
+	if err != nil {
+		return err
+	}
+	merged := maps.Clone(all[device])
+	if merged == nil {
+		merged = make(map[string]string, len(labels))
+	}
+	for k, v := range labels {
+		if _, ok := merged[k]; !ok && v != "" {
+			merged[k] = v
+		}
+	}
+	if !maps.Equal(merged, all[device]) {
+		if err := ls.SetDeviceLabels(ctx, device, merged); err != nil {
+			return err
+		}
+		p.logger.Info("registered zigbee2mqtt device", "device", device, "labels", merged)
+	}
+	if m.registry.done == nil {
+		m.registry.done = make(map[string]bool)
+	}
+	m.registry.done[device] = true
+	return nil
+}
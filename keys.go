@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/server"
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+// runKeys handles `keys [flags] import|hash`, the way from plaintext keys
+// to hashed ones:
+//
+//   - import stores the secret key and the API keys of the config file
+//     hashed in the database, after which the API keys can be removed from
+//     the file and the secret key replaced by one the devices don't know.
+//   - hash prints the bcrypt hash of the key read from stdin, for an API
+//     key of the config file given by its hash.
+func runKeys(logger *slog.Logger, args []string) error {
+	var cfg config
+	fs := flag.NewFlagSet("keys", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	secretKeyName := fs.String("secret-key-name", "secret-key", "Name the secret key is imported as with every scope, empty to leave it out")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: esp8266-web keys [flags] import|hash")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	switch action := fs.Arg(0); action {
+	case "hash":
+		key, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		hash, err := server.HashKey(strings.TrimSpace(key))
+		if err != nil {
+			return err
+		}
+		fmt.Println(hash)
+		return nil
+	case "import":
+	case "":
+		fs.Usage()
+		return errors.New("missing keys action")
+	default:
+		return fmt.Errorf("unknown keys action %q", action)
+	}
+
+	if err := cfg.applyProfile(fs, logger); err != nil {
+		return err
+	}
+	if err := cfg.applyEnv(logger); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	reloader, err := cfg.loadSettings(ctx, logger)
+	if err != nil {
+		return err
+	}
+	if _, err := cfg.watchSecrets(ctx, logger); err != nil {
+		return err
+	}
+	keys := reloader.APIKeys()
+	if *secretKeyName != "" && cfg.secretKey != "" {
+		keys = append([]server.APIKey{{Name: *secretKeyName, Key: cfg.secretKey, Scopes: server.Scopes}}, keys...)
+	}
+
+	db, err := openStore(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ks, ok := db.(store.APIKeyStore)
+	if !ok {
+		return fmt.Errorf("keys import is not supported by db driver %q", cfg.dbDriver)
+	}
+	return importKeys(ctx, ks, keys, os.Stdout)
+}
+
+// importKeys stores the keys given in plaintext hashed, keeping keys stored
+// under the same name, and writes what it did to w.
+func importKeys(ctx context.Context, ks store.APIKeyStore, keys []server.APIKey, w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSCOPES\tRESULT")
+	var errs []error
+	for _, k := range keys {
+		result := "imported"
+		if k.Key == "" {
+			result = "skipped, hashed in the config file"
+		} else if hash, err := server.HashKey(k.Key); err != nil {
+			result = "failed"
+			errs = append(errs, fmt.Errorf("key %s: %w", k.Name, err))
+		} else if err := ks.CreateAPIKey(ctx, store.APIKey{Name: k.Name, Hash: hash, Scopes: k.Scopes, CreatedAt: time.Now().Unix()}); errors.Is(err, store.ErrExists) {
+			result = "skipped, already stored"
+		} else if err != nil {
+			result = "failed"
+			errs = append(errs, fmt.Errorf("key %s: %w", k.Name, err))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", k.Name, strings.Join(k.Scopes, ","), result)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
@@ -2,362 +2,1252 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
-	"github.com/google/uuid"
+	"github.com/bartosz121/esp8266-web/alert"
+	"github.com/bartosz121/esp8266-web/control"
+	"github.com/bartosz121/esp8266-web/features"
+	"github.com/bartosz121/esp8266-web/ingest"
+	"github.com/bartosz121/esp8266-web/middleware"
+	"github.com/bartosz121/esp8266-web/modbus"
+	"github.com/bartosz121/esp8266-web/server"
+	"github.com/bartosz121/esp8266-web/sink"
+	"github.com/bartosz121/esp8266-web/snmp"
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/clickhouse"
+	"github.com/bartosz121/esp8266-web/store/influx"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/bartosz121/esp8266-web/store/postgres"
+	"github.com/bartosz121/esp8266-web/systemd"
+	"github.com/bartosz121/esp8266-web/weather"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	slogctx "github.com/veqryn/slog-context"
 )
 
-type TemperatureReadingPayload struct {
-	TempCo    float64 `json:"tempCo"`
-	TempRoom  float64 `json:"tempRoom"`
-	Humidity  float64 `json:"humidity"`
-	Timestamp *int64  `json:"timestamp"`
-}
+var logLevel = new(slog.LevelVar)
 
-type TemperatureReading struct {
-	Id        int     `json:"id"`
-	TempCo    float64 `json:"tempCo"`
-	TempRoom  float64 `json:"tempRoom"`
-	Humidity  float64 `json:"humidity"`
-	Timestamp *int64  `json:"timestamp"`
-}
+// shutdownTimeout is how long the requests in flight may take to finish
+// once the server is stopped or upgraded.
+const shutdownTimeout = 30 * time.Second
 
-type app struct {
-	db        *pgxpool.Pool
-	secretKey string
-}
+type config struct {
+	configPath string
+	profile    string
+	logLevel   string
+	host       string
+	port       int
+	dbDriver   string
+	dbHost     string
+	dbPort     int
+	dbUser     string
+	dbPass     string
+	dbName     string
+	dbMaxConns int
+	dbTimeout  time.Duration
+	// dbPgBouncer avoids named prepared statements, which PgBouncer can't
+	// route in transaction pooling mode.
+	dbPgBouncer bool
+	// slowQueryThreshold is how long a PostgreSQL statement may take
+	// before it is logged.
+	slowQueryThreshold time.Duration
+	// queryDBUser is the restricted role ad-hoc queries at POST /query
+	// connect as; the endpoint is disabled without it.
+	queryDBUser  string
+	queryDBPass  string
+	queryTimeout time.Duration
+	secretKey    string
+	// keyGracePeriod is how long a rotated-out secret key keeps working.
+	keyGracePeriod time.Duration
 
-func main() {
-	h := slogctx.NewHandler(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}), nil)
-	logger := slog.New(h)
-	slog.SetDefault(logger)
+	secretsProvider string
+	vaultAddr       string
+	vaultToken      string
+	vaultDBPath     string
+	vaultKVPath     string
+
+	publicURL      string
+	telegramToken  string
+	telegramChatID string
+	smtpAddr       string
+	smtpUser       string
+	smtpPass       string
+	smtpFrom       string
+	emailTo        string
+	twilioSID      string
+	twilioToken    string
+	twilioFrom     string
+	smsTo          string
+
+	forwardURL       string
+	forwardDevice    string
+	forwardSecretKey string
+	influxURL        string
+	influxToken      string
+	influxOrg        string
+	influxBucket     string
+	mqttBroker       string
+	mqttTopic        string
+	mqttUser         string
+	mqttPass         string
+	mqttIngestTopic  string
+	mqttIngestFormat string
+	clickhouseURL    string
+	clickhouseDB     string
+	clickhouseUser   string
+	clickhousePass   string
+	kafkaBrokers     string
+	natsURL          string
+	natsStream       string
+	eventsPrefix     string
+	modbusAddr       string
+	modbusDevices    string
+	snmpAddr         string
+	snmpDevices      string
+	snmpCommunity    string
+	bacnetAddr       string
+	bacnetDeviceID   uint
+	graphiteAddr     string
+	statsdAddr       string
+	owmAPIKey        string
+	weatherLat       float64
+	weatherLon       float64
+	weatherInterval  time.Duration
+
+	ingestBatchInterval time.Duration
+	ingestBatchWorkers  int
+	ingestAck           string
+
+	// beforeConnect is set when database credentials come from a secrets
+	// provider.
+	beforeConnect func(context.Context, *pgx.ConnConfig) error
+}
 
-	host := flag.String("host", "127.0.0.1", "Server host")
-	port := flag.Int("port", 8080, "Server port")
-	dbHost := flag.String("db-host", "localhost", "Database host")
-	dbPort := flag.Int("db-port", 5432, "Database port")
-	dbUser := flag.String("db-user", "user", "Database user")
-	dbPass := flag.String("db-pass", "", "Database password")
-	dbName := flag.String("db-name", "dbname", "Database name")
-	flag.Parse()
+func (c *config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.configPath, "config", "", "Path to a YAML file with reloadable settings")
+	fs.StringVar(&c.profile, "profile", "", "Preset bundle of settings for a kind of deployment: "+strings.Join(profileNames(), ", ")+"; flags and env variables override its values")
+	fs.StringVar(&c.logLevel, "log-level", "debug", "Log level: debug, info, warn or error")
+	fs.StringVar(&c.host, "host", "127.0.0.1", "Server host")
+	fs.IntVar(&c.port, "port", 8080, "Server port")
+	fs.StringVar(&c.dbDriver, "db-driver", "postgres", "Storage backend: postgres, memory, influx or clickhouse")
+	fs.StringVar(&c.dbHost, "db-host", "localhost", "Database host")
+	fs.IntVar(&c.dbPort, "db-port", 5432, "Database port")
+	fs.StringVar(&c.dbUser, "db-user", "user", "Database user")
+	fs.StringVar(&c.dbPass, "db-pass", "", "Database password")
+	fs.StringVar(&c.dbName, "db-name", "dbname", "Database name")
+	fs.IntVar(&c.dbMaxConns, "db-max-conns", 0, "Most PostgreSQL connections in the pool, 0 for pgx's default of max(4, CPUs)")
+	fs.DurationVar(&c.dbTimeout, "db-timeout", postgres.DefaultTimeout, "How long a PostgreSQL store call may take, 0 for no limit")
+	fs.BoolVar(&c.dbPgBouncer, "db-pgbouncer", false, "Don't cache prepared statements, for PostgreSQL behind PgBouncer in transaction pooling mode")
+	fs.DurationVar(&c.slowQueryThreshold, "slow-query-threshold", postgres.DefaultSlowQueryThreshold, "Log PostgreSQL statements taking longer, 0 disables")
+	fs.StringVar(&c.queryDBUser, "query-db-user", "", "Restricted database user ad-hoc queries at POST /query run as; the endpoint is disabled when empty")
+	fs.StringVar(&c.queryDBPass, "query-db-pass", "", "Password of --query-db-user")
+	fs.DurationVar(&c.queryTimeout, "query-timeout", server.DefaultQueryTimeout, "How long an ad-hoc query may run")
+	fs.DurationVar(&c.keyGracePeriod, "key-grace-period", server.DefaultKeyGracePeriod, "How long the previous secret key keeps working after a rotation")
+	fs.StringVar(&c.secretsProvider, "secrets-provider", "env", "Where the database credentials and secret key come from: env or vault")
+	fs.StringVar(&c.vaultAddr, "vault-addr", "", "Vault address, e.g. https://vault:8200")
+	fs.StringVar(&c.vaultDBPath, "vault-db-path", "", "Vault database secrets engine path issuing DB credentials, e.g. database/creds/esp8266-web")
+	fs.StringVar(&c.vaultKVPath, "vault-kv-path", "", "Vault KV secret holding secret_key (and optionally db_user, db_pass), e.g. secret/data/esp8266-web")
+	fs.StringVar(&c.publicURL, "public-url", "", "Public base URL of the server, used for acknowledge links in alert notifications and given to claimed devices, which can't be claimed without it")
+	fs.StringVar(&c.telegramChatID, "telegram-chat-id", "", "Telegram chat receiving alert notifications")
+	fs.StringVar(&c.smtpAddr, "smtp-addr", "", "SMTP server for alert emails, host:port")
+	fs.StringVar(&c.smtpUser, "smtp-user", "", "SMTP username")
+	fs.StringVar(&c.smtpFrom, "smtp-from", "", "Sender address of alert emails")
+	fs.StringVar(&c.emailTo, "email-to", "", "Comma-separated recipients of alert emails")
+	fs.StringVar(&c.twilioSID, "twilio-sid", "", "Twilio account SID for alert SMS")
+	fs.StringVar(&c.twilioFrom, "twilio-from", "", "Twilio phone number alert SMS are sent from")
+	fs.StringVar(&c.smsTo, "sms-to", "", "Comma-separated phone numbers receiving alert SMS")
+	fs.StringVar(&c.forwardURL, "forward-url", "", "Upstream esp8266-web instance to replicate readings to, e.g. https://temp.example.com")
+	fs.StringVar(&c.forwardDevice, "forward-device", "", "Name of this instance upstream, defaults to the hostname")
+	fs.StringVar(&c.influxURL, "influx-url", "", "InfluxDB 2.x to store readings in with --db-driver=influx, or to also write them to, e.g. http://influx:8086")
+	fs.StringVar(&c.influxOrg, "influx-org", "", "InfluxDB organization")
+	fs.StringVar(&c.influxBucket, "influx-bucket", "", "InfluxDB bucket")
+	fs.StringVar(&c.mqttBroker, "mqtt-broker", "", "MQTT broker to also publish readings to, e.g. tcp://mqtt:1883")
+	fs.StringVar(&c.mqttTopic, "mqtt-topic", "esp8266/readings", "MQTT topic readings are published to")
+	fs.StringVar(&c.mqttUser, "mqtt-user", "", "MQTT username")
+	fs.StringVar(&c.mqttIngestTopic, "mqtt-ingest-topic", "", "MQTT topic to ingest readings from, a + level names the device, e.g. esp8266/+/data")
+	fs.StringVar(&c.mqttIngestFormat, "mqtt-ingest-format", "", "Format of ingested MQTT messages: empty for the /data JSON or zigbee2mqtt, then the topic is the Zigbee2MQTT base topic, zigbee2mqtt by default")
+	fs.StringVar(&c.clickhouseURL, "clickhouse-url", "", "ClickHouse HTTP endpoint used with --db-driver=clickhouse, e.g. http://clickhouse:8123")
+	fs.StringVar(&c.clickhouseDB, "clickhouse-db", "default", "ClickHouse database")
+	fs.StringVar(&c.clickhouseUser, "clickhouse-user", "", "ClickHouse username")
+	fs.StringVar(&c.kafkaBrokers, "kafka-brokers", "", "Comma-separated Kafka brokers to publish reading and alert events to, e.g. kafka:9092")
+	fs.StringVar(&c.natsURL, "nats-url", "", "NATS server to publish reading and alert events to with JetStream, e.g. nats://nats:4222")
+	fs.StringVar(&c.natsStream, "nats-stream", "ESP8266", "JetStream stream created for the events, empty to use an existing one")
+	fs.StringVar(&c.eventsPrefix, "events-topic-prefix", "esp8266", "Events go to <prefix>.readings and <prefix>.alerts topics or subjects")
+	fs.StringVar(&c.modbusAddr, "modbus-addr", "", "Address to serve the latest readings on as Modbus TCP registers, e.g. :502, empty disables")
+	fs.StringVar(&c.modbusDevices, "modbus-devices", "default", "Comma-separated devices given Modbus register blocks in order, default is readings sent without a device")
+	fs.StringVar(&c.snmpAddr, "snmp-addr", "", "UDP address to serve the latest readings on with a read-only SNMP agent, e.g. :161, empty disables")
+	fs.StringVar(&c.snmpDevices, "snmp-devices", "default", "Comma-separated devices given SNMP table rows in order, default is readings sent without a device")
+	fs.StringVar(&c.snmpCommunity, "snmp-community", snmp.DefaultCommunity, "SNMP community requests must carry")
+	fs.StringVar(&c.bacnetAddr, "bacnet-addr", "", "UDP address to serve location temperatures on as BACnet/IP analog inputs, e.g. :47808, empty disables; needs a build with -tags bacnet")
+	fs.UintVar(&c.bacnetDeviceID, "bacnet-device-id", 8266, "BACnet device instance, unique on the BACnet network")
+	fs.StringVar(&c.graphiteAddr, "graphite-addr", "", "TCP address to ingest graphite plaintext metrics on, mapped by metric_paths of the config file, e.g. :2003, empty disables")
+	fs.StringVar(&c.statsdAddr, "statsd-addr", "", "UDP address to ingest StatsD gauges on, mapped by metric_paths of the config file, e.g. :8125, empty disables")
+	fs.Float64Var(&c.weatherLat, "weather-lat", 0, "Latitude of the location outdoor weather is fetched for, with APP_OWM_API_KEY set")
+	fs.Float64Var(&c.weatherLon, "weather-lon", 0, "Longitude of the location outdoor weather is fetched for")
+	fs.DurationVar(&c.weatherInterval, "weather-interval", weather.DefaultInterval, "How often outdoor weather is fetched from OpenWeatherMap")
+	fs.DurationVar(&c.ingestBatchInterval, "ingest-batch-interval", 0, "Queue ingested readings and store them together this often, e.g. 100ms, 0 stores every request's at once")
+	fs.IntVar(&c.ingestBatchWorkers, "ingest-batch-workers", ingest.DefaultBatchWorkers, "Workers storing queued readings")
+	fs.StringVar(&c.ingestAck, "ingest-ack", ingest.AckStored, "When ingest requests are answered with batching: stored or queued")
+}
 
-	// env variables take precedence, prefix APP_
+// applyEnv overrides flag values with env variables, prefix APP_
+func (c *config) applyEnv(logger *slog.Logger) error {
+	if env := os.Getenv("APP_CONFIG"); env != "" {
+		c.configPath = env
+		logger.Debug("flag config overridden by env APP_CONFIG", "value", env)
+	}
+	if env := os.Getenv("APP_LOG_LEVEL"); env != "" {
+		c.logLevel = env
+		logger.Debug("flag log-level overridden by env APP_LOG_LEVEL", "value", env)
+	}
 	if env := os.Getenv("APP_HOST"); env != "" {
-		*host = env
+		c.host = env
 		logger.Debug("flag host overridden by env APP_HOST", "value", env)
 	}
 	if env := os.Getenv("APP_PORT"); env != "" {
 		if p, err := strconv.Atoi(env); err == nil {
-			*port = p
+			c.port = p
 			logger.Debug("flag port overridden by env APP_PORT", "value", p)
 		}
 	}
+	if env := os.Getenv("APP_DB_DRIVER"); env != "" {
+		c.dbDriver = env
+		logger.Debug("flag db-driver overridden by env APP_DB_DRIVER", "value", env)
+	}
 	if env := os.Getenv("APP_DB_HOST"); env != "" {
-		*dbHost = env
+		c.dbHost = env
 		logger.Debug("flag db-host overridden by env APP_DB_HOST", "value", env)
 	}
 	if env := os.Getenv("APP_DB_PORT"); env != "" {
 		if p, err := strconv.Atoi(env); err == nil {
-			*dbPort = p
+			c.dbPort = p
 			logger.Debug("flag db-port overridden by env APP_DB_PORT", "value", p)
 		}
 	}
 	if env := os.Getenv("APP_DB_USER"); env != "" {
-		*dbUser = env
+		c.dbUser = env
 		logger.Debug("flag db-user overridden by env APP_DB_USER", "value", env)
 	}
-	if env := os.Getenv("APP_DB_PASS"); env != "" {
-		*dbPass = env
+	if env, err := secretEnv("APP_DB_PASS"); err != nil {
+		return err
+	} else if env != "" {
+		c.dbPass = env
 		logger.Debug("flag db-pass overridden by env APP_DB_PASS", "value", "***")
 	}
 	if env := os.Getenv("APP_DB_NAME"); env != "" {
-		*dbName = env
+		c.dbName = env
 		logger.Debug("flag db-name overridden by env APP_DB_NAME", "value", env)
 	}
+	if env := os.Getenv("APP_DB_MAX_CONNS"); env != "" {
+		if v, err := strconv.Atoi(env); err == nil {
+			c.dbMaxConns = v
+			logger.Debug("flag db-max-conns overridden by env APP_DB_MAX_CONNS", "value", v)
+		}
+	}
+	if env := os.Getenv("APP_DB_TIMEOUT"); env != "" {
+		if d, err := time.ParseDuration(env); err == nil {
+			c.dbTimeout = d
+			logger.Debug("flag db-timeout overridden by env APP_DB_TIMEOUT", "value", d)
+		}
+	}
+	if env := os.Getenv("APP_DB_PGBOUNCER"); env != "" {
+		if v, err := strconv.ParseBool(env); err == nil {
+			c.dbPgBouncer = v
+			logger.Debug("flag db-pgbouncer overridden by env APP_DB_PGBOUNCER", "value", v)
+		}
+	}
+	if env := os.Getenv("APP_SLOW_QUERY_THRESHOLD"); env != "" {
+		if d, err := time.ParseDuration(env); err == nil {
+			c.slowQueryThreshold = d
+			logger.Debug("flag slow-query-threshold overridden by env APP_SLOW_QUERY_THRESHOLD", "value", d)
+		}
+	}
+	if env := os.Getenv("APP_QUERY_DB_USER"); env != "" {
+		c.queryDBUser = env
+		logger.Debug("flag query-db-user overridden by env APP_QUERY_DB_USER", "value", env)
+	}
+	if env, err := secretEnv("APP_QUERY_DB_PASS"); err != nil {
+		return err
+	} else if env != "" {
+		c.queryDBPass = env
+		logger.Debug("flag query-db-pass overridden by env APP_QUERY_DB_PASS", "value", "***")
+	}
+	if env := os.Getenv("APP_QUERY_TIMEOUT"); env != "" {
+		if d, err := time.ParseDuration(env); err == nil {
+			c.queryTimeout = d
+			logger.Debug("flag query-timeout overridden by env APP_QUERY_TIMEOUT", "value", d)
+		}
+	}
+	if env := os.Getenv("APP_SECRETS_PROVIDER"); env != "" {
+		c.secretsProvider = env
+		logger.Debug("flag secrets-provider overridden by env APP_SECRETS_PROVIDER", "value", env)
+	}
+	if env := os.Getenv("APP_VAULT_ADDR"); env != "" {
+		c.vaultAddr = env
+		logger.Debug("flag vault-addr overridden by env APP_VAULT_ADDR", "value", env)
+	}
+	if env := os.Getenv("APP_VAULT_DB_PATH"); env != "" {
+		c.vaultDBPath = env
+		logger.Debug("flag vault-db-path overridden by env APP_VAULT_DB_PATH", "value", env)
+	}
+	if env := os.Getenv("APP_VAULT_KV_PATH"); env != "" {
+		c.vaultKVPath = env
+		logger.Debug("flag vault-kv-path overridden by env APP_VAULT_KV_PATH", "value", env)
+	}
+	if env := os.Getenv("APP_PUBLIC_URL"); env != "" {
+		c.publicURL = env
+		logger.Debug("flag public-url overridden by env APP_PUBLIC_URL", "value", env)
+	}
+	if env := os.Getenv("APP_TELEGRAM_CHAT_ID"); env != "" {
+		c.telegramChatID = env
+		logger.Debug("flag telegram-chat-id overridden by env APP_TELEGRAM_CHAT_ID", "value", env)
+	}
+	if env := os.Getenv("APP_SMTP_ADDR"); env != "" {
+		c.smtpAddr = env
+		logger.Debug("flag smtp-addr overridden by env APP_SMTP_ADDR", "value", env)
+	}
+	if env := os.Getenv("APP_SMTP_USER"); env != "" {
+		c.smtpUser = env
+		logger.Debug("flag smtp-user overridden by env APP_SMTP_USER", "value", env)
+	}
+	if env := os.Getenv("APP_SMTP_FROM"); env != "" {
+		c.smtpFrom = env
+		logger.Debug("flag smtp-from overridden by env APP_SMTP_FROM", "value", env)
+	}
+	if env := os.Getenv("APP_EMAIL_TO"); env != "" {
+		c.emailTo = env
+		logger.Debug("flag email-to overridden by env APP_EMAIL_TO", "value", env)
+	}
+	if env := os.Getenv("APP_TWILIO_SID"); env != "" {
+		c.twilioSID = env
+		logger.Debug("flag twilio-sid overridden by env APP_TWILIO_SID", "value", env)
+	}
+	if env := os.Getenv("APP_TWILIO_FROM"); env != "" {
+		c.twilioFrom = env
+		logger.Debug("flag twilio-from overridden by env APP_TWILIO_FROM", "value", env)
+	}
+	if env := os.Getenv("APP_SMS_TO"); env != "" {
+		c.smsTo = env
+		logger.Debug("flag sms-to overridden by env APP_SMS_TO", "value", env)
+	}
+	if env := os.Getenv("APP_FORWARD_URL"); env != "" {
+		c.forwardURL = env
+		logger.Debug("flag forward-url overridden by env APP_FORWARD_URL", "value", env)
+	}
+	if env := os.Getenv("APP_FORWARD_DEVICE"); env != "" {
+		c.forwardDevice = env
+		logger.Debug("flag forward-device overridden by env APP_FORWARD_DEVICE", "value", env)
+	}
+	if env := os.Getenv("APP_INFLUX_URL"); env != "" {
+		c.influxURL = env
+		logger.Debug("flag influx-url overridden by env APP_INFLUX_URL", "value", env)
+	}
+	if env := os.Getenv("APP_INFLUX_ORG"); env != "" {
+		c.influxOrg = env
+		logger.Debug("flag influx-org overridden by env APP_INFLUX_ORG", "value", env)
+	}
+	if env := os.Getenv("APP_INFLUX_BUCKET"); env != "" {
+		c.influxBucket = env
+		logger.Debug("flag influx-bucket overridden by env APP_INFLUX_BUCKET", "value", env)
+	}
+	if env := os.Getenv("APP_MQTT_BROKER"); env != "" {
+		c.mqttBroker = env
+		logger.Debug("flag mqtt-broker overridden by env APP_MQTT_BROKER", "value", env)
+	}
+	if env := os.Getenv("APP_MQTT_TOPIC"); env != "" {
+		c.mqttTopic = env
+		logger.Debug("flag mqtt-topic overridden by env APP_MQTT_TOPIC", "value", env)
+	}
+	if env := os.Getenv("APP_MQTT_USER"); env != "" {
+		c.mqttUser = env
+		logger.Debug("flag mqtt-user overridden by env APP_MQTT_USER", "value", env)
+	}
+	if env := os.Getenv("APP_MQTT_INGEST_TOPIC"); env != "" {
+		c.mqttIngestTopic = env
+		logger.Debug("flag mqtt-ingest-topic overridden by env APP_MQTT_INGEST_TOPIC", "value", env)
+	}
+	if env := os.Getenv("APP_MQTT_INGEST_FORMAT"); env != "" {
+		c.mqttIngestFormat = env
+		logger.Debug("flag mqtt-ingest-format overridden by env APP_MQTT_INGEST_FORMAT", "value", env)
+	}
+	if env := os.Getenv("APP_CLICKHOUSE_URL"); env != "" {
+		c.clickhouseURL = env
+		logger.Debug("flag clickhouse-url overridden by env APP_CLICKHOUSE_URL", "value", env)
+	}
+	if env := os.Getenv("APP_CLICKHOUSE_DB"); env != "" {
+		c.clickhouseDB = env
+		logger.Debug("flag clickhouse-db overridden by env APP_CLICKHOUSE_DB", "value", env)
+	}
+	if env := os.Getenv("APP_CLICKHOUSE_USER"); env != "" {
+		c.clickhouseUser = env
+		logger.Debug("flag clickhouse-user overridden by env APP_CLICKHOUSE_USER", "value", env)
+	}
+	if env := os.Getenv("APP_KAFKA_BROKERS"); env != "" {
+		c.kafkaBrokers = env
+		logger.Debug("flag kafka-brokers overridden by env APP_KAFKA_BROKERS", "value", env)
+	}
+	if env := os.Getenv("APP_NATS_URL"); env != "" {
+		c.natsURL = env
+		logger.Debug("flag nats-url overridden by env APP_NATS_URL", "value", env)
+	}
+	if env := os.Getenv("APP_NATS_STREAM"); env != "" {
+		c.natsStream = env
+		logger.Debug("flag nats-stream overridden by env APP_NATS_STREAM", "value", env)
+	}
+	if env := os.Getenv("APP_EVENTS_TOPIC_PREFIX"); env != "" {
+		c.eventsPrefix = env
+		logger.Debug("flag events-topic-prefix overridden by env APP_EVENTS_TOPIC_PREFIX", "value", env)
+	}
+	if env := os.Getenv("APP_MODBUS_ADDR"); env != "" {
+		c.modbusAddr = env
+		logger.Debug("flag modbus-addr overridden by env APP_MODBUS_ADDR", "value", env)
+	}
+	if env := os.Getenv("APP_MODBUS_DEVICES"); env != "" {
+		c.modbusDevices = env
+		logger.Debug("flag modbus-devices overridden by env APP_MODBUS_DEVICES", "value", env)
+	}
+	if env := os.Getenv("APP_SNMP_ADDR"); env != "" {
+		c.snmpAddr = env
+		logger.Debug("flag snmp-addr overridden by env APP_SNMP_ADDR", "value", env)
+	}
+	if env := os.Getenv("APP_SNMP_DEVICES"); env != "" {
+		c.snmpDevices = env
+		logger.Debug("flag snmp-devices overridden by env APP_SNMP_DEVICES", "value", env)
+	}
+	if env := os.Getenv("APP_SNMP_COMMUNITY"); env != "" {
+		c.snmpCommunity = env
+		logger.Debug("flag snmp-community overridden by env APP_SNMP_COMMUNITY", "value", "***")
+	}
+	if env := os.Getenv("APP_BACNET_ADDR"); env != "" {
+		c.bacnetAddr = env
+		logger.Debug("flag bacnet-addr overridden by env APP_BACNET_ADDR", "value", env)
+	}
+	if env := os.Getenv("APP_BACNET_DEVICE_ID"); env != "" {
+		if v, err := strconv.ParseUint(env, 10, 32); err == nil {
+			c.bacnetDeviceID = uint(v)
+			logger.Debug("flag bacnet-device-id overridden by env APP_BACNET_DEVICE_ID", "value", v)
+		}
+	}
+	if env := os.Getenv("APP_GRAPHITE_ADDR"); env != "" {
+		c.graphiteAddr = env
+		logger.Debug("flag graphite-addr overridden by env APP_GRAPHITE_ADDR", "value", env)
+	}
+	if env := os.Getenv("APP_STATSD_ADDR"); env != "" {
+		c.statsdAddr = env
+		logger.Debug("flag statsd-addr overridden by env APP_STATSD_ADDR", "value", env)
+	}
+	if env := os.Getenv("APP_WEATHER_LAT"); env != "" {
+		if v, err := strconv.ParseFloat(env, 64); err == nil {
+			c.weatherLat = v
+			logger.Debug("flag weather-lat overridden by env APP_WEATHER_LAT", "value", v)
+		}
+	}
+	if env := os.Getenv("APP_WEATHER_LON"); env != "" {
+		if v, err := strconv.ParseFloat(env, 64); err == nil {
+			c.weatherLon = v
+			logger.Debug("flag weather-lon overridden by env APP_WEATHER_LON", "value", v)
+		}
+	}
+	if env := os.Getenv("APP_WEATHER_INTERVAL"); env != "" {
+		if d, err := time.ParseDuration(env); err == nil {
+			c.weatherInterval = d
+			logger.Debug("flag weather-interval overridden by env APP_WEATHER_INTERVAL", "value", d)
+		}
+	}
+	if env := os.Getenv("APP_INGEST_BATCH_INTERVAL"); env != "" {
+		if d, err := time.ParseDuration(env); err == nil {
+			c.ingestBatchInterval = d
+			logger.Debug("flag ingest-batch-interval overridden by env APP_INGEST_BATCH_INTERVAL", "value", d)
+		}
+	}
+	if env := os.Getenv("APP_INGEST_BATCH_WORKERS"); env != "" {
+		if v, err := strconv.Atoi(env); err == nil {
+			c.ingestBatchWorkers = v
+			logger.Debug("flag ingest-batch-workers overridden by env APP_INGEST_BATCH_WORKERS", "value", v)
+		}
+	}
+	if env := os.Getenv("APP_INGEST_ACK"); env != "" {
+		c.ingestAck = env
+		logger.Debug("flag ingest-ack overridden by env APP_INGEST_ACK", "value", env)
+	}
+	if env := os.Getenv("APP_KEY_GRACE_PERIOD"); env != "" {
+		if d, err := time.ParseDuration(env); err == nil {
+			c.keyGracePeriod = d
+			logger.Debug("flag key-grace-period overridden by env APP_KEY_GRACE_PERIOD", "value", d)
+		}
+	}
+	vaultToken, err := secretEnv("APP_VAULT_TOKEN")
+	if err != nil {
+		return err
+	}
+	c.vaultToken = vaultToken
+	secretKey, err := secretEnv("APP_SECRET_KEY")
+	if err != nil {
+		return err
+	}
+	c.secretKey = secretKey
+	if c.telegramToken, err = secretEnv("APP_TELEGRAM_TOKEN"); err != nil {
+		return err
+	}
+	if c.smtpPass, err = secretEnv("APP_SMTP_PASS"); err != nil {
+		return err
+	}
+	if c.twilioToken, err = secretEnv("APP_TWILIO_TOKEN"); err != nil {
+		return err
+	}
+	if c.forwardSecretKey, err = secretEnv("APP_FORWARD_SECRET_KEY"); err != nil {
+		return err
+	}
+	if c.influxToken, err = secretEnv("APP_INFLUX_TOKEN"); err != nil {
+		return err
+	}
+	if c.mqttPass, err = secretEnv("APP_MQTT_PASS"); err != nil {
+		return err
+	}
+	if c.clickhousePass, err = secretEnv("APP_CLICKHOUSE_PASS"); err != nil {
+		return err
+	}
+	if c.owmAPIKey, err = secretEnv("APP_OWM_API_KEY"); err != nil {
+		return err
+	}
+	return nil
+}
 
-	secretKey := os.Getenv("APP_SECRET_KEY")
-	if secretKey == "" {
-		logger.Error("APP_SECRET_KEY environment variable is required")
-		os.Exit(1)
+// secretEnv returns the value of the env variable name or, when name_FILE is
+// set instead, the contents of that file (e.g. a Docker secret under
+// /run/secrets), so secrets don't have to live in the process environment.
+func secretEnv(name string) (string, error) {
+	value, path := os.Getenv(name), os.Getenv(name+"_FILE")
+	if path == "" {
+		return value, nil
+	}
+	if value != "" {
+		return "", fmt.Errorf("both %s and %s_FILE are set", name, name)
 	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read %s_FILE: %w", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
 
-	connStr := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?application_name=esp8266-web",
-		*dbUser, *dbPass, *dbHost, *dbPort, *dbName)
-	ctx := context.Background()
-	config, err := pgxpool.ParseConfig(connStr)
+// parseRouteLimits parses the --max-in-flight-routes list of pattern=n.
+func parseRouteLimits(s string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, entry := range splitList(s) {
+		pattern, n, ok := strings.Cut(entry, "=")
+		limit, err := strconv.Atoi(n)
+		if !ok || err != nil || limit < 1 {
+			return nil, fmt.Errorf("invalid route limit %q, want pattern=n", entry)
+		}
+		limits[pattern] = limit
+	}
+	return limits, nil
+}
+
+// loadSettings applies the reloadable settings, from the config file when
+// one is given, and returns the reloader for later reloads.
+func (c *config) loadSettings(ctx context.Context, logger *slog.Logger) (*reloader, error) {
+	r := &reloader{
+		path:     c.configPath,
+		defaults: reloadableSettings{LogLevel: c.logLevel},
+		logLevel: logLevel,
+		logger:   logger,
+	}
+	if err := r.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (c *config) connString() string {
+	return fmt.Sprintf("postgres://%s:%s@%s:%d/%s?application_name=esp8266-web",
+		c.dbUser, c.dbPass, c.dbHost, c.dbPort, c.dbName)
+}
+
+func (c *config) openPostgres(ctx context.Context) (*postgres.Store, error) {
+	poolConfig, err := pgxpool.ParseConfig(c.connString())
 	if err != nil {
-		logger.Error("Failed to parse database config", "error", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("parse database config: %w", err)
+	}
+	poolConfig.BeforeConnect = c.beforeConnect
+	if c.dbMaxConns > 0 {
+		poolConfig.MaxConns = int32(c.dbMaxConns)
+	}
+	c.configureConn(poolConfig.ConnConfig)
+	if c.slowQueryThreshold > 0 {
+		poolConfig.ConnConfig.Tracer = &postgres.SlowQueryTracer{Threshold: c.slowQueryThreshold}
 	}
-	pool, err := pgxpool.NewWithConfig(ctx, config)
+	db, err := postgres.OpenConfig(ctx, poolConfig)
 	if err != nil {
-		logger.Error("Failed to create database pool", "error", err)
-		os.Exit(1)
+		return nil, err
 	}
-	defer pool.Close()
+	db.SetTimeout(c.dbTimeout)
+	return db, nil
+}
 
-	if err := pool.Ping(ctx); err != nil {
-		logger.Error("Failed to ping database", "error", err)
-		os.Exit(1)
+// openQuerier connects to the database as the restricted query user, for
+// ad-hoc queries. Unlike openPostgres it doesn't take credentials from the
+// secrets provider, as those belong to the application's own role.
+func (c *config) openQuerier(ctx context.Context) (*postgres.Querier, error) {
+	connString := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?application_name=esp8266-web-query",
+		url.PathEscape(c.queryDBUser), url.PathEscape(c.queryDBPass), c.dbHost, c.dbPort, c.dbName)
+	poolConfig, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, fmt.Errorf("parse query database config: %w", err)
 	}
+	poolConfig.MaxConns = 2
+	c.configureConn(poolConfig.ConnConfig)
+	return postgres.OpenQuerier(ctx, poolConfig)
+}
 
-	app := &app{db: pool, secretKey: secretKey}
-
-	if err := app.applyMigrations(ctx); err != nil {
-		logger.Error("Failed to apply migrations", "error", err)
-		os.Exit(1)
+// configureConn applies the connection settings shared by every pool. With
+// --db-pgbouncer every statement is prepared unnamed and described anew,
+// within the transaction PgBouncer assigned a server connection for.
+func (c *config) configureConn(cc *pgx.ConnConfig) {
+	if c.dbPgBouncer {
+		cc.DefaultQueryExecMode = pgx.QueryExecModeExec
+		cc.StatementCacheCapacity = 0
+		cc.DescriptionCacheCapacity = 0
 	}
+}
 
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
-	mux.Handle("/health", panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(loggingMiddleware(http.HandlerFunc(app.healthHandler)))))
+// openStore opens the configured storage backend, applying migrations where
+// the backend has them.
+func openStore(ctx context.Context, cfg *config) (store.Store, error) {
+	switch cfg.dbDriver {
+	case "postgres":
+		db, err := cfg.openPostgres(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := db.Migrate(ctx); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("apply migrations: %w", err)
+		}
+		return db, nil
+	case "memory":
+		return memory.New(), nil
+	case "influx":
+		influxConfig, err := cfg.influxConfig()
+		if err != nil {
+			return nil, err
+		}
+		return influx.Open(ctx, influxConfig)
+	case "clickhouse":
+		if cfg.clickhouseURL == "" {
+			return nil, fmt.Errorf("--clickhouse-url is required for clickhouse")
+		}
+		db, err := clickhouse.Open(ctx, clickhouse.Config{URL: cfg.clickhouseURL, Database: cfg.clickhouseDB, Username: cfg.clickhouseUser, Password: cfg.clickhousePass})
+		if err != nil {
+			return nil, err
+		}
+		if err := db.Migrate(ctx); err != nil {
+			return nil, fmt.Errorf("apply migrations: %w", err)
+		}
+		return db, nil
+	default:
+		return nil, fmt.Errorf("unknown db driver %q", cfg.dbDriver)
+	}
+}
 
-	mux.Handle("/", panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(loggingMiddleware(http.HandlerFunc(app.homeHandler)))))
-	mux.Handle("/data", panicRecoveryMiddleware(logger)(requestIdMiddleware(logger)(loggingMiddleware(http.HandlerFunc(app.dataHandler)))))
+func main() {
+	logLevel.Set(slog.LevelDebug)
+	h := slogctx.NewHandler(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}), nil)
+	logger := slog.New(h)
+	slog.SetDefault(logger)
 
-	addr := fmt.Sprintf("%s:%d", *host, *port)
-	server := &http.Server{
-		Addr:         addr,
-		Handler:      mux,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
 	}
 
-	logger.Info(fmt.Sprintf("starting server at http://%s", addr), slog.String("addr", addr))
-	if err := server.ListenAndServe(); err != nil {
-		logger.Error("server failed", "error", err)
+	var err error
+	switch cmd {
+	case "serve":
+		err = runServe(logger, args)
+	case "migrate":
+		err = runMigrate(logger, args)
+	case "seed":
+		err = runSeed(logger, args)
+	case "simulate":
+		err = runSimulate(logger, args)
+	case "bench":
+		err = runBench(logger, args)
+	case "healthcheck":
+		err = runHealthcheck(logger, args)
+	case "check":
+		err = runCheck(logger, args)
+	case "keys":
+		err = runKeys(logger, args)
+	case "config":
+		err = runConfig(logger, args)
+	default:
+		err = fmt.Errorf("unknown command %q", cmd)
+	}
+	if err != nil {
+		logger.Error("command failed", "command", cmd, "error", err)
 		os.Exit(1)
 	}
 }
 
-func (a *app) healthHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// seedLastSeen records the newest stored reading of every device as when
+// it was last seen, so the devices that went silent before a restart keep
+// being reported stale.
+func seedLastSeen(ctx context.Context, ss store.StatusStore, logger *slog.Logger) {
+	status, err := ss.StorageStatus(ctx)
+	if err != nil {
+		logger.Error("failed to read when devices were last seen", "error", err)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(w, `{"status": "ok"}`)
+	for _, d := range status.Devices {
+		if d.Newest != nil {
+			ingest.Seen(d.Device, time.Unix(*d.Newest, 0))
+		}
+	}
 }
 
-func (a *app) homeHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+func runServe(logger *slog.Logger, args []string) error {
+	var cfg config
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	legacyIngest := fs.Bool("legacy-ingest", false, "Enable /ingest for sketches sending query-string or form-encoded readings")
+	requireReadKey := fs.Bool("require-read-key", false, "Require a key with the read scope for GET requests")
+	memorySeedDays := fs.Int("memory-seed-days", 7, "Days of synthetic readings to preload with --db-driver=memory, 0 disables")
+	maxInFlight := fs.Int("max-in-flight", 0, "Most requests served at once, 0 for no limit")
+	maxInFlightRoutes := fs.String("max-in-flight-routes", "", "Most requests served at once by route pattern, e.g. /data/export.xlsx=2,/chart.png=4")
+	leaderElection := fs.Bool("leader-election", false, "Run the background jobs on one replica only, elected with a PostgreSQL advisory lock")
+	readOnly := fs.Bool("read-only", false, "Start in read-only maintenance mode, answering writes 503 until restarted without it")
+	pauseBackoff := fs.Duration("pause-backoff", server.DefaultPauseBackoff, "How long devices are told to back off in Retry-After while ingestion is paused or read-only")
+	staleAfter := fs.Duration("stale-after", 0, "List the devices without a reading for longer in /readyz, 0 disables")
+	minFirmware := fs.String("min-firmware", "", "Oldest firmware version devices should run, older ones are reported as outdated")
+	anomalyDelta := fs.Float64("anomaly-delta", 0, "Flag readings whose temperature changed by more degrees since the device's previous reading as anomalous, 0 disables")
+	reportInterval := fs.Duration("report-interval", server.DefaultReportInterval, "How often claimed devices are told to send a reading")
+	responseEnvelope := fs.Bool("response-envelope", false, "Wrap JSON list responses in {data, meta, links} unless clients ask for the bare profile")
+	queueTimeout := fs.Duration("queue-timeout", 2*time.Second, "How long a request over a max-in-flight limit waits before it's answered 503")
+	fs.Parse(args)
+	if err := cfg.applyProfile(fs, logger); err != nil {
+		return err
+	}
+	if err := cfg.applyEnv(logger); err != nil {
+		return err
 	}
-	data, err := os.ReadFile("index.html")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloader, err := cfg.loadSettings(ctx, logger)
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+		return err
 	}
-	w.Header().Set("Content-Type", "text/html")
-	w.Write(data)
-}
+	reloader.watchSIGHUP(ctx)
 
-func (a *app) dataHandler(w http.ResponseWriter, r *http.Request) {
-	logger := slogctx.FromCtx(r.Context())
-
-	w.Header().Set("Content-Type", "application/json")
-
-	switch r.Method {
-	case http.MethodPost:
-		headerSecretKey := r.Header.Get("X-Secret-Key")
-		logger.Debug("X-Secret-Key header value", slog.String("value", headerSecretKey))
-		if headerSecretKey != a.secretKey {
-			http.Error(w, "Forbidden", http.StatusForbidden)
-			return
-		}
-		var tri TemperatureReadingPayload
-		if err := json.NewDecoder(r.Body).Decode(&tri); err != nil {
-			logger.Error("failed to decode temperature reading",
-				slog.Any("error", err),
-			)
-			http.Error(w, "Bad request", http.StatusUnprocessableEntity)
-			return
-		}
-		logger.Info("Received temperature reading",
-			slog.Any("data", tri),
-		)
-		if tri.Timestamp == nil {
-			now := time.Now().UTC().Unix()
-			tri.Timestamp = &now
-		}
-		var tr TemperatureReading
-		err := a.db.QueryRow(r.Context(), `
-			INSERT INTO readings (temp_co, temp_room, humidity, timestamp)
-			VALUES ($1, $2, $3, $4)
-			RETURNING id, temp_co, temp_room, humidity, timestamp
-		`, tri.TempCo, tri.TempRoom, tri.Humidity, *tri.Timestamp).Scan(&tr.Id, &tr.TempCo, &tr.TempRoom, &tr.Humidity, &tr.Timestamp)
-		if err != nil {
-			logger.Error("Failed to insert temperature reading", "error", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
-		json.NewEncoder(w).Encode(tr)
-
-	case http.MethodGet:
-		limitStr := r.URL.Query().Get("limit")
-		limit := 10
-		if limitStr != "" {
-			if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 100 {
-				limit = l
-			}
+	live, err := cfg.watchSecrets(ctx, logger)
+	if err != nil {
+		return err
+	}
+	if cfg.secretKey == "" {
+		return errors.New("APP_SECRET_KEY or APP_SECRET_KEY_FILE environment variable is required")
+	}
+
+	db, err := openStore(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if cfg.dbDriver == "memory" && *memorySeedDays > 0 {
+		now := time.Now()
+		readings := generateReadings(seedOptions{
+			from:        now.Add(-time.Duration(*memorySeedDays) * 24 * time.Hour),
+			to:          now,
+			interval:    time.Minute,
+			noise:       0.15,
+			anomalyRate: 0.002,
+		}, rand.New(rand.NewPCG(uint64(now.UnixNano()), 0)))
+		if _, err := db.InsertReadings(ctx, readings); err != nil {
+			return fmt.Errorf("seed memory store: %w", err)
 		}
+		logger.Info("memory store seeded with synthetic readings", "count", len(readings))
+	}
 
-		offsetStr := r.URL.Query().Get("offset")
-		offset := 0
-		if offsetStr != "" {
-			if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
-				offset = o
-			}
+	if env := os.Getenv("APP_LEGACY_INGEST"); env != "" {
+		if v, err := strconv.ParseBool(env); err == nil {
+			*legacyIngest = v
+			logger.Debug("flag legacy-ingest overridden by env APP_LEGACY_INGEST", "value", v)
+		}
+	}
+	if env := os.Getenv("APP_REQUIRE_READ_KEY"); env != "" {
+		if v, err := strconv.ParseBool(env); err == nil {
+			*requireReadKey = v
+			logger.Debug("flag require-read-key overridden by env APP_REQUIRE_READ_KEY", "value", v)
+		}
+	}
+	if env := os.Getenv("APP_READ_ONLY"); env != "" {
+		if v, err := strconv.ParseBool(env); err == nil {
+			*readOnly = v
+			logger.Debug("flag read-only overridden by env APP_READ_ONLY", "value", v)
+		}
+	}
+	if env := os.Getenv("APP_PAUSE_BACKOFF"); env != "" {
+		if d, err := time.ParseDuration(env); err == nil {
+			*pauseBackoff = d
+			logger.Debug("flag pause-backoff overridden by env APP_PAUSE_BACKOFF", "value", d)
+		}
+	}
+	if env := os.Getenv("APP_STALE_AFTER"); env != "" {
+		if d, err := time.ParseDuration(env); err == nil {
+			*staleAfter = d
+			logger.Debug("flag stale-after overridden by env APP_STALE_AFTER", "value", d)
+		}
+	}
+	if env := os.Getenv("APP_MIN_FIRMWARE"); env != "" {
+		*minFirmware = env
+		logger.Debug("flag min-firmware overridden by env APP_MIN_FIRMWARE", "value", env)
+	}
+	if env := os.Getenv("APP_ANOMALY_DELTA"); env != "" {
+		if v, err := strconv.ParseFloat(env, 64); err == nil {
+			*anomalyDelta = v
+			logger.Debug("flag anomaly-delta overridden by env APP_ANOMALY_DELTA", "value", v)
+		}
+	}
+	if env := os.Getenv("APP_MAX_IN_FLIGHT"); env != "" {
+		if v, err := strconv.Atoi(env); err == nil {
+			*maxInFlight = v
+			logger.Debug("flag max-in-flight overridden by env APP_MAX_IN_FLIGHT", "value", v)
+		}
+	}
+	if env := os.Getenv("APP_MAX_IN_FLIGHT_ROUTES"); env != "" {
+		*maxInFlightRoutes = env
+		logger.Debug("flag max-in-flight-routes overridden by env APP_MAX_IN_FLIGHT_ROUTES", "value", env)
+	}
+	if env := os.Getenv("APP_QUEUE_TIMEOUT"); env != "" {
+		if d, err := time.ParseDuration(env); err == nil {
+			*queueTimeout = d
+			logger.Debug("flag queue-timeout overridden by env APP_QUEUE_TIMEOUT", "value", d)
+		}
+	}
+	if env := os.Getenv("APP_LEADER_ELECTION"); env != "" {
+		if v, err := strconv.ParseBool(env); err == nil {
+			*leaderElection = v
+			logger.Debug("flag leader-election overridden by env APP_LEADER_ELECTION", "value", v)
+		}
+	}
+	if *leaderElection && cfg.dbPgBouncer {
+		// the advisory lock is held by a session, which transaction pooling
+		// hands to other clients between statements
+		return errors.New("--leader-election needs a direct database connection, not --db-pgbouncer")
+	}
+	if env := os.Getenv("APP_REPORT_INTERVAL"); env != "" {
+		if d, err := time.ParseDuration(env); err == nil {
+			*reportInterval = d
+			logger.Debug("flag report-interval overridden by env APP_REPORT_INTERVAL", "value", d)
 		}
+	}
+	if env := os.Getenv("APP_RESPONSE_ENVELOPE"); env != "" {
+		if v, err := strconv.ParseBool(env); err == nil {
+			*responseEnvelope = v
+			logger.Debug("flag response-envelope overridden by env APP_RESPONSE_ENVELOPE", "value", v)
+		}
+	}
+	routeLimits, err := parseRouteLimits(*maxInFlightRoutes)
+	if err != nil {
+		return err
+	}
 
-		rows, err := a.db.Query(r.Context(), `
-			SELECT id, temp_co, temp_room, humidity, timestamp
-			FROM readings
-			ORDER BY timestamp DESC
-			LIMIT $1 OFFSET $2
-		`, limit, offset)
+	flags := features.New(db, logger)
+	if *readOnly {
+		flags.Pin(features.ReadOnly, true)
+		logger.Warn("serving in read-only maintenance mode")
+	}
+	serverConfig := server.Config{
+		SecretKey:       cfg.secretKey,
+		KeyGracePeriod:  cfg.keyGracePeriod,
+		Logger:          logger,
+		Reload:          reloader.Reload,
+		LegacyIngest:    *legacyIngest,
+		APIKeysFunc:     reloader.APIKeys,
+		WebhooksFunc:    reloader.Webhooks,
+		PayloadKeysFunc: reloader.PayloadKeys,
+		RequireReadKey:  *requireReadKey,
+		Features:        flags,
+		PauseBackoff:    *pauseBackoff,
+		StaleAfter:      *staleAfter,
+		Envelope:        *responseEnvelope,
+		PublicURL:       cfg.publicURL,
+		ReportInterval:  *reportInterval,
+		Limits:          middleware.Limits{MaxInFlight: *maxInFlight, Routes: routeLimits, QueueTimeout: *queueTimeout},
+	}
+	if cfg.queryDBUser != "" {
+		if cfg.dbDriver != "postgres" {
+			return fmt.Errorf("ad-hoc queries are not supported by db driver %q", cfg.dbDriver)
+		}
+		querier, err := cfg.openQuerier(ctx)
 		if err != nil {
-			logger.Error("Failed to query temperature readings", "error", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		readings := make([]TemperatureReading, 0)
-		for rows.Next() {
-			var tr TemperatureReading
-			if err := rows.Scan(&tr.Id, &tr.TempCo, &tr.TempRoom, &tr.Humidity, &tr.Timestamp); err != nil {
-				logger.Error("Failed to scan row", "error", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
+			return err
+		}
+		defer querier.Close()
+		serverConfig.Querier = querier
+		serverConfig.QueryTimeout = cfg.queryTimeout
+		logger.Info("serving ad-hoc queries", "user", cfg.queryDBUser, "timeout", cfg.queryTimeout)
+	}
+	publisher, err := cfg.eventPublisher(ctx, logger)
+	if err != nil {
+		return err
+	}
+	// jobs are the background jobs that must run once across replicas
+	var jobs []func(context.Context)
+	if cs, ok := db.(control.Store); ok {
+		serverConfig.Control = control.New(cs, control.Config{Logger: logger})
+	}
+	if as, ok := db.(store.AlertStore); ok {
+		alertConfig := alert.Config{
+			Logger:    logger,
+			Notifiers: cfg.notifiers(),
+			AckURL:    cfg.publicURL,
+			Templates: reloader.templates,
+			Readings:  db,
+			Enabled:   flags.AlertsEnabled,
+		}
+		if publisher != nil {
+			alertConfig.OnEvent = publisher.Alert
+		}
+		if serverConfig.Control != nil {
+			alertConfig.Away = serverConfig.Control.Away
+		}
+		if cs, ok := db.(store.CrashStore); ok {
+			alertConfig.Reboots = cs.CountCrashReports
+		}
+		engine := alert.NewEngine(as, alertConfig)
+		reloader.setTemplates = engine.SetTemplates
+		jobs = append(jobs, func(ctx context.Context) { engine.Run(ctx, alert.EscalationInterval) })
+		serverConfig.Alerts = engine
+	}
+	forwarder, err := cfg.forwarder(logger, db)
+	if err != nil {
+		return err
+	}
+	if forwarder != nil {
+		jobs = append(jobs, forwarder.Run)
+	}
+	sinks, err := cfg.sinks(ctx, logger)
+	if err != nil {
+		return err
+	}
+	if publisher != nil {
+		sinks = append(sinks, publisher)
+	}
+	if len(sinks) > 0 {
+		fanout := sink.NewFanout(sink.Config{Logger: logger}, sinks...)
+		go fanout.Run(ctx)
+		serverConfig.Forward = fanout.Enqueue
+	}
+	if !slices.Contains(ingest.AckModes, cfg.ingestAck) {
+		return fmt.Errorf("unknown ingest ack %q, want one of %s", cfg.ingestAck, strings.Join(ingest.AckModes, ", "))
+	}
+	if cfg.mqttIngestFormat != "" && cfg.mqttIngestFormat != ingest.FormatZigbee2MQTT {
+		return fmt.Errorf("unknown mqtt ingest format %q, want %s or none", cfg.mqttIngestFormat, ingest.FormatZigbee2MQTT)
+	}
+	ingestConfig := ingest.Config{
+		Logger:        logger,
+		Alerts:        serverConfig.Alerts,
+		Control:       serverConfig.Control,
+		Forward:       serverConfig.Forward,
+		BatchInterval: cfg.ingestBatchInterval,
+		BatchWorkers:  cfg.ingestBatchWorkers,
+		Ack:           cfg.ingestAck,
+		Paused:        flags.IngestPaused,
+		MinFirmware:   *minFirmware,
+		AnomalyDelta:  *anomalyDelta,
+	}
+	// the sockets besides the HTTP one, taken over from the old process in
+	// an upgrade
+	socks := inheritedSockets()
+	if cfg.modbusAddr != "" {
+		devices := splitList(cfg.modbusDevices)
+		mb := modbus.New(modbus.Config{Devices: devices, Logger: logger})
+		ingestConfig.OnNewest = mb.Update
+		ln, err := socks.Listen("tcp", cfg.modbusAddr)
+		if err != nil {
+			return fmt.Errorf("modbus listen: %w", err)
+		}
+		go func() {
+			if err := mb.Serve(ctx, ln); err != nil {
+				logger.Error("modbus server stopped", "error", err)
 			}
-			readings = append(readings, tr)
+		}()
+		logger.Info("serving readings over modbus tcp", "addr", cfg.modbusAddr, "devices", devices)
+	}
+	if cfg.snmpAddr != "" {
+		devices := splitList(cfg.snmpDevices)
+		agent := snmp.New(snmp.Config{Devices: devices, Community: cfg.snmpCommunity, Logger: logger})
+		if onNewest := ingestConfig.OnNewest; onNewest != nil {
+			ingestConfig.OnNewest = func(device string, r store.TemperatureReading) {
+				onNewest(device, r)
+				agent.Update(device, r)
+			}
+		} else {
+			ingestConfig.OnNewest = agent.Update
 		}
-		if err := rows.Err(); err != nil {
-			logger.Error("Rows error", "error", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
+		conn, err := socks.ListenPacket("udp", cfg.snmpAddr)
+		if err != nil {
+			return fmt.Errorf("snmp listen: %w", err)
 		}
-		json.NewEncoder(w).Encode(readings)
-
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		go func() {
+			if err := agent.Serve(ctx, conn); err != nil {
+				logger.Error("snmp agent stopped", "error", err)
+			}
+		}()
+		logger.Info("serving readings over snmp", "addr", cfg.snmpAddr, "devices", devices)
 	}
-
-}
-
-func (a *app) applyMigrations(ctx context.Context) error {
-	slog.Debug("Applying migrations")
-	_, err := a.db.Exec(ctx, `
-		CREATE TABLE IF NOT EXISTS readings (
-			id SERIAL PRIMARY KEY,
-			temp_co DOUBLE PRECISION,
-			temp_room DOUBLE PRECISION,
-			timestamp BIGINT,
-			created_at TIMESTAMP DEFAULT NOW()
-		)
-	`)
+	if cfg.bacnetAddr != "" {
+		if err := cfg.serveBACnet(ctx, logger, db, socks); err != nil {
+			return err
+		}
+	}
+	if cfg.owmAPIKey != "" {
+		ws, ok := db.(store.WeatherStore)
+		if !ok {
+			return fmt.Errorf("outdoor weather is not supported by db driver %q", cfg.dbDriver)
+		}
+		fetcher := weather.New(ws, weather.Config{APIKey: cfg.owmAPIKey, Lat: cfg.weatherLat, Lon: cfg.weatherLon, Interval: cfg.weatherInterval, Logger: logger})
+		jobs = append(jobs, fetcher.Run)
+		logger.Info("fetching outdoor weather", "lat", cfg.weatherLat, "lon", cfg.weatherLon, "interval", cfg.weatherInterval)
+	}
+	if *leaderElection {
+		pg, ok := db.(*postgres.Store)
+		if !ok {
+			return fmt.Errorf("leader election is not supported by db driver %q", cfg.dbDriver)
+		}
+		elector := postgres.NewElector(pg, postgres.DefaultLeaderInterval, logger)
+		go elector.Run(ctx, jobs...)
+		serverConfig.Leader = elector.IsLeader
+	} else {
+		for _, job := range jobs {
+			go job(ctx)
+		}
+	}
+	pipeline := ingest.New(db, ingestConfig)
+	flushed := make(chan struct{})
+	go func() {
+		pipeline.Run(ctx)
+		close(flushed)
+	}()
+	if cfg.ingestBatchInterval > 0 {
+		logger.Info("batching ingested readings", "interval", cfg.ingestBatchInterval, "workers", cfg.ingestBatchWorkers, "ack", cfg.ingestAck)
+	}
+	serverConfig.Ingest = pipeline
+	if ss, ok := db.(store.StatusStore); ok {
+		go seedLastSeen(ctx, ss, logger)
+	}
+	ttn := ingest.NewLoRaWAN(ingest.FormatTTN, reloader.decoders)
+	chirpstack := ingest.NewLoRaWAN(ingest.FormatChirpStack, reloader.decoders)
+	reloader.setDecoders = func(d map[string]ingest.LoRaDecoder) {
+		ttn.SetDecoders(d)
+		chirpstack.SetDecoders(d)
+	}
+	tasmota := ingest.NewFirmware(ingest.FormatTasmota, reloader.fields[ingest.FormatTasmota])
+	esphome := ingest.NewFirmware(ingest.FormatESPHome, reloader.fields[ingest.FormatESPHome])
+	reloader.setFields = func(f map[string]map[string]ingest.FieldMap) {
+		tasmota.SetFields(f[ingest.FormatTasmota])
+		esphome.SetFields(f[ingest.FormatESPHome])
+	}
+	serverConfig.Adapters = append(serverConfig.Adapters, ttn, chirpstack, tasmota, esphome)
+	listeners, err := cfg.listeners(logger, reloader, socks)
 	if err != nil {
 		return err
 	}
-	_, err = a.db.Exec(ctx, `
-		ALTER TABLE readings ADD COLUMN IF NOT EXISTS humidity DOUBLE PRECISION NOT NULL DEFAULT 0.0
-	`)
+	for _, l := range listeners {
+		go func() {
+			if err := l.Run(ctx, pipeline); err != nil {
+				logger.Error("ingest listener stopped", "listener", l.Name(), "error", err)
+			}
+		}()
+	}
+	if live != nil {
+		if pg, ok := db.(*postgres.Store); ok {
+			reset := pg.Reset
+			live.resetDB.Store(&reset)
+		}
+		serverConfig.SecretKeyFunc = live.secretKey(cfg.secretKey)
+	}
+	handler := server.NewServer(serverConfig, db)
+
+	addr := fmt.Sprintf("%s:%d", cfg.host, cfg.port)
+	httpServer := &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	ln, upgraded, err := inheritedListener()
 	if err != nil {
 		return err
 	}
-	_, err = a.db.Exec(ctx, `
-		ALTER TABLE readings ALTER COLUMN temp_co SET DEFAULT 0.0;
-		ALTER TABLE readings ALTER COLUMN temp_co SET NOT NULL;
-		ALTER TABLE readings ALTER COLUMN temp_room SET DEFAULT 0.0;
-		ALTER TABLE readings ALTER COLUMN temp_room SET NOT NULL;
-		ALTER TABLE readings ALTER COLUMN timestamp SET DEFAULT 0;
-		ALTER TABLE readings ALTER COLUMN timestamp SET NOT NULL
-	`)
+	activated, err := systemd.Listeners()
 	if err != nil {
 		return err
 	}
-	slog.Debug("Migrations applied successfully")
-	return nil
-}
+	switch {
+	case ln != nil:
+		addr = ln.Addr().String()
+		logger.Info("using the listener handed over by an upgrade")
+	case len(activated) > 0:
+		ln = activated[0]
+		addr = ln.Addr().String()
+		logger.Info("using systemd socket activation", "listeners", len(activated))
+	default:
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return fmt.Errorf("listen: %w", err)
+		}
+	}
 
-func requestIdMiddleware(logger *slog.Logger) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx := slogctx.NewCtx(r.Context(), logger)
+	// the store is connected and migrated at this point
+	socks.closeUnused()
+	ready := "READY=1"
+	if upgraded != nil {
+		if err := upgraded(); err != nil {
+			return fmt.Errorf("report upgrade ready: %w", err)
+		}
+		// systemd accepts it with NotifyAccess=all
+		ready = fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid())
+	}
+	if _, err := systemd.Notify(ready); err != nil {
+		logger.Error("failed to notify systemd", "error", err)
+	}
+	systemd.Watchdog(ctx, db.Ping, func(err error) {
+		logger.Error("watchdog check failed", "error", err)
+	})
 
-			requestID := uuid.New().String()
-			w.Header().Set("X-Request-ID", requestID)
-			ctx = slogctx.With(ctx, slog.String("request_id", requestID))
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, append([]os.Signal{syscall.SIGTERM, os.Interrupt}, upgradeSignals...)...)
+		defer signal.Stop(signals)
+		for sig := range signals {
+			if sig == syscall.SIGTERM || sig == os.Interrupt {
+				break
+			}
+			logger.Info("upgrading", "signal", sig.String())
+			pid, err := upgrade(ln, socks)
+			if err != nil {
+				logger.Error("upgrade failed, serving on", "error", err)
+				continue
+			}
+			logger.Info("handed the listeners over to the new process", "pid", pid)
+			break
+		}
+		logger.Info("shutting down", "timeout", shutdownTimeout)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			logger.Error("failed to finish the requests in flight", "error", err)
+		}
+	}()
 
-			r = r.WithContext(ctx)
-			next.ServeHTTP(w, r)
-		})
+	logger.Info(fmt.Sprintf("starting server at http://%s", addr), slog.String("addr", addr))
+	if err := httpServer.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("server failed: %w", err)
 	}
+	<-shutdown
+	// stop the background jobs and store what the ingest queue holds
+	cancel()
+	<-flushed
+	return nil
 }
 
-func panicRecoveryMiddleware(logger *slog.Logger) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			defer func() {
-				if err := recover(); err != nil {
-					reqLogger := slogctx.FromCtx(r.Context())
-					if reqLogger == nil {
-						reqLogger = logger
-					}
-					reqLogger.Error("panic recovered", slog.Any("panic", err))
-					http.Error(w, "Internal server error", http.StatusInternalServerError)
-				}
-			}()
-			next.ServeHTTP(w, r)
-		})
+// runMigrate handles `migrate [flags] status|up|down N`.
+func runMigrate(logger *slog.Logger, args []string) error {
+	var cfg config
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "Print the SQL instead of executing it")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: esp8266-web migrate [flags] status|up|down N")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := cfg.applyProfile(fs, logger); err != nil {
+		return err
+	}
+	if err := cfg.applyEnv(logger); err != nil {
+		return err
 	}
-}
 
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-
-		reqLogger := slogctx.FromCtx(r.Context())
-		reqLogger.Info("request",
-			slog.String("method", r.Method),
-			slog.String("url", r.URL.Path),
-			slog.String("remote", r.RemoteAddr),
-			slog.String("user_agent", r.UserAgent()),
-		)
-
-		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-		next.ServeHTTP(rw, r)
-
-		duration := time.Since(start)
-
-		reqLogger.Info("response",
-			slog.String("method", r.Method),
-			slog.String("url", r.URL.Path),
-			slog.Int("status", rw.statusCode),
-			slog.Duration("duration", duration),
-		)
-	})
-}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("missing migrate action")
+	}
+	if cfg.dbDriver != "postgres" {
+		return fmt.Errorf("migrate is not supported by db driver %q", cfg.dbDriver)
+	}
 
-type responseWriter struct {
-	http.ResponseWriter
-	statusCode int
-}
+	ctx := context.Background()
+	if _, err := cfg.loadSettings(ctx, logger); err != nil {
+		return err
+	}
+	if _, err := cfg.watchSecrets(ctx, logger); err != nil {
+		return err
+	}
 
-func (rw *responseWriter) WriteHeader(code int) {
-	rw.statusCode = code
-	rw.ResponseWriter.WriteHeader(code)
+	db, err := cfg.openPostgres(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var out io.Writer
+	if *dryRun {
+		out = os.Stdout
+	}
+
+	switch action := fs.Arg(0); action {
+	case "status":
+		status, err := db.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range status {
+			appliedAt := "pending"
+			if s.AppliedAt != nil {
+				appliedAt = s.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+		}
+		return tw.Flush()
+	case "up":
+		return db.MigrateUp(ctx, out)
+	case "down":
+		n := 1
+		if fs.NArg() > 1 {
+			n, err = strconv.Atoi(fs.Arg(1))
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid migration count %q", fs.Arg(1))
+			}
+		}
+		return db.MigrateDown(ctx, n, out)
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown migrate action %q", action)
+	}
 }
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+var requestsShed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "esp8266_http_requests_shed_total",
+	Help: "HTTP requests answered 503 by the concurrency limiter, by route pattern.",
+}, []string{"route"})
+
+// Limits bounds how many requests are served at once. A request over a
+// limit waits up to QueueTimeout for a slot and is then shed with 503.
+type Limits struct {
+	// MaxInFlight bounds the requests served at once across routes, 0 for
+	// no bound.
+	MaxInFlight int
+	// Routes bounds the requests served at once by route pattern, e.g.
+	// "/data/export.xlsx".
+	Routes map[string]int
+	// QueueTimeout is how long a request waits for a slot altogether.
+	QueueTimeout time.Duration
+}
+
+// semaphore holds a slot per request being served.
+type semaphore chan struct{}
+
+// acquire takes a slot, waiting until deadline at the latest.
+func (s semaphore) acquire(ctx context.Context, deadline time.Time) bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+	}
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return false
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// Limit enforces l. It must run inside the mux, where the route pattern of
+// a request is known.
+func Limit(l Limits) func(http.Handler) http.Handler {
+	var global semaphore
+	if l.MaxInFlight > 0 {
+		global = make(semaphore, l.MaxInFlight)
+	}
+	routes := make(map[string]semaphore, len(l.Routes))
+	for pattern, n := range l.Routes {
+		if n > 0 {
+			routes[pattern] = make(semaphore, n)
+		}
+	}
+	retryAfter := strconv.Itoa(max(1, int(math.Ceil(l.QueueTimeout.Seconds()))))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			deadline := time.Now().Add(l.QueueTimeout)
+			// The route's slot is taken first, so a storm on one route
+			// queues there rather than for the slots of the others.
+			route := routes[r.Pattern]
+			if !route.acquire(r.Context(), deadline) {
+				shed(w, r, retryAfter)
+				return
+			}
+			defer route.release()
+			if !global.acquire(r.Context(), deadline) {
+				shed(w, r, retryAfter)
+				return
+			}
+			defer global.release()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func shed(w http.ResponseWriter, r *http.Request, retryAfter string) {
+	slogctx.FromCtx(r.Context()).Warn("request shed by the concurrency limiter", "route", route(r))
+	requestsShed.WithLabelValues(route(r)).Inc()
+	w.Header().Set("Retry-After", retryAfter)
+	http.Error(w, "Service unavailable: too many requests in flight", http.StatusServiceUnavailable)
+}
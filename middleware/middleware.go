@@ -0,0 +1,170 @@
+// Package middleware contains the HTTP middleware shared by every route.
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "esp8266_http_requests_total",
+		Help: "HTTP requests by method, route pattern and status code.",
+	}, []string{"method", "route", "status"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "esp8266_http_request_duration_seconds",
+		Help: "Time to serve an HTTP request by method and route pattern.",
+	}, []string{"method", "route"})
+)
+
+// route is the pattern of the mux route serving r, e.g.
+// "/devices/{device}/labels", so requests to every device share it.
+func route(r *http.Request) string {
+	if r.Pattern == "" {
+		return "unmatched"
+	}
+	return r.Pattern
+}
+
+// method bounds the method label to the standard methods.
+func method(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return r.Method
+	default:
+		return "other"
+	}
+}
+
+func RequestID(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := slogctx.NewCtx(r.Context(), logger)
+
+			requestID := uuid.New().String()
+			w.Header().Set("X-Request-ID", requestID)
+			ctx = slogctx.With(ctx, slog.String("request_id", requestID))
+
+			r = r.WithContext(ctx)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func PanicRecovery(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				if err := recover(); err != nil {
+					reqLogger := slogctx.FromCtx(r.Context())
+					if reqLogger == nil {
+						reqLogger = logger
+					}
+					reqLogger.Error("panic recovered", slog.Any("panic", err))
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+				}
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func Logging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		reqLogger := slogctx.FromCtx(r.Context())
+		reqLogger.Info("request",
+			slog.String("method", r.Method),
+			slog.String("route", route(r)),
+			slog.String("url", r.URL.Path),
+			slog.String("remote", r.RemoteAddr),
+			slog.String("user_agent", r.UserAgent()),
+		)
+
+		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		duration := time.Since(start)
+
+		reqLogger.Info("response",
+			slog.String("method", r.Method),
+			slog.String("route", route(r)),
+			slog.String("url", r.URL.Path),
+			slog.Int("status", rw.statusCode),
+			slog.Duration("duration", duration),
+		)
+	})
+}
+
+// Metrics counts requests and observes their duration by route pattern
+// rather than path, keeping the label values bounded.
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		requestDuration.WithLabelValues(method(r), route(r)).Observe(time.Since(start).Seconds())
+		requestsTotal.WithLabelValues(method(r), route(r), strconv.Itoa(rw.statusCode)).Inc()
+	})
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	rw.statusCode = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush a stream.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Decompress transparently decodes gzip request bodies (Content-Encoding:
+// gzip) and caps every body at maxBytes after decompression, so a small
+// compressed request can't expand without bound. Reads past the cap fail with
+// *http.MaxBytesError.
+func Decompress(maxBytes int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Header.Get("Content-Encoding") {
+			case "", "identity":
+			case "gzip":
+				gz, err := gzip.NewReader(r.Body)
+				if err != nil {
+					http.Error(w, "Bad request: invalid gzip body", http.StatusBadRequest)
+					return
+				}
+				defer gz.Close()
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{gz, r.Body}
+				r.Header.Del("Content-Encoding")
+				r.Header.Del("Content-Length")
+				r.ContentLength = -1
+			default:
+				http.Error(w, "Unsupported content encoding", http.StatusUnsupportedMediaType)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
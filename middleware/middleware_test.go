@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	var got []byte
+	var readErr error
+	h := Decompress(1024)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, readErr = io.ReadAll(r.Body)
+	}))
+
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(gzipBytes(t, []byte(`{"tempCo": 25.5}`))))
+	req.Header.Set("Content-Encoding", "gzip")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	require.NoError(t, readErr)
+	assert.Equal(t, `{"tempCo": 25.5}`, string(got))
+
+	// a few hundred compressed bytes expanding past the limit
+	req = httptest.NewRequest("POST", "/", bytes.NewReader(gzipBytes(t, []byte(strings.Repeat("0", 1<<20)))))
+	req.Header.Set("Content-Encoding", "gzip")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	var maxBytesErr *http.MaxBytesError
+	assert.True(t, errors.As(readErr, &maxBytesErr))
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader("not gzip"))
+	req.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader("data"))
+	req.Header.Set("Content-Encoding", "br")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+}
+
+func TestMetricsByRoute(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/test/devices/{device}", Metrics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("device") == "missing" {
+			http.Error(w, "Not found", http.StatusNotFound)
+		}
+	})))
+
+	for _, path := range []string{"/test/devices/attic", "/test/devices/cellar", "/test/devices/missing"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	req := httptest.NewRequest("PROPFIND", "/test/devices/attic", nil)
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(requestsTotal.WithLabelValues("GET", "/test/devices/{device}", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(requestsTotal.WithLabelValues("GET", "/test/devices/{device}", "404")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(requestsTotal.WithLabelValues("other", "/test/devices/{device}", "200")))
+	assert.Equal(t, 3, testutil.CollectAndCount(requestsTotal))
+}
+
+func TestLimit(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	limit := Limit(Limits{MaxInFlight: 2, Routes: map[string]int{"/slow": 1}, QueueTimeout: 200 * time.Millisecond})
+	mux := http.NewServeMux()
+	mux.Handle("/slow", limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	})))
+	mux.Handle("/fast", limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	done := make(chan struct{})
+	go func() {
+		get("/slow")
+		close(done)
+	}()
+	<-entered
+
+	// the route's one slot is taken, the other routes still have theirs
+	w := get("/slow")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, get("/fast").Code)
+	assert.Equal(t, 1.0, testutil.ToFloat64(requestsShed.WithLabelValues("/slow")))
+
+	// a queued request gets the slot once it's released
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release <- struct{}{}
+	}()
+	go func() {
+		<-entered
+		release <- struct{}{}
+	}()
+	assert.Equal(t, http.StatusOK, get("/slow").Code)
+	<-done
+}
@@ -0,0 +1,231 @@
+// Package modbus serves the latest reading of every configured device as
+// Modbus TCP holding registers, for controllers that speak nothing else.
+//
+// Every device has a block of BlockSize registers, the first device at
+// address 0, the second at BlockSize and so on:
+//
+//	+0  tempCo × 100, signed
+//	+1  tempRoom × 100, signed
+//	+2  humidity × 100
+//	+3  timestamp, high word of the unix time
+//	+4  timestamp, low word
+//	+5  age of the reading in seconds, 65535 at most
+//	+6  1 once the device sent a reading, 0 before
+//	+7  reserved, 0
+//
+// Read Holding Registers (0x03) and Read Input Registers (0x04) return the
+// same values; the registers are read-only.
+package modbus
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	BlockSize = 8
+	// DefaultDevice names readings sent without a device, e.g. to /data.
+	DefaultDevice = "default"
+
+	funcReadHolding = 0x03
+	funcReadInput   = 0x04
+
+	exIllegalFunction = 0x01
+	exIllegalAddress  = 0x02
+	exIllegalValue    = 0x03
+
+	// maxRegisters is the most one read may ask for.
+	maxRegisters = 125
+	// idleTimeout closes connections of controllers that stopped polling.
+	idleTimeout = 5 * time.Minute
+)
+
+var requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "esp8266_modbus_requests_total",
+	Help: "Modbus requests by result: ok or exception.",
+}, []string{"result"})
+
+type Config struct {
+	// Devices are given register blocks in order.
+	Devices []string
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// Server answers Modbus TCP reads from the latest readings passed to Update.
+type Server struct {
+	logger  *slog.Logger
+	devices map[string]int
+	size    int
+	now     func() time.Time
+
+	mu     sync.RWMutex
+	latest map[int]store.TemperatureReading
+}
+
+func New(cfg Config) *Server {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	s := &Server{
+		logger:  cfg.Logger,
+		devices: make(map[string]int, len(cfg.Devices)),
+		size:    len(cfg.Devices) * BlockSize,
+		now:     time.Now,
+		latest:  make(map[int]store.TemperatureReading),
+	}
+	for i, device := range cfg.Devices {
+		s.devices[device] = i
+	}
+	return s
+}
+
+// Update records r as the latest reading of device; readings of devices
+// without a block are ignored. It fits ingest.Config.OnNewest.
+func (s *Server) Update(device string, r store.TemperatureReading) {
+	if device == "" {
+		device = DefaultDevice
+	}
+	block, ok := s.devices[device]
+	if !ok {
+		return
+	}
+	if r.Timestamp == nil {
+		ts := s.now().Unix()
+		r.Timestamp = &ts
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.latest[block]; ok && *prev.Timestamp > *r.Timestamp {
+		return
+	}
+	s.latest[block] = r
+}
+
+// ListenAndServe serves Modbus TCP on addr until ctx is done.
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("modbus listen: %w", err)
+	}
+	return s.Serve(ctx, ln)
+}
+
+// Serve accepts connections on ln until ctx is done.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("modbus accept: %w", err)
+		}
+		go s.handle(ctx, conn)
+	}
+}
+
+func (s *Server) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	header := make([]byte, 7)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				s.logger.Debug("modbus connection closed", "remote", conn.RemoteAddr().String(), "error", err)
+			}
+			return
+		}
+		// transaction id, protocol id, length of the unit id and PDU, unit id
+		length := binary.BigEndian.Uint16(header[4:])
+		if binary.BigEndian.Uint16(header[2:]) != 0 || length < 2 || length > 254 {
+			s.logger.Debug("invalid modbus frame", "remote", conn.RemoteAddr().String())
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+
+		resp := s.respond(pdu)
+		frame := make([]byte, 7, 7+len(resp))
+		copy(frame, header[:4])
+		binary.BigEndian.PutUint16(frame[4:], uint16(len(resp)+1))
+		frame[6] = header[6]
+		if _, err := conn.Write(append(frame, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// respond returns the response PDU to a request PDU.
+func (s *Server) respond(pdu []byte) []byte {
+	fn := pdu[0]
+	exception := func(code byte) []byte {
+		requestsTotal.WithLabelValues("exception").Inc()
+		return []byte{fn | 0x80, code}
+	}
+	if fn != funcReadHolding && fn != funcReadInput {
+		return exception(exIllegalFunction)
+	}
+	if len(pdu) != 5 {
+		return exception(exIllegalValue)
+	}
+	addr, count := int(binary.BigEndian.Uint16(pdu[1:])), int(binary.BigEndian.Uint16(pdu[3:]))
+	if count < 1 || count > maxRegisters {
+		return exception(exIllegalValue)
+	}
+	if addr+count > s.size {
+		return exception(exIllegalAddress)
+	}
+
+	regs := s.registers()
+	resp := make([]byte, 2, 2+2*count)
+	resp[0], resp[1] = fn, byte(2*count)
+	for _, v := range regs[addr : addr+count] {
+		resp = binary.BigEndian.AppendUint16(resp, v)
+	}
+	requestsTotal.WithLabelValues("ok").Inc()
+	return resp
+}
+
+// registers renders every block.
+func (s *Server) registers() []uint16 {
+	regs := make([]uint16, s.size)
+	now := s.now().Unix()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for block, r := range s.latest {
+		b := regs[block*BlockSize:]
+		b[0] = uint16(scaled(r.TempCo, math.MinInt16, math.MaxInt16))
+		b[1] = uint16(scaled(r.TempRoom, math.MinInt16, math.MaxInt16))
+		b[2] = uint16(scaled(r.Humidity, 0, math.MaxUint16))
+		ts := uint32(*r.Timestamp)
+		b[3], b[4] = uint16(ts>>16), uint16(ts)
+		b[5] = uint16(min(max(now-*r.Timestamp, 0), math.MaxUint16))
+		b[6] = 1
+	}
+	return regs
+}
+
+// scaled returns v in hundredths, clamped to [lo, hi].
+func scaled(v float64, lo, hi int64) int64 {
+	return min(max(int64(math.Round(v*100)), lo), hi)
+}
@@ -0,0 +1,64 @@
+package modbus
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ts(v int64) *int64 { return &v }
+
+func TestServer(t *testing.T) {
+	s := New(Config{Devices: []string{"attic", DefaultDevice}})
+	s.now = func() time.Time { return time.Unix(1761388161, 0) }
+	s.Update("attic", store.TemperatureReading{TempCo: 40.5, TempRoom: -2.25, Humidity: 50, Timestamp: ts(1761388101)})
+	// older readings and unknown devices are ignored
+	s.Update("attic", store.TemperatureReading{TempCo: 1, Timestamp: ts(1761388000)})
+	s.Update("garage", store.TemperatureReading{TempCo: 1})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx, ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	request := func(pdu ...byte) []byte {
+		frame := []byte{0x12, 0x34, 0, 0, 0, byte(len(pdu) + 1), 7}
+		_, err := conn.Write(append(frame, pdu...))
+		require.NoError(t, err)
+		header := make([]byte, 7)
+		_, err = io.ReadFull(conn, header)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0x12, 0x34, 0, 0}, header[:4])
+		assert.Equal(t, byte(7), header[6])
+		resp := make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+		_, err = io.ReadFull(conn, resp)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := request(funcReadHolding, 0, 0, 0, BlockSize+1)
+	require.Len(t, resp, 2+2*(BlockSize+1))
+	assert.Equal(t, []byte{funcReadHolding, 2 * (BlockSize + 1)}, resp[:2])
+	var regs []uint16
+	for i := 2; i < len(resp); i += 2 {
+		regs = append(regs, binary.BigEndian.Uint16(resp[i:]))
+	}
+	neg := int16(-225)
+	assert.Equal(t, []uint16{4050, uint16(neg), 5000, 1761388101 >> 16, 1761388101 & 0xffff, 60, 1, 0, 0}, regs)
+
+	assert.Equal(t, []byte{funcReadInput, 2, 0x13, 0x88}, request(funcReadInput, 0, 2, 0, 1))
+	assert.Equal(t, []byte{0x86, exIllegalFunction}, request(0x06, 0, 0, 0, 1))
+	assert.Equal(t, []byte{0x83, exIllegalAddress}, request(funcReadHolding, 0, 10, 0, 7))
+	assert.Equal(t, []byte{0x83, exIllegalValue}, request(funcReadHolding, 0, 0, 0, 0))
+}
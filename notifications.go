@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/bartosz121/esp8266-web/notify"
+)
+
+// notifiers returns the alert notification channels that are configured, by
+// the names escalation steps use.
+func (c *config) notifiers() map[string]notify.Notifier {
+	n := make(map[string]notify.Notifier)
+	if c.telegramToken != "" && c.telegramChatID != "" {
+		n["telegram"] = &notify.Telegram{Token: c.telegramToken, ChatID: c.telegramChatID}
+	}
+	if c.smtpAddr != "" && c.emailTo != "" {
+		n["email"] = &notify.Email{
+			Addr:     c.smtpAddr,
+			Username: c.smtpUser,
+			Password: c.smtpPass,
+			From:     c.smtpFrom,
+			To:       splitList(c.emailTo),
+		}
+	}
+	if c.twilioSID != "" && c.smsTo != "" {
+		n["sms"] = &notify.SMS{
+			Provider: &notify.Twilio{
+				AccountSID: c.twilioSID,
+				AuthToken:  c.twilioToken,
+				From:       c.twilioFrom,
+			},
+			To: splitList(c.smsTo),
+		}
+	}
+	return n
+}
+
+// notificationChannels returns the settings of the channels notifiers
+// builds, leaving out tokens and passwords.
+func (c *config) notificationChannels() map[string]map[string]string {
+	channels := make(map[string]map[string]string)
+	if c.telegramToken != "" && c.telegramChatID != "" {
+		channels["telegram"] = map[string]string{"chat_id": c.telegramChatID}
+	}
+	if c.smtpAddr != "" && c.emailTo != "" {
+		channels["email"] = map[string]string{"smtp_addr": c.smtpAddr, "smtp_user": c.smtpUser, "from": c.smtpFrom, "to": c.emailTo}
+	}
+	if c.twilioSID != "" && c.smsTo != "" {
+		channels["sms"] = map[string]string{"twilio_sid": c.twilioSID, "from": c.twilioFrom, "to": c.smsTo}
+	}
+	if len(channels) == 0 {
+		return nil
+	}
+	return channels
+}
+
+func splitList(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
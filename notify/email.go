@@ -0,0 +1,48 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// sendMail is swapped in tests.
+var sendMail = smtp.SendMail
+
+// Email sends plain text mail through an SMTP server. Username and Password
+// are optional; PLAIN auth is used when set.
+type Email struct {
+	// Addr is the SMTP server, host:port.
+	Addr     string
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+var _ Notifier = (*Email)(nil)
+
+func (e *Email) Notify(ctx context.Context, m Message) error {
+	var auth smtp.Auth
+	if e.Username != "" {
+		host, _, err := net.SplitHostPort(e.Addr)
+		if err != nil {
+			return fmt.Errorf("email send: %w", err)
+		}
+		auth = smtp.PlainAuth("", e.Username, e.Password, host)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", e.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", m.Subject)
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(m.body(), "\n", "\r\n"))
+
+	if err := sendMail(e.Addr, auth, e.From, e.To, []byte(msg.String())); err != nil {
+		return fmt.Errorf("email send: %w", err)
+	}
+	return nil
+}
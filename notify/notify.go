@@ -0,0 +1,35 @@
+// Package notify delivers alert notifications over external channels.
+package notify
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Message is a notification about an alert. AckURL, when set, is a link
+// acknowledging the alert, which stops its escalation.
+type Message struct {
+	Subject string
+	Text    string
+	AckURL  string
+}
+
+// body returns the message text followed by the acknowledge link.
+func (m Message) body() string {
+	if m.AckURL == "" {
+		return m.Text
+	}
+	return m.Text + "\n\nAcknowledge: " + m.AckURL
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, m Message) error
+}
+
+func httpClient(c *http.Client) *http.Client {
+	if c != nil {
+		return c
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
@@ -0,0 +1,101 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testMessage = Message{Subject: "[critical] boiler hot firing", Text: "tempCo is 72.5 (gt 70)", AckURL: "https://temp.example.com/alerts/ack/abc"}
+
+func TestTelegram(t *testing.T) {
+	var got map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bot123:token/sendMessage" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+	}))
+	defer srv.Close()
+
+	tg := &Telegram{Token: "123:token", ChatID: "42", BaseURL: srv.URL}
+	require.NoError(t, tg.Notify(context.Background(), testMessage))
+	assert.Equal(t, "42", got["chat_id"])
+	assert.Equal(t, "[critical] boiler hot firing\n\ntempCo is 72.5 (gt 70)", got["text"])
+	assert.Contains(t, got["reply_markup"], "inline_keyboard")
+
+	tg.Token = "wrong"
+	assert.Error(t, tg.Notify(context.Background(), testMessage))
+}
+
+func TestEmail(t *testing.T) {
+	var gotAddr, gotFrom string
+	var gotTo []string
+	var gotMsg []byte
+	sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		gotAddr, gotFrom, gotTo, gotMsg = addr, from, to, msg
+		return nil
+	}
+	t.Cleanup(func() { sendMail = smtp.SendMail })
+
+	e := &Email{Addr: "smtp.example.com:587", Username: "alerts", Password: "pass", From: "alerts@example.com", To: []string{"me@example.com"}}
+	require.NoError(t, e.Notify(context.Background(), testMessage))
+	assert.Equal(t, "smtp.example.com:587", gotAddr)
+	assert.Equal(t, "alerts@example.com", gotFrom)
+	assert.Equal(t, []string{"me@example.com"}, gotTo)
+	assert.Contains(t, string(gotMsg), "Subject: [critical] boiler hot firing\r\n")
+	assert.Contains(t, string(gotMsg), "Acknowledge: https://temp.example.com/alerts/ack/abc")
+}
+
+func TestTwilio(t *testing.T) {
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		if r.URL.Path != "/2010-04-01/Accounts/AC1/Messages.json" || user != "AC1" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		require.NoError(t, r.ParseForm())
+		bodies = append(bodies, r.PostForm.Get("To")+": "+r.PostForm.Get("Body"))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	tw := &Twilio{AccountSID: "AC1", AuthToken: "secret", From: "+100", BaseURL: srv.URL}
+	sms := &SMS{Provider: tw, To: []string{"+200", "+300"}}
+	require.NoError(t, sms.Notify(context.Background(), testMessage))
+	assert.Equal(t, []string{
+		"+200: [critical] boiler hot firing https://temp.example.com/alerts/ack/abc",
+		"+300: [critical] boiler hot firing https://temp.example.com/alerts/ack/abc",
+	}, bodies)
+
+	tw.AuthToken = "wrong"
+	assert.Error(t, sms.Notify(context.Background(), testMessage))
+}
+
+type failingProvider struct {
+	sent []string
+}
+
+func (p *failingProvider) SendSMS(ctx context.Context, to, text string) error {
+	if to == "+bad" {
+		return errors.New("invalid number")
+	}
+	p.sent = append(p.sent, to)
+	return nil
+}
+
+func TestSMSKeepsSendingAfterFailure(t *testing.T) {
+	p := &failingProvider{}
+	err := (&SMS{Provider: p, To: []string{"+bad", "+200"}}).Notify(context.Background(), testMessage)
+	assert.ErrorContains(t, err, "sms send to +bad")
+	assert.Equal(t, []string{"+200"}, p.sent)
+}
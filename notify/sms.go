@@ -0,0 +1,36 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// SMSProvider sends a text message to one phone number.
+type SMSProvider interface {
+	SendSMS(ctx context.Context, to, text string) error
+}
+
+// SMS notifies phone numbers through an SMSProvider. Every recipient is
+// tried even when one fails.
+type SMS struct {
+	Provider SMSProvider
+	To       []string
+}
+
+var _ Notifier = (*SMS)(nil)
+
+func (s *SMS) Notify(ctx context.Context, m Message) error {
+	// SMS is short; the subject already says what fired
+	text := m.Subject
+	if m.AckURL != "" {
+		text += " " + m.AckURL
+	}
+	var errs []error
+	for _, to := range s.To {
+		if err := s.Provider.SendSMS(ctx, to, text); err != nil {
+			errs = append(errs, fmt.Errorf("sms send to %s: %w", to, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,60 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Telegram sends messages through a Telegram bot to one chat.
+type Telegram struct {
+	Token  string
+	ChatID string
+	// BaseURL defaults to https://api.telegram.org.
+	BaseURL string
+	Client  *http.Client
+}
+
+var _ Notifier = (*Telegram)(nil)
+
+func (t *Telegram) Notify(ctx context.Context, m Message) error {
+	payload := map[string]any{
+		"chat_id": t.ChatID,
+		"text":    m.Subject + "\n\n" + m.Text,
+	}
+	if m.AckURL != "" {
+		payload["reply_markup"] = map[string]any{
+			"inline_keyboard": [][]map[string]string{{{"text": "Acknowledge", "url": m.AckURL}}},
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	baseURL := t.BaseURL
+	if baseURL == "" {
+		baseURL = "https://api.telegram.org"
+	}
+	url := strings.TrimRight(baseURL, "/") + "/bot" + t.Token + "/sendMessage"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := httpClient(t.Client).Do(req)
+	if err != nil {
+		// the URL contains the bot token
+		return fmt.Errorf("telegram send: %w", errors.Unwrap(err))
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("telegram send: unexpected status %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Twilio sends SMS through the Twilio Messages API.
+type Twilio struct {
+	AccountSID string
+	AuthToken  string
+	From       string
+	// BaseURL defaults to https://api.twilio.com.
+	BaseURL string
+	Client  *http.Client
+}
+
+var _ SMSProvider = (*Twilio)(nil)
+
+func (t *Twilio) SendSMS(ctx context.Context, to, text string) error {
+	baseURL := t.BaseURL
+	if baseURL == "" {
+		baseURL = "https://api.twilio.com"
+	}
+	endpoint := strings.TrimRight(baseURL, "/") + "/2010-04-01/Accounts/" + url.PathEscape(t.AccountSID) + "/Messages.json"
+
+	form := url.Values{"From": {t.From}, "To": {to}, "Body": {text}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(t.AccountSID, t.AuthToken)
+
+	res, err := httpClient(t.Client).Do(req)
+	if err != nil {
+		return fmt.Errorf("twilio: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusOK {
+		return fmt.Errorf("twilio: unexpected status %s", res.Status)
+	}
+	return nil
+}
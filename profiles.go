@@ -0,0 +1,80 @@
+package main
+
+import (
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// profileFS holds the built-in profiles, bundles of flag values for a
+// kind of deployment, one file per profile.
+//
+//go:embed profiles/*.yaml
+var profileFS embed.FS
+
+type profile struct {
+	Description string `yaml:"description"`
+	// Flags are flag values by flag name.
+	Flags map[string]string `yaml:"flags"`
+}
+
+// profileNames lists the built-in profiles, sorted.
+func profileNames() []string {
+	entries, _ := fs.ReadDir(profileFS, "profiles")
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), path.Ext(e.Name())))
+	}
+	slices.Sort(names)
+	return names
+}
+
+func loadProfile(name string) (profile, error) {
+	var p profile
+	data, err := profileFS.ReadFile("profiles/" + name + ".yaml")
+	if err != nil {
+		return p, fmt.Errorf("unknown profile %q, available: %s", name, strings.Join(profileNames(), ", "))
+	}
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return p, fmt.Errorf("parse profile %s: %w", name, err)
+	}
+	return p, nil
+}
+
+// applyProfile sets the flags of fs preset by the profile selected with
+// --profile or APP_PROFILE. Flags given on the command line keep their
+// value and applyEnv, called after it, still overrides any of them; flags
+// fs doesn't have, e.g. serve's in another command, are skipped.
+func (c *config) applyProfile(fs *flag.FlagSet, logger *slog.Logger) error {
+	if env := os.Getenv("APP_PROFILE"); env != "" {
+		c.profile = env
+		logger.Debug("flag profile overridden by env APP_PROFILE", "value", env)
+	}
+	if c.profile == "" {
+		return nil
+	}
+	p, err := loadProfile(c.profile)
+	if err != nil {
+		return err
+	}
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for name, value := range p.Flags {
+		if explicit[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("profile %s: flag %s: %w", c.profile, name, err)
+		}
+	}
+	logger.Debug("applied profile", "profile", c.profile)
+	return nil
+}
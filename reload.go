@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/bartosz121/esp8266-web/alert"
+	"github.com/bartosz121/esp8266-web/ingest"
+	"github.com/bartosz121/esp8266-web/server"
+	"gopkg.in/yaml.v3"
+)
+
+// reloadableSettings are the non-structural settings read from the --config
+// file at startup and again on SIGHUP or POST /admin/reload. Settings that
+// need a restart (addresses, database) stay flags and env variables.
+type reloadableSettings struct {
+	LogLevel string `yaml:"log_level"`
+	// NotificationTemplates are Go templates for alert notifications, keyed
+	// by channel name or "default".
+	NotificationTemplates map[string]string `yaml:"notification_templates"`
+	// LoRaWANDecoders decode TTN and ChirpStack uplinks, keyed by device
+	// id, dev EUI or "default".
+	LoRaWANDecoders map[string]ingest.LoRaDecoder `yaml:"lorawan_decoders"`
+	// FirmwareFields map Tasmota and ESPHome values to reading fields, keyed
+	// by format and then by device or "default".
+	FirmwareFields map[string]map[string]ingest.FieldMap `yaml:"firmware_fields"`
+	// APIKeys are scoped keys accepted next to the secret key.
+	APIKeys []server.APIKey `yaml:"api_keys"`
+	// Webhooks authorize platforms calling ingest adapters, keyed by
+	// adapter name.
+	Webhooks map[string]ingest.Webhook `yaml:"webhooks"`
+	// PayloadKeys decrypt the request bodies devices seal with them.
+	PayloadKeys []server.PayloadKey `yaml:"payload_keys"`
+	// MetricPaths map graphite and StatsD metrics to devices and reading
+	// fields, the first matching one applies.
+	MetricPaths []ingest.MetricPath `yaml:"metric_paths"`
+}
+
+type reloader struct {
+	mu       sync.Mutex
+	path     string
+	defaults reloadableSettings
+	logLevel *slog.LevelVar
+	logger   *slog.Logger
+
+	// templates are the notification templates last loaded.
+	templates alert.Templates
+	// setTemplates, when set, applies reloaded notification templates.
+	setTemplates func(alert.Templates)
+	// decoders are the LoRaWAN decoders last loaded.
+	decoders map[string]ingest.LoRaDecoder
+	// setDecoders, when set, applies reloaded LoRaWAN decoders.
+	setDecoders func(map[string]ingest.LoRaDecoder)
+	// fields are the firmware field maps last loaded.
+	fields map[string]map[string]ingest.FieldMap
+	// setFields, when set, applies reloaded firmware field maps.
+	setFields func(map[string]map[string]ingest.FieldMap)
+	// apiKeys are the API keys last loaded.
+	apiKeys []server.APIKey
+	// webhooks are the webhooks last loaded.
+	webhooks map[string]ingest.Webhook
+	// payloadKeys are the payload keys last loaded.
+	payloadKeys []server.PayloadKey
+	// paths are the metric paths last loaded.
+	paths []ingest.MetricPath
+	// setPaths, when set, applies reloaded metric paths.
+	setPaths func([]ingest.MetricPath)
+}
+
+func (r *reloader) load() (reloadableSettings, error) {
+	s := r.defaults
+	if r.path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return s, fmt.Errorf("read config: %w", err)
+	}
+	if err := yaml.Unmarshal(data, &s); err != nil {
+		return s, fmt.Errorf("parse config: %w", err)
+	}
+	return s, nil
+}
+
+// Reload re-reads the config file and applies it. Nothing is applied when
+// the file is invalid.
+func (r *reloader) Reload(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, err := r.load()
+	if err != nil {
+		return err
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s.LogLevel)); err != nil {
+		return fmt.Errorf("invalid log_level %q: %w", s.LogLevel, err)
+	}
+	templates, err := alert.ParseTemplates(s.NotificationTemplates)
+	if err != nil {
+		return fmt.Errorf("invalid notification_templates: %w", err)
+	}
+	if err := ingest.ValidateDecoders(s.LoRaWANDecoders); err != nil {
+		return fmt.Errorf("invalid lorawan_decoders: %w", err)
+	}
+	if err := ingest.ValidateFieldMaps(s.FirmwareFields); err != nil {
+		return fmt.Errorf("invalid firmware_fields: %w", err)
+	}
+	if err := server.ValidateAPIKeys(s.APIKeys); err != nil {
+		return fmt.Errorf("invalid api_keys: %w", err)
+	}
+	if err := ingest.ValidateWebhooks(s.Webhooks); err != nil {
+		return fmt.Errorf("invalid webhooks: %w", err)
+	}
+	if err := server.ValidatePayloadKeys(s.PayloadKeys); err != nil {
+		return fmt.Errorf("invalid payload_keys: %w", err)
+	}
+	if err := ingest.ValidateMetricPaths(s.MetricPaths); err != nil {
+		return fmt.Errorf("invalid metric_paths: %w", err)
+	}
+
+	r.logLevel.Set(level)
+	r.templates = templates
+	if r.setTemplates != nil {
+		r.setTemplates(templates)
+	}
+	r.decoders = s.LoRaWANDecoders
+	if r.setDecoders != nil {
+		r.setDecoders(s.LoRaWANDecoders)
+	}
+	r.fields = s.FirmwareFields
+	if r.setFields != nil {
+		r.setFields(s.FirmwareFields)
+	}
+	r.apiKeys = s.APIKeys
+	r.webhooks = s.Webhooks
+	r.payloadKeys = s.PayloadKeys
+	r.paths = s.MetricPaths
+	if r.setPaths != nil {
+		r.setPaths(s.MetricPaths)
+	}
+	r.logger.Info("settings reloaded", "path", r.path, "log_level", level.String(), "api_keys", len(s.APIKeys), "webhooks", len(s.Webhooks), "payload_keys", len(s.PayloadKeys))
+	return nil
+}
+
+// APIKeys returns the API keys last loaded.
+func (r *reloader) APIKeys() []server.APIKey {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.apiKeys
+}
+
+// Webhooks returns the webhooks last loaded.
+func (r *reloader) Webhooks() map[string]ingest.Webhook {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.webhooks
+}
+
+// PayloadKeys returns the payload keys last loaded.
+func (r *reloader) PayloadKeys() []server.PayloadKey {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.payloadKeys
+}
+
+// watchSIGHUP reloads settings on every SIGHUP until ctx is done.
+func (r *reloader) watchSIGHUP(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
+				if err := r.Reload(ctx); err != nil {
+					r.logger.Error("failed to reload settings", "error", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/bartosz121/esp8266-web/secrets"
+	"github.com/jackc/pgx/v5"
+)
+
+// liveSecrets holds the secrets fetched from an external provider and
+// applies their rotations to the running process.
+type liveSecrets struct {
+	current atomic.Pointer[secrets.Secrets]
+	// resetDB is called when the database credentials change.
+	resetDB atomic.Pointer[func()]
+}
+
+// watchSecrets fetches secrets from the configured provider into c and keeps
+// them fresh. It returns nil for the default env provider.
+func (c *config) watchSecrets(ctx context.Context, logger *slog.Logger) (*liveSecrets, error) {
+	var p secrets.Provider
+	switch c.secretsProvider {
+	case "env":
+		return nil, nil
+	case "vault":
+		if c.vaultAddr == "" {
+			return nil, fmt.Errorf("--vault-addr is required with --secrets-provider=vault")
+		}
+		p = &secrets.Vault{
+			Addr:        c.vaultAddr,
+			Token:       c.vaultToken,
+			DBCredsPath: c.vaultDBPath,
+			KVPath:      c.vaultKVPath,
+		}
+	default:
+		return nil, fmt.Errorf("unknown secrets provider %q", c.secretsProvider)
+	}
+
+	ls := &liveSecrets{}
+	err := secrets.Watch(ctx, p, logger, func(s secrets.Secrets) {
+		prev := ls.current.Swap(&s)
+		if prev != nil && (prev.DBUser != s.DBUser || prev.DBPass != s.DBPass) {
+			if reset := ls.resetDB.Load(); reset != nil {
+				(*reset)()
+			}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetch secrets: %w", err)
+	}
+
+	s := ls.current.Load()
+	if s.DBUser != "" {
+		c.dbUser = s.DBUser
+	}
+	if s.DBPass != "" {
+		c.dbPass = s.DBPass
+	}
+	if s.SecretKey != "" {
+		c.secretKey = s.SecretKey
+	}
+	c.beforeConnect = ls.beforeConnect
+	return ls, nil
+}
+
+func (ls *liveSecrets) beforeConnect(ctx context.Context, cc *pgx.ConnConfig) error {
+	s := ls.current.Load()
+	if s.DBUser != "" {
+		cc.User = s.DBUser
+	}
+	if s.DBPass != "" {
+		cc.Password = s.DBPass
+	}
+	return nil
+}
+
+// secretKey returns the device secret, falling back to the configured one
+// when the provider doesn't manage it.
+func (ls *liveSecrets) secretKey(fallback string) func() string {
+	return func() string {
+		if s := ls.current.Load(); s.SecretKey != "" {
+			return s.SecretKey
+		}
+		return fallback
+	}
+}
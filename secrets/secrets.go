@@ -0,0 +1,64 @@
+// Package secrets fetches the database credentials and device secret from an
+// external secret manager and keeps them fresh as their leases expire.
+package secrets
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Secrets holds the credentials a provider returned. Empty fields are not
+// managed by the provider and keep their configured value.
+type Secrets struct {
+	DBUser    string
+	DBPass    string
+	SecretKey string
+	// TTL is how long the secrets stay valid; zero means they don't expire.
+	TTL time.Duration
+}
+
+type Provider interface {
+	Fetch(ctx context.Context) (Secrets, error)
+}
+
+// retryInterval is how long Watch waits after a failed refresh.
+var retryInterval = 30 * time.Second
+
+// Watch fetches secrets from p and passes them to apply. The first fetch is
+// synchronous and its error is returned. When the secrets have a TTL they are
+// fetched again at two thirds of it, until ctx is done.
+func Watch(ctx context.Context, p Provider, logger *slog.Logger, apply func(Secrets)) error {
+	s, err := p.Fetch(ctx)
+	if err != nil {
+		return err
+	}
+	apply(s)
+	if s.TTL <= 0 {
+		return nil
+	}
+
+	go func() {
+		next := s.TTL * 2 / 3
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(next):
+			}
+			s, err := p.Fetch(ctx)
+			if err != nil {
+				logger.Error("failed to refresh secrets", "error", err)
+				next = retryInterval
+				continue
+			}
+			logger.Info("secrets refreshed", "ttl", s.TTL)
+			apply(s)
+			if s.TTL <= 0 {
+				return
+			}
+			next = s.TTL * 2 / 3
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,80 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVaultFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/esp8266-web":
+			fmt.Fprint(w, `{"lease_duration": 0, "data": {"data": {"secret_key": "device-secret"}, "metadata": {"version": 3}}}`)
+		case "/v1/kv/esp8266-web":
+			fmt.Fprint(w, `{"lease_duration": 2764800, "data": {"secret_key": "v1-secret", "db_user": "static", "db_pass": "static-pass"}}`)
+		case "/v1/database/creds/esp8266-web":
+			fmt.Fprint(w, `{"lease_duration": 3600, "data": {"username": "v-esp-abc", "password": "generated"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	v := &Vault{Addr: srv.URL, Token: "root", DBCredsPath: "database/creds/esp8266-web", KVPath: "secret/data/esp8266-web"}
+	s, err := v.Fetch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, Secrets{DBUser: "v-esp-abc", DBPass: "generated", SecretKey: "device-secret", TTL: time.Hour}, s)
+
+	v = &Vault{Addr: srv.URL, Token: "root", KVPath: "kv/esp8266-web"}
+	s, err = v.Fetch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, Secrets{DBUser: "static", DBPass: "static-pass", SecretKey: "v1-secret", TTL: 768 * time.Hour}, s)
+
+	v = &Vault{Addr: srv.URL, Token: "wrong", KVPath: "secret/data/esp8266-web"}
+	_, err = v.Fetch(context.Background())
+	assert.Error(t, err)
+}
+
+type countingProvider struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (p *countingProvider) Fetch(ctx context.Context) (Secrets, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls++
+	return Secrets{DBPass: fmt.Sprint(p.calls), TTL: 30 * time.Millisecond}, nil
+}
+
+func TestWatchRefreshesBeforeExpiry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	applied := make(chan Secrets, 10)
+	p := &countingProvider{}
+	err := Watch(ctx, p, slog.New(slog.NewTextHandler(io.Discard, nil)), func(s Secrets) { applied <- s })
+	require.NoError(t, err)
+
+	assert.Equal(t, "1", (<-applied).DBPass)
+	select {
+	case s := <-applied:
+		assert.Equal(t, "2", s.DBPass)
+	case <-time.After(time.Second):
+		t.Fatal("secrets were not refreshed")
+	}
+}
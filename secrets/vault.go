@@ -0,0 +1,106 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Vault reads secrets from HashiCorp Vault over its HTTP API.
+//
+// DBCredsPath points at a database secrets engine role (e.g.
+// "database/creds/esp8266-web") issuing dynamic credentials with a lease.
+// KVPath points at a KV v1 or v2 secret (e.g. "secret/data/esp8266-web")
+// whose "secret_key" field is the device secret; it may also hold static
+// "db_user" and "db_pass" fields. Either path may be empty.
+type Vault struct {
+	Addr        string
+	Token       string
+	DBCredsPath string
+	KVPath      string
+	Client      *http.Client
+}
+
+var _ Provider = (*Vault)(nil)
+
+type vaultResponse struct {
+	LeaseDuration int             `json:"lease_duration"`
+	Data          json.RawMessage `json:"data"`
+}
+
+func (v *Vault) read(ctx context.Context, path string) (vaultResponse, error) {
+	var resp vaultResponse
+	url := strings.TrimRight(v.Addr, "/") + "/v1/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return resp, err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return resp, fmt.Errorf("vault read %s: %w", path, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return resp, fmt.Errorf("vault read %s: unexpected status %s", path, res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return resp, fmt.Errorf("vault read %s: %w", path, err)
+	}
+	return resp, nil
+}
+
+func (v *Vault) Fetch(ctx context.Context) (Secrets, error) {
+	var s Secrets
+
+	if v.KVPath != "" {
+		resp, err := v.read(ctx, v.KVPath)
+		if err != nil {
+			return s, err
+		}
+		var kv struct {
+			Data      map[string]any `json:"data"`
+			SecretKey string         `json:"secret_key"`
+			DBUser    string         `json:"db_user"`
+			DBPass    string         `json:"db_pass"`
+		}
+		if err := json.Unmarshal(resp.Data, &kv); err != nil {
+			return s, fmt.Errorf("vault read %s: %w", v.KVPath, err)
+		}
+		// KV v2 nests the secret under data.data
+		if kv.Data != nil {
+			kv.SecretKey, _ = kv.Data["secret_key"].(string)
+			kv.DBUser, _ = kv.Data["db_user"].(string)
+			kv.DBPass, _ = kv.Data["db_pass"].(string)
+		}
+		s.SecretKey, s.DBUser, s.DBPass = kv.SecretKey, kv.DBUser, kv.DBPass
+		s.TTL = time.Duration(resp.LeaseDuration) * time.Second
+	}
+
+	if v.DBCredsPath != "" {
+		resp, err := v.read(ctx, v.DBCredsPath)
+		if err != nil {
+			return s, err
+		}
+		var creds struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := json.Unmarshal(resp.Data, &creds); err != nil {
+			return s, fmt.Errorf("vault read %s: %w", v.DBCredsPath, err)
+		}
+		s.DBUser, s.DBPass = creds.Username, creds.Password
+		if ttl := time.Duration(resp.LeaseDuration) * time.Second; ttl > 0 && (s.TTL == 0 || ttl < s.TTL) {
+			s.TTL = ttl
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/simulate"
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+type seedOptions struct {
+	from        time.Time
+	to          time.Time
+	interval    time.Duration
+	noise       float64
+	anomalyRate float64
+}
+
+// generateReadings produces synthetic readings between from and to, see
+// simulate.Sample, with occasional spikes.
+func generateReadings(opts seedOptions, rng *rand.Rand) []store.TemperatureReading {
+	readings := make([]store.TemperatureReading, 0)
+	for t := opts.from; !t.After(opts.to); t = t.Add(opts.interval) {
+		tempCo, tempRoom, humidity := simulate.Sample(t, opts.noise, rng)
+
+		if rng.Float64() < opts.anomalyRate {
+			switch rng.IntN(3) {
+			case 0:
+				tempCo += 20 + rng.Float64()*20
+			case 1:
+				tempRoom -= 5 + rng.Float64()*10
+			default:
+				humidity = math.Min(100, humidity+25+rng.Float64()*20)
+			}
+		}
+
+		ts := t.UTC().Unix()
+		readings = append(readings, store.TemperatureReading{
+			TempCo:    math.Round(tempCo*100) / 100,
+			TempRoom:  math.Round(tempRoom*100) / 100,
+			Humidity:  math.Round(math.Max(0, math.Min(100, humidity))*100) / 100,
+			Timestamp: &ts,
+		})
+	}
+	return readings
+}
+
+func parseSeedTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(time.DateOnly, s, time.Local)
+}
+
+// runSeed handles `seed [flags]`, filling the database with synthetic data
+// for development.
+func runSeed(logger *slog.Logger, args []string) error {
+	var cfg config
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	from := fs.String("from", "", "Start of the generated range, RFC3339 or YYYY-MM-DD (default 7 days before --to)")
+	to := fs.String("to", "", "End of the generated range, RFC3339 or YYYY-MM-DD (default now)")
+	interval := fs.Duration("interval", time.Minute, "Time between generated readings")
+	noise := fs.Float64("noise", 0.15, "Standard deviation of the noise added to the room temperature")
+	anomalyRate := fs.Float64("anomaly-rate", 0.002, "Probability of a reading being an anomaly")
+	randSeed := fs.Uint64("seed", uint64(time.Now().UnixNano()), "Random seed, for reproducible data")
+	fs.Parse(args)
+	if err := cfg.applyProfile(fs, logger); err != nil {
+		return err
+	}
+	if err := cfg.applyEnv(logger); err != nil {
+		return err
+	}
+
+	opts := seedOptions{
+		to:          time.Now(),
+		interval:    *interval,
+		noise:       *noise,
+		anomalyRate: *anomalyRate,
+	}
+	var err error
+	if *to != "" {
+		if opts.to, err = parseSeedTime(*to); err != nil {
+			return fmt.Errorf("invalid --to: %w", err)
+		}
+	}
+	opts.from = opts.to.Add(-7 * 24 * time.Hour)
+	if *from != "" {
+		if opts.from, err = parseSeedTime(*from); err != nil {
+			return fmt.Errorf("invalid --from: %w", err)
+		}
+	}
+	if !opts.from.Before(opts.to) {
+		return errors.New("--from must be before --to")
+	}
+	if opts.interval <= 0 {
+		return errors.New("--interval must be positive")
+	}
+	if cfg.dbDriver != "postgres" {
+		return fmt.Errorf("seed is not supported by db driver %q", cfg.dbDriver)
+	}
+
+	ctx := context.Background()
+	if _, err := cfg.loadSettings(ctx, logger); err != nil {
+		return err
+	}
+	if _, err := cfg.watchSecrets(ctx, logger); err != nil {
+		return err
+	}
+
+	db, err := cfg.openPostgres(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.Migrate(ctx); err != nil {
+		return fmt.Errorf("apply migrations: %w", err)
+	}
+
+	readings := generateReadings(opts, rand.New(rand.NewPCG(*randSeed, *randSeed)))
+	n, err := db.InsertReadings(ctx, readings)
+	if err != nil {
+		return fmt.Errorf("insert readings: %w", err)
+	}
+	logger.Info("seeded readings", "count", n, "from", opts.from, "to", opts.to, "seed", *randSeed)
+	return nil
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/aggregate"
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const (
+	// maxSmooth is the widest smooth window.
+	maxSmooth = 24 * time.Hour
+
+	defaultDownsampleRange = 24 * time.Hour
+	maxDownsamplePoints    = 10000
+
+	defaultInterpolateRange = 24 * time.Hour
+	// maxInterpolatePoints caps the response of GET /data?cadence=.
+	maxInterpolatePoints = 10000
+
+	defaultAggregateRange    = 24 * time.Hour
+	defaultAggregateInterval = time.Hour
+	minAggregateInterval     = time.Minute
+	// maxAggregateBuckets caps the response of GET /data/aggregate.
+	maxAggregateBuckets = 10000
+)
+
+// parseTimeRange parses the from and to query parameters, unix timestamps;
+// to defaults to now and from to def before to. It responds with 422 when
+// one is invalid.
+func parseTimeRange(w http.ResponseWriter, q url.Values, def time.Duration) (from, to int64, ok bool) {
+	to = time.Now().Unix()
+	if v := q.Get("to"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Bad request: invalid to", http.StatusUnprocessableEntity)
+			return 0, 0, false
+		}
+		to = n
+	}
+	from = to - int64(def/time.Second)
+	if v := q.Get("from"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Bad request: invalid from", http.StatusUnprocessableEntity)
+			return 0, 0, false
+		}
+		from = n
+	}
+	return from, to, true
+}
+
+// parseSmooth parses the smooth query parameter, the width of a centered
+// rolling mean, and returns half of it in seconds, 0 when it isn't given.
+// It responds with 422 when smooth is invalid and with 501 when the store
+// can't smooth.
+func (s *server) parseSmooth(w http.ResponseWriter, q url.Values) (half int64, ok bool) {
+	v := q.Get("smooth")
+	if v == "" {
+		return 0, true
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 2*time.Second || d > maxSmooth {
+		http.Error(w, "Bad request: smooth must be a duration between 2s and 24h", http.StatusUnprocessableEntity)
+		return 0, false
+	}
+	if _, ok := s.store.(store.SmoothingStore); !ok {
+		http.Error(w, "Smoothing is not supported by this storage backend", http.StatusNotImplemented)
+		return 0, false
+	}
+	return int64(d/time.Second) / 2, true
+}
+
+// aggregateHandler averages the readings between from and to into buckets
+// of interval, filling empty buckets as fill says.
+func (s *server) aggregateHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	from, to, ok := parseTimeRange(w, q, defaultAggregateRange)
+	if !ok {
+		return
+	}
+	interval := defaultAggregateInterval
+	if v := q.Get("interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < minAggregateInterval || d%time.Second != 0 {
+			http.Error(w, "Bad request: interval must be a whole number of seconds, at least 1m", http.StatusUnprocessableEntity)
+			return
+		}
+		interval = d
+	}
+	step := int64(interval / time.Second)
+	if from >= to || to-from > int64(maxUsageRange/time.Second) || (to-from)/step >= maxAggregateBuckets {
+		http.Error(w, "Bad request: from must be before to, at most 366 days and 10000 intervals apart", http.StatusUnprocessableEntity)
+		return
+	}
+	fill := q.Get("fill")
+	if err := aggregate.ValidateFill(fill); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	list, ok := s.parseSelection(w, r, nil)
+	if !ok {
+		return
+	}
+
+	readings, err := readingsSince(r.Context(), from, list)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query readings")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aggregate.Buckets(readings, from, to, step, fill))
+}
+
+// writeDownsampled answers GET /data?points=N: the readings between from
+// and to, the last day by default, downsampled to N with LTTB and newest
+// first like the rest of /data. limit and offset don't apply.
+func (s *server) writeDownsampled(w http.ResponseWriter, r *http.Request, format string, csvf csvFormat) {
+	logger := slogctx.FromCtx(r.Context())
+
+	q := r.URL.Query()
+	points, err := strconv.Atoi(q.Get("points"))
+	if err != nil || points < 3 || points > maxDownsamplePoints {
+		http.Error(w, "Bad request: points must be between 3 and 10000", http.StatusUnprocessableEntity)
+		return
+	}
+	from, to, ok := parseTimeRange(w, q, defaultDownsampleRange)
+	if !ok {
+		return
+	}
+	if from >= to || to-from > int64(maxUsageRange/time.Second) {
+		http.Error(w, "Bad request: from must be before to and at most 366 days apart", http.StatusUnprocessableEntity)
+		return
+	}
+
+	list, ok := s.parseSelection(w, r, nil)
+	if !ok {
+		return
+	}
+
+	readings, err := readingsSince(r.Context(), from, list)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query temperature readings")
+		return
+	}
+	end := len(readings)
+	for end > 0 && *readings[end-1].Timestamp > to {
+		end--
+	}
+	sampled := slices.Clone(aggregate.LTTB(readings[:end], points))
+	slices.Reverse(sampled)
+	if err := s.writeReadings(w, r, format, csvf, sampled, nil); err != nil {
+		logger.Error("Failed to write temperature readings", "error", err)
+	}
+}
+
+// writeInterpolated answers GET /data?cadence=D: one reading every D
+// between from and to, the last day by default, virtual ones interpolated
+// between the stored readings around them and flagged as such, newest
+// first like the rest of /data. limit and offset don't apply.
+func (s *server) writeInterpolated(w http.ResponseWriter, r *http.Request, format string, csvf csvFormat) {
+	logger := slogctx.FromCtx(r.Context())
+
+	q := r.URL.Query()
+	cadence, err := time.ParseDuration(q.Get("cadence"))
+	if err != nil || cadence < time.Second || cadence%time.Second != 0 {
+		http.Error(w, "Bad request: cadence must be a whole number of seconds, at least 1s", http.StatusUnprocessableEntity)
+		return
+	}
+	from, to, ok := parseTimeRange(w, q, defaultInterpolateRange)
+	if !ok {
+		return
+	}
+	step := int64(cadence / time.Second)
+	if from >= to || to-from > int64(maxUsageRange/time.Second) || (to-from)/step >= maxInterpolatePoints {
+		http.Error(w, "Bad request: from must be before to, at most 366 days and 10000 cadences apart", http.StatusUnprocessableEntity)
+		return
+	}
+
+	list, ok := s.parseSelection(w, r, nil)
+	if !ok {
+		return
+	}
+
+	readings, err := readingsSince(r.Context(), from, list)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query temperature readings")
+		return
+	}
+	series := aggregate.Interpolate(readings, from, to, step)
+	slices.Reverse(series)
+	if err := s.writeReadings(w, r, format, csvf, series, nil); err != nil {
+		logger.Error("Failed to write temperature readings", "error", err)
+	}
+}
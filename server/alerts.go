@@ -0,0 +1,425 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/alert"
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const (
+	defaultAlertHistoryLimit = 50
+	maxAlertHistoryLimit     = 500
+)
+
+// alertStore returns the alert store, or responds with 501 when the storage
+// backend doesn't support alerting.
+func (s *server) alertStore(w http.ResponseWriter) (store.AlertStore, bool) {
+	if s.alerts == nil {
+		http.Error(w, "Alerts are not supported by this storage backend", http.StatusNotImplemented)
+		return nil, false
+	}
+	return s.alerts.Store(), true
+}
+
+func (s *server) alertsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st, ok := s.alertStore(w)
+	if !ok {
+		return
+	}
+	alerts, err := st.ListFiringAlerts(r.Context())
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query firing alerts")
+		return
+	}
+	now := time.Now().Unix()
+	for i, a := range alerts {
+		if alerts[i].Silenced, err = s.alerts.Silenced(r.Context(), a.RuleName, a.Severity, now); err != nil {
+			writeStoreError(w, logger, err, "Failed to query alert silences")
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts)
+}
+
+func (s *server) alertHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st, ok := s.alertStore(w)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	f := store.AlertHistoryFilter{State: q.Get("state"), Limit: defaultAlertHistoryLimit}
+	switch f.State {
+	case "", store.AlertFiring, store.AlertAcknowledged, store.AlertResolved:
+	default:
+		http.Error(w, "Bad request: state must be firing, acknowledged or resolved", http.StatusUnprocessableEntity)
+		return
+	}
+	for name, dst := range map[string]*int64{"from": &f.From, "to": &f.To} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				http.Error(w, "Bad request: invalid "+name, http.StatusUnprocessableEntity)
+				return
+			}
+			*dst = n
+		}
+	}
+	if v := q.Get("rule"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Bad request: invalid rule", http.StatusUnprocessableEntity)
+			return
+		}
+		f.RuleId = id
+	}
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 && l <= maxAlertHistoryLimit {
+		f.Limit = l
+	}
+	if o, err := strconv.Atoi(q.Get("offset")); err == nil && o >= 0 {
+		f.Offset = o
+	}
+
+	events, err := st.ListAlertHistory(r.Context(), f)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query alert history")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+func (s *server) alertRulesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	st, ok := s.alertStore(w)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rules, err := st.ListAlertRules(r.Context())
+		if err != nil {
+			writeStoreError(w, logger, err, "Failed to query alert rules")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rules)
+
+	case http.MethodPost:
+		if !s.authorized(r, ScopeAdmin) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		rule, ok := decodeAlertRule(w, r)
+		if !ok {
+			return
+		}
+		rule, err := st.CreateAlertRule(r.Context(), rule)
+		if err != nil {
+			writeStoreError(w, logger, err, "Failed to create alert rule")
+			return
+		}
+		logger.Info("Created alert rule", slog.Int("id", rule.Id), slog.String("name", rule.Name))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rule)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) alertRuleHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	st, ok := s.alertStore(w)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var rule store.AlertRule
+	switch r.Method {
+	case http.MethodGet:
+		rule, err = st.GetAlertRule(r.Context(), id)
+
+	case http.MethodPut:
+		if !s.authorized(r, ScopeAdmin) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if rule, ok = decodeAlertRule(w, r); !ok {
+			return
+		}
+		rule.Id = id
+		rule, err = st.UpdateAlertRule(r.Context(), rule)
+
+	case http.MethodDelete:
+		if !s.authorized(r, ScopeAdmin) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if err = st.DeleteAlertRule(r.Context(), id); err == nil {
+			logger.Info("Deleted alert rule", slog.Int("id", id))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to access alert rule", "id", id)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+// decodeAlertRule reads and validates a rule from the request body. Enabled
+// defaults to true when omitted.
+func decodeAlertRule(w http.ResponseWriter, r *http.Request) (store.AlertRule, bool) {
+	rule := store.AlertRule{Enabled: true}
+	if err := decodeBody(r, &rule); err != nil {
+		slogctx.FromCtx(r.Context()).Error("failed to decode alert rule", slog.Any("error", err))
+		writeDecodeError(w, err)
+		return rule, false
+	}
+	if err := alert.Validate(&rule); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusUnprocessableEntity)
+		return rule, false
+	}
+	return rule, true
+}
+
+// SilencePayload creates a silence lasting Duration, a Go duration such as
+// "48h", from StartsAt or now.
+type SilencePayload struct {
+	Matchers []store.SilenceMatcher `json:"matchers"`
+	Duration string                 `json:"duration"`
+	Comment  string                 `json:"comment"`
+	StartsAt *int64                 `json:"startsAt"`
+}
+
+func (s *server) silencesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	st, ok := s.alertStore(w)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		silences, err := st.ListActiveSilences(r.Context(), time.Now().Unix())
+		if err != nil {
+			writeStoreError(w, logger, err, "Failed to query alert silences")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(silences)
+
+	case http.MethodPost:
+		if !s.authorized(r, ScopeAdmin) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var p SilencePayload
+		if err := decodeBody(r, &p); err != nil {
+			logger.Error("failed to decode alert silence", slog.Any("error", err))
+			writeDecodeError(w, err)
+			return
+		}
+		d, err := time.ParseDuration(p.Duration)
+		if err != nil {
+			http.Error(w, "Bad request: invalid duration", http.StatusUnprocessableEntity)
+			return
+		}
+		silence := store.Silence{Matchers: p.Matchers, Comment: p.Comment, StartsAt: time.Now().Unix()}
+		if p.StartsAt != nil {
+			silence.StartsAt = *p.StartsAt
+		}
+		silence.EndsAt = silence.StartsAt + int64(d/time.Second)
+		if err := alert.ValidateSilence(silence); err != nil {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		silence, err = st.CreateSilence(r.Context(), silence)
+		if err != nil {
+			writeStoreError(w, logger, err, "Failed to create alert silence")
+			return
+		}
+		logger.Info("Created alert silence", slog.Int("id", silence.Id), slog.Int64("ends_at", silence.EndsAt), slog.String("comment", silence.Comment))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(silence)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// silenceHandler expires a silence before its end.
+func (s *server) silenceHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st, ok := s.alertStore(w)
+	if !ok {
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	err = st.ExpireSilence(r.Context(), id, time.Now().Unix())
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to expire alert silence", "id", id)
+		return
+	}
+	logger.Info("Expired alert silence", slog.Int("id", id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ackLinkHandler acknowledges an alert from the link embedded in its
+// notifications; the token in the link authorizes it.
+func (s *server) ackLinkHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := s.alertStore(w); !ok {
+		return
+	}
+	a, err := s.alerts.Ack(r.Context(), r.PathValue("token"))
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Alert not found, it may have resolved already", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to acknowledge alert")
+		return
+	}
+	logger.Info("Acknowledged alert", slog.Int("rule_id", a.RuleId))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Alert %q acknowledged, escalation stopped.\n", a.RuleName)
+}
+
+// alertAckHandler acknowledges the firing alert of a rule.
+func (s *server) alertAckHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st, ok := s.alertStore(w)
+	if !ok {
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	alerts, err := st.ListFiringAlerts(r.Context())
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query firing alerts")
+		return
+	}
+	i := slices.IndexFunc(alerts, func(a store.Alert) bool { return a.RuleId == id })
+	if i < 0 {
+		http.Error(w, "Not found: alert is not firing", http.StatusNotFound)
+		return
+	}
+	a, err := s.alerts.Ack(r.Context(), alerts[i].AckToken)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to acknowledge alert", "rule_id", id)
+		return
+	}
+	logger.Info("Acknowledged alert", slog.Int("rule_id", id))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// alertRulesExportHandler renders the alert rules for the Prometheus
+// stack, as a rules file or Alertmanager routes.
+func (s *server) alertRulesExportHandler(render func([]store.AlertRule) ([]byte, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := slogctx.FromCtx(r.Context())
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		st, ok := s.alertStore(w)
+		if !ok {
+			return
+		}
+		rules, err := st.ListAlertRules(r.Context())
+		if err != nil {
+			writeStoreError(w, logger, err, "Failed to query alert rules")
+			return
+		}
+		out, err := render(rules)
+		if err != nil {
+			logger.Error("Failed to render alert rules", "error", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(out)
+	}
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func doRequest(t *testing.T, srv *httptest.Server, method, path, body string) *http.Response {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("X-Secret-Key", "testsecret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestAlertRulesCRUD(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "POST", "/alerts/rules", `{"name": "boiler hot", "field": "tempCo", "op": "gt", "threshold": 70}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var rule store.AlertRule
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&rule))
+	assert.Equal(t, store.AlertRule{Id: 1, Name: "boiler hot", Field: "tempCo", Op: "gt", Threshold: 70, Severity: "warning", Enabled: true, Escalation: []store.EscalationStep{}, Templates: map[string]string{}}, rule)
+
+	resp = doRequest(t, srv, "POST", "/alerts/rules", `{"name": "bad", "field": "pressure", "op": "gt"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp = doRequest(t, srv, "PUT", "/alerts/rules/1", `{"name": "boiler hot", "field": "tempCo", "op": "gt", "threshold": 75, "severity": "critical"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, srv, "GET", "/alerts/rules/1", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&rule))
+	assert.Equal(t, 75.0, rule.Threshold)
+	assert.Equal(t, "critical", rule.Severity)
+
+	resp = doRequest(t, srv, "GET", "/alerts/rules", "")
+	var rules []store.AlertRule
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&rules))
+	assert.Len(t, rules, 1)
+
+	resp = doRequest(t, srv, "DELETE", "/alerts/rules/1", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = doRequest(t, srv, "GET", "/alerts/rules/1", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAlertRulesRequireAuth(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "othersecret"}, memory.New()))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "POST", "/alerts/rules", `{"name": "boiler hot", "field": "tempCo", "op": "gt", "threshold": 70}`)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = doRequest(t, srv, "DELETE", "/alerts/rules/1", "")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestAlertsFireOnIngest(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	doRequest(t, srv, "POST", "/alerts/rules", `{"name": "boiler hot", "field": "tempCo", "op": "gt", "threshold": 70}`)
+	doRequest(t, srv, "POST", "/data", `{"tempCo": 72.5, "tempRoom": 22.0, "humidity": 50.0, "timestamp": 1761388101}`)
+
+	resp := doRequest(t, srv, "GET", "/alerts", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var alerts []store.Alert
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&alerts))
+	require.Len(t, alerts, 1)
+	assert.Equal(t, 1, alerts[0].RuleId)
+	assert.Equal(t, "boiler hot", alerts[0].RuleName)
+	assert.Equal(t, int64(1761388101), alerts[0].Since)
+	assert.Equal(t, 72.5, alerts[0].Value)
+
+	// only the newest reading of a batch is evaluated
+	doRequest(t, srv, "POST", "/data/batch", `[
+		{"tempCo": 60.0, "tempRoom": 22.0, "humidity": 50.0, "timestamp": 1761388221},
+		{"tempCo": 80.0, "tempRoom": 22.0, "humidity": 50.0, "timestamp": 1761388161}
+	]`)
+
+	resp = doRequest(t, srv, "GET", "/alerts", "")
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&alerts))
+	assert.Empty(t, alerts)
+
+	resp = doRequest(t, srv, "GET", "/alerts/history?state=resolved", "")
+	var events []store.AlertEvent
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+	require.Len(t, events, 1)
+	assert.Equal(t, int64(1761388221), events[0].Timestamp)
+
+	resp = doRequest(t, srv, "GET", "/alerts/history?to=1761388200", "")
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+	require.Len(t, events, 1)
+	assert.Equal(t, store.AlertFiring, events[0].State)
+
+	resp = doRequest(t, srv, "GET", "/alerts/history?state=pending", "")
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+}
+
+func TestAlertSilences(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	doRequest(t, srv, "POST", "/alerts/rules", `{"name": "boiler hot", "field": "tempCo", "op": "gt", "threshold": 70}`)
+	doRequest(t, srv, "POST", "/data", `{"tempCo": 72.5, "tempRoom": 22.0, "humidity": 50.0}`)
+
+	resp := doRequest(t, srv, "POST", "/alerts/silences", `{"matchers": [{"name": "rule", "value": "boiler.*", "isRegex": true}], "duration": "48h", "comment": "flapping sensor"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var silence store.Silence
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&silence))
+	assert.Equal(t, int64(48*60*60), silence.EndsAt-silence.StartsAt)
+
+	resp = doRequest(t, srv, "GET", "/alerts", "")
+	var alerts []store.Alert
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&alerts))
+	require.Len(t, alerts, 1)
+	assert.True(t, alerts[0].Silenced)
+
+	resp = doRequest(t, srv, "GET", "/alerts/silences", "")
+	var silences []store.Silence
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&silences))
+	assert.Equal(t, []store.Silence{silence}, silences)
+
+	resp = doRequest(t, srv, "DELETE", fmt.Sprintf("/alerts/silences/%d", silence.Id), "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = doRequest(t, srv, "GET", "/alerts", "")
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&alerts))
+	require.Len(t, alerts, 1)
+	assert.False(t, alerts[0].Silenced)
+
+	resp = doRequest(t, srv, "POST", "/alerts/silences", `{"matchers": [{"name": "rule", "value": "boiler hot"}], "duration": "soon"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	resp = doRequest(t, srv, "POST", "/alerts/silences", `{"matchers": [], "duration": "1h"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+}
+
+func TestAlertAcknowledge(t *testing.T) {
+	st := memory.New()
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, st))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "POST", "/alerts/rules/1/ack", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	doRequest(t, srv, "POST", "/alerts/rules", `{"name": "boiler hot", "field": "tempCo", "op": "gt", "threshold": 70,
+		"escalation": [{"channel": "telegram"}, {"channel": "email", "afterSeconds": 900}]}`)
+	doRequest(t, srv, "POST", "/data", `{"tempCo": 72.5, "tempRoom": 22.0, "humidity": 50.0}`)
+
+	resp = doRequest(t, srv, "GET", "/alerts/ack/not-a-token", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	firing, err := st.ListFiringAlerts(t.Context())
+	require.NoError(t, err)
+	require.Len(t, firing, 1)
+	resp = doRequest(t, srv, "GET", "/alerts/ack/"+firing[0].AckToken, "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, srv, "POST", "/alerts/rules/1/ack", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var a store.Alert
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&a))
+	assert.NotNil(t, a.AckedAt)
+
+	resp = doRequest(t, srv, "GET", "/alerts/history?state=acknowledged", "")
+	var events []store.AlertEvent
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&events))
+	assert.Len(t, events, 1, "acknowledging twice records one event")
+}
+
+func TestAlertFeed(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	now := time.Now().Unix()
+	doRequest(t, srv, "POST", "/alerts/rules", `{"name": "boiler hot", "field": "tempCo", "op": "gt", "threshold": 70}`)
+	doRequest(t, srv, "POST", "/data", fmt.Sprintf(`{"tempCo": 72.5, "tempRoom": 22.0, "humidity": 50.0, "timestamp": %d}`, now-7200))
+	doRequest(t, srv, "POST", "/data", fmt.Sprintf(`{"tempCo": 60.0, "tempRoom": 22.0, "humidity": 50.0, "timestamp": %d}`, now-3600))
+
+	resp := doRequest(t, srv, "GET", "/alerts/feed.atom", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/atom+xml; charset=utf-8", resp.Header.Get("Content-Type"))
+	var feed atomFeed
+	require.NoError(t, xml.NewDecoder(resp.Body).Decode(&feed))
+	titles := make([]string, len(feed.Entries))
+	for i, e := range feed.Entries {
+		titles[i] = e.Title
+	}
+	// newest first: offline since the last reading, back online after the
+	// gap, resolved and firing
+	assert.Equal(t, []string{
+		"Offline: unnamed device",
+		"Resolved: boiler hot (60)",
+		"Back online: unnamed device after 1h0m0s",
+		"Firing: boiler hot (72.5)",
+	}, titles)
+	assert.Equal(t, "urn:esp8266-web:alert-event:1", feed.Entries[3].ID)
+	assert.Equal(t, fmt.Sprintf("urn:esp8266-web:offline::%d", now-3600), feed.Entries[0].ID)
+	assert.Equal(t, "alert-resolved", feed.Entries[1].Category.Term)
+
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+	req, err := http.NewRequest("GET", srv.URL+"/alerts/feed.atom", nil)
+	require.NoError(t, err)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	req.Header.Del("If-None-Match")
+	req.Header.Set("If-Modified-Since", time.Now().UTC().Format(http.TimeFormat))
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	req.Header.Set("If-Modified-Since", time.Unix(now-86400, 0).UTC().Format(http.TimeFormat))
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestAlertRulesExport(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "POST", "/alerts/rules", `{"name": "boiler hot", "field": "tempCo", "op": "gt", "threshold": 70, "escalation": [{"channel": "telegram"}]}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = doRequest(t, srv, "GET", "/alerts/rules/prometheus.yml", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/yaml", resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "expr: esp8266_temp_co_celsius > 70\n")
+
+	resp = doRequest(t, srv, "GET", "/alerts/rules/alertmanager.yml", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "- receiver: telegram\n")
+
+	assert.Equal(t, http.StatusMethodNotAllowed, doRequest(t, srv, "POST", "/alerts/rules/prometheus.yml", "").StatusCode)
+}
+
+func TestDeadLetters(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	// no channel is configured, so the notification is kept as a dead letter
+	require.Equal(t, http.StatusCreated, doRequest(t, srv, "POST", "/alerts/rules", `{"name": "boiler hot", "field": "tempCo", "op": "gt", "threshold": 70,
+		"severity": "critical", "escalation": [{"channel": "telegram"}]}`).StatusCode)
+	require.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/data", `{"tempCo": 72.5, "tempRoom": 22.0, "humidity": 50.0}`).StatusCode)
+
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "wrong", "GET", "/admin/notifications/dead-letters", "").StatusCode)
+	resp := doRequest(t, srv, "GET", "/admin/notifications/dead-letters", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var letters []store.DeadLetter
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&letters))
+	require.Len(t, letters, 1)
+	assert.Equal(t, "telegram", letters[0].Channel)
+	assert.Equal(t, "boiler hot", letters[0].RuleName)
+	assert.Equal(t, "[critical] boiler hot firing", letters[0].Subject)
+
+	path := fmt.Sprintf("/admin/notifications/dead-letters/%d", letters[0].Id)
+	assert.Equal(t, http.StatusConflict, doRequest(t, srv, "POST", path+"/replay", "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, doRequest(t, srv, "POST", "/admin/notifications/dead-letters/999/replay", "").StatusCode)
+	assert.Equal(t, http.StatusNoContent, doRequest(t, srv, "DELETE", path, "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, doRequest(t, srv, "DELETE", path, "").StatusCode)
+}
+
+func TestDeadLettersNotSupported(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, struct{ store.Store }{memory.New()}))
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusNotImplemented, doRequest(t, srv, "GET", "/admin/notifications/dead-letters", "").StatusCode)
+}
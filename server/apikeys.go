@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// API key scopes. ScopeAdmin includes the others; ScopeWrite doesn't
+// include ScopeRead, so a device's key can't read the data back.
+const (
+	// ScopeRead allows GET requests, only checked with
+	// Config.RequireReadKey.
+	ScopeRead = "read"
+	// ScopeWrite allows sending readings and polling device commands.
+	ScopeWrite = "write"
+	// ScopeAdmin allows everything else, e.g. managing alert rules, zones
+	// and labels.
+	ScopeAdmin = "admin"
+)
+
+// Scopes lists the API key scopes.
+var Scopes = []string{ScopeRead, ScopeWrite, ScopeAdmin}
+
+// APIKey is a named key accepted in the X-Secret-Key header for its scopes
+// only, unlike the secret key, which has them all. The config gives either
+// the key or its bcrypt hash, see HashKey.
+type APIKey struct {
+	Name   string   `yaml:"name" json:"name"`
+	Key    string   `yaml:"key" json:"key"`
+	Hash   string   `yaml:"hash" json:"hash"`
+	Scopes []string `yaml:"scopes" json:"scopes"`
+}
+
+// Allows reports whether the key has scope, directly or through
+// ScopeAdmin.
+func (k APIKey) Allows(scope string) bool {
+	return slices.Contains(k.Scopes, scope) || slices.Contains(k.Scopes, ScopeAdmin)
+}
+
+// ValidateAPIKeys checks that every key is named uniquely, at least
+// minKeyLength long or a bcrypt hash and has known scopes.
+func ValidateAPIKeys(keys []APIKey) error {
+	var errs []error
+	names := make(map[string]bool, len(keys))
+	for i, k := range keys {
+		switch {
+		case k.Name == "":
+			errs = append(errs, fmt.Errorf("key %d: name is required", i))
+		case names[k.Name]:
+			errs = append(errs, fmt.Errorf("key %s: duplicate name", k.Name))
+		}
+		names[k.Name] = true
+		switch {
+		case k.Key != "" && k.Hash != "":
+			errs = append(errs, fmt.Errorf("key %s: key and hash are exclusive", k.Name))
+		case k.Hash != "":
+			if _, err := bcrypt.Cost([]byte(k.Hash)); err != nil {
+				errs = append(errs, fmt.Errorf("key %s: hash is not a bcrypt hash", k.Name))
+			}
+		case len(k.Key) < minKeyLength:
+			errs = append(errs, fmt.Errorf("key %s: key must be at least %d characters", k.Name, minKeyLength))
+		}
+		if len(k.Scopes) == 0 {
+			errs = append(errs, fmt.Errorf("key %s: scopes are required", k.Name))
+		}
+		for _, scope := range k.Scopes {
+			if !slices.Contains(Scopes, scope) {
+				errs = append(errs, fmt.Errorf("key %s: unknown scope %q", k.Name, scope))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *server) apiKeys() []APIKey {
+	if s.cfg.APIKeysFunc != nil {
+		return s.cfg.APIKeysFunc()
+	}
+	return s.cfg.APIKeys
+}
+
+// acceptedKeys returns the keys allowed scope: the secret keys, the
+// current one first, and the API keys with the scope that aren't hashed.
+func (s *server) acceptedKeys(scope string) []string {
+	keys := s.secretKeys()
+	for _, k := range s.apiKeys() {
+		if k.Key != "" && k.Allows(scope) {
+			keys = append(keys, k.Key)
+		}
+	}
+	return keys
+}
+
+// secretKeyName names the secret key where keys are named, e.g. in the
+// feature flag changes.
+const secretKeyName = "secret-key"
+
+// requestKey is a key a request was sent with.
+type requestKey struct {
+	name string
+	// device is the device a provisioned key is bound to, empty for a key
+	// not bound to one.
+	device string
+}
+
+// resolveKey returns key when it is allowed scope, named secretKeyName for
+// a secret key or after the API key.
+func (s *server) resolveKey(ctx context.Context, key, scope string) (requestKey, bool) {
+	for _, k := range s.secretKeys() {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			return requestKey{name: secretKeyName}, true
+		}
+	}
+	for _, k := range s.apiKeys() {
+		if k.Key != "" && k.Allows(scope) && subtle.ConstantTimeCompare([]byte(key), []byte(k.Key)) == 1 {
+			return requestKey{name: k.Name}, true
+		}
+	}
+	return s.resolveHashedKey(ctx, key, scope)
+}
+
+// keyName returns the name of key when it is allowed scope, see
+// resolveKey.
+func (s *server) keyName(ctx context.Context, key, scope string) (string, bool) {
+	k, ok := s.resolveKey(ctx, key, scope)
+	return k.name, ok
+}
+
+// keyDevice returns the device the key r was sent with is bound to: the
+// device of the payload key the body was sealed with, or of the provisioned
+// key in X-Secret-Key. It is empty for a key not bound to a device.
+func (s *server) keyDevice(r *http.Request) string {
+	if device := payloadDevice(r.Context()); device != "" {
+		return device
+	}
+	k, _ := s.resolveKey(r.Context(), r.Header.Get("X-Secret-Key"), ScopeWrite)
+	return k.device
+}
+
+// keyAllowsDevice reports whether the key r was sent with may act for
+// device: a key bound to a device may only act for its own.
+func (s *server) keyAllowsDevice(r *http.Request, device string) bool {
+	bound := s.keyDevice(r)
+	return bound == "" || bound == device
+}
+
+// validKey reports whether key is allowed scope.
+func (s *server) validKey(ctx context.Context, key, scope string) bool {
+	_, ok := s.keyName(ctx, key, scope)
+	return ok
+}
+
+// requireRead rejects GET requests without a key allowed ScopeRead when
+// Config.RequireReadKey is set; on tokenPaths a read token will do, which
+// is then in the request context. Other methods are authorized by the
+// handlers.
+func (s *server) requireRead(h http.HandlerFunc) http.HandlerFunc {
+	if !s.cfg.RequireReadKey {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || s.authorized(r, ScopeRead) {
+			h(w, r)
+			return
+		}
+		if slices.Contains(tokenPaths, r.URL.Path) {
+			if t, ok := s.requestToken(r); ok {
+				h(w, r.WithContext(context.WithValue(r.Context(), readTokenKey{}, t)))
+				return
+			}
+		}
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}
+}
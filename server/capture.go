@@ -0,0 +1,493 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bartosz121/esp8266-web/ingest"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const (
+	// DefaultCaptureSize is how many requests a capture keeps unless asked
+	// otherwise.
+	DefaultCaptureSize = 50
+	// maxCaptureSize is the most requests a capture keeps.
+	maxCaptureSize = 500
+	// DefaultCaptureTTL is how long a capture records unless asked
+	// otherwise.
+	DefaultCaptureTTL = time.Hour
+	// maxCaptureTTL is the longest a capture records, so a forgotten one
+	// stops by itself.
+	maxCaptureTTL = 24 * time.Hour
+	// maxCapturedBody is how much of a request or response body is kept.
+	maxCapturedBody = 16 << 10
+)
+
+// redactedHeaders carry secrets, their values aren't captured.
+var redactedHeaders = []string{"X-Secret-Key", "Authorization", "Cookie", ingest.DefaultSecretHeader, ingest.DefaultSignatureHeader}
+
+// redactedParams are the query parameters and body fields carrying
+// secrets, matched case-insensitively, e.g. the key of the legacy /ingest.
+var redactedParams = []string{"key", "token", "secret", "password", "api_key", "apikey", "access_token"}
+
+// Capture records the requests a device sends to the ingest endpoints and
+// the responses, to debug firmware remotely.
+type Capture struct {
+	// Target is the device, matched against the device a request names in
+	// its body or key, or the IP address requests come from.
+	Target    string `json:"target"`
+	Size      int    `json:"size"`
+	StartedAt int64  `json:"startedAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+	// Captured is how many requests are kept.
+	Captured int `json:"captured"`
+	// Requests are the captured requests, oldest first, only returned for
+	// a single capture.
+	Requests []CapturedRequest `json:"requests,omitempty"`
+}
+
+// CapturedRequest is a captured request and its response. Bodies that
+// aren't UTF-8, e.g. gzipped or encrypted ones, are base64-encoded.
+type CapturedRequest struct {
+	Time   int64  `json:"time"`
+	Method string `json:"method"`
+	// URL is the path and query, secrets redacted.
+	URL    string `json:"url"`
+	Remote string `json:"remote"`
+	// Headers are the request headers, secrets redacted.
+	Headers           map[string]string `json:"headers"`
+	Body              string            `json:"body"`
+	BodyBase64        bool              `json:"bodyBase64,omitempty"`
+	BodyTruncated     bool              `json:"bodyTruncated,omitempty"`
+	Status            int               `json:"status"`
+	ResponseHeaders   map[string]string `json:"responseHeaders"`
+	Response          string            `json:"response"`
+	ResponseBase64    bool              `json:"responseBase64,omitempty"`
+	ResponseTruncated bool              `json:"responseTruncated,omitempty"`
+	DurationMs        float64           `json:"durationMs"`
+}
+
+type CapturePayload struct {
+	Size int    `json:"size"`
+	TTL  string `json:"ttl"`
+}
+
+// captures holds the captures by target, in memory only.
+type captures struct {
+	mu       sync.Mutex
+	captures map[string]*Capture
+}
+
+func (c *captures) start(target string, size int, ttl time.Duration) Capture {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.captures == nil {
+		c.captures = make(map[string]*Capture)
+	}
+	now := time.Now()
+	capture := &Capture{Target: target, Size: size, StartedAt: now.Unix(), ExpiresAt: now.Add(ttl).Unix()}
+	c.captures[target] = capture
+	return *capture
+}
+
+func (c *captures) stop(target string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.captures[target]
+	delete(c.captures, target)
+	return ok
+}
+
+// list returns the captures by target, without their requests.
+func (c *captures) list() []Capture {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := make([]Capture, 0, len(c.captures))
+	for _, target := range slices.Sorted(maps.Keys(c.captures)) {
+		capture := *c.captures[target]
+		capture.Requests = nil
+		list = append(list, capture)
+	}
+	return list
+}
+
+func (c *captures) get(target string) (Capture, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	capture, ok := c.captures[target]
+	if !ok {
+		return Capture{}, false
+	}
+	cp := *capture
+	cp.Requests = slices.Clone(capture.Requests)
+	if cp.Requests == nil {
+		cp.Requests = []CapturedRequest{}
+	}
+	return cp, true
+}
+
+// recording returns the targets recording at now.
+func (c *captures) recording(now time.Time) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var targets []string
+	for target, capture := range c.captures {
+		if now.Unix() < capture.ExpiresAt {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// record adds req to the capture of target, dropping the oldest request
+// when it is full.
+func (c *captures) record(target string, req CapturedRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	capture, ok := c.captures[target]
+	if !ok {
+		return
+	}
+	capture.Requests = append(capture.Requests, req)
+	if len(capture.Requests) > capture.Size {
+		capture.Requests = slices.Delete(capture.Requests, 0, len(capture.Requests)-capture.Size)
+	}
+	capture.Captured = len(capture.Requests)
+}
+
+// capture records the requests of the devices being captured and the
+// responses. It reads the body only while a capture is recording.
+func (s *server) capture(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		targets := s.captures.recording(start)
+		if len(targets) == 0 {
+			h(w, r)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, s.cfg.MaxBodyBytes+1))
+		if err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		target, ok := s.captureTarget(r, body, targets)
+		if !ok {
+			h(w, r)
+			return
+		}
+
+		// the handlers change the headers, e.g. when decompressing
+		headers := s.redactedHeaders(r.Header)
+		rec := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r)
+
+		req := CapturedRequest{
+			Time:            start.Unix(),
+			Method:          r.Method,
+			URL:             redactedURL(r),
+			Remote:          r.RemoteAddr,
+			Headers:         headers,
+			Status:          rec.status,
+			ResponseHeaders: flatHeaders(rec.Header()),
+			DurationMs:      float64(time.Since(start).Microseconds()) / 1000,
+		}
+		req.Body, req.BodyBase64, req.BodyTruncated = capturedBody(redactedBody(r.Header.Get("Content-Type"), body))
+		req.Response, req.ResponseBase64, req.ResponseTruncated = capturedBody(rec.body.Bytes())
+		req.ResponseTruncated = req.ResponseTruncated || rec.truncated
+		s.captures.record(target, req)
+		slogctx.FromCtx(r.Context()).Debug("Captured request", slog.String("target", target), slog.Int("status", rec.status))
+	}
+}
+
+// captureTarget returns the target of targets r is captured for: the
+// device of its payload key, the device its body names, the name or device
+// of its key or its IP address.
+func (s *server) captureTarget(r *http.Request, body []byte, targets []string) (string, bool) {
+	var candidates []string
+	if id := r.Header.Get(PayloadKeyHeader); id != "" {
+		for _, k := range s.payloadKeys() {
+			if k.ID == id {
+				candidates = append(candidates, k.Device)
+			}
+		}
+	}
+	var named struct {
+		Device string `json:"device"`
+	}
+	if json.Unmarshal(body, &named) == nil && named.Device != "" {
+		candidates = append(candidates, named.Device)
+	}
+	if key, ok := s.resolveKey(r.Context(), requestSecret(r, body), ScopeWrite); ok {
+		candidates = append(candidates, key.name)
+		if key.device != "" {
+			candidates = append(candidates, key.device)
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		candidates = append(candidates, host)
+	}
+	for _, c := range candidates {
+		if slices.Contains(targets, c) {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// requestSecret returns the key r is sent with, in X-Secret-Key or, as
+// old sketches send it to the legacy /ingest, the key parameter of the
+// query or form body.
+func requestSecret(r *http.Request, body []byte) string {
+	if key := r.Header.Get("X-Secret-Key"); key != "" {
+		return key
+	}
+	params := r.URL.Query()
+	if isForm(r.Header.Get("Content-Type")) {
+		if form, err := url.ParseQuery(string(body)); err == nil {
+			maps.Copy(params, form)
+		}
+	}
+	for _, name := range legacyFields.key {
+		if key := params.Get(name); key != "" {
+			return key
+		}
+	}
+	return ""
+}
+
+// redactedHeaders returns the first value of every header, those carrying
+// secrets, including the configured webhook headers, replaced.
+func (s *server) redactedHeaders(h http.Header) map[string]string {
+	redacted := slices.Clone(redactedHeaders)
+	for _, wh := range s.webhooks() {
+		if wh.Header != "" {
+			redacted = append(redacted, wh.Header)
+		}
+	}
+	headers := flatHeaders(h)
+	for name := range headers {
+		if slices.ContainsFunc(redacted, func(r string) bool { return strings.EqualFold(r, name) }) {
+			headers[name] = "***"
+		}
+	}
+	return headers
+}
+
+func flatHeaders(h http.Header) map[string]string {
+	flat := make(map[string]string, len(h))
+	for name, values := range h {
+		if len(values) > 0 {
+			flat[name] = values[0]
+		}
+	}
+	return flat
+}
+
+func redactedParam(name string) bool {
+	return slices.ContainsFunc(redactedParams, func(p string) bool { return strings.EqualFold(p, name) })
+}
+
+// redactValues replaces the values of the parameters carrying secrets and
+// reports whether there were any.
+func redactValues(v url.Values) bool {
+	redacted := false
+	for name := range v {
+		if redactedParam(name) {
+			v[name] = []string{"***"}
+			redacted = true
+		}
+	}
+	return redacted
+}
+
+// redactedURL returns the path and query of r, the parameters carrying
+// secrets replaced.
+func redactedURL(r *http.Request) string {
+	q := r.URL.Query()
+	if redactValues(q) {
+		return r.URL.Path + "?" + q.Encode()
+	}
+	return r.URL.RequestURI()
+}
+
+func isForm(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/x-www-form-urlencoded"
+}
+
+// redactedBody returns body with the fields carrying secrets replaced, of a
+// form or of the JSON objects in it. Other bodies, e.g. compressed ones,
+// are returned as they are.
+func redactedBody(contentType string, body []byte) []byte {
+	if isForm(contentType) {
+		form, err := url.ParseQuery(string(body))
+		if err == nil && redactValues(form) {
+			return []byte(form.Encode())
+		}
+		return body
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if dec.Decode(&v) != nil || dec.More() || !redactJSON(v) {
+		return body
+	}
+	redacted, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return redacted
+}
+
+// redactJSON replaces the fields carrying secrets in the objects of v and
+// reports whether there were any.
+func redactJSON(v any) bool {
+	redacted := false
+	switch v := v.(type) {
+	case map[string]any:
+		for name, field := range v {
+			if _, isString := field.(string); isString && redactedParam(name) {
+				v[name] = "***"
+				redacted = true
+			} else if redactJSON(field) {
+				redacted = true
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if redactJSON(item) {
+				redacted = true
+			}
+		}
+	}
+	return redacted
+}
+
+// capturedBody returns up to maxCapturedBody of b, base64-encoded unless
+// it is UTF-8.
+func capturedBody(b []byte) (body string, base64Encoded, truncated bool) {
+	if len(b) > maxCapturedBody {
+		b, truncated = b[:maxCapturedBody], true
+	}
+	if utf8.Valid(b) {
+		return string(b), false, truncated
+	}
+	return base64.StdEncoding.EncodeToString(b), true, truncated
+}
+
+// captureWriter keeps the start of a response body.
+type captureWriter struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (cw *captureWriter) WriteHeader(code int) {
+	cw.status = code
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	if room := maxCapturedBody - cw.body.Len(); room < len(b) {
+		cw.body.Write(b[:max(room, 0)])
+		cw.truncated = true
+	} else {
+		cw.body.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// capturesHandler lists the captures.
+func (s *server) capturesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.captures.list())
+}
+
+// captureHandler starts, returns and stops the capture of a target.
+func (s *server) captureHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	target := r.PathValue("target")
+	switch r.Method {
+	case http.MethodGet:
+		capture, ok := s.captures.get(target)
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(capture)
+
+	case http.MethodPut:
+		var p CapturePayload
+		if err := decodeBody(r, &p); err != nil {
+			writeDecodeError(w, err)
+			return
+		}
+		size := DefaultCaptureSize
+		if p.Size != 0 {
+			if p.Size < 0 || p.Size > maxCaptureSize {
+				http.Error(w, "Bad request: size must be between 1 and 500", http.StatusUnprocessableEntity)
+				return
+			}
+			size = p.Size
+		}
+		ttl := DefaultCaptureTTL
+		if p.TTL != "" {
+			d, err := time.ParseDuration(p.TTL)
+			if err != nil || d <= 0 || d > maxCaptureTTL {
+				http.Error(w, "Bad request: ttl must be a duration up to 24h", http.StatusUnprocessableEntity)
+				return
+			}
+			ttl = d
+		}
+		capture := s.captures.start(target, size, ttl)
+		logger.Info("Started capturing requests", slog.String("target", target), slog.Int("size", size), slog.Duration("ttl", ttl))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(capture)
+
+	case http.MethodDelete:
+		if !s.captures.stop(target) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		logger.Info("Stopped capturing requests", slog.String("target", target))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptures(t *testing.T) {
+	st := memory.New()
+	srv := httptest.NewServer(NewServer(Config{
+		SecretKey: "testsecret",
+		APIKeys:   []APIKey{{Name: "attic", Key: "attic-key-0123456789", Scopes: []string{ScopeWrite}}},
+	}, st))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "PUT", "/admin/captures/attic", `{"size": 2, "ttl": "10m"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var capture Capture
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&capture))
+	assert.Equal(t, "attic", capture.Target)
+	assert.Equal(t, 2, capture.Size)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "attic-key-0123456789", "PUT", "/admin/captures/boiler", `{}`).StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "PUT", "/admin/captures/boiler", `{"ttl": "48h"}`).StatusCode)
+
+	// requests naming the device in the body or by their key are captured,
+	// also when they are rejected
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "wrong", "POST", "/sync", `{"device": "attic", "readings": [{"seq": 1}]}`).StatusCode)
+	assert.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/sync", `{"device": "boiler", "readings": [{"seq": 1}]}`).StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequestWithKey(t, srv, "attic-key-0123456789", "POST", "/data", `{"tempCo": "hot"}`).StatusCode)
+	assert.Equal(t, http.StatusOK, doRequestWithKey(t, srv, "attic-key-0123456789", "POST", "/data", `{"tempCo": 40}`).StatusCode)
+
+	resp = doRequest(t, srv, "GET", "/admin/captures/attic", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&capture))
+	assert.Equal(t, 2, capture.Captured)
+	require.Len(t, capture.Requests, 2, "the oldest request is dropped")
+	rejected := capture.Requests[0]
+	assert.Equal(t, "/data", rejected.URL)
+	assert.Equal(t, `{"tempCo": "hot"}`, rejected.Body)
+	assert.Equal(t, "***", rejected.Headers["X-Secret-Key"])
+	assert.Equal(t, http.StatusUnprocessableEntity, rejected.Status)
+	assert.Contains(t, rejected.Response, "Bad request")
+	assert.Equal(t, http.StatusOK, capture.Requests[1].Status)
+
+	resp = doRequest(t, srv, "GET", "/admin/captures", "")
+	var captures []Capture
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&captures))
+	require.Len(t, captures, 1)
+	assert.Nil(t, captures[0].Requests)
+
+	assert.Equal(t, http.StatusNoContent, doRequest(t, srv, "DELETE", "/admin/captures/attic", "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, doRequest(t, srv, "GET", "/admin/captures/attic", "").StatusCode)
+}
+
+func TestCapturesRedacted(t *testing.T) {
+	hash, err := HashKey("boiler-key-0123456789")
+	require.NoError(t, err)
+	st := memory.New()
+	srv := httptest.NewServer(NewServer(Config{
+		SecretKey:    "testsecret",
+		APIKeys:      []APIKey{{Name: "boiler", Hash: hash, Scopes: []string{ScopeWrite}}},
+		LegacyIngest: true,
+	}, st))
+	defer srv.Close()
+
+	require.Equal(t, http.StatusOK, doRequest(t, srv, "PUT", "/admin/captures/boiler", `{}`).StatusCode)
+
+	// a hashed key is matched by its name, also sent as the key parameter
+	// of the legacy /ingest, and never recorded
+	resp, err := http.Get(srv.URL + "/ingest?t1=25.5&t2=22.0&key=boiler-key-0123456789")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, err = http.PostForm(srv.URL+"/ingest", url.Values{"t1": {"25.5"}, "t2": {"22.0"}, "key": {"boiler-key-0123456789"}})
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, http.StatusOK, doRequestWithKey(t, srv, "boiler-key-0123456789", "POST", "/sync", `{"device": "boiler", "key": "boiler-key-0123456789", "readings": []}`).StatusCode)
+
+	resp = doRequest(t, srv, "GET", "/admin/captures/boiler", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var capture Capture
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&capture))
+	require.Len(t, capture.Requests, 3)
+	assert.Equal(t, "/ingest?key=%2A%2A%2A&t1=25.5&t2=22.0", capture.Requests[0].URL)
+	assert.Equal(t, "key=%2A%2A%2A&t1=25.5&t2=22.0", capture.Requests[1].Body)
+	assert.JSONEq(t, `{"device": "boiler", "key": "***", "readings": []}`, capture.Requests[2].Body)
+	for _, r := range capture.Requests {
+		assert.NotContains(t, r.URL+r.Body, "boiler-key-0123456789")
+	}
+}
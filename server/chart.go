@@ -0,0 +1,172 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/aggregate"
+	"github.com/bartosz121/esp8266-web/chart"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const (
+	// defaultChartRange is charted when from isn't given.
+	defaultChartRange = 24 * time.Hour
+	// minChartSize and maxChartSize bound the width and height in pixels.
+	minChartSize = 100
+	maxChartSize = 2000
+	// sparklineRange is how far back sparklines reach.
+	sparklineRange = 24 * time.Hour
+	// maxSparklineSize bounds the sparkline width and height in pixels.
+	maxSparklineSize = 1000
+)
+
+// chartHandler renders the readings between from and to as a PNG line
+// chart, for clients that can't run the dashboard. Readings are selected
+// like on GET /data and downsampled to about one per pixel.
+func (s *server) chartHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	opts := chart.Options{Title: q.Get("title"), Location: time.Local}
+	for name, dst := range map[string]*int{"width": &opts.Width, "height": &opts.Height} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < minChartSize || n > maxChartSize {
+				http.Error(w, "Bad request: "+name+" must be between 100 and 2000", http.StatusUnprocessableEntity)
+				return
+			}
+			*dst = n
+		}
+	}
+	if v := q.Get("fields"); v != "" {
+		opts.Fields = strings.Split(v, ",")
+		if err := chart.ValidateFields(opts.Fields); err != nil {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	from, to, ok := parseTimeRange(w, q, defaultChartRange)
+	if !ok {
+		return
+	}
+	if from >= to || to-from > int64(maxUsageRange/time.Second) {
+		http.Error(w, "Bad request: from must be before to and at most 366 days apart", http.StatusUnprocessableEntity)
+		return
+	}
+	opts.From, opts.To = from, to
+
+	list, ok := s.parseSelection(w, r, nil)
+	if !ok {
+		return
+	}
+	readings, err := readingsSince(r.Context(), from, list)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query temperature readings")
+		return
+	}
+	end := len(readings)
+	for end > 0 && *readings[end-1].Timestamp > to {
+		end--
+	}
+	width := opts.Width
+	if width == 0 {
+		width = chart.DefaultWidth
+	}
+
+	var buf bytes.Buffer
+	err = chart.PNG(&buf, aggregate.LTTB(readings[:end], width), opts)
+	if errors.Is(err, chart.ErrNoReadings) {
+		http.Error(w, "Not found: no readings in range", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to render chart", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Write(buf.Bytes())
+}
+
+// sparklineHandler renders the last day of one field as a tiny SVG line to
+// inline in Home Assistant cards or wiki pages. Readings are selected like
+// on GET /data. Responses carry an ETag and may be cached for a minute.
+func (s *server) sparklineHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	field := "tempRoom"
+	if v := q.Get("field"); v != "" {
+		field = v
+	}
+	if err := chart.ValidateFields([]string{field}); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	width, height := chart.SparklineWidth, chart.SparklineHeight
+	for name, dst := range map[string]*int{"width": &width, "height": &height} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 10 || n > maxSparklineSize {
+				http.Error(w, "Bad request: "+name+" must be between 10 and 1000", http.StatusUnprocessableEntity)
+				return
+			}
+			*dst = n
+		}
+	}
+
+	list, ok := s.parseSelection(w, r, nil)
+	if !ok {
+		return
+	}
+	readings, err := readingsSince(r.Context(), time.Now().Add(-sparklineRange).Unix(), list)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query temperature readings")
+		return
+	}
+	var buf bytes.Buffer
+	if err := chart.Sparkline(&buf, aggregate.LTTB(readings, width), field, width, height); err != nil {
+		logger.Error("Failed to render sparkline", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "max-age=60")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Write(buf.Bytes())
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, weakly
+// compared as the header requires.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
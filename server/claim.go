@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const (
+	// DefaultClaimTokenTTL is how long a claim token is valid unless the
+	// request minting it says otherwise, long enough for a printed batch
+	// of boards to be deployed, or Config.KeyGracePeriod when shorter.
+	DefaultClaimTokenTTL = 30 * 24 * time.Hour
+	// maxClaimTokenTTL is the longest a claim token may be valid.
+	maxClaimTokenTTL = 366 * 24 * time.Hour
+)
+
+// claimTokenTTLs returns the default and the longest validity of a claim
+// token. Tokens are signed with the secret key, so neither outlasts
+// Config.KeyGracePeriod, and a token minted right before a rotation can
+// still be claimed with the key rotated out.
+func (s *server) claimTokenTTLs() (def, longest time.Duration) {
+	return min(DefaultClaimTokenTTL, s.cfg.KeyGracePeriod), min(maxClaimTokenTTL, s.cfg.KeyGracePeriod)
+}
+
+// ClaimToken lets a flashed but unregistered device claim the key of the
+// device it describes once, until ExpiresAt.
+type ClaimToken struct {
+	ProvisionDevice
+	ExpiresAt int64 `json:"exp"`
+}
+
+// MintedClaimToken is a signed claim token of a device, e.g. to print as a
+// QR code or flash over serial.
+type MintedClaimToken struct {
+	Name      string `json:"name"`
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// ClaimPayload is what a device sends to claim its credentials.
+type ClaimPayload struct {
+	Token string `json:"token"`
+}
+
+// DeviceConfig is what a claimed device needs to send readings, for it to
+// persist next to its WiFi credentials.
+type DeviceConfig struct {
+	// ServerURL is where the device sends readings, Config.PublicURL.
+	ServerURL string `json:"serverUrl"`
+	Device    string `json:"device"`
+	// Key is the device's write key, only shown when it is claimed.
+	Key string `json:"key"`
+	// ReportInterval is how often the device sends a reading, in seconds.
+	ReportInterval int64 `json:"reportInterval"`
+	// MinFirmware is the oldest firmware version the device should run,
+	// empty when not set.
+	MinFirmware string `json:"minFirmware,omitempty"`
+}
+
+// claimTokensHandler mints a claim token for every device of a manifest,
+// checked like POST /devices/bulk checks it. ?ttl= sets how long they're
+// valid, up to claimTokenTTLs.
+func (s *server) claimTokensHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ks, ok := s.apiKeyStore(w)
+	if !ok {
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	ttl, longest := s.claimTokenTTLs()
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > longest {
+			http.Error(w, "Bad request: ttl must be a duration up to "+longest.String()+", the key grace period", http.StatusUnprocessableEntity)
+			return
+		}
+		ttl = d
+	}
+	devices, err := decodeManifest(r)
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if _, _, ok := s.checkManifest(w, r, ks, devices); !ok {
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl).Unix()
+	minted := make([]MintedClaimToken, 0, len(devices))
+	for _, d := range devices {
+		t := ClaimToken{ProvisionDevice: d, ExpiresAt: expiresAt}
+		minted = append(minted, MintedClaimToken{Name: d.Name, Token: signPayload(t, claimTokenPurpose, s.secretKeys()[0]), ExpiresAt: expiresAt})
+	}
+	logger.Info("Minted claim tokens", slog.Int("count", len(minted)), slog.Int64("expires_at", expiresAt))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(minted)
+}
+
+// claimHandler provisions the device of a claim token, without a key, and
+// answers with its credentials and config. A token is claimed once: the
+// device's key exists afterwards, so claiming again is 409.
+func (s *server) claimHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var p ClaimPayload
+	if err := decodeBody(r, &p); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	s.claim(w, r, p.Token)
+}
+
+// claim provisions the device of token, responding with its DeviceConfig
+// or an error. The server URL given to the device is always the configured
+// one: the Host header is up to the client.
+func (s *server) claim(w http.ResponseWriter, r *http.Request, token string) {
+	logger := slogctx.FromCtx(r.Context())
+
+	ks, ok := s.apiKeyStore(w)
+	if !ok {
+		return
+	}
+	if s.cfg.PublicURL == "" {
+		http.Error(w, "Claiming devices needs the public URL of the server, see --public-url", http.StatusNotImplemented)
+		return
+	}
+	var t ClaimToken
+	if err := verifyPayload(token, claimTokenPurpose, s.secretKeys(), &t); err != nil || time.Now().Unix() >= t.ExpiresAt {
+		logger.Debug("Rejected claim token", "error", err)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	devices := []ProvisionDevice{t.ProvisionDevice}
+	ls, rooms, ok := s.checkManifest(w, r, ks, devices)
+	if !ok {
+		return
+	}
+	key, ok := s.provisionDevice(w, r, ks, ls, t.ProvisionDevice)
+	if !ok || !s.placeDevices(w, r, rooms) {
+		return
+	}
+	logger.Info("Device claimed", slog.String("device", t.Name))
+	w.Header().Set("Content-Type", "application/json")
+	// the key is only shown once
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(DeviceConfig{
+		ServerURL:      strings.TrimSuffix(s.cfg.PublicURL, "/"),
+		Device:         t.Name,
+		Key:            key,
+		ReportInterval: int64(s.cfg.ReportInterval / time.Second),
+		MinFirmware:    s.ingest.MinFirmware(),
+	})
+}
+
+// provisionConfigHandler serves the config of the device of a claim token
+// at GET /provision/{token}/config, for onboarding firmware such as
+// Improv or WiFiManager that can only fetch a URL. It claims the device,
+// so the config is only served once, and never cached.
+func (s *server) provisionConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.claim(w, r, r.PathValue("token"))
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/ingest"
+)
+
+// ClockSkew is how far a device's clock was off when it last sent
+// timestamped readings.
+type ClockSkew struct {
+	Device string `json:"device"`
+	// Skew is in seconds, positive when the device's clock is ahead.
+	Skew int64 `json:"skew"`
+	// At is when it was measured.
+	At int64 `json:"at"`
+}
+
+// clockSkewHandler lists the clock skew of every device known to this
+// replica, by name, optionally only those off by more than ?min=.
+func (s *server) clockSkewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var minSkew time.Duration
+	if v := r.URL.Query().Get("min"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "Bad request: min must be a duration, e.g. 30s", http.StatusUnprocessableEntity)
+			return
+		}
+		minSkew = d
+	}
+	skews := ingest.ClockSkews()
+	devices := make([]ClockSkew, 0, len(skews))
+	for _, device := range slices.Sorted(maps.Keys(skews)) {
+		sk := skews[device]
+		if (time.Duration(sk.Seconds) * time.Second).Abs() < minSkew {
+			continue
+		}
+		devices = append(devices, ClockSkew{Device: device, Skew: sk.Seconds, At: sk.At.Unix()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices)
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClockSkew(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	ahead := time.Now().Unix() + 3600
+	resp := doRequest(t, srv, "POST", "/sync", fmt.Sprintf(`{"device": "skew-ahead", "readings": [{"seq": 1, "tempCo": 40, "tempRoom": 21, "humidity": 50, "timestamp": %d}]}`, ahead))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doRequest(t, srv, "GET", "/devices/clock-skew?min=30m", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var skews []ClockSkew
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&skews))
+	i := slices.IndexFunc(skews, func(s ClockSkew) bool { return s.Device == "skew-ahead" })
+	require.GreaterOrEqual(t, i, 0)
+	assert.InDelta(t, 3600, skews[i].Skew, 5)
+
+	resp = doRequest(t, srv, "GET", "/devices/clock-skew?min=2h", "")
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&skews))
+	assert.False(t, slices.ContainsFunc(skews, func(s ClockSkew) bool { return s.Device == "skew-ahead" }))
+
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/devices/clock-skew?min=soon", "").StatusCode)
+}
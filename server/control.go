@@ -0,0 +1,395 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/control"
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const (
+	defaultZoneHistoryLimit = 50
+	maxZoneHistoryLimit     = 500
+)
+
+// zoneStore returns the zone store, or responds with 501 when the storage
+// backend doesn't support thermostat zones.
+func (s *server) zoneStore(w http.ResponseWriter) (control.Store, bool) {
+	if s.control == nil {
+		http.Error(w, "Thermostat zones are not supported by this storage backend", http.StatusNotImplemented)
+		return nil, false
+	}
+	return s.control.Store(), true
+}
+
+// commandStore returns the command store, or responds with 501 when the
+// storage backend doesn't support the device command queue.
+func (s *server) commandStore(w http.ResponseWriter) (store.CommandStore, bool) {
+	cs, ok := s.store.(store.CommandStore)
+	if !ok {
+		http.Error(w, "Device commands are not supported by this storage backend", http.StatusNotImplemented)
+		return nil, false
+	}
+	return cs, true
+}
+
+func (s *server) zonesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	st, ok := s.zoneStore(w)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		zones, err := st.ListZones(r.Context())
+		if err != nil {
+			writeStoreError(w, logger, err, "Failed to query zones")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(zones)
+
+	case http.MethodPost:
+		if !s.authorized(r, ScopeAdmin) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		zone, ok := decodeZone(w, r)
+		if !ok {
+			return
+		}
+		zone, err := st.CreateZone(r.Context(), zone)
+		if err != nil {
+			writeStoreError(w, logger, err, "Failed to create zone")
+			return
+		}
+		logger.Info("Created zone", slog.Int("id", zone.Id), slog.String("name", zone.Name))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(zone)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) zoneHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	st, ok := s.zoneStore(w)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var zone store.Zone
+	switch r.Method {
+	case http.MethodGet:
+		zone, err = st.GetZone(r.Context(), id)
+
+	case http.MethodPut:
+		if !s.authorized(r, ScopeAdmin) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if zone, ok = decodeZone(w, r); !ok {
+			return
+		}
+		zone.Id = id
+		zone, err = st.UpdateZone(r.Context(), zone)
+
+	case http.MethodDelete:
+		if !s.authorized(r, ScopeAdmin) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if err = st.DeleteZone(r.Context(), id); err == nil {
+			logger.Info("Deleted zone", slog.Int("id", id))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to access zone", "id", id)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(zone)
+}
+
+// decodeZone reads and validates a zone from the request body. Enabled
+// defaults to true when omitted.
+func decodeZone(w http.ResponseWriter, r *http.Request) (store.Zone, bool) {
+	zone := store.Zone{Enabled: true}
+	if err := decodeBody(r, &zone); err != nil {
+		slogctx.FromCtx(r.Context()).Error("failed to decode zone", slog.Any("error", err))
+		writeDecodeError(w, err)
+		return zone, false
+	}
+	if err := control.Validate(&zone); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusUnprocessableEntity)
+		return zone, false
+	}
+	return zone, true
+}
+
+// OverridePayload forces a zone's relay On for Duration, a Go duration such
+// as "2h", or until cleared when it is empty.
+type OverridePayload struct {
+	On       *bool  `json:"on"`
+	Duration string `json:"duration"`
+}
+
+// zoneOverrideHandler sets (PUT) or clears (DELETE) a zone's manual override.
+func (s *server) zoneOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := s.zoneStore(w); !ok {
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var p OverridePayload
+	var until int64
+	if r.Method == http.MethodPut {
+		if err := decodeBody(r, &p); err != nil {
+			logger.Error("failed to decode zone override", slog.Any("error", err))
+			writeDecodeError(w, err)
+			return
+		}
+		if p.On == nil {
+			http.Error(w, "Bad request: on is required", http.StatusUnprocessableEntity)
+			return
+		}
+		if p.Duration != "" {
+			d, err := time.ParseDuration(p.Duration)
+			if err != nil || d <= 0 {
+				http.Error(w, "Bad request: invalid duration", http.StatusUnprocessableEntity)
+				return
+			}
+			until = time.Now().Add(d).Unix()
+		}
+	}
+
+	zone, err := s.control.Override(r.Context(), id, p.On, until)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to override zone", "id", id)
+		return
+	}
+	logger.Info("Zone override changed", slog.Int("id", id), slog.Any("on", p.On), slog.Int64("until", until))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(zone)
+}
+
+func (s *server) zoneHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st, ok := s.zoneStore(w)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	limit, offset := defaultZoneHistoryLimit, 0
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 && l <= maxZoneHistoryLimit {
+		limit = l
+	}
+	if o, err := strconv.Atoi(q.Get("offset")); err == nil && o >= 0 {
+		offset = o
+	}
+
+	events, err := st.ListZoneHistory(r.Context(), id, limit, offset)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query zone history", "id", id)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// commandsHandler lists a device's pending commands; devices poll it.
+func (s *server) commandsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cs, ok := s.commandStore(w)
+	if !ok {
+		return
+	}
+	if !s.authorized(r, ScopeWrite) || !s.keyAllowsDevice(r, r.PathValue("device")) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	commands, err := cs.PendingCommands(r.Context(), r.PathValue("device"))
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query device commands")
+		return
+	}
+	// polls double as heartbeats
+	s.recordFirmware(r, r.PathValue("device"), "")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(commands)
+}
+
+// commandAckHandler is called by a device once it carried out a command.
+func (s *server) commandAckHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cs, ok := s.commandStore(w)
+	if !ok {
+		return
+	}
+	device := r.PathValue("device")
+	if !s.authorized(r, ScopeWrite) || !s.keyAllowsDevice(r, device) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	err = cs.AckCommand(r.Context(), device, id, time.Now().Unix())
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Not found: command is not pending", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to acknowledge device command", "id", id)
+		return
+	}
+	logger.Info("Device command acknowledged", slog.String("device", device), slog.Int64("id", id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Mode is the house mode, "home" or "away" with the away mode settings.
+type Mode struct {
+	Mode string `json:"mode"`
+	*store.AwayMode
+}
+
+// ModePayload sets the away mode until Until, a unix timestamp, holding
+// heating zones at Setpoint, control.DefaultFrostSetpoint when omitted. Mode
+// "home" clears it.
+type ModePayload struct {
+	Mode     string   `json:"mode"`
+	Setpoint *float64 `json:"setpoint"`
+	Until    int64    `json:"until"`
+}
+
+// modeHandler reads (GET), sets (PUT) or clears (DELETE) the away mode.
+func (s *server) modeHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if _, ok := s.zoneStore(w); !ok {
+		return
+	}
+
+	var away *store.AwayMode
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		if away, err = s.control.Away(r.Context()); err != nil {
+			writeStoreError(w, logger, err, "Failed to query away mode")
+			return
+		}
+
+	case http.MethodPut, http.MethodDelete:
+		if !s.authorized(r, ScopeAdmin) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		p := ModePayload{Mode: "home"}
+		if r.Method == http.MethodPut {
+			if err := decodeBody(r, &p); err != nil {
+				logger.Error("failed to decode mode", slog.Any("error", err))
+				writeDecodeError(w, err)
+				return
+			}
+		}
+		now := time.Now().Unix()
+		switch p.Mode {
+		case "home":
+		case "away":
+			if p.Until <= now {
+				http.Error(w, "Bad request: until must be a future unix timestamp", http.StatusUnprocessableEntity)
+				return
+			}
+			away = &store.AwayMode{Setpoint: control.DefaultFrostSetpoint, Since: now, Until: p.Until}
+			if p.Setpoint != nil {
+				away.Setpoint = *p.Setpoint
+			}
+		default:
+			http.Error(w, "Bad request: mode must be home or away", http.StatusUnprocessableEntity)
+			return
+		}
+		if err := s.control.SetAway(r.Context(), away); err != nil {
+			writeStoreError(w, logger, err, "Failed to set away mode")
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mode := Mode{Mode: "home", AwayMode: away}
+	if away != nil {
+		mode.Mode = "away"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mode)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pendingCommands(t *testing.T, srv *httptest.Server, device string) []store.Command {
+	t.Helper()
+	resp := doRequest(t, srv, "GET", "/devices/"+device+"/commands", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var commands []store.Command
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&commands))
+	return commands
+}
+
+func TestZonesAndCommands(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "POST", "/control/zones", `{"name": "living room", "device": "attic", "relayDevice": "boiler", "target": 21, "hysteresis": 0.5}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var zone store.Zone
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&zone))
+	assert.Equal(t, store.Zone{Id: 1, Name: "living room", Device: "attic", RelayDevice: "boiler", Field: "tempRoom", Target: 21, Hysteresis: 0.5, Mode: "heat", Enabled: true}, zone)
+
+	resp = doRequest(t, srv, "POST", "/control/zones", `{"name": "no relay", "target": 21}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp = doRequest(t, srv, "POST", "/sync", `{"device": "attic", "readings": [{"seq": 1, "tempRoom": 19.5}]}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	commands := pendingCommands(t, srv, "boiler")
+	require.Len(t, commands, 1)
+	assert.Equal(t, "relay", commands[0].Type)
+	assert.Equal(t, "on", commands[0].Value)
+
+	resp = doRequest(t, srv, "POST", "/devices/boiler/commands/1/ack", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = doRequest(t, srv, "POST", "/devices/boiler/commands/1/ack", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Empty(t, pendingCommands(t, srv, "boiler"))
+
+	resp = doRequest(t, srv, "PUT", "/control/zones/1/override", `{"on": false, "duration": "1h"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&zone))
+	require.NotNil(t, zone.Override)
+	assert.False(t, *zone.Override)
+	assert.NotZero(t, zone.OverrideUntil)
+	commands = pendingCommands(t, srv, "boiler")
+	require.Len(t, commands, 1)
+	assert.Equal(t, "off", commands[0].Value)
+
+	resp = doRequest(t, srv, "PUT", "/control/zones/1/override", `{"duration": "1h"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	resp = doRequest(t, srv, "DELETE", "/control/zones/1/override", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, srv, "DELETE", "/control/zones/2/override", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = doRequest(t, srv, "GET", "/control/zones/1/history", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var history []store.ZoneEvent
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&history))
+	assert.Len(t, history, 4)
+
+	resp = doRequest(t, srv, "PUT", "/control/zones/1", `{"name": "living room", "device": "attic", "target": 22}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&zone))
+	assert.Equal(t, "attic", zone.RelayDevice)
+	require.NotNil(t, zone.Relay)
+	assert.False(t, *zone.Relay)
+
+	resp = doRequest(t, srv, "DELETE", "/control/zones/1", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = doRequest(t, srv, "GET", "/control/zones/1", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestCommandsRequireAuth(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/devices/boiler/commands")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestModeHandler(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	decode := func(resp *http.Response) Mode {
+		t.Helper()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var m Mode
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&m))
+		return m
+	}
+	assert.Equal(t, Mode{Mode: "home"}, decode(doRequest(t, srv, "GET", "/control/mode", "")))
+
+	until := time.Now().Add(24 * time.Hour).Unix()
+	m := decode(doRequest(t, srv, "PUT", "/control/mode", fmt.Sprintf(`{"mode": "away", "until": %d}`, until)))
+	assert.Equal(t, "away", m.Mode)
+	require.NotNil(t, m.AwayMode)
+	assert.Equal(t, 7.0, m.Setpoint)
+	assert.Equal(t, until, m.Until)
+	assert.Equal(t, "away", decode(doRequest(t, srv, "GET", "/control/mode", "")).Mode)
+
+	resp := doRequest(t, srv, "PUT", "/control/mode", `{"mode": "away", "until": 1}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	resp = doRequest(t, srv, "PUT", "/control/mode", `{"mode": "party"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	assert.Equal(t, Mode{Mode: "home"}, decode(doRequest(t, srv, "DELETE", "/control/mode", "")))
+	assert.Equal(t, Mode{Mode: "home"}, decode(doRequest(t, srv, "GET", "/control/mode", "")))
+}
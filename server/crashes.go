@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/alert"
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const (
+	defaultCrashesLimit = 50
+	maxCrashesLimit     = 500
+)
+
+var crashesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "esp8266_device_crashes_total",
+	Help: "Crash reports received, by device and reset reason.",
+}, []string{"device", "reason"})
+
+// CrashPayload is what a device reports after restarting, e.g. from
+// ESP.getResetReason(), ESP.getResetInfoPtr()->exccause and the stack dump
+// saved by a custom_crash_callback.
+type CrashPayload struct {
+	Reason    string `json:"reason"`
+	Exception *int   `json:"exception"`
+	Stack     string `json:"stack"`
+	Firmware  string `json:"firmware"`
+}
+
+// crashStore returns the crash store, or responds with 501 when the storage
+// backend doesn't keep crash reports.
+func (s *server) crashStore(w http.ResponseWriter) (store.CrashStore, bool) {
+	cs, ok := s.store.(store.CrashStore)
+	if !ok {
+		http.Error(w, "Crash reports are not supported by this storage backend", http.StatusNotImplemented)
+		return nil, false
+	}
+	return cs, true
+}
+
+// crashHandler stores a device's crash report and evaluates the reboots
+// alert rules against its reports of the last hour.
+func (s *server) crashHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	cs, ok := s.crashStore(w)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	device := r.PathValue("device")
+	if !s.authorized(r, ScopeWrite) || !s.keyAllowsDevice(r, device) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var p CrashPayload
+	if err := decodeBody(r, &p); err != nil {
+		logger.Error("failed to decode crash report", slog.Any("error", err))
+		writeDecodeError(w, err)
+		return
+	}
+	if strings.TrimSpace(p.Reason) == "" {
+		http.Error(w, "Bad request: reason is required", http.StatusUnprocessableEntity)
+		return
+	}
+	now := time.Now()
+	c, err := cs.AddCrashReport(r.Context(), store.CrashReport{Device: device, Reason: p.Reason, Exception: p.Exception, Stack: p.Stack, Firmware: p.Firmware, At: now.Unix()})
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to store crash report", "device", device)
+		return
+	}
+	crashesTotal.WithLabelValues(device, p.Reason).Inc()
+	s.recordFirmware(r, device, p.Firmware)
+	logger.Warn("Device crashed", slog.String("device", device), slog.String("reason", p.Reason), slog.Any("exception", p.Exception))
+
+	// failures are logged; the report is already stored
+	if s.alerts != nil {
+		if n, err := cs.CountCrashReports(r.Context(), device, now.Add(-alert.RebootWindow).Unix()); err != nil {
+			logger.Error("Failed to count crash reports", "device", device, "error", err)
+		} else if err := s.alerts.EvaluateReboots(r.Context(), device, n, c.At); err != nil {
+			logger.Error("Failed to evaluate reboots alert rules", "device", device, "error", err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// crashesHandler lists a device's crash reports, newest first.
+func (s *server) crashesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	cs, ok := s.crashStore(w)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := defaultCrashesLimit
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= maxCrashesLimit {
+		limit = l
+	}
+	device := r.PathValue("device")
+	reports, err := cs.ListCrashReports(r.Context(), device, limit)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query crash reports", "device", device)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
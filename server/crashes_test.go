@@ -0,0 +1,60 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCrashReports(t *testing.T) {
+	st := memory.New()
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, st))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "POST", "/alerts/rules", `{"name": "crash loop", "field": "reboots", "op": "gt", "threshold": 1}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	crash := `{"reason": "Exception", "exception": 28, "stack": ">>>stack>>>\n3ffffdc0: 40201c4d\n<<<stack<<<", "firmware": "1.2.0"}`
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "wrong", "POST", "/devices/attic/crash", crash).StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "POST", "/devices/attic/crash", `{"stack": ""}`).StatusCode)
+	resp = doRequest(t, srv, "POST", "/devices/attic/crash", crash)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var c store.CrashReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&c))
+	assert.Equal(t, "attic", c.Device)
+	assert.Equal(t, 28, *c.Exception)
+
+	firing, err := st.ListFiringAlerts(t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, firing)
+	require.Equal(t, http.StatusCreated, doRequest(t, srv, "POST", "/devices/attic/crash", `{"reason": "Hardware Watchdog"}`).StatusCode)
+	firing, err = st.ListFiringAlerts(t.Context())
+	require.NoError(t, err)
+	require.Len(t, firing, 1)
+	assert.Equal(t, "attic", firing[0].Device)
+
+	resp = doRequest(t, srv, "GET", "/devices/attic/crashes?limit=1", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var reports []store.CrashReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&reports))
+	require.Len(t, reports, 1)
+	assert.Equal(t, "Hardware Watchdog", reports[0].Reason)
+
+	firmware, err := st.DeviceFirmware(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.0", firmware[0].Version)
+}
+
+func TestCrashReportsNotSupported(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, struct{ store.Store }{memory.New()}))
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusNotImplemented, doRequest(t, srv, "POST", "/devices/attic/crash", `{"reason": "Exception"}`).StatusCode)
+	assert.Equal(t, http.StatusNotImplemented, doRequest(t, srv, "GET", "/devices/attic/crashes", "").StatusCode)
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/aggregate"
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const (
+	// defaultDashboardPoints is how many readings of the last day a device
+	// dashboard has unless points says otherwise.
+	defaultDashboardPoints = 300
+	// defaultDashboardDays is how many days of daily stats a device
+	// dashboard has unless days says otherwise.
+	defaultDashboardDays = 7
+	maxDashboardDays     = 31
+	// dashboardSeriesRange is how far back the series of a device
+	// dashboard goes.
+	dashboardSeriesRange = 24 * time.Hour
+)
+
+// DeviceDashboard is everything the device page of the dashboard shows.
+type DeviceDashboard struct {
+	Device string `json:"device"`
+	// Latest is the device's newest reading, whatever its age.
+	Latest store.TemperatureReading `json:"latest"`
+	// LastSeen is the timestamp of Latest; Online is set when it is within
+	// offlineAfter.
+	LastSeen int64 `json:"lastSeen"`
+	Online   bool  `json:"online"`
+	// Series are the readings of the last day downsampled to points, oldest
+	// first.
+	Series []store.TemperatureReading `json:"series"`
+	// Daily are the stats of the last days, oldest first, in server time.
+	Daily []aggregate.Day `json:"daily"`
+	// Alerts are the firing alerts started by the device's readings, empty
+	// when the storage backend doesn't support alerting.
+	Alerts []store.Alert `json:"alerts"`
+}
+
+// deviceDashboardHandler serves the device page of the dashboard in one
+// response instead of a request per panel.
+func (s *server) deviceDashboardHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fs, ok := s.store.(store.FilterStore)
+	if !ok {
+		http.Error(w, "Device dashboards are not supported by this storage backend", http.StatusNotImplemented)
+		return
+	}
+	q := r.URL.Query()
+	points, days := defaultDashboardPoints, defaultDashboardDays
+	if v := q.Get("points"); v != "" {
+		var err error
+		if points, err = strconv.Atoi(v); err != nil || points < 3 || points > maxDownsamplePoints {
+			http.Error(w, "Bad request: points must be between 3 and 10000", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if v := q.Get("days"); v != "" {
+		var err error
+		if days, err = strconv.Atoi(v); err != nil || days < 1 || days > maxDashboardDays {
+			http.Error(w, "Bad request: days must be between 1 and 31", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	device := r.PathValue("device")
+	rq := store.ReadingQuery{Devices: []string{device}}
+	list := func(ctx context.Context, limit, offset int) ([]store.TemperatureReading, error) {
+		return fs.ListFilteredReadings(ctx, rq, limit, offset)
+	}
+	latest, err := list(r.Context(), 1, 0)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query temperature readings", "device", device)
+		return
+	}
+	if len(latest) == 0 || latest[0].Timestamp == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	y, m, d := now.Date()
+	firstDay := time.Date(y, m, d-days+1, 0, 0, 0, 0, time.Local)
+	from := min(firstDay.Unix(), now.Add(-dashboardSeriesRange).Unix())
+	readings, err := readingsSince(r.Context(), from, list)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query temperature readings", "device", device)
+		return
+	}
+
+	dashboard := DeviceDashboard{
+		Device:   device,
+		Latest:   latest[0],
+		LastSeen: *latest[0].Timestamp,
+		Online:   now.Unix()-*latest[0].Timestamp <= int64(offlineAfter/time.Second),
+		Series:   make([]store.TemperatureReading, 0),
+		Alerts:   make([]store.Alert, 0),
+	}
+	seriesFrom := now.Add(-dashboardSeriesRange).Unix()
+	var daily []store.TemperatureReading
+	for i, reading := range readings {
+		if *reading.Timestamp >= seriesFrom && len(dashboard.Series) == 0 {
+			dashboard.Series = aggregate.LTTB(readings[i:], points)
+		}
+		if *reading.Timestamp >= firstDay.Unix() && daily == nil {
+			daily = readings[i:]
+		}
+	}
+	dashboard.Daily = aggregate.Daily(daily, time.Local)
+
+	if s.alerts != nil {
+		alerts, err := s.alerts.Store().ListFiringAlerts(r.Context())
+		if err != nil {
+			writeStoreError(w, logger, err, "Failed to query firing alerts")
+			return
+		}
+		for _, a := range alerts {
+			if a.Device != device {
+				continue
+			}
+			if a.Silenced, err = s.alerts.Silenced(r.Context(), a.RuleName, a.Severity, now.Unix()); err != nil {
+				writeStoreError(w, logger, err, "Failed to query alert silences")
+				return
+			}
+			dashboard.Alerts = append(dashboard.Alerts, a)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dashboard)
+}
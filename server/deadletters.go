@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/bartosz121/esp8266-web/alert"
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const (
+	defaultDeadLettersLimit = 50
+	maxDeadLettersLimit     = 500
+)
+
+// deadLetterStore returns the dead letter store, or responds with 501 when
+// the storage backend doesn't keep failed notifications.
+func (s *server) deadLetterStore(w http.ResponseWriter) (store.DeadLetterStore, bool) {
+	ds, ok := s.store.(store.DeadLetterStore)
+	if !ok || s.alerts == nil {
+		http.Error(w, "Dead letters are not supported by this storage backend", http.StatusNotImplemented)
+		return nil, false
+	}
+	return ds, true
+}
+
+// deadLettersHandler lists the alert notifications that failed to send,
+// newest first.
+func (s *server) deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	ds, ok := s.deadLetterStore(w)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	limit := defaultDeadLettersLimit
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= maxDeadLettersLimit {
+		limit = l
+	}
+	letters, err := ds.ListDeadLetters(r.Context(), limit)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query dead letters")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(letters)
+}
+
+// deadLetterHandler discards a dead letter.
+func (s *server) deadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	ds, ok := s.deadLetterStore(w)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err := ds.DeleteDeadLetter(r.Context(), id); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		writeStoreError(w, logger, err, "Failed to delete dead letter", "id", id)
+		return
+	}
+	logger.Info("Discarded dead letter", slog.Int("id", id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// replayDeadLetterHandler sends a dead letter again, deleting it once sent.
+func (s *server) replayDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if _, ok := s.deadLetterStore(w); !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	d, err := s.alerts.Replay(r.Context(), id)
+	var sendErr *alert.SendError
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	case errors.Is(err, alert.ErrNotConfigured):
+		http.Error(w, "Conflict: "+err.Error(), http.StatusConflict)
+		return
+	case errors.As(err, &sendErr):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(d)
+		return
+	case err != nil:
+		writeStoreError(w, logger, err, "Failed to replay dead letter", "id", id)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
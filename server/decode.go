@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	contentTypeCBOR    = "application/cbor"
+	contentTypeMsgpack = "application/msgpack"
+)
+
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// decodeBody decodes the request body into v according to its Content-Type.
+// JSON is assumed when the header is missing. CBOR and MessagePack map keys
+// are the json tag names, so constrained firmware sends the same fields it
+// would in JSON.
+func decodeBody(r *http.Request, v any) error {
+	mediaType, err := bodyMediaType(r)
+	if err != nil {
+		return err
+	}
+	switch mediaType {
+	case contentTypeJSON:
+		return json.NewDecoder(r.Body).Decode(v)
+	case contentTypeCBOR:
+		return cbor.NewDecoder(r.Body).Decode(v)
+	case contentTypeMsgpack, "application/x-msgpack", "application/vnd.msgpack":
+		dec := msgpack.NewDecoder(r.Body)
+		dec.SetCustomStructTag("json")
+		return dec.Decode(v)
+	default:
+		return errUnsupportedMediaType
+	}
+}
+
+// bodyMediaType returns the media type of the request body, JSON when the
+// Content-Type header is missing.
+func bodyMediaType(r *http.Request) (string, error) {
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return contentTypeJSON, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return "", errUnsupportedMediaType
+	}
+	return mediaType, nil
+}
+
+// decodeGeneric decodes a body of mediaType into maps, slices and scalars for
+// schema validation.
+func decodeGeneric(mediaType string, body []byte) (any, error) {
+	var doc any
+	switch mediaType {
+	case contentTypeJSON:
+		return jsonschema.UnmarshalJSON(bytes.NewReader(body))
+	case contentTypeCBOR:
+		dm, err := cbor.DecOptions{DefaultMapType: reflect.TypeFor[map[string]any]()}.DecMode()
+		if err != nil {
+			return nil, err
+		}
+		return doc, dm.Unmarshal(body, &doc)
+	case contentTypeMsgpack, "application/x-msgpack", "application/vnd.msgpack":
+		return doc, msgpack.Unmarshal(body, &doc)
+	default:
+		return nil, errUnsupportedMediaType
+	}
+}
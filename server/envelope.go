@@ -0,0 +1,94 @@
+package server
+
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Profiles of application/json a client picks the shape of list responses
+// with, e.g. Accept: application/json; profile=envelope.
+const (
+	profileEnvelope = "envelope"
+	profileBare     = "bare"
+)
+
+// Envelope wraps a JSON list response for frontend frameworks expecting
+// JSON:API-style documents. Bare arrays stay the default, as firmware
+// reads them.
+type Envelope struct {
+	Data  any           `json:"data"`
+	Meta  EnvelopeMeta  `json:"meta"`
+	Links EnvelopeLinks `json:"links"`
+}
+
+// EnvelopeMeta describes the page of an Envelope. Limit and Offset are
+// omitted for responses that aren't paginated.
+type EnvelopeMeta struct {
+	Count  int  `json:"count"`
+	Limit  *int `json:"limit,omitempty"`
+	Offset *int `json:"offset,omitempty"`
+}
+
+// EnvelopeLinks are relative URLs of the page and, when there are any, of
+// the pages around it.
+type EnvelopeLinks struct {
+	Self string `json:"self"`
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+// page is the limit and offset a list response was read with.
+type page struct {
+	limit, offset int
+}
+
+// wantsEnvelope reports whether r asks for an Envelope: its Accept header
+// names the envelope or the bare profile of application/json, or, when it
+// names neither, Config.Envelope says so.
+func (s *server) wantsEnvelope(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mediaType != contentTypeJSON {
+			continue
+		}
+		switch params["profile"] {
+		case profileEnvelope:
+			return true
+		case profileBare:
+			return false
+		}
+	}
+	return s.cfg.Envelope
+}
+
+// envelope wraps the count items of data answering r, read as p or, when p
+// is nil, all at once. A full page links to the next one.
+func envelope(r *http.Request, data any, count int, p *page) Envelope {
+	env := Envelope{Data: data, Meta: EnvelopeMeta{Count: count}, Links: EnvelopeLinks{Self: pageURL(r, p)}}
+	if p == nil {
+		return env
+	}
+	env.Meta.Limit, env.Meta.Offset = &p.limit, &p.offset
+	if count == p.limit {
+		env.Links.Next = pageURL(r, &page{limit: p.limit, offset: p.offset + p.limit})
+	}
+	if p.offset > 0 {
+		env.Links.Prev = pageURL(r, &page{limit: p.limit, offset: max(p.offset-p.limit, 0)})
+	}
+	return env
+}
+
+// pageURL returns the path and query of r with the limit and offset of p,
+// when it isn't nil.
+func pageURL(r *http.Request, p *page) string {
+	q := r.URL.Query()
+	if p != nil {
+		q.Set("limit", strconv.Itoa(p.limit))
+		q.Set("offset", strconv.Itoa(p.offset))
+	}
+	u := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+	return u.String()
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// Explained queries.
+const (
+	// ExplainData is the query of GET /data.
+	ExplainData = "data"
+	// ExplainAggregate is the query GET /data/aggregate pages through, and
+	// the downsampling and interpolation of GET /data with it.
+	ExplainAggregate = "aggregate"
+)
+
+var explainQueries = []string{ExplainData, ExplainAggregate}
+
+// Explanation is the plan of an explained query.
+type Explanation struct {
+	Query string `json:"query"`
+	store.QueryPlan
+}
+
+func (s *server) explainStore(w http.ResponseWriter) (store.ExplainStore, bool) {
+	es, ok := s.store.(store.ExplainStore)
+	if !ok {
+		http.Error(w, "Explaining queries is not supported by this storage backend", http.StatusNotImplemented)
+		return nil, false
+	}
+	return es, true
+}
+
+// explainHandler runs the query behind a read endpoint with the parameters
+// it would be given, the rest of the query string, and returns its plan.
+func (s *server) explainHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	es, ok := s.explainStore(w)
+	if !ok {
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	q := r.URL.Query()
+	query := q.Get("query")
+	if query == "" {
+		query = ExplainData
+	}
+	if !slices.Contains(explainQueries, query) {
+		http.Error(w, "Bad request: query must be one of "+strings.Join(explainQueries, ", "), http.StatusUnprocessableEntity)
+		return
+	}
+
+	var filters []store.ReadingFilter
+	// the first page, as the aggregation reads it
+	limit, offset := usagePageSize, 0
+	if query == ExplainData {
+		if filters, ok = s.parseFilters(w, q); !ok {
+			return
+		}
+		limit = 10
+		if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+		if o, err := strconv.Atoi(q.Get("offset")); err == nil && o >= 0 {
+			offset = o
+		}
+	}
+	sel, ok := s.parseReadingQuery(w, r, filters)
+	if !ok {
+		return
+	}
+
+	plan, err := es.ExplainReadings(r.Context(), sel.query, sel.half, limit, offset)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to explain query", "query", query)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Explanation{Query: query, QueryPlan: plan})
+}
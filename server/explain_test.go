@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// explainedStore records the listing it's asked to explain.
+type explainedStore struct {
+	*memory.Store
+	calls *[]string
+}
+
+func (s explainedStore) ExplainReadings(ctx context.Context, q *store.ReadingQuery, half int64, limit, offset int) (store.QueryPlan, error) {
+	*s.calls = append(*s.calls, fmt.Sprintf("%+v %d %d %d", q, half, limit, offset))
+	return store.QueryPlan{Statement: "SELECT 1", Parameters: []any{limit, offset}, Plan: []string{"Result"}}, nil
+}
+
+func TestExplain(t *testing.T) {
+	var calls []string
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, explainedStore{Store: memory.New(), calls: &calls}))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "GET", "/admin/explain?limit=5&offset=10", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"query": "data", "statement": "SELECT 1", "parameters": [5, 10], "plan": ["Result"]}`, string(body))
+
+	assert.Equal(t, http.StatusOK, doRequest(t, srv, "GET", "/admin/explain?device=attic&tempCo[gt]=40", "").StatusCode)
+	assert.Equal(t, http.StatusOK, doRequest(t, srv, "GET", "/admin/explain?query=aggregate&smooth=10m", "").StatusCode)
+	assert.Equal(t, []string{
+		"<nil> 0 5 10",
+		"&{Filters:[{Field:tempCo Op:gt Value:40}] Devices:[attic] Qualities:[] Order: After:<nil>} 0 10 0",
+		"<nil> 300 1000 0",
+	}, calls)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/admin/explain?query=usage", "").StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/admin/explain?smooth=10m&device=attic", "").StatusCode)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "wrong", "GET", "/admin/explain", "").StatusCode)
+	assert.Equal(t, http.StatusMethodNotAllowed, doRequest(t, srv, "POST", "/admin/explain", "").StatusCode)
+
+	unsupported := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer unsupported.Close()
+	assert.Equal(t, http.StatusNotImplemented, doRequest(t, unsupported, "GET", "/admin/explain", "").StatusCode)
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/export"
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const (
+	contentTypeXLSX    = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	contentTypeParquet = "application/vnd.apache.parquet"
+	contentTypeArrow   = "application/vnd.apache.arrow.stream"
+	// defaultExportRange is the range of GET /data/export.xlsx without
+	// from.
+	defaultExportRange = 31 * 24 * time.Hour
+	// exportBatchSize is how many readings the streaming exports write at
+	// once, e.g. a Parquet row group.
+	exportBatchSize = 65536
+	// exportPageTimeout is how long the streaming exports may take to read
+	// and write a page of readings. The write deadline is pushed back by it
+	// for every page, so the server's write timeout doesn't cut long
+	// exports short.
+	exportPageTimeout = 15 * time.Second
+)
+
+// exportXLSXHandler serves the selected readings between from and to as a
+// spreadsheet, for people who'd rather open the data in Excel.
+func (s *server) exportXLSXHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	from, to, ok := parseTimeRange(w, r.URL.Query(), defaultExportRange)
+	if !ok {
+		return
+	}
+	if from >= to || to-from > int64(maxUsageRange/time.Second) {
+		http.Error(w, "Bad request: from must be before to and at most 366 days apart", http.StatusUnprocessableEntity)
+		return
+	}
+	list, ok := s.parseSelection(w, r, nil)
+	if !ok {
+		return
+	}
+
+	readings, err := readingsSince(r.Context(), from, list)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query temperature readings")
+		return
+	}
+	end := len(readings)
+	for end > 0 && *readings[end-1].Timestamp > to {
+		end--
+	}
+	var buf bytes.Buffer
+	if err := export.XLSX(&buf, readings[:end], time.Local); err != nil {
+		logger.Error("Failed to write spreadsheet", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	name := fmt.Sprintf("readings-%s-%s.xlsx", time.Unix(from, 0).Format(time.DateOnly), time.Unix(to, 0).Format(time.DateOnly))
+	w.Header().Set("Content-Type", contentTypeXLSX)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Write(buf.Bytes())
+}
+
+// exportSelection is what a streaming export reads: the readings of query,
+// stamped within [from, to], when the store can filter them, or else those
+// of list, e.g. smoothed ones.
+type exportSelection struct {
+	from, to int64
+	query    *store.ReadingQuery
+	list     readingLister
+}
+
+// streamReadings pages through the readings of sel stamped within [from,
+// to], newest first, passing them to write in batches of exportBatchSize
+// or fewer, so only a batch is held in memory. Readings of a query are
+// paged through by cursor, so every page costs the same however deep into
+// the export it is. Every page extends the write deadline of rc.
+func (s *server) streamReadings(ctx context.Context, rc *http.ResponseController, sel exportSelection, write func([]store.TemperatureReading) error) error {
+	extend := func() error {
+		if err := rc.SetWriteDeadline(time.Now().Add(exportPageTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		return nil
+	}
+	batch := make([]store.TemperatureReading, 0, exportBatchSize)
+	add := func(r store.TemperatureReading) error {
+		batch = append(batch, r)
+		if len(batch) < exportBatchSize {
+			return nil
+		}
+		err := write(batch)
+		batch = batch[:0]
+		return err
+	}
+	if sel.query != nil {
+		fs := s.store.(store.FilterStore)
+		q := *sel.query
+		for {
+			if err := extend(); err != nil {
+				return err
+			}
+			page, err := fs.ListFilteredReadings(ctx, q, usagePageSize, 0)
+			if err != nil {
+				return err
+			}
+			for _, r := range page {
+				if err := add(r); err != nil {
+					return err
+				}
+			}
+			if len(page) < usagePageSize {
+				break
+			}
+			after := store.CursorAfter(page[len(page)-1])
+			q.After = &after
+		}
+	} else {
+		for offset := 0; ; offset += usagePageSize {
+			if err := extend(); err != nil {
+				return err
+			}
+			page, err := sel.list(ctx, usagePageSize, offset)
+			if err != nil {
+				return err
+			}
+			for _, r := range page {
+				if r.Timestamp == nil || *r.Timestamp > sel.to {
+					continue
+				}
+				if *r.Timestamp < sel.from {
+					page = nil
+					break
+				}
+				if err := add(r); err != nil {
+					return err
+				}
+			}
+			if len(page) < usagePageSize {
+				break
+			}
+		}
+	}
+	if len(batch) > 0 {
+		return write(batch)
+	}
+	return nil
+}
+
+// parseExport parses the range and selection of a streaming export: from
+// and to default to all readings.
+func (s *server) parseExport(w http.ResponseWriter, r *http.Request) (exportSelection, bool) {
+	q := r.URL.Query()
+	from, to, ok := parseTimeRange(w, q, 0)
+	if !ok {
+		return exportSelection{}, false
+	}
+	if !q.Has("from") {
+		from = 0
+	}
+	if from > to {
+		http.Error(w, "Bad request: from must not be after to", http.StatusUnprocessableEntity)
+		return exportSelection{}, false
+	}
+	sel, ok := s.parseReadingQuery(w, r, nil)
+	if !ok {
+		return exportSelection{}, false
+	}
+	if _, canFilter := s.store.(store.FilterStore); !canFilter || sel.half > 0 {
+		return exportSelection{from: from, to: to, list: s.lister(sel)}, true
+	}
+	var query store.ReadingQuery
+	if sel.query != nil {
+		query = *sel.query
+	}
+	query.Filters = append(slices.Clip(query.Filters),
+		store.ReadingFilter{Field: "timestamp", Op: "gte", Value: float64(from)},
+		store.ReadingFilter{Field: "timestamp", Op: "lte", Value: float64(to)},
+	)
+	// exports are newest first by timestamp, the order cursors page in
+	query.Order = ""
+	return exportSelection{from: from, to: to, query: &query}, true
+}
+
+// exportParquetHandler streams the selected readings between from and to,
+// all of them by default, as a Parquet file for analytics tools.
+func (s *server) exportParquetHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sel, ok := s.parseExport(w, r)
+	if !ok {
+		return
+	}
+
+	name := fmt.Sprintf("readings-%s-%s.parquet", time.Unix(sel.from, 0).Format(time.DateOnly), time.Unix(sel.to, 0).Format(time.DateOnly))
+	w.Header().Set("Content-Type", contentTypeParquet)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	pw, err := export.NewParquetWriter(w)
+	if err != nil {
+		logger.Error("Failed to write Parquet file", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// the status is sent with the first row group; a failure after it can
+	// only cut the file short, which readers reject without its footer
+	if err := s.streamReadings(r.Context(), http.NewResponseController(w), sel, pw.Write); err != nil {
+		logger.Error("Failed to export readings as Parquet", "error", err)
+		return
+	}
+	if err := pw.Close(); err != nil {
+		logger.Error("Failed to write Parquet file", "error", err)
+	}
+}
+
+// exportArrowHandler streams the selected readings between from and to,
+// all of them by default, as Arrow record batches, far cheaper for
+// programs to parse than JSON. Every batch is flushed as soon as it is
+// written.
+func (s *server) exportArrowHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sel, ok := s.parseExport(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeArrow)
+	rc := http.NewResponseController(w)
+	aw := export.NewArrowWriter(w)
+	err := s.streamReadings(r.Context(), rc, sel, func(readings []store.TemperatureReading) error {
+		if err := aw.Write(readings); err != nil {
+			return err
+		}
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		return nil
+	})
+	// a failure after the first batch can only cut the stream short,
+	// which readers report as an unexpected end of stream
+	if err != nil {
+		logger.Error("Failed to export readings as Arrow", "error", err)
+		return
+	}
+	if err := aw.Close(); err != nil {
+		logger.Error("Failed to write Arrow stream", "error", err)
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const (
+	// feedAlertEvents is how many alert transitions the feed lists.
+	feedAlertEvents = 50
+	// feedOfflineRange is how far back the feed looks for silent sensors.
+	feedOfflineRange = 48 * time.Hour
+	// offlineAfter is how long a device may go without a reading before it
+	// counts as offline.
+	offlineAfter = 30 * time.Minute
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title     string       `xml:"title"`
+	ID        string       `xml:"id"`
+	Updated   string       `xml:"updated"`
+	Published string       `xml:"published"`
+	Category  atomCategory `xml:"category"`
+	Link      atomLink     `xml:"link"`
+	Content   string       `xml:"content"`
+
+	// updated orders the entries.
+	updated int64
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+func atomTime(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+}
+
+// requestBaseURL is the scheme and host the request was sent to, honouring
+// a reverse proxy's X-Forwarded-Proto.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// alertEntries turns alert transitions into feed entries.
+func alertEntries(events []store.AlertEvent, base string) []atomEntry {
+	entries := make([]atomEntry, 0, len(events))
+	for _, e := range events {
+		state := strings.ToUpper(e.State[:1]) + e.State[1:]
+		entries = append(entries, atomEntry{
+			Title:     fmt.Sprintf("%s: %s (%g)", state, e.RuleName, e.Value),
+			ID:        fmt.Sprintf("urn:esp8266-web:alert-event:%d", e.Id),
+			Updated:   atomTime(e.Timestamp),
+			Published: atomTime(e.Timestamp),
+			Category:  atomCategory{Term: "alert-" + e.State},
+			Link:      atomLink{Href: fmt.Sprintf("%s/alerts/history?rule=%d", base, e.RuleId)},
+			Content:   fmt.Sprintf("Alert rule %q is %s with a value of %g at %s.", e.RuleName, e.State, e.Value, atomTime(e.Timestamp)),
+			updated:   e.Timestamp,
+		})
+	}
+	return entries
+}
+
+// offlineEntries finds the gaps longer than offlineAfter in every device's
+// readings, oldest first, and the devices silent since before now minus
+// offlineAfter.
+func offlineEntries(readings []store.TemperatureReading, now int64, base string) []atomEntry {
+	last := make(map[string]int64)
+	var entries []atomEntry
+	gap := int64(offlineAfter / time.Second)
+	entry := func(device string, since, until int64) atomEntry {
+		name := device
+		if name == "" {
+			name = "unnamed device"
+		}
+		e := atomEntry{
+			ID:        fmt.Sprintf("urn:esp8266-web:offline:%s:%d", url.PathEscape(device), since),
+			Published: atomTime(since + gap),
+			Category:  atomCategory{Term: "sensor-offline"},
+			Link:      atomLink{Href: base + "/data?device=" + url.QueryEscape(device)},
+		}
+		if until == 0 {
+			e.Title = fmt.Sprintf("Offline: %s", name)
+			e.Content = fmt.Sprintf("No readings from %s since %s.", name, atomTime(since))
+			e.updated = since + gap
+		} else {
+			e.Title = fmt.Sprintf("Back online: %s after %s", name, time.Duration(until-since)*time.Second)
+			e.Content = fmt.Sprintf("No readings from %s between %s and %s.", name, atomTime(since), atomTime(until))
+			e.updated = until
+		}
+		e.Updated = atomTime(e.updated)
+		return e
+	}
+	for _, r := range readings {
+		ts := *r.Timestamp
+		if prev, ok := last[r.Device]; ok && ts-prev > gap {
+			entries = append(entries, entry(r.Device, prev, ts))
+		}
+		last[r.Device] = ts
+	}
+	for device, ts := range last {
+		if now-ts > gap {
+			entries = append(entries, entry(device, ts, 0))
+		}
+	}
+	return entries
+}
+
+// alertFeedHandler serves alert transitions and sensors going offline as
+// an Atom feed for feed readers, answering conditional requests with 304.
+func (s *server) alertFeedHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st, ok := s.alertStore(w)
+	if !ok {
+		return
+	}
+	events, err := st.ListAlertHistory(r.Context(), store.AlertHistoryFilter{Limit: feedAlertEvents})
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query alert history")
+		return
+	}
+	now := time.Now()
+	readings, err := readingsSince(r.Context(), now.Add(-feedOfflineRange).Unix(), s.store.ListReadings)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query temperature readings")
+		return
+	}
+
+	base := requestBaseURL(r)
+	entries := append(alertEntries(events, base), offlineEntries(readings, now.Unix(), base)...)
+	slices.SortFunc(entries, func(a, b atomEntry) int {
+		return cmp.Or(cmp.Compare(b.updated, a.updated), strings.Compare(a.ID, b.ID))
+	})
+	var updated int64
+	if len(entries) > 0 {
+		updated = entries[0].updated
+	}
+	feed := atomFeed{
+		Title:   "esp8266-web alerts",
+		ID:      "urn:esp8266-web:alerts",
+		Updated: atomTime(updated),
+		Links: []atomLink{
+			{Rel: "self", Href: base + "/alerts/feed.atom"},
+			{Rel: "alternate", Href: base + "/"},
+		},
+		Author:  atomAuthor{Name: "esp8266-web"},
+		Entries: entries,
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(feed); err != nil {
+		logger.Error("Failed to encode alert feed", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	lastModified := time.Unix(updated, 0).UTC()
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagMatches(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+// parseFilters parses the field[op]=value query parameters of GET /data,
+// e.g. tempCo[gte]=50, into filters matching readings on all of them. It
+// responds with 422 when one is invalid and with 501 when the store can't
+// filter.
+func (s *server) parseFilters(w http.ResponseWriter, q url.Values) ([]store.ReadingFilter, bool) {
+	keys := make([]string, 0, len(q))
+	for key := range q {
+		if strings.HasSuffix(key, "]") && strings.Contains(key, "[") {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, true
+	}
+	sort.Strings(keys)
+
+	var filters []store.ReadingFilter
+	for _, key := range keys {
+		field, op, _ := strings.Cut(strings.TrimSuffix(key, "]"), "[")
+		if !slices.Contains(store.FilterFields, field) {
+			http.Error(w, "Bad request: filter field must be one of "+strings.Join(store.FilterFields, ", "), http.StatusUnprocessableEntity)
+			return nil, false
+		}
+		if !slices.Contains(store.FilterOps, op) {
+			http.Error(w, "Bad request: filter op must be one of "+strings.Join(store.FilterOps, ", "), http.StatusUnprocessableEntity)
+			return nil, false
+		}
+		for _, v := range q[key] {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil || math.IsNaN(n) || math.IsInf(n, 0) || ((field == "timestamp" || field == "receivedAt") && n != math.Trunc(n)) {
+				http.Error(w, "Bad request: invalid "+key, http.StatusUnprocessableEntity)
+				return nil, false
+			}
+			filters = append(filters, store.ReadingFilter{Field: field, Op: op, Value: n})
+		}
+	}
+	if _, ok := s.store.(store.FilterStore); !ok {
+		http.Error(w, "Filtering is not supported by this storage backend", http.StatusNotImplemented)
+		return nil, false
+	}
+	return filters, true
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"github.com/bartosz121/esp8266-web/ingest"
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// FirmwareVersion is how many devices run a version.
+type FirmwareVersion struct {
+	Version  string `json:"version"`
+	Devices  int    `json:"devices"`
+	Outdated bool   `json:"outdated"`
+}
+
+// FirmwareDevice is the version a device runs.
+type FirmwareDevice struct {
+	store.DeviceFirmware
+	Outdated bool `json:"outdated"`
+}
+
+// FleetReport summarizes the firmware versions of every device.
+type FleetReport struct {
+	// MinVersion is the oldest version devices should run, empty when
+	// not set.
+	MinVersion string `json:"minVersion"`
+	// Versions are ordered newest first.
+	Versions []FirmwareVersion `json:"versions"`
+	Devices  []FirmwareDevice  `json:"devices"`
+}
+
+// recordFirmware records the firmware version device reported with r,
+// given in the payload or else the X-Firmware-Version header. A failure is
+// only logged; the request was handled.
+func (s *server) recordFirmware(r *http.Request, device, version string) {
+	if version == "" {
+		version = r.Header.Get(ingest.FirmwareHeader)
+	}
+	if err := s.ingest.Firmware(r.Context(), device, version); err != nil {
+		slogctx.FromCtx(r.Context()).Error("Failed to record firmware version", "device", device, "error", err)
+	}
+}
+
+// firmwareHandler reports how many devices run each firmware version.
+func (s *server) firmwareHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	fs, ok := s.store.(store.FirmwareStore)
+	if !ok {
+		http.Error(w, "Firmware versions are not supported by this storage backend", http.StatusNotImplemented)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	firmware, err := fs.DeviceFirmware(r.Context())
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query firmware versions")
+		return
+	}
+	report := FleetReport{MinVersion: s.ingest.MinFirmware(), Versions: []FirmwareVersion{}, Devices: make([]FirmwareDevice, 0, len(firmware))}
+	counts := make(map[string]int)
+	for _, f := range firmware {
+		report.Devices = append(report.Devices, FirmwareDevice{DeviceFirmware: f, Outdated: s.ingest.Outdated(f.Version)})
+		counts[f.Version]++
+	}
+	for version, n := range counts {
+		report.Versions = append(report.Versions, FirmwareVersion{Version: version, Devices: n, Outdated: s.ingest.Outdated(version)})
+	}
+	slices.SortFunc(report.Versions, func(a, b FirmwareVersion) int {
+		if c := ingest.CompareVersions(b.Version, a.Version); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Version, b.Version)
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bartosz121/esp8266-web/ingest"
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceFirmware(t *testing.T) {
+	st := memory.New()
+	pipeline := ingest.New(st, ingest.Config{MinFirmware: "1.2"})
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret", Ingest: pipeline}, st))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "POST", "/sync", `{"device": "attic", "firmware": "1.10.0", "readings": [{"seq": 1, "tempCo": 40, "tempRoom": 21, "humidity": 50}]}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	// command polls are heartbeats
+	for _, device := range []string{"garage", "cellar"} {
+		req, err := http.NewRequest("GET", srv.URL+"/devices/"+device+"/commands", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Secret-Key", "testsecret")
+		req.Header.Set(ingest.FirmwareHeader, "v1.1.4")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	resp = doRequest(t, srv, "GET", "/devices/firmware", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var report FleetReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.Equal(t, "1.2", report.MinVersion)
+	assert.Equal(t, []FirmwareVersion{{Version: "1.10.0", Devices: 1}, {Version: "v1.1.4", Devices: 2, Outdated: true}}, report.Versions)
+	require.Len(t, report.Devices, 3)
+	assert.Equal(t, "attic", report.Devices[0].Device)
+	assert.False(t, report.Devices[0].Outdated)
+	assert.Equal(t, "cellar", report.Devices[1].Device)
+	assert.True(t, report.Devices[1].Outdated)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, doRequest(t, srv, "POST", "/devices/firmware", "").StatusCode)
+}
+
+func TestDeviceFirmwareNotSupported(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, struct{ store.Store }{memory.New()}))
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusNotImplemented, doRequest(t, srv, "GET", "/devices/firmware", "").StatusCode)
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/number"
+)
+
+const (
+	contentTypeJSON   = "application/json"
+	contentTypeCSV    = "text/csv"
+	contentTypeNDJSON = "application/x-ndjson"
+)
+
+// csvFormat is the field delimiter and decimal separator of CSV output.
+type csvFormat struct {
+	comma   rune
+	decimal string
+}
+
+var defaultCSVFormat = csvFormat{comma: ',', decimal: "."}
+
+// csvDelimiters are the accepted ?delimiter= values.
+var csvDelimiters = map[string]rune{",": ',', ";": ';', "|": '|', "tab": '\t'}
+
+// parseCSVFormat reads ?locale=, a BCP 47 tag such as de or pl-PL, and
+// ?delimiter=. A locale writing decimal commas defaults the delimiter to a
+// semicolon, as European spreadsheets expect.
+func parseCSVFormat(w http.ResponseWriter, q url.Values) (csvFormat, bool) {
+	f := defaultCSVFormat
+	if q.Has("locale") {
+		tag, err := language.Parse(q.Get("locale"))
+		if err != nil {
+			http.Error(w, "Bad request: locale must be a language tag, e.g. de or pl-PL", http.StatusUnprocessableEntity)
+			return csvFormat{}, false
+		}
+		f.decimal = decimalSeparator(tag)
+		if f.decimal == "," {
+			f.comma = ';'
+		}
+	}
+	if q.Has("delimiter") {
+		comma, ok := csvDelimiters[q.Get("delimiter")]
+		if !ok {
+			http.Error(w, "Bad request: delimiter must be one of , ; | or tab", http.StatusUnprocessableEntity)
+			return csvFormat{}, false
+		}
+		if string(comma) == f.decimal {
+			http.Error(w, "Bad request: delimiter can't be the locale's decimal separator", http.StatusUnprocessableEntity)
+			return csvFormat{}, false
+		}
+		f.comma = comma
+	}
+	return f, true
+}
+
+// decimalSeparator returns what tag writes between the integer and the
+// fraction digits.
+func decimalSeparator(tag language.Tag) string {
+	s := []rune(message.NewPrinter(tag).Sprint(number.Decimal(1.5)))
+	if len(s) < 3 {
+		return "."
+	}
+	return string(s[1 : len(s)-1])
+}
+
+// formatFloat formats v for CSV in format f.
+func (f csvFormat) formatFloat(v float64) string {
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	if f.decimal != "." {
+		s = strings.Replace(s, ".", f.decimal, 1)
+	}
+	return s
+}
+
+// writeReadings encodes the readings answering r as contentType, one of the
+// contentType constants, with CSV in format f and JSON wrapped in an
+// Envelope when r asks for one. p is the page they were read as, nil when
+// they aren't paginated.
+func (s *server) writeReadings(w http.ResponseWriter, r *http.Request, contentType string, f csvFormat, readings []store.TemperatureReading, p *page) error {
+	switch contentType {
+	case contentTypeCSV:
+		w.Header().Set("Content-Type", contentTypeCSV+"; charset=utf-8")
+		cw := csv.NewWriter(w)
+		cw.Comma = f.comma
+		cw.Write([]string{"id", "tempCo", "tempRoom", "humidity", "timestamp", "receivedAt", "quality"})
+		for _, tr := range readings {
+			var ts, received string
+			if tr.Timestamp != nil {
+				ts = strconv.FormatInt(*tr.Timestamp, 10)
+			}
+			if tr.ReceivedAt != nil {
+				received = strconv.FormatInt(*tr.ReceivedAt, 10)
+			}
+			cw.Write([]string{
+				strconv.Itoa(tr.Id),
+				f.formatFloat(tr.TempCo),
+				f.formatFloat(tr.TempRoom),
+				f.formatFloat(tr.Humidity),
+				ts,
+				received,
+				tr.Quality,
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	case contentTypeNDJSON:
+		w.Header().Set("Content-Type", contentTypeNDJSON)
+		enc := json.NewEncoder(w)
+		for _, tr := range readings {
+			if err := enc.Encode(tr); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		if s.wantsEnvelope(r) {
+			w.Header().Set("Content-Type", contentTypeJSON+"; profile="+profileEnvelope)
+			return json.NewEncoder(w).Encode(envelope(r, readings, len(readings), p))
+		}
+		w.Header().Set("Content-Type", contentTypeJSON)
+		return json.NewEncoder(w).Encode(readings)
+	}
+}
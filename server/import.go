@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/ingest"
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+type ImportReadingPayload struct {
+	TemperatureReadingPayload
+	// StoredAt is when the source stored the reading, unix seconds.
+	StoredAt *int64 `json:"storedAt"`
+}
+
+type ImportPayload struct {
+	Device string `json:"device"`
+	// Conflict is one of store.ConflictStrategies, store.ConflictSkip by
+	// default.
+	Conflict string                 `json:"conflict"`
+	Readings []ImportReadingPayload `json:"readings"`
+}
+
+type ImportResponse struct {
+	Conflict string `json:"conflict"`
+	store.ImportResult
+}
+
+// importHandler backfills historic readings of a device, resolving those
+// overlapping stored readings with the requested strategy. Unlike the
+// ingest endpoints it doesn't evaluate alerts or forward the readings,
+// they're history.
+func (s *server) importHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	is, ok := s.store.(store.ImportStore)
+	if !ok {
+		http.Error(w, "Importing readings is not supported by this storage backend", http.StatusNotImplemented)
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var p ImportPayload
+	if err := decodeBody(r, &p); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if p.Conflict == "" {
+		p.Conflict = store.ConflictSkip
+	}
+	if !slices.Contains(store.ConflictStrategies, p.Conflict) {
+		http.Error(w, "Bad request: conflict must be one of "+strings.Join(store.ConflictStrategies, ", "), http.StatusUnprocessableEntity)
+		return
+	}
+	readings, err := importReadings(p, time.Now())
+	if err != nil {
+		s.writeIngestError(w, logger, err)
+		return
+	}
+
+	result, err := is.ImportReadings(r.Context(), p.Device, readings, p.Conflict)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to import temperature readings")
+		return
+	}
+	logger.Info("Imported temperature readings", slog.String("device", p.Device), slog.String("conflict", p.Conflict),
+		slog.Int("inserted", result.Inserted), slog.Int("overwritten", result.Overwritten), slog.Int("skipped", result.Skipped))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ImportResponse{Conflict: p.Conflict, ImportResult: result})
+}
+
+// importReadings validates the readings of p like the ingest pipeline does
+// and additionally requires a unique timestamp on every one, plus StoredAt
+// for store.ConflictKeepNewer.
+func importReadings(p ImportPayload, now time.Time) ([]store.ImportReading, error) {
+	if len(p.Readings) > ingest.MaxBatchSize {
+		return nil, ingest.ErrBatchTooLarge
+	}
+	readings := make([]store.ImportReading, 0, len(p.Readings))
+	seen := make(map[int64]bool, len(p.Readings))
+	for i, rp := range p.Readings {
+		r := store.ImportReading{
+			TemperatureReading: store.TemperatureReading{TempCo: rp.TempCo, TempRoom: rp.TempRoom, Humidity: rp.Humidity, Timestamp: rp.Timestamp},
+			StoredAt:           rp.StoredAt,
+		}
+		var err error
+		switch {
+		case r.Timestamp == nil:
+			err = errors.New("timestamp is required")
+		case seen[*r.Timestamp]:
+			err = errors.New("timestamp is repeated")
+		case p.Conflict == store.ConflictKeepNewer && r.StoredAt == nil:
+			err = errors.New("storedAt is required to keep the newer reading")
+		default:
+			err = ingest.Validate(r.TemperatureReading, now)
+		}
+		if err != nil {
+			return nil, &ingest.ValidationError{Index: i, Err: err}
+		}
+		seen[*r.Timestamp] = true
+		readings = append(readings, r)
+	}
+	return readings, nil
+}
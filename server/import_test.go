@@ -0,0 +1,78 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportHandler(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "POST", "/sync", `{"device": "attic", "readings": [
+		{"seq": 1, "tempCo": 20, "tempRoom": 21, "humidity": 40, "timestamp": 100},
+		{"seq": 2, "tempCo": 20, "tempRoom": 21, "humidity": 40, "timestamp": 200}
+	]}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	importReadings := func(body string) ImportResponse {
+		t.Helper()
+		resp := doRequest(t, srv, "POST", "/data/import", body)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var got ImportResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+		return got
+	}
+	tempCo := func(ts int64) float64 {
+		t.Helper()
+		resp := doRequest(t, srv, "GET", "/data?device=attic", "")
+		var readings []store.TemperatureReading
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&readings))
+		for _, r := range readings {
+			if *r.Timestamp == ts {
+				return r.TempCo
+			}
+		}
+		t.Fatalf("no reading at %d", ts)
+		return 0
+	}
+
+	got := importReadings(`{"device": "attic", "readings": [{"tempCo": 30, "timestamp": 100}, {"tempCo": 30, "timestamp": 300}]}`)
+	assert.Equal(t, ImportResponse{Conflict: "skip", ImportResult: store.ImportResult{Inserted: 1, Skipped: 1}}, got)
+	assert.Equal(t, 20.0, tempCo(100))
+	assert.Equal(t, 30.0, tempCo(300))
+
+	got = importReadings(`{"device": "attic", "conflict": "overwrite", "readings": [{"tempCo": 31, "timestamp": 100}]}`)
+	assert.Equal(t, ImportResponse{Conflict: "overwrite", ImportResult: store.ImportResult{Overwritten: 1}}, got)
+	assert.Equal(t, 31.0, tempCo(100))
+
+	got = importReadings(`{"device": "attic", "conflict": "keep-newer", "readings": [
+		{"tempCo": 32, "timestamp": 100, "storedAt": 1},
+		{"tempCo": 32, "timestamp": 200, "storedAt": 4102444800}
+	]}`)
+	assert.Equal(t, ImportResponse{Conflict: "keep-newer", ImportResult: store.ImportResult{Overwritten: 1, Skipped: 1}}, got)
+	assert.Equal(t, 31.0, tempCo(100))
+	assert.Equal(t, 32.0, tempCo(200))
+
+	for _, body := range []string{
+		`{"device": "attic", "conflict": "merge", "readings": []}`,
+		`{"device": "attic", "readings": [{"tempCo": 30}]}`,
+		`{"device": "attic", "readings": [{"tempCo": 30, "timestamp": 500}, {"tempCo": 31, "timestamp": 500}]}`,
+		`{"device": "attic", "conflict": "keep-newer", "readings": [{"tempCo": 30, "timestamp": 500}]}`,
+		`{"device": "attic", "readings": [{"humidity": 130, "timestamp": 500}]}`,
+	} {
+		assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "POST", "/data/import", body).StatusCode, body)
+	}
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "wrong", "POST", "/data/import", `{"readings": []}`).StatusCode)
+
+	unsupported := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, struct{ store.Store }{memory.New()}))
+	defer unsupported.Close()
+	assert.Equal(t, http.StatusNotImplemented, doRequest(t, unsupported, "POST", "/data/import", `{"readings": []}`).StatusCode)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/bartosz121/esp8266-web/ingest"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+func (s *server) webhooks() map[string]ingest.Webhook {
+	if s.cfg.WebhooksFunc != nil {
+		return s.cfg.WebhooksFunc()
+	}
+	return s.cfg.Webhooks
+}
+
+// webhookAuthorized reports whether r carries the secret or signature of
+// the webhook configured for adapter.
+func (s *server) webhookAuthorized(r *http.Request, adapter string) (bool, error) {
+	wh, ok := s.webhooks()[adapter]
+	if !ok {
+		return false, nil
+	}
+	return wh.Verify(r)
+}
+
+// adapterHandler receives readings through a registered ingest adapter.
+func (s *server) adapterHandler(a ingest.HTTPAdapter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := slogctx.FromCtx(r.Context())
+
+		methods := []string{http.MethodPost}
+		if ma, ok := a.(ingest.MethodsAdapter); ok {
+			methods = ma.Methods()
+		}
+		if !slices.Contains(methods, r.Method) {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// a sealed body authorizes its device's readings, see decrypt
+		_, authorized := payloadKeyFrom(r.Context())
+		var err error
+		if !authorized {
+			authorized, err = s.webhookAuthorized(r, a.Name())
+		}
+		if err != nil {
+			logger.Error("failed to verify webhook", slog.String("adapter", a.Name()), slog.Any("error", err))
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if !authorized {
+			authorized = slices.ContainsFunc(s.acceptedKeys(ScopeWrite), func(key string) bool { return a.Authorize(r, key) })
+		}
+		if !authorized {
+			// hashed keys can only be checked in the X-Secret-Key header
+			_, authorized = s.resolveHashedKey(r.Context(), r.Header.Get("X-Secret-Key"), ScopeWrite)
+		}
+		if !authorized {
+			reason := ingest.RejectInvalid
+			if wh, ok := s.webhooks()[a.Name()]; r.Header.Get("X-Secret-Key") == "" && (!ok || !wh.Present(r)) {
+				reason = ingest.RejectMissing
+			}
+			ingest.Rejected(a.Name(), reason)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		b, err := a.Parse(r)
+		if err != nil {
+			logger.Error("failed to parse readings", slog.String("adapter", a.Name()), slog.Any("error", err))
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Bad request: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		// a device's key only writes its own readings
+		if device := s.keyDevice(r); device != "" {
+			if b.Device != "" && b.Device != device {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			b.Device = device
+		}
+		result, err := s.ingest.Ingest(r.Context(), a.Name(), b)
+		if err != nil {
+			s.writeIngestError(w, logger, err)
+			return
+		}
+		s.recordFirmware(r, b.Device, "")
+		logger.Info("Received temperature readings",
+			slog.String("adapter", a.Name()),
+			slog.String("device", b.Device),
+			slog.Int("count", len(result.Stored)),
+			slog.Int("duplicates", result.Duplicates),
+		)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"inserted": len(result.Stored), "duplicates": result.Duplicates})
+	}
+}
+
+// writeIngestError responds to readings the ingest pipeline rejected.
+func (s *server) writeIngestError(w http.ResponseWriter, logger *slog.Logger, err error) {
+	var validationErr *ingest.ValidationError
+	switch {
+	case errors.Is(err, ingest.ErrBatchTooLarge):
+		http.Error(w, fmt.Sprintf("Batch too large, at most %d readings", maxBatchSize), http.StatusRequestEntityTooLarge)
+	case errors.As(err, &validationErr):
+		http.Error(w, "Bad request: "+err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, ingest.ErrPaused):
+		s.writePaused(w)
+	default:
+		writeStoreError(w, logger, err, "Failed to insert temperature readings")
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// DefaultKeyGracePeriod is how long the previous secret key keeps working
+// after a rotation unless Config.KeyGracePeriod says otherwise.
+const DefaultKeyGracePeriod = 24 * time.Hour
+
+// minKeyLength is the shortest key POST /admin/rotate-key installs.
+const minKeyLength = 16
+
+// keyring holds the current secret key and the one it replaced, which is
+// accepted until previousUntil so devices can be moved over one by one.
+type keyring struct {
+	mu sync.Mutex
+	// source is the key last seen in the config; when it changes, e.g. a
+	// Vault rotation, it replaces the current key.
+	source        string
+	current       string
+	previous      string
+	previousUntil time.Time
+}
+
+// rotate must be called with mu held.
+func (k *keyring) rotate(key string, until time.Time) {
+	if key == k.current {
+		return
+	}
+	k.previous, k.previousUntil, k.current = k.current, until, key
+}
+
+// secretKeys returns the accepted secret keys, the current one first.
+func (s *server) secretKeys() []string {
+	s.keys.mu.Lock()
+	defer s.keys.mu.Unlock()
+	now := time.Now()
+	if src := s.configuredKey(); src != s.keys.source {
+		s.keys.source = src
+		s.keys.rotate(src, now.Add(s.cfg.KeyGracePeriod))
+	}
+	if s.keys.previous != "" && now.Before(s.keys.previousUntil) {
+		return []string{s.keys.current, s.keys.previous}
+	}
+	return []string{s.keys.current}
+}
+
+// RotateKeyPayload installs Key, or a generated key when it is empty, as
+// the secret key. The old key keeps working for Grace, a Go duration such
+// as "2h", defaulting to the configured grace period.
+type RotateKeyPayload struct {
+	Key   string `json:"key"`
+	Grace string `json:"grace"`
+}
+
+// RotatedKey is the installed key and when the previous one stops working.
+type RotatedKey struct {
+	Key           string `json:"key"`
+	PreviousUntil int64  `json:"previousUntil"`
+}
+
+// rotateKeyHandler replaces the secret key at runtime. Only the current key
+// may rotate it, not one in its grace period.
+func (s *server) rotateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if current := s.secretKeys()[0]; subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Secret-Key")), []byte(current)) != 1 {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var p RotateKeyPayload
+	if err := decodeBody(r, &p); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	grace := s.cfg.KeyGracePeriod
+	if p.Grace != "" {
+		d, err := time.ParseDuration(p.Grace)
+		if err != nil || d < 0 {
+			http.Error(w, "Bad request: grace must be a non-negative duration", http.StatusUnprocessableEntity)
+			return
+		}
+		grace = d
+	}
+	if p.Key == "" {
+		b := make([]byte, 32)
+		rand.Read(b)
+		p.Key = hex.EncodeToString(b)
+	}
+	if len(p.Key) < minKeyLength {
+		http.Error(w, "Bad request: key must be at least 16 characters", http.StatusUnprocessableEntity)
+		return
+	}
+
+	until := time.Now().Add(grace)
+	s.keys.mu.Lock()
+	s.keys.rotate(p.Key, until)
+	s.keys.mu.Unlock()
+	logger.Info("Rotated secret key", slog.Time("previousUntil", until))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RotatedKey{Key: p.Key, PreviousUntil: until.Unix()})
+}
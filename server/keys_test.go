@@ -0,0 +1,427 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func doRequestWithKey(t *testing.T, srv *httptest.Server, key, method, path, body string) *http.Response {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("X-Secret-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestRotateKey(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	reading := `{"tempCo": 40, "tempRoom": 21, "humidity": 50}`
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "wrong", "POST", "/admin/rotate-key", `{}`).StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "POST", "/admin/rotate-key", `{"key": "short"}`).StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "POST", "/admin/rotate-key", `{"grace": "soon"}`).StatusCode)
+
+	resp := doRequest(t, srv, "POST", "/admin/rotate-key", `{"grace": "1h"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var rotated RotatedKey
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&rotated))
+	assert.Len(t, rotated.Key, 64)
+	assert.InDelta(t, time.Now().Add(time.Hour).Unix(), rotated.PreviousUntil, 5)
+
+	// both keys work during the grace period, only the new one rotates
+	assert.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/data", reading).StatusCode)
+	assert.Equal(t, http.StatusOK, doRequestWithKey(t, srv, rotated.Key, "POST", "/data", reading).StatusCode)
+	assert.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/ingest/line", "room tempRoom=21").StatusCode)
+	assert.Equal(t, http.StatusForbidden, doRequest(t, srv, "POST", "/admin/rotate-key", `{}`).StatusCode)
+
+	// without a grace period the old key stops working at once
+	resp = doRequestWithKey(t, srv, rotated.Key, "POST", "/admin/rotate-key", `{"key": "0123456789abcdef", "grace": "0s"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, rotated.Key, "POST", "/data", reading).StatusCode)
+	assert.Equal(t, http.StatusOK, doRequestWithKey(t, srv, "0123456789abcdef", "POST", "/data", reading).StatusCode)
+}
+
+func TestRotateKeyFromConfig(t *testing.T) {
+	var key atomic.Value
+	key.Store("testsecret")
+	srv := httptest.NewServer(NewServer(Config{
+		SecretKeyFunc:  func() string { return key.Load().(string) },
+		KeyGracePeriod: time.Hour,
+	}, memory.New()))
+	defer srv.Close()
+
+	reading := `{"tempCo": 40, "tempRoom": 21, "humidity": 50}`
+	key.Store("rotatedsecret")
+	assert.Equal(t, http.StatusOK, doRequestWithKey(t, srv, "rotatedsecret", "POST", "/data", reading).StatusCode)
+	assert.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/data", reading).StatusCode)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "other", "POST", "/data", reading).StatusCode)
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	const (
+		grafana = "grafana-0123456789"
+		attic   = "attic-0123456789"
+		ops     = "ops-0123456789"
+	)
+	srv := httptest.NewServer(NewServer(Config{
+		SecretKey: "testsecret",
+		APIKeys: []APIKey{
+			{Name: "grafana", Key: grafana, Scopes: []string{ScopeRead}},
+			{Name: "attic", Key: attic, Scopes: []string{ScopeWrite}},
+			{Name: "ops", Key: ops, Scopes: []string{ScopeAdmin}},
+		},
+		RequireReadKey: true,
+	}, memory.New()))
+	defer srv.Close()
+
+	reading := `{"tempCo": 40, "tempRoom": 21, "humidity": 50}`
+	rule := `{"name": "boiler hot", "field": "tempCo", "op": "gt", "threshold": 70}`
+	for _, tc := range []struct {
+		key, method, path, body string
+		want                    int
+	}{
+		{"", "GET", "/data", "", http.StatusForbidden},
+		{grafana, "GET", "/data", "", http.StatusOK},
+		{attic, "GET", "/data", "", http.StatusForbidden},
+		{ops, "GET", "/data", "", http.StatusOK},
+		{"testsecret", "GET", "/data/aggregate", "", http.StatusOK},
+		{grafana, "POST", "/data", reading, http.StatusForbidden},
+		{attic, "POST", "/data", reading, http.StatusOK},
+		{attic, "POST", "/ingest/line", "room tempRoom=21", http.StatusOK},
+		{grafana, "POST", "/ingest/line", "room tempRoom=21", http.StatusForbidden},
+		{attic, "GET", "/devices/attic/commands", "", http.StatusOK},
+		{attic, "POST", "/alerts/rules", rule, http.StatusForbidden},
+		{ops, "POST", "/alerts/rules", rule, http.StatusCreated},
+		{ops, "POST", "/data", reading, http.StatusOK},
+		{"", "GET", "/health", "", http.StatusOK},
+		{"", "GET", "/", "", http.StatusOK},
+	} {
+		resp := doRequestWithKey(t, srv, tc.key, tc.method, tc.path, tc.body)
+		assert.Equal(t, tc.want, resp.StatusCode, "%s %s with %q", tc.method, tc.path, tc.key)
+	}
+}
+
+func TestAPIKeysOptionalForReads(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusOK, doRequestWithKey(t, srv, "", "GET", "/data", "").StatusCode)
+}
+
+func TestValidateAPIKeys(t *testing.T) {
+	assert.NoError(t, ValidateAPIKeys([]APIKey{{Name: "grafana", Key: "0123456789abcdef", Scopes: []string{ScopeRead}}}))
+	assert.Error(t, ValidateAPIKeys([]APIKey{{Key: "0123456789abcdef", Scopes: []string{ScopeRead}}}))
+	assert.Error(t, ValidateAPIKeys([]APIKey{{Name: "grafana", Key: "short", Scopes: []string{ScopeRead}}}))
+	assert.Error(t, ValidateAPIKeys([]APIKey{{Name: "grafana", Key: "0123456789abcdef", Scopes: []string{"root"}}}))
+	assert.Error(t, ValidateAPIKeys([]APIKey{{Name: "grafana", Key: "0123456789abcdef"}}))
+	assert.NoError(t, ValidateAPIKeys([]APIKey{{Name: "grafana", Hash: "$2a$04$wQ3gYGbnGhqUiqEqT6.mIuTgU4Wf3cD3xbxYoQ3O3Zx1Iw7rMzGfC", Scopes: []string{ScopeRead}}}))
+	assert.Error(t, ValidateAPIKeys([]APIKey{{Name: "grafana", Hash: "0123456789abcdef", Scopes: []string{ScopeRead}}}))
+	assert.Error(t, ValidateAPIKeys([]APIKey{{Name: "grafana", Key: "0123456789abcdef", Hash: "$2a$04$wQ3gYGbnGhqUiqEqT6.mIuTgU4Wf3cD3xbxYoQ3O3Zx1Iw7rMzGfC", Scopes: []string{ScopeRead}}}))
+	assert.Error(t, ValidateAPIKeys([]APIKey{
+		{Name: "grafana", Key: "0123456789abcdef", Scopes: []string{ScopeRead}},
+		{Name: "grafana", Key: "fedcba9876543210", Scopes: []string{ScopeRead}},
+	}))
+}
+
+func TestStoredAPIKeys(t *testing.T) {
+	hash, err := HashKey("grafana-0123456789")
+	require.NoError(t, err)
+	srv := httptest.NewServer(NewServer(Config{
+		SecretKey:      "testsecret",
+		APIKeys:        []APIKey{{Name: "grafana", Hash: hash, Scopes: []string{ScopeRead}}},
+		RequireReadKey: true,
+	}, memory.New()))
+	defer srv.Close()
+
+	// a key hashed in the config
+	assert.Equal(t, http.StatusOK, doRequestWithKey(t, srv, "grafana-0123456789", "GET", "/data", "").StatusCode)
+	assert.Equal(t, http.StatusOK, doRequestWithKey(t, srv, "grafana-0123456789", "GET", "/data", "").StatusCode)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "grafana-0123456789", "POST", "/data", `{"tempCo": 40}`).StatusCode)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, hash, "GET", "/data", "").StatusCode)
+
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "attic-0123456789", "POST", "/admin/api-keys", `{"name": "attic", "scopes": ["write"]}`).StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "POST", "/admin/api-keys", `{"name": "attic", "scopes": ["root"]}`).StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "POST", "/admin/api-keys", `{"name": "attic", "key": "`+strings.Repeat("k", 73)+`", "scopes": ["write"]}`).StatusCode)
+	resp := doRequest(t, srv, "POST", "/admin/api-keys", `{"name": "attic", "key": "attic-0123456789", "scopes": ["write"]}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var created StoredKey
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	// the key given is prefixed with the stored key's ID
+	assert.Regexp(t, `^[0-9a-f]{12}\.attic-0123456789$`, created.Key)
+	attic := created.Key
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "attic-0123456789", "POST", "/data", `{"tempCo": 40}`).StatusCode)
+	assert.Equal(t, http.StatusConflict, doRequest(t, srv, "POST", "/admin/api-keys", `{"name": "attic", "scopes": ["write"]}`).StatusCode)
+	resp = doRequest(t, srv, "POST", "/admin/api-keys", `{"name": "ops", "scopes": ["admin"]}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var ops StoredKey
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&ops))
+	assert.Regexp(t, `^[0-9a-f]{12}\.[0-9a-f]{64}$`, ops.Key)
+
+	// keys are only shown when created
+	resp = doRequestWithKey(t, srv, ops.Key, "GET", "/admin/api-keys", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var listed []StoredKey
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&listed))
+	require.Len(t, listed, 2)
+	assert.Equal(t, "attic", listed[0].Name)
+	assert.Empty(t, listed[0].Key)
+	assert.Equal(t, []string{ScopeWrite}, listed[0].Scopes)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, attic, "GET", "/admin/api-keys", "").StatusCode)
+
+	reading := `{"tempCo": 40, "tempRoom": 21, "humidity": 50}`
+	assert.Equal(t, http.StatusOK, doRequestWithKey(t, srv, attic, "POST", "/data", reading).StatusCode)
+	assert.Equal(t, http.StatusOK, doRequestWithKey(t, srv, attic, "POST", "/ingest/line", "room tempRoom=21").StatusCode)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, attic, "GET", "/data", "").StatusCode)
+
+	// a revoked key stops working at once
+	assert.Equal(t, http.StatusNoContent, doRequestWithKey(t, srv, ops.Key, "DELETE", "/admin/api-keys/attic", "").StatusCode)
+	assert.Equal(t, http.StatusNotFound, doRequestWithKey(t, srv, ops.Key, "DELETE", "/admin/api-keys/attic", "").StatusCode)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, attic, "POST", "/data", reading).StatusCode)
+}
+
+func TestStoredAPIKeysNotSupported(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, struct{ store.Store }{memory.New()}))
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusNotImplemented, doRequest(t, srv, "GET", "/admin/api-keys", "").StatusCode)
+}
+
+// slowKeyStore blocks listing the API keys, but the first time, until
+// release is closed.
+type slowKeyStore struct {
+	*memory.Store
+	lists   atomic.Int32
+	release chan struct{}
+}
+
+func (s *slowKeyStore) ListAPIKeys(ctx context.Context) ([]store.APIKey, error) {
+	if s.lists.Add(1) > 1 {
+		<-s.release
+	}
+	return s.Store.ListAPIKeys(ctx)
+}
+
+func TestStoredKeysReadUnlocked(t *testing.T) {
+	st := &slowKeyStore{Store: memory.New(), release: make(chan struct{})}
+	require.NoError(t, st.CreateAPIKey(t.Context(), store.APIKey{Name: "attic", Hash: "$2a$04$wQ3gYGbnGhqUiqEqT6.mIuTgU4Wf3cD3xbxYoQ3O3Zx1Iw7rMzGfC", Scopes: []string{ScopeWrite}}))
+	s := &server{store: st}
+	require.Len(t, s.storedKeys(t.Context()), 1)
+
+	s.forgetStoredKeys()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.storedKeys(t.Context())
+	}()
+	require.Eventually(t, func() bool { return st.lists.Load() == 2 }, time.Second, time.Millisecond)
+	// the slow read doesn't hold up others, which use the keys read before
+	assert.Len(t, s.storedKeys(t.Context()), 1)
+	close(st.release)
+	<-done
+}
+
+func TestRejectedKeysRemembered(t *testing.T) {
+	hash, err := HashKey("attic-0123456789")
+	require.NoError(t, err)
+	st := memory.New()
+	s := &server{cfg: Config{APIKeys: []APIKey{{Name: "attic", Hash: hash, Scopes: []string{ScopeWrite}}}}, store: st}
+
+	_, ok := s.resolveHashedKey(t.Context(), "cellar-0123456789", ScopeWrite)
+	assert.False(t, ok)
+	assert.Len(t, s.hashed.rejected, 1)
+	_, ok = s.resolveHashedKey(t.Context(), "cellar-0123456789", ScopeWrite)
+	assert.False(t, ok)
+
+	// a rejected key is checked again once it's added
+	hash, err = HashKey("cellar-0123456789")
+	require.NoError(t, err)
+	require.NoError(t, st.CreateAPIKey(t.Context(), store.APIKey{Name: "cellar", Hash: hash, Scopes: []string{ScopeWrite}}))
+	s.forgetStoredKeys()
+	k, ok := s.resolveHashedKey(t.Context(), "cellar-0123456789", ScopeWrite)
+	assert.True(t, ok)
+	assert.Equal(t, "cellar", k.name)
+}
+
+func TestStoredKeysFoundByID(t *testing.T) {
+	st := memory.New()
+	s := &server{store: st}
+	for _, name := range []string{"attic", "cellar"} {
+		id, _, hash, err := hashStoredKey(name + "-0123456789")
+		require.NoError(t, err)
+		require.NoError(t, st.CreateAPIKey(t.Context(), store.APIKey{Name: name, ID: id, Hash: hash, Scopes: []string{ScopeWrite}}))
+	}
+	keys := s.storedKeys(t.Context())
+
+	k, ok := s.resolveHashedKey(t.Context(), keys[0].ID+".attic-0123456789", ScopeWrite)
+	assert.True(t, ok)
+	assert.Equal(t, "attic", k.name)
+	// a wrong secret is only compared with the hash of the key of its ID
+	_, ok = s.resolveHashedKey(t.Context(), keys[1].ID+".attic-0123456789", ScopeWrite)
+	assert.False(t, ok)
+	assert.Equal(t, map[[sha256.Size]byte][sha256.Size]byte{
+		sha256.Sum256([]byte(keys[1].ID + ".attic-0123456789")): hashesDigest([]string{keys[1].Hash}),
+	}, s.hashed.rejected)
+	// and a key of no stored ID with none
+	_, ok = s.resolveHashedKey(t.Context(), "0123456789ab.attic-0123456789", ScopeWrite)
+	assert.False(t, ok)
+	assert.Len(t, s.hashed.rejected, 1)
+}
+
+func TestPayloadKeys(t *testing.T) {
+	key := PayloadKey{ID: "attic-1", Device: "attic", Key: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"}
+	st := memory.New()
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret", PayloadKeys: []PayloadKey{key}}, st))
+	defer srv.Close()
+	post := func(k PayloadKey, path string, body []byte) int {
+		req, err := http.NewRequest("POST", srv.URL+path, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(PayloadKeyHeader, k.ID)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	seal := func(k PayloadKey, body string) []byte {
+		sealed, err := SealPayload(k, []byte(body))
+		require.NoError(t, err)
+		return sealed
+	}
+
+	// a sealed body authorizes writing the key's device's readings
+	assert.Equal(t, http.StatusOK, post(key, "/data", seal(key, `{"tempCo": 40, "tempRoom": 21, "humidity": 50}`)))
+	assert.Equal(t, http.StatusOK, post(key, "/sync", seal(key, `{"device": "attic", "readings": [{"seq": 1, "tempCo": 41}]}`)))
+	assert.Equal(t, http.StatusForbidden, post(key, "/sync", seal(key, `{"device": "boiler", "readings": [{"seq": 1, "tempCo": 41}]}`)))
+	readings, err := st.ListReadings(context.Background(), 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 2)
+	for _, r := range readings {
+		assert.Equal(t, "attic", r.Device)
+	}
+
+	// tampered bodies, other keys and unknown key ids are refused
+	sealed := seal(key, `{"tempCo": 40, "tempRoom": 21, "humidity": 50}`)
+	sealed[len(sealed)-1] ^= 1
+	assert.Equal(t, http.StatusForbidden, post(key, "/data", sealed))
+	other := PayloadKey{ID: key.ID, Key: "0f0e0d0c0b0a09080706050403020100"}
+	assert.Equal(t, http.StatusForbidden, post(key, "/data", seal(other, `{"tempCo": 40}`)))
+	assert.Equal(t, http.StatusForbidden, post(PayloadKey{ID: "unknown"}, "/data", []byte("x")))
+	assert.Equal(t, http.StatusForbidden, post(key, "/data", []byte("short")))
+	// also to the adapters, for the key's device only
+	assert.Equal(t, http.StatusOK, post(key, "/ingest/line", seal(key, "temp,device=attic tempCo=40,tempRoom=21,humidity=50")))
+	assert.Equal(t, http.StatusForbidden, post(key, "/ingest/line", seal(key, "temp,device=boiler tempCo=40,tempRoom=21,humidity=50")))
+	assert.Equal(t, http.StatusOK, post(key, "/metrics/job/attic", seal(key, "temp_room 21\nhumidity 50\n")))
+	// it only authorizes writes
+	assert.Equal(t, http.StatusForbidden, post(key, "/data/import", seal(key, `{"device": "attic", "readings": []}`)))
+
+	// replayed and stale bodies are refused
+	sealed = seal(key, `{"tempCo": 42}`)
+	assert.Equal(t, http.StatusOK, post(key, "/data", sealed))
+	assert.Equal(t, http.StatusForbidden, post(key, "/data", sealed))
+	for _, at := range []time.Time{time.Now().Add(-payloadWindow - time.Minute), time.Now().Add(payloadWindow + time.Minute)} {
+		stale, err := sealPayloadAt(key, []byte(`{"tempCo": 43}`), at)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusForbidden, post(key, "/data", stale))
+	}
+	readings, err = st.ListReadings(context.Background(), 10, 0)
+	require.NoError(t, err)
+	assert.Len(t, readings, 5)
+	for _, r := range readings {
+		assert.Equal(t, "attic", r.Device)
+	}
+
+	assert.NoError(t, ValidatePayloadKeys([]PayloadKey{key}))
+	assert.Error(t, ValidatePayloadKeys([]PayloadKey{key, key}))
+	assert.Error(t, ValidatePayloadKeys([]PayloadKey{{ID: "a", Device: "attic", Key: "0102"}}))
+	assert.Error(t, ValidatePayloadKeys([]PayloadKey{{ID: "a", Key: key.Key}}))
+}
+
+func TestReadTokens(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret", RequireReadKey: true}, memory.New()))
+	defer srv.Close()
+
+	for seq, r := range []struct {
+		device string
+		ts     int64
+	}{{"attic", 1761386400}, {"boiler", 1761386460}, {"attic", 1761390000}} {
+		body, err := json.Marshal(map[string]any{"device": r.device, "readings": []map[string]any{{"seq": seq + 1, "tempRoom": 20, "humidity": 50, "timestamp": r.ts}}})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/sync", string(body)).StatusCode)
+	}
+
+	mint := `{"device": "attic", "from": 1761386000, "to": 1761387000, "ttl": "5m"}`
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "", "POST", "/tokens", mint).StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "POST", "/tokens", `{"ttl": "48h"}`).StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "POST", "/tokens", `{"from": 10, "to": 5}`).StatusCode)
+	resp := doRequest(t, srv, "POST", "/tokens", mint)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var minted MintedToken
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&minted))
+	assert.InDelta(t, time.Now().Add(5*time.Minute).Unix(), minted.ExpiresAt, 5)
+
+	withToken := func(method, path, token string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// only the device's readings within the range
+	resp = withToken("GET", "/data", minted.Token)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var readings []store.TemperatureReading
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&readings))
+	require.Len(t, readings, 1)
+	assert.Equal(t, "attic", readings[0].Device)
+	assert.Equal(t, int64(1761386400), *readings[0].Timestamp)
+
+	resp = doRequestWithKey(t, srv, "", "GET", "/data?token="+minted.Token, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, http.StatusOK, withToken("GET", "/data/aggregate?from=1761386000&to=1761400000", minted.Token).StatusCode)
+
+	// read-only, on the reading endpoints only, and not forgeable
+	assert.Equal(t, http.StatusForbidden, withToken("GET", "/alerts", minted.Token).StatusCode)
+	assert.Equal(t, http.StatusForbidden, withToken("POST", "/data", minted.Token).StatusCode)
+	assert.Equal(t, http.StatusForbidden, withToken("GET", "/data", minted.Token+"x").StatusCode)
+	assert.Equal(t, http.StatusForbidden, withToken("GET", "/data", signToken(ReadToken{ExpiresAt: minted.ExpiresAt}, "guessed")).StatusCode)
+
+	// unrestricted tokens see everything
+	resp = withToken("GET", "/data", signToken(ReadToken{ExpiresAt: minted.ExpiresAt}, "testsecret"))
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&readings))
+	assert.Len(t, readings, 3)
+}
+
+func TestVerifyToken(t *testing.T) {
+	now := time.Unix(1761386400, 0)
+	token := signToken(ReadToken{Device: "attic", ExpiresAt: now.Unix() + 60}, "oldsecret")
+
+	got, err := verifyToken(token, []string{"newsecret", "oldsecret"}, now)
+	require.NoError(t, err)
+	assert.Equal(t, "attic", got.Device)
+
+	_, err = verifyToken(token, []string{"newsecret"}, now)
+	assert.Error(t, err)
+	_, err = verifyToken(token, []string{"oldsecret"}, now.Add(time.Minute))
+	assert.Error(t, err)
+	_, err = verifyToken("garbage", []string{"oldsecret"}, now)
+	assert.Error(t, err)
+}
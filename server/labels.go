@@ -0,0 +1,313 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// labelKeyPattern is what Prometheus allows in label names.
+var labelKeyPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// DeviceLabels is a device with its labels.
+type DeviceLabels struct {
+	Device string            `json:"device"`
+	Labels map[string]string `json:"labels"`
+}
+
+// readingLister pages through readings like store.Store.ListReadings.
+type readingLister func(ctx context.Context, limit, offset int) ([]store.TemperatureReading, error)
+
+// parseSelection parses what selects readings on a read endpoint: the smooth
+// window, label selectors, label=key:value, matching devices with all of
+// them, a location, matching the devices in it and its descendants, and a
+// single device, the qualities, and the order, by timestamp or receivedAt. filters, if
+// any, are applied too, as are the device and time range of the read token
+// that authorized the request. It returns how to list the selected
+// readings, or responds with an error.
+func (s *server) parseSelection(w http.ResponseWriter, r *http.Request, filters []store.ReadingFilter) (readingLister, bool) {
+	sel, ok := s.parseReadingQuery(w, r, filters)
+	if !ok {
+		return nil, false
+	}
+	return s.lister(sel), true
+}
+
+// lister returns how to list the readings of sel.
+func (s *server) lister(sel selection) readingLister {
+	switch {
+	case sel.half > 0:
+		ss := s.store.(store.SmoothingStore)
+		return func(ctx context.Context, limit, offset int) ([]store.TemperatureReading, error) {
+			return ss.ListSmoothedReadings(ctx, limit, offset, sel.half)
+		}
+	case sel.query != nil:
+		fs := s.store.(store.FilterStore)
+		return func(ctx context.Context, limit, offset int) ([]store.TemperatureReading, error) {
+			return fs.ListFilteredReadings(ctx, *sel.query, limit, offset)
+		}
+	}
+	return s.store.ListReadings
+}
+
+// selection is what parseReadingQuery parsed: the readings smoothed over
+// twice half seconds when half isn't 0, those of query when it isn't nil,
+// or else all of them.
+type selection struct {
+	half  int64
+	query *store.ReadingQuery
+}
+
+// parseReadingQuery parses what parseSelection does into a selection.
+func (s *server) parseReadingQuery(w http.ResponseWriter, r *http.Request, filters []store.ReadingFilter) (selection, bool) {
+	q := r.URL.Query()
+	half, ok := s.parseSmooth(w, q)
+	if !ok {
+		return selection{}, false
+	}
+	devices, ok := s.labelDevices(w, r)
+	if !ok {
+		return selection{}, false
+	}
+	inLocation, ok := s.locationDevices(w, r)
+	if !ok {
+		return selection{}, false
+	}
+	if inLocation != nil {
+		if devices != nil {
+			inLocation = slices.DeleteFunc(inLocation, func(d string) bool { return !slices.Contains(devices, d) })
+		}
+		devices = inLocation
+	}
+	_, canFilter := s.store.(store.FilterStore)
+	order := q.Get("order")
+	switch order {
+	case "", store.OrderTimestamp:
+		order = ""
+	case store.OrderReceivedAt:
+		if !canFilter {
+			http.Error(w, "Ordering by receivedAt is not supported by this storage backend", http.StatusNotImplemented)
+			return selection{}, false
+		}
+	default:
+		http.Error(w, "Bad request: order must be "+store.OrderTimestamp+" or "+store.OrderReceivedAt, http.StatusUnprocessableEntity)
+		return selection{}, false
+	}
+	var qualities []string
+	if v := q.Get("quality"); v != "" {
+		if !canFilter {
+			http.Error(w, "Selecting qualities is not supported by this storage backend", http.StatusNotImplemented)
+			return selection{}, false
+		}
+		qualities = strings.Split(v, ",")
+		for _, quality := range qualities {
+			if !slices.Contains(store.Qualities, quality) {
+				http.Error(w, "Bad request: quality must be one of "+strings.Join(store.Qualities, ", "), http.StatusUnprocessableEntity)
+				return selection{}, false
+			}
+		}
+	}
+	if device := q.Get("device"); device != "" {
+		if !canFilter {
+			http.Error(w, "Selecting devices is not supported by this storage backend", http.StatusNotImplemented)
+			return selection{}, false
+		}
+		devices = onlyDevice(devices, device)
+	}
+	if t, ok := readTokenFrom(r.Context()); ok {
+		if !canFilter && (t.Device != "" || len(t.filters()) > 0) {
+			http.Error(w, "Restricted read tokens are not supported by this storage backend", http.StatusNotImplemented)
+			return selection{}, false
+		}
+		filters = append(slices.Clip(filters), t.filters()...)
+		if t.Device != "" {
+			devices = onlyDevice(devices, t.Device)
+		}
+	}
+	selected := devices != nil || len(filters) > 0 || qualities != nil || order != ""
+	switch {
+	case selected && half > 0:
+		http.Error(w, "Bad request: smooth can't be combined with filters, quality, order, labels, location, device or a restricted read token", http.StatusUnprocessableEntity)
+		return selection{}, false
+	case selected:
+		return selection{query: &store.ReadingQuery{Filters: filters, Devices: devices, Qualities: qualities, Order: order}}, true
+	}
+	return selection{half: half}, true
+}
+
+// onlyDevice narrows the selected devices, nil for any, to device.
+func onlyDevice(devices []string, device string) []string {
+	if devices == nil {
+		return []string{device}
+	}
+	return slices.DeleteFunc(devices, func(d string) bool { return d != device })
+}
+
+// labelDevices returns the devices matching the label query parameters,
+// nil when there are none. It responds with 422 when a selector is
+// invalid and with 501 when the store can't select by label.
+func (s *server) labelDevices(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	logger := slogctx.FromCtx(r.Context())
+
+	selectors := r.URL.Query()["label"]
+	if len(selectors) == 0 {
+		return nil, true
+	}
+	want := make(map[string]string, len(selectors))
+	for _, sel := range selectors {
+		key, value, ok := strings.Cut(sel, ":")
+		if !ok || !labelKeyPattern.MatchString(key) || value == "" {
+			http.Error(w, "Bad request: label must be key:value", http.StatusUnprocessableEntity)
+			return nil, false
+		}
+		want[key] = value
+	}
+	ls, ok := s.store.(store.LabelStore)
+	if _, filters := s.store.(store.FilterStore); !ok || !filters {
+		http.Error(w, "Device labels are not supported by this storage backend", http.StatusNotImplemented)
+		return nil, false
+	}
+	labels, err := ls.DeviceLabels(r.Context())
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query device labels")
+		return nil, false
+	}
+	devices := make([]string, 0)
+	for device, l := range labels {
+		if matchLabels(l, want) {
+			devices = append(devices, device)
+		}
+	}
+	sort.Strings(devices)
+	return devices, true
+}
+
+func matchLabels(labels, want map[string]string) bool {
+	for k, v := range want {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// labelStore returns the label store, or responds with 501 when the storage
+// backend doesn't support device labels.
+func (s *server) labelStore(w http.ResponseWriter) (store.LabelStore, bool) {
+	ls, ok := s.store.(store.LabelStore)
+	if !ok {
+		http.Error(w, "Device labels are not supported by this storage backend", http.StatusNotImplemented)
+		return nil, false
+	}
+	return ls, true
+}
+
+// devicesHandler lists the labelled devices, optionally only those matching
+// label selectors.
+func (s *server) devicesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ls, ok := s.labelStore(w)
+	if !ok {
+		return
+	}
+	labels, err := ls.DeviceLabels(r.Context())
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query device labels")
+		return
+	}
+	matching, ok := s.labelDevices(w, r)
+	if !ok {
+		return
+	}
+
+	devices := make([]DeviceLabels, 0, len(labels))
+	for _, device := range slices.Sorted(maps.Keys(labels)) {
+		if matching == nil || slices.Contains(matching, device) {
+			devices = append(devices, DeviceLabels{Device: device, Labels: labels[device]})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices)
+}
+
+// deviceLabelsHandler reads and replaces the labels of a device.
+func (s *server) deviceLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	ls, ok := s.labelStore(w)
+	if !ok {
+		return
+	}
+	device := r.PathValue("device")
+
+	switch r.Method {
+	case http.MethodGet:
+		labels, err := ls.DeviceLabels(r.Context())
+		if err != nil {
+			writeStoreError(w, logger, err, "Failed to query device labels")
+			return
+		}
+		l := labels[device]
+		if l == nil {
+			l = map[string]string{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(DeviceLabels{Device: device, Labels: l})
+
+	case http.MethodPut:
+		if !s.authorized(r, ScopeAdmin) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var labels map[string]string
+		if err := decodeBody(r, &labels); err != nil {
+			writeDecodeError(w, err)
+			return
+		}
+		if err := validateLabels(labels); err != nil {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err := ls.SetDeviceLabels(r.Context(), device, labels); err != nil {
+			writeStoreError(w, logger, err, "Failed to set device labels", "device", device)
+			return
+		}
+		logger.Info("Set device labels", slog.String("device", device), slog.Any("labels", labels))
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(DeviceLabels{Device: device, Labels: labels})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func validateLabels(labels map[string]string) error {
+	var errs []error
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		if !labelKeyPattern.MatchString(key) {
+			errs = append(errs, errors.New("invalid label key "+key))
+		}
+		if labels[key] == "" {
+			errs = append(errs, errors.New("empty value of label "+key))
+		}
+	}
+	return errors.Join(errs...)
+}
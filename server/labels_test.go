@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/aggregate"
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceLabels(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	for device, labels := range map[string]string{
+		"attic":   `{"floor": "1", "type": "room"}`,
+		"bedroom": `{"floor": "1", "type": "room"}`,
+		"boiler":  `{"floor": "0", "type": "boiler"}`,
+	} {
+		resp := doRequest(t, srv, "PUT", "/devices/"+device+"/labels", labels)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	req, err := http.NewRequest("PUT", srv.URL+"/devices/attic/labels", strings.NewReader(`{}`))
+	require.NoError(t, err)
+	unauthorized, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	unauthorized.Body.Close()
+	assert.Equal(t, http.StatusForbidden, unauthorized.StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "PUT", "/devices/attic/labels", `{"floor-no": "1"}`).StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "PUT", "/devices/attic/labels", `{"floor": ""}`).StatusCode)
+
+	resp := doRequest(t, srv, "GET", "/devices?label=floor:1", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var devices []DeviceLabels
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&devices))
+	assert.Equal(t, []DeviceLabels{
+		{Device: "attic", Labels: map[string]string{"floor": "1", "type": "room"}},
+		{Device: "bedroom", Labels: map[string]string{"floor": "1", "type": "room"}},
+	}, devices)
+
+	resp = doRequest(t, srv, "GET", "/devices/garage/labels", "")
+	var labels DeviceLabels
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&labels))
+	assert.Equal(t, DeviceLabels{Device: "garage", Labels: map[string]string{}}, labels)
+
+	sync := func(device string, seq int, room float64, ts int64) {
+		body, err := json.Marshal(map[string]any{"device": device, "readings": []map[string]any{{"seq": seq, "tempRoom": room, "humidity": 50, "timestamp": ts}}})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/sync", string(body)).StatusCode)
+	}
+	sync("attic", 1, 18, 1761386400)
+	sync("bedroom", 1, 22, 1761386460)
+	sync("boiler", 1, 30, 1761386520)
+
+	resp = doRequest(t, srv, "GET", "/data?label=floor:1&label=type:room", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var readings []store.TemperatureReading
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&readings))
+	require.Len(t, readings, 2)
+	assert.Equal(t, "bedroom", readings[0].Device)
+	assert.Equal(t, "attic", readings[1].Device)
+
+	// aggregated across the matching devices
+	resp = doRequest(t, srv, "GET", "/data/aggregate?label=floor:1&from=1761386400&to=1761390000", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var buckets []aggregate.Bucket
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&buckets))
+	require.Len(t, buckets, 1)
+	assert.Equal(t, 2, buckets[0].Count)
+	assert.Equal(t, 20.0, *buckets[0].TempRoom)
+
+	resp = doRequest(t, srv, "GET", "/data?label=floor:7", "")
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&readings))
+	assert.Empty(t, readings)
+
+	for _, query := range []string{"label=floor", "label=floor:1&smooth=15m"} {
+		assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/data?"+query, "").StatusCode, query)
+	}
+}
+
+func TestDeviceDashboard(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	doRequest(t, srv, "POST", "/alerts/rules", `{"name": "boiler hot", "field": "tempCo", "op": "gt", "threshold": 70}`)
+	now := time.Now()
+	seq := 0
+	sync := func(device string, co float64, at time.Time) {
+		seq++
+		body, err := json.Marshal(map[string]any{"device": device, "readings": []map[string]any{
+			{"seq": seq, "tempCo": co, "tempRoom": 21, "humidity": 50, "timestamp": at.Unix()},
+		}})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/sync", string(body)).StatusCode)
+	}
+	sync("boiler", 40, now.Add(-48*time.Hour))
+	for i := 20; i > 0; i-- {
+		sync("boiler", 50+float64(i), now.Add(-time.Duration(i)*time.Hour))
+	}
+	sync("attic", 20, now.Add(-2*time.Hour))
+	sync("boiler", 75, now.Add(-time.Minute))
+
+	resp := doRequest(t, srv, "GET", "/devices/boiler/dashboard?points=10&days=3", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var dashboard DeviceDashboard
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&dashboard))
+	assert.Equal(t, "boiler", dashboard.Device)
+	assert.Equal(t, 75.0, dashboard.Latest.TempCo)
+	assert.Equal(t, now.Add(-time.Minute).Unix(), dashboard.LastSeen)
+	assert.True(t, dashboard.Online)
+	require.Len(t, dashboard.Series, 10)
+	assert.Equal(t, 70.0, dashboard.Series[0].TempCo)
+	assert.Equal(t, 75.0, dashboard.Series[9].TempCo)
+	var count int
+	for _, d := range dashboard.Daily {
+		count += d.Count
+	}
+	assert.Equal(t, 22, count)
+	assert.Equal(t, 40.0, dashboard.Daily[0].TempCo.Min)
+	require.Len(t, dashboard.Alerts, 1)
+	assert.Equal(t, "boiler hot", dashboard.Alerts[0].RuleName)
+
+	resp = doRequest(t, srv, "GET", "/devices/attic/dashboard", "")
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&dashboard))
+	assert.False(t, dashboard.Online)
+	assert.Len(t, dashboard.Series, 1)
+	assert.Empty(t, dashboard.Alerts)
+
+	assert.Equal(t, http.StatusNotFound, doRequest(t, srv, "GET", "/devices/garage/dashboard", "").StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/devices/boiler/dashboard?points=2", "").StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/devices/boiler/dashboard?days=32", "").StatusCode)
+
+	unsupported := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, struct{ store.Store }{memory.New()}))
+	defer unsupported.Close()
+	assert.Equal(t, http.StatusNotImplemented, doRequest(t, unsupported, "GET", "/devices/boiler/dashboard", "").StatusCode)
+}
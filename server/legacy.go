@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/bartosz121/esp8266-web/ingest"
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// legacyFields maps each reading field to the parameter names old sketches
+// send, short names first.
+var legacyFields = struct {
+	tempCo, tempRoom, humidity, timestamp, key []string
+}{
+	tempCo:    []string{"t1", "tempCo"},
+	tempRoom:  []string{"t2", "tempRoom"},
+	humidity:  []string{"h", "humidity"},
+	timestamp: []string{"ts", "timestamp"},
+	key:       []string{"key"},
+}
+
+func formValue(r *http.Request, names []string) string {
+	for _, name := range names {
+		if v := r.Form.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// legacyIngestHandler accepts readings as query parameters on GET or as a
+// form-encoded POST, for sketches that can't build a JSON body, e.g.
+// GET /ingest?t1=25.5&t2=22.0&h=55&key=secret. The secret may be passed as
+// the key parameter or the X-Secret-Key header.
+func (s *server) legacyIngestHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if key := formValue(r, legacyFields.key); key != "" {
+		r.Header.Set("X-Secret-Key", key)
+	}
+	if !s.authorized(r, ScopeWrite) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var tr store.TemperatureReading
+	var err error
+	parse := func(names []string, required bool) float64 {
+		v := formValue(r, names)
+		if v == "" {
+			if required && err == nil {
+				err = &legacyParamError{name: names[0]}
+			}
+			return 0
+		}
+		f, parseErr := strconv.ParseFloat(v, 64)
+		if parseErr != nil && err == nil {
+			err = &legacyParamError{name: names[0]}
+		}
+		return f
+	}
+	tr.TempCo = parse(legacyFields.tempCo, true)
+	tr.TempRoom = parse(legacyFields.tempRoom, true)
+	tr.Humidity = parse(legacyFields.humidity, false)
+	if v := formValue(r, legacyFields.timestamp); v != "" {
+		ts, parseErr := strconv.ParseInt(v, 10, 64)
+		if parseErr != nil && err == nil {
+			err = &legacyParamError{name: legacyFields.timestamp[0]}
+		}
+		tr.Timestamp = &ts
+	}
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	logger.Info("Received legacy temperature reading",
+		slog.Any("data", tr),
+	)
+	result, err := s.ingest.Ingest(r.Context(), "legacy", ingest.Batch{Device: s.keyDevice(r), Readings: []store.TemperatureReading{tr}})
+	if err != nil {
+		s.writeIngestError(w, logger, err)
+		return
+	}
+	if len(result.Stored) > 0 {
+		tr = result.Stored[0]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tr)
+}
+
+type legacyParamError struct {
+	name string
+}
+
+func (e *legacyParamError) Error() string {
+	return "missing or invalid parameter " + e.name
+}
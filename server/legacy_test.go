@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLegacyIngestHandler(t *testing.T) {
+	s, st := newTestServer("testsecret")
+
+	req := httptest.NewRequest("GET", "/ingest?t1=25.5&t2=22.0&h=55&ts=1761388101&key=testsecret", nil)
+	w := httptest.NewRecorder()
+	s.legacyIngestHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	form := url.Values{"tempCo": {"26"}, "tempRoom": {"23"}}
+	req = httptest.NewRequest("POST", "/ingest", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w = httptest.NewRecorder()
+	s.legacyIngestHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	readings, err := st.ListReadings(context.Background(), 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 2)
+	legacy := readings[1]
+	assert.Equal(t, 25.5, legacy.TempCo)
+	assert.Equal(t, 22.0, legacy.TempRoom)
+	assert.Equal(t, 55.0, legacy.Humidity)
+	assert.Equal(t, int64(1761388101), *legacy.Timestamp)
+}
+
+func TestLegacyIngestHandlerErrors(t *testing.T) {
+	s, _ := newTestServer("testsecret")
+
+	tests := []struct {
+		query string
+		code  int
+	}{
+		{"t1=25.5&t2=22.0&key=wrong", http.StatusForbidden},
+		{"t1=25.5&key=testsecret", http.StatusUnprocessableEntity},
+		{"t1=warm&t2=22.0&key=testsecret", http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/ingest?"+tt.query, nil)
+		w := httptest.NewRecorder()
+		s.legacyIngestHandler(w, req)
+		assert.Equal(t, tt.code, w.Code, tt.query)
+	}
+}
+
+func TestLegacyIngestDisabledByDefault(t *testing.T) {
+	st := memory.New()
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, st))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/ingest?t1=25.5&t2=22.0&key=testsecret")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	readings, err := st.ListReadings(context.Background(), 10, 0)
+	require.NoError(t, err)
+	assert.Empty(t, readings)
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// defaultSummaryMaxAge is how old a device's latest reading may be to count
+// towards a location summary unless maxAge says otherwise.
+const defaultSummaryMaxAge = time.Hour
+
+// LocationSummary is the current state of a location, averaged over the
+// latest reading of every device placed in it or its descendants.
+type LocationSummary struct {
+	Location store.Location `json:"location"`
+	// Devices are placed in the location or its descendants.
+	Devices []string `json:"devices"`
+	// Readings are the devices' latest readings no older than maxAge, the
+	// ones averaged.
+	Readings []store.TemperatureReading `json:"readings"`
+	// TempCo, TempRoom and Humidity are nil when there are no Readings.
+	TempCo   *float64 `json:"tempCo"`
+	TempRoom *float64 `json:"tempRoom"`
+	Humidity *float64 `json:"humidity"`
+}
+
+// locationStore returns the location store, or responds with 501 when the
+// storage backend doesn't support locations.
+func (s *server) locationStore(w http.ResponseWriter) (store.LocationStore, bool) {
+	ls, ok := s.store.(store.LocationStore)
+	if !ok {
+		http.Error(w, "Locations are not supported by this storage backend", http.StatusNotImplemented)
+		return nil, false
+	}
+	return ls, true
+}
+
+func (s *server) locationsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	ls, ok := s.locationStore(w)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		locations, err := ls.ListLocations(r.Context())
+		if err != nil {
+			writeStoreError(w, logger, err, "Failed to query locations")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(locations)
+
+	case http.MethodPost:
+		if !s.authorized(r, ScopeAdmin) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		location, ok := s.decodeLocation(w, r, ls, 0)
+		if !ok {
+			return
+		}
+		location, err := ls.CreateLocation(r.Context(), location)
+		if err != nil {
+			writeStoreError(w, logger, err, "Failed to create location")
+			return
+		}
+		logger.Info("Created location", slog.Int("id", location.Id), slog.String("name", location.Name))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(location)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) locationHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	ls, ok := s.locationStore(w)
+	if !ok {
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var location store.Location
+	switch r.Method {
+	case http.MethodGet:
+		location, err = ls.GetLocation(r.Context(), id)
+
+	case http.MethodPut:
+		if !s.authorized(r, ScopeAdmin) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if location, ok = s.decodeLocation(w, r, ls, id); !ok {
+			return
+		}
+		location.Id = id
+		location, err = ls.UpdateLocation(r.Context(), location)
+
+	case http.MethodDelete:
+		if !s.authorized(r, ScopeAdmin) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if err = ls.DeleteLocation(r.Context(), id); err == nil {
+			logger.Info("Deleted location", slog.Int("id", id))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to access location", "id", id)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(location)
+}
+
+// decodeLocation reads and validates a location from the request body. id
+// is the location being updated, 0 when creating one.
+func (s *server) decodeLocation(w http.ResponseWriter, r *http.Request, ls store.LocationStore, id int) (store.Location, bool) {
+	logger := slogctx.FromCtx(r.Context())
+
+	var location store.Location
+	if err := decodeBody(r, &location); err != nil {
+		logger.Error("failed to decode location", slog.Any("error", err))
+		writeDecodeError(w, err)
+		return location, false
+	}
+	locations, err := ls.ListLocations(r.Context())
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query locations")
+		return location, false
+	}
+	location.Id = id
+	if err := validateLocation(&location, locations); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusUnprocessableEntity)
+		return location, false
+	}
+	return location, true
+}
+
+// validateLocation checks l against the existing locations: a house holds
+// floors and rooms, a floor holds rooms. Its devices are sorted and
+// deduplicated.
+func validateLocation(l *store.Location, locations []store.Location) error {
+	var errs []error
+	if l.Name == "" {
+		errs = append(errs, errors.New("name is required"))
+	}
+	rank := slices.Index(store.LocationKinds, l.Kind)
+	if rank < 0 {
+		errs = append(errs, fmt.Errorf("kind must be one of %v", store.LocationKinds))
+	}
+	if l.ParentId != nil {
+		i := slices.IndexFunc(locations, func(p store.Location) bool { return p.Id == *l.ParentId })
+		switch {
+		case i < 0 || *l.ParentId == l.Id:
+			errs = append(errs, fmt.Errorf("parent %d doesn't exist", *l.ParentId))
+		case rank >= 0 && slices.Index(store.LocationKinds, locations[i].Kind) >= rank:
+			errs = append(errs, fmt.Errorf("a %s can't be inside a %s", l.Kind, locations[i].Kind))
+		}
+	}
+	if l.Id != 0 && rank >= 0 {
+		for _, c := range locations {
+			if c.ParentId != nil && *c.ParentId == l.Id && slices.Index(store.LocationKinds, c.Kind) <= rank {
+				errs = append(errs, fmt.Errorf("a %s can't hold the %s %d", l.Kind, c.Kind, c.Id))
+			}
+		}
+	}
+	if slices.Contains(l.Devices, "") {
+		errs = append(errs, errors.New("device names must not be empty"))
+	}
+	l.Devices = slices.Compact(slices.Sorted(slices.Values(l.Devices)))
+	if l.Devices == nil {
+		l.Devices = []string{}
+	}
+	return errors.Join(errs...)
+}
+
+// subtreeDevices returns the devices placed in the location with id or any
+// of its descendants, sorted.
+func subtreeDevices(locations []store.Location, id int) []string {
+	devices := make([]string, 0)
+	ids := []int{id}
+	for len(ids) > 0 {
+		id, ids = ids[0], ids[1:]
+		for _, l := range locations {
+			if l.Id == id {
+				devices = append(devices, l.Devices...)
+			}
+			if l.ParentId != nil && *l.ParentId == id {
+				ids = append(ids, l.Id)
+			}
+		}
+	}
+	slices.Sort(devices)
+	return devices
+}
+
+// locationDevices returns the devices in the location query parameter's
+// location and its descendants, nil when it isn't given. It responds with
+// 422 when the location doesn't exist and with 501 when the store can't
+// select by location.
+func (s *server) locationDevices(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	logger := slogctx.FromCtx(r.Context())
+
+	v := r.URL.Query().Get("location")
+	if v == "" {
+		return nil, true
+	}
+	id, err := strconv.Atoi(v)
+	if err != nil {
+		http.Error(w, "Bad request: invalid location", http.StatusUnprocessableEntity)
+		return nil, false
+	}
+	ls, ok := s.store.(store.LocationStore)
+	if _, filters := s.store.(store.FilterStore); !ok || !filters {
+		http.Error(w, "Locations are not supported by this storage backend", http.StatusNotImplemented)
+		return nil, false
+	}
+	locations, err := ls.ListLocations(r.Context())
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query locations")
+		return nil, false
+	}
+	if !slices.ContainsFunc(locations, func(l store.Location) bool { return l.Id == id }) {
+		http.Error(w, "Bad request: location doesn't exist", http.StatusUnprocessableEntity)
+		return nil, false
+	}
+	return subtreeDevices(locations, id), true
+}
+
+// locationSummaryHandler averages the latest readings of the devices in a
+// location and its descendants.
+func (s *server) locationSummaryHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ls, ok := s.locationStore(w)
+	if !ok {
+		return
+	}
+	fs, ok := s.store.(store.FilterStore)
+	if !ok {
+		http.Error(w, "Locations are not supported by this storage backend", http.StatusNotImplemented)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	maxAge := defaultSummaryMaxAge
+	if v := r.URL.Query().Get("maxAge"); v != "" {
+		if maxAge, err = time.ParseDuration(v); err != nil || maxAge <= 0 {
+			http.Error(w, "Bad request: maxAge must be a positive duration", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	locations, err := ls.ListLocations(r.Context())
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query locations")
+		return
+	}
+	i := slices.IndexFunc(locations, func(l store.Location) bool { return l.Id == id })
+	if i < 0 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	summary := LocationSummary{
+		Location: locations[i],
+		Devices:  subtreeDevices(locations, id),
+		Readings: make([]store.TemperatureReading, 0),
+	}
+	since := time.Now().Add(-maxAge).Unix()
+	var sum store.TemperatureReading
+	for _, device := range summary.Devices {
+		latest, err := fs.ListFilteredReadings(r.Context(), store.ReadingQuery{Devices: []string{device}}, 1, 0)
+		if err != nil {
+			writeStoreError(w, logger, err, "Failed to query readings", "device", device)
+			return
+		}
+		if len(latest) == 0 || latest[0].Timestamp == nil || *latest[0].Timestamp < since {
+			continue
+		}
+		summary.Readings = append(summary.Readings, latest[0])
+		sum.TempCo += latest[0].TempCo
+		sum.TempRoom += latest[0].TempRoom
+		sum.Humidity += latest[0].Humidity
+	}
+	if n := float64(len(summary.Readings)); n > 0 {
+		tempCo, tempRoom, humidity := sum.TempCo/n, sum.TempRoom/n, sum.Humidity/n
+		summary.TempCo, summary.TempRoom, summary.Humidity = &tempCo, &tempRoom, &humidity
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocations(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	create := func(body string) store.Location {
+		t.Helper()
+		resp := doRequest(t, srv, "POST", "/locations", body)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var l store.Location
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&l))
+		return l
+	}
+	house := create(`{"name": "Home", "kind": "house", "devices": ["porch"]}`)
+	floor := create(fmt.Sprintf(`{"name": "First", "kind": "floor", "parentId": %d}`, house.Id))
+	bedroom := create(fmt.Sprintf(`{"name": "Bedroom", "kind": "room", "parentId": %d, "devices": ["bedroom", "bedroom"]}`, floor.Id))
+	create(fmt.Sprintf(`{"name": "Attic", "kind": "room", "parentId": %d, "devices": ["attic"]}`, floor.Id))
+	assert.Equal(t, []string{"bedroom"}, bedroom.Devices)
+
+	req, err := http.NewRequest("POST", srv.URL+"/locations", strings.NewReader(`{"name": "Shed", "kind": "house"}`))
+	require.NoError(t, err)
+	unauthorized, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	unauthorized.Body.Close()
+	assert.Equal(t, http.StatusForbidden, unauthorized.StatusCode)
+
+	for _, body := range []string{
+		`{"kind": "house"}`,
+		`{"name": "Cellar", "kind": "basement"}`,
+		`{"name": "Hall", "kind": "room", "parentId": 999}`,
+		fmt.Sprintf(`{"name": "Loft", "kind": "floor", "parentId": %d}`, bedroom.Id),
+		`{"name": "Porch", "kind": "room", "devices": [""]}`,
+	} {
+		assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "POST", "/locations", body).StatusCode, body)
+	}
+	// a floor holding rooms can't become a room
+	assert.Equal(t, http.StatusUnprocessableEntity,
+		doRequest(t, srv, "PUT", fmt.Sprintf("/locations/%d", floor.Id), `{"name": "First", "kind": "room"}`).StatusCode)
+	assert.Equal(t, http.StatusNotFound, doRequest(t, srv, "GET", "/locations/999", "").StatusCode)
+
+	now := time.Now().Unix()
+	sync := func(device string, room, humidity float64, ts int64) {
+		body, err := json.Marshal(map[string]any{"device": device, "readings": []map[string]any{{"seq": 1, "tempRoom": room, "humidity": humidity, "timestamp": ts}}})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/sync", string(body)).StatusCode)
+	}
+	sync("bedroom", 21, 40, now-60)
+	sync("attic", 17, 60, now-120)
+	sync("porch", 5, 90, now-2*3600)
+
+	resp := doRequest(t, srv, "GET", fmt.Sprintf("/locations/%d/summary", house.Id), "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var summary LocationSummary
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&summary))
+	assert.Equal(t, []string{"attic", "bedroom", "porch"}, summary.Devices)
+	// porch's reading is older than an hour
+	require.Len(t, summary.Readings, 2)
+	assert.Equal(t, 19.0, *summary.TempRoom)
+	assert.Equal(t, 50.0, *summary.Humidity)
+
+	resp = doRequest(t, srv, "GET", fmt.Sprintf("/locations/%d/summary?maxAge=3h", house.Id), "")
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&summary))
+	assert.Len(t, summary.Readings, 3)
+
+	resp = doRequest(t, srv, "GET", fmt.Sprintf("/locations/%d/summary", bedroom.Id), "")
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&summary))
+	assert.Equal(t, 21.0, *summary.TempRoom)
+
+	// readings selected by location include its descendants
+	resp = doRequest(t, srv, "GET", fmt.Sprintf("/data?location=%d", floor.Id), "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var readings []store.TemperatureReading
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&readings))
+	require.Len(t, readings, 2)
+	assert.Equal(t, "bedroom", readings[0].Device)
+	assert.Equal(t, "attic", readings[1].Device)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/data?location=999", "").StatusCode)
+
+	assert.Equal(t, http.StatusNoContent, doRequest(t, srv, "DELETE", fmt.Sprintf("/locations/%d", floor.Id), "").StatusCode)
+	resp = doRequest(t, srv, "GET", fmt.Sprintf("/locations/%d/summary", house.Id), "")
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&summary))
+	assert.Equal(t, []string{"porch"}, summary.Devices)
+	assert.Nil(t, summary.TempRoom)
+}
+
+func TestLocationsUnsupported(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, struct{ store.Store }{memory.New()}))
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusNotImplemented, doRequest(t, srv, "GET", "/locations", "").StatusCode)
+	assert.Equal(t, http.StatusNotImplemented, doRequest(t, srv, "GET", "/data?location=1", "").StatusCode)
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// Maintenance job statuses.
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// maxMaintenanceJobs is how many finished jobs are remembered.
+const maxMaintenanceJobs = 20
+
+// MaintenanceJob is a maintenance operation running in the background.
+type MaintenanceJob struct {
+	Id        int    `json:"id"`
+	Operation string `json:"operation"`
+	// Table is empty when the operation runs on every table.
+	Table      string `json:"table,omitempty"`
+	Status     string `json:"status"`
+	StartedAt  int64  `json:"startedAt"`
+	FinishedAt *int64 `json:"finishedAt"`
+	Error      string `json:"error,omitempty"`
+}
+
+type MaintenancePayload struct {
+	Operation string `json:"operation"`
+	Table     string `json:"table"`
+}
+
+// maintenanceJobs remembers the latest jobs, oldest first. Only one runs at
+// a time, as e.g. a VACUUM and a REINDEX of the same table would just wait
+// on each other's locks.
+type maintenanceJobs struct {
+	mu     sync.Mutex
+	nextID int
+	jobs   []MaintenanceJob
+}
+
+// start records a new running job, or returns false when one is running.
+func (m *maintenanceJobs) start(op, table string) (MaintenanceJob, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if slices.ContainsFunc(m.jobs, func(j MaintenanceJob) bool { return j.Status == JobRunning }) {
+		return MaintenanceJob{}, false
+	}
+	m.nextID++
+	job := MaintenanceJob{Id: m.nextID, Operation: op, Table: table, Status: JobRunning, StartedAt: time.Now().Unix()}
+	m.jobs = append(m.jobs, job)
+	if len(m.jobs) > maxMaintenanceJobs {
+		m.jobs = m.jobs[len(m.jobs)-maxMaintenanceJobs:]
+	}
+	return job, true
+}
+
+func (m *maintenanceJobs) finish(id int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.jobs, func(j MaintenanceJob) bool { return j.Id == id })
+	if i < 0 {
+		return
+	}
+	now := time.Now().Unix()
+	m.jobs[i].FinishedAt = &now
+	m.jobs[i].Status = JobDone
+	if err != nil {
+		m.jobs[i].Status = JobFailed
+		m.jobs[i].Error = err.Error()
+	}
+}
+
+// list returns the jobs, newest first.
+func (m *maintenanceJobs) list() []MaintenanceJob {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := slices.Clone(m.jobs)
+	slices.Reverse(jobs)
+	if jobs == nil {
+		jobs = []MaintenanceJob{}
+	}
+	return jobs
+}
+
+func (m *maintenanceJobs) get(id int) (MaintenanceJob, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.jobs, func(j MaintenanceJob) bool { return j.Id == id })
+	if i < 0 {
+		return MaintenanceJob{}, false
+	}
+	return m.jobs[i], true
+}
+
+func (s *server) maintenanceStore(w http.ResponseWriter) (store.MaintenanceStore, bool) {
+	ms, ok := s.store.(store.MaintenanceStore)
+	if !ok {
+		http.Error(w, "Maintenance is not supported by this storage backend", http.StatusNotImplemented)
+		return nil, false
+	}
+	return ms, true
+}
+
+// maintenanceHandler lists the maintenance jobs and starts new ones.
+func (s *server) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ms, ok := s.maintenanceStore(w)
+	if !ok {
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.maintenance.list())
+		return
+	}
+
+	var p MaintenancePayload
+	if err := decodeBody(r, &p); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if !slices.Contains(store.MaintenanceOps, p.Operation) {
+		http.Error(w, "Bad request: operation must be one of "+strings.Join(store.MaintenanceOps, ", "), http.StatusUnprocessableEntity)
+		return
+	}
+	job, ok := s.maintenance.start(p.Operation, p.Table)
+	if !ok {
+		http.Error(w, "Conflict: a maintenance job is already running", http.StatusConflict)
+		return
+	}
+	logger.Info("Started maintenance job", slog.Int("id", job.Id), slog.String("operation", job.Operation), slog.String("table", job.Table))
+
+	// The job outlives the request but keeps its logger.
+	ctx := context.WithoutCancel(r.Context())
+	go func() {
+		started := time.Now()
+		err := ms.Maintain(ctx, job.Operation, job.Table)
+		if errors.Is(err, store.ErrNotFound) {
+			err = errors.New("table not found")
+		}
+		s.maintenance.finish(job.Id, err)
+		if err != nil {
+			logger.Error("Maintenance job failed", "id", job.Id, "operation", job.Operation, "error", err)
+			return
+		}
+		logger.Info("Finished maintenance job", slog.Int("id", job.Id), slog.String("operation", job.Operation), slog.Duration("duration", time.Since(started)))
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/admin/maintenance/"+strconv.Itoa(job.Id))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// maintenanceJobHandler reports the status of a maintenance job.
+func (s *server) maintenanceJobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := s.maintenanceStore(w); !ok {
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	job, ok := s.maintenance.get(id)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// maintainedStore pretends to maintain, blocking each operation until
+// release is closed.
+type maintainedStore struct {
+	*memory.Store
+	release chan struct{}
+}
+
+func (s maintainedStore) Maintain(ctx context.Context, op, table string) error {
+	<-s.release
+	if table == "missing" {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+func TestMaintenance(t *testing.T) {
+	st := maintainedStore{Store: memory.New(), release: make(chan struct{})}
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, st))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "POST", "/admin/maintenance", `{"operation": "defrag"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "wrong", "POST", "/admin/maintenance", `{"operation": "vacuum"}`).StatusCode)
+
+	resp = doRequest(t, srv, "POST", "/admin/maintenance", `{"operation": "vacuum", "table": "readings"}`)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, "/admin/maintenance/1", resp.Header.Get("Location"))
+	var job MaintenanceJob
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&job))
+	assert.Equal(t, JobRunning, job.Status)
+	assert.Equal(t, http.StatusConflict, doRequest(t, srv, "POST", "/admin/maintenance", `{"operation": "analyze"}`).StatusCode)
+
+	close(st.release)
+	assert.Eventually(t, func() bool {
+		resp := doRequest(t, srv, "GET", "/admin/maintenance/1", "")
+		var job MaintenanceJob
+		return json.NewDecoder(resp.Body).Decode(&job) == nil && job.Status == JobDone && job.FinishedAt != nil
+	}, time.Second, 10*time.Millisecond)
+
+	resp = doRequest(t, srv, "POST", "/admin/maintenance", `{"operation": "reindex", "table": "missing"}`)
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Eventually(t, func() bool {
+		resp := doRequest(t, srv, "GET", "/admin/maintenance/2", "")
+		var job MaintenanceJob
+		return json.NewDecoder(resp.Body).Decode(&job) == nil && job.Status == JobFailed && job.Error == "table not found"
+	}, time.Second, 10*time.Millisecond)
+
+	resp = doRequest(t, srv, "GET", "/admin/maintenance", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var jobs []MaintenanceJob
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&jobs))
+	require.Len(t, jobs, 2)
+	assert.Equal(t, 2, jobs[0].Id)
+	assert.Equal(t, http.StatusNotFound, doRequest(t, srv, "GET", "/admin/maintenance/3", "").StatusCode)
+
+	unsupported := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer unsupported.Close()
+	assert.Equal(t, http.StatusNotImplemented, doRequest(t, unsupported, "GET", "/admin/maintenance", "").StatusCode)
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// PayloadKeyHeader carries the ID of the key an encrypted request body is
+// sealed with.
+const PayloadKeyHeader = "X-Key-Id"
+
+const (
+	// payloadWindow is how far the time a body was sealed at may be from
+	// the server's clock, either way.
+	payloadWindow = 5 * time.Minute
+	// maxSeenNonces is the most nonces remembered within payloadWindow.
+	maxSeenNonces = 1 << 16
+)
+
+var (
+	errPayloadStale    = errors.New("sealed body outside the time window")
+	errPayloadReplayed = errors.New("sealed body replayed")
+	errTooManyNonces   = errors.New("too many sealed bodies within the time window")
+)
+
+// PayloadKey is a device's symmetric key for request bodies encrypted with
+// AES-GCM, for devices reporting over untrusted networks without the memory
+// TLS takes. A body sealed with it authorizes the request like a write
+// key, for the device's readings only.
+type PayloadKey struct {
+	// ID is sent in the X-Key-Id header.
+	ID string `yaml:"id" json:"id"`
+	// Device is the device sending with the key.
+	Device string `yaml:"device" json:"device"`
+	// Key is the hex-encoded AES-128 or AES-256 key.
+	Key string `yaml:"key" json:"key"`
+}
+
+// ValidatePayloadKeys checks that every key has a unique ID, a device and
+// an AES-128 or AES-256 key.
+func ValidatePayloadKeys(keys []PayloadKey) error {
+	var errs []error
+	ids := make(map[string]bool, len(keys))
+	for i, k := range keys {
+		switch {
+		case k.ID == "":
+			errs = append(errs, fmt.Errorf("payload key %d: id is required", i))
+		case ids[k.ID]:
+			errs = append(errs, fmt.Errorf("payload key %s: duplicate id", k.ID))
+		}
+		ids[k.ID] = true
+		if k.Device == "" {
+			errs = append(errs, fmt.Errorf("payload key %s: device is required", k.ID))
+		}
+		if _, err := k.aead(); err != nil {
+			errs = append(errs, fmt.Errorf("payload key %s: %w", k.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (k PayloadKey) aead() (cipher.AEAD, error) {
+	key, err := hex.DecodeString(k.Key)
+	if err != nil || (len(key) != 16 && len(key) != 32) {
+		return nil, errors.New("key must be 32 or 64 hex digits")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealPayload encrypts body with k as a device does: a random 12-byte nonce
+// followed by the AES-GCM ciphertext and tag, the key ID authenticated as
+// additional data. The plaintext is the time of sealing, 8 big-endian bytes
+// of Unix seconds, followed by body.
+func SealPayload(k PayloadKey, body []byte) ([]byte, error) {
+	return sealPayloadAt(k, body, time.Now())
+}
+
+func sealPayloadAt(k PayloadKey, body []byte, at time.Time) ([]byte, error) {
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	plaintext := binary.BigEndian.AppendUint64(nil, uint64(at.Unix()))
+	return aead.Seal(nonce, nonce, append(plaintext, body...), []byte(k.ID)), nil
+}
+
+// sealedPayload is a body opened by openPayload.
+type sealedPayload struct {
+	body     []byte
+	nonce    []byte
+	sealedAt time.Time
+}
+
+// openPayload decrypts a body sealed by SealPayload.
+func openPayload(k PayloadKey, sealed []byte) (sealedPayload, error) {
+	aead, err := k.aead()
+	if err != nil {
+		return sealedPayload{}, err
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return sealedPayload{}, errors.New("sealed body too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(k.ID))
+	if err != nil {
+		return sealedPayload{}, err
+	}
+	if len(plaintext) < 8 {
+		return sealedPayload{}, errors.New("sealed body has no timestamp")
+	}
+	return sealedPayload{
+		body:     plaintext[8:],
+		nonce:    nonce,
+		sealedAt: time.Unix(int64(binary.BigEndian.Uint64(plaintext)), 0),
+	}, nil
+}
+
+// seenNonces are the nonces of the sealed bodies accepted within
+// payloadWindow, so none is accepted twice.
+type seenNonces struct {
+	mu sync.Mutex
+	// seen holds when each nonce, prefixed by its key ID, can be forgotten.
+	seen map[string]time.Time
+}
+
+// check returns an error unless p, sealed with the key id, is fresh at now
+// and wasn't seen before, in which case it is remembered.
+func (n *seenNonces) check(id string, p sealedPayload, now time.Time) error {
+	if p.sealedAt.Before(now.Add(-payloadWindow)) || p.sealedAt.After(now.Add(payloadWindow)) {
+		return errPayloadStale
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.seen == nil {
+		n.seen = make(map[string]time.Time)
+	}
+	seen := id + "\x00" + string(p.nonce)
+	if _, ok := n.seen[seen]; ok {
+		return errPayloadReplayed
+	}
+	if len(n.seen) >= maxSeenNonces {
+		maps.DeleteFunc(n.seen, func(_ string, forget time.Time) bool { return !now.Before(forget) })
+		if len(n.seen) >= maxSeenNonces {
+			return errTooManyNonces
+		}
+	}
+	// a body sealed at the end of the window can be replayed until
+	// another window has passed
+	n.seen[seen] = p.sealedAt.Add(payloadWindow)
+	return nil
+}
+
+func (s *server) payloadKeys() []PayloadKey {
+	if s.cfg.PayloadKeysFunc != nil {
+		return s.cfg.PayloadKeysFunc()
+	}
+	return s.cfg.PayloadKeys
+}
+
+type payloadKeyKey struct{}
+
+// payloadKeyFrom returns the key the request body was sealed with, if any.
+func payloadKeyFrom(ctx context.Context) (PayloadKey, bool) {
+	k, ok := ctx.Value(payloadKeyKey{}).(PayloadKey)
+	return k, ok
+}
+
+// payloadDevice returns the device of the key the request body was sealed
+// with, empty for a plain body.
+func payloadDevice(ctx context.Context) string {
+	k, _ := payloadKeyFrom(ctx)
+	return k.Device
+}
+
+// decrypt opens request bodies sealed with the payload key named in
+// X-Key-Id, which is then in the request context; other requests pass
+// through. Content-Type and Content-Encoding describe the decrypted body.
+func (s *server) decrypt(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(PayloadKeyHeader)
+		if id == "" {
+			h(w, r)
+			return
+		}
+		logger := slogctx.FromCtx(r.Context())
+		var key PayloadKey
+		found := false
+		for _, k := range s.payloadKeys() {
+			if k.ID == id {
+				key, found = k, true
+				break
+			}
+		}
+		if !found {
+			logger.Warn("Unknown payload key", slog.String("key_id", id))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		sealed, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		payload, err := openPayload(key, sealed)
+		if err != nil {
+			// a wrong key or a tampered body
+			logger.Warn("Failed to decrypt request body", slog.String("key_id", id), slog.Any("error", err))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if err := s.nonces.check(id, payload, time.Now()); err != nil {
+			logger.Warn("Refused sealed request body", slog.String("key_id", id), slog.Any("error", err))
+			if errors.Is(err, errTooManyNonces) {
+				http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		body := payload.body
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		h(w, r.WithContext(context.WithValue(r.Context(), payloadKeyKey{}, key)))
+	}
+}
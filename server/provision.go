@@ -0,0 +1,295 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// maxProvisionDevices is the most devices provisioned by one request, as
+// hashing every key takes a while.
+const maxProvisionDevices = 100
+
+// ProvisionDevice is a device of a provisioning manifest: it gets a write
+// key named after it, its labels and, when Room is set, is placed in the
+// room location of that name.
+type ProvisionDevice struct {
+	Name   string            `json:"name"`
+	Room   string            `json:"room"`
+	Labels map[string]string `json:"labels"`
+}
+
+// ProvisionedDevice is a provisioned device with its key, which is only
+// shown once.
+type ProvisionedDevice struct {
+	Name   string            `json:"name"`
+	Key    string            `json:"key"`
+	Room   string            `json:"room,omitempty"`
+	Labels map[string]string `json:"labels"`
+}
+
+// bulkDevicesHandler provisions a batch of devices from a JSON or CSV
+// manifest. Every device is checked before any is stored, so a rejected
+// manifest can be fixed and sent again.
+func (s *server) bulkDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ks, ok := s.apiKeyStore(w)
+	if !ok {
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	devices, err := decodeManifest(r)
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	ls, rooms, ok := s.checkManifest(w, r, ks, devices)
+	if !ok {
+		return
+	}
+
+	provisioned := make([]ProvisionedDevice, 0, len(devices))
+	for _, d := range devices {
+		key, ok := s.provisionDevice(w, r, ks, ls, d)
+		if !ok {
+			return
+		}
+		if d.Labels == nil {
+			d.Labels = map[string]string{}
+		}
+		provisioned = append(provisioned, ProvisionedDevice{Name: d.Name, Key: key, Room: d.Room, Labels: d.Labels})
+	}
+	if !s.placeDevices(w, r, rooms) {
+		return
+	}
+	logger.Info("Provisioned devices", slog.Int("count", len(provisioned)))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(provisioned)
+}
+
+// checkManifest checks the devices of a manifest against the store before
+// any is provisioned. It returns the label store, nil when no device has
+// labels, and the rooms the devices are placed in, see manifestRooms, or
+// responds with an error.
+func (s *server) checkManifest(w http.ResponseWriter, r *http.Request, ks store.APIKeyStore, devices []ProvisionDevice) (store.LabelStore, []store.Location, bool) {
+	if err := validateManifest(devices); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusUnprocessableEntity)
+		return nil, nil, false
+	}
+	var ls store.LabelStore
+	if slices.ContainsFunc(devices, func(d ProvisionDevice) bool { return len(d.Labels) > 0 }) {
+		var ok bool
+		if ls, ok = s.labelStore(w); !ok {
+			return nil, nil, false
+		}
+	}
+	rooms, ok := s.manifestRooms(w, r, devices)
+	if !ok || !s.checkUnclaimed(w, r, ks, devices) {
+		return nil, nil, false
+	}
+	return ls, rooms, true
+}
+
+// checkUnclaimed responds with 409 unless every device is still without a
+// stored key.
+func (s *server) checkUnclaimed(w http.ResponseWriter, r *http.Request, ks store.APIKeyStore, devices []ProvisionDevice) bool {
+	keys, err := ks.ListAPIKeys(r.Context())
+	if err != nil {
+		writeStoreError(w, slogctx.FromCtx(r.Context()), err, "Failed to query API keys")
+		return false
+	}
+	for _, d := range devices {
+		if slices.ContainsFunc(keys, func(k store.APIKey) bool { return k.Name == d.Name }) {
+			http.Error(w, "Conflict: an API key named "+d.Name+" exists", http.StatusConflict)
+			return false
+		}
+	}
+	return true
+}
+
+// provisionDevice stores a generated write key named after d, which it
+// returns, and d's labels in ls. It responds with 409 when the key exists.
+func (s *server) provisionDevice(w http.ResponseWriter, r *http.Request, ks store.APIKeyStore, ls store.LabelStore, d ProvisionDevice) (string, bool) {
+	logger := slogctx.FromCtx(r.Context())
+
+	id, key, hash, err := hashStoredKey(generateKey())
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to hash device key", "device", d.Name)
+		return "", false
+	}
+	k := store.APIKey{Name: d.Name, ID: id, Hash: hash, Scopes: []string{ScopeWrite}, Device: d.Name, CreatedAt: time.Now().Unix()}
+	if err := ks.CreateAPIKey(r.Context(), k); err != nil {
+		if errors.Is(err, store.ErrExists) {
+			http.Error(w, "Conflict: an API key named "+d.Name+" exists", http.StatusConflict)
+			return "", false
+		}
+		writeStoreError(w, logger, err, "Failed to create device key", "device", d.Name)
+		return "", false
+	}
+	s.forgetStoredKeys()
+	if len(d.Labels) > 0 {
+		if err := ls.SetDeviceLabels(r.Context(), d.Name, d.Labels); err != nil {
+			writeStoreError(w, logger, err, "Failed to set device labels", "device", d.Name)
+			return "", false
+		}
+	}
+	return key, true
+}
+
+// placeDevices stores the rooms returned by manifestRooms.
+func (s *server) placeDevices(w http.ResponseWriter, r *http.Request, rooms []store.Location) bool {
+	for _, room := range rooms {
+		if _, err := s.store.(store.LocationStore).UpdateLocation(r.Context(), room); err != nil {
+			writeStoreError(w, slogctx.FromCtx(r.Context()), err, "Failed to place devices", "location", room.Id)
+			return false
+		}
+	}
+	return true
+}
+
+// decodeManifest decodes a manifest of devices, a CSV body with a name,
+// room and labels header, labels written key:value and separated by
+// semicolons, or a body decodeBody accepts.
+func decodeManifest(r *http.Request) ([]ProvisionDevice, error) {
+	mediaType, err := bodyMediaType(r)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != contentTypeCSV {
+		var devices []ProvisionDevice
+		return devices, decodeBody(r, &devices)
+	}
+	cr := csv.NewReader(r.Body)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	var devices []ProvisionDevice
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return devices, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		d := ProvisionDevice{Name: field(record, "name"), Room: field(record, "room")}
+		for label := range strings.SplitSeq(field(record, "labels"), ";") {
+			if label = strings.TrimSpace(label); label == "" {
+				continue
+			}
+			// a label without a value is rejected by validateManifest
+			key, value, _ := strings.Cut(label, ":")
+			if d.Labels == nil {
+				d.Labels = make(map[string]string)
+			}
+			d.Labels[key] = value
+		}
+		devices = append(devices, d)
+	}
+}
+
+// validateManifest checks that there are devices, at most
+// maxProvisionDevices, named uniquely and with valid labels.
+func validateManifest(devices []ProvisionDevice) error {
+	if len(devices) == 0 || len(devices) > maxProvisionDevices {
+		return fmt.Errorf("a manifest has 1 to %d devices", maxProvisionDevices)
+	}
+	var errs []error
+	names := make(map[string]bool, len(devices))
+	for i, d := range devices {
+		switch {
+		case d.Name == "":
+			errs = append(errs, fmt.Errorf("device %d: name is required", i))
+		case names[d.Name]:
+			errs = append(errs, fmt.Errorf("device %s: duplicate name", d.Name))
+		}
+		names[d.Name] = true
+		if err := validateLabels(d.Labels); err != nil {
+			errs = append(errs, fmt.Errorf("device %s: %w", d.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// manifestRooms returns the room locations the devices are placed in, with
+// the devices added. It responds with 422 when a room doesn't exist or its
+// name is ambiguous and with 501 when the store doesn't keep locations.
+func (s *server) manifestRooms(w http.ResponseWriter, r *http.Request, devices []ProvisionDevice) ([]store.Location, bool) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if !slices.ContainsFunc(devices, func(d ProvisionDevice) bool { return d.Room != "" }) {
+		return nil, true
+	}
+	ls, ok := s.locationStore(w)
+	if !ok {
+		return nil, false
+	}
+	locations, err := ls.ListLocations(r.Context())
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query locations")
+		return nil, false
+	}
+	var rooms []store.Location
+	for _, d := range devices {
+		if d.Room == "" {
+			continue
+		}
+		if i := slices.IndexFunc(rooms, func(l store.Location) bool { return l.Name == d.Room }); i >= 0 {
+			if !slices.Contains(rooms[i].Devices, d.Name) {
+				rooms[i].Devices = append(rooms[i].Devices, d.Name)
+			}
+			continue
+		}
+		var matching []store.Location
+		for _, l := range locations {
+			if l.Kind == store.LocationRoom && l.Name == d.Room {
+				matching = append(matching, l)
+			}
+		}
+		switch len(matching) {
+		case 0:
+			http.Error(w, "Bad request: device "+d.Name+": no room named "+d.Room, http.StatusUnprocessableEntity)
+			return nil, false
+		case 1:
+			room := matching[0]
+			if !slices.Contains(room.Devices, d.Name) {
+				room.Devices = append(room.Devices, d.Name)
+			}
+			rooms = append(rooms, room)
+		default:
+			http.Error(w, "Bad request: device "+d.Name+": more than one room is named "+d.Room, http.StatusUnprocessableEntity)
+			return nil, false
+		}
+	}
+	return rooms, true
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkDevices(t *testing.T) {
+	st := memory.New()
+	ctx := context.Background()
+	garden, err := st.CreateLocation(ctx, store.Location{Name: "Garden", Kind: store.LocationHouse})
+	require.NoError(t, err)
+	shed, err := st.CreateLocation(ctx, store.Location{Name: "Shed", Kind: store.LocationRoom, ParentId: &garden.Id, Devices: []string{"gate"}})
+	require.NoError(t, err)
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, st))
+	defer srv.Close()
+
+	manifest := `[{"name": "plot-1", "room": "Shed", "labels": {"plot": "1"}}, {"name": "plot-2"}]`
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "wrong", "POST", "/devices/bulk", manifest).StatusCode)
+	resp := doRequest(t, srv, "POST", "/devices/bulk", manifest)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var provisioned []ProvisionedDevice
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&provisioned))
+	require.Len(t, provisioned, 2)
+	assert.Equal(t, "plot-1", provisioned[0].Name)
+	assert.Equal(t, map[string]string{"plot": "1"}, provisioned[0].Labels)
+	assert.Equal(t, map[string]string{}, provisioned[1].Labels)
+
+	// every device sends readings with its own key, which can't read
+	reading := `{"tempCo": 40, "tempRoom": 21, "humidity": 50}`
+	for _, d := range provisioned {
+		assert.Regexp(t, `^[0-9a-f]{12}\.[0-9a-f]{64}$`, d.Key)
+		assert.Equal(t, http.StatusOK, doRequestWithKey(t, srv, d.Key, "POST", "/data", reading).StatusCode)
+		assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, d.Key, "POST", "/devices/bulk", `[{"name": "x"}]`).StatusCode)
+	}
+	labels, err := st.DeviceLabels(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"plot-1": {"plot": "1"}}, labels)
+	shed, err = st.GetLocation(ctx, shed.Id)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gate", "plot-1"}, shed.Devices)
+
+	req, err := http.NewRequest("POST", srv.URL+"/devices/bulk", strings.NewReader("name,room,labels\nplot-3,Shed,plot:3; bed:raised\nplot-4,,\n"))
+	require.NoError(t, err)
+	req.Header.Set("X-Secret-Key", "testsecret")
+	req.Header.Set("Content-Type", "text/csv")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&provisioned))
+	require.Len(t, provisioned, 2)
+	assert.Equal(t, ProvisionedDevice{Name: "plot-3", Key: provisioned[0].Key, Room: "Shed", Labels: map[string]string{"plot": "3", "bed": "raised"}}, provisioned[0])
+
+	// a rejected manifest stores nothing
+	for _, manifest := range []string{`[]`, `[{"room": "Shed"}]`, `[{"name": "a"}, {"name": "a"}]`, `[{"name": "a", "labels": {"1st": "x"}}]`, `[{"name": "a", "room": "Attic"}]`} {
+		assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "POST", "/devices/bulk", manifest).StatusCode, manifest)
+	}
+	assert.Equal(t, http.StatusConflict, doRequest(t, srv, "POST", "/devices/bulk", `[{"name": "plot-5"}, {"name": "plot-1"}]`).StatusCode)
+	keys, err := st.ListAPIKeys(ctx)
+	require.NoError(t, err)
+	assert.Len(t, keys, 4)
+}
+
+func TestProvisionedDeviceReadings(t *testing.T) {
+	st := memory.New()
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret", LegacyIngest: true}, st))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "POST", "/devices/bulk", `[{"name": "plot-1"}]`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var provisioned []ProvisionedDevice
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&provisioned))
+	key := provisioned[0].Key
+
+	// readings sent with a device's key are the device's, however they're sent
+	require.Equal(t, http.StatusOK, doRequestWithKey(t, srv, key, "POST", "/data", `{"tempCo": 40, "tempRoom": 21, "humidity": 50, "timestamp": 100}`).StatusCode)
+	require.Equal(t, http.StatusOK, doRequestWithKey(t, srv, key, "POST", "/data/batch", `[{"tempCo": 41, "tempRoom": 21, "humidity": 50, "timestamp": 200}]`).StatusCode)
+	require.Equal(t, http.StatusOK, doRequestWithKey(t, srv, "", "GET", "/ingest?t1=42&t2=21&ts=300&key="+key, "").StatusCode)
+	// the secret key isn't bound to a device
+	require.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/data", `{"tempCo": 43, "tempRoom": 21, "humidity": 50, "timestamp": 400}`).StatusCode)
+
+	readings, err := st.ListReadings(t.Context(), 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 4)
+	devices := make([]string, 0, len(readings))
+	for _, r := range readings {
+		devices = append(devices, r.Device)
+	}
+	assert.Equal(t, []string{"", "plot-1", "plot-1", "plot-1"}, devices)
+}
+
+func TestProvisionedDeviceScope(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "POST", "/devices/bulk", `[{"name": "plot-1"}]`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var provisioned []ProvisionedDevice
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&provisioned))
+	key := provisioned[0].Key
+
+	// a device's key only acts for its device
+	sync := `{"device": "%s", "readings": [{"seq": 1, "tempCo": 40, "tempRoom": 21, "humidity": 50}]}`
+	assert.Equal(t, http.StatusOK, doRequestWithKey(t, srv, key, "GET", "/devices/plot-1/commands", "").StatusCode)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, key, "GET", "/devices/plot-2/commands", "").StatusCode)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, key, "POST", "/devices/plot-2/commands/1/ack", "").StatusCode)
+	assert.Equal(t, http.StatusOK, doRequestWithKey(t, srv, key, "POST", "/sync", fmt.Sprintf(sync, "plot-1")).StatusCode)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, key, "POST", "/sync", fmt.Sprintf(sync, "plot-2")).StatusCode)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, key, "POST", "/devices/plot-2/crash", `{"reason": "Exception"}`).StatusCode)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, key, "POST", "/ingest/line", "temp,device=plot-2 tempCo=40,tempRoom=21,humidity=50").StatusCode)
+	// other keys act for any device
+	assert.Equal(t, http.StatusOK, doRequest(t, srv, "GET", "/devices/plot-2/commands", "").StatusCode)
+	assert.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/sync", fmt.Sprintf(sync, "plot-2")).StatusCode)
+}
+
+func TestClaimDevices(t *testing.T) {
+	st := memory.New()
+	ctx := context.Background()
+	shed, err := st.CreateLocation(ctx, store.Location{Name: "Shed", Kind: store.LocationRoom})
+	require.NoError(t, err)
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret", PublicURL: "https://temp.example.com", KeyGracePeriod: 72 * time.Hour}, st))
+	defer srv.Close()
+
+	manifest := `[{"name": "plot-1", "room": "Shed", "labels": {"plot": "1"}}, {"name": "plot-2"}]`
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "wrong", "POST", "/devices/claim-tokens", manifest).StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "POST", "/devices/claim-tokens?ttl=forever", manifest).StatusCode)
+	// tokens don't outlast the grace period of a rotated out key
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "POST", "/devices/claim-tokens?ttl=96h", manifest).StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "POST", "/devices/claim-tokens", `[{"name": "a", "room": "Attic"}]`).StatusCode)
+	resp := doRequest(t, srv, "POST", "/devices/claim-tokens?ttl=48h", manifest)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var minted []MintedClaimToken
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&minted))
+	require.Len(t, minted, 2)
+	assert.Equal(t, "plot-1", minted[0].Name)
+	assert.InDelta(t, time.Now().Add(48*time.Hour).Unix(), minted[0].ExpiresAt, 5)
+	// nothing is stored until a device claims its token
+	keys, err := st.ListAPIKeys(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	claim := func(token string) *http.Response {
+		return doRequestWithKey(t, srv, "", "POST", "/devices/claim", `{"token": "`+token+`"}`)
+	}
+	resp = claim(minted[0].Token)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var cfg DeviceConfig
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&cfg))
+	assert.Equal(t, DeviceConfig{ServerURL: "https://temp.example.com", Device: "plot-1", Key: cfg.Key, ReportInterval: 60}, cfg)
+	assert.Equal(t, http.StatusOK, doRequestWithKey(t, srv, cfg.Key, "POST", "/data", `{"tempCo": 40, "tempRoom": 21, "humidity": 50}`).StatusCode)
+	labels, err := st.DeviceLabels(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"plot": "1"}, labels["plot-1"])
+	shed, err = st.GetLocation(ctx, shed.Id)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"plot-1"}, shed.Devices)
+
+	// a token is claimed once
+	assert.Equal(t, http.StatusConflict, claim(minted[0].Token).StatusCode)
+	// tokens are signed for claiming, a read token won't do
+	assert.Equal(t, http.StatusForbidden, claim(signToken(ReadToken{ExpiresAt: minted[1].ExpiresAt}, "testsecret")).StatusCode)
+	assert.Equal(t, http.StatusForbidden, claim(signPayload(ClaimToken{ProvisionDevice: ProvisionDevice{Name: "plot-2"}, ExpiresAt: minted[1].ExpiresAt}, claimTokenPurpose, "guessed")).StatusCode)
+	assert.Equal(t, http.StatusForbidden, claim(signPayload(ClaimToken{ProvisionDevice: ProvisionDevice{Name: "plot-2"}, ExpiresAt: time.Now().Unix()}, claimTokenPurpose, "testsecret")).StatusCode)
+	assert.Equal(t, http.StatusCreated, claim(minted[1].Token).StatusCode)
+}
+
+func TestClaimTokensOutliveRotation(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret", PublicURL: "https://temp.example.com"}, memory.New()))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "POST", "/devices/claim-tokens", `[{"name": "plot-1"}]`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var minted []MintedClaimToken
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&minted))
+	// valid for the grace period by default, not 30 days
+	assert.InDelta(t, time.Now().Add(DefaultKeyGracePeriod).Unix(), minted[0].ExpiresAt, 5)
+
+	// so a token minted before a rotation can be claimed until it expires
+	require.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/admin/rotate-key", `{"key": "rotatedsecret-0123"}`).StatusCode)
+	assert.Equal(t, http.StatusCreated, doRequestWithKey(t, srv, "", "POST", "/devices/claim", `{"token": "`+minted[0].Token+`"}`).StatusCode)
+}
+
+func TestProvisionConfig(t *testing.T) {
+	st := memory.New()
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret", RequireReadKey: true, PublicURL: "https://temp.example.com/", ReportInterval: 5 * time.Minute}, st))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "POST", "/devices/claim-tokens", `[{"name": "plot-1"}]`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var minted []MintedClaimToken
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&minted))
+
+	// the token is all the onboarding firmware has, also with read keys
+	// required
+	resp = doRequestWithKey(t, srv, "", "GET", "/provision/"+minted[0].Token+"/config", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+	var cfg DeviceConfig
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&cfg))
+	assert.Equal(t, DeviceConfig{ServerURL: "https://temp.example.com", Device: "plot-1", Key: cfg.Key, ReportInterval: 300}, cfg)
+	assert.Equal(t, http.StatusOK, doRequestWithKey(t, srv, cfg.Key, "POST", "/data", `{"tempCo": 40, "tempRoom": 21, "humidity": 50}`).StatusCode)
+
+	// it is served once
+	assert.Equal(t, http.StatusConflict, doRequestWithKey(t, srv, "", "GET", "/provision/"+minted[0].Token+"/config", "").StatusCode)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "", "GET", "/provision/forged/config", "").StatusCode)
+	assert.Equal(t, http.StatusMethodNotAllowed, doRequestWithKey(t, srv, "", "POST", "/provision/"+minted[0].Token+"/config", "").StatusCode)
+}
+
+func TestClaimNeedsPublicURL(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "POST", "/devices/claim-tokens", `[{"name": "plot-1"}]`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var minted []MintedClaimToken
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&minted))
+
+	// the Host header isn't trusted for the server URL given to the device
+	req, err := http.NewRequest("GET", srv.URL+"/provision/"+minted[0].Token+"/config", nil)
+	require.NoError(t, err)
+	req.Host = "attacker.example.com"
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+	assert.Equal(t, http.StatusNotImplemented, doRequestWithKey(t, srv, "", "POST", "/devices/claim", `{"token": "`+minted[0].Token+`"}`).StatusCode)
+}
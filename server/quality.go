@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// ReadingQuality flags a reading, e.g. after a correction recalibrated it.
+type ReadingQuality struct {
+	Id      int    `json:"id"`
+	Quality string `json:"quality"`
+}
+
+// readingQualityHandler sets the quality flag of a reading, so corrections
+// and analysts can mark readings instead of deleting them.
+func (s *server) readingQualityHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	qs, ok := s.store.(store.QualityStore)
+	if !ok {
+		http.Error(w, "Reading quality flags are not supported by this storage backend", http.StatusNotImplemented)
+		return
+	}
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	var p ReadingQuality
+	if err := decodeBody(r, &p); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if !slices.Contains(store.Qualities, p.Quality) {
+		http.Error(w, "Bad request: quality must be one of "+strings.Join(store.Qualities, ", "), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := qs.SetReadingQuality(r.Context(), id, p.Quality); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		writeStoreError(w, logger, err, "Failed to set reading quality", "id", id)
+		return
+	}
+	logger.Info("Set reading quality", slog.Int("id", id), slog.String("quality", p.Quality))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ReadingQuality{Id: id, Quality: p.Quality})
+}
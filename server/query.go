@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// DefaultQueryTimeout is how long an ad-hoc query may run by default.
+const DefaultQueryTimeout = 10 * time.Second
+
+type queryRequest struct {
+	SQL string `json:"sql"`
+}
+
+// queryHandler runs an ad-hoc read-only SQL statement and streams its
+// result as JSON, {"columns": [...], "rows": [[...], ...]}, or as CSV with a
+// header row.
+func (s *server) queryHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.cfg.Querier == nil {
+		http.Error(w, "Ad-hoc queries are not configured", http.StatusNotImplemented)
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Vary", "Accept")
+	format := negotiate(r.Header.Get("Accept"), contentTypeJSON, contentTypeCSV)
+	if format == "" {
+		http.Error(w, "Not acceptable, supported: "+contentTypeJSON+", "+contentTypeCSV, http.StatusNotAcceptable)
+		return
+	}
+	var req queryRequest
+	if err := decodeBody(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+
+	var res queryWriter
+	if format == contentTypeCSV {
+		res = &csvQueryWriter{w: w}
+	} else {
+		res = &jsonQueryWriter{w: w}
+	}
+	err := s.cfg.Querier.Query(r.Context(), req.SQL, s.cfg.QueryTimeout, res)
+	var queryErr *store.QueryError
+	switch {
+	case err != nil && !res.started() && errors.As(err, &queryErr):
+		http.Error(w, "Bad request: "+queryErr.Msg, http.StatusUnprocessableEntity)
+		return
+	case err != nil && !res.started():
+		logger.Error("Failed to run query", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	case err != nil:
+		// The status is sent already, the truncated body is all that's
+		// left to signal the failure.
+		logger.Error("Failed to stream query result", "error", err)
+		return
+	}
+	if err := res.finish(); err != nil {
+		logger.Error("Failed to write query result", "error", err)
+		return
+	}
+	logger.Info("Ran ad-hoc query", "sql", req.SQL, "rows", res.rows())
+}
+
+// queryWriter streams a query result to the response.
+type queryWriter interface {
+	store.QueryResult
+	// started reports whether anything was written.
+	started() bool
+	rows() int
+	finish() error
+}
+
+type jsonQueryWriter struct {
+	w http.ResponseWriter
+	n int
+	// columnsSent is set once the header and the columns are written.
+	columnsSent bool
+}
+
+func (q *jsonQueryWriter) Columns(names []string) error {
+	q.w.Header().Set("Content-Type", contentTypeJSON)
+	columns, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	q.columnsSent = true
+	_, err = fmt.Fprintf(q.w, `{"columns":%s,"rows":[`, columns)
+	return err
+}
+
+func (q *jsonQueryWriter) Row(values []any) error {
+	row, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	if q.n > 0 {
+		row = append([]byte{','}, row...)
+	}
+	q.n++
+	_, err = q.w.Write(row)
+	return err
+}
+
+func (q *jsonQueryWriter) started() bool { return q.columnsSent }
+func (q *jsonQueryWriter) rows() int     { return q.n }
+
+func (q *jsonQueryWriter) finish() error {
+	_, err := q.w.Write([]byte("]}\n"))
+	return err
+}
+
+type csvQueryWriter struct {
+	w  http.ResponseWriter
+	cw *csv.Writer
+	n  int
+}
+
+func (q *csvQueryWriter) Columns(names []string) error {
+	q.w.Header().Set("Content-Type", contentTypeCSV+"; charset=utf-8")
+	q.cw = csv.NewWriter(q.w)
+	return q.cw.Write(names)
+}
+
+func (q *csvQueryWriter) Row(values []any) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		record[i] = csvValue(v)
+	}
+	q.n++
+	return q.cw.Write(record)
+}
+
+func (q *csvQueryWriter) started() bool { return q.cw != nil }
+func (q *csvQueryWriter) rows() int     { return q.n }
+
+func (q *csvQueryWriter) finish() error {
+	q.cw.Flush()
+	return q.cw.Error()
+}
+
+// csvValue formats a column value, leaving NULL empty.
+func csvValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return v.String()
+	}
+	if b, err := json.Marshal(v); err == nil {
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
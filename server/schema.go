@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// schemaFS holds the JSON Schemas of the ingest request bodies, served at
+// /schemas/ for firmware authors.
+//
+//go:embed schemas/*.json
+var schemaFS embed.FS
+
+// schemaBaseURL is where the schemas are registered; their relative $refs
+// resolve the same here as when fetched from /schemas/.
+const schemaBaseURL = "http://esp8266-web/schemas/"
+
+// schemaPrinter formats schema violations.
+var schemaPrinter = message.NewPrinter(language.English)
+
+// bodySchemas are the compiled schemas by file name, e.g. "reading.json".
+var bodySchemas = compileSchemas()
+
+func compileSchemas() map[string]*jsonschema.Schema {
+	c := jsonschema.NewCompiler()
+	names, err := fs.Glob(schemaFS, "schemas/*.json")
+	if err != nil {
+		panic(err)
+	}
+	for _, name := range names {
+		f, err := schemaFS.Open(name)
+		if err != nil {
+			panic(err)
+		}
+		doc, err := jsonschema.UnmarshalJSON(f)
+		f.Close()
+		if err != nil {
+			panic(fmt.Sprintf("schema %s: %v", name, err))
+		}
+		if err := c.AddResource(schemaBaseURL+strings.TrimPrefix(name, "schemas/"), doc); err != nil {
+			panic(err)
+		}
+	}
+	schemas := make(map[string]*jsonschema.Schema, len(names))
+	for _, name := range names {
+		name = strings.TrimPrefix(name, "schemas/")
+		schemas[name] = c.MustCompile(schemaBaseURL + name)
+	}
+	return schemas
+}
+
+// schemaError lists every way a request body violates its schema.
+type schemaError struct {
+	violations []string
+}
+
+func (e *schemaError) Error() string {
+	return strings.Join(e.violations, "; ")
+}
+
+// violations flattens a validation error into one "location: constraint"
+// line per failed keyword, the location a JSON pointer into the body.
+func violations(err *jsonschema.ValidationError) []string {
+	if len(err.Causes) == 0 {
+		location := "/" + strings.Join(err.InstanceLocation, "/")
+		return []string{fmt.Sprintf("%s: %s", location, err.ErrorKind.LocalizedString(schemaPrinter))}
+	}
+	var lines []string
+	for _, cause := range err.Causes {
+		lines = append(lines, violations(cause)...)
+	}
+	return lines
+}
+
+// decodeValidBody decodes the request body into v like decodeBody, after
+// validating it against the named schema.
+func decodeValidBody(r *http.Request, schema string, v any) error {
+	mediaType, err := bodyMediaType(r)
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	doc, err := decodeGeneric(mediaType, body)
+	if err != nil {
+		return err
+	}
+	if err := bodySchemas[schema].Validate(doc); err != nil {
+		var validationErr *jsonschema.ValidationError
+		if !errors.As(err, &validationErr) {
+			return err
+		}
+		return &schemaError{violations: violations(validationErr)}
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return decodeBody(r, v)
+}
+
+// schemaHandler serves the request body schemas.
+func (s *server) schemaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := schemaFS.ReadFile("schemas/" + r.PathValue("name"))
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(b)
+}
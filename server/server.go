@@ -0,0 +1,572 @@
+// Package server wires the HTTP API on top of a store.Store so it can be
+// mounted in-process by the binary, by tests, or by other Go programs.
+package server
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/alert"
+	"github.com/bartosz121/esp8266-web/control"
+	"github.com/bartosz121/esp8266-web/features"
+	"github.com/bartosz121/esp8266-web/ingest"
+	"github.com/bartosz121/esp8266-web/middleware"
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+//go:embed index.html
+var indexHTML []byte
+
+type TemperatureReadingPayload struct {
+	TempCo    float64 `json:"tempCo"`
+	TempRoom  float64 `json:"tempRoom"`
+	Humidity  float64 `json:"humidity"`
+	Timestamp *int64  `json:"timestamp"`
+}
+
+type Config struct {
+	// SecretKey is required in the X-Secret-Key header of write requests.
+	SecretKey string
+	// SecretKeyFunc, when set, is called on every request instead of using
+	// SecretKey, for keys rotated at runtime.
+	SecretKeyFunc func() string
+	// KeyGracePeriod is how long the previous secret key is still accepted
+	// after a rotation, defaults to DefaultKeyGracePeriod.
+	KeyGracePeriod time.Duration
+	// APIKeys are scoped keys accepted next to the secret key.
+	APIKeys []APIKey
+	// APIKeysFunc, when set, is called on every request instead of using
+	// APIKeys, for keys reloaded at runtime.
+	APIKeysFunc func() []APIKey
+	// Webhooks authorize platforms calling ingest adapters by a shared
+	// secret or body signature, keyed by adapter name.
+	Webhooks map[string]ingest.Webhook
+	// WebhooksFunc, when set, is called on every request instead of using
+	// Webhooks, for webhooks reloaded at runtime.
+	WebhooksFunc func() map[string]ingest.Webhook
+	// PayloadKeys decrypt the ingest request bodies devices seal with them.
+	PayloadKeys []PayloadKey
+	// PayloadKeysFunc, when set, is called on every request instead of
+	// using PayloadKeys, for keys reloaded at runtime.
+	PayloadKeysFunc func() []PayloadKey
+	// RequireReadKey makes GET requests need a key allowed ScopeRead,
+	// except for the dashboard page, /health and /metrics.
+	RequireReadKey bool
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+	// Reload re-applies the reloadable settings. POST /admin/reload is only
+	// registered when it is set.
+	Reload func(ctx context.Context) error
+	// LegacyIngest registers /ingest, accepting readings as query parameters
+	// or form-encoded bodies for old sketches.
+	LegacyIngest bool
+	// MaxBodyBytes caps ingest request bodies after decompression, defaults
+	// to DefaultMaxBodyBytes.
+	MaxBodyBytes int64
+	// Alerts evaluates alert rules on every ingested reading. When nil, an
+	// engine is created if the store implements store.AlertStore.
+	Alerts *alert.Engine
+	// Control switches thermostat zones on every ingested reading. When
+	// nil, a controller is created if the store implements control.Store.
+	Control *control.Controller
+	// Forward, when set, is called with every batch of newly stored
+	// readings, e.g. sink.Fanout.Enqueue. It must not block.
+	Forward func([]store.TemperatureReading)
+	// Ingest validates, deduplicates and stores readings from every
+	// endpoint. When nil, one is created from Alerts, Control and Forward.
+	Ingest *ingest.Pipeline
+	// Adapters are registered at POST /ingest/{name} next to the built-in
+	// line protocol adapter.
+	Adapters []ingest.HTTPAdapter
+	// Querier runs ad-hoc SQL at POST /query, which answers 501 when it is
+	// nil.
+	Querier store.Querier
+	// QueryTimeout cancels ad-hoc queries, defaults to DefaultQueryTimeout.
+	QueryTimeout time.Duration
+	// Leader, when set, reports whether this replica runs the background
+	// jobs of a multi-replica deployment; /readyz includes it.
+	Leader func() bool
+	// StaleAfter, when set, makes /readyz list the devices without a
+	// reading for longer, without failing readiness.
+	StaleAfter time.Duration
+	// Limits bounds the requests served at once, except for /health,
+	// /readyz and /metrics. The zero value sets no bounds.
+	Limits middleware.Limits
+	// Features are the feature flags switched at /admin/settings. When
+	// nil, they're created from the store and also switch the Alerts and
+	// Ingest created here.
+	Features *features.Flags
+	// Envelope wraps JSON list responses in an Envelope unless the client
+	// asks for the bare profile; by default only clients asking for the
+	// envelope profile get one.
+	Envelope bool
+	// PublicURL is the base URL devices reach the server at, given to
+	// claimed devices. Devices can't be claimed without it.
+	PublicURL string
+	// ReportInterval is how often claimed devices are told to send a
+	// reading, defaults to DefaultReportInterval.
+	ReportInterval time.Duration
+	// PauseBackoff is how long devices are told to back off, in
+	// Retry-After, while ingestion is paused or the server is read-only,
+	// defaults to DefaultPauseBackoff.
+	PauseBackoff time.Duration
+}
+
+const (
+	DefaultMaxBodyBytes   = 8 << 20
+	DefaultReportInterval = time.Minute
+	// maxBatchSize is the most readings accepted by one request.
+	maxBatchSize = ingest.MaxBatchSize
+)
+
+type server struct {
+	cfg     Config
+	store   store.Store
+	alerts  *alert.Engine
+	control *control.Controller
+	ingest  *ingest.Pipeline
+	keys    keyring
+	hashed  hashedKeys
+	// features are switched at /admin/settings.
+	features *features.Flags
+	// maintenance tracks the jobs started at /admin/maintenance.
+	maintenance maintenanceJobs
+	// captures record the requests of devices being debugged.
+	captures captures
+	// nonces are those of the sealed bodies accepted lately.
+	nonces seenNonces
+}
+
+// NewServer returns the full API, including middleware, backed by st.
+func NewServer(cfg Config, st store.Store) http.Handler {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	if cfg.KeyGracePeriod <= 0 {
+		cfg.KeyGracePeriod = DefaultKeyGracePeriod
+	}
+	if cfg.PauseBackoff <= 0 {
+		cfg.PauseBackoff = DefaultPauseBackoff
+	}
+	if cfg.ReportInterval <= 0 {
+		cfg.ReportInterval = DefaultReportInterval
+	}
+	if cfg.QueryTimeout <= 0 {
+		cfg.QueryTimeout = DefaultQueryTimeout
+	}
+	s := &server{cfg: cfg, store: st, alerts: cfg.Alerts, control: cfg.Control, ingest: cfg.Ingest, features: cfg.Features}
+	s.keys.source = s.configuredKey()
+	s.keys.current = s.keys.source
+	logger := cfg.Logger
+	if s.features == nil {
+		s.features = features.New(st, logger)
+	}
+	if cs, ok := st.(control.Store); ok && s.control == nil {
+		s.control = control.New(cs, control.Config{Logger: logger})
+	}
+	if as, ok := st.(store.AlertStore); ok && s.alerts == nil {
+		alertConfig := alert.Config{Logger: logger, Readings: st, Enabled: s.features.AlertsEnabled}
+		if s.control != nil {
+			alertConfig.Away = s.control.Away
+		}
+		if cs, ok := st.(store.CrashStore); ok {
+			alertConfig.Reboots = cs.CountCrashReports
+		}
+		s.alerts = alert.NewEngine(as, alertConfig)
+	}
+	if s.ingest == nil {
+		s.ingest = ingest.New(st, ingest.Config{Logger: logger, Alerts: s.alerts, Control: s.control, Forward: cfg.Forward, Paused: s.features.IngestPaused})
+	}
+
+	probe := func(h http.Handler) http.Handler {
+		return middleware.Metrics(middleware.PanicRecovery(logger)(middleware.RequestID(logger)(middleware.Logging(h))))
+	}
+	limit := middleware.Limit(cfg.Limits)
+	public := func(h http.HandlerFunc) http.Handler {
+		return probe(limit(h))
+	}
+	wrap := func(h http.HandlerFunc) http.Handler {
+		return public(s.requireRead(s.readOnly(h)))
+	}
+	// ingest routes are captured before anything can reject them
+	ingestRoute := func(h http.HandlerFunc) http.Handler {
+		return public(s.capture(s.requireRead(s.readOnly(s.pausable(s.decrypt(middleware.Decompress(cfg.MaxBodyBytes)(h).ServeHTTP))))))
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/health", probe(http.HandlerFunc(s.healthHandler)))
+	mux.Handle("/readyz", probe(http.HandlerFunc(s.readyHandler)))
+	mux.Handle("/schemas/{name}", public(s.schemaHandler))
+
+	mux.Handle("/", public(s.homeHandler))
+	mux.Handle("/data", ingestRoute(s.dataHandler))
+	mux.Handle("/data/batch", ingestRoute(s.batchHandler))
+	mux.Handle("/data/import", ingestRoute(s.importHandler))
+	mux.Handle("/data/aggregate", wrap(s.aggregateHandler))
+	mux.Handle("/data/heating-usage", wrap(s.heatingUsageHandler))
+	mux.Handle("/data/outdoor", wrap(s.outdoorHandler))
+	mux.Handle("/data/export.xlsx", wrap(s.exportXLSXHandler))
+	mux.Handle("/data/export.parquet", wrap(s.exportParquetHandler))
+	mux.Handle("/data/export.arrow", wrap(s.exportArrowHandler))
+	mux.Handle("/chart.png", wrap(s.chartHandler))
+	mux.Handle("/sparkline.svg", wrap(s.sparklineHandler))
+	mux.Handle("/sync", ingestRoute(s.syncHandler))
+	mux.Handle("/sync/marks", wrap(s.syncMarksHandler))
+	mux.Handle("/sync/digests", wrap(s.syncDigestsHandler))
+	mux.Handle("/sync/range", wrap(s.syncRangeHandler))
+	pushgateway := ingestRoute(s.adapterHandler(&ingest.Pushgateway{}))
+	mux.Handle("/metrics/job/{job}", pushgateway)
+	mux.Handle("/metrics/job/{job}/{labels...}", pushgateway)
+	mux.Handle("/readings/{id}/quality", wrap(s.readingQualityHandler))
+	for _, a := range append([]ingest.HTTPAdapter{&ingest.LineProtocol{}}, cfg.Adapters...) {
+		mux.Handle("/ingest/"+a.Name(), ingestRoute(s.adapterHandler(a)))
+	}
+	mux.Handle("/alerts", wrap(s.alertsHandler))
+	mux.Handle("/alerts/history", wrap(s.alertHistoryHandler))
+	mux.Handle("/alerts/feed.atom", wrap(s.alertFeedHandler))
+	mux.Handle("/alerts/rules", wrap(s.alertRulesHandler))
+	mux.Handle("/alerts/rules/{id}", wrap(s.alertRuleHandler))
+	mux.Handle("/alerts/rules/prometheus.yml", wrap(s.alertRulesExportHandler(alert.PrometheusRules)))
+	mux.Handle("/alerts/rules/alertmanager.yml", wrap(s.alertRulesExportHandler(alert.AlertmanagerRoutes)))
+	mux.Handle("/alerts/rules/{id}/ack", wrap(s.alertAckHandler))
+	mux.Handle("/alerts/ack/{token}", public(s.ackLinkHandler))
+	mux.Handle("/alerts/silences", wrap(s.silencesHandler))
+	mux.Handle("/alerts/silences/{id}", wrap(s.silenceHandler))
+	mux.Handle("/control/mode", wrap(s.modeHandler))
+	mux.Handle("/control/zones", wrap(s.zonesHandler))
+	mux.Handle("/control/zones/{id}", wrap(s.zoneHandler))
+	mux.Handle("/control/zones/{id}/override", wrap(s.zoneOverrideHandler))
+	mux.Handle("/control/zones/{id}/history", wrap(s.zoneHistoryHandler))
+	mux.Handle("/locations", wrap(s.locationsHandler))
+	mux.Handle("/locations/{id}", wrap(s.locationHandler))
+	mux.Handle("/locations/{id}/summary", wrap(s.locationSummaryHandler))
+	mux.Handle("/devices", wrap(s.devicesHandler))
+	mux.Handle("/devices/bulk", wrap(s.bulkDevicesHandler))
+	mux.Handle("/devices/claim-tokens", wrap(s.claimTokensHandler))
+	mux.Handle("/devices/claim", wrap(s.claimHandler))
+	// the claim token authorizes it, also with RequireReadKey
+	mux.Handle("/provision/{token}/config", public(s.readOnly(s.provisionConfigHandler)))
+	mux.Handle("/devices/firmware", wrap(s.firmwareHandler))
+	mux.Handle("/devices/clock-skew", wrap(s.clockSkewHandler))
+	mux.Handle("/devices/{device}/labels", wrap(s.deviceLabelsHandler))
+	mux.Handle("/devices/{device}/dashboard", wrap(s.deviceDashboardHandler))
+	mux.Handle("/devices/{device}/crash", wrap(middleware.Decompress(cfg.MaxBodyBytes)(http.HandlerFunc(s.crashHandler)).ServeHTTP))
+	mux.Handle("/devices/{device}/crashes", wrap(s.crashesHandler))
+	mux.Handle("/devices/{device}/commands", public(s.readOnly(s.commandsHandler)))
+	mux.Handle("/devices/{device}/commands/{id}/ack", wrap(s.commandAckHandler))
+	if cfg.LegacyIngest {
+		// Old sketches send readings with GET; the handler authorizes them.
+		mux.Handle("/ingest", public(s.capture(s.readOnly(middleware.Decompress(cfg.MaxBodyBytes)(http.HandlerFunc(s.legacyIngestHandler)).ServeHTTP))))
+	}
+	mux.Handle("/tokens", wrap(s.tokensHandler))
+	mux.Handle("/admin/rotate-key", wrap(s.rotateKeyHandler))
+	mux.Handle("/admin/settings", wrap(s.settingsHandler))
+	mux.Handle("/admin/settings/history", wrap(s.settingsHistoryHandler))
+	mux.Handle("/admin/api-keys", wrap(s.apiKeysHandler))
+	mux.Handle("/admin/api-keys/{name}", wrap(s.apiKeyHandler))
+	mux.Handle("/admin/notifications/dead-letters", wrap(s.deadLettersHandler))
+	mux.Handle("/admin/notifications/dead-letters/{id}", wrap(s.deadLetterHandler))
+	mux.Handle("/admin/notifications/dead-letters/{id}/replay", wrap(s.replayDeadLetterHandler))
+	mux.Handle("/admin/state", wrap(s.stateHandler))
+	mux.Handle("/admin/storage", wrap(s.storageHandler))
+	mux.Handle("/admin/maintenance", wrap(s.maintenanceHandler))
+	mux.Handle("/admin/maintenance/{id}", wrap(s.maintenanceJobHandler))
+	mux.Handle("/admin/explain", wrap(s.explainHandler))
+	mux.Handle("/admin/captures", wrap(s.capturesHandler))
+	mux.Handle("/admin/captures/{target}", wrap(s.captureHandler))
+	mux.Handle("/query", wrap(s.queryHandler))
+	if cfg.Reload != nil {
+		mux.Handle("/admin/reload", wrap(s.reloadHandler))
+	}
+	return mux
+}
+
+func (s *server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status": "ok"}`)
+}
+
+// readyHandler reports whether the server can serve requests, i.e. its
+// store is reachable, unlike /health which only says the process is up.
+func (s *server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := s.store.Ping(r.Context()); err != nil {
+		logger.Warn("Readiness check failed", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"status": "unavailable"}`)
+		return
+	}
+	ready := map[string]any{"status": "ready"}
+	if s.cfg.Leader != nil {
+		ready["leader"] = s.cfg.Leader()
+	}
+	if s.cfg.StaleAfter > 0 {
+		ready["stale"] = staleDevices(ingest.LastSeen(), s.cfg.StaleAfter, time.Now())
+	}
+	json.NewEncoder(w).Encode(ready)
+}
+
+// StaleDevice is a device without a reading for longer than
+// Config.StaleAfter.
+type StaleDevice struct {
+	Device   string `json:"device"`
+	LastSeen int64  `json:"lastSeen"`
+	// Age is the seconds since LastSeen.
+	Age int64 `json:"age"`
+}
+
+// staleDevices returns the devices of lastSeen silent for longer than
+// after, by name.
+func staleDevices(lastSeen map[string]time.Time, after time.Duration, now time.Time) []StaleDevice {
+	stale := make([]StaleDevice, 0)
+	for _, device := range slices.Sorted(maps.Keys(lastSeen)) {
+		if age := now.Sub(lastSeen[device]); age > after {
+			stale = append(stale, StaleDevice{Device: device, LastSeen: lastSeen[device].Unix(), Age: int64(age / time.Second)})
+		}
+	}
+	return stale
+}
+
+func (s *server) homeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Write(indexHTML)
+}
+
+// authorized reports whether r carries a key allowed scope.
+func (s *server) authorized(r *http.Request, scope string) bool {
+	if _, ok := payloadKeyFrom(r.Context()); ok && scope == ScopeWrite {
+		return true
+	}
+	return s.validKey(r.Context(), r.Header.Get("X-Secret-Key"), scope)
+}
+
+// configuredKey returns the secret key of the config, which replaces the
+// current key whenever it changes.
+func (s *server) configuredKey() string {
+	if s.cfg.SecretKeyFunc != nil {
+		return s.cfg.SecretKeyFunc()
+	}
+	return s.cfg.SecretKey
+}
+
+func (s *server) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := s.cfg.Reload(r.Context()); err != nil {
+		logger.Error("Failed to reload settings", "error", err)
+		http.Error(w, "Reload failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status": "reloaded"}`)
+}
+
+// writeDecodeError responds to a request whose body decodeBody rejected.
+func writeDecodeError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	var schemaErr *schemaError
+	switch {
+	case errors.As(err, &schemaErr):
+		http.Error(w, "Bad request: "+schemaErr.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, errUnsupportedMediaType):
+		http.Error(w, "Unsupported media type", http.StatusUnsupportedMediaType)
+	case errors.As(err, &maxBytesErr):
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+	default:
+		http.Error(w, "Bad request", http.StatusUnprocessableEntity)
+	}
+}
+
+// writeStoreError logs a failed store call and responds 504 when it ran out
+// of time, 500 otherwise.
+func writeStoreError(w http.ResponseWriter, logger *slog.Logger, err error, msg string, args ...any) {
+	logger.Error(msg, append(args, "error", err)...)
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, "Gateway timeout: the database took too long", http.StatusGatewayTimeout)
+		return
+	}
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+// batchHandler stores many readings at once, e.g. a device's offline backlog.
+func (s *server) batchHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r, ScopeWrite) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var payloads []TemperatureReadingPayload
+	if err := decodeValidBody(r, "batch.json", &payloads); err != nil {
+		logger.Error("failed to decode temperature reading batch",
+			slog.Any("error", err),
+		)
+		writeDecodeError(w, err)
+		return
+	}
+	readings := make([]store.TemperatureReading, 0, len(payloads))
+	for _, p := range payloads {
+		readings = append(readings, store.TemperatureReading{TempCo: p.TempCo, TempRoom: p.TempRoom, Humidity: p.Humidity, Timestamp: p.Timestamp})
+	}
+	result, err := s.ingest.Ingest(r.Context(), "batch", ingest.Batch{Device: s.keyDevice(r), Readings: readings})
+	if err != nil {
+		s.writeIngestError(w, logger, err)
+		return
+	}
+	logger.Info("Received temperature reading batch", slog.Int("count", len(result.Stored)), slog.Int("duplicates", result.Duplicates))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"inserted": len(result.Stored), "duplicates": result.Duplicates})
+}
+
+func (s *server) dataHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodPost:
+		if !s.authorized(r, ScopeWrite) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		var tri TemperatureReadingPayload
+		if err := decodeValidBody(r, "reading.json", &tri); err != nil {
+			logger.Error("failed to decode temperature reading",
+				slog.Any("error", err),
+			)
+			writeDecodeError(w, err)
+			return
+		}
+		logger.Info("Received temperature reading",
+			slog.Any("data", tri),
+		)
+		tr := store.TemperatureReading{
+			TempCo:    tri.TempCo,
+			TempRoom:  tri.TempRoom,
+			Humidity:  tri.Humidity,
+			Timestamp: tri.Timestamp,
+		}
+		result, err := s.ingest.Ingest(r.Context(), "json", ingest.Batch{Device: s.keyDevice(r), Readings: []store.TemperatureReading{tr}})
+		if err != nil {
+			s.writeIngestError(w, logger, err)
+			return
+		}
+		// a re-sent reading is acknowledged again without an id
+		if len(result.Stored) > 0 {
+			tr = result.Stored[0]
+		}
+		json.NewEncoder(w).Encode(tr)
+
+	case http.MethodGet:
+		limitStr := r.URL.Query().Get("limit")
+		limit := 10
+		if limitStr != "" {
+			if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 100 {
+				limit = l
+			}
+		}
+
+		offsetStr := r.URL.Query().Get("offset")
+		offset := 0
+		if offsetStr != "" {
+			if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+				offset = o
+			}
+		}
+
+		w.Header().Set("Vary", "Accept")
+		format := negotiate(r.Header.Get("Accept"), contentTypeJSON, contentTypeCSV, contentTypeNDJSON)
+		if format == "" {
+			http.Error(w, "Not acceptable, supported: "+contentTypeJSON+", "+contentTypeCSV+", "+contentTypeNDJSON, http.StatusNotAcceptable)
+			return
+		}
+
+		q := r.URL.Query()
+		csvf, ok := parseCSVFormat(w, q)
+		if !ok {
+			return
+		}
+		filters, ok := s.parseFilters(w, q)
+		if !ok {
+			return
+		}
+		if len(filters) > 0 && (q.Has("points") || q.Has("cadence") || q.Has("smooth")) {
+			http.Error(w, "Bad request: filters can't be combined with points, cadence or smooth", http.StatusUnprocessableEntity)
+			return
+		}
+		if q.Has("order") && (q.Has("points") || q.Has("cadence")) {
+			http.Error(w, "Bad request: order can't be combined with points or cadence", http.StatusUnprocessableEntity)
+			return
+		}
+		if q.Has("points") && q.Has("cadence") {
+			http.Error(w, "Bad request: points can't be combined with cadence", http.StatusUnprocessableEntity)
+			return
+		}
+		if q.Has("points") {
+			s.writeDownsampled(w, r, format, csvf)
+			return
+		}
+		if q.Has("cadence") {
+			s.writeInterpolated(w, r, format, csvf)
+			return
+		}
+
+		list, ok := s.parseSelection(w, r, filters)
+		if !ok {
+			return
+		}
+		readings, err := list(r.Context(), limit, offset)
+		if err != nil {
+			writeStoreError(w, logger, err, "Failed to query temperature readings")
+			return
+		}
+		if err := s.writeReadings(w, r, format, csvf, readings, &page{limit: limit, offset: offset}); err != nil {
+			logger.Error("Failed to write temperature readings", "error", err)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+
+}
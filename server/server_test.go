@@ -0,0 +1,1242 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	arrowmemory "github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+	"github.com/bartosz121/esp8266-web/aggregate"
+	"github.com/bartosz121/esp8266-web/alert"
+	"github.com/bartosz121/esp8266-web/ingest"
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/xuri/excelize/v2"
+)
+
+func newTestServer(secretKey string) (*server, *memory.Store) {
+	st := memory.New()
+	engine := alert.NewEngine(st, alert.Config{})
+	return &server{cfg: Config{SecretKey: secretKey}, store: st, alerts: engine, ingest: ingest.New(st, ingest.Config{Alerts: engine})}, st
+}
+
+func TestDataHandlerPOST(t *testing.T) {
+	s, _ := newTestServer("testsecret")
+
+	body := `{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0, "timestamp": 1761388101}`
+	req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+
+	s.dataHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp store.TemperatureReading
+	err := json.NewDecoder(w.Body).Decode(&resp)
+
+	assert.NoError(t, err)
+	assert.NotNil(t, resp.Id)
+	assert.Equal(t, 25.5, resp.TempCo)
+	assert.Equal(t, 22.0, resp.TempRoom)
+	assert.Equal(t, 60.0, resp.Humidity)
+	assert.Equal(t, int64(1761388101), *resp.Timestamp)
+}
+
+func TestDataHandlerPOSTNilTimestamp(t *testing.T) {
+	s, _ := newTestServer("testsecret")
+
+	body := `{"tempCo": 26.0, "tempRoom": 23.0, "humidity": 55.0}`
+	req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+
+	s.dataHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp store.TemperatureReading
+	err := json.NewDecoder(w.Body).Decode(&resp)
+
+	assert.NoError(t, err)
+	assert.NotNil(t, resp.Id)
+	assert.Equal(t, 26.0, resp.TempCo)
+	assert.Equal(t, 23.0, resp.TempRoom)
+	assert.Equal(t, 55.0, resp.Humidity)
+	assert.NotNil(t, resp.Timestamp)
+}
+
+func TestDataHandlerGET(t *testing.T) {
+	s, st := newTestServer("dummy")
+
+	now := time.Now().UTC().Unix()
+	_, err := st.InsertReading(context.Background(), store.TemperatureReading{TempCo: 27.0, TempRoom: 24.0, Humidity: 50.0, Timestamp: &now})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/data", nil)
+	w := httptest.NewRecorder()
+
+	s.dataHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp []store.TemperatureReading
+	err = json.NewDecoder(w.Body).Decode(&resp)
+
+	assert.NoError(t, err)
+	assert.Greater(t, len(resp), 0)
+}
+
+func TestDataHandlerGETEmpty(t *testing.T) {
+	s, _ := newTestServer("dummy")
+
+	req := httptest.NewRequest("GET", "/data", nil)
+	w := httptest.NewRecorder()
+
+	s.dataHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp []store.TemperatureReading
+	err := json.NewDecoder(w.Body).Decode(&resp)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(resp))
+}
+
+func TestDataHandlerPOSTInvalidAuth(t *testing.T) {
+	s, _ := newTestServer("testsecret")
+
+	body := `{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0}`
+	req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Secret-Key", "wrongkey")
+	w := httptest.NewRecorder()
+
+	s.dataHandler(w, req)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestDataHandlerInvalidMethod(t *testing.T) {
+	s := &server{}
+	req := httptest.NewRequest("PUT", "/data", nil)
+	w := httptest.NewRecorder()
+
+	s.dataHandler(w, req)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestHealthHandler(t *testing.T) {
+	s := &server{}
+	req := httptest.NewRequest("GET", "/health", nil)
+	w := httptest.NewRecorder()
+
+	s.healthHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "ok"}`, w.Body.String())
+}
+
+// unreachableStore fails to ping, like a database that is down.
+type unreachableStore struct{ store.Store }
+
+func (unreachableStore) Ping(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+func TestReadyHandler(t *testing.T) {
+	s := &server{store: memory.New()}
+	w := httptest.NewRecorder()
+	s.readyHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "ready"}`, w.Body.String())
+
+	s = &server{store: unreachableStore{memory.New()}}
+	w = httptest.NewRecorder()
+	s.readyHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"status": "unavailable"}`, w.Body.String())
+
+	s = &server{store: memory.New(), cfg: Config{Leader: func() bool { return true }}}
+	w = httptest.NewRecorder()
+	s.readyHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "ready", "leader": true}`, w.Body.String())
+}
+
+func TestStaleDevices(t *testing.T) {
+	now := time.Unix(1761388200, 0)
+	lastSeen := map[string]time.Time{
+		"boiler": now.Add(-time.Hour),
+		"attic":  now.Add(-time.Minute),
+		"cellar": now.Add(-2 * time.Hour),
+	}
+	assert.Equal(t, []StaleDevice{
+		{Device: "boiler", LastSeen: 1761384600, Age: 3600},
+		{Device: "cellar", LastSeen: 1761381000, Age: 7200},
+	}, staleDevices(lastSeen, 30*time.Minute, now))
+	assert.Empty(t, staleDevices(lastSeen, 3*time.Hour, now))
+
+	ingest.Seen("garage", time.Now().Add(-time.Hour))
+	s := &server{store: memory.New(), cfg: Config{StaleAfter: 30 * time.Minute}}
+	w := httptest.NewRecorder()
+	s.readyHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var ready struct {
+		Status string        `json:"status"`
+		Stale  []StaleDevice `json:"stale"`
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&ready))
+	assert.Equal(t, "ready", ready.Status)
+	assert.True(t, slices.ContainsFunc(ready.Stale, func(d StaleDevice) bool { return d.Device == "garage" }))
+}
+
+// slowStore times out listing readings, like a stuck query.
+type slowStore struct{ store.Store }
+
+func (slowStore) ListReadings(ctx context.Context, limit, offset int) ([]store.TemperatureReading, error) {
+	return nil, fmt.Errorf("list readings: %w", context.DeadlineExceeded)
+}
+
+func TestStoreTimeout(t *testing.T) {
+	srv := NewServer(Config{SecretKey: "testsecret"}, slowStore{memory.New()})
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/data", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+}
+
+func TestHomeHandler(t *testing.T) {
+	s := &server{}
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+
+	s.homeHandler(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Temperature Monitor")
+}
+
+func TestNewServer(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/health")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("X-Request-ID"))
+}
+
+func TestReloadHandler(t *testing.T) {
+	reloads := 0
+	s := &server{cfg: Config{SecretKey: "testsecret", Reload: func(ctx context.Context) error {
+		reloads++
+		return nil
+	}}}
+
+	req := httptest.NewRequest("POST", "/admin/reload", nil)
+	w := httptest.NewRecorder()
+	s.reloadHandler(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, 0, reloads)
+
+	req = httptest.NewRequest("POST", "/admin/reload", nil)
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w = httptest.NewRecorder()
+	s.reloadHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, reloads)
+}
+
+func TestDataHandlerGETContentNegotiation(t *testing.T) {
+	s, st := newTestServer("dummy")
+	ts := int64(1761388101)
+	_, err := st.InsertReading(context.Background(), store.TemperatureReading{TempCo: 27.5, TempRoom: 24.0, Humidity: 50.0, Timestamp: &ts})
+	require.NoError(t, err)
+
+	tests := []struct {
+		accept      string
+		code        int
+		contentType string
+		body        string
+	}{
+		{"", http.StatusOK, "application/json", `[{"id":1,"tempCo":27.5,"tempRoom":24,"humidity":50,"timestamp":1761388101,"quality":"ok"}]` + "\n"},
+		{"*/*", http.StatusOK, "application/json", `[{"id":1,"tempCo":27.5,"tempRoom":24,"humidity":50,"timestamp":1761388101,"quality":"ok"}]` + "\n"},
+		{"text/csv", http.StatusOK, "text/csv; charset=utf-8", "id,tempCo,tempRoom,humidity,timestamp,receivedAt,quality\n1,27.5,24,50,1761388101,,ok\n"},
+		{"application/x-ndjson", http.StatusOK, "application/x-ndjson", `{"id":1,"tempCo":27.5,"tempRoom":24,"humidity":50,"timestamp":1761388101,"quality":"ok"}` + "\n"},
+		{"application/json;q=0.5, text/*", http.StatusOK, "text/csv; charset=utf-8", "id,tempCo,tempRoom,humidity,timestamp,receivedAt,quality\n1,27.5,24,50,1761388101,,ok\n"},
+		{"application/xml", http.StatusNotAcceptable, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/data", nil)
+			req.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+
+			s.dataHandler(w, req)
+
+			assert.Equal(t, tt.code, w.Code)
+			assert.Equal(t, "Accept", w.Header().Get("Vary"))
+			if tt.code == http.StatusOK {
+				assert.Equal(t, tt.contentType, w.Header().Get("Content-Type"))
+				assert.Equal(t, tt.body, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestDataHandlerCSVFormat(t *testing.T) {
+	s, st := newTestServer("dummy")
+	ts := int64(1761388101)
+	_, err := st.InsertReading(context.Background(), store.TemperatureReading{TempCo: 27.5, TempRoom: 24.0, Humidity: 50.25, Timestamp: &ts})
+	require.NoError(t, err)
+
+	tests := []struct {
+		query string
+		code  int
+		body  string
+	}{
+		{"", http.StatusOK, "id,tempCo,tempRoom,humidity,timestamp,receivedAt,quality\n1,27.5,24,50.25,1761388101,,ok\n"},
+		{"locale=de", http.StatusOK, "id;tempCo;tempRoom;humidity;timestamp;receivedAt;quality\n1;27,5;24;50,25;1761388101;;ok\n"},
+		{"locale=pl-PL&delimiter=tab", http.StatusOK, "id\ttempCo\ttempRoom\thumidity\ttimestamp\treceivedAt\tquality\n1\t27,5\t24\t50,25\t1761388101\t\tok\n"},
+		{"locale=en-GB", http.StatusOK, "id,tempCo,tempRoom,humidity,timestamp,receivedAt,quality\n1,27.5,24,50.25,1761388101,,ok\n"},
+		{"delimiter=;", http.StatusOK, "id;tempCo;tempRoom;humidity;timestamp;receivedAt;quality\n1;27.5;24;50.25;1761388101;;ok\n"},
+		{"locale=de&delimiter=,", http.StatusUnprocessableEntity, ""},
+		{"delimiter=x", http.StatusUnprocessableEntity, ""},
+		{"locale=not_a_locale!", http.StatusUnprocessableEntity, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/data?"+strings.ReplaceAll(tt.query, ";", "%3B"), nil)
+			req.Header.Set("Accept", "text/csv")
+			w := httptest.NewRecorder()
+
+			s.dataHandler(w, req)
+
+			assert.Equal(t, tt.code, w.Code)
+			if tt.code == http.StatusOK {
+				assert.Equal(t, tt.body, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestDataHandlerPOSTBinaryEncodings(t *testing.T) {
+	payload := map[string]any{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0, "timestamp": 1761388101}
+	cborBody, err := cbor.Marshal(payload)
+	require.NoError(t, err)
+	msgpackBody, err := msgpack.Marshal(payload)
+	require.NoError(t, err)
+
+	tests := []struct {
+		contentType string
+		body        []byte
+	}{
+		{"application/cbor", cborBody},
+		{"application/msgpack", msgpackBody},
+		{"application/x-msgpack", msgpackBody},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			s, _ := newTestServer("testsecret")
+			req := httptest.NewRequest("POST", "/data", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set("X-Secret-Key", "testsecret")
+			w := httptest.NewRecorder()
+
+			s.dataHandler(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			var resp store.TemperatureReading
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			assert.Equal(t, 25.5, resp.TempCo)
+			assert.Equal(t, 22.0, resp.TempRoom)
+			assert.Equal(t, 60.0, resp.Humidity)
+			assert.Equal(t, int64(1761388101), *resp.Timestamp)
+		})
+	}
+}
+
+func TestDataHandlerPOSTUnsupportedMediaType(t *testing.T) {
+	s, _ := newTestServer("testsecret")
+	req := httptest.NewRequest("POST", "/data", bytes.NewReader([]byte("<reading/>")))
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+
+	s.dataHandler(w, req)
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+}
+
+func TestSchemaValidation(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	tests := []struct {
+		path, body string
+		want       []string
+	}{
+		{"/data", `{"tempCo": "25.5", "tempRoom": 22.0, "timestamp": -1}`,
+			[]string{"/tempCo: got string, want number", "/timestamp: minimum: got -1, want 0"}},
+		{"/data", `[]`, []string{"/: got array, want object"}},
+		{"/data/batch", `[{"tempCo": 25.5}, {"humidity": true}]`, []string{"/1/humidity: got boolean, want number"}},
+		{"/sync", `{"device": "", "readings": [{"tempCo": 25.5}]}`,
+			[]string{"/device: minLength: got 0, want 1", "/readings/0: missing property 'seq'"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp := doRequest(t, srv, "POST", tt.path, tt.body)
+			assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			for _, want := range tt.want {
+				assert.Contains(t, string(body), want)
+			}
+		})
+	}
+
+	// binary encodings are validated the same
+	cborBody, err := cbor.Marshal(map[string]any{"tempCo": "hot"})
+	require.NoError(t, err)
+	req, err := http.NewRequest("POST", srv.URL+"/data", bytes.NewReader(cborBody))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/cbor")
+	req.Header.Set("X-Secret-Key", "testsecret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "/tempCo: got string, want number")
+
+	resp = doRequest(t, srv, "GET", "/schemas/batch.json", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/schema+json", resp.Header.Get("Content-Type"))
+	var schema map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&schema))
+	assert.Equal(t, "array", schema["type"])
+
+	resp = doRequest(t, srv, "GET", "/schemas/missing.json", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestBatchHandlerGzip(t *testing.T) {
+	st := memory.New()
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, st))
+	defer srv.Close()
+
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	_, err := gz.Write([]byte(`[
+		{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0, "timestamp": 1761388101},
+		{"tempCo": 26.0, "tempRoom": 22.5, "humidity": 59.0, "timestamp": 1761388161}
+	]`))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	req, err := http.NewRequest("POST", srv.URL+"/data/batch", &body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("X-Secret-Key", "testsecret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var result map[string]int64
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, int64(2), result["inserted"])
+
+	readings, err := st.ListReadings(context.Background(), 10, 0)
+	require.NoError(t, err)
+	assert.Len(t, readings, 2)
+}
+
+func TestBatchHandlerBodyTooLarge(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret", MaxBodyBytes: 64}, memory.New()))
+	defer srv.Close()
+
+	body := `[` + strings.Repeat(`{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0},`, 10) + `{}]`
+	req, err := http.NewRequest("POST", srv.URL+"/data/batch", strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("X-Secret-Key", "testsecret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func TestDataHandlerPOSTDeduplicates(t *testing.T) {
+	s, st := newTestServer("testsecret")
+	body := `{"tempCo": 25.5, "tempRoom": 22.0, "humidity": 60.0, "timestamp": 1761388101}`
+	for range 2 {
+		req := httptest.NewRequest("POST", "/data", strings.NewReader(body))
+		req.Header.Set("X-Secret-Key", "testsecret")
+		w := httptest.NewRecorder()
+		s.dataHandler(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	readings, err := st.ListReadings(context.Background(), 10, 0)
+	require.NoError(t, err)
+	assert.Len(t, readings, 1)
+
+	req := httptest.NewRequest("POST", "/data", strings.NewReader(`{"tempCo": 25.5, "humidity": 160.0}`))
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+	s.dataHandler(w, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), "humidity must be between 0 and 100")
+}
+
+func TestLineProtocolIngest(t *testing.T) {
+	st := memory.New()
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, st))
+	defer srv.Close()
+
+	body := "readings temp_co=40.5,temp_room=21.5,humidity=50 1761388101\nreadings temp_co=41,temp_room=21.6,humidity=50 1761388161\n"
+	req, err := http.NewRequest("POST", srv.URL+"/ingest/line?precision=s", strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("X-Secret-Key", "testsecret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var result map[string]int
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, map[string]int{"inserted": 2, "duplicates": 0}, result)
+
+	req, err = http.NewRequest("POST", srv.URL+"/ingest/line", strings.NewReader(body))
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestWebhookIngest(t *testing.T) {
+	webhooks := map[string]ingest.Webhook{"line": {Secret: "0123456789abcdef", Signature: ingest.SignatureHMACSHA256}}
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret", Webhooks: webhooks}, memory.New()))
+	defer srv.Close()
+
+	body := "readings temp_co=40.5,temp_room=21.5,humidity=50 1761388101\n"
+	post := func(header, value string) int {
+		req, err := http.NewRequest("POST", srv.URL+"/ingest/line?precision=s", strings.NewReader(body))
+		require.NoError(t, err)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	mac := hmac.New(sha256.New, []byte("0123456789abcdef"))
+	mac.Write([]byte(body))
+	assert.Equal(t, http.StatusOK, post("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil))))
+	assert.Equal(t, http.StatusForbidden, post("X-Signature", hex.EncodeToString([]byte("spoofed"))))
+	assert.Equal(t, http.StatusForbidden, post("", ""))
+	// the secret key still authorizes devices
+	assert.Equal(t, http.StatusOK, post("X-Secret-Key", "testsecret"))
+
+}
+
+func TestOutdoorHandler(t *testing.T) {
+	s, st := newTestServer("dummy")
+	ctx := context.Background()
+	now := time.Now().Unix()
+	require.NoError(t, st.InsertOutdoorReading(ctx, store.OutdoorReading{Temp: 4.5, Humidity: 87, Timestamp: now - 600}))
+	require.NoError(t, st.InsertOutdoorReading(ctx, store.OutdoorReading{Temp: 3, Humidity: 90, Timestamp: now - 2*86400}))
+
+	w := httptest.NewRecorder()
+	s.outdoorHandler(w, httptest.NewRequest("GET", "/data/outdoor", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp []store.OutdoorReading
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, []store.OutdoorReading{{Temp: 4.5, Humidity: 87, Timestamp: now - 600}}, resp)
+
+	w = httptest.NewRecorder()
+	s.outdoorHandler(w, httptest.NewRequest("GET", "/data/outdoor?from=0", nil))
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Len(t, resp, 2)
+
+	w = httptest.NewRecorder()
+	s.outdoorHandler(w, httptest.NewRequest("GET", "/data/outdoor?to=soon", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = httptest.NewRecorder()
+	s.outdoorHandler(w, httptest.NewRequest("POST", "/data/outdoor", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestHeatingUsageHandler(t *testing.T) {
+	st := memory.New()
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, st))
+	defer srv.Close()
+	ctx := context.Background()
+
+	now := time.Now().Unix()
+	from, to := now-7200, now
+	for i, co := range []float64{55, 60, 50, 25, 20} {
+		ts := from + int64(i)*900
+		_, err := st.InsertReading(ctx, store.TemperatureReading{TempCo: co, Timestamp: &ts})
+		require.NoError(t, err)
+	}
+	get := func(path string) HeatingUsage {
+		resp := doRequest(t, srv, "GET", path, "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var u HeatingUsage
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&u))
+		return u
+	}
+
+	// 55, 60 and 50 are at or above the default threshold, 15 minutes each
+	u := get(fmt.Sprintf("/data/heating-usage?from=%d&to=%d&power=20", from, to))
+	assert.Equal(t, "readings", u.Source)
+	assert.InDelta(t, 0.75, u.RuntimeHours, 1e-9)
+	assert.InDelta(t, 15, u.EnergyKWh, 1e-9)
+	assert.NotEmpty(t, u.Days)
+	u = get(fmt.Sprintf("/data/heating-usage?from=%d&to=%d&threshold=58", from, to))
+	assert.InDelta(t, 0.25, u.RuntimeHours, 1e-9)
+
+	zone, err := st.CreateZone(ctx, store.Zone{Name: "living room", Device: "boiler", RelayDevice: "boiler", Field: "tempRoom", Mode: "heat", Enabled: true})
+	require.NoError(t, err)
+	require.NoError(t, st.SetZoneRelay(ctx, store.ZoneEvent{ZoneId: zone.Id, State: "on", Timestamp: from - 3600}))
+	require.NoError(t, st.SetZoneRelay(ctx, store.ZoneEvent{ZoneId: zone.Id, State: "off", Timestamp: from + 1800}))
+	require.NoError(t, st.SetZoneRelay(ctx, store.ZoneEvent{ZoneId: zone.Id, State: "on", Timestamp: to - 900}))
+	u = get(fmt.Sprintf("/data/heating-usage?from=%d&to=%d&zone=%d", from, to, zone.Id))
+	assert.Equal(t, "relay", u.Source)
+	assert.InDelta(t, 0.75, u.RuntimeHours, 1e-9)
+
+	assert.Equal(t, http.StatusNotFound, doRequest(t, srv, "GET", "/data/heating-usage?zone=99", "").StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/data/heating-usage?from=10&to=5", "").StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/data/heating-usage?power=-1", "").StatusCode)
+}
+
+func TestAggregateHandler(t *testing.T) {
+	s, st := newTestServer("dummy")
+	ctx := context.Background()
+	for _, r := range []struct {
+		room float64
+		ts   int64
+	}{{20, 3600}, {22, 3700}, {26, 3 * 3600}} {
+		_, err := st.InsertReading(ctx, store.TemperatureReading{TempRoom: r.room, Timestamp: &r.ts})
+		require.NoError(t, err)
+	}
+	get := func(query string) []aggregate.Bucket {
+		w := httptest.NewRecorder()
+		s.aggregateHandler(w, httptest.NewRequest("GET", "/data/aggregate?from=3600&to=14400"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var buckets []aggregate.Bucket
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&buckets))
+		return buckets
+	}
+
+	buckets := get("")
+	require.Len(t, buckets, 2)
+	assert.Equal(t, 2, buckets[0].Count)
+	assert.Equal(t, 21.0, *buckets[0].TempRoom)
+
+	buckets = get("&fill=linear")
+	require.Len(t, buckets, 3)
+	assert.Equal(t, int64(7200), buckets[1].Timestamp)
+	assert.Equal(t, 0, buckets[1].Count)
+	assert.Equal(t, 23.5, *buckets[1].TempRoom)
+
+	buckets = get("&interval=2h&fill=null")
+	require.Len(t, buckets, 2)
+	assert.Equal(t, int64(0), buckets[0].Timestamp)
+
+	for _, query := range []string{"from=3600&fill=spline", "from=3600&interval=1s", "from=3600&interval=soon", "from=14400"} {
+		w := httptest.NewRecorder()
+		s.aggregateHandler(w, httptest.NewRequest("GET", "/data/aggregate?to=14400&"+query, nil))
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code, query)
+	}
+}
+
+func TestDataHandlerGETDownsampled(t *testing.T) {
+	s, st := newTestServer("dummy")
+	ctx := context.Background()
+	var readings []store.TemperatureReading
+	for i := range 1000 {
+		ts := int64(i * 60)
+		readings = append(readings, store.TemperatureReading{TempCo: 40 + float64(i%7), TempRoom: 21, Humidity: 50, Timestamp: &ts})
+	}
+	_, err := st.InsertReadings(ctx, readings)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	s.dataHandler(w, httptest.NewRequest("GET", "/data?points=50&from=0&to=59940", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp []store.TemperatureReading
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.Len(t, resp, 50)
+	// newest first, the range ends are kept
+	assert.Equal(t, int64(59940), *resp[0].Timestamp)
+	assert.Equal(t, int64(0), *resp[49].Timestamp)
+
+	// fewer readings than points in the range are returned as they are
+	w = httptest.NewRecorder()
+	s.dataHandler(w, httptest.NewRequest("GET", "/data?points=50&from=600&to=1200", nil))
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Len(t, resp, 11)
+
+	req := httptest.NewRequest("GET", "/data?points=5&from=0&to=59940", nil)
+	req.Header.Set("Accept", "text/csv")
+	w = httptest.NewRecorder()
+	s.dataHandler(w, req)
+	assert.Equal(t, 6, strings.Count(w.Body.String(), "\n"))
+
+	for _, query := range []string{"points=2", "points=many", "points=50&from=100&to=50"} {
+		w = httptest.NewRecorder()
+		s.dataHandler(w, httptest.NewRequest("GET", "/data?"+query, nil))
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code, query)
+	}
+}
+
+func TestDataHandlerGETEnvelope(t *testing.T) {
+	s, st := newTestServer("dummy")
+	ctx := context.Background()
+	for i := range 5 {
+		ts := int64(1761388000 + i*60)
+		_, err := st.InsertReading(ctx, store.TemperatureReading{TempCo: 40, TempRoom: 21, Humidity: 50, Timestamp: &ts})
+		require.NoError(t, err)
+	}
+
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		s.dataHandler(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		return w
+	}
+	w := get("/data?limit=2&offset=2&quality=ok", "application/json; profile=envelope")
+	assert.Equal(t, "application/json; profile=envelope", w.Header().Get("Content-Type"))
+	var env struct {
+		Data []store.TemperatureReading `json:"data"`
+		Envelope
+	}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&env))
+	require.Len(t, env.Data, 2)
+	assert.Equal(t, int64(1761388120), *env.Data[0].Timestamp)
+	two := 2
+	assert.Equal(t, EnvelopeMeta{Count: 2, Limit: &two, Offset: &two}, env.Meta)
+	assert.Equal(t, EnvelopeLinks{
+		Self: "/data?limit=2&offset=2&quality=ok",
+		Next: "/data?limit=2&offset=4&quality=ok",
+		Prev: "/data?limit=2&offset=0&quality=ok",
+	}, env.Links)
+
+	// the last page isn't full
+	w = get("/data?limit=2&offset=4", "application/json; profile=envelope")
+	env.Links = EnvelopeLinks{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&env))
+	assert.Empty(t, env.Links.Next)
+	assert.Equal(t, "/data?limit=2&offset=2", env.Links.Prev)
+
+	// bare arrays stay the default, unless configured otherwise
+	w = get("/data", "")
+	assert.True(t, strings.HasPrefix(w.Body.String(), "["))
+	s.cfg.Envelope = true
+	w = get("/data", "")
+	assert.True(t, strings.HasPrefix(w.Body.String(), "{"))
+	w = get("/data", "application/json; profile=bare")
+	assert.True(t, strings.HasPrefix(w.Body.String(), "["))
+	w = get("/data?points=3&from=1761388000&to=1761388240", "")
+	env.Meta = EnvelopeMeta{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&env))
+	assert.Equal(t, EnvelopeMeta{Count: 3}, env.Meta)
+	assert.Equal(t, "text/csv; charset=utf-8", get("/data", "text/csv").Header().Get("Content-Type"))
+}
+
+func TestDataHandlerGETInterpolated(t *testing.T) {
+	s, st := newTestServer("dummy")
+	ctx := context.Background()
+	var readings []store.TemperatureReading
+	for i, ts := range []int64{0, 70, 300} {
+		readings = append(readings, store.TemperatureReading{TempCo: 40, TempRoom: 20 + float64(i), Humidity: 50, Timestamp: &ts})
+	}
+	_, err := st.InsertReadings(ctx, readings)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	s.dataHandler(w, httptest.NewRequest("GET", "/data?cadence=1m&from=0&to=300", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp []store.TemperatureReading
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.Len(t, resp, 6)
+	// newest first, stored readings on a tick are kept as they are
+	assert.Equal(t, int64(300), *resp[0].Timestamp)
+	assert.NotZero(t, resp[0].Id)
+	assert.Equal(t, store.QualityOK, resp[0].Quality)
+	assert.Equal(t, int64(0), *resp[5].Timestamp)
+	for _, r := range resp[1:5] {
+		assert.Zero(t, r.Id)
+		assert.Equal(t, store.QualityInterpolated, r.Quality)
+	}
+	assert.InDelta(t, 20+60.0/70, resp[4].TempRoom, 1e-9)
+
+	for _, query := range []string{"cadence=0s", "cadence=1500ms", "cadence=often", "cadence=1s&from=0&to=86400", "cadence=1m&points=10", "cadence=1m&order=receivedAt", "cadence=1m&tempCo[gt]=1"} {
+		w = httptest.NewRecorder()
+		s.dataHandler(w, httptest.NewRequest("GET", "/data?"+query, nil))
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code, query)
+	}
+}
+
+func TestDataHandlerGETSmoothed(t *testing.T) {
+	s, st := newTestServer("dummy")
+	ctx := context.Background()
+	var readings []store.TemperatureReading
+	for i, co := range []float64{40, 43, 40, 49, 40} {
+		ts := int64(1761388000 + i*60)
+		readings = append(readings, store.TemperatureReading{TempCo: co, TempRoom: 21, Humidity: 50, Timestamp: &ts})
+	}
+	_, err := st.InsertReadings(ctx, readings)
+	require.NoError(t, err)
+
+	get := func(path string) []store.TemperatureReading {
+		w := httptest.NewRecorder()
+		s.dataHandler(w, httptest.NewRequest("GET", path, nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp []store.TemperatureReading
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		return resp
+	}
+	resp := get("/data?limit=2&offset=1&smooth=2m")
+	assert.Equal(t, []float64{43, 44}, []float64{resp[0].TempCo, resp[1].TempCo})
+	resp = get("/data?points=3&from=1761388000&to=1761388240&smooth=2m")
+	assert.Equal(t, []float64{44.5, 41, 41.5}, []float64{resp[0].TempCo, resp[1].TempCo, resp[2].TempCo})
+
+	w := httptest.NewRecorder()
+	s.dataHandler(w, httptest.NewRequest("GET", "/data?smooth=1s", nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	// stores that can't smooth
+	s.store = struct{ store.Store }{st}
+	w = httptest.NewRecorder()
+	s.dataHandler(w, httptest.NewRequest("GET", "/data?smooth=15m", nil))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+func TestDataHandlerGETFiltered(t *testing.T) {
+	s, st := newTestServer("dummy")
+	ctx := context.Background()
+	var readings []store.TemperatureReading
+	for i, co := range []float64{40, 55, 60, 52, 45} {
+		ts := int64(1761388000 + i*60)
+		readings = append(readings, store.TemperatureReading{TempCo: co, TempRoom: 16 + float64(i), Humidity: 50, Timestamp: &ts})
+	}
+	_, err := st.InsertReadings(ctx, readings)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	s.dataHandler(w, httptest.NewRequest("GET", "/data?tempCo[gte]=50&tempRoom[lt]=19", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp []store.TemperatureReading
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, []float64{60, 55}, []float64{resp[0].TempCo, resp[1].TempCo})
+
+	// escaped brackets and repeated keys
+	w = httptest.NewRecorder()
+	s.dataHandler(w, httptest.NewRequest("GET", "/data?tempCo%5Bgt%5D=41&tempCo%5Bgt%5D=50&limit=1", nil))
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, []float64{52}, []float64{resp[0].TempCo})
+
+	for _, query := range []string{"pressure[gt]=1", "tempCo[like]=5", "tempCo[gt]=hot", "timestamp[gt]=1.5", "tempCo[gt]=1&smooth=15m", "tempCo[gt]=1&points=10"} {
+		w = httptest.NewRecorder()
+		s.dataHandler(w, httptest.NewRequest("GET", "/data?"+query, nil))
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code, query)
+	}
+
+	s.store = struct{ store.Store }{st}
+	w = httptest.NewRecorder()
+	s.dataHandler(w, httptest.NewRequest("GET", "/data?tempCo[gt]=1", nil))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+func TestDataHandlerReceivedAt(t *testing.T) {
+	s, st := newTestServer("dummy")
+	ctx := context.Background()
+	// the first reading was measured before, but uploaded after, the second
+	for _, ts := range [][2]int64{{1761388000, 1761388700}, {1761388600, 1761388600}} {
+		measured, received := ts[0], ts[1]
+		_, err := st.InsertReading(ctx, store.TemperatureReading{TempCo: 40, Timestamp: &measured, ReceivedAt: &received})
+		require.NoError(t, err)
+	}
+
+	var resp []store.TemperatureReading
+	w := httptest.NewRecorder()
+	s.dataHandler(w, httptest.NewRequest("GET", "/data", nil))
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, []int{2, 1}, []int{resp[0].Id, resp[1].Id})
+	assert.Equal(t, int64(1761388600), *resp[0].ReceivedAt)
+
+	w = httptest.NewRecorder()
+	s.dataHandler(w, httptest.NewRequest("GET", "/data?order=receivedAt", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, []int{1, 2}, []int{resp[0].Id, resp[1].Id})
+
+	w = httptest.NewRecorder()
+	s.dataHandler(w, httptest.NewRequest("GET", "/data?receivedAt[gt]=1761388600", nil))
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.Len(t, resp, 1)
+	assert.Equal(t, 1, resp[0].Id)
+
+	for _, query := range []string{"order=stored", "order=receivedAt&smooth=15m", "order=receivedAt&points=10", "receivedAt[gt]=1.5"} {
+		w = httptest.NewRecorder()
+		s.dataHandler(w, httptest.NewRequest("GET", "/data?"+query, nil))
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code, query)
+	}
+
+	s.store = struct{ store.Store }{st}
+	w = httptest.NewRecorder()
+	s.dataHandler(w, httptest.NewRequest("GET", "/data?order=receivedAt", nil))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+func TestChartHandler(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	for seq, ts := range []int64{1761386400, 1761388200, 1761390000} {
+		body := fmt.Sprintf(`{"device": "attic", "readings": [{"seq": %d, "tempCo": 40, "tempRoom": %d, "humidity": 50, "timestamp": %d}]}`, seq+1, 20+seq, ts)
+		require.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/sync", body).StatusCode)
+	}
+
+	resp := doRequest(t, srv, "GET", "/chart.png?device=attic&from=1761386000&to=1761391000&width=400&height=240&fields=tempRoom,humidity", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+	img, err := png.Decode(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 400, img.Bounds().Dx())
+	assert.Equal(t, 240, img.Bounds().Dy())
+
+	assert.Equal(t, http.StatusNotFound, doRequest(t, srv, "GET", "/chart.png?device=boiler&from=1761386000&to=1761391000", "").StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/chart.png?width=10", "").StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/chart.png?fields=pressure", "").StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/chart.png?from=1761391000&to=1761386000", "").StatusCode)
+}
+
+func TestExportXLSXHandler(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	for seq, ts := range []int64{1761386400, 1761388200, 1761390000} {
+		for _, device := range []string{"attic", "boiler"} {
+			body := fmt.Sprintf(`{"device": %q, "readings": [{"seq": %d, "tempCo": 40, "tempRoom": %d, "humidity": 50, "timestamp": %d}]}`, device, seq+1, 20+seq, ts)
+			require.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/sync", body).StatusCode)
+		}
+	}
+
+	resp := doRequest(t, srv, "GET", "/data/export.xlsx?from=1761386000&to=1761389000", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, contentTypeXLSX, resp.Header.Get("Content-Type"))
+	assert.Contains(t, resp.Header.Get("Content-Disposition"), "attachment")
+	f, err := excelize.OpenReader(resp.Body)
+	require.NoError(t, err)
+	defer f.Close()
+	assert.Equal(t, []string{"Summary", "attic", "boiler"}, f.GetSheetList())
+	rows, err := f.GetRows("attic")
+	require.NoError(t, err)
+	assert.Len(t, rows, 3) // the header and the readings up to to
+
+	resp = doRequest(t, srv, "GET", "/data/export.xlsx?device=boiler&from=1761386000&to=1761391000", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	f, err = excelize.OpenReader(resp.Body)
+	require.NoError(t, err)
+	defer f.Close()
+	assert.Equal(t, []string{"Summary", "boiler"}, f.GetSheetList())
+
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/data/export.xlsx?from=1761391000&to=1761386000", "").StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/data/export.xlsx?from=0", "").StatusCode)
+}
+
+func TestExportParquetHandler(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	for seq, ts := range []int64{1761386400, 1761388200, 1761390000} {
+		for _, device := range []string{"attic", "boiler"} {
+			body := fmt.Sprintf(`{"device": %q, "readings": [{"seq": %d, "tempCo": 40, "tempRoom": %d, "humidity": 50, "timestamp": %d}]}`, device, seq+1, 20+seq, ts)
+			require.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/sync", body).StatusCode)
+		}
+	}
+
+	readTable := func(path string) arrow.Table {
+		resp := doRequest(t, srv, "GET", path, "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, contentTypeParquet, resp.Header.Get("Content-Type"))
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		table, err := pqarrow.ReadTable(context.Background(), bytes.NewReader(body), nil, pqarrow.ArrowReadProperties{}, arrowmemory.DefaultAllocator)
+		require.NoError(t, err)
+		t.Cleanup(table.Release)
+		return table
+	}
+	assert.Equal(t, int64(6), readTable("/data/export.parquet").NumRows())
+	assert.Equal(t, int64(2), readTable("/data/export.parquet?device=boiler&to=1761389000").NumRows())
+	assert.Equal(t, int64(0), readTable("/data/export.parquet?from=1761390001").NumRows())
+
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/data/export.parquet?from=1761391000&to=1761386000", "").StatusCode)
+}
+
+func TestExportArrowHandler(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	for seq, ts := range []int64{1761386400, 1761388200, 1761390000} {
+		for _, device := range []string{"attic", "boiler"} {
+			body := fmt.Sprintf(`{"device": %q, "readings": [{"seq": %d, "tempCo": 40, "tempRoom": %d, "humidity": 50, "timestamp": %d}]}`, device, seq+1, 20+seq, ts)
+			require.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/sync", body).StatusCode)
+		}
+	}
+
+	resp := doRequest(t, srv, "GET", "/data/export.arrow?device=attic&from=1761388000", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, contentTypeArrow, resp.Header.Get("Content-Type"))
+	rdr, err := ipc.NewReader(resp.Body)
+	require.NoError(t, err)
+	defer rdr.Release()
+	var timestamps []arrow.Timestamp
+	for rdr.Next() {
+		ts := rdr.Record().Column(2).(*array.Timestamp)
+		for i := 0; i < ts.Len(); i++ {
+			timestamps = append(timestamps, ts.Value(i))
+		}
+	}
+	require.NoError(t, rdr.Err())
+	assert.Equal(t, []arrow.Timestamp{1761390000, 1761388200}, timestamps)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/data/export.arrow?to=abc", "").StatusCode)
+}
+
+// slowPagesStore takes a while for every page of readings.
+type slowPagesStore struct {
+	*memory.Store
+	delay time.Duration
+}
+
+func (s slowPagesStore) ListFilteredReadings(ctx context.Context, q store.ReadingQuery, limit, offset int) ([]store.TemperatureReading, error) {
+	time.Sleep(s.delay)
+	return s.Store.ListFilteredReadings(ctx, q, limit, offset)
+}
+
+func TestExportPages(t *testing.T) {
+	st := memory.New()
+	// the export takes longer than the write timeout, but no page does
+	srv := httptest.NewUnstartedServer(NewServer(Config{SecretKey: "testsecret"}, slowPagesStore{Store: st, delay: 100 * time.Millisecond}))
+	srv.Config.WriteTimeout = 250 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	// more readings stamped the same second than fit a page, and one after
+	// to
+	rs := make([]store.TemperatureReading, 2*usagePageSize+10)
+	for i := range rs {
+		ts := int64(1761388200)
+		if i == len(rs)-1 {
+			ts++
+		}
+		rs[i] = store.TemperatureReading{Device: "attic", TempCo: 40, Timestamp: &ts}
+	}
+	_, err := st.InsertReadings(context.Background(), rs)
+	require.NoError(t, err)
+
+	resp := doRequest(t, srv, "GET", "/data/export.arrow?to=1761388200", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	rdr, err := ipc.NewReader(resp.Body)
+	require.NoError(t, err)
+	defer rdr.Release()
+	ids := make(map[int64]bool)
+	for rdr.Next() {
+		col := rdr.Record().Column(0).(*array.Int64)
+		for i := 0; i < col.Len(); i++ {
+			ids[col.Value(i)] = true
+		}
+	}
+	require.NoError(t, rdr.Err())
+	assert.Len(t, ids, len(rs)-1, "every reading up to to, once")
+}
+
+func TestSparklineHandler(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer srv.Close()
+
+	now := time.Now().Unix()
+	for seq, ts := range []int64{now - 7200, now - 3600, now - 60} {
+		body := fmt.Sprintf(`{"device": "attic", "readings": [{"seq": %d, "tempCo": 40, "tempRoom": %d, "humidity": 50, "timestamp": %d}]}`, seq+1, 20+seq, ts)
+		require.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/sync", body).StatusCode)
+	}
+
+	resp := doRequest(t, srv, "GET", "/sparkline.svg?device=attic&field=tempRoom", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/svg+xml", resp.Header.Get("Content-Type"))
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+	var body strings.Builder
+	_, err := io.Copy(&body, resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, body.String(), "<polyline")
+
+	req, err := http.NewRequest("GET", srv.URL+"/sparkline.svg?device=attic&field=tempRoom", nil)
+	require.NoError(t, err)
+	req.Header.Set("If-None-Match", `"stale", W/`+etag)
+	notModified, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	notModified.Body.Close()
+	assert.Equal(t, http.StatusNotModified, notModified.StatusCode)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/sparkline.svg?field=pressure", "").StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/sparkline.svg?width=5000", "").StatusCode)
+}
+
+// fakeQuerier answers every accepted query with the same two rows.
+type fakeQuerier struct{}
+
+func (fakeQuerier) Query(ctx context.Context, sql string, timeout time.Duration, res store.QueryResult) error {
+	if err := store.CheckQuery(sql); err != nil {
+		return err
+	}
+	if err := res.Columns([]string{"device", "n"}); err != nil {
+		return err
+	}
+	if err := res.Row([]any{"attic", int64(2)}); err != nil {
+		return err
+	}
+	return res.Row([]any{nil, int64(1)})
+}
+
+func TestQuery(t *testing.T) {
+	const ops, grafana = "ops-0123456789", "grafana-0123456789"
+	srv := httptest.NewServer(NewServer(Config{
+		SecretKey: "testsecret",
+		APIKeys: []APIKey{
+			{Name: "ops", Key: ops, Scopes: []string{ScopeAdmin}},
+			{Name: "grafana", Key: grafana, Scopes: []string{ScopeRead}},
+		},
+		Querier: fakeQuerier{},
+	}, memory.New()))
+	defer srv.Close()
+
+	query := `{"sql": "SELECT device, count(*) AS n FROM readings GROUP BY device"}`
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, grafana, "POST", "/query", query).StatusCode)
+
+	resp := doRequestWithKey(t, srv, ops, "POST", "/query", query)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"columns": ["device", "n"], "rows": [["attic", 2], [null, 1]]}`, string(body))
+
+	req, err := http.NewRequest("POST", srv.URL+"/query", strings.NewReader(query))
+	require.NoError(t, err)
+	req.Header.Set("X-Secret-Key", ops)
+	req.Header.Set("Accept", "text/csv")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "device,n\nattic,2\n,1\n", string(body))
+
+	resp = doRequestWithKey(t, srv, ops, "POST", "/query", `{"sql": "DELETE FROM readings"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	unconfigured := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, memory.New()))
+	defer unconfigured.Close()
+	assert.Equal(t, http.StatusNotImplemented, doRequest(t, unconfigured, "POST", "/query", query).StatusCode)
+}
+
+func TestCheckQuery(t *testing.T) {
+	for _, sql := range []string{"SELECT 1", "  select\n1;", "WITH x AS (SELECT 1) SELECT * FROM x", "TABLE readings", "VALUES (1)"} {
+		assert.NoError(t, store.CheckQuery(sql), sql)
+	}
+	for _, sql := range []string{"", "DELETE FROM readings", "SET ROLE postgres", "selectx", "-- c\nDROP TABLE readings"} {
+		assert.Error(t, store.CheckQuery(sql), sql)
+	}
+}
+
+func TestReadingQualityHandler(t *testing.T) {
+	st := memory.New()
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, st))
+	defer srv.Close()
+
+	ts := int64(1761388000)
+	_, err := st.InsertReadings(context.Background(), []store.TemperatureReading{{TempCo: 40, Timestamp: &ts}, {TempCo: 85, Timestamp: &ts}})
+	require.NoError(t, err)
+
+	resp := doRequest(t, srv, "PUT", "/readings/2/quality", `{"quality": "suspect"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var rq ReadingQuality
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&rq))
+	assert.Equal(t, ReadingQuality{Id: 2, Quality: "suspect"}, rq)
+
+	resp = doRequest(t, srv, "GET", "/data?quality=ok,calibrated", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var readings []store.TemperatureReading
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&readings))
+	require.Len(t, readings, 1)
+	assert.Equal(t, 1, readings[0].Id)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/data?quality=junk", "").StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "GET", "/data?quality=ok&smooth=15m", "").StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "PUT", "/readings/1/quality", `{"quality": "junk"}`).StatusCode)
+	assert.Equal(t, http.StatusNotFound, doRequest(t, srv, "PUT", "/readings/99/quality", `{"quality": "ok"}`).StatusCode)
+	assert.Equal(t, http.StatusNotFound, doRequest(t, srv, "PUT", "/readings/one/quality", `{"quality": "ok"}`).StatusCode)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "wrong", "PUT", "/readings/1/quality", `{"quality": "ok"}`).StatusCode)
+
+	srv = httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, struct{ store.Store }{memory.New()}))
+	defer srv.Close()
+	assert.Equal(t, http.StatusNotImplemented, doRequest(t, srv, "PUT", "/readings/1/quality", `{"quality": "ok"}`).StatusCode)
+	assert.Equal(t, http.StatusNotImplemented, doRequest(t, srv, "GET", "/data?quality=ok", "").StatusCode)
+}
+
+func TestPushgatewayIngest(t *testing.T) {
+	st := memory.New()
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, st))
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "wrong", "POST", "/metrics/job/cron", "temp_room 21\n").StatusCode)
+	assert.Equal(t, http.StatusMethodNotAllowed, doRequest(t, srv, "GET", "/metrics/job/cron", "").StatusCode)
+	assert.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/metrics/job/cron", "temp_room 21\nhumidity 50\n").StatusCode)
+	assert.Equal(t, http.StatusOK, doRequest(t, srv, "PUT", "/metrics/job/cron/instance/attic", "temp_room 22\n").StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "POST", "/metrics/job/cron/instance", "temp_room 22\n").StatusCode)
+
+	readings, err := st.ListReadings(context.Background(), 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 2)
+	byDevice := map[string]store.TemperatureReading{readings[0].Device: readings[0], readings[1].Device: readings[1]}
+	assert.Equal(t, 50.0, byDevice["cron"].Humidity)
+	assert.Equal(t, 22.0, byDevice["attic"].TempRoom)
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/features"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const (
+	defaultSettingsHistoryLimit = 50
+	maxSettingsHistoryLimit     = 500
+)
+
+// DefaultPauseBackoff is how long devices are told to back off while
+// ingestion is paused unless Config.PauseBackoff says otherwise.
+const DefaultPauseBackoff = 5 * time.Minute
+
+// settingsHandler reads and switches the feature flags. PUT takes the flags
+// to switch, e.g. {"read_only": true}, and answers with every flag.
+func (s *server) settingsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	actor, ok := s.keyName(r.Context(), r.Header.Get("X-Secret-Key"), ScopeAdmin)
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var flags map[string]bool
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		flags, err = s.features.All(r.Context())
+
+	case http.MethodPut:
+		var changes map[string]bool
+		if err := decodeBody(r, &changes); err != nil {
+			writeDecodeError(w, err)
+			return
+		}
+		flags, err = s.features.Set(slogctx.NewCtx(r.Context(), logger), changes, actor)
+		var unknownErr *features.UnknownError
+		if errors.As(err, &unknownErr) {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if errors.Is(err, features.ErrPinned) {
+			http.Error(w, "Conflict: "+err.Error(), http.StatusConflict)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query settings")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flags)
+}
+
+// settingsHistoryHandler lists the feature flag changes, newest first.
+func (s *server) settingsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	limit := defaultSettingsHistoryLimit
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= maxSettingsHistoryLimit {
+		limit = l
+	}
+	changes, err := s.features.Changes(r.Context(), limit)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query settings history")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
+
+// writes reports whether r may change data. Old sketches send readings to
+// the legacy /ingest with GET, and fetching a provisioning config claims
+// the device, though it is a GET for onboarding firmware.
+func writes(r *http.Request) bool {
+	return (r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions) ||
+		r.URL.Path == "/ingest" || strings.HasPrefix(r.URL.Path, "/provision/")
+}
+
+// Problem is an RFC 9457 problem details response.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// writeProblem responds with p as application/problem+json.
+func writeProblem(w http.ResponseWriter, p Problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// readOnlyExempt are the endpoints changing data in read-only mode: the
+// settings, so it can be switched off again, the maintenance jobs it is
+// for, and ad-hoc queries, which only read.
+var readOnlyExempt = []string{"/admin/settings", "/admin/maintenance", "/query"}
+
+// readOnly rejects requests changing data while the features.ReadOnly flag
+// is on, except to readOnlyExempt. Every response then has an X-Read-Only
+// header, from which the dashboard shows a banner.
+func (s *server) readOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.features.Enabled(features.ReadOnly) {
+			h(w, r)
+			return
+		}
+		w.Header().Set("X-Read-Only", "true")
+		exempt := slices.ContainsFunc(readOnlyExempt, func(p string) bool {
+			return r.URL.Path == p || strings.HasPrefix(r.URL.Path, p+"/")
+		})
+		if writes(r) && !exempt {
+			s.setRetryAfter(w)
+			writeProblem(w, Problem{
+				Type:   "about:blank",
+				Title:  "Service Unavailable",
+				Status: http.StatusServiceUnavailable,
+				Detail: "The server is in read-only maintenance mode; retry the request later.",
+			})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// pausable rejects readings while the features.IngestPaused flag is on,
+// also on the endpoints storing them without the ingest pipeline, e.g.
+// /sync.
+func (s *server) pausable(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if writes(r) && s.features.Enabled(features.IngestPaused) {
+			s.writePaused(w)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// setRetryAfter tells devices to back off for Config.PauseBackoff, keeping
+// their readings buffered until then.
+func (s *server) setRetryAfter(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(s.cfg.PauseBackoff.Seconds())))
+}
+
+// writePaused rejects readings while ingestion is paused.
+func (s *server) writePaused(w http.ResponseWriter) {
+	s.setRetryAfter(w)
+	http.Error(w, "Service unavailable: ingestion is paused", http.StatusServiceUnavailable)
+}
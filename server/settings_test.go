@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/features"
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSettings(t *testing.T) {
+	st := memory.New()
+	srv := httptest.NewServer(NewServer(Config{
+		SecretKey: "testsecret",
+		APIKeys:   []APIKey{{Name: "grafana", Key: "grafana-0123456789", Scopes: []string{ScopeRead}}},
+	}, st))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "GET", "/admin/settings", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var flags map[string]bool
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&flags))
+	assert.Equal(t, map[string]bool{"alerts": true, "ingest_paused": false, "read_only": false}, flags)
+
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "grafana-0123456789", "PUT", "/admin/settings", `{"read_only": true}`).StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "PUT", "/admin/settings", `{"maintenance": true}`).StatusCode)
+
+	// read-only mode rejects writes, except to the admin endpoints
+	reading := `{"tempCo": 72.5, "tempRoom": 22.0, "humidity": 50.0}`
+	resp = doRequest(t, srv, "PUT", "/admin/settings", `{"read_only": true}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&flags))
+	assert.True(t, flags["read_only"])
+	resp = doRequest(t, srv, "POST", "/data", reading)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "300", resp.Header.Get("Retry-After"))
+	var problem Problem
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&problem))
+	assert.Equal(t, http.StatusServiceUnavailable, problem.Status)
+	assert.Contains(t, problem.Detail, "read-only")
+	assert.Equal(t, http.StatusServiceUnavailable, doRequest(t, srv, "POST", "/alerts/rules", `{"name": "boiler hot", "field": "tempCo", "op": "gt", "threshold": 70}`).StatusCode)
+	resp = doRequest(t, srv, "GET", "/data", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get("X-Read-Only"))
+	require.Equal(t, http.StatusOK, doRequest(t, srv, "PUT", "/admin/settings", `{"read_only": false}`).StatusCode)
+	assert.Empty(t, doRequest(t, srv, "GET", "/data", "").Header.Get("X-Read-Only"))
+
+	// paused ingestion rejects readings only
+	require.Equal(t, http.StatusOK, doRequest(t, srv, "PUT", "/admin/settings", `{"ingest_paused": true}`).StatusCode)
+	resp = doRequest(t, srv, "POST", "/data", reading)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "300", resp.Header.Get("Retry-After"))
+	resp = doRequest(t, srv, "POST", "/sync", `{"device": "attic", "readings": [{"seq": 1, "tempRoom": 20, "humidity": 50, "timestamp": 1761386400}]}`)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "300", resp.Header.Get("Retry-After"))
+	assert.Equal(t, http.StatusServiceUnavailable, doRequest(t, srv, "POST", "/ingest/line", "room tempRoom=21").StatusCode)
+	assert.Equal(t, http.StatusCreated, doRequest(t, srv, "POST", "/alerts/rules", `{"name": "boiler hot", "field": "tempCo", "op": "gt", "threshold": 70}`).StatusCode)
+
+	// with alerts off readings don't fire alerts
+	require.Equal(t, http.StatusOK, doRequest(t, srv, "PUT", "/admin/settings", `{"ingest_paused": false, "alerts": false}`).StatusCode)
+	assert.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/data", reading).StatusCode)
+	firing, err := st.ListFiringAlerts(t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, firing)
+	require.Equal(t, http.StatusOK, doRequest(t, srv, "PUT", "/admin/settings", `{"alerts": true}`).StatusCode)
+	assert.Equal(t, http.StatusOK, doRequest(t, srv, "POST", "/data", reading).StatusCode)
+	firing, err = st.ListFiringAlerts(t.Context())
+	require.NoError(t, err)
+	assert.Len(t, firing, 1)
+
+	resp = doRequest(t, srv, "GET", "/admin/settings/history?limit=2", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var changes []store.FeatureChange
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&changes))
+	require.Len(t, changes, 2)
+	assert.Equal(t, store.FeatureChange{Id: 6, Name: "alerts", Value: true, Actor: secretKeyName, At: changes[0].At}, changes[0])
+	assert.Equal(t, "ingest_paused", changes[1].Name)
+}
+
+func TestSettingsWithoutFeatureStore(t *testing.T) {
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, struct{ store.Store }{memory.New()}))
+	defer srv.Close()
+
+	require.Equal(t, http.StatusOK, doRequest(t, srv, "PUT", "/admin/settings", `{"ingest_paused": true}`).StatusCode)
+	assert.Equal(t, http.StatusServiceUnavailable, doRequest(t, srv, "POST", "/data", `{"tempCo": 40}`).StatusCode)
+
+	resp := doRequest(t, srv, "GET", "/admin/settings/history", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var changes []store.FeatureChange
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&changes))
+	require.Len(t, changes, 1)
+	assert.Equal(t, store.FeatureChange{Id: 1, Name: "ingest_paused", Value: true, Actor: secretKeyName, At: changes[0].At}, changes[0])
+}
+
+func TestSettingsPinned(t *testing.T) {
+	st := memory.New()
+	flags := features.New(st, nil)
+	flags.Pin(features.ReadOnly, true)
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret", Features: flags, LegacyIngest: true, PauseBackoff: time.Minute}, st))
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusConflict, doRequest(t, srv, "PUT", "/admin/settings", `{"read_only": false}`).StatusCode)
+	assert.Equal(t, http.StatusServiceUnavailable, doRequest(t, srv, "POST", "/data", `{"tempCo": 40}`).StatusCode)
+	resp := doRequest(t, srv, "GET", "/ingest?t1=25.5&t2=22.0&h=55", "")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+	assert.Equal(t, http.StatusServiceUnavailable, doRequest(t, srv, "GET", "/provision/token/config", "").StatusCode)
+	// admin endpoints changing data are refused too
+	resp = doRequest(t, srv, "PUT", "/admin/state", `{}`)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, http.StatusServiceUnavailable, doRequest(t, srv, "POST", "/admin/api-keys", `{"name": "grafana", "scopes": ["read"]}`).StatusCode)
+	assert.Equal(t, http.StatusServiceUnavailable, doRequest(t, srv, "POST", "/admin/notifications/dead-letters/1/replay", "").StatusCode)
+	assert.Equal(t, http.StatusOK, doRequest(t, srv, "GET", "/admin/settings", "").StatusCode)
+	resp = doRequest(t, srv, "GET", "/devices/plot-1/commands", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get("X-Read-Only"))
+}
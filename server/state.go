@@ -0,0 +1,273 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bartosz121/esp8266-web/alert"
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// Actions of a StateChange.
+const (
+	StateCreate = "create"
+	StateUpdate = "update"
+	StateDelete = "delete"
+)
+
+// State is the declared state of the server PUT /admin/state reconciles it
+// to, e.g. kept in a homelab-as-code repository. A section left out, or
+// null, isn't managed, so its stored state is kept as it is.
+type State struct {
+	// Devices are the labelled devices; other devices are unlabelled.
+	Devices []DeviceLabels `json:"devices"`
+	// AlertRules are matched to the stored rules by name; other rules are
+	// deleted.
+	AlertRules []StateAlertRule `json:"alertRules"`
+	// Channels are the notification channels that must be configured. They
+	// are set by flags and env variables, so they're checked, not changed.
+	Channels []string `json:"channels"`
+}
+
+// StateAlertRule is an alert rule of a State, enabled unless Enabled is
+// false.
+type StateAlertRule struct {
+	store.AlertRule
+	Enabled *bool `json:"enabled"`
+}
+
+// StateChange is a change reconciling the server to a State. Id is the id
+// of the stored alert rule it changes.
+type StateChange struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Id     int    `json:"id,omitempty"`
+	Action string `json:"action"`
+}
+
+// StatePlan lists the changes reconciling the server to a State, applied
+// unless the plan was only asked for.
+type StatePlan struct {
+	Changes []StateChange `json:"changes"`
+	Applied bool          `json:"applied"`
+}
+
+// stateHandler reconciles labels and alert rules to the State of the body,
+// or with ?plan=true only answers with the changes it would make.
+func (s *server) stateHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	planOnly := false
+	if v := r.URL.Query().Get("plan"); v != "" {
+		var err error
+		if planOnly, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "Bad request: plan must be true or false", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	var state State
+	if err := decodeBody(r, &state); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	rules, err := s.validateState(&state)
+	if err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	plan := StatePlan{Changes: []StateChange{}}
+	var ls store.LabelStore
+	var labels map[string]map[string]string
+	if state.Devices != nil {
+		var ok bool
+		if ls, ok = s.labelStore(w); !ok {
+			return
+		}
+		if labels, err = ls.DeviceLabels(r.Context()); err != nil {
+			writeStoreError(w, logger, err, "Failed to query device labels")
+			return
+		}
+		plan.Changes = append(plan.Changes, planLabels(labels, state.Devices)...)
+	}
+	var as store.AlertStore
+	var stored []store.AlertRule
+	if rules != nil {
+		var ok bool
+		if as, ok = s.alertStore(w); !ok {
+			return
+		}
+		if stored, err = as.ListAlertRules(r.Context()); err != nil {
+			writeStoreError(w, logger, err, "Failed to query alert rules")
+			return
+		}
+		plan.Changes = append(plan.Changes, planAlertRules(stored, rules)...)
+	}
+
+	if !planOnly {
+		for _, c := range plan.Changes {
+			if err := applyStateChange(r, ls, as, state, rules, c); err != nil {
+				writeStoreError(w, logger, err, "Failed to apply state", "kind", c.Kind, "name", c.Name, "action", c.Action)
+				return
+			}
+		}
+		plan.Applied = true
+		logger.Info("Reconciled state", slog.Int("changes", len(plan.Changes)))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
+
+// validateState checks state and returns its alert rules, validated, nil
+// when they aren't managed.
+func (s *server) validateState(state *State) ([]store.AlertRule, error) {
+	var errs []error
+	devices := make(map[string]bool, len(state.Devices))
+	for _, d := range state.Devices {
+		switch {
+		case d.Device == "":
+			errs = append(errs, errors.New("device name is required"))
+		case devices[d.Device]:
+			errs = append(errs, fmt.Errorf("device %s: duplicate name", d.Device))
+		}
+		devices[d.Device] = true
+		if err := validateLabels(d.Labels); err != nil {
+			errs = append(errs, fmt.Errorf("device %s: %w", d.Device, err))
+		}
+	}
+
+	var rules []store.AlertRule
+	if state.AlertRules != nil {
+		rules = make([]store.AlertRule, 0, len(state.AlertRules))
+	}
+	names := make(map[string]bool, len(state.AlertRules))
+	for _, sr := range state.AlertRules {
+		rule := sr.AlertRule
+		rule.Id = 0
+		rule.Enabled = sr.Enabled == nil || *sr.Enabled
+		if err := alert.Validate(&rule); err != nil {
+			errs = append(errs, fmt.Errorf("alert rule %s: %w", rule.Name, err))
+		}
+		if names[rule.Name] {
+			errs = append(errs, fmt.Errorf("alert rule %s: duplicate name", rule.Name))
+		}
+		names[rule.Name] = true
+		rules = append(rules, rule)
+	}
+
+	if state.Channels != nil {
+		var configured []string
+		if s.alerts != nil {
+			configured = s.alerts.Channels()
+		}
+		for _, c := range state.Channels {
+			if !slices.Contains(configured, c) {
+				errs = append(errs, fmt.Errorf("channel %s isn't configured, set it with flags or env variables", c))
+			}
+		}
+		for _, c := range configured {
+			if !slices.Contains(state.Channels, c) {
+				errs = append(errs, fmt.Errorf("channel %s is configured but not declared, unset its flags or env variables", c))
+			}
+		}
+	}
+	return rules, errors.Join(errs...)
+}
+
+// planLabels returns the changes turning the stored labels into the
+// declared ones, ordered by device.
+func planLabels(stored map[string]map[string]string, devices []DeviceLabels) []StateChange {
+	var changes []StateChange
+	declared := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		declared[d.Device] = true
+		current, ok := stored[d.Device]
+		switch {
+		case !ok && len(d.Labels) > 0:
+			changes = append(changes, StateChange{Kind: "device", Name: d.Device, Action: StateCreate})
+		case ok && len(d.Labels) == 0:
+			changes = append(changes, StateChange{Kind: "device", Name: d.Device, Action: StateDelete})
+		case ok && !maps.Equal(current, d.Labels):
+			changes = append(changes, StateChange{Kind: "device", Name: d.Device, Action: StateUpdate})
+		}
+	}
+	for device, labels := range stored {
+		if !declared[device] && len(labels) > 0 {
+			changes = append(changes, StateChange{Kind: "device", Name: device, Action: StateDelete})
+		}
+	}
+	slices.SortStableFunc(changes, func(a, b StateChange) int { return strings.Compare(a.Name, b.Name) })
+	return changes
+}
+
+// planAlertRules returns the changes turning the stored rules into the
+// declared ones: deletes first, of rules no longer declared and of all but
+// the first of stored rules sharing a name, then updates and creates in
+// declared order.
+func planAlertRules(stored, rules []store.AlertRule) []StateChange {
+	var changes []StateChange
+	seen := make(map[string]bool, len(stored))
+	for _, sr := range stored {
+		if seen[sr.Name] || !slices.ContainsFunc(rules, func(r store.AlertRule) bool { return r.Name == sr.Name }) {
+			changes = append(changes, StateChange{Kind: "alert rule", Name: sr.Name, Id: sr.Id, Action: StateDelete})
+		}
+		seen[sr.Name] = true
+	}
+	for _, rule := range rules {
+		i := slices.IndexFunc(stored, func(sr store.AlertRule) bool { return sr.Name == rule.Name })
+		switch {
+		case i < 0:
+			changes = append(changes, StateChange{Kind: "alert rule", Name: rule.Name, Action: StateCreate})
+		case !sameAlertRule(stored[i], rule):
+			changes = append(changes, StateChange{Kind: "alert rule", Name: rule.Name, Id: stored[i].Id, Action: StateUpdate})
+		}
+	}
+	return changes
+}
+
+// sameAlertRule reports whether a and b differ in their id at most.
+func sameAlertRule(a, b store.AlertRule) bool {
+	return a.Name == b.Name && a.Field == b.Field && a.Op == b.Op && a.Threshold == b.Threshold &&
+		a.Severity == b.Severity && a.Enabled == b.Enabled &&
+		slices.Equal(a.Escalation, b.Escalation) && maps.Equal(a.Templates, b.Templates)
+}
+
+// applyStateChange makes change c, planned from state and its validated
+// alert rules.
+func applyStateChange(r *http.Request, ls store.LabelStore, as store.AlertStore, state State, rules []store.AlertRule, c StateChange) error {
+	ctx := r.Context()
+	if c.Kind == "device" {
+		var labels map[string]string
+		if i := slices.IndexFunc(state.Devices, func(d DeviceLabels) bool { return d.Device == c.Name }); i >= 0 {
+			labels = state.Devices[i].Labels
+		}
+		return ls.SetDeviceLabels(ctx, c.Name, labels)
+	}
+	if c.Action == StateDelete {
+		return as.DeleteAlertRule(ctx, c.Id)
+	}
+	rule := rules[slices.IndexFunc(rules, func(r store.AlertRule) bool { return r.Name == c.Name })]
+	if c.Action == StateCreate {
+		_, err := as.CreateAlertRule(ctx, rule)
+		return err
+	}
+	rule.Id = c.Id
+	_, err := as.UpdateAlertRule(ctx, rule)
+	return err
+}
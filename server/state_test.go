@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bartosz121/esp8266-web/alert"
+	"github.com/bartosz121/esp8266-web/notify"
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestState(t *testing.T) {
+	st := memory.New()
+	ctx := context.Background()
+	require.NoError(t, st.SetDeviceLabels(ctx, "attic", map[string]string{"floor": "2"}))
+	require.NoError(t, st.SetDeviceLabels(ctx, "shed", map[string]string{"floor": "0"}))
+	hot, err := st.CreateAlertRule(ctx, store.AlertRule{Name: "hot", Field: "tempRoom", Op: "gt", Threshold: 28, Severity: alert.SeverityWarning, Enabled: true})
+	require.NoError(t, err)
+	old, err := st.CreateAlertRule(ctx, store.AlertRule{Name: "old", Field: "humidity", Op: "gt", Threshold: 80, Severity: alert.SeverityWarning})
+	require.NoError(t, err)
+	engine := alert.NewEngine(st, alert.Config{Notifiers: map[string]notify.Notifier{alert.ChannelTelegram: &notify.Telegram{}}})
+	srv := httptest.NewServer(NewServer(Config{SecretKey: "testsecret", Alerts: engine}, st))
+	defer srv.Close()
+
+	state := `{
+		"devices": [{"device": "attic", "labels": {"floor": "3"}}, {"device": "cellar", "labels": {"floor": "-1"}}],
+		"alertRules": [
+			{"name": "hot", "field": "tempRoom", "op": "gt", "threshold": 28},
+			{"name": "freezing", "field": "tempRoom", "op": "lt", "threshold": 5, "severity": "critical", "enabled": false}
+		],
+		"channels": ["telegram"]
+	}`
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "wrong", "PUT", "/admin/state", state).StatusCode)
+	resp := doRequest(t, srv, "PUT", "/admin/state?plan=true", state)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var plan StatePlan
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&plan))
+	assert.False(t, plan.Applied)
+	assert.Equal(t, []StateChange{
+		{Kind: "device", Name: "attic", Action: StateUpdate},
+		{Kind: "device", Name: "cellar", Action: StateCreate},
+		{Kind: "device", Name: "shed", Action: StateDelete},
+		{Kind: "alert rule", Name: "old", Id: old.Id, Action: StateDelete},
+		{Kind: "alert rule", Name: "freezing", Action: StateCreate},
+	}, plan.Changes)
+	labels, err := st.DeviceLabels(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"floor": "2"}, labels["attic"])
+
+	resp = doRequest(t, srv, "PUT", "/admin/state", state)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&plan))
+	assert.True(t, plan.Applied)
+	assert.Len(t, plan.Changes, 5)
+	labels, err = st.DeviceLabels(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"attic": {"floor": "3"}, "cellar": {"floor": "-1"}}, labels)
+	rules, err := st.ListAlertRules(ctx)
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, hot.Id, rules[0].Id)
+	assert.Equal(t, "freezing", rules[1].Name)
+	assert.False(t, rules[1].Enabled)
+
+	// reconciled, nothing changes; a section left out isn't managed
+	resp = doRequest(t, srv, "PUT", "/admin/state", state)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&plan))
+	assert.Empty(t, plan.Changes)
+	resp = doRequest(t, srv, "PUT", "/admin/state", `{"alertRules": [{"name": "hot", "field": "tempRoom", "op": "gt", "threshold": 30}]}`)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&plan))
+	assert.Equal(t, []StateChange{
+		{Kind: "alert rule", Name: "freezing", Id: rules[1].Id, Action: StateDelete},
+		{Kind: "alert rule", Name: "hot", Id: hot.Id, Action: StateUpdate},
+	}, plan.Changes)
+	labels, err = st.DeviceLabels(ctx)
+	require.NoError(t, err)
+	assert.Len(t, labels, 2)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "PUT", "/admin/state", `{"channels": ["email"]}`).StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "PUT", "/admin/state", `{"alertRules": [{"name": "a", "field": "x"}]}`).StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "PUT", "/admin/state?plan=maybe", `{}`).StatusCode)
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// storageHandler reports the database size, table and index sizes and the
+// readings per device, to keep an eye on the disk.
+func (s *server) storageHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ss, ok := s.store.(store.StatusStore)
+	if !ok {
+		http.Error(w, "Storage status is not supported by this storage backend", http.StatusNotImplemented)
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	status, err := ss.StorageStatus(r.Context())
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query storage status")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageStatus(t *testing.T) {
+	const grafana = "grafana-0123456789"
+	srv := httptest.NewServer(NewServer(Config{
+		SecretKey: "testsecret",
+		APIKeys:   []APIKey{{Name: "grafana", Key: grafana, Scopes: []string{ScopeRead}}},
+	}, memory.New()))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "POST", "/sync", `{"device": "attic", "readings": [
+		{"seq": 1, "tempCo": 20, "tempRoom": 21, "humidity": 40, "timestamp": 100},
+		{"seq": 2, "tempCo": 20, "tempRoom": 21, "humidity": 40, "timestamp": 300}
+	]}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = doRequest(t, srv, "POST", "/data", `{"tempCo": 20, "tempRoom": 21, "humidity": 40, "timestamp": 200}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, grafana, "GET", "/admin/storage", "").StatusCode)
+	resp = doRequest(t, srv, "GET", "/admin/storage", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"databaseBytes": 0, "tables": [], "devices": [
+		{"device": "", "count": 1, "oldest": 200, "newest": 200},
+		{"device": "attic", "count": 2, "oldest": 100, "newest": 300}
+	]}`, string(body))
+
+	unsupported := httptest.NewServer(NewServer(Config{SecretKey: "testsecret"}, struct{ store.Store }{memory.New()}))
+	defer unsupported.Close()
+	assert.Equal(t, http.StatusNotImplemented, doRequest(t, unsupported, "GET", "/admin/storage", "").StatusCode)
+}
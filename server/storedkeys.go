@@ -0,0 +1,337 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// storedKeysTTL is how long the API keys read from the store are used
+	// before they're read again, so a key revoked through another replica
+	// stops working here within it.
+	storedKeysTTL = 10 * time.Second
+	// maxVerifiedKeys bounds how many verified keys are remembered.
+	maxVerifiedKeys = 1024
+	// maxRejectedKeys bounds how many rejected keys are remembered.
+	maxRejectedKeys = 4096
+	// maxHashedKeyLength is the longest key bcrypt hashes.
+	maxHashedKeyLength = 72
+)
+
+// hashedKeys verifies keys against the bcrypt hashes of the API keys in the
+// config and the store. bcrypt is slow on purpose, so a key it verified is
+// remembered by its SHA-256 for as long as the hash it matched is accepted,
+// and devices sending the same key every minute pay for it once. A key no
+// hash matched is remembered as well, with the hashes it was checked
+// against, so a client retrying a wrong or revoked key doesn't cost a
+// comparison with every hash each time.
+type hashedKeys struct {
+	mu       sync.Mutex
+	stored   []store.APIKey
+	readAt   time.Time
+	verified map[[sha256.Size]byte]string
+	// rejected maps keys to the hashesDigest of the hashes they didn't
+	// match.
+	rejected map[[sha256.Size]byte][sha256.Size]byte
+}
+
+// storedKeys returns the API keys of the store, read again once they're
+// older than storedKeysTTL. The store is read without holding the lock, so
+// a slow database only holds up the request reading it; the others use the
+// keys read before meanwhile, as they do when reading fails.
+func (s *server) storedKeys(ctx context.Context) []store.APIKey {
+	ks, ok := s.store.(store.APIKeyStore)
+	if !ok {
+		return nil
+	}
+	s.hashed.mu.Lock()
+	if time.Since(s.hashed.readAt) < storedKeysTTL {
+		defer s.hashed.mu.Unlock()
+		return s.hashed.stored
+	}
+	started := time.Now()
+	s.hashed.readAt = started
+	s.hashed.mu.Unlock()
+
+	keys, err := ks.ListAPIKeys(ctx)
+	s.hashed.mu.Lock()
+	defer s.hashed.mu.Unlock()
+	if err != nil {
+		slogctx.FromCtx(ctx).Error("Failed to read the stored API keys", "error", err)
+		return s.hashed.stored
+	}
+	// unless the keys were forgotten and read again meanwhile
+	if s.hashed.readAt.Equal(started) {
+		s.hashed.stored = keys
+	}
+	return keys
+}
+
+// forgetStoredKeys makes the next request read the stored API keys again,
+// after they were changed here.
+func (s *server) forgetStoredKeys() {
+	s.hashed.mu.Lock()
+	s.hashed.readAt = time.Time{}
+	s.hashed.mu.Unlock()
+}
+
+// resolveHashedKey returns the API key whose hash key matches when it is
+// allowed scope. A key starting with the ID of a stored key is only
+// compared with that key's hash; other keys are compared with the hashes
+// of the config and of the stored keys without an ID, see store.APIKey.
+func (s *server) resolveHashedKey(ctx context.Context, key, scope string) (requestKey, bool) {
+	if key == "" {
+		return requestKey{}, false
+	}
+	type hashedKey struct {
+		requestKey
+		allows bool
+	}
+	allowed := func(k hashedKey) (requestKey, bool) {
+		if !k.allows {
+			return requestKey{}, false
+		}
+		return k.requestKey, true
+	}
+	// by hash
+	accepted := make(map[string]hashedKey)
+	stored := s.storedKeys(ctx)
+	password := key
+	id, secret, _ := strings.Cut(key, ".")
+	if i := slices.IndexFunc(stored, func(k store.APIKey) bool { return k.ID != "" && k.ID == id }); i >= 0 {
+		k := stored[i]
+		accepted[k.Hash] = hashedKey{requestKey{name: k.Name, device: k.Device}, APIKey{Scopes: k.Scopes}.Allows(scope)}
+		password = secret
+	} else {
+		for _, k := range s.apiKeys() {
+			if k.Hash != "" {
+				accepted[k.Hash] = hashedKey{requestKey{name: k.Name}, k.Allows(scope)}
+			}
+		}
+		for _, k := range stored {
+			if k.ID == "" {
+				accepted[k.Hash] = hashedKey{requestKey{name: k.Name, device: k.Device}, APIKey{Scopes: k.Scopes}.Allows(scope)}
+			}
+		}
+	}
+	if len(accepted) == 0 {
+		return requestKey{}, false
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	hashes := hashesDigest(slices.Sorted(maps.Keys(accepted)))
+	s.hashed.mu.Lock()
+	matched, ok := s.hashed.verified[sum]
+	rejected, wasRejected := s.hashed.rejected[sum]
+	s.hashed.mu.Unlock()
+	if k, stillAccepted := accepted[matched]; ok && stillAccepted {
+		return allowed(k)
+	}
+	// a key is only checked again once the accepted hashes change
+	if wasRejected && rejected == hashes {
+		return requestKey{}, false
+	}
+	for hash, k := range accepted {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+			continue
+		}
+		s.hashed.mu.Lock()
+		if s.hashed.verified == nil || len(s.hashed.verified) >= maxVerifiedKeys {
+			s.hashed.verified = make(map[[sha256.Size]byte]string)
+		}
+		s.hashed.verified[sum] = hash
+		s.hashed.mu.Unlock()
+		return allowed(k)
+	}
+	s.hashed.mu.Lock()
+	if s.hashed.rejected == nil || len(s.hashed.rejected) >= maxRejectedKeys {
+		s.hashed.rejected = make(map[[sha256.Size]byte][sha256.Size]byte)
+	}
+	s.hashed.rejected[sum] = hashes
+	s.hashed.mu.Unlock()
+	return requestKey{}, false
+}
+
+// hashesDigest returns a digest of the sorted accepted hashes, which
+// changes whenever a key is added or revoked.
+func hashesDigest(hashes []string) [sha256.Size]byte {
+	h := sha256.New()
+	for _, hash := range hashes {
+		h.Write([]byte(hash))
+		h.Write([]byte{'\n'})
+	}
+	return [sha256.Size]byte(h.Sum(nil))
+}
+
+// HashKey returns the bcrypt hash of key, for an API key in the config or
+// the store.
+func HashKey(key string) (string, error) {
+	if len(key) > maxHashedKeyLength {
+		return "", fmt.Errorf("key must be at most %d characters", maxHashedKeyLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(key), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// generateKey returns a random key for an API key in the store.
+func generateKey() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// hashStoredKey returns a random ID for an API key in the store with
+// secret, the key given out, "<ID>.<secret>", and the hash of secret
+// stored with the ID.
+func hashStoredKey(secret string) (id, key, hash string, err error) {
+	hash, err = HashKey(secret)
+	if err != nil {
+		return "", "", "", err
+	}
+	b := make([]byte, 6)
+	rand.Read(b)
+	id = hex.EncodeToString(b)
+	return id, id + "." + secret, hash, nil
+}
+
+// StoredKey is an API key in the store. Key is only shown once, when the
+// key is created.
+type StoredKey struct {
+	Name   string   `json:"name"`
+	Key    string   `json:"key,omitempty"`
+	Scopes []string `json:"scopes"`
+	// Device is the device a provisioned key is bound to.
+	Device    string `json:"device,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// CreateKeyPayload creates an API key with Scopes, storing Key, or a
+// generated key when it is empty, hashed. The key given out is Key
+// prefixed with the ID of the stored key, see hashStoredKey.
+type CreateKeyPayload struct {
+	Name   string   `json:"name"`
+	Key    string   `json:"key"`
+	Scopes []string `json:"scopes"`
+}
+
+// apiKeyStore returns the API key store, or responds with 501 when the
+// storage backend doesn't keep API keys.
+func (s *server) apiKeyStore(w http.ResponseWriter) (store.APIKeyStore, bool) {
+	ks, ok := s.store.(store.APIKeyStore)
+	if !ok {
+		http.Error(w, "Stored API keys are not supported by this storage backend", http.StatusNotImplemented)
+		return nil, false
+	}
+	return ks, true
+}
+
+// apiKeysHandler lists and creates the API keys in the store.
+func (s *server) apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	ks, ok := s.apiKeyStore(w)
+	if !ok {
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := ks.ListAPIKeys(r.Context())
+		if err != nil {
+			writeStoreError(w, logger, err, "Failed to query API keys")
+			return
+		}
+		listed := make([]StoredKey, 0, len(keys))
+		for _, k := range keys {
+			listed = append(listed, StoredKey{Name: k.Name, Scopes: k.Scopes, Device: k.Device, CreatedAt: k.CreatedAt})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(listed)
+
+	case http.MethodPost:
+		var p CreateKeyPayload
+		if err := decodeBody(r, &p); err != nil {
+			writeDecodeError(w, err)
+			return
+		}
+		if p.Key == "" {
+			p.Key = generateKey()
+		}
+		if err := ValidateAPIKeys([]APIKey{{Name: p.Name, Key: p.Key, Scopes: p.Scopes}}); err != nil {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		id, key, hash, err := hashStoredKey(p.Key)
+		if err != nil {
+			http.Error(w, "Bad request: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		k := store.APIKey{Name: p.Name, ID: id, Hash: hash, Scopes: p.Scopes, CreatedAt: time.Now().Unix()}
+		if err := ks.CreateAPIKey(r.Context(), k); err != nil {
+			if errors.Is(err, store.ErrExists) {
+				http.Error(w, "Conflict: an API key with this name exists", http.StatusConflict)
+				return
+			}
+			writeStoreError(w, logger, err, "Failed to create API key", "name", p.Name)
+			return
+		}
+		s.forgetStoredKeys()
+		logger.Info("Created API key", slog.String("name", k.Name), slog.Any("scopes", k.Scopes))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(StoredKey{Name: k.Name, Key: key, Scopes: k.Scopes, CreatedAt: k.CreatedAt})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// apiKeyHandler revokes an API key in the store.
+func (s *server) apiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	ks, ok := s.apiKeyStore(w)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	name := r.PathValue("name")
+	if err := ks.DeleteAPIKey(r.Context(), name); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		writeStoreError(w, logger, err, "Failed to delete API key", "name", name)
+		return
+	}
+	s.forgetStoredKeys()
+	logger.Info("Deleted API key", slog.String("name", name))
+	w.WriteHeader(http.StatusNoContent)
+}
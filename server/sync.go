@@ -0,0 +1,416 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/ingest"
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+type SyncReadingPayload struct {
+	Seq int64 `json:"seq"`
+	TemperatureReadingPayload
+}
+
+// SyncPayload is a batch of buffered readings from one device. Seq is a
+// counter the device increments for every reading it buffers.
+type SyncPayload struct {
+	Device   string               `json:"device"`
+	Readings []SyncReadingPayload `json:"readings"`
+	// Firmware is the version the device runs, if it reports it.
+	Firmware string `json:"firmware,omitempty"`
+}
+
+type SyncResponse struct {
+	Device string `json:"device"`
+	// AckedSeq is the highest sequence number the server has stored; the
+	// device can drop every buffered reading up to it.
+	AckedSeq   int64 `json:"ackedSeq"`
+	Inserted   int   `json:"inserted"`
+	Duplicates int   `json:"duplicates"`
+}
+
+// syncHandler implements the offline sync protocol: a device uploads its
+// buffered readings and drops them once acknowledged. Re-uploads after a lost
+// response are recognized by their sequence numbers and not stored twice.
+func (s *server) syncHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r, ScopeWrite) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	syncStore, ok := s.store.(store.SyncStore)
+	if !ok {
+		http.Error(w, "Sync is not supported by this storage backend", http.StatusNotImplemented)
+		return
+	}
+
+	var payload SyncPayload
+	if err := decodeValidBody(r, "sync.json", &payload); err != nil {
+		logger.Error("failed to decode sync payload",
+			slog.Any("error", err),
+		)
+		writeDecodeError(w, err)
+		return
+	}
+	if payload.Device == "" {
+		http.Error(w, "Bad request: device is required", http.StatusUnprocessableEntity)
+		return
+	}
+	// a device's key only writes its own readings
+	if !s.keyAllowsDevice(r, payload.Device) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if len(payload.Readings) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("Batch too large, at most %d readings", maxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	now := time.Now().UTC()
+	ts := now.Unix()
+	var newest *int64
+	for _, p := range payload.Readings {
+		if p.Timestamp != nil && (newest == nil || *p.Timestamp > *newest) {
+			newest = p.Timestamp
+		}
+	}
+	if newest != nil {
+		ingest.RecordSkew(payload.Device, *newest, now)
+	}
+	readings := make([]store.SyncReading, 0, len(payload.Readings))
+	for i, p := range payload.Readings {
+		if p.Seq <= 0 {
+			http.Error(w, "Bad request: seq must be positive", http.StatusUnprocessableEntity)
+			return
+		}
+		tr := store.TemperatureReading{TempCo: p.TempCo, TempRoom: p.TempRoom, Humidity: p.Humidity, Timestamp: p.Timestamp}
+		// sequence numbers dedup synced readings, only validation and quality
+		// flags are shared with the ingest pipeline
+		if err := ingest.Validate(tr, now); err != nil {
+			http.Error(w, "Bad request: "+(&ingest.ValidationError{Index: i, Err: err}).Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if tr.Timestamp == nil {
+			tr.Timestamp = &ts
+		}
+		tr.ReceivedAt = &ts
+		readings = append(readings, store.SyncReading{Seq: p.Seq, TemperatureReading: tr})
+	}
+	// flagged once the whole upload is valid
+	for i := range readings {
+		readings[i].Quality = s.ingest.Quality(payload.Device, readings[i].TemperatureReading)
+	}
+
+	result, err := syncStore.SyncReadings(r.Context(), payload.Device, readings)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to sync temperature readings")
+		return
+	}
+	s.recordFirmware(r, payload.Device, payload.Firmware)
+	logger.Info("Synced temperature readings",
+		slog.String("device", payload.Device),
+		slog.Int64("acked_seq", result.AckedSeq),
+		slog.Int("inserted", result.Inserted),
+	)
+	if result.Inserted > 0 {
+		fresh := make([]store.TemperatureReading, 0, result.Inserted)
+		for _, sr := range readings {
+			if sr.Seq > result.PrevAckedSeq {
+				fresh = append(fresh, sr.TemperatureReading)
+			}
+		}
+		s.ingest.Accepted(r.Context(), payload.Device, fresh...)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SyncResponse{
+		Device:     payload.Device,
+		AckedSeq:   result.AckedSeq,
+		Inserted:   result.Inserted,
+		Duplicates: len(readings) - result.Inserted,
+	})
+}
+
+// maxSyncRange caps the time range of a digests request and of a replaced
+// range, so neither loads more than a few days of readings at once.
+const maxSyncRange = 7 * 24 * time.Hour
+
+type SyncMarksRequest struct {
+	Devices []string `json:"devices"`
+}
+
+// SyncMarksResponse has the high-water mark of every requested device, the
+// timestamp of the newest reading stored for it, 0 when there is none.
+type SyncMarksResponse struct {
+	Marks map[string]int64 `json:"marks"`
+}
+
+// SyncDigestsRequest asks for the digests of the devices' readings stamped
+// in [From, To), in buckets of Bucket seconds aligned to multiples of it.
+type SyncDigestsRequest struct {
+	Devices []string `json:"devices"`
+	From    int64    `json:"from"`
+	To      int64    `json:"to"`
+	Bucket  int64    `json:"bucket"`
+}
+
+// SyncDigestsResponse has the digests of every requested device, of the
+// buckets that have readings.
+type SyncDigestsResponse struct {
+	Digests map[string][]store.ReadingDigest `json:"digests"`
+}
+
+type SyncRangeReadingPayload struct {
+	TemperatureReadingPayload
+	// Quality is one of store.Qualities, store.QualityOK when empty.
+	Quality string `json:"quality,omitempty"`
+}
+
+// SyncRangePayload replaces the readings of Device stamped in [From, To).
+type SyncRangePayload struct {
+	Device   string                    `json:"device"`
+	From     int64                     `json:"from"`
+	To       int64                     `json:"to"`
+	Readings []SyncRangeReadingPayload `json:"readings"`
+}
+
+// SyncRangeResponse is the digest of the replaced range, for the edge to
+// check against its own.
+type SyncRangeResponse struct {
+	Device string `json:"device"`
+	store.ReadingDigest
+}
+
+// replicaStore returns the store of the edge replication endpoints, or
+// responds with 501 when the storage backend doesn't support them.
+func (s *server) replicaStore(w http.ResponseWriter) (interface {
+	store.ReplaceStore
+	store.FilterStore
+}, bool) {
+	rs, ok := s.store.(interface {
+		store.ReplaceStore
+		store.FilterStore
+	})
+	if !ok {
+		http.Error(w, "Sync is not supported by this storage backend", http.StatusNotImplemented)
+		return nil, false
+	}
+	return rs, true
+}
+
+// syncMarksHandler returns the high-water marks of devices, up to which an
+// edge instance has no newer readings to push.
+func (s *server) syncMarksHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	rs, ok := s.replicaStore(w)
+	if !ok {
+		return
+	}
+	var req SyncMarksRequest
+	if err := decodeBody(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if len(req.Devices) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("Batch too large, at most %d devices", maxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	resp := SyncMarksResponse{Marks: make(map[string]int64, len(req.Devices))}
+	for _, device := range req.Devices {
+		newest, err := rs.ListFilteredReadings(r.Context(), store.ReadingQuery{Devices: []string{device}}, 1, 0)
+		if err != nil {
+			writeStoreError(w, logger, err, "Failed to query readings", "device", device)
+			return
+		}
+		resp.Marks[device] = 0
+		if len(newest) > 0 && newest[0].Timestamp != nil {
+			resp.Marks[device] = *newest[0].Timestamp
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// syncDigestsHandler returns the digests of devices' readings, for an edge
+// instance to find the ranges where the copies differ.
+func (s *server) syncDigestsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	rs, ok := s.replicaStore(w)
+	if !ok {
+		return
+	}
+	var req SyncDigestsRequest
+	if err := decodeBody(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if err := validateSyncRange(req.From, req.To); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if req.Bucket <= 0 {
+		http.Error(w, "Bad request: bucket must be positive", http.StatusUnprocessableEntity)
+		return
+	}
+	if len(req.Devices) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("Batch too large, at most %d devices", maxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	resp := SyncDigestsResponse{Digests: make(map[string][]store.ReadingDigest, len(req.Devices))}
+	for _, device := range req.Devices {
+		readings, err := rangeReadings(r.Context(), rs, device, req.From, req.To)
+		if err != nil {
+			writeStoreError(w, logger, err, "Failed to query readings", "device", device)
+			return
+		}
+		resp.Digests[device] = store.DigestReadings(readings, req.Bucket)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// syncRangeHandler replaces the readings of a device in a time range with an
+// edge instance's copy of them. Replacing the same range twice stores the
+// same readings, so pushes are retried safely.
+func (s *server) syncRangeHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r, ScopeAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	rs, ok := s.replicaStore(w)
+	if !ok {
+		return
+	}
+	var p SyncRangePayload
+	if err := decodeBody(r, &p); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if p.Device == "" {
+		http.Error(w, "Bad request: device is required", http.StatusUnprocessableEntity)
+		return
+	}
+	if !s.keyAllowsDevice(r, p.Device) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := validateSyncRange(p.From, p.To); err != nil {
+		http.Error(w, "Bad request: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if len(p.Readings) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("Batch too large, at most %d readings", maxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	now := time.Now().Unix()
+	readings := make([]store.TemperatureReading, 0, len(p.Readings))
+	for i, rp := range p.Readings {
+		switch {
+		case rp.Timestamp == nil || *rp.Timestamp < p.From || *rp.Timestamp >= p.To:
+			http.Error(w, fmt.Sprintf("Bad request: reading %d: timestamp must be within the range", i), http.StatusUnprocessableEntity)
+			return
+		case rp.Quality != "" && !slices.Contains(store.Qualities, rp.Quality):
+			http.Error(w, fmt.Sprintf("Bad request: reading %d: unknown quality %q", i, rp.Quality), http.StatusUnprocessableEntity)
+			return
+		}
+		reading := store.TemperatureReading{
+			TempCo: rp.TempCo, TempRoom: rp.TempRoom, Humidity: rp.Humidity, Timestamp: rp.Timestamp,
+			ReceivedAt: &now, Quality: rp.Quality,
+		}
+		if err := ingest.Validate(reading, time.Unix(now, 0)); err != nil {
+			http.Error(w, fmt.Sprintf("Bad request: reading %d: %v", i, err), http.StatusUnprocessableEntity)
+			return
+		}
+		readings = append(readings, reading)
+	}
+
+	if err := rs.ReplaceReadings(r.Context(), p.Device, p.From, p.To, readings); err != nil {
+		writeStoreError(w, logger, err, "Failed to replace temperature readings", "device", p.Device)
+		return
+	}
+	stored, err := rangeReadings(r.Context(), rs, p.Device, p.From, p.To)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query readings", "device", p.Device)
+		return
+	}
+	resp := SyncRangeResponse{Device: p.Device, ReadingDigest: store.Digest(p.From, stored)}
+	logger.Info("Replaced temperature readings",
+		slog.String("device", p.Device),
+		slog.Int64("from", p.From),
+		slog.Int64("to", p.To),
+		slog.Int("count", resp.Count),
+	)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func validateSyncRange(from, to int64) error {
+	switch {
+	case to <= from:
+		return errors.New("to must be after from")
+	case time.Duration(to-from)*time.Second > maxSyncRange:
+		return fmt.Errorf("the range must be at most %s", maxSyncRange)
+	}
+	return nil
+}
+
+// rangeReadings returns the readings of device stamped in [from, to).
+func rangeReadings(ctx context.Context, fs store.FilterStore, device string, from, to int64) ([]store.TemperatureReading, error) {
+	q := store.ReadingQuery{
+		Devices: []string{device},
+		Filters: []store.ReadingFilter{
+			{Field: "timestamp", Op: "gte", Value: float64(from)},
+			{Field: "timestamp", Op: "lt", Value: float64(to)},
+		},
+	}
+	var readings []store.TemperatureReading
+	for offset := 0; ; offset += usagePageSize {
+		page, err := fs.ListFilteredReadings(ctx, q, usagePageSize, offset)
+		if err != nil {
+			return nil, err
+		}
+		readings = append(readings, page...)
+		if len(page) < usagePageSize {
+			return readings, nil
+		}
+	}
+}
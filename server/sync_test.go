@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bartosz121/esp8266-web/ingest"
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func postSync(t *testing.T, s *server, body string) (int, SyncResponse) {
+	req := httptest.NewRequest("POST", "/sync", bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Secret-Key", "testsecret")
+	w := httptest.NewRecorder()
+
+	s.syncHandler(w, req)
+
+	var resp SyncResponse
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	}
+	return w.Code, resp
+}
+
+func TestSyncHandler(t *testing.T) {
+	s, st := newTestServer("testsecret")
+
+	code, resp := postSync(t, s, `{"device": "boiler", "readings": [
+		{"seq": 1, "tempCo": 40.0, "tempRoom": 21.0, "humidity": 50.0, "timestamp": 1761388101},
+		{"seq": 2, "tempCo": 41.0, "tempRoom": 21.1, "humidity": 50.5, "timestamp": 1761388161}
+	]}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, SyncResponse{Device: "boiler", AckedSeq: 2, Inserted: 2, Duplicates: 0}, resp)
+
+	// the acknowledgement was lost and the device uploads again with one more
+	code, resp = postSync(t, s, `{"device": "boiler", "readings": [
+		{"seq": 1, "tempCo": 40.0, "tempRoom": 21.0, "humidity": 50.0, "timestamp": 1761388101},
+		{"seq": 2, "tempCo": 41.0, "tempRoom": 21.1, "humidity": 50.5, "timestamp": 1761388161},
+		{"seq": 3, "tempCo": 42.0, "tempRoom": 21.2, "humidity": 51.0, "timestamp": 1761388221}
+	]}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, SyncResponse{Device: "boiler", AckedSeq: 3, Inserted: 1, Duplicates: 2}, resp)
+
+	// sequences are tracked per device
+	code, resp = postSync(t, s, `{"device": "attic", "readings": [{"seq": 1, "tempCo": 10.0, "tempRoom": 5.0, "humidity": 70.0}]}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, int64(1), resp.AckedSeq)
+
+	readings, err := st.ListReadings(context.Background(), 100, 0)
+	require.NoError(t, err)
+	assert.Len(t, readings, 4)
+}
+
+func TestSyncHandlerValidation(t *testing.T) {
+	s, _ := newTestServer("testsecret")
+
+	code, _ := postSync(t, s, `{"readings": [{"seq": 1}]}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	code, _ = postSync(t, s, `{"device": "boiler", "readings": [{"seq": 0}]}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	code, _ = postSync(t, s, `{"device": "boiler", "readings": [{"seq": 1, "humidity": 120}]}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+}
+
+func TestSyncHandlerForwardsNewReadings(t *testing.T) {
+	s, st := newTestServer("testsecret")
+	var forwarded []float64
+	s.ingest = ingest.New(st, ingest.Config{Forward: func(rs []store.TemperatureReading) {
+		for _, r := range rs {
+			forwarded = append(forwarded, r.TempCo)
+		}
+	}})
+
+	postSync(t, s, `{"device": "boiler", "readings": [{"seq": 1, "tempCo": 40.0}, {"seq": 2, "tempCo": 41.0}]}`)
+	postSync(t, s, `{"device": "boiler", "readings": [{"seq": 2, "tempCo": 41.0}, {"seq": 3, "tempCo": 42.0}]}`)
+	postSync(t, s, `{"device": "boiler", "readings": [{"seq": 3, "tempCo": 42.0}]}`)
+	assert.Equal(t, []float64{40, 41, 42}, forwarded)
+}
+
+func TestSyncRangeHandlers(t *testing.T) {
+	s, st := newTestServer("testsecret")
+	call := func(h http.HandlerFunc, method, body string, resp any) int {
+		req := httptest.NewRequest(method, "/sync/range", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Secret-Key", "testsecret")
+		w := httptest.NewRecorder()
+		h(w, req)
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+		}
+		return w.Code
+	}
+	ts := int64(1761388101)
+	_, err := st.InsertReading(context.Background(), store.TemperatureReading{Device: "boiler", TempCo: 1, Timestamp: &ts})
+	require.NoError(t, err)
+
+	// replacing a range twice leaves the same readings
+	body := `{"device": "boiler", "from": 1761386400, "to": 1761390000, "readings": [
+		{"tempCo": 40.0, "tempRoom": 21.0, "humidity": 50.0, "timestamp": 1761388101},
+		{"tempCo": 41.0, "tempRoom": 21.1, "humidity": 50.5, "timestamp": 1761388161, "quality": "suspect"}
+	]}`
+	var rangeResp SyncRangeResponse
+	for range 2 {
+		require.Equal(t, http.StatusOK, call(s.syncRangeHandler, http.MethodPut, body, &rangeResp))
+		assert.Equal(t, "boiler", rangeResp.Device)
+		assert.Equal(t, 2, rangeResp.Count)
+	}
+	readings, err := st.ListReadings(context.Background(), 100, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 2)
+	assert.Equal(t, rangeResp.ReadingDigest, store.Digest(1761386400, readings))
+
+	var marks SyncMarksResponse
+	require.Equal(t, http.StatusOK, call(s.syncMarksHandler, http.MethodPost, `{"devices": ["boiler", "attic"]}`, &marks))
+	assert.Equal(t, map[string]int64{"boiler": 1761388161, "attic": 0}, marks.Marks)
+
+	var digests SyncDigestsResponse
+	require.Equal(t, http.StatusOK, call(s.syncDigestsHandler, http.MethodPost,
+		`{"devices": ["boiler", "attic"], "from": 1761382800, "to": 1761393600, "bucket": 3600}`, &digests))
+	assert.Equal(t, []store.ReadingDigest{rangeResp.ReadingDigest}, digests.Digests["boiler"])
+	assert.Empty(t, digests.Digests["attic"])
+
+	for _, body := range []string{
+		`{"from": 1761386400, "to": 1761390000, "readings": []}`,
+		`{"device": "boiler", "from": 1761390000, "to": 1761386400, "readings": []}`,
+		`{"device": "boiler", "from": 1761386400, "to": 1761390000, "readings": [{"timestamp": 1761390000}]}`,
+		`{"device": "boiler", "from": 1761386400, "to": 1761390000, "readings": [{"timestamp": 1761388101, "quality": "great"}]}`,
+		`{"device": "boiler", "from": 1761386400, "to": 1761390000, "readings": [{"timestamp": 1761388101, "humidity": 150}]}`,
+	} {
+		assert.Equal(t, http.StatusUnprocessableEntity, call(s.syncRangeHandler, http.MethodPut, body, nil), body)
+	}
+	assert.Equal(t, http.StatusUnprocessableEntity, call(s.syncDigestsHandler, http.MethodPost,
+		`{"devices": ["boiler"], "from": 0, "to": 1761393600, "bucket": 3600}`, nil))
+}
+
+func TestSyncRangeScope(t *testing.T) {
+	st := memory.New()
+	srv := httptest.NewServer(NewServer(Config{
+		SecretKey: "testsecret",
+		APIKeys:   []APIKey{{Name: "edge", Key: "edge-key-0123456789", Scopes: []string{ScopeWrite}}},
+	}, st))
+	defer srv.Close()
+
+	resp := doRequest(t, srv, "POST", "/devices/bulk", `[{"name": "plot-1"}, {"name": "plot-2"}]`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var provisioned []ProvisionedDevice
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&provisioned))
+	ts := int64(1761388101)
+	_, err := st.InsertReading(context.Background(), store.TemperatureReading{Device: "plot-2", TempCo: 40, Timestamp: &ts})
+	require.NoError(t, err)
+
+	// replacing readings takes an admin key, not a device's or a write key
+	body := `{"device": "plot-2", "from": 1761386400, "to": 1761390000, "readings": []}`
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, provisioned[0].Key, "PUT", "/sync/range", body).StatusCode)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "edge-key-0123456789", "PUT", "/sync/range", body).StatusCode)
+	assert.Equal(t, http.StatusForbidden, doRequestWithKey(t, srv, "edge-key-0123456789", "POST", "/sync/marks", `{"devices": ["plot-2"]}`).StatusCode)
+	readings, err := st.ListReadings(context.Background(), 10, 0)
+	require.NoError(t, err)
+	assert.Len(t, readings, 1)
+
+	assert.Equal(t, http.StatusOK, doRequest(t, srv, "PUT", "/sync/range", body).StatusCode)
+	readings, err = st.ListReadings(context.Background(), 10, 0)
+	require.NoError(t, err)
+	assert.Empty(t, readings)
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const (
+	// DefaultReadTokenTTL is how long a read token is valid unless the
+	// request minting it says otherwise.
+	DefaultReadTokenTTL = 15 * time.Minute
+	// maxReadTokenTTL is the longest a read token may be valid.
+	maxReadTokenTTL = 24 * time.Hour
+)
+
+// tokenPaths are the read endpoints accepting read tokens instead of a key.
+var tokenPaths = []string{"/data", "/data/aggregate", "/data/outdoor", "/data/export.xlsx", "/data/export.parquet", "/data/export.arrow", "/chart.png", "/sparkline.svg"}
+
+// ReadToken grants GET access to the readings of Device, any device when
+// empty, stamped within [From, To], unbounded when 0, until ExpiresAt.
+type ReadToken struct {
+	Device    string `json:"device,omitempty"`
+	From      int64  `json:"from,omitempty"`
+	To        int64  `json:"to,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// filters returns the reading filters of the token's time range.
+func (t ReadToken) filters() []store.ReadingFilter {
+	var filters []store.ReadingFilter
+	if t.From != 0 {
+		filters = append(filters, store.ReadingFilter{Field: "timestamp", Op: "gte", Value: float64(t.From)})
+	}
+	if t.To != 0 {
+		filters = append(filters, store.ReadingFilter{Field: "timestamp", Op: "lte", Value: float64(t.To)})
+	}
+	return filters
+}
+
+// clamp narrows [from, to] to the token's time range.
+func (t ReadToken) clamp(from, to int64) (int64, int64) {
+	if t.From != 0 {
+		from = max(from, t.From)
+	}
+	if t.To != 0 {
+		to = min(to, t.To)
+	}
+	return from, to
+}
+
+var errInvalidToken = errors.New("invalid token")
+
+// signToken returns the token encoded as payload.signature, both
+// base64url, signed with key.
+func signToken(t ReadToken, key string) string {
+	return signPayload(t, readTokenPurpose, key)
+}
+
+// Token purposes, which are signed along with the payload so a token of
+// one kind can't pass for another.
+const (
+	readTokenPurpose  = "read-token"
+	claimTokenPurpose = "claim-token"
+)
+
+// signPayload returns v encoded as payload.signature, both base64url,
+// signed with key for purpose.
+func signPayload(v any, purpose, key string) string {
+	payload, _ := json.Marshal(v)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(encoded, purpose, key))
+}
+
+func tokenMAC(encoded, purpose, key string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(purpose + ":" + encoded))
+	return mac.Sum(nil)
+}
+
+// verifyToken decodes a token signed with one of keys that hasn't expired
+// at now.
+func verifyToken(token string, keys []string, now time.Time) (ReadToken, error) {
+	var t ReadToken
+	if err := verifyPayload(token, readTokenPurpose, keys, &t); err != nil {
+		return t, err
+	}
+	if now.Unix() >= t.ExpiresAt {
+		return t, errInvalidToken
+	}
+	return t, nil
+}
+
+// verifyPayload decodes a token signed for purpose with one of keys into
+// v.
+func verifyPayload(token, purpose string, keys []string, v any) error {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return errInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return errInvalidToken
+	}
+	if !slices.ContainsFunc(keys, func(key string) bool { return hmac.Equal(mac, tokenMAC(encoded, purpose, key)) }) {
+		return errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || json.Unmarshal(payload, v) != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+type readTokenKey struct{}
+
+// readTokenFrom returns the token that authorized the request, if any.
+func readTokenFrom(ctx context.Context) (ReadToken, bool) {
+	t, ok := ctx.Value(readTokenKey{}).(ReadToken)
+	return t, ok
+}
+
+// requestToken verifies the read token in the Authorization header, as a
+// bearer token, or the token query parameter.
+func (s *server) requestToken(r *http.Request) (ReadToken, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return ReadToken{}, false
+	}
+	t, err := verifyToken(token, s.secretKeys(), time.Now())
+	if err != nil {
+		slogctx.FromCtx(r.Context()).Debug("Rejected read token", "error", err)
+		return ReadToken{}, false
+	}
+	return t, true
+}
+
+// ReadTokenPayload asks for a read token; TTL is a Go duration such as
+// "1h", defaulting to DefaultReadTokenTTL.
+type ReadTokenPayload struct {
+	Device string `json:"device"`
+	From   int64  `json:"from"`
+	To     int64  `json:"to"`
+	TTL    string `json:"ttl"`
+}
+
+// MintedToken is a signed read token and when it expires.
+type MintedToken struct {
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// tokensHandler mints read tokens for callers allowed to read, e.g. a
+// backend handing the dashboard a token instead of its key.
+func (s *server) tokensHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r, ScopeRead) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var p ReadTokenPayload
+	if err := decodeBody(r, &p); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	ttl := DefaultReadTokenTTL
+	if p.TTL != "" {
+		d, err := time.ParseDuration(p.TTL)
+		if err != nil || d <= 0 || d > maxReadTokenTTL {
+			http.Error(w, "Bad request: ttl must be a duration up to 24h", http.StatusUnprocessableEntity)
+			return
+		}
+		ttl = d
+	}
+	if p.From < 0 || p.To < 0 || (p.To != 0 && p.To < p.From) {
+		http.Error(w, "Bad request: invalid time range", http.StatusUnprocessableEntity)
+		return
+	}
+
+	t := ReadToken{Device: p.Device, From: p.From, To: p.To, ExpiresAt: time.Now().Add(ttl).Unix()}
+	logger.Info("Minted read token", slog.String("device", t.Device), slog.Int64("from", t.From), slog.Int64("to", t.To),
+		slog.Int64("expires_at", t.ExpiresAt))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(MintedToken{Token: signToken(t, s.secretKeys()[0]), ExpiresAt: t.ExpiresAt})
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/usage"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+const (
+	// defaultUsageRange is the range of GET /data/heating-usage without
+	// from.
+	defaultUsageRange = 7 * 24 * time.Hour
+	// maxUsageRange covers a yearly gas bill.
+	maxUsageRange = 366 * 24 * time.Hour
+	// usagePageSize is how many readings or zone events are loaded at once.
+	usagePageSize = 1000
+)
+
+// HeatingUsage is the estimated boiler runtime per day between From and To.
+type HeatingUsage struct {
+	// Source is "relay" for runtime from a zone's relay commands, or
+	// "readings" for runtime estimated from the CO temperature.
+	Source       string      `json:"source"`
+	From         int64       `json:"from"`
+	To           int64       `json:"to"`
+	Days         []usage.Day `json:"days"`
+	RuntimeHours float64     `json:"runtimeHours"`
+	EnergyKWh    float64     `json:"energyKWh"`
+}
+
+// heatingUsageHandler estimates daily boiler runtime from the relay of
+// zone, when given, or from the CO temperature at or above threshold.
+// power, the boiler's rated power in kW, turns runtime into energy.
+func (s *server) heatingUsageHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	from, to, ok := parseTimeRange(w, q, defaultUsageRange)
+	if !ok {
+		return
+	}
+	if from >= to || to-from > int64(maxUsageRange/time.Second) {
+		http.Error(w, "Bad request: from must be before to and at most 366 days apart", http.StatusUnprocessableEntity)
+		return
+	}
+	threshold, power := usage.DefaultThreshold, 0.0
+	for name, dst := range map[string]*float64{"threshold": &threshold, "power": &power} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil || math.IsNaN(n) || math.IsInf(n, 0) || (name == "power" && n < 0) {
+				http.Error(w, "Bad request: invalid "+name, http.StatusUnprocessableEntity)
+				return
+			}
+			*dst = n
+		}
+	}
+
+	resp := HeatingUsage{Source: "readings", From: from, To: to}
+	var intervals []usage.Interval
+	if v := q.Get("zone"); v != "" {
+		st, ok := s.zoneStore(w)
+		if !ok {
+			return
+		}
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Bad request: invalid zone", http.StatusUnprocessableEntity)
+			return
+		}
+		if _, err := st.GetZone(r.Context(), id); errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeStoreError(w, logger, err, "Failed to get zone", "id", id)
+			return
+		}
+		events, err := zoneEventsSince(r.Context(), st, id, from)
+		if err != nil {
+			writeStoreError(w, logger, err, "Failed to query zone history", "id", id)
+			return
+		}
+		resp.Source = "relay"
+		intervals = usage.RelayIntervals(events, min(to, time.Now().Unix()))
+	} else {
+		readings, err := readingsSince(r.Context(), from-int64(usage.DefaultMaxGap/time.Second), s.store.ListReadings)
+		if err != nil {
+			writeStoreError(w, logger, err, "Failed to query readings")
+			return
+		}
+		intervals = usage.ReadingIntervals(readings, threshold, usage.DefaultMaxGap)
+	}
+
+	resp.Days = usage.Daily(intervals, from, to, time.Local, power)
+	for _, d := range resp.Days {
+		resp.RuntimeHours += d.RuntimeHours
+		resp.EnergyKWh += d.EnergyKWh
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// readingsSince returns the readings stamped at or after from, oldest
+// first, paging through them with list, e.g. a readingLister.
+func readingsSince(ctx context.Context, from int64, list readingLister) ([]store.TemperatureReading, error) {
+	var readings []store.TemperatureReading
+	for offset := 0; ; offset += usagePageSize {
+		page, err := list(ctx, usagePageSize, offset)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range page {
+			if r.Timestamp == nil {
+				continue
+			}
+			if *r.Timestamp < from {
+				slices.Reverse(readings)
+				return readings, nil
+			}
+			readings = append(readings, r)
+		}
+		if len(page) < usagePageSize {
+			slices.Reverse(readings)
+			return readings, nil
+		}
+	}
+}
+
+// zoneEventsSince returns the zone's events from the last one before from
+// on, which gives the relay state at from, oldest first.
+func zoneEventsSince(ctx context.Context, st store.ZoneStore, id int, from int64) ([]store.ZoneEvent, error) {
+	var events []store.ZoneEvent
+	for offset := 0; ; offset += usagePageSize {
+		page, err := st.ListZoneHistory(ctx, id, usagePageSize, offset)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range page {
+			events = append(events, e)
+			if e.Timestamp < from && e.Kind == store.ZoneEventRelay {
+				slices.Reverse(events)
+				return events, nil
+			}
+		}
+		if len(page) < usagePageSize {
+			slices.Reverse(events)
+			return events, nil
+		}
+	}
+}
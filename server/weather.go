@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// defaultOutdoorRange is how far back GET /data/outdoor looks without from.
+const defaultOutdoorRange = 24 * time.Hour
+
+// outdoorHandler serves the stored outdoor readings between from and to,
+// unix timestamps defaulting to the last day, within the time range of the
+// read token that authorized the request.
+func (s *server) outdoorHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slogctx.FromCtx(r.Context())
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ws, ok := s.store.(store.WeatherStore)
+	if !ok {
+		http.Error(w, "Outdoor readings are not supported by this storage backend", http.StatusNotImplemented)
+		return
+	}
+
+	q := r.URL.Query()
+	to := time.Now().Unix()
+	from := to - int64(defaultOutdoorRange/time.Second)
+	for name, dst := range map[string]*int64{"from": &from, "to": &to} {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				http.Error(w, "Bad request: invalid "+name, http.StatusUnprocessableEntity)
+				return
+			}
+			*dst = n
+		}
+	}
+
+	if t, ok := readTokenFrom(r.Context()); ok {
+		from, to = t.clamp(from, to)
+	}
+
+	readings, err := ws.ListOutdoorReadings(r.Context(), from, to)
+	if err != nil {
+		writeStoreError(w, logger, err, "Failed to query outdoor readings")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(readings)
+}
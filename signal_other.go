@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// upgradeSignals is empty where inheriting sockets isn't supported.
+var upgradeSignals []os.Signal
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/simulate"
+)
+
+// runSimulate handles `simulate [flags]`: virtual devices upload readings
+// to a server until interrupted or --duration passes, for load testing
+// alerting, batching and rate limits.
+func runSimulate(logger *slog.Logger, args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	url := fs.String("url", "http://127.0.0.1:8080", "Base URL of the server to send readings to")
+	devices := fs.Int("devices", simulate.DefaultDevices, "Number of simulated devices")
+	prefix := fs.String("prefix", simulate.DefaultPrefix, "Prefix of the device names, numbered from 1")
+	interval := fs.Duration("interval", simulate.DefaultInterval, "Time between a device's readings")
+	jitter := fs.Float64("jitter", 0.1, "Fraction of --interval by which readings are randomly early or late")
+	dropoutRate := fs.Float64("dropout-rate", 0.01, "Probability of a device losing its connection instead of uploading")
+	maxDropout := fs.Duration("max-dropout", 0, "Longest a connection is lost (default 10 intervals)")
+	clockSkew := fs.Duration("clock-skew", 0, "How far off each device's clock is at most, either way")
+	badRate := fs.Float64("bad-rate", 0, "Probability of an upload being a malformed payload")
+	duration := fs.Duration("duration", 0, "How long to run, until interrupted when 0")
+	randSeed := fs.Uint64("seed", uint64(time.Now().UnixNano()), "Random seed, for reproducible runs")
+	fs.Parse(args)
+	if *interval <= 0 {
+		return errors.New("--interval must be positive")
+	}
+	for name, rate := range map[string]float64{"jitter": *jitter, "dropout-rate": *dropoutRate, "bad-rate": *badRate} {
+		if rate < 0 || rate > 1 {
+			return errors.New("--" + name + " must be between 0 and 1")
+		}
+	}
+	key, err := secretEnv("APP_SECRET_KEY")
+	if err != nil {
+		return err
+	}
+	if env := os.Getenv("APP_SIMULATE_URL"); env != "" {
+		*url = env
+		logger.Debug("flag url overridden by env APP_SIMULATE_URL", "value", env)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	sim := simulate.New(simulate.Config{
+		URL:         *url,
+		SecretKey:   key,
+		Devices:     *devices,
+		Prefix:      *prefix,
+		Interval:    *interval,
+		Jitter:      *jitter,
+		DropoutRate: *dropoutRate,
+		MaxDropout:  *maxDropout,
+		ClockSkew:   *clockSkew,
+		BadRate:     *badRate,
+		Seed:        *randSeed,
+		Logger:      logger,
+	})
+	logger.Info("simulating devices", "url", *url, "devices", *devices, "interval", *interval, "seed", *randSeed)
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				logger.Info("simulation progress", "stats", sim.Stats())
+			}
+		}
+	}()
+	sim.Run(ctx)
+	logger.Info("simulation finished", "stats", sim.Stats())
+	return nil
+}
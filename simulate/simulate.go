@@ -0,0 +1,312 @@
+// Package simulate runs virtual ESP8266 devices against an esp8266-web
+// server for end-to-end and load testing: each one measures realistic
+// readings, buffers them and uploads its backlog through POST /sync like the
+// offline sync firmware, with configurable send jitter, connection dropouts,
+// clock skew and malformed payloads.
+package simulate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultDevices  = 10
+	DefaultPrefix   = "sim-"
+	DefaultInterval = 10 * time.Second
+	// maxBuffer is how many readings a device buffers while it can't
+	// upload, the oldest dropped first, about what fits an ESP8266's RAM.
+	maxBuffer = 500
+	// maxUpload is the most readings a device uploads at once.
+	maxUpload = 100
+)
+
+type Config struct {
+	// URL is the server's base URL, e.g. http://127.0.0.1:8080.
+	URL string
+	// SecretKey is sent in X-Secret-Key.
+	SecretKey string
+	// Devices is how many devices run, defaults to DefaultDevices.
+	Devices int
+	// Prefix names the devices, numbered from 1, defaults to
+	// DefaultPrefix.
+	Prefix string
+	// Interval between a device's readings, defaults to DefaultInterval.
+	Interval time.Duration
+	// Jitter is the fraction of Interval by which every reading is taken
+	// randomly early or late, between 0 and 1.
+	Jitter float64
+	// DropoutRate is the probability of a device losing its connection
+	// instead of uploading, for up to MaxDropout.
+	DropoutRate float64
+	// MaxDropout is the longest a connection is lost, defaults to 10
+	// intervals.
+	MaxDropout time.Duration
+	// ClockSkew is how far off each device's clock is at most, either way.
+	ClockSkew time.Duration
+	// BadRate is the probability of an upload being a malformed payload.
+	BadRate float64
+	// Seed makes the devices' randomness reproducible.
+	Seed   uint64
+	Client *http.Client
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// Stats count what the devices did.
+type Stats struct {
+	// Requests is how many uploads were sent, bad ones included.
+	Requests int64 `json:"requests"`
+	// Readings is how many readings were uploaded, re-sent ones included.
+	Readings int64 `json:"readings"`
+	// Acked is how many readings the server acknowledged.
+	Acked int64 `json:"acked"`
+	// Bad is how many malformed payloads were sent.
+	Bad int64 `json:"bad"`
+	// Rejected is how many uploads were answered with a client error
+	// other than 429.
+	Rejected int64 `json:"rejected"`
+	// Throttled is how many uploads were answered with 429 or 503.
+	Throttled int64 `json:"throttled"`
+	// Failed is how many uploads failed otherwise.
+	Failed int64 `json:"failed"`
+	// Dropouts is how many times a device lost its connection.
+	Dropouts int64 `json:"dropouts"`
+	// Dropped is how many readings devices dropped from a full buffer.
+	Dropped int64 `json:"dropped"`
+}
+
+type Simulator struct {
+	cfg    Config
+	client *http.Client
+	logger *slog.Logger
+
+	requests, readings, acked, bad, rejected, throttled, failed, dropouts, dropped atomic.Int64
+}
+
+func New(cfg Config) *Simulator {
+	if cfg.Devices <= 0 {
+		cfg.Devices = DefaultDevices
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = DefaultPrefix
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	cfg.Jitter = min(max(cfg.Jitter, 0), 1)
+	if cfg.MaxDropout <= 0 {
+		cfg.MaxDropout = 10 * cfg.Interval
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	client := cfg.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Simulator{cfg: cfg, client: client, logger: cfg.Logger}
+}
+
+// Stats returns what the devices did so far.
+func (s *Simulator) Stats() Stats {
+	return Stats{
+		Requests:  s.requests.Load(),
+		Readings:  s.readings.Load(),
+		Acked:     s.acked.Load(),
+		Bad:       s.bad.Load(),
+		Rejected:  s.rejected.Load(),
+		Throttled: s.throttled.Load(),
+		Failed:    s.failed.Load(),
+		Dropouts:  s.dropouts.Load(),
+		Dropped:   s.dropped.Load(),
+	}
+}
+
+// Run runs the devices until ctx is done.
+func (s *Simulator) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := range s.cfg.Devices {
+		rng := rand.New(rand.NewPCG(s.cfg.Seed, uint64(i)))
+		d := &device{
+			name: s.cfg.Prefix + strconv.Itoa(i+1),
+			rng:  rng,
+			skew: time.Duration((rng.Float64()*2 - 1) * float64(s.cfg.ClockSkew)),
+			// rooms differ by a few degrees
+			offset: math.Round((rng.Float64()*4-2)*10) / 10,
+		}
+		wg.Go(func() { s.run(ctx, d) })
+	}
+	wg.Wait()
+}
+
+type reading struct {
+	Seq       int64   `json:"seq"`
+	TempCo    float64 `json:"tempCo"`
+	TempRoom  float64 `json:"tempRoom"`
+	Humidity  float64 `json:"humidity"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+type device struct {
+	name   string
+	rng    *rand.Rand
+	skew   time.Duration
+	offset float64
+	seq    int64
+	buffer []reading
+	// offlineUntil is when a lost connection is back.
+	offlineUntil time.Time
+}
+
+func (s *Simulator) run(ctx context.Context, d *device) {
+	// devices don't start in step
+	wait := time.Duration(d.rng.Float64() * float64(s.cfg.Interval))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		jitter := (d.rng.Float64()*2 - 1) * s.cfg.Jitter
+		wait = time.Duration(float64(s.cfg.Interval) * (1 + jitter))
+
+		now := time.Now()
+		d.measure(now.Add(d.skew))
+		if len(d.buffer) > maxBuffer {
+			s.dropped.Add(int64(len(d.buffer) - maxBuffer))
+			d.buffer = d.buffer[len(d.buffer)-maxBuffer:]
+		}
+		if now.Before(d.offlineUntil) {
+			continue
+		}
+		if d.rng.Float64() < s.cfg.DropoutRate {
+			d.offlineUntil = now.Add(time.Duration(d.rng.Float64() * float64(s.cfg.MaxDropout)))
+			s.dropouts.Add(1)
+			s.logger.Debug("simulated device lost its connection", "device", d.name, "until", d.offlineUntil)
+			continue
+		}
+		if d.rng.Float64() < s.cfg.BadRate {
+			s.bad.Add(1)
+			s.upload(ctx, d, d.badPayload())
+			continue
+		}
+		batch := d.buffer[:min(len(d.buffer), maxUpload)]
+		body, err := json.Marshal(map[string]any{"device": d.name, "readings": batch})
+		if err != nil {
+			s.logger.Error("failed to encode readings", "device", d.name, "error", err)
+			continue
+		}
+		s.readings.Add(int64(len(batch)))
+		if acked, ok := s.upload(ctx, d, body); ok {
+			n := 0
+			for n < len(d.buffer) && d.buffer[n].Seq <= acked {
+				n++
+			}
+			d.buffer = d.buffer[n:]
+			s.acked.Add(int64(n))
+		}
+	}
+}
+
+// measure buffers a reading taken at the device's clock.
+func (d *device) measure(clock time.Time) {
+	tempCo, tempRoom, humidity := Sample(clock, 0.15, d.rng)
+	d.seq++
+	d.buffer = append(d.buffer, reading{
+		Seq:       d.seq,
+		TempCo:    math.Round(tempCo*100) / 100,
+		TempRoom:  math.Round((tempRoom+d.offset)*100) / 100,
+		Humidity:  math.Round(math.Max(0, math.Min(100, humidity))*100) / 100,
+		Timestamp: clock.Unix(),
+	})
+}
+
+// badPayload returns an upload the server must reject, of the kinds broken
+// firmware sends.
+func (d *device) badPayload() []byte {
+	ts := time.Now().Add(d.skew).Unix()
+	switch d.rng.IntN(4) {
+	case 0:
+		// cut off mid-request
+		return []byte(`{"device": "` + d.name + `", "readings": [{"seq": 1, "tempCo": 4`)
+	case 1:
+		// a failed sensor read formatted as text
+		return []byte(fmt.Sprintf(`{"device": %q, "readings": [{"seq": %d, "tempCo": "nan", "timestamp": %d}]}`, d.name, d.seq, ts))
+	case 2:
+		return []byte(fmt.Sprintf(`{"device": %q, "readings": [{"seq": %d, "tempCo": 40, "humidity": 250, "timestamp": %d}]}`, d.name, d.seq, ts))
+	default:
+		return []byte(fmt.Sprintf(`{"readings": [{"seq": %d, "tempCo": 40, "timestamp": %d}]}`, d.seq, ts))
+	}
+}
+
+// upload posts body to /sync and returns the acknowledged sequence.
+func (s *Simulator) upload(ctx context.Context, d *device, body []byte) (int64, bool) {
+	s.requests.Add(1)
+	url := strings.TrimRight(s.cfg.URL, "/") + "/sync"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		s.failed.Add(1)
+		return 0, false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Secret-Key", s.cfg.SecretKey)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			s.failed.Add(1)
+			s.logger.Debug("simulated upload failed", "device", d.name, "error", err)
+		}
+		return 0, false
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		var ack struct {
+			AckedSeq int64 `json:"ackedSeq"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&ack); err != nil {
+			s.failed.Add(1)
+			return 0, false
+		}
+		return ack.AckedSeq, true
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		s.throttled.Add(1)
+		// back off like the firmware, the buffer keeps filling meanwhile
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			d.offlineUntil = time.Now().Add(time.Duration(secs) * time.Second)
+		}
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		s.rejected.Add(1)
+	default:
+		s.failed.Add(1)
+	}
+	s.logger.Debug("simulated upload refused", "device", d.name, "status", resp.StatusCode)
+	return 0, false
+}
+
+// Sample returns the boiler (CO) and room temperatures and the humidity at
+// t: a daily room temperature cycle, a heating curve that peaks in the
+// morning and evening and humidity moving inversely to the room
+// temperature, with gaussian noise of the given standard deviation.
+func Sample(t time.Time, noise float64, rng *rand.Rand) (tempCo, tempRoom, humidity float64) {
+	hour := float64(t.Hour()) + float64(t.Minute())/60
+	day := 2 * math.Pi * (hour - 9) / 24
+
+	tempRoom = 21 + 2*math.Sin(day) + rng.NormFloat64()*noise
+	heating := math.Max(0, math.Cos(2*math.Pi*(hour-7)/12))
+	tempCo = 25 + 30*heating + rng.NormFloat64()*noise*2
+	humidity = 55 - 4*math.Sin(day) + rng.NormFloat64()*noise*3
+	return tempCo, tempRoom, humidity
+}
@@ -0,0 +1,63 @@
+package simulate
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/server"
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSimulator(t *testing.T) {
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	st := memory.New()
+	srv := httptest.NewServer(server.NewServer(server.Config{SecretKey: "secret", Logger: discard}, st))
+	defer srv.Close()
+
+	sim := New(Config{
+		URL:         srv.URL,
+		SecretKey:   "secret",
+		Devices:     3,
+		Interval:    5 * time.Millisecond,
+		Jitter:      0.5,
+		DropoutRate: 0.1,
+		MaxDropout:  20 * time.Millisecond,
+		ClockSkew:   time.Hour,
+		BadRate:     0.2,
+		Seed:        1,
+		Logger:      discard,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	sim.Run(ctx)
+
+	stats := sim.Stats()
+	assert.Positive(t, stats.Acked)
+	assert.Positive(t, stats.Bad)
+	assert.Positive(t, stats.Dropouts)
+	// only the bad payloads are rejected, those cut off by the end aren't
+	// answered
+	assert.LessOrEqual(t, stats.Rejected, stats.Bad)
+	assert.GreaterOrEqual(t, stats.Rejected, stats.Bad-3)
+	assert.Zero(t, stats.Failed)
+
+	// every acknowledged reading is stored once, re-sent ones weren't
+	// stored twice; uploads cut off by the end may be stored unacknowledged
+	readings, err := st.ListFilteredReadings(context.Background(), store.ReadingQuery{}, 10000, 0)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, int64(len(readings)), stats.Acked)
+	assert.LessOrEqual(t, int64(len(readings)), stats.Acked+3*maxUpload)
+	devices := make(map[string]bool)
+	for _, r := range readings {
+		devices[r.Device] = true
+		assert.InDelta(t, 21, r.TempRoom, 5)
+	}
+	assert.Equal(t, map[string]bool{"sim-1": true, "sim-2": true, "sim-3": true}, devices)
+}
@@ -0,0 +1,91 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT publishes every reading as JSON to Topic, e.g. for Home Assistant or
+// Node-RED. It connects on the first write and reconnects on its own.
+type MQTT struct {
+	// Broker is the broker URL, e.g. tcp://mqtt:1883 or ssl://mqtt:8883.
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	Topic    string
+	// QoS is 0, 1 or 2.
+	QoS byte
+	// Retain keeps the last reading on the broker for new subscribers.
+	Retain bool
+
+	mu     sync.Mutex
+	client mqtt.Client
+}
+
+var _ Sink = (*MQTT)(nil)
+
+func (m *MQTT) Name() string { return "mqtt" }
+
+// timeout bounds connecting and every publish.
+const mqttTimeout = 10 * time.Second
+
+func (m *MQTT) connect() (mqtt.Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client != nil {
+		return m.client, nil
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(m.Broker).
+		SetClientID(m.ClientID).
+		SetUsername(m.Username).
+		SetPassword(m.Password).
+		SetAutoReconnect(true).
+		SetConnectTimeout(mqttTimeout)
+	client := mqtt.NewClient(opts)
+	if t := client.Connect(); !t.WaitTimeout(mqttTimeout) {
+		return nil, fmt.Errorf("mqtt connect %s: timeout", m.Broker)
+	} else if err := t.Error(); err != nil {
+		return nil, fmt.Errorf("mqtt connect %s: %w", m.Broker, err)
+	}
+	m.client = client
+	return client, nil
+}
+
+func (m *MQTT) Write(ctx context.Context, readings []store.TemperatureReading) error {
+	client, err := m.connect()
+	if err != nil {
+		return err
+	}
+	for _, r := range readings {
+		payload, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		t := client.Publish(m.Topic, m.QoS, m.Retain, payload)
+		if !t.WaitTimeout(mqttTimeout) {
+			return fmt.Errorf("mqtt publish %s: timeout", m.Topic)
+		}
+		if err := t.Error(); err != nil {
+			return fmt.Errorf("mqtt publish %s: %w", m.Topic, err)
+		}
+	}
+	return nil
+}
+
+// Close disconnects from the broker.
+func (m *MQTT) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client != nil {
+		m.client.Disconnect(250)
+		m.client = nil
+	}
+}
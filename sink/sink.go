@@ -0,0 +1,181 @@
+// Package sink fans accepted readings out to extra destinations next to the
+// primary store, e.g. InfluxDB or MQTT. Every sink has its own buffer and
+// retry loop, so a slow or failing destination doesn't hold back ingest or
+// the other sinks.
+package sink
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+const (
+	DefaultMaxBuffer = 100000
+	DefaultBatchSize = 1000
+	// maxBackoff caps the wait between failed writes.
+	maxBackoff = 5 * time.Minute
+)
+
+// Sink is a destination for readings.
+type Sink interface {
+	// Name identifies the sink in logs.
+	Name() string
+	// Write stores readings; on error the whole batch is retried.
+	Write(ctx context.Context, readings []store.TemperatureReading) error
+}
+
+type Config struct {
+	// MaxBuffer caps the readings buffered per sink; the oldest are dropped
+	// when a sink falls too far behind. Defaults to DefaultMaxBuffer.
+	MaxBuffer int
+	// BatchSize defaults to DefaultBatchSize.
+	BatchSize int
+	// RetryInterval is the first wait after a failed write, doubled up to
+	// five minutes while it keeps failing. Defaults to a second.
+	RetryInterval time.Duration
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// Fanout writes readings to every sink in the background.
+type Fanout struct {
+	cfg    Config
+	queues []*queue
+}
+
+type queue struct {
+	sink   Sink
+	logger *slog.Logger
+	notify chan struct{}
+
+	mu      sync.Mutex
+	buf     []store.TemperatureReading
+	dropped int64
+}
+
+func NewFanout(cfg Config, sinks ...Sink) *Fanout {
+	if cfg.MaxBuffer <= 0 {
+		cfg.MaxBuffer = DefaultMaxBuffer
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = time.Second
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	f := &Fanout{cfg: cfg}
+	for _, s := range sinks {
+		f.queues = append(f.queues, &queue{
+			sink:   s,
+			logger: cfg.Logger.With("sink", s.Name()),
+			notify: make(chan struct{}, 1),
+		})
+	}
+	return f
+}
+
+// Enqueue buffers readings for every sink. It never blocks on a sink.
+func (f *Fanout) Enqueue(readings []store.TemperatureReading) {
+	for _, q := range f.queues {
+		q.mu.Lock()
+		q.buf = append(q.buf, readings...)
+		if over := len(q.buf) - f.cfg.MaxBuffer; over > 0 {
+			q.buf = append(q.buf[:0], q.buf[over:]...)
+			q.dropped += int64(over)
+			q.logger.Warn("sink buffer full, dropped oldest readings", "dropped", over, "dropped_total", q.dropped)
+		}
+		q.mu.Unlock()
+		select {
+		case q.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Pending returns the readings buffered per sink name.
+func (f *Fanout) Pending() map[string]int {
+	pending := make(map[string]int, len(f.queues))
+	for _, q := range f.queues {
+		q.mu.Lock()
+		pending[q.sink.Name()] = len(q.buf)
+		q.mu.Unlock()
+	}
+	return pending
+}
+
+// Run writes to every sink until ctx is done.
+func (f *Fanout) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, q := range f.queues {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.run(ctx, f.cfg)
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *queue) run(ctx context.Context, cfg Config) {
+	wait := cfg.RetryInterval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.notify:
+		}
+		for {
+			q.mu.Lock()
+			batch := append([]store.TemperatureReading(nil), q.buf[:min(len(q.buf), cfg.BatchSize)]...)
+			dropped := q.dropped
+			q.mu.Unlock()
+			if len(batch) == 0 {
+				break
+			}
+
+			if err := q.sink.Write(ctx, batch); err != nil {
+				q.logger.Error("failed to write readings to sink", "error", err, "retry_in", wait)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+				wait = min(wait*2, maxBackoff)
+				continue
+			}
+			wait = cfg.RetryInterval
+
+			q.mu.Lock()
+			// readings dropped for space while writing were the front
+			// of this batch and are gone already
+			n := max(len(batch)-int(q.dropped-dropped), 0)
+			q.buf = append(q.buf[:0], q.buf[n:]...)
+			q.mu.Unlock()
+		}
+	}
+}
+
+// storeSink writes to a store.Store.
+type storeSink struct {
+	name  string
+	store store.Store
+}
+
+// FromStore makes a sink of a secondary store, e.g. a second database.
+func FromStore(name string, st store.Store) Sink {
+	return &storeSink{name: name, store: st}
+}
+
+func (s *storeSink) Name() string { return s.name }
+
+func (s *storeSink) Write(ctx context.Context, readings []store.TemperatureReading) error {
+	_, err := s.store.InsertReadings(ctx, readings)
+	return err
+}
@@ -0,0 +1,84 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+type fakeSink struct {
+	name string
+
+	mu       sync.Mutex
+	failures int
+	written  []store.TemperatureReading
+}
+
+func (f *fakeSink) Name() string { return f.name }
+
+func (f *fakeSink) Write(ctx context.Context, rs []store.TemperatureReading) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("unavailable")
+	}
+	f.written = append(f.written, rs...)
+	return nil
+}
+
+func (f *fakeSink) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.written)
+}
+
+func reading(tempCo float64) store.TemperatureReading {
+	ts := int64(1761388101)
+	return store.TemperatureReading{TempCo: tempCo, TempRoom: 21.5, Humidity: 50, Timestamp: &ts}
+}
+
+func TestFanoutIsolatesFailingSinks(t *testing.T) {
+	healthy := &fakeSink{name: "healthy"}
+	flaky := &fakeSink{name: "flaky", failures: 2}
+	f := NewFanout(Config{RetryInterval: time.Millisecond, Logger: discard}, healthy, flaky)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go f.Run(ctx)
+
+	f.Enqueue([]store.TemperatureReading{reading(40), reading(41)})
+	f.Enqueue([]store.TemperatureReading{reading(42)})
+
+	assert.Eventually(t, func() bool { return healthy.count() == 3 && flaky.count() == 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, map[string]int{"healthy": 0, "flaky": 0}, f.Pending())
+}
+
+func TestFanoutMaxBuffer(t *testing.T) {
+	s := &fakeSink{name: "stalled"}
+	f := NewFanout(Config{MaxBuffer: 2, Logger: discard}, s)
+	f.Enqueue([]store.TemperatureReading{reading(40), reading(41), reading(42)})
+	assert.Equal(t, map[string]int{"stalled": 2}, f.Pending())
+	assert.Equal(t, 41.0, f.queues[0].buf[0].TempCo, "oldest readings are dropped")
+}
+
+func TestFromStore(t *testing.T) {
+	st := memory.New()
+	s := FromStore("replica", st)
+	assert.Equal(t, "replica", s.Name())
+	require.NoError(t, s.Write(context.Background(), []store.TemperatureReading{reading(40)}))
+	readings, err := st.ListReadings(context.Background(), 10, 0)
+	require.NoError(t, err)
+	assert.Len(t, readings, 1)
+}
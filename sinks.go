@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/bartosz121/esp8266-web/events"
+	"github.com/bartosz121/esp8266-web/forward"
+	"github.com/bartosz121/esp8266-web/ingest"
+	"github.com/bartosz121/esp8266-web/sink"
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/influx"
+)
+
+// sinks returns the configured destinations readings are written to next to
+// the primary store.
+func (c *config) sinks(ctx context.Context, logger *slog.Logger) ([]sink.Sink, error) {
+	var sinks []sink.Sink
+	// with --db-driver=influx it is the primary store already
+	if c.influxURL != "" && c.dbDriver != "influx" {
+		influxConfig, err := c.influxConfig()
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink.FromStore("influx", influx.New(influxConfig)))
+		logger.Info("writing readings to influxdb", "url", c.influxURL, "bucket", c.influxBucket)
+	}
+	if c.mqttBroker != "" {
+		sinks = append(sinks, &sink.MQTT{
+			Broker:   c.mqttBroker,
+			ClientID: "esp8266-web",
+			Username: c.mqttUser,
+			Password: c.mqttPass,
+			Topic:    c.mqttTopic,
+			QoS:      1,
+		})
+		logger.Info("publishing readings to mqtt", "broker", c.mqttBroker, "topic", c.mqttTopic)
+	}
+	return sinks, nil
+}
+
+// forwarder returns the forwarder replicating db upstream, nil when none is
+// configured.
+func (c *config) forwarder(logger *slog.Logger, db store.Store) (*forward.Forwarder, error) {
+	if c.forwardURL == "" {
+		return nil, nil
+	}
+	fs, ok := db.(store.FilterStore)
+	if !ok {
+		return nil, fmt.Errorf("forwarding is not supported by db driver %q", c.dbDriver)
+	}
+	device := c.forwardDevice
+	if device == "" {
+		var err error
+		if device, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("forward device name: %w", err)
+		}
+	}
+	logger.Info("forwarding readings upstream", "url", c.forwardURL, "device", device)
+	return forward.New(forward.Config{
+		URL:       c.forwardURL,
+		SecretKey: c.forwardSecretKey,
+		Device:    device,
+		Store:     fs,
+		Logger:    logger,
+	}), nil
+}
+
+func (c *config) influxConfig() (influx.Config, error) {
+	if c.influxURL == "" || c.influxOrg == "" || c.influxBucket == "" {
+		return influx.Config{}, fmt.Errorf("--influx-url, --influx-org and --influx-bucket are required for influxdb")
+	}
+	return influx.Config{URL: c.influxURL, Token: c.influxToken, Org: c.influxOrg, Bucket: c.influxBucket}, nil
+}
+
+// eventPublisher starts publishing reading and alert events to the
+// configured broker, it returns nil when there is none.
+func (c *config) eventPublisher(ctx context.Context, logger *slog.Logger) (*events.Publisher, error) {
+	readingsTopic, alertsTopic := c.eventsPrefix+".readings", c.eventsPrefix+".alerts"
+	var broker events.Broker
+	switch {
+	case c.kafkaBrokers != "" && c.natsURL != "":
+		return nil, errors.New("--kafka-brokers and --nats-url are mutually exclusive")
+	case c.kafkaBrokers != "":
+		broker = events.NewKafka(splitList(c.kafkaBrokers))
+		logger.Info("publishing events to kafka", "brokers", c.kafkaBrokers, "topics", []string{readingsTopic, alertsTopic})
+	case c.natsURL != "":
+		broker = &events.NATS{URL: c.natsURL, Stream: c.natsStream, Subjects: []string{readingsTopic, alertsTopic}}
+		logger.Info("publishing events to nats", "url", c.natsURL, "subjects", []string{readingsTopic, alertsTopic})
+	default:
+		return nil, nil
+	}
+	publisher := events.NewPublisher(events.Config{
+		Broker:        broker,
+		ReadingsTopic: readingsTopic,
+		AlertsTopic:   alertsTopic,
+		Logger:        logger,
+	})
+	go publisher.Run(ctx)
+	return publisher, nil
+}
+
+// listeners returns the configured ingest adapters that aren't HTTP
+// endpoints, those mapping metrics reloaded by r.
+func (c *config) listeners(logger *slog.Logger, r *reloader, socks *sockets) ([]ingest.Listener, error) {
+	var listeners []ingest.Listener
+	topic := c.mqttIngestTopic
+	if topic == "" && c.mqttIngestFormat == ingest.FormatZigbee2MQTT {
+		topic = ingest.DefaultZigbee2MQTTTopic
+	}
+	if c.mqttBroker != "" && topic != "" {
+		listeners = append(listeners, &ingest.MQTT{
+			Broker:   c.mqttBroker,
+			ClientID: "esp8266-web-ingest",
+			Username: c.mqttUser,
+			Password: c.mqttPass,
+			Topic:    topic,
+			Format:   c.mqttIngestFormat,
+		})
+		logger.Info("ingesting readings from mqtt", "broker", c.mqttBroker, "topic", topic, "format", c.mqttIngestFormat)
+	}
+	if c.graphiteAddr != "" || c.statsdAddr != "" {
+		g := ingest.NewGraphite(c.graphiteAddr, c.statsdAddr, r.paths)
+		var err error
+		if c.graphiteAddr != "" {
+			if g.Listener, err = socks.Listen("tcp", c.graphiteAddr); err != nil {
+				return nil, fmt.Errorf("graphite listen %s: %w", c.graphiteAddr, err)
+			}
+		}
+		if c.statsdAddr != "" {
+			if g.StatsDConn, err = socks.ListenPacket("udp", c.statsdAddr); err != nil {
+				return nil, fmt.Errorf("statsd listen %s: %w", c.statsdAddr, err)
+			}
+		}
+		r.setPaths = g.SetPaths
+		listeners = append(listeners, g)
+		logger.Info("ingesting graphite and statsd metrics", "graphite_addr", c.graphiteAddr, "statsd_addr", c.statsdAddr, "paths", len(r.paths))
+	}
+	return listeners, nil
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"gopkg.in/yaml.v3"
+)
+
+// siteConfig is what configures a site beyond its flags and config file:
+// everything set up through the API, so a site can be rebuilt from
+// scratch or replicated to a second one.
+type siteConfig struct {
+	// Devices are the labelled devices.
+	Devices    []siteDevice    `yaml:"devices,omitempty"`
+	APIKeys    []siteAPIKey    `yaml:"api_keys,omitempty"`
+	Locations  []siteLocation  `yaml:"locations,omitempty"`
+	Zones      []siteZone      `yaml:"zones,omitempty"`
+	AwayMode   *siteAwayMode   `yaml:"away_mode,omitempty"`
+	AlertRules []siteAlertRule `yaml:"alert_rules,omitempty"`
+	// Features are the feature flags ever set at runtime.
+	Features map[string]bool `yaml:"features,omitempty"`
+	// NotificationChannels are the settings of every configured channel
+	// but its secrets, keyed by channel name. They come from flags and env
+	// variables, so they're exported for reference and not imported.
+	NotificationChannels map[string]map[string]string `yaml:"notification_channels,omitempty"`
+}
+
+type siteDevice struct {
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// siteAPIKey is a stored API key, only ever exported hashed.
+type siteAPIKey struct {
+	Name      string   `yaml:"name"`
+	ID        string   `yaml:"id,omitempty"`
+	Hash      string   `yaml:"hash"`
+	Scopes    []string `yaml:"scopes"`
+	CreatedAt int64    `yaml:"created_at"`
+}
+
+// siteLocation refers to its parent by the id it was exported with; new
+// ids are assigned on import.
+type siteLocation struct {
+	Id       int      `yaml:"id"`
+	Name     string   `yaml:"name"`
+	Kind     string   `yaml:"kind"`
+	ParentId *int     `yaml:"parent_id,omitempty"`
+	Devices  []string `yaml:"devices,omitempty"`
+}
+
+// siteZone is a zone's settings, without its override and relay state.
+type siteZone struct {
+	Name        string  `yaml:"name"`
+	Device      string  `yaml:"device"`
+	RelayDevice string  `yaml:"relay_device"`
+	Field       string  `yaml:"field"`
+	Target      float64 `yaml:"target"`
+	Hysteresis  float64 `yaml:"hysteresis"`
+	Mode        string  `yaml:"mode"`
+	Enabled     bool    `yaml:"enabled"`
+}
+
+type siteAwayMode struct {
+	Setpoint float64 `yaml:"setpoint"`
+	Since    int64   `yaml:"since"`
+	Until    int64   `yaml:"until"`
+}
+
+type siteAlertRule struct {
+	Name       string               `yaml:"name"`
+	Field      string               `yaml:"field"`
+	Op         string               `yaml:"op"`
+	Threshold  float64              `yaml:"threshold"`
+	Severity   string               `yaml:"severity"`
+	Enabled    bool                 `yaml:"enabled"`
+	Escalation []siteEscalationStep `yaml:"escalation,omitempty"`
+	Templates  map[string]string    `yaml:"templates,omitempty"`
+}
+
+type siteEscalationStep struct {
+	Channel      string `yaml:"channel"`
+	AfterSeconds int64  `yaml:"after_seconds"`
+}
+
+// configImportActor names `config import` in the feature flag changes.
+const configImportActor = "config-import"
+
+// runConfig handles `config [flags] export|import [file]`: export writes
+// the site's configuration as YAML to stdout, import reads it from file,
+// or stdin when it is - or missing, into the configured store.
+func runConfig(logger *slog.Logger, args []string) error {
+	var cfg config
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	cfg.registerFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: esp8266-web config [flags] export|import [file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	action := fs.Arg(0)
+	switch action {
+	case "export", "import":
+	case "":
+		fs.Usage()
+		return errors.New("missing config action")
+	default:
+		return fmt.Errorf("unknown config action %q", action)
+	}
+
+	if err := cfg.applyProfile(fs, logger); err != nil {
+		return err
+	}
+	if err := cfg.applyEnv(logger); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if _, err := cfg.watchSecrets(ctx, logger); err != nil {
+		return err
+	}
+	db, err := openStore(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if action == "export" {
+		sc, err := exportSiteConfig(ctx, db)
+		if err != nil {
+			return err
+		}
+		sc.NotificationChannels = cfg.notificationChannels()
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(sc); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+
+	in := io.Reader(os.Stdin)
+	if path := fs.Arg(1); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	var sc siteConfig
+	dec := yaml.NewDecoder(in)
+	dec.KnownFields(true)
+	if err := dec.Decode(&sc); err != nil {
+		return fmt.Errorf("parse site config: %w", err)
+	}
+	return importSiteConfig(ctx, db, sc, os.Stdout)
+}
+
+// exportSiteConfig reads the site's configuration from whatever db keeps.
+func exportSiteConfig(ctx context.Context, db store.Store) (siteConfig, error) {
+	var sc siteConfig
+	if ls, ok := db.(store.LabelStore); ok {
+		labels, err := ls.DeviceLabels(ctx)
+		if err != nil {
+			return sc, fmt.Errorf("export device labels: %w", err)
+		}
+		for _, device := range slices.Sorted(maps.Keys(labels)) {
+			sc.Devices = append(sc.Devices, siteDevice{Name: device, Labels: labels[device]})
+		}
+	}
+	if ks, ok := db.(store.APIKeyStore); ok {
+		keys, err := ks.ListAPIKeys(ctx)
+		if err != nil {
+			return sc, fmt.Errorf("export API keys: %w", err)
+		}
+		for _, k := range keys {
+			sc.APIKeys = append(sc.APIKeys, siteAPIKey{Name: k.Name, ID: k.ID, Hash: k.Hash, Scopes: k.Scopes, CreatedAt: k.CreatedAt})
+		}
+	}
+	if ls, ok := db.(store.LocationStore); ok {
+		locations, err := ls.ListLocations(ctx)
+		if err != nil {
+			return sc, fmt.Errorf("export locations: %w", err)
+		}
+		for _, l := range locations {
+			sc.Locations = append(sc.Locations, siteLocation{Id: l.Id, Name: l.Name, Kind: l.Kind, ParentId: l.ParentId, Devices: l.Devices})
+		}
+	}
+	if zs, ok := db.(store.ZoneStore); ok {
+		zones, err := zs.ListZones(ctx)
+		if err != nil {
+			return sc, fmt.Errorf("export zones: %w", err)
+		}
+		for _, z := range zones {
+			sc.Zones = append(sc.Zones, siteZone{Name: z.Name, Device: z.Device, RelayDevice: z.RelayDevice, Field: z.Field, Target: z.Target, Hysteresis: z.Hysteresis, Mode: z.Mode, Enabled: z.Enabled})
+		}
+		away, err := zs.GetAwayMode(ctx)
+		if err != nil {
+			return sc, fmt.Errorf("export away mode: %w", err)
+		}
+		if away != nil {
+			sc.AwayMode = &siteAwayMode{Setpoint: away.Setpoint, Since: away.Since, Until: away.Until}
+		}
+	}
+	if as, ok := db.(store.AlertStore); ok {
+		rules, err := as.ListAlertRules(ctx)
+		if err != nil {
+			return sc, fmt.Errorf("export alert rules: %w", err)
+		}
+		for _, r := range rules {
+			rule := siteAlertRule{Name: r.Name, Field: r.Field, Op: r.Op, Threshold: r.Threshold, Severity: r.Severity, Enabled: r.Enabled, Templates: r.Templates}
+			for _, step := range r.Escalation {
+				rule.Escalation = append(rule.Escalation, siteEscalationStep{Channel: step.Channel, AfterSeconds: step.AfterSeconds})
+			}
+			sc.AlertRules = append(sc.AlertRules, rule)
+		}
+	}
+	if fs, ok := db.(store.FeatureStore); ok {
+		flags, err := fs.FeatureFlags(ctx)
+		if err != nil {
+			return sc, fmt.Errorf("export feature flags: %w", err)
+		}
+		if len(flags) > 0 {
+			sc.Features = flags
+		}
+	}
+	return sc, nil
+}
+
+// importSiteConfig stores sc in db and writes what it did to w. Keys,
+// locations, zones and alert rules already stored under the same name are
+// kept, so it can be run again; labels, the away mode and feature flags are
+// overwritten.
+func importSiteConfig(ctx context.Context, db store.Store, sc siteConfig, w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tNAME\tRESULT")
+	var errs []error
+	row := func(kind, name, result string, err error) {
+		if err != nil {
+			result = "failed"
+			errs = append(errs, fmt.Errorf("%s %s: %w", kind, name, err))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", kind, name, result)
+	}
+	unsupported := fmt.Errorf("not supported by this storage backend")
+
+	ks, ok := db.(store.APIKeyStore)
+	for _, k := range sc.APIKeys {
+		switch {
+		case !ok:
+			row("api key", k.Name, "", unsupported)
+		default:
+			err := ks.CreateAPIKey(ctx, store.APIKey{Name: k.Name, ID: k.ID, Hash: k.Hash, Scopes: k.Scopes, CreatedAt: k.CreatedAt})
+			if errors.Is(err, store.ErrExists) {
+				row("api key", k.Name, "skipped, already stored", nil)
+				continue
+			}
+			row("api key", k.Name, "imported", err)
+		}
+	}
+
+	ls, ok := db.(store.LabelStore)
+	for _, d := range sc.Devices {
+		if !ok {
+			row("device", d.Name, "", unsupported)
+			continue
+		}
+		row("device", d.Name, "imported", ls.SetDeviceLabels(ctx, d.Name, d.Labels))
+	}
+
+	if len(sc.Locations) > 0 {
+		importLocations(ctx, db, sc.Locations, row, unsupported)
+	}
+
+	if zs, ok := db.(store.ZoneStore); ok {
+		zones, err := zs.ListZones(ctx)
+		if err != nil {
+			return fmt.Errorf("import zones: %w", err)
+		}
+		for _, z := range sc.Zones {
+			if slices.ContainsFunc(zones, func(stored store.Zone) bool { return stored.Name == z.Name }) {
+				row("zone", z.Name, "skipped, already stored", nil)
+				continue
+			}
+			_, err := zs.CreateZone(ctx, store.Zone{Name: z.Name, Device: z.Device, RelayDevice: z.RelayDevice, Field: z.Field, Target: z.Target, Hysteresis: z.Hysteresis, Mode: z.Mode, Enabled: z.Enabled})
+			row("zone", z.Name, "imported", err)
+		}
+		if m := sc.AwayMode; m != nil {
+			row("away mode", strconv.FormatFloat(m.Setpoint, 'f', -1, 64), "imported", zs.SetAwayMode(ctx, &store.AwayMode{Setpoint: m.Setpoint, Since: m.Since, Until: m.Until}))
+		}
+	} else {
+		for _, z := range sc.Zones {
+			row("zone", z.Name, "", unsupported)
+		}
+		if sc.AwayMode != nil {
+			row("away mode", "", "", unsupported)
+		}
+	}
+
+	if as, ok := db.(store.AlertStore); ok {
+		rules, err := as.ListAlertRules(ctx)
+		if err != nil {
+			return fmt.Errorf("import alert rules: %w", err)
+		}
+		for _, r := range sc.AlertRules {
+			if slices.ContainsFunc(rules, func(stored store.AlertRule) bool { return stored.Name == r.Name }) {
+				row("alert rule", r.Name, "skipped, already stored", nil)
+				continue
+			}
+			rule := store.AlertRule{Name: r.Name, Field: r.Field, Op: r.Op, Threshold: r.Threshold, Severity: r.Severity, Enabled: r.Enabled, Templates: r.Templates}
+			for _, step := range r.Escalation {
+				rule.Escalation = append(rule.Escalation, store.EscalationStep{Channel: step.Channel, AfterSeconds: step.AfterSeconds})
+			}
+			_, err := as.CreateAlertRule(ctx, rule)
+			row("alert rule", r.Name, "imported", err)
+		}
+	} else {
+		for _, r := range sc.AlertRules {
+			row("alert rule", r.Name, "", unsupported)
+		}
+	}
+
+	if len(sc.Features) > 0 {
+		names := slices.Sorted(maps.Keys(sc.Features))
+		fs, ok := db.(store.FeatureStore)
+		var err error
+		if !ok {
+			err = unsupported
+		} else {
+			changes := make([]store.FeatureChange, 0, len(names))
+			for _, name := range names {
+				changes = append(changes, store.FeatureChange{Name: name, Value: sc.Features[name], Actor: configImportActor, At: time.Now().Unix()})
+			}
+			err = fs.SetFeatureFlags(ctx, changes)
+		}
+		for _, name := range names {
+			row("feature", name, "imported", err)
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(sc.NotificationChannels)) {
+		row("notification channel", name, "skipped, set by flags or env variables", nil)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// importLocations creates the locations, outermost first so parents exist
+// before their children, reusing a stored location of the same name, kind
+// and parent.
+func importLocations(ctx context.Context, db store.Store, locations []siteLocation, row func(kind, name, result string, err error), unsupported error) {
+	ls, ok := db.(store.LocationStore)
+	if !ok {
+		for _, l := range locations {
+			row("location", l.Name, "", unsupported)
+		}
+		return
+	}
+	stored, err := ls.ListLocations(ctx)
+	if err != nil {
+		row("location", "", "", err)
+		return
+	}
+	locations = slices.Clone(locations)
+	slices.SortStableFunc(locations, func(a, b siteLocation) int {
+		return cmp.Compare(slices.Index(store.LocationKinds, a.Kind), slices.Index(store.LocationKinds, b.Kind))
+	})
+	// ids maps exported ids to stored ones.
+	ids := make(map[int]int, len(locations))
+	for _, l := range locations {
+		var parent *int
+		if l.ParentId != nil {
+			id, ok := ids[*l.ParentId]
+			if !ok {
+				row("location", l.Name, "", fmt.Errorf("parent %d wasn't imported", *l.ParentId))
+				continue
+			}
+			parent = &id
+		}
+		if i := slices.IndexFunc(stored, func(s store.Location) bool {
+			return s.Name == l.Name && s.Kind == l.Kind && (s.ParentId == nil) == (parent == nil) && (parent == nil || *s.ParentId == *parent)
+		}); i >= 0 {
+			ids[l.Id] = stored[i].Id
+			row("location", l.Name, "skipped, already stored", nil)
+			continue
+		}
+		created, err := ls.CreateLocation(ctx, store.Location{Name: l.Name, Kind: l.Kind, ParentId: parent, Devices: l.Devices})
+		if err == nil {
+			ids[l.Id] = created.Id
+		}
+		row("location", l.Name, "imported", err)
+	}
+}
@@ -0,0 +1,201 @@
+package snmp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BER tags of the types an SNMP message is made of.
+const (
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagNull        = 0x05
+	tagOID         = 0x06
+	tagSequence    = 0x30
+	tagGauge32     = 0x42
+	tagTimeTicks   = 0x43
+
+	tagNoSuchObject   = 0x80
+	tagNoSuchInstance = 0x81
+	tagEndOfMibView   = 0x82
+)
+
+var errTruncated = errors.New("truncated BER element")
+
+// element is a decoded BER element, its content undecoded.
+type element struct {
+	tag     byte
+	content []byte
+}
+
+// readElement splits the first element off b.
+func readElement(b []byte) (element, []byte, error) {
+	if len(b) < 2 {
+		return element{}, nil, errTruncated
+	}
+	tag, length, n := b[0], int(b[1]), 2
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size == 0 || size > 3 || len(b) < 2+size {
+			return element{}, nil, fmt.Errorf("unsupported BER length of %d bytes", size)
+		}
+		length = 0
+		for _, c := range b[2 : 2+size] {
+			length = length<<8 | int(c)
+		}
+		n += size
+	}
+	if len(b) < n+length {
+		return element{}, nil, errTruncated
+	}
+	return element{tag: tag, content: b[n : n+length]}, b[n+length:], nil
+}
+
+// readElements splits the content of a sequence into its elements.
+func readElements(b []byte) ([]element, error) {
+	var elements []element
+	for len(b) > 0 {
+		e, rest, err := readElement(b)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, e)
+		b = rest
+	}
+	return elements, nil
+}
+
+// integer decodes a two's complement integer of up to 8 bytes.
+func (e element) integer() (int64, error) {
+	if e.tag != tagInteger || len(e.content) == 0 || len(e.content) > 8 {
+		return 0, errors.New("invalid integer")
+	}
+	v := int64(int8(e.content[0]))
+	for _, c := range e.content[1:] {
+		v = v<<8 | int64(c)
+	}
+	return v, nil
+}
+
+// oid decodes an object identifier.
+func (e element) oid() (OID, error) {
+	if e.tag != tagOID || len(e.content) == 0 {
+		return nil, errors.New("invalid object identifier")
+	}
+	oid := OID{uint32(e.content[0]) / 40, uint32(e.content[0]) % 40}
+	var v uint32
+	for i, c := range e.content[1:] {
+		if v > 1<<25 {
+			return nil, errors.New("object identifier component too large")
+		}
+		v = v<<7 | uint32(c&0x7f)
+		if c&0x80 == 0 {
+			oid = append(oid, v)
+			v = 0
+		} else if i == len(e.content)-2 {
+			return nil, errTruncated
+		}
+	}
+	return oid, nil
+}
+
+// encode returns the element of tag with content.
+func encode(tag byte, content ...[]byte) []byte {
+	var n int
+	for _, c := range content {
+		n += len(c)
+	}
+	b := []byte{tag}
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n <= 0xff:
+		b = append(b, 0x81, byte(n))
+	default:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	}
+	for _, c := range content {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// encodeInteger returns v as a minimal two's complement integer of tag.
+func encodeInteger(tag byte, v int64) []byte {
+	b := make([]byte, integerSize(v))
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+	return encode(tag, b)
+}
+
+// integerSize is how many bytes v takes in two's complement.
+func integerSize(v int64) int {
+	n := 1
+	for v < -0x80 || v > 0x7f {
+		v >>= 8
+		n++
+	}
+	return n
+}
+
+// encodeUnsigned returns v as an unsigned integer of tag, e.g. a Gauge32,
+// prefixed with a zero byte when its top bit is set.
+func encodeUnsigned(tag byte, v uint32) []byte {
+	return encodeInteger(tag, int64(v))
+}
+
+// OID is an SNMP object identifier.
+type OID []uint32
+
+func (o OID) String() string {
+	parts := make([]string, len(o))
+	for i, v := range o {
+		parts[i] = strconv.FormatUint(uint64(v), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+// compare orders object identifiers lexicographically, as a MIB is walked.
+func (o OID) compare(p OID) int {
+	for i := range min(len(o), len(p)) {
+		switch {
+		case o[i] < p[i]:
+			return -1
+		case o[i] > p[i]:
+			return 1
+		}
+	}
+	return len(o) - len(p)
+}
+
+// hasPrefix reports whether o is p or below it.
+func (o OID) hasPrefix(p OID) bool {
+	return len(o) >= len(p) && o[:len(p)].compare(p) == 0
+}
+
+// append returns o followed by sub, without modifying o.
+func (o OID) append(sub ...uint32) OID {
+	return append(append(OID{}, o...), sub...)
+}
+
+func (o OID) encode() []byte {
+	b := []byte{byte(o[0]*40 + o[1])}
+	for _, v := range o[2:] {
+		var chunk []byte
+		for {
+			chunk = append([]byte{byte(v & 0x7f)}, chunk...)
+			if v >>= 7; v == 0 {
+				break
+			}
+		}
+		for i := range len(chunk) - 1 {
+			chunk[i] |= 0x80
+		}
+		b = append(b, chunk...)
+	}
+	return encode(tagOID, b)
+}
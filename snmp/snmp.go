@@ -0,0 +1,404 @@
+// Package snmp serves the latest reading of every configured device over a
+// read-only SNMP v1 and v2c agent, for building-management systems that can
+// only poll SNMP.
+//
+// Readings are a table under Base, in the net-snmp playpen reserved for
+// local MIBs, with a row per configured device, indexed from 1 in order:
+//
+//	Base.1.1.1.i  index, INTEGER
+//	Base.1.1.2.i  device name, OCTET STRING
+//	Base.1.1.3.i  tempCo × 100, INTEGER
+//	Base.1.1.4.i  tempRoom × 100, INTEGER
+//	Base.1.1.5.i  humidity × 100, Gauge32
+//	Base.1.1.6.i  timestamp of the reading, unix time, Gauge32
+//	Base.1.1.7.i  seconds since the device last sent a reading, Gauge32
+//	Base.1.1.8.i  1 once the device sent a reading, 0 before, INTEGER
+//	Base.2.0      number of devices, INTEGER
+//
+// sysDescr, sysObjectID and sysUpTime of the system group are answered
+// too. Get, GetNext and GetBulk requests are answered when they carry the
+// community; Set requests are refused and requests with another community
+// dropped.
+package snmp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// DefaultDevice names readings sent without a device, e.g. to /data.
+	DefaultDevice = "default"
+	// DefaultCommunity is the community requests carry unless configured.
+	DefaultCommunity = "public"
+
+	versionV1  = 0
+	versionV2c = 1
+
+	pduGet      = 0xa0
+	pduGetNext  = 0xa1
+	pduResponse = 0xa2
+	pduSet      = 0xa3
+	pduGetBulk  = 0xa5
+
+	errNoSuchName  = 2
+	errReadOnly    = 4
+	errNotWritable = 17
+
+	// maxVarBinds is the most variables one response carries, so it fits
+	// a datagram.
+	maxVarBinds = 100
+)
+
+// Base is the object identifier of the readings MIB, under the net-snmp
+// playpen 1.3.6.1.4.1.8072.9999.9999.
+var Base = OID{1, 3, 6, 1, 4, 1, 8072, 9999, 9999, 8266}
+
+var (
+	sysDescr    = OID{1, 3, 6, 1, 2, 1, 1, 1, 0}
+	sysObjectID = OID{1, 3, 6, 1, 2, 1, 1, 2, 0}
+	sysUpTime   = OID{1, 3, 6, 1, 2, 1, 1, 3, 0}
+)
+
+var requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "esp8266_snmp_requests_total",
+	Help: "SNMP requests by result: ok, error, bad community or invalid.",
+}, []string{"result"})
+
+type Config struct {
+	// Devices are given table rows in order.
+	Devices []string
+	// Community is the read-only community, DefaultCommunity when empty.
+	Community string
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// Agent answers SNMP requests from the latest readings passed to Update.
+type Agent struct {
+	logger    *slog.Logger
+	community string
+	devices   []string
+	now       func() time.Time
+	started   time.Time
+
+	mu     sync.RWMutex
+	latest map[string]latest
+}
+
+// latest is the latest reading of a device and when it was received.
+type latest struct {
+	r    store.TemperatureReading
+	seen time.Time
+}
+
+// varBind is a variable of a request or response, its value encoded.
+type varBind struct {
+	oid   OID
+	value []byte
+}
+
+func New(cfg Config) *Agent {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	if cfg.Community == "" {
+		cfg.Community = DefaultCommunity
+	}
+	return &Agent{
+		logger:    cfg.Logger,
+		community: cfg.Community,
+		devices:   cfg.Devices,
+		now:       time.Now,
+		started:   time.Now(),
+		latest:    make(map[string]latest),
+	}
+}
+
+// Update records r as the latest reading of device; readings of devices
+// without a row are ignored. It fits ingest.Config.OnNewest.
+func (a *Agent) Update(device string, r store.TemperatureReading) {
+	if device == "" {
+		device = DefaultDevice
+	}
+	if !slices.Contains(a.devices, device) {
+		return
+	}
+	now := a.now()
+	if r.Timestamp == nil {
+		ts := now.Unix()
+		r.Timestamp = &ts
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if prev, ok := a.latest[device]; ok && *prev.r.Timestamp > *r.Timestamp {
+		return
+	}
+	a.latest[device] = latest{r: r, seen: now}
+}
+
+// ListenAndServe serves SNMP over UDP on addr until ctx is done.
+func (a *Agent) ListenAndServe(ctx context.Context, addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("snmp listen: %w", err)
+	}
+	return a.Serve(ctx, conn)
+}
+
+// Serve answers the requests received on conn until ctx is done.
+func (a *Agent) Serve(ctx context.Context, conn net.PacketConn) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("snmp read: %w", err)
+		}
+		resp, err := a.respond(buf[:n])
+		if err != nil {
+			a.logger.Debug("invalid snmp request", "remote", addr.String(), "error", err)
+			continue
+		}
+		if resp == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			a.logger.Debug("failed to answer snmp request", "remote", addr.String(), "error", err)
+		}
+	}
+}
+
+// respond returns the response to a request message, nil when it is
+// dropped.
+func (a *Agent) respond(msg []byte) ([]byte, error) {
+	invalid := func(err error) ([]byte, error) {
+		requestsTotal.WithLabelValues("invalid").Inc()
+		return nil, err
+	}
+	top, _, err := readElement(msg)
+	if err != nil || top.tag != tagSequence {
+		return invalid(errors.New("not an snmp message"))
+	}
+	parts, err := readElements(top.content)
+	if err != nil || len(parts) != 3 {
+		return invalid(errors.New("not an snmp message"))
+	}
+	version, err := parts[0].integer()
+	if err != nil || (version != versionV1 && version != versionV2c) {
+		return invalid(fmt.Errorf("unsupported snmp version %d", version))
+	}
+	if parts[1].tag != tagOctetString || string(parts[1].content) != a.community {
+		requestsTotal.WithLabelValues("bad community").Inc()
+		return nil, nil
+	}
+	pdu := parts[2]
+	fields, err := readElements(pdu.content)
+	if err != nil || len(fields) != 4 || fields[3].tag != tagSequence {
+		return invalid(errors.New("invalid pdu"))
+	}
+	requestID, err1 := fields[0].integer()
+	nonRepeaters, err2 := fields[1].integer()
+	maxRepetitions, err3 := fields[2].integer()
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return invalid(err)
+	}
+	var requested []OID
+	binds, err := readElements(fields[3].content)
+	if err != nil {
+		return invalid(err)
+	}
+	for _, b := range binds {
+		pair, err := readElements(b.content)
+		if err != nil || len(pair) != 2 {
+			return invalid(errors.New("invalid variable binding"))
+		}
+		oid, err := pair[0].oid()
+		if err != nil {
+			return invalid(err)
+		}
+		requested = append(requested, oid)
+	}
+
+	mib := a.mib()
+	var (
+		response            []varBind
+		errStatus, errIndex int
+	)
+	switch {
+	case pdu.tag == pduGet:
+		for i, oid := range requested {
+			v, ok := lookup(mib, oid)
+			switch {
+			case ok:
+				response = append(response, varBind{oid, v})
+			case version == versionV1:
+				errStatus, errIndex = errNoSuchName, i+1
+			case oid.hasPrefix(Base):
+				response = append(response, varBind{oid, encode(tagNoSuchInstance)})
+			default:
+				response = append(response, varBind{oid, encode(tagNoSuchObject)})
+			}
+		}
+	case pdu.tag == pduGetNext:
+		for i, oid := range requested {
+			next, ok := following(mib, oid)
+			switch {
+			case ok:
+				response = append(response, next)
+			case version == versionV1:
+				errStatus, errIndex = errNoSuchName, i+1
+			default:
+				response = append(response, varBind{oid, encode(tagEndOfMibView)})
+			}
+		}
+	case pdu.tag == pduGetBulk && version == versionV2c:
+		nonRepeaters = min(max(nonRepeaters, 0), int64(len(requested)))
+		for _, oid := range requested[:nonRepeaters] {
+			response = append(response, nextOrEnd(mib, oid))
+		}
+		repeaters := requested[nonRepeaters:]
+		for range max(maxRepetitions, 0) {
+			if len(repeaters) == 0 || len(response)+len(repeaters) > maxVarBinds {
+				break
+			}
+			for i, oid := range repeaters {
+				next := nextOrEnd(mib, oid)
+				response = append(response, next)
+				repeaters[i] = next.oid
+			}
+		}
+	case pdu.tag == pduSet:
+		errStatus, errIndex = errNotWritable, 1
+		if version == versionV1 {
+			errStatus = errReadOnly
+		}
+	default:
+		return invalid(fmt.Errorf("unsupported pdu type %#x", pdu.tag))
+	}
+
+	result := "ok"
+	if errStatus != 0 {
+		result = "error"
+		// an error response echoes the request's variables
+		response = response[:0]
+		for _, oid := range requested {
+			response = append(response, varBind{oid, encode(tagNull)})
+		}
+	}
+	requestsTotal.WithLabelValues(result).Inc()
+	encoded := make([][]byte, 0, len(response))
+	for _, b := range response {
+		encoded = append(encoded, encode(tagSequence, b.oid.encode(), b.value))
+	}
+	return encode(tagSequence,
+		encodeInteger(tagInteger, version),
+		encode(tagOctetString, []byte(a.community)),
+		encode(pduResponse,
+			encodeInteger(tagInteger, requestID),
+			encodeInteger(tagInteger, int64(errStatus)),
+			encodeInteger(tagInteger, int64(errIndex)),
+			encode(tagSequence, encoded...),
+		),
+	), nil
+}
+
+// mib renders every variable, ordered as the MIB is walked.
+func (a *Agent) mib() []varBind {
+	now := a.now()
+	mib := []varBind{
+		{sysDescr, encode(tagOctetString, []byte("esp8266-web temperature readings"))},
+		{sysObjectID, Base.encode()},
+		{sysUpTime, encodeUnsigned(tagTimeTicks, uint32(now.Sub(a.started)/(10*time.Millisecond)))},
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	entry := Base.append(1, 1)
+	for column := uint32(1); column <= 8; column++ {
+		for i, device := range a.devices {
+			l, ok := a.latest[device]
+			var v []byte
+			switch column {
+			case 1:
+				v = encodeInteger(tagInteger, int64(i+1))
+			case 2:
+				v = encode(tagOctetString, []byte(device))
+			case 3:
+				v = encodeInteger(tagInteger, scaled(l.r.TempCo))
+			case 4:
+				v = encodeInteger(tagInteger, scaled(l.r.TempRoom))
+			case 5:
+				v = encodeUnsigned(tagGauge32, uint32(max(scaled(l.r.Humidity), 0)))
+			case 6:
+				var ts int64
+				if ok {
+					ts = *l.r.Timestamp
+				}
+				v = encodeUnsigned(tagGauge32, uint32(ts))
+			case 7:
+				var age int64
+				if ok {
+					age = max(int64(now.Sub(l.seen)/time.Second), 0)
+				}
+				v = encodeUnsigned(tagGauge32, uint32(min(age, math.MaxUint32)))
+			case 8:
+				var reported int64
+				if ok {
+					reported = 1
+				}
+				v = encodeInteger(tagInteger, reported)
+			}
+			mib = append(mib, varBind{entry.append(column, uint32(i+1)), v})
+		}
+	}
+	return append(mib, varBind{Base.append(2, 0), encodeInteger(tagInteger, int64(len(a.devices)))})
+}
+
+// lookup returns the value of oid.
+func lookup(mib []varBind, oid OID) ([]byte, bool) {
+	i, found := slices.BinarySearchFunc(mib, oid, func(b varBind, oid OID) int { return b.oid.compare(oid) })
+	if !found {
+		return nil, false
+	}
+	return mib[i].value, true
+}
+
+// following returns the variable after oid.
+func following(mib []varBind, oid OID) (varBind, bool) {
+	i, found := slices.BinarySearchFunc(mib, oid, func(b varBind, oid OID) int { return b.oid.compare(oid) })
+	if found {
+		i++
+	}
+	if i == len(mib) {
+		return varBind{}, false
+	}
+	return mib[i], true
+}
+
+// nextOrEnd returns the variable after oid, or the end of the MIB view.
+func nextOrEnd(mib []varBind, oid OID) varBind {
+	if next, ok := following(mib, oid); ok {
+		return next
+	}
+	return varBind{oid, encode(tagEndOfMibView)}
+}
+
+// scaled returns v in hundredths, clamped to 32 bits.
+func scaled(v float64) int64 {
+	return min(max(int64(math.Round(v*100)), math.MinInt32), math.MaxInt32)
+}
@@ -0,0 +1,179 @@
+package snmp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ts(v int64) *int64 { return &v }
+
+// response is a decoded response message.
+type response struct {
+	requestID int64
+	errStatus int64
+	errIndex  int64
+	binds     []element
+	oids      []OID
+}
+
+func TestAgent(t *testing.T) {
+	a := New(Config{Devices: []string{"attic", DefaultDevice}})
+	now := time.Unix(1761388161, 0)
+	a.now = func() time.Time { return now }
+	a.started = now.Add(-time.Minute)
+	a.Update("attic", store.TemperatureReading{TempCo: 40.5, TempRoom: -2.25, Humidity: 50, Timestamp: ts(1761388101)})
+	// older readings and unknown devices are ignored
+	a.Update("attic", store.TemperatureReading{TempCo: 1, Timestamp: ts(1761388000)})
+	a.Update("garage", store.TemperatureReading{TempCo: 1})
+	now = now.Add(30 * time.Second)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Serve(ctx, conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	request := func(version int64, community string, pdu byte, a, b int64, oids ...OID) *response {
+		var binds [][]byte
+		for _, oid := range oids {
+			binds = append(binds, encode(tagSequence, oid.encode(), encode(tagNull)))
+		}
+		msg := encode(tagSequence,
+			encodeInteger(tagInteger, version),
+			encode(tagOctetString, []byte(community)),
+			encode(pdu, encodeInteger(tagInteger, 4242), encodeInteger(tagInteger, a), encodeInteger(tagInteger, b), encode(tagSequence, binds...)),
+		)
+		_, err := client.Write(msg)
+		require.NoError(t, err)
+		require.NoError(t, client.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+		buf := make([]byte, 65535)
+		n, err := client.Read(buf)
+		if err != nil {
+			return nil
+		}
+		top, _, err := readElement(buf[:n])
+		require.NoError(t, err)
+		parts, err := readElements(top.content)
+		require.NoError(t, err)
+		require.Len(t, parts, 3)
+		assert.Equal(t, []byte(community), parts[1].content)
+		require.Equal(t, byte(pduResponse), parts[2].tag)
+		fields, err := readElements(parts[2].content)
+		require.NoError(t, err)
+		var r response
+		r.requestID, _ = fields[0].integer()
+		r.errStatus, _ = fields[1].integer()
+		r.errIndex, _ = fields[2].integer()
+		varBinds, err := readElements(fields[3].content)
+		require.NoError(t, err)
+		for _, vb := range varBinds {
+			pair, err := readElements(vb.content)
+			require.NoError(t, err)
+			oid, err := pair[0].oid()
+			require.NoError(t, err)
+			r.oids = append(r.oids, oid)
+			r.binds = append(r.binds, pair[1])
+		}
+		return &r
+	}
+
+	// a GET of sysDescr.0 as net-snmp's snmpget sends it
+	_, err = client.Write([]byte{
+		0x30, 0x27, 0x02, 0x01, 0x01, 0x04, 0x06, 'p', 'u', 'b', 'l', 'i', 'c',
+		0xa0, 0x1a, 0x02, 0x02, 0x10, 0x92, 0x02, 0x01, 0x00, 0x02, 0x01, 0x00,
+		0x30, 0x0e, 0x30, 0x0c, 0x06, 0x08, 0x2b, 0x06, 0x01, 0x02, 0x01, 0x01, 0x01, 0x00, 0x05, 0x00,
+	})
+	require.NoError(t, err)
+	buf := make([]byte, 1500)
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := client.Read(buf)
+	require.NoError(t, err)
+	descr := "esp8266-web temperature readings"
+	assert.Equal(t, append([]byte{
+		0x30, byte(0x27 + len(descr)), 0x02, 0x01, 0x01, 0x04, 0x06, 'p', 'u', 'b', 'l', 'i', 'c',
+		0xa2, byte(0x1a + len(descr)), 0x02, 0x02, 0x10, 0x92, 0x02, 0x01, 0x00, 0x02, 0x01, 0x00,
+		0x30, byte(0x0e + len(descr)), 0x30, byte(0x0c + len(descr)), 0x06, 0x08, 0x2b, 0x06, 0x01, 0x02, 0x01, 0x01, 0x01, 0x00, 0x04, byte(len(descr)),
+	}, descr...), buf[:n])
+
+	entry := Base.append(1, 1)
+	r := request(versionV2c, "public", pduGet, 0, 0, entry.append(2, 1), entry.append(3, 1), entry.append(4, 1), entry.append(5, 1),
+		entry.append(6, 1), entry.append(7, 1), entry.append(8, 1), entry.append(8, 2), Base.append(2, 0), sysUpTime)
+	require.NotNil(t, r)
+	assert.Equal(t, int64(4242), r.requestID)
+	assert.Zero(t, r.errStatus)
+	require.Len(t, r.binds, 10)
+	assert.Equal(t, element{tagOctetString, []byte("attic")}, r.binds[0])
+	values := make([]int64, 0, len(r.binds)-1)
+	for _, b := range r.binds[1:] {
+		b.tag = tagInteger
+		v, err := b.integer()
+		require.NoError(t, err)
+		values = append(values, v)
+	}
+	assert.Equal(t, []int64{4050, -225, 5000, 1761388101, 30, 1, 0, 2, 9000}, values)
+	assert.Equal(t, byte(tagGauge32), r.binds[3].tag)
+	assert.Equal(t, byte(tagTimeTicks), r.binds[9].tag)
+
+	r = request(versionV2c, "public", pduGet, 0, 0, entry.append(2, 3), OID{1, 3, 6, 1, 2, 1, 2, 1, 0})
+	require.NotNil(t, r)
+	assert.Equal(t, []element{{tagNoSuchInstance, []byte{}}, {tagNoSuchObject, []byte{}}}, r.binds)
+	r = request(versionV1, "public", pduGet, 0, 0, sysDescr, entry.append(2, 3))
+	require.NotNil(t, r)
+	assert.Equal(t, []int64{errNoSuchName, 2}, []int64{r.errStatus, r.errIndex})
+	assert.Equal(t, []OID{sysDescr, entry.append(2, 3)}, r.oids)
+
+	// a walk of the table visits a column of every device before the next
+	r = request(versionV2c, "public", pduGetNext, 0, 0, Base)
+	require.NotNil(t, r)
+	assert.Equal(t, []OID{entry.append(1, 1)}, r.oids)
+	r = request(versionV2c, "public", pduGetNext, 0, 0, entry.append(2, 1))
+	require.NotNil(t, r)
+	assert.Equal(t, []OID{entry.append(2, 2)}, r.oids)
+	assert.Equal(t, element{tagOctetString, []byte(DefaultDevice)}, r.binds[0])
+	r = request(versionV2c, "public", pduGetNext, 0, 0, Base.append(2, 0))
+	require.NotNil(t, r)
+	assert.Equal(t, byte(tagEndOfMibView), r.binds[0].tag)
+	r = request(versionV1, "public", pduGetNext, 0, 0, Base.append(2, 0))
+	require.NotNil(t, r)
+	assert.Equal(t, int64(errNoSuchName), r.errStatus)
+
+	r = request(versionV2c, "public", pduGetBulk, 1, 3, sysDescr, entry.append(8))
+	require.NotNil(t, r)
+	assert.Equal(t, []OID{sysObjectID, entry.append(8, 1), entry.append(8, 2), Base.append(2, 0)}, r.oids)
+
+	r = request(versionV2c, "public", pduSet, 0, 0, sysDescr)
+	require.NotNil(t, r)
+	assert.Equal(t, []int64{errNotWritable, 1}, []int64{r.errStatus, r.errIndex})
+	r = request(versionV1, "public", pduSet, 0, 0, sysDescr)
+	require.NotNil(t, r)
+	assert.Equal(t, int64(errReadOnly), r.errStatus)
+
+	assert.Nil(t, request(versionV2c, "private", pduGet, 0, 0, sysDescr))
+}
+
+func TestOIDEncoding(t *testing.T) {
+	for _, oid := range []OID{sysDescr, Base.append(1, 1, 7, 300), {1, 3, 6, 1, 4294967295}} {
+		e, rest, err := readElement(oid.encode())
+		require.NoError(t, err)
+		assert.Empty(t, rest)
+		got, err := e.oid()
+		require.NoError(t, err, oid.String())
+		assert.Equal(t, oid, got)
+	}
+	for _, v := range []int64{0, 127, 128, -1, -128, -129, 1761388101, 4294967295} {
+		e, _, err := readElement(encodeInteger(tagInteger, v))
+		require.NoError(t, err)
+		got, err := e.integer()
+		require.NoError(t, err)
+		assert.Equal(t, v, got)
+	}
+}
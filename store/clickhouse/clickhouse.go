@@ -0,0 +1,241 @@
+// Package clickhouse implements store.Store on top of ClickHouse's HTTP
+// interface, for deployments aggregating many buildings where Postgres
+// would struggle with the row count.
+//
+// ClickHouse has no row ids, so readings are returned with Id 0. Sync and
+// alerting aren't supported.
+package clickhouse
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+type Config struct {
+	// URL is the ClickHouse HTTP endpoint, e.g. http://clickhouse:8123.
+	URL string
+	// Database defaults to "default".
+	Database string
+	Username string
+	Password string
+	Client   *http.Client
+}
+
+type Store struct {
+	cfg    Config
+	client *http.Client
+}
+
+var _ store.Store = (*Store)(nil)
+
+func New(cfg Config) *Store {
+	if cfg.Database == "" {
+		cfg.Database = "default"
+	}
+	client := cfg.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &Store{cfg: cfg, client: client}
+}
+
+// Open verifies ClickHouse is reachable before returning the store.
+func Open(ctx context.Context, cfg Config) (*Store, error) {
+	s := New(cfg)
+	if err := s.Ping(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) Close() {}
+
+func (s *Store) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(s.cfg.URL, "/")+"/ping", nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return fmt.Errorf("clickhouse ping: %w", err)
+	}
+	res.Body.Close()
+	return nil
+}
+
+// exec runs query with body as its input data. settings are passed as
+// ClickHouse query settings.
+func (s *Store) exec(ctx context.Context, query string, body io.Reader, settings url.Values) (*http.Response, error) {
+	q := url.Values{"database": {s.cfg.Database}, "query": {query}}
+	for k, v := range settings {
+		q[k] = v
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(s.cfg.URL, "/")+"/?"+q.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	return s.do(req)
+}
+
+func (s *Store) do(req *http.Request) (*http.Response, error) {
+	if s.cfg.Username != "" {
+		req.Header.Set("X-ClickHouse-User", s.cfg.Username)
+		req.Header.Set("X-ClickHouse-Key", s.cfg.Password)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, fmt.Errorf("unexpected status %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return res, nil
+}
+
+// rollups are the materialized aggregates kept next to the raw readings,
+// by table suffix and the function truncating timestamps to the bucket.
+var rollups = []struct{ name, trunc string }{
+	{"hourly", "toStartOfHour"},
+	{"daily", "toStartOfDay"},
+}
+
+// Migrate creates the readings table and the materialized rollups if they
+// don't exist yet. Dashboards over long ranges should query the
+// readings_hourly and readings_daily tables with the -Merge combinators
+// instead of scanning raw readings.
+func (s *Store) Migrate(ctx context.Context) error {
+	stmts := []string{`
+		CREATE TABLE IF NOT EXISTS readings (
+			timestamp DateTime DEFAULT now(),
+			temp_co Float64,
+			temp_room Float64,
+			humidity Float64
+		) ENGINE = MergeTree
+		PARTITION BY toYYYYMM(timestamp)
+		ORDER BY timestamp`,
+	}
+	for _, r := range rollups {
+		stmts = append(stmts, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS readings_%s (
+			bucket DateTime,
+			count AggregateFunction(count),
+			temp_co_avg AggregateFunction(avg, Float64),
+			temp_co_min AggregateFunction(min, Float64),
+			temp_co_max AggregateFunction(max, Float64),
+			temp_room_avg AggregateFunction(avg, Float64),
+			temp_room_min AggregateFunction(min, Float64),
+			temp_room_max AggregateFunction(max, Float64),
+			humidity_avg AggregateFunction(avg, Float64),
+			humidity_min AggregateFunction(min, Float64),
+			humidity_max AggregateFunction(max, Float64)
+		) ENGINE = AggregatingMergeTree
+		ORDER BY bucket`, r.name), fmt.Sprintf(`
+		CREATE MATERIALIZED VIEW IF NOT EXISTS readings_%[1]s_mv TO readings_%[1]s AS
+		SELECT
+			%[2]s(timestamp) AS bucket,
+			countState() AS count,
+			avgState(temp_co) AS temp_co_avg,
+			minState(temp_co) AS temp_co_min,
+			maxState(temp_co) AS temp_co_max,
+			avgState(temp_room) AS temp_room_avg,
+			minState(temp_room) AS temp_room_min,
+			maxState(temp_room) AS temp_room_max,
+			avgState(humidity) AS humidity_avg,
+			minState(humidity) AS humidity_min,
+			maxState(humidity) AS humidity_max
+		FROM readings
+		GROUP BY bucket`, r.name, r.trunc))
+	}
+	for _, stmt := range stmts {
+		res, err := s.exec(ctx, stmt, nil, nil)
+		if err != nil {
+			return fmt.Errorf("clickhouse migrate: %w", err)
+		}
+		res.Body.Close()
+	}
+	return nil
+}
+
+type row struct {
+	Timestamp *int64  `json:"timestamp,omitempty"`
+	TempCo    float64 `json:"temp_co"`
+	TempRoom  float64 `json:"temp_room"`
+	Humidity  float64 `json:"humidity"`
+}
+
+// InsertReading uses an asynchronous insert so ClickHouse batches the many
+// single-reading requests server side instead of creating a part for each.
+func (s *Store) InsertReading(ctx context.Context, r store.TemperatureReading) (store.TemperatureReading, error) {
+	settings := url.Values{"async_insert": {"1"}, "wait_for_async_insert": {"1"}}
+	if err := s.insert(ctx, []store.TemperatureReading{r}, settings); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// InsertReadings writes rs in one INSERT. Readings without a timestamp get
+// the server's time.
+func (s *Store) InsertReadings(ctx context.Context, rs []store.TemperatureReading) (int64, error) {
+	if len(rs) == 0 {
+		return 0, nil
+	}
+	if err := s.insert(ctx, rs, nil); err != nil {
+		return 0, err
+	}
+	return int64(len(rs)), nil
+}
+
+func (s *Store) insert(ctx context.Context, rs []store.TemperatureReading, settings url.Values) error {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, r := range rs {
+		if err := enc.Encode(row{Timestamp: r.Timestamp, TempCo: r.TempCo, TempRoom: r.TempRoom, Humidity: r.Humidity}); err != nil {
+			return err
+		}
+	}
+	res, err := s.exec(ctx, "INSERT INTO readings FORMAT JSONEachRow", &b, settings)
+	if err != nil {
+		return fmt.Errorf("clickhouse insert: %w", err)
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *Store) ListReadings(ctx context.Context, limit, offset int) ([]store.TemperatureReading, error) {
+	query := fmt.Sprintf(`
+		SELECT toUnixTimestamp(timestamp) AS ts, temp_co, temp_room, humidity
+		FROM readings
+		ORDER BY timestamp DESC
+		LIMIT %d OFFSET %d
+		FORMAT JSONEachRow`, limit, offset)
+	res, err := s.exec(ctx, query, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("clickhouse query: %w", err)
+	}
+	defer res.Body.Close()
+
+	readings := make([]store.TemperatureReading, 0)
+	dec := json.NewDecoder(res.Body)
+	for dec.More() {
+		var r struct {
+			Ts int64 `json:"ts"`
+			row
+		}
+		if err := dec.Decode(&r); err != nil {
+			return nil, fmt.Errorf("clickhouse query: %w", err)
+		}
+		readings = append(readings, store.TemperatureReading{TempCo: r.TempCo, TempRoom: r.TempRoom, Humidity: r.Humidity, Timestamp: &r.Ts})
+	}
+	return readings, nil
+}
@@ -0,0 +1,87 @@
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInsertReadings(t *testing.T) {
+	var queries []string
+	var body, user string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		queries = append(queries, r.URL.RawQuery)
+		body, user = string(b), r.Header.Get("X-ClickHouse-User")
+	}))
+	defer srv.Close()
+
+	s := New(Config{URL: srv.URL, Database: "heating", Username: "esp", Password: "pass"})
+	ts := int64(1761388101)
+	n, err := s.InsertReadings(context.Background(), []store.TemperatureReading{
+		{TempCo: 40.5, TempRoom: 21.5, Humidity: 50, Timestamp: &ts},
+		{TempCo: 41},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	assert.Equal(t, `{"timestamp":1761388101,"temp_co":40.5,"temp_room":21.5,"humidity":50}`+"\n"+`{"temp_co":41,"temp_room":0,"humidity":0}`+"\n", body)
+	assert.Equal(t, "database=heating&query=INSERT+INTO+readings+FORMAT+JSONEachRow", queries[0])
+	assert.Equal(t, "esp", user)
+
+	_, err = s.InsertReading(context.Background(), store.TemperatureReading{TempCo: 42})
+	require.NoError(t, err)
+	assert.Contains(t, queries[1], "async_insert=1")
+	assert.Contains(t, queries[1], "wait_for_async_insert=1")
+}
+
+func TestListReadings(t *testing.T) {
+	var query string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			query = r.URL.Query().Get("query")
+			fmt.Fprint(w, `{"ts":1761388161,"temp_co":41,"temp_room":21.1,"humidity":50.5}`+"\n"+
+				`{"ts":1761388101,"temp_co":40,"temp_room":21,"humidity":50}`+"\n")
+		case "/ping":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "not ready")
+		}
+	}))
+	defer srv.Close()
+
+	s := New(Config{URL: srv.URL})
+	readings, err := s.ListReadings(context.Background(), 10, 5)
+	require.NoError(t, err)
+	ts1, ts2 := int64(1761388161), int64(1761388101)
+	assert.Equal(t, []store.TemperatureReading{
+		{TempCo: 41, TempRoom: 21.1, Humidity: 50.5, Timestamp: &ts1},
+		{TempCo: 40, TempRoom: 21, Humidity: 50, Timestamp: &ts2},
+	}, readings)
+	assert.Contains(t, query, "LIMIT 10 OFFSET 5")
+
+	err = s.Ping(context.Background())
+	assert.ErrorContains(t, err, "not ready")
+}
+
+func TestMigrate(t *testing.T) {
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("query"))
+	}))
+	defer srv.Close()
+
+	require.NoError(t, New(Config{URL: srv.URL}).Migrate(context.Background()))
+	require.Len(t, queries, 5)
+	assert.Contains(t, queries[0], "CREATE TABLE IF NOT EXISTS readings (")
+	assert.Contains(t, queries[2], "CREATE MATERIALIZED VIEW IF NOT EXISTS readings_hourly_mv TO readings_hourly")
+	assert.Contains(t, queries[2], "toStartOfHour(timestamp) AS bucket")
+	assert.True(t, strings.HasPrefix(strings.TrimSpace(queries[3]), "CREATE TABLE IF NOT EXISTS readings_daily"))
+}
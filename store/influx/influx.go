@@ -0,0 +1,227 @@
+// Package influx implements store.Store on top of an InfluxDB 2.x bucket,
+// for users who already keep their home metrics in Influx.
+//
+// Influx has no row ids, so readings are returned with Id 0. Sync and
+// alerting aren't supported.
+package influx
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+type Config struct {
+	// URL is the InfluxDB base URL, e.g. http://influx:8086.
+	URL    string
+	Token  string
+	Org    string
+	Bucket string
+	// Measurement defaults to "readings".
+	Measurement string
+	Client      *http.Client
+}
+
+type Store struct {
+	cfg    Config
+	client *http.Client
+}
+
+var _ store.Store = (*Store)(nil)
+
+func New(cfg Config) *Store {
+	if cfg.Measurement == "" {
+		cfg.Measurement = "readings"
+	}
+	client := cfg.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &Store{cfg: cfg, client: client}
+}
+
+// Open verifies InfluxDB is reachable before returning the store.
+func Open(ctx context.Context, cfg Config) (*Store, error) {
+	s := New(cfg)
+	if err := s.Ping(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) Close() {}
+
+func (s *Store) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Token "+s.cfg.Token)
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		var msg struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(res.Body, 4096)).Decode(&msg)
+		return nil, fmt.Errorf("unexpected status %s: %s", res.Status, msg.Message)
+	}
+	return res, nil
+}
+
+func (s *Store) endpoint(path string, q url.Values) string {
+	return strings.TrimRight(s.cfg.URL, "/") + path + "?" + q.Encode()
+}
+
+func (s *Store) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(s.cfg.URL, "/")+"/health", nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req)
+	if err != nil {
+		return fmt.Errorf("influx ping: %w", err)
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s *Store) InsertReading(ctx context.Context, r store.TemperatureReading) (store.TemperatureReading, error) {
+	_, err := s.InsertReadings(ctx, []store.TemperatureReading{r})
+	return r, err
+}
+
+// InsertReadings writes rs as line protocol with second precision. Readings
+// without a timestamp get the server's time.
+func (s *Store) InsertReadings(ctx context.Context, rs []store.TemperatureReading) (int64, error) {
+	measurement := strings.NewReplacer(",", `\,`, " ", `\ `).Replace(s.cfg.Measurement)
+	var b strings.Builder
+	for _, r := range rs {
+		fmt.Fprintf(&b, "%s temp_co=%s,temp_room=%s,humidity=%s",
+			measurement,
+			strconv.FormatFloat(r.TempCo, 'f', -1, 64),
+			strconv.FormatFloat(r.TempRoom, 'f', -1, 64),
+			strconv.FormatFloat(r.Humidity, 'f', -1, 64),
+		)
+		if r.Timestamp != nil {
+			fmt.Fprintf(&b, " %d", *r.Timestamp)
+		}
+		b.WriteByte('\n')
+	}
+
+	q := url.Values{"org": {s.cfg.Org}, "bucket": {s.cfg.Bucket}, "precision": {"s"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint("/api/v2/write", q), strings.NewReader(b.String()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	res, err := s.do(req)
+	if err != nil {
+		return 0, fmt.Errorf("influx write: %w", err)
+	}
+	res.Body.Close()
+	return int64(len(rs)), nil
+}
+
+// fluxString quotes s as a Flux string literal.
+func fluxString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "${", `\${`).Replace(s) + `"`
+}
+
+func (s *Store) ListReadings(ctx context.Context, limit, offset int) ([]store.TemperatureReading, error) {
+	query := fmt.Sprintf(`from(bucket: %s)
+  |> range(start: 0)
+  |> filter(fn: (r) => r._measurement == %s)
+  |> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+  |> group()
+  |> sort(columns: ["_time"], desc: true)
+  |> limit(n: %d, offset: %d)`,
+		fluxString(s.cfg.Bucket), fluxString(s.cfg.Measurement), limit, offset)
+
+	body, err := json.Marshal(map[string]any{
+		"query":   query,
+		"type":    "flux",
+		"dialect": map[string]any{"header": true, "annotations": []string{}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint("/api/v2/query", url.Values{"org": {s.cfg.Org}}), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/csv")
+	res, err := s.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("influx query: %w", err)
+	}
+	defer res.Body.Close()
+
+	readings, err := parseReadings(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("influx query: %w", err)
+	}
+	return readings, nil
+}
+
+// parseReadings reads the pivoted query result. An empty result has no
+// header at all.
+func parseReadings(r io.Reader) ([]store.TemperatureReading, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	readings := make([]store.TemperatureReading, 0)
+	var col map[string]int
+	for {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return readings, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if col == nil {
+			col = make(map[string]int, len(rec))
+			for i, name := range rec {
+				col[name] = i
+			}
+			if _, ok := col["_time"]; !ok {
+				return nil, errors.New("result has no _time column")
+			}
+			continue
+		}
+		// every table repeats the header
+		if rec[col["_time"]] == "_time" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339Nano, rec[col["_time"]])
+		if err != nil {
+			return nil, fmt.Errorf("parse _time: %w", err)
+		}
+		ts := t.Unix()
+		tr := store.TemperatureReading{Timestamp: &ts}
+		for field, dst := range map[string]*float64{"temp_co": &tr.TempCo, "temp_room": &tr.TempRoom, "humidity": &tr.Humidity} {
+			i, ok := col[field]
+			if !ok || i >= len(rec) || rec[i] == "" {
+				continue
+			}
+			if *dst, err = strconv.ParseFloat(rec[i], 64); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", field, err)
+			}
+		}
+		readings = append(readings, tr)
+	}
+}
@@ -0,0 +1,77 @@
+package influx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInsertReadings(t *testing.T) {
+	var body, query, auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body, query, auth = string(b), r.URL.RawQuery, r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	s := New(Config{URL: srv.URL, Token: "tok", Org: "home", Bucket: "heating"})
+	ts := int64(1761388101)
+	n, err := s.InsertReadings(context.Background(), []store.TemperatureReading{
+		{TempCo: 40.5, TempRoom: 21.5, Humidity: 50, Timestamp: &ts},
+		{TempCo: 41},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	assert.Equal(t, "readings temp_co=40.5,temp_room=21.5,humidity=50 1761388101\nreadings temp_co=41,temp_room=0,humidity=0\n", body)
+	assert.Equal(t, "bucket=heating&org=home&precision=s", query)
+	assert.Equal(t, "Token tok", auth)
+}
+
+func TestListReadings(t *testing.T) {
+	var flux string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/query":
+			var q struct {
+				Query string `json:"query"`
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&q))
+			flux = q.Query
+			fmt.Fprint(w, ",result,table,_start,_stop,_time,_measurement,humidity,temp_co,temp_room\r\n"+
+				",_result,0,1970-01-01T00:00:00Z,2025-10-25T10:00:00Z,2025-10-25T10:29:21Z,readings,50.5,41,21.1\r\n"+
+				",_result,0,1970-01-01T00:00:00Z,2025-10-25T10:00:00Z,2025-10-25T10:28:21Z,readings,50,40,21\r\n\r\n")
+		case "/health":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"message": "not ready"}`)
+		}
+	}))
+	defer srv.Close()
+
+	s := New(Config{URL: srv.URL, Org: "home", Bucket: `heat"ing`})
+	readings, err := s.ListReadings(context.Background(), 10, 5)
+	require.NoError(t, err)
+	require.Len(t, readings, 2)
+	assert.Equal(t, 41.0, readings[0].TempCo)
+	assert.Equal(t, 50.5, readings[0].Humidity)
+	assert.Equal(t, int64(1761388161), *readings[0].Timestamp)
+	assert.Equal(t, int64(1761388101), *readings[1].Timestamp)
+	assert.Contains(t, flux, `from(bucket: "heat\"ing")`)
+	assert.Contains(t, flux, "limit(n: 10, offset: 5)")
+
+	assert.ErrorContains(t, s.Ping(context.Background()), "not ready")
+}
+
+func TestParseReadingsEmpty(t *testing.T) {
+	readings, err := parseReadings(http.NoBody)
+	require.NoError(t, err)
+	assert.Empty(t, readings)
+}
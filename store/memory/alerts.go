@@ -0,0 +1,219 @@
+package memory
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sort"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.AlertStore = (*Store)(nil)
+
+func (s *Store) ListAlertRules(ctx context.Context) ([]store.AlertRule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append(make([]store.AlertRule, 0, len(s.alertRules)), s.alertRules...), nil
+}
+
+// ruleIndex must be called with mu held.
+func (s *Store) ruleIndex(id int) int {
+	return slices.IndexFunc(s.alertRules, func(r store.AlertRule) bool { return r.Id == id })
+}
+
+func (s *Store) GetAlertRule(ctx context.Context, id int) (store.AlertRule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := s.ruleIndex(id)
+	if i < 0 {
+		return store.AlertRule{}, store.ErrNotFound
+	}
+	return s.alertRules[i], nil
+}
+
+func (s *Store) CreateAlertRule(ctx context.Context, r store.AlertRule) (store.AlertRule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r.Id = s.nextRuleID
+	s.nextRuleID++
+	r.Escalation = slices.Clone(r.Escalation)
+	r.Templates = maps.Clone(r.Templates)
+	s.alertRules = append(s.alertRules, r)
+	return r, nil
+}
+
+func (s *Store) UpdateAlertRule(ctx context.Context, r store.AlertRule) (store.AlertRule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.ruleIndex(r.Id)
+	if i < 0 {
+		return store.AlertRule{}, store.ErrNotFound
+	}
+	r.Escalation = slices.Clone(r.Escalation)
+	r.Templates = maps.Clone(r.Templates)
+	s.alertRules[i] = r
+	return r, nil
+}
+
+func (s *Store) DeleteAlertRule(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.ruleIndex(id)
+	if i < 0 {
+		return store.ErrNotFound
+	}
+	s.alertRules = slices.Delete(s.alertRules, i, i+1)
+	delete(s.firing, id)
+	return nil
+}
+
+func (s *Store) ListFiringAlerts(ctx context.Context) ([]store.Alert, error) {
+	s.mu.RLock()
+	alerts := make([]store.Alert, 0, len(s.firing))
+	for _, a := range s.firing {
+		i := s.ruleIndex(a.RuleId)
+		a.RuleName, a.Severity = s.alertRules[i].Name, s.alertRules[i].Severity
+		alerts = append(alerts, a)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Since != alerts[j].Since {
+			return alerts[i].Since > alerts[j].Since
+		}
+		return alerts[i].RuleId < alerts[j].RuleId
+	})
+	return alerts, nil
+}
+
+func (s *Store) FireAlert(ctx context.Context, a store.Alert) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.ruleIndex(a.RuleId)
+	if i < 0 {
+		return nil
+	}
+	if _, ok := s.firing[a.RuleId]; ok {
+		return nil
+	}
+	if s.firing == nil {
+		s.firing = make(map[int]store.Alert)
+	}
+	s.firing[a.RuleId] = a
+	s.recordAlertEvent(s.alertRules[i], store.AlertFiring, a.Value, a.Since)
+	return nil
+}
+
+func (s *Store) ResolveAlert(ctx context.Context, ruleId int, value float64, timestamp int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.firing[ruleId]; !ok {
+		return nil
+	}
+	delete(s.firing, ruleId)
+	s.recordAlertEvent(s.alertRules[s.ruleIndex(ruleId)], store.AlertResolved, value, timestamp)
+	return nil
+}
+
+// recordAlertEvent must be called with mu held.
+func (s *Store) recordAlertEvent(r store.AlertRule, state string, value float64, timestamp int64) {
+	s.alertHistory = append(s.alertHistory, store.AlertEvent{
+		Id:        int64(len(s.alertHistory) + 1),
+		RuleId:    r.Id,
+		RuleName:  r.Name,
+		State:     state,
+		Value:     value,
+		Timestamp: timestamp,
+	})
+}
+
+func (s *Store) AckAlert(ctx context.Context, token string, now int64) (store.Alert, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, a := range s.firing {
+		if token == "" || a.AckToken != token {
+			continue
+		}
+		rule := s.alertRules[s.ruleIndex(id)]
+		a.RuleName, a.Severity = rule.Name, rule.Severity
+		if a.AckedAt != nil {
+			return a, nil
+		}
+		a.AckedAt = &now
+		s.firing[id] = a
+		s.recordAlertEvent(rule, store.AlertAcknowledged, a.Value, now)
+		return a, nil
+	}
+	return store.Alert{}, store.ErrNotFound
+}
+
+func (s *Store) SetAlertNotified(ctx context.Context, ruleId int, notified int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a, ok := s.firing[ruleId]; ok {
+		a.Notified = notified
+		s.firing[ruleId] = a
+	}
+	return nil
+}
+
+func (s *Store) ListAlertHistory(ctx context.Context, f store.AlertHistoryFilter) ([]store.AlertEvent, error) {
+	s.mu.RLock()
+	var matched []store.AlertEvent
+	for _, e := range s.alertHistory {
+		if (f.RuleId != 0 && e.RuleId != f.RuleId) ||
+			(f.State != "" && e.State != f.State) ||
+			(f.From != 0 && e.Timestamp < f.From) ||
+			(f.To != 0 && e.Timestamp > f.To) {
+			continue
+		}
+		matched = append(matched, e)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].Timestamp != matched[j].Timestamp {
+			return matched[i].Timestamp > matched[j].Timestamp
+		}
+		return matched[i].Id > matched[j].Id
+	})
+
+	events := make([]store.AlertEvent, 0)
+	if f.Offset >= len(matched) {
+		return events, nil
+	}
+	end := min(f.Offset+f.Limit, len(matched))
+	return append(events, matched[f.Offset:end]...), nil
+}
+
+func (s *Store) CreateSilence(ctx context.Context, silence store.Silence) (store.Silence, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	silence.Id = s.nextSilenceID
+	s.nextSilenceID++
+	silence.Matchers = slices.Clone(silence.Matchers)
+	s.silences = append(s.silences, silence)
+	return silence, nil
+}
+
+func (s *Store) ListActiveSilences(ctx context.Context, now int64) ([]store.Silence, error) {
+	s.mu.Lock()
+	s.silences = slices.DeleteFunc(s.silences, func(silence store.Silence) bool { return silence.EndsAt <= now })
+	active := slices.Clone(s.silences)
+	s.mu.Unlock()
+
+	sort.SliceStable(active, func(i, j int) bool { return active[i].EndsAt < active[j].EndsAt })
+	return append(make([]store.Silence, 0, len(active)), active...), nil
+}
+
+func (s *Store) ExpireSilence(ctx context.Context, id int, now int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.silences, func(silence store.Silence) bool { return silence.Id == id && silence.EndsAt > now })
+	if i < 0 {
+		return store.ErrNotFound
+	}
+	s.silences = slices.Delete(s.silences, i, i+1)
+	return nil
+}
@@ -0,0 +1,47 @@
+package memory
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.APIKeyStore = (*Store)(nil)
+
+func (s *Store) ListAPIKeys(ctx context.Context) ([]store.APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]store.APIKey, 0, len(s.apiKeys))
+	for _, k := range s.apiKeys {
+		k.Scopes = slices.Clone(k.Scopes)
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (s *Store) CreateAPIKey(ctx context.Context, k store.APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, found := slices.BinarySearchFunc(s.apiKeys, k.Name, func(k store.APIKey, name string) int {
+		return strings.Compare(k.Name, name)
+	})
+	if found {
+		return store.ErrExists
+	}
+	k.Scopes = slices.Clone(k.Scopes)
+	s.apiKeys = slices.Insert(s.apiKeys, i, k)
+	return nil
+}
+
+func (s *Store) DeleteAPIKey(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.apiKeys, func(k store.APIKey) bool { return k.Name == name })
+	if i < 0 {
+		return store.ErrNotFound
+	}
+	s.apiKeys = slices.Delete(s.apiKeys, i, i+1)
+	return nil
+}
@@ -0,0 +1,195 @@
+package memory
+
+import (
+	"context"
+	"slices"
+	"sort"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var (
+	_ store.ZoneStore    = (*Store)(nil)
+	_ store.CommandStore = (*Store)(nil)
+)
+
+func (s *Store) ListZones(ctx context.Context) ([]store.Zone, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append(make([]store.Zone, 0, len(s.zones)), s.zones...), nil
+}
+
+// zoneIndex must be called with mu held.
+func (s *Store) zoneIndex(id int) int {
+	return slices.IndexFunc(s.zones, func(z store.Zone) bool { return z.Id == id })
+}
+
+func (s *Store) GetZone(ctx context.Context, id int) (store.Zone, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := s.zoneIndex(id)
+	if i < 0 {
+		return store.Zone{}, store.ErrNotFound
+	}
+	return s.zones[i], nil
+}
+
+func (s *Store) CreateZone(ctx context.Context, z store.Zone) (store.Zone, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z.Id = s.nextZoneID
+	s.nextZoneID++
+	z.Override, z.OverrideUntil, z.Relay, z.ChangedAt = nil, 0, nil, 0
+	s.zones = append(s.zones, z)
+	return z, nil
+}
+
+func (s *Store) UpdateZone(ctx context.Context, z store.Zone) (store.Zone, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.zoneIndex(z.Id)
+	if i < 0 {
+		return store.Zone{}, store.ErrNotFound
+	}
+	prev := s.zones[i]
+	z.Override, z.OverrideUntil, z.Relay, z.ChangedAt = prev.Override, prev.OverrideUntil, prev.Relay, prev.ChangedAt
+	s.zones[i] = z
+	return z, nil
+}
+
+func (s *Store) DeleteZone(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.zoneIndex(id)
+	if i < 0 {
+		return store.ErrNotFound
+	}
+	s.zones = slices.Delete(s.zones, i, i+1)
+	return nil
+}
+
+func (s *Store) SetZoneRelay(ctx context.Context, e store.ZoneEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.zoneIndex(e.ZoneId)
+	if i < 0 {
+		return store.ErrNotFound
+	}
+	on := e.State == "on"
+	s.zones[i].Relay, s.zones[i].ChangedAt = &on, e.Timestamp
+	e.Kind = store.ZoneEventRelay
+	s.recordZoneEvent(e)
+	return nil
+}
+
+func (s *Store) SetZoneOverride(ctx context.Context, id int, override *bool, until, now int64) (store.Zone, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.zoneIndex(id)
+	if i < 0 {
+		return store.Zone{}, store.ErrNotFound
+	}
+	z := &s.zones[i]
+	state := "auto"
+	if override != nil {
+		v := *override
+		override, state = &v, "off"
+		if v {
+			state = "on"
+		}
+	} else {
+		until = 0
+	}
+	z.Override, z.OverrideUntil = override, until
+	s.recordZoneEvent(store.ZoneEvent{ZoneId: id, Kind: store.ZoneEventOverride, State: state, Target: z.Target, Timestamp: now})
+	return *z, nil
+}
+
+// recordZoneEvent must be called with mu held.
+func (s *Store) recordZoneEvent(e store.ZoneEvent) {
+	e.Id = int64(len(s.zoneHistory) + 1)
+	s.zoneHistory = append(s.zoneHistory, e)
+}
+
+func (s *Store) ListZoneHistory(ctx context.Context, id int, limit, offset int) ([]store.ZoneEvent, error) {
+	s.mu.RLock()
+	var matched []store.ZoneEvent
+	for _, e := range s.zoneHistory {
+		if e.ZoneId == id {
+			matched = append(matched, e)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].Timestamp != matched[j].Timestamp {
+			return matched[i].Timestamp > matched[j].Timestamp
+		}
+		return matched[i].Id > matched[j].Id
+	})
+
+	events := make([]store.ZoneEvent, 0)
+	if offset >= len(matched) {
+		return events, nil
+	}
+	end := min(offset+limit, len(matched))
+	return append(events, matched[offset:end]...), nil
+}
+
+func (s *Store) GetAwayMode(ctx context.Context) (*store.AwayMode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.away == nil {
+		return nil, nil
+	}
+	m := *s.away
+	return &m, nil
+}
+
+func (s *Store) SetAwayMode(ctx context.Context, m *store.AwayMode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m != nil {
+		v := *m
+		m = &v
+	}
+	s.away = m
+	return nil
+}
+
+func (s *Store) EnqueueCommand(ctx context.Context, c store.Command) (store.Command, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands = slices.DeleteFunc(s.commands, func(p store.Command) bool {
+		return p.Device == c.Device && p.Type == c.Type && p.AckedAt == nil
+	})
+	c.Id, c.AckedAt = s.nextCommandID, nil
+	s.nextCommandID++
+	s.commands = append(s.commands, c)
+	return c, nil
+}
+
+func (s *Store) PendingCommands(ctx context.Context, device string) ([]store.Command, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pending := make([]store.Command, 0)
+	for _, c := range s.commands {
+		if c.Device == device && c.AckedAt == nil {
+			pending = append(pending, c)
+		}
+	}
+	return pending, nil
+}
+
+func (s *Store) AckCommand(ctx context.Context, device string, id int64, now int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.commands, func(c store.Command) bool {
+		return c.Id == id && c.Device == device && c.AckedAt == nil
+	})
+	if i < 0 {
+		return store.ErrNotFound
+	}
+	s.commands[i].AckedAt = &now
+	return nil
+}
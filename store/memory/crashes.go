@@ -0,0 +1,46 @@
+package memory
+
+import (
+	"context"
+	"slices"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.CrashStore = (*Store)(nil)
+
+func (s *Store) AddCrashReport(ctx context.Context, c store.CrashReport) (store.CrashReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextCrashID++
+	c.Id = s.nextCrashID
+	s.crashes = append(s.crashes, c)
+	return c, nil
+}
+
+func (s *Store) ListCrashReports(ctx context.Context, device string, limit int) ([]store.CrashReport, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	reports := make([]store.CrashReport, 0)
+	for _, c := range slices.Backward(s.crashes) {
+		if len(reports) == limit {
+			break
+		}
+		if c.Device == device {
+			reports = append(reports, c)
+		}
+	}
+	return reports, nil
+}
+
+func (s *Store) CountCrashReports(ctx context.Context, device string, since int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, c := range s.crashes {
+		if c.Device == device && c.At >= since {
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,66 @@
+package memory
+
+import (
+	"context"
+	"slices"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.DeadLetterStore = (*Store)(nil)
+
+func (s *Store) AddDeadLetter(ctx context.Context, d store.DeadLetter) (store.DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextDeadLetterID++
+	d.Id = s.nextDeadLetterID
+	s.deadLetters = append(s.deadLetters, d)
+	return d, nil
+}
+
+func (s *Store) ListDeadLetters(ctx context.Context, limit int) ([]store.DeadLetter, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	letters := make([]store.DeadLetter, 0, min(limit, len(s.deadLetters)))
+	for _, d := range slices.Backward(s.deadLetters) {
+		if len(letters) == limit {
+			break
+		}
+		letters = append(letters, d)
+	}
+	return letters, nil
+}
+
+func (s *Store) GetDeadLetter(ctx context.Context, id int) (store.DeadLetter, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := slices.IndexFunc(s.deadLetters, func(d store.DeadLetter) bool { return d.Id == id })
+	if i < 0 {
+		return store.DeadLetter{}, store.ErrNotFound
+	}
+	return s.deadLetters[i], nil
+}
+
+func (s *Store) UpdateDeadLetter(ctx context.Context, d store.DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.deadLetters, func(stored store.DeadLetter) bool { return stored.Id == d.Id })
+	if i < 0 {
+		return store.ErrNotFound
+	}
+	s.deadLetters[i].Error = d.Error
+	s.deadLetters[i].Attempts = d.Attempts
+	s.deadLetters[i].FailedAt = d.FailedAt
+	return nil
+}
+
+func (s *Store) DeleteDeadLetter(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.deadLetters, func(d store.DeadLetter) bool { return d.Id == id })
+	if i < 0 {
+		return store.ErrNotFound
+	}
+	s.deadLetters = slices.Delete(s.deadLetters, i, i+1)
+	return nil
+}
@@ -0,0 +1,49 @@
+package memory
+
+import (
+	"context"
+	"maps"
+	"slices"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.FeatureStore = (*Store)(nil)
+
+func (s *Store) FeatureFlags(ctx context.Context) (map[string]bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	flags := maps.Clone(s.features)
+	if flags == nil {
+		flags = make(map[string]bool)
+	}
+	return flags, nil
+}
+
+func (s *Store) SetFeatureFlags(ctx context.Context, changes []store.FeatureChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.features == nil {
+		s.features = make(map[string]bool)
+	}
+	for _, c := range changes {
+		s.features[c.Name] = c.Value
+		s.nextFeatureChangeID++
+		c.Id = s.nextFeatureChangeID
+		s.featureChanges = append(s.featureChanges, c)
+	}
+	return nil
+}
+
+func (s *Store) ListFeatureChanges(ctx context.Context, limit int) ([]store.FeatureChange, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	changes := make([]store.FeatureChange, 0, min(limit, len(s.featureChanges)))
+	for _, c := range slices.Backward(s.featureChanges) {
+		if len(changes) == limit {
+			break
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
@@ -0,0 +1,34 @@
+package memory
+
+import (
+	"context"
+	"maps"
+	"slices"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.FirmwareStore = (*Store)(nil)
+
+func (s *Store) SetDeviceFirmware(ctx context.Context, device, version string, at int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.firmware == nil {
+		s.firmware = make(map[string]store.DeviceFirmware)
+	}
+	if f, ok := s.firmware[device]; ok && f.Version == version {
+		return nil
+	}
+	s.firmware[device] = store.DeviceFirmware{Device: device, Version: version, Since: at}
+	return nil
+}
+
+func (s *Store) DeviceFirmware(ctx context.Context) ([]store.DeviceFirmware, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	firmware := make([]store.DeviceFirmware, 0, len(s.firmware))
+	for _, device := range slices.Sorted(maps.Keys(s.firmware)) {
+		firmware = append(firmware, s.firmware[device])
+	}
+	return firmware, nil
+}
@@ -0,0 +1,53 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.ImportStore = (*Store)(nil)
+
+func (s *Store) ImportReadings(ctx context.Context, device string, readings []store.ImportReading, conflict string) (store.ImportResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().Unix()
+	var result store.ImportResult
+	for _, ir := range readings {
+		storedAt := now
+		if ir.StoredAt != nil {
+			storedAt = *ir.StoredAt
+		}
+		matched, won := false, false
+		for i, r := range s.readings {
+			if r.Device != device || *r.Timestamp != *ir.Timestamp {
+				continue
+			}
+			matched = true
+			if conflict == store.ConflictSkip || (conflict == store.ConflictKeepNewer && storedAt <= s.storedAt[r.Id]) {
+				continue
+			}
+			ts := *ir.Timestamp
+			received := now
+			s.readings[i].TempCo, s.readings[i].TempRoom, s.readings[i].Humidity, s.readings[i].Timestamp = ir.TempCo, ir.TempRoom, ir.Humidity, &ts
+			s.readings[i].ReceivedAt = &received
+			s.storedAt[r.Id] = storedAt
+			won = true
+		}
+		switch {
+		case !matched:
+			r := ir.TemperatureReading
+			r.Device = device
+			r.ReceivedAt = &now
+			s.storedAt[s.insert(r).Id] = storedAt
+			result.Inserted++
+		case won:
+			result.Overwritten++
+		default:
+			result.Skipped++
+		}
+	}
+	return result, nil
+}
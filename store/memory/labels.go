@@ -0,0 +1,34 @@
+package memory
+
+import (
+	"context"
+	"maps"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.LabelStore = (*Store)(nil)
+
+func (s *Store) DeviceLabels(ctx context.Context) (map[string]map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	labels := make(map[string]map[string]string, len(s.labels))
+	for device, l := range s.labels {
+		labels[device] = maps.Clone(l)
+	}
+	return labels, nil
+}
+
+func (s *Store) SetDeviceLabels(ctx context.Context, device string, labels map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(labels) == 0 {
+		delete(s.labels, device)
+		return nil
+	}
+	if s.labels == nil {
+		s.labels = make(map[string]map[string]string)
+	}
+	s.labels[device] = maps.Clone(labels)
+	return nil
+}
@@ -0,0 +1,97 @@
+package memory
+
+import (
+	"context"
+	"slices"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.LocationStore = (*Store)(nil)
+
+func cloneLocation(l store.Location) store.Location {
+	if l.ParentId != nil {
+		parent := *l.ParentId
+		l.ParentId = &parent
+	}
+	l.Devices = append(make([]string, 0, len(l.Devices)), l.Devices...)
+	return l
+}
+
+func (s *Store) ListLocations(ctx context.Context) ([]store.Location, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	locations := make([]store.Location, 0, len(s.locations))
+	for _, l := range s.locations {
+		locations = append(locations, cloneLocation(l))
+	}
+	return locations, nil
+}
+
+// locationIndex must be called with mu held.
+func (s *Store) locationIndex(id int) int {
+	return slices.IndexFunc(s.locations, func(l store.Location) bool { return l.Id == id })
+}
+
+func (s *Store) GetLocation(ctx context.Context, id int) (store.Location, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := s.locationIndex(id)
+	if i < 0 {
+		return store.Location{}, store.ErrNotFound
+	}
+	return cloneLocation(s.locations[i]), nil
+}
+
+// unplaceDevices removes devices from every location but the one with id.
+// It must be called with mu held.
+func (s *Store) unplaceDevices(id int, devices []string) {
+	for i := range s.locations {
+		if s.locations[i].Id == id {
+			continue
+		}
+		s.locations[i].Devices = slices.DeleteFunc(s.locations[i].Devices, func(d string) bool {
+			return slices.Contains(devices, d)
+		})
+	}
+}
+
+func (s *Store) CreateLocation(ctx context.Context, l store.Location) (store.Location, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l = cloneLocation(l)
+	l.Id = s.nextLocationID
+	s.nextLocationID++
+	s.unplaceDevices(l.Id, l.Devices)
+	s.locations = append(s.locations, l)
+	return cloneLocation(l), nil
+}
+
+func (s *Store) UpdateLocation(ctx context.Context, l store.Location) (store.Location, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.locationIndex(l.Id)
+	if i < 0 {
+		return store.Location{}, store.ErrNotFound
+	}
+	l = cloneLocation(l)
+	s.unplaceDevices(l.Id, l.Devices)
+	s.locations[i] = l
+	return cloneLocation(l), nil
+}
+
+func (s *Store) DeleteLocation(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.locationIndex(id)
+	if i < 0 {
+		return store.ErrNotFound
+	}
+	s.locations = slices.Delete(s.locations, i, i+1)
+	for i := range s.locations {
+		if p := s.locations[i].ParentId; p != nil && *p == id {
+			s.locations[i].ParentId = nil
+		}
+	}
+	return nil
+}
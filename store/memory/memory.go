@@ -0,0 +1,190 @@
+// Package memory implements store.Store in process memory. Data is lost on
+// restart; it is meant for tests and the demo mode.
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+type Store struct {
+	mu       sync.RWMutex
+	nextID   int
+	readings []store.TemperatureReading
+	// storedAt is when each reading was stored, by id, for imports keeping
+	// the newer reading.
+	storedAt map[int]int64
+	ackedSeq map[string]int64
+
+	nextRuleID   int
+	alertRules   []store.AlertRule
+	firing       map[int]store.Alert
+	alertHistory []store.AlertEvent
+
+	nextSilenceID int
+	silences      []store.Silence
+
+	nextZoneID  int
+	zones       []store.Zone
+	zoneHistory []store.ZoneEvent
+	away        *store.AwayMode
+
+	nextCommandID int64
+	commands      []store.Command
+
+	outdoor []store.OutdoorReading
+	labels  map[string]map[string]string
+
+	nextLocationID int
+	locations      []store.Location
+
+	// apiKeys are ordered by name.
+	apiKeys []store.APIKey
+
+	features            map[string]bool
+	nextFeatureChangeID int64
+	featureChanges      []store.FeatureChange
+
+	nextDeadLetterID int
+	deadLetters      []store.DeadLetter
+
+	firmware map[string]store.DeviceFirmware
+
+	nextCrashID int64
+	crashes     []store.CrashReport
+}
+
+var _ store.Store = (*Store)(nil)
+
+func New() *Store {
+	return &Store{nextID: 1, nextRuleID: 1, nextSilenceID: 1, nextZoneID: 1, nextCommandID: 1, nextLocationID: 1}
+}
+
+func (s *Store) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *Store) Close() {}
+
+func (s *Store) InsertReading(ctx context.Context, r store.TemperatureReading) (store.TemperatureReading, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insert(r), nil
+}
+
+func (s *Store) InsertReadings(ctx context.Context, rs []store.TemperatureReading) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range rs {
+		s.insert(r)
+	}
+	return int64(len(rs)), nil
+}
+
+// insert must be called with mu held.
+func (s *Store) insert(r store.TemperatureReading) store.TemperatureReading {
+	r.Id = s.nextID
+	s.nextID++
+	if r.Timestamp == nil {
+		var zero int64
+		r.Timestamp = &zero
+	} else {
+		ts := *r.Timestamp
+		r.Timestamp = &ts
+	}
+	if r.ReceivedAt != nil {
+		at := *r.ReceivedAt
+		r.ReceivedAt = &at
+	}
+	r.Quality = store.QualityOf(r)
+	s.readings = append(s.readings, r)
+	if s.storedAt == nil {
+		s.storedAt = make(map[int]int64)
+	}
+	s.storedAt[r.Id] = time.Now().Unix()
+	return r
+}
+
+func (s *Store) ListReadings(ctx context.Context, limit, offset int) ([]store.TemperatureReading, error) {
+	s.mu.RLock()
+	sorted := make([]store.TemperatureReading, len(s.readings))
+	copy(sorted, s.readings)
+	s.mu.RUnlock()
+
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		return *a.Timestamp > *b.Timestamp || *a.Timestamp == *b.Timestamp && a.Id > b.Id
+	})
+
+	readings := make([]store.TemperatureReading, 0)
+	if offset >= len(sorted) {
+		return readings, nil
+	}
+	end := min(offset+limit, len(sorted))
+	return append(readings, sorted[offset:end]...), nil
+}
+
+var _ store.SmoothingStore = (*Store)(nil)
+
+func (s *Store) ListSmoothedReadings(ctx context.Context, limit, offset int, half int64) ([]store.TemperatureReading, error) {
+	page, err := s.ListReadings(ctx, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i, r := range page {
+		if *r.Timestamp == 0 {
+			// stored without a timestamp
+			continue
+		}
+		var sum store.TemperatureReading
+		n := 0.0
+		for _, o := range s.readings {
+			if o.Device == r.Device && *o.Timestamp >= *r.Timestamp-half && *o.Timestamp <= *r.Timestamp+half {
+				sum.TempCo += o.TempCo
+				sum.TempRoom += o.TempRoom
+				sum.Humidity += o.Humidity
+				n++
+			}
+		}
+		page[i].TempCo, page[i].TempRoom, page[i].Humidity = sum.TempCo/n, sum.TempRoom/n, sum.Humidity/n
+	}
+	return page, nil
+}
+
+var _ store.FilterStore = (*Store)(nil)
+
+func (s *Store) ListFilteredReadings(ctx context.Context, q store.ReadingQuery, limit, offset int) ([]store.TemperatureReading, error) {
+	if q.After != nil && q.Order == store.OrderReceivedAt {
+		return nil, fmt.Errorf("a cursor needs order %q", store.OrderTimestamp)
+	}
+	s.mu.RLock()
+	n := len(s.readings)
+	s.mu.RUnlock()
+	all, err := s.ListReadings(ctx, n, 0)
+	if err != nil {
+		return nil, err
+	}
+	readings := make([]store.TemperatureReading, 0)
+	for _, r := range all {
+		if q.Matches(r) {
+			readings = append(readings, r)
+		}
+	}
+	if q.Order == store.OrderReceivedAt {
+		sort.SliceStable(readings, func(i, j int) bool {
+			a, b := readings[i].ReceivedAt, readings[j].ReceivedAt
+			return a != nil && (b == nil || *a > *b)
+		})
+	}
+	if offset >= len(readings) {
+		return readings[:0], nil
+	}
+	return readings[offset:min(offset+limit, len(readings))], nil
+}
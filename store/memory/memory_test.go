@@ -0,0 +1,614 @@
+package memory
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInsertAndListReadings(t *testing.T) {
+	s := New()
+
+	older, newer := int64(1761388101), int64(1761388161)
+	tr, err := s.InsertReading(context.Background(), store.TemperatureReading{TempCo: 25.5, TempRoom: 22.0, Humidity: 60.0, Timestamp: &older})
+	require.NoError(t, err)
+	assert.Equal(t, 1, tr.Id)
+
+	n, err := s.InsertReadings(context.Background(), []store.TemperatureReading{{TempCo: 26.0, TempRoom: 23.0, Humidity: 55.0, Timestamp: &newer}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	readings, err := s.ListReadings(context.Background(), 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 2)
+	assert.Equal(t, newer, *readings[0].Timestamp)
+	assert.Equal(t, older, *readings[1].Timestamp)
+
+	readings, err = s.ListReadings(context.Background(), 1, 1)
+	require.NoError(t, err)
+	require.Len(t, readings, 1)
+	assert.Equal(t, older, *readings[0].Timestamp)
+
+	readings, err = s.ListReadings(context.Background(), 10, 5)
+	require.NoError(t, err)
+	assert.Empty(t, readings)
+}
+
+func TestAlerts(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	rule, err := s.CreateAlertRule(ctx, store.AlertRule{Name: "humid", Field: "humidity", Op: "gt", Threshold: 80, Severity: "warning", Enabled: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, rule.Id)
+
+	rule.Threshold = 85
+	_, err = s.UpdateAlertRule(ctx, rule)
+	require.NoError(t, err)
+	got, err := s.GetAlertRule(ctx, rule.Id)
+	require.NoError(t, err)
+	assert.Equal(t, 85.0, got.Threshold)
+
+	_, err = s.UpdateAlertRule(ctx, store.AlertRule{Id: 42})
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	require.NoError(t, s.FireAlert(ctx, store.Alert{RuleId: rule.Id, Since: 100, Value: 90}))
+	// firing an already firing rule keeps the original since
+	require.NoError(t, s.FireAlert(ctx, store.Alert{RuleId: rule.Id, Since: 200, Value: 95}))
+	firing, err := s.ListFiringAlerts(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []store.Alert{{RuleId: rule.Id, RuleName: "humid", Severity: "warning", Since: 100, Value: 90}}, firing)
+
+	require.NoError(t, s.ResolveAlert(ctx, rule.Id, 70, 300))
+	history, err := s.ListAlertHistory(ctx, store.AlertHistoryFilter{State: store.AlertFiring, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, int64(100), history[0].Timestamp)
+
+	history, err = s.ListAlertHistory(ctx, store.AlertHistoryFilter{From: 200, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, store.AlertResolved, history[0].State)
+
+	require.NoError(t, s.DeleteAlertRule(ctx, rule.Id))
+	assert.ErrorIs(t, s.DeleteAlertRule(ctx, rule.Id), store.ErrNotFound)
+	history, err = s.ListAlertHistory(ctx, store.AlertHistoryFilter{Limit: 10})
+	require.NoError(t, err)
+	assert.Len(t, history, 2)
+}
+
+func TestSilences(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	matchers := []store.SilenceMatcher{{Name: "rule", Value: "humid"}}
+	short, err := s.CreateSilence(ctx, store.Silence{Matchers: matchers, StartsAt: 100, EndsAt: 200})
+	require.NoError(t, err)
+	long, err := s.CreateSilence(ctx, store.Silence{Matchers: matchers, Comment: "weekend", StartsAt: 100, EndsAt: 300})
+	require.NoError(t, err)
+
+	active, err := s.ListActiveSilences(ctx, 150)
+	require.NoError(t, err)
+	require.Len(t, active, 2)
+	assert.Equal(t, short.Id, active[0].Id)
+
+	active, err = s.ListActiveSilences(ctx, 200)
+	require.NoError(t, err)
+	require.Len(t, active, 1)
+	assert.Equal(t, "weekend", active[0].Comment)
+
+	require.NoError(t, s.ExpireSilence(ctx, long.Id, 250))
+	assert.ErrorIs(t, s.ExpireSilence(ctx, long.Id, 250), store.ErrNotFound)
+	active, err = s.ListActiveSilences(ctx, 250)
+	require.NoError(t, err)
+	assert.Empty(t, active)
+}
+
+func TestAckAlert(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	rule, err := s.CreateAlertRule(ctx, store.AlertRule{Name: "humid", Field: "humidity", Op: "gt", Threshold: 80, Enabled: true})
+	require.NoError(t, err)
+	require.NoError(t, s.FireAlert(ctx, store.Alert{RuleId: rule.Id, Since: 100, Value: 90, FiredAt: 110, AckToken: "token"}))
+	require.NoError(t, s.SetAlertNotified(ctx, rule.Id, 2))
+
+	_, err = s.AckAlert(ctx, "", 200)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	a, err := s.AckAlert(ctx, "token", 200)
+	require.NoError(t, err)
+	require.NotNil(t, a.AckedAt)
+	assert.Equal(t, int64(200), *a.AckedAt)
+	assert.Equal(t, 2, a.Notified)
+
+	a, err = s.AckAlert(ctx, "token", 300)
+	require.NoError(t, err)
+	assert.Equal(t, int64(200), *a.AckedAt)
+
+	history, err := s.ListAlertHistory(ctx, store.AlertHistoryFilter{State: store.AlertAcknowledged, Limit: 10})
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+}
+
+func TestZones(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	z, err := s.CreateZone(ctx, store.Zone{Name: "living room", Device: "attic", RelayDevice: "boiler", Field: "tempRoom", Target: 21, Hysteresis: 0.5, Mode: "heat", Enabled: true})
+	require.NoError(t, err)
+	assert.Nil(t, z.Relay)
+
+	on := true
+	z, err = s.SetZoneOverride(ctx, z.Id, &on, 500, 100)
+	require.NoError(t, err)
+	require.NotNil(t, z.Override)
+	assert.True(t, *z.Override)
+	require.NoError(t, s.SetZoneRelay(ctx, store.ZoneEvent{ZoneId: z.Id, State: "on", Value: 20, Target: 21, Timestamp: 110}))
+
+	// settings updates keep the override and relay state
+	z.Target = 22
+	z.Override, z.Relay = nil, nil
+	z, err = s.UpdateZone(ctx, z)
+	require.NoError(t, err)
+	assert.Equal(t, 22.0, z.Target)
+	require.NotNil(t, z.Override)
+	require.NotNil(t, z.Relay)
+	assert.True(t, *z.Relay)
+	assert.Equal(t, int64(110), z.ChangedAt)
+
+	z, err = s.SetZoneOverride(ctx, z.Id, nil, 500, 120)
+	require.NoError(t, err)
+	assert.Nil(t, z.Override)
+	assert.Zero(t, z.OverrideUntil)
+
+	history, err := s.ListZoneHistory(ctx, z.Id, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	assert.Equal(t, store.ZoneEventOverride, history[0].Kind)
+	assert.Equal(t, "auto", history[0].State)
+	assert.Equal(t, store.ZoneEventRelay, history[1].Kind)
+	assert.Equal(t, 20.0, history[1].Value)
+
+	require.NoError(t, s.DeleteZone(ctx, z.Id))
+	_, err = s.GetZone(ctx, z.Id)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	assert.ErrorIs(t, s.SetZoneRelay(ctx, store.ZoneEvent{ZoneId: z.Id, State: "off"}), store.ErrNotFound)
+}
+
+func TestCommands(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	_, err := s.EnqueueCommand(ctx, store.Command{Device: "boiler", Type: "relay", Value: "on", CreatedAt: 100})
+	require.NoError(t, err)
+	_, err = s.EnqueueCommand(ctx, store.Command{Device: "boiler", Type: "led", Value: "blink", CreatedAt: 100})
+	require.NoError(t, err)
+	// supersedes the pending relay command
+	off, err := s.EnqueueCommand(ctx, store.Command{Device: "boiler", Type: "relay", Value: "off", CreatedAt: 110})
+	require.NoError(t, err)
+
+	pending, err := s.PendingCommands(ctx, "boiler")
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, "led", pending[0].Type)
+	assert.Equal(t, off.Id, pending[1].Id)
+
+	assert.ErrorIs(t, s.AckCommand(ctx, "attic", off.Id, 120), store.ErrNotFound)
+	require.NoError(t, s.AckCommand(ctx, "boiler", off.Id, 120))
+	assert.ErrorIs(t, s.AckCommand(ctx, "boiler", off.Id, 130), store.ErrNotFound)
+
+	pending, err = s.PendingCommands(ctx, "boiler")
+	require.NoError(t, err)
+	assert.Len(t, pending, 1)
+}
+
+func TestAwayMode(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	m, err := s.GetAwayMode(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, m)
+
+	require.NoError(t, s.SetAwayMode(ctx, &store.AwayMode{Setpoint: 7, Since: 100, Until: 200}))
+	require.NoError(t, s.SetAwayMode(ctx, &store.AwayMode{Setpoint: 8, Since: 100, Until: 300}))
+	m, err = s.GetAwayMode(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, &store.AwayMode{Setpoint: 8, Since: 100, Until: 300}, m)
+
+	require.NoError(t, s.SetAwayMode(ctx, nil))
+	m, err = s.GetAwayMode(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, m)
+}
+
+func TestOutdoorReadings(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	require.NoError(t, s.InsertOutdoorReading(ctx, store.OutdoorReading{Temp: 5, Humidity: 80, Timestamp: 100}))
+	require.NoError(t, s.InsertOutdoorReading(ctx, store.OutdoorReading{Temp: 6, Humidity: 75, Timestamp: 200}))
+	require.NoError(t, s.InsertOutdoorReading(ctx, store.OutdoorReading{Temp: 6.5, Humidity: 70, Timestamp: 200}))
+	require.NoError(t, s.InsertOutdoorReading(ctx, store.OutdoorReading{Temp: 7, Humidity: 65, Timestamp: 300}))
+
+	readings, err := s.ListOutdoorReadings(ctx, 100, 200)
+	require.NoError(t, err)
+	assert.Equal(t, []store.OutdoorReading{{Temp: 6.5, Humidity: 70, Timestamp: 200}, {Temp: 5, Humidity: 80, Timestamp: 100}}, readings)
+
+	readings, err = s.ListOutdoorReadings(ctx, 400, 500)
+	require.NoError(t, err)
+	assert.Empty(t, readings)
+	assert.NotNil(t, readings)
+}
+
+func TestListSmoothedReadings(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	var rs []store.TemperatureReading
+	for i, co := range []float64{40, 43, 40, 49, 40} {
+		ts := int64(1761388000 + i*60)
+		rs = append(rs, store.TemperatureReading{TempCo: co, TempRoom: 21, Humidity: 50, Timestamp: &ts})
+	}
+	_, err := s.InsertReadings(ctx, rs)
+	require.NoError(t, err)
+
+	// a 2 minute window averages every reading with its neighbours
+	readings, err := s.ListSmoothedReadings(ctx, 3, 1, 60)
+	require.NoError(t, err)
+	require.Len(t, readings, 3)
+	assert.Equal(t, []float64{43, 44, 41}, []float64{readings[0].TempCo, readings[1].TempCo, readings[2].TempCo})
+	assert.Equal(t, int64(1761388180), *readings[0].Timestamp)
+	assert.Equal(t, 21.0, readings[0].TempRoom)
+
+	// the unsmoothed readings are kept
+	readings, err = s.ListReadings(ctx, 1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 49.0, readings[0].TempCo)
+}
+
+func TestListFilteredReadings(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	var rs []store.TemperatureReading
+	for i, co := range []float64{40, 55, 60, 52, 45} {
+		ts := int64(1761388000 + i*60)
+		rs = append(rs, store.TemperatureReading{TempCo: co, TempRoom: 16 + float64(i), Humidity: 50, Timestamp: &ts})
+	}
+	_, err := s.InsertReadings(ctx, rs)
+	require.NoError(t, err)
+
+	filters := []store.ReadingFilter{{Field: "tempCo", Op: "gte", Value: 52}, {Field: "tempRoom", Op: "lt", Value: 19}}
+	readings, err := s.ListFilteredReadings(ctx, store.ReadingQuery{Filters: filters}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 2)
+	assert.Equal(t, []float64{60, 55}, []float64{readings[0].TempCo, readings[1].TempCo})
+
+	readings, err = s.ListFilteredReadings(ctx, store.ReadingQuery{Filters: filters}, 10, 1)
+	require.NoError(t, err)
+	require.Len(t, readings, 1)
+	assert.Equal(t, 55.0, readings[0].TempCo)
+
+	readings, err = s.ListFilteredReadings(ctx, store.ReadingQuery{Filters: []store.ReadingFilter{{Field: "timestamp", Op: "gt", Value: 1761388180}}}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 1)
+	assert.Equal(t, 45.0, readings[0].TempCo)
+
+	readings, err = s.ListFilteredReadings(ctx, store.ReadingQuery{}, 10, 0)
+	require.NoError(t, err)
+	assert.Len(t, readings, 5)
+}
+
+func TestReadingCursor(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	// readings as old as each other are paged through by id
+	var rs []store.TemperatureReading
+	for i := range 5 {
+		ts := int64(1761388000 + i/3*60)
+		rs = append(rs, store.TemperatureReading{TempCo: float64(40 + i), Timestamp: &ts})
+	}
+	_, err := s.InsertReadings(ctx, rs)
+	require.NoError(t, err)
+
+	var (
+		q   store.ReadingQuery
+		got []float64
+	)
+	for {
+		page, err := s.ListFilteredReadings(ctx, q, 2, 0)
+		require.NoError(t, err)
+		for _, r := range page {
+			got = append(got, r.TempCo)
+		}
+		if len(page) < 2 {
+			break
+		}
+		after := store.CursorAfter(page[len(page)-1])
+		q.After = &after
+	}
+	assert.Equal(t, []float64{44, 43, 42, 41, 40}, got)
+
+	_, err = s.ListFilteredReadings(ctx, store.ReadingQuery{Order: store.OrderReceivedAt, After: q.After}, 2, 0)
+	assert.Error(t, err)
+}
+
+func TestReceivedAtOrder(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	// a backlog measured before, but received after, the live reading
+	live, backlog, received := int64(1761388600), int64(1761388000), int64(1761388700)
+	liveReceived := live
+	_, err := s.InsertReading(ctx, store.TemperatureReading{TempCo: 40, Timestamp: &live, ReceivedAt: &liveReceived})
+	require.NoError(t, err)
+	_, err = s.InsertReading(ctx, store.TemperatureReading{TempCo: 50, Timestamp: &backlog, ReceivedAt: &received})
+	require.NoError(t, err)
+	old := int64(1761387000)
+	_, err = s.InsertReading(ctx, store.TemperatureReading{TempCo: 60, Timestamp: &old})
+	require.NoError(t, err)
+
+	readings, err := s.ListFilteredReadings(ctx, store.ReadingQuery{}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 3)
+	assert.Equal(t, []float64{40, 50, 60}, []float64{readings[0].TempCo, readings[1].TempCo, readings[2].TempCo})
+	assert.Equal(t, received, *readings[1].ReceivedAt)
+
+	readings, err = s.ListFilteredReadings(ctx, store.ReadingQuery{Order: store.OrderReceivedAt}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 3)
+	assert.Equal(t, []float64{50, 40, 60}, []float64{readings[0].TempCo, readings[1].TempCo, readings[2].TempCo})
+	assert.Nil(t, readings[2].ReceivedAt)
+
+	readings, err = s.ListFilteredReadings(ctx, store.ReadingQuery{Filters: []store.ReadingFilter{{Field: "receivedAt", Op: "gt", Value: float64(live)}}}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 1)
+	assert.Equal(t, 50.0, readings[0].TempCo)
+}
+
+func TestReadingQuality(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	ts := int64(1761388000)
+	ok, err := s.InsertReading(ctx, store.TemperatureReading{TempCo: 40, Timestamp: &ts})
+	require.NoError(t, err)
+	assert.Equal(t, store.QualityOK, ok.Quality)
+	_, err = s.InsertReadings(ctx, []store.TemperatureReading{{TempCo: 85, Timestamp: &ts, Quality: store.QualitySuspect}})
+	require.NoError(t, err)
+
+	require.NoError(t, s.SetReadingQuality(ctx, ok.Id, store.QualityCalibrated))
+	assert.ErrorIs(t, s.SetReadingQuality(ctx, ok.Id+100, store.QualityOK), store.ErrNotFound)
+
+	readings, err := s.ListFilteredReadings(ctx, store.ReadingQuery{Qualities: []string{store.QualityOK, store.QualityCalibrated}}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 1)
+	assert.Equal(t, ok.Id, readings[0].Id)
+	assert.Equal(t, store.QualityCalibrated, readings[0].Quality)
+
+	readings, err = s.ListFilteredReadings(ctx, store.ReadingQuery{Qualities: []string{store.QualitySuspect}}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 1)
+	assert.Equal(t, 85.0, readings[0].TempCo)
+}
+
+func TestAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	keys, err := s.ListAPIKeys(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	grafana := store.APIKey{Name: "grafana", Hash: "$2a$10$hash", Scopes: []string{"read"}, CreatedAt: 1761388000}
+	require.NoError(t, s.CreateAPIKey(ctx, grafana))
+	require.NoError(t, s.CreateAPIKey(ctx, store.APIKey{Name: "attic", Hash: "$2a$10$other", Scopes: []string{"write"}, Device: "attic", CreatedAt: 1761388000}))
+	assert.ErrorIs(t, s.CreateAPIKey(ctx, grafana), store.ErrExists)
+
+	keys, err = s.ListAPIKeys(ctx)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, "attic", keys[0].Name)
+	assert.Equal(t, "attic", keys[0].Device)
+	assert.Equal(t, grafana, keys[1])
+
+	require.NoError(t, s.DeleteAPIKey(ctx, "attic"))
+	assert.ErrorIs(t, s.DeleteAPIKey(ctx, "attic"), store.ErrNotFound)
+	keys, err = s.ListAPIKeys(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []store.APIKey{grafana}, keys)
+}
+
+func TestDeviceLabels(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	labels, err := s.DeviceLabels(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, labels)
+
+	require.NoError(t, s.SetDeviceLabels(ctx, "attic", map[string]string{"floor": "2", "type": "room"}))
+	require.NoError(t, s.SetDeviceLabels(ctx, "boiler", map[string]string{"floor": "0"}))
+	require.NoError(t, s.SetDeviceLabels(ctx, "boiler", map[string]string{"floor": "0", "type": "boiler"}))
+	require.NoError(t, s.SetDeviceLabels(ctx, "garage", map[string]string{"floor": "0"}))
+	require.NoError(t, s.SetDeviceLabels(ctx, "garage", nil))
+	labels, err = s.DeviceLabels(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{
+		"attic":  {"floor": "2", "type": "room"},
+		"boiler": {"floor": "0", "type": "boiler"},
+	}, labels)
+
+	// readings keep their device and can be selected by it
+	ts := int64(1761388000)
+	_, err = s.InsertReading(ctx, store.TemperatureReading{TempCo: 60, Timestamp: &ts, Device: "boiler"})
+	require.NoError(t, err)
+	_, err = s.InsertReadings(ctx, []store.TemperatureReading{{TempRoom: 19, Timestamp: &ts, Device: "attic"}, {TempRoom: 21, Timestamp: &ts}})
+	require.NoError(t, err)
+	readings, err := s.ListFilteredReadings(ctx, store.ReadingQuery{Devices: []string{"attic", "boiler"}}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 2)
+	assert.ElementsMatch(t, []string{"attic", "boiler"}, []string{readings[0].Device, readings[1].Device})
+	readings, err = s.ListFilteredReadings(ctx, store.ReadingQuery{Devices: []string{}}, 10, 0)
+	require.NoError(t, err)
+	assert.Empty(t, readings)
+}
+
+func TestLocations(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	locations, err := s.ListLocations(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, locations)
+
+	house, err := s.CreateLocation(ctx, store.Location{Name: "Home", Kind: store.LocationHouse, Devices: []string{}})
+	require.NoError(t, err)
+	floor, err := s.CreateLocation(ctx, store.Location{Name: "Ground", Kind: store.LocationFloor, ParentId: &house.Id, Devices: []string{"hall"}})
+	require.NoError(t, err)
+	room, err := s.CreateLocation(ctx, store.Location{Name: "Kitchen", Kind: store.LocationRoom, ParentId: &floor.Id, Devices: []string{"kitchen"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hall"}, floor.Devices)
+
+	// placing a device elsewhere moves it
+	room.Devices = []string{"hall", "kitchen"}
+	_, err = s.UpdateLocation(ctx, room)
+	require.NoError(t, err)
+	got, err := s.GetLocation(ctx, floor.Id)
+	require.NoError(t, err)
+	assert.Empty(t, got.Devices)
+	got, err = s.GetLocation(ctx, room.Id)
+	require.NoError(t, err)
+	assert.Equal(t, store.Location{Id: room.Id, Name: "Kitchen", Kind: store.LocationRoom, ParentId: &floor.Id, Devices: []string{"hall", "kitchen"}}, got)
+
+	_, err = s.UpdateLocation(ctx, store.Location{Id: 999, Name: "Nowhere", Kind: store.LocationRoom})
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	// deleting a location makes its children top-level
+	require.NoError(t, s.DeleteLocation(ctx, floor.Id))
+	got, err = s.GetLocation(ctx, room.Id)
+	require.NoError(t, err)
+	assert.Nil(t, got.ParentId)
+	_, err = s.GetLocation(ctx, floor.Id)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	assert.ErrorIs(t, s.DeleteLocation(ctx, floor.Id), store.ErrNotFound)
+
+	locations, err = s.ListLocations(ctx)
+	require.NoError(t, err)
+	require.Len(t, locations, 2)
+	assert.Equal(t, house.Id, locations[0].Id)
+	assert.Equal(t, room.Id, locations[1].Id)
+}
+
+func TestFeatureFlags(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	flags, err := s.FeatureFlags(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, flags)
+
+	require.NoError(t, s.SetFeatureFlags(ctx, []store.FeatureChange{
+		{Name: "alerts", Value: false, Actor: "ops", At: 1761388000},
+		{Name: "read_only", Value: true, Actor: "ops", At: 1761388000},
+	}))
+	require.NoError(t, s.SetFeatureFlags(ctx, []store.FeatureChange{{Name: "read_only", Value: false, Actor: "secret-key", At: 1761388060}}))
+
+	flags, err = s.FeatureFlags(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"alerts": false, "read_only": false}, flags)
+
+	changes, err := s.ListFeatureChanges(ctx, 2)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	assert.Equal(t, store.FeatureChange{Id: changes[0].Id, Name: "read_only", Value: false, Actor: "secret-key", At: 1761388060}, changes[0])
+	assert.Equal(t, "read_only", changes[1].Name)
+	assert.Greater(t, changes[0].Id, changes[1].Id)
+}
+
+func TestDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	letters, err := s.ListDeadLetters(ctx, 10)
+	require.NoError(t, err)
+	assert.Empty(t, letters)
+
+	first, err := s.AddDeadLetter(ctx, store.DeadLetter{RuleId: 1, RuleName: "boiler hot", Channel: "telegram", Subject: "[critical] boiler hot firing", Text: "tempCo is 75", Error: "timeout", Attempts: 1, FailedAt: 1761388000})
+	require.NoError(t, err)
+	second, err := s.AddDeadLetter(ctx, store.DeadLetter{RuleId: 1, RuleName: "boiler hot", Channel: "email", Subject: "[critical] boiler hot firing", AckURL: "https://temp.example.com/alerts/ack/abc", Error: "dial tcp: connection refused", Attempts: 1, FailedAt: 1761388060})
+	require.NoError(t, err)
+
+	letters, err = s.ListDeadLetters(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []store.DeadLetter{second, first}, letters)
+
+	first.Error, first.Attempts, first.FailedAt = "unexpected status 502", 2, 1761388120
+	require.NoError(t, s.UpdateDeadLetter(ctx, first))
+	got, err := s.GetDeadLetter(ctx, first.Id)
+	require.NoError(t, err)
+	assert.Equal(t, first, got)
+
+	require.NoError(t, s.DeleteDeadLetter(ctx, first.Id))
+	assert.ErrorIs(t, s.DeleteDeadLetter(ctx, first.Id), store.ErrNotFound)
+	_, err = s.GetDeadLetter(ctx, first.Id)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	assert.ErrorIs(t, s.UpdateDeadLetter(ctx, first), store.ErrNotFound)
+}
+
+func TestDeviceFirmware(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	firmware, err := s.DeviceFirmware(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, firmware)
+
+	require.NoError(t, s.SetDeviceFirmware(ctx, "attic", "1.2.0", 1761388000))
+	require.NoError(t, s.SetDeviceFirmware(ctx, "attic", "1.2.0", 1761388060))
+	require.NoError(t, s.SetDeviceFirmware(ctx, "garage", "1.1.3", 1761388000))
+	require.NoError(t, s.SetDeviceFirmware(ctx, "garage", "1.2.0", 1761388120))
+
+	firmware, err = s.DeviceFirmware(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []store.DeviceFirmware{
+		{Device: "attic", Version: "1.2.0", Since: 1761388000},
+		{Device: "garage", Version: "1.2.0", Since: 1761388120},
+	}, firmware)
+}
+
+func TestCrashReports(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+
+	exception := 29
+	first, err := s.AddCrashReport(ctx, store.CrashReport{Device: "attic", Reason: "Exception", Exception: &exception, Stack: ">>>stack>>>\n3ffffdc0:  40201c4d 00000000\n<<<stack<<<", Firmware: "1.2.0", At: 1761388000})
+	require.NoError(t, err)
+	second, err := s.AddCrashReport(ctx, store.CrashReport{Device: "attic", Reason: "Hardware Watchdog", At: 1761388060})
+	require.NoError(t, err)
+	_, err = s.AddCrashReport(ctx, store.CrashReport{Device: "garage", Reason: "Software Watchdog", At: 1761388060})
+	require.NoError(t, err)
+
+	reports, err := s.ListCrashReports(ctx, "attic", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []store.CrashReport{second, first}, reports)
+	reports, err = s.ListCrashReports(ctx, "attic", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []store.CrashReport{second}, reports)
+	reports, err = s.ListCrashReports(ctx, "cellar", 10)
+	require.NoError(t, err)
+	assert.Empty(t, reports)
+
+	n, err := s.CountCrashReports(ctx, "attic", 1761388060)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = s.CountCrashReports(ctx, "attic", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
@@ -0,0 +1,21 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.QualityStore = (*Store)(nil)
+
+func (s *Store) SetReadingQuality(ctx context.Context, id int, quality string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.readings {
+		if s.readings[i].Id == id {
+			s.readings[i].Quality = quality
+			return nil
+		}
+	}
+	return store.ErrNotFound
+}
@@ -0,0 +1,43 @@
+package memory
+
+import (
+	"cmp"
+	"context"
+	"slices"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.StatusStore = (*Store)(nil)
+
+// StorageStatus reports the readings per device; the store has no tables
+// and lives in memory, so there are no sizes.
+func (s *Store) StorageStatus(ctx context.Context) (store.StorageStatus, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	devices := make(map[string]*store.DeviceStorage)
+	for _, r := range s.readings {
+		d, ok := devices[r.Device]
+		if !ok {
+			d = &store.DeviceStorage{Device: r.Device}
+			devices[r.Device] = d
+		}
+		d.Count++
+		if r.Timestamp == nil {
+			continue
+		}
+		ts := *r.Timestamp
+		if d.Oldest == nil || ts < *d.Oldest {
+			d.Oldest = &ts
+		}
+		if d.Newest == nil || ts > *d.Newest {
+			d.Newest = &ts
+		}
+	}
+	status := store.StorageStatus{Tables: []store.TableSize{}, Devices: make([]store.DeviceStorage, 0, len(devices))}
+	for _, d := range devices {
+		status.Devices = append(status.Devices, *d)
+	}
+	slices.SortFunc(status.Devices, func(a, b store.DeviceStorage) int { return cmp.Compare(a.Device, b.Device) })
+	return status, nil
+}
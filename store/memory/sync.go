@@ -0,0 +1,53 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.SyncStore = (*Store)(nil)
+
+func (s *Store) SyncReadings(ctx context.Context, device string, readings []store.SyncReading) (store.SyncResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ackedSeq == nil {
+		s.ackedSeq = make(map[string]int64)
+	}
+	result := store.SyncResult{AckedSeq: s.ackedSeq[device], PrevAckedSeq: s.ackedSeq[device]}
+	acked := result.AckedSeq
+	for _, r := range readings {
+		if r.Seq > result.AckedSeq {
+			r.Device = device
+			s.insert(r.TemperatureReading)
+			result.Inserted++
+			acked = max(acked, r.Seq)
+		}
+	}
+	s.ackedSeq[device] = acked
+	result.AckedSeq = acked
+	return result, nil
+}
+
+var _ store.ReplaceStore = (*Store)(nil)
+
+func (s *Store) ReplaceReadings(ctx context.Context, device string, from, to int64, readings []store.TemperatureReading) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.readings[:0]
+	for _, r := range s.readings {
+		if r.Device == device && *r.Timestamp >= from && *r.Timestamp < to {
+			delete(s.storedAt, r.Id)
+			continue
+		}
+		kept = append(kept, r)
+	}
+	s.readings = kept
+	for _, r := range readings {
+		r.Device = device
+		s.insert(r)
+	}
+	return nil
+}
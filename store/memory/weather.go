@@ -0,0 +1,36 @@
+package memory
+
+import (
+	"context"
+	"slices"
+	"sort"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.WeatherStore = (*Store)(nil)
+
+func (s *Store) InsertOutdoorReading(ctx context.Context, r store.OutdoorReading) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.outdoor, func(o store.OutdoorReading) bool { return o.Timestamp == r.Timestamp })
+	if i >= 0 {
+		s.outdoor[i] = r
+		return nil
+	}
+	s.outdoor = append(s.outdoor, r)
+	return nil
+}
+
+func (s *Store) ListOutdoorReadings(ctx context.Context, from, to int64) ([]store.OutdoorReading, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	readings := make([]store.OutdoorReading, 0)
+	for _, r := range s.outdoor {
+		if r.Timestamp >= from && r.Timestamp <= to {
+			readings = append(readings, r)
+		}
+	}
+	sort.Slice(readings, func(i, j int) bool { return readings[i].Timestamp > readings[j].Timestamp })
+	return readings, nil
+}
@@ -0,0 +1,292 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/jackc/pgx/v5"
+)
+
+var _ store.AlertStore = (*Store)(nil)
+
+const alertRuleColumns = `id, name, field, op, threshold, severity, enabled, escalation, templates`
+
+func scanAlertRule(row pgx.Row) (store.AlertRule, error) {
+	var r store.AlertRule
+	err := row.Scan(&r.Id, &r.Name, &r.Field, &r.Op, &r.Threshold, &r.Severity, &r.Enabled, &r.Escalation, &r.Templates)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return r, store.ErrNotFound
+	}
+	return r, err
+}
+
+func (s *Store) ListAlertRules(ctx context.Context) ([]store.AlertRule, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.Query(ctx, `SELECT `+alertRuleColumns+` FROM alert_rules ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := make([]store.AlertRule, 0)
+	for rows.Next() {
+		r, err := scanAlertRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (s *Store) GetAlertRule(ctx context.Context, id int) (store.AlertRule, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return scanAlertRule(s.db.QueryRow(ctx, `SELECT `+alertRuleColumns+` FROM alert_rules WHERE id = $1`, id))
+}
+
+// escalation keeps a nil slice from being stored as SQL NULL.
+func escalation(r store.AlertRule) []store.EscalationStep {
+	if r.Escalation == nil {
+		return []store.EscalationStep{}
+	}
+	return r.Escalation
+}
+
+// templates keeps a nil map from being stored as SQL NULL.
+func templates(r store.AlertRule) map[string]string {
+	if r.Templates == nil {
+		return map[string]string{}
+	}
+	return r.Templates
+}
+
+func (s *Store) CreateAlertRule(ctx context.Context, r store.AlertRule) (store.AlertRule, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return scanAlertRule(s.db.QueryRow(ctx, `
+		INSERT INTO alert_rules (name, field, op, threshold, severity, enabled, escalation, templates)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING `+alertRuleColumns,
+		r.Name, r.Field, r.Op, r.Threshold, r.Severity, r.Enabled, escalation(r), templates(r)))
+}
+
+func (s *Store) UpdateAlertRule(ctx context.Context, r store.AlertRule) (store.AlertRule, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return scanAlertRule(s.db.QueryRow(ctx, `
+		UPDATE alert_rules
+		SET name = $2, field = $3, op = $4, threshold = $5, severity = $6, enabled = $7, escalation = $8, templates = $9
+		WHERE id = $1
+		RETURNING `+alertRuleColumns,
+		r.Id, r.Name, r.Field, r.Op, r.Threshold, r.Severity, r.Enabled, escalation(r), templates(r)))
+}
+
+func (s *Store) DeleteAlertRule(ctx context.Context, id int) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tag, err := s.db.Exec(ctx, `DELETE FROM alert_rules WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+func (s *Store) ListFiringAlerts(ctx context.Context) ([]store.Alert, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.Query(ctx, `
+		SELECT st.rule_id, r.name, r.severity, st.since, st.value, st.device, st.fired_at, st.acked_at, st.notified, st.ack_token
+		FROM alert_state st
+		JOIN alert_rules r ON r.id = st.rule_id
+		ORDER BY st.since DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := make([]store.Alert, 0)
+	for rows.Next() {
+		var a store.Alert
+		if err := rows.Scan(&a.RuleId, &a.RuleName, &a.Severity, &a.Since, &a.Value, &a.Device, &a.FiredAt, &a.AckedAt, &a.Notified, &a.AckToken); err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
+
+func (s *Store) FireAlert(ctx context.Context, a store.Alert) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `
+			INSERT INTO alert_state (rule_id, since, value, device, fired_at, ack_token) VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (rule_id) DO NOTHING
+		`, a.RuleId, a.Since, a.Value, a.Device, a.FiredAt, a.AckToken)
+		if err != nil || tag.RowsAffected() == 0 {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO alert_history (rule_id, rule_name, state, value, timestamp)
+			SELECT id, name, $2, $3, $4 FROM alert_rules WHERE id = $1
+		`, a.RuleId, store.AlertFiring, a.Value, a.Since)
+		return err
+	})
+}
+
+func (s *Store) ResolveAlert(ctx context.Context, ruleId int, value float64, timestamp int64) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `DELETE FROM alert_state WHERE rule_id = $1`, ruleId)
+		if err != nil || tag.RowsAffected() == 0 {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO alert_history (rule_id, rule_name, state, value, timestamp)
+			SELECT id, name, $2, $3, $4 FROM alert_rules WHERE id = $1
+		`, ruleId, store.AlertResolved, value, timestamp)
+		return err
+	})
+}
+
+func (s *Store) AckAlert(ctx context.Context, token string, now int64) (store.Alert, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	var a store.Alert
+	err := pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, `
+			SELECT st.rule_id, r.name, r.severity, st.since, st.value, st.device, st.fired_at, st.acked_at, st.notified, st.ack_token
+			FROM alert_state st
+			JOIN alert_rules r ON r.id = st.rule_id
+			WHERE st.ack_token = $1 AND st.ack_token <> ''
+			FOR UPDATE OF st
+		`, token).Scan(&a.RuleId, &a.RuleName, &a.Severity, &a.Since, &a.Value, &a.Device, &a.FiredAt, &a.AckedAt, &a.Notified, &a.AckToken)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return store.ErrNotFound
+		}
+		if err != nil || a.AckedAt != nil {
+			return err
+		}
+		a.AckedAt = &now
+		if _, err := tx.Exec(ctx, `UPDATE alert_state SET acked_at = $2 WHERE rule_id = $1`, a.RuleId, now); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO alert_history (rule_id, rule_name, state, value, timestamp)
+			VALUES ($1, $2, $3, $4, $5)
+		`, a.RuleId, a.RuleName, store.AlertAcknowledged, a.Value, now)
+		return err
+	})
+	return a, err
+}
+
+func (s *Store) SetAlertNotified(ctx context.Context, ruleId int, notified int) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	_, err := s.db.Exec(ctx, `UPDATE alert_state SET notified = $2 WHERE rule_id = $1`, ruleId, notified)
+	return err
+}
+
+func (s *Store) ListAlertHistory(ctx context.Context, f store.AlertHistoryFilter) ([]store.AlertEvent, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	var where []string
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if f.RuleId != 0 {
+		add("rule_id = $%d", f.RuleId)
+	}
+	if f.State != "" {
+		add("state = $%d", f.State)
+	}
+	if f.From != 0 {
+		add("timestamp >= $%d", f.From)
+	}
+	if f.To != 0 {
+		add("timestamp <= $%d", f.To)
+	}
+	query := `SELECT id, rule_id, rule_name, state, value, timestamp FROM alert_history`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	args = append(args, f.Limit, f.Offset)
+	query += fmt.Sprintf(` ORDER BY timestamp DESC, id DESC LIMIT $%d OFFSET $%d`, len(args)-1, len(args))
+
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]store.AlertEvent, 0)
+	for rows.Next() {
+		var e store.AlertEvent
+		if err := rows.Scan(&e.Id, &e.RuleId, &e.RuleName, &e.State, &e.Value, &e.Timestamp); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *Store) CreateSilence(ctx context.Context, silence store.Silence) (store.Silence, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	err := s.db.QueryRow(ctx, `
+		INSERT INTO alert_silences (matchers, comment, starts_at, ends_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, silence.Matchers, silence.Comment, silence.StartsAt, silence.EndsAt).Scan(&silence.Id)
+	return silence, err
+}
+
+func (s *Store) ListActiveSilences(ctx context.Context, now int64) ([]store.Silence, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.Query(ctx, `
+		SELECT id, matchers, comment, starts_at, ends_at
+		FROM alert_silences
+		WHERE ends_at > $1
+		ORDER BY ends_at, id
+	`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	silences := make([]store.Silence, 0)
+	for rows.Next() {
+		var silence store.Silence
+		if err := rows.Scan(&silence.Id, &silence.Matchers, &silence.Comment, &silence.StartsAt, &silence.EndsAt); err != nil {
+			return nil, err
+		}
+		silences = append(silences, silence)
+	}
+	return silences, rows.Err()
+}
+
+func (s *Store) ExpireSilence(ctx context.Context, id int, now int64) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tag, err := s.db.Exec(ctx, `UPDATE alert_silences SET ends_at = $2 WHERE id = $1 AND ends_at > $2`, id, now)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.APIKeyStore = (*Store)(nil)
+
+func (s *Store) ListAPIKeys(ctx context.Context) ([]store.APIKey, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.Query(ctx, `SELECT name, key_id, hash, scopes, device, created_at FROM api_keys ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]store.APIKey, 0)
+	for rows.Next() {
+		var k store.APIKey
+		if err := rows.Scan(&k.Name, &k.ID, &k.Hash, &k.Scopes, &k.Device, &k.CreatedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *Store) CreateAPIKey(ctx context.Context, k store.APIKey) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tag, err := s.db.Exec(ctx, `
+		INSERT INTO api_keys (name, key_id, hash, scopes, device, created_at) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (name) DO NOTHING
+	`, k.Name, k.ID, k.Hash, k.Scopes, k.Device, k.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return store.ErrExists
+	}
+	return nil
+}
+
+func (s *Store) DeleteAPIKey(ctx context.Context, name string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tag, err := s.db.Exec(ctx, `DELETE FROM api_keys WHERE name = $1`, name)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
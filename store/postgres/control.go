@@ -0,0 +1,248 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	_ store.ZoneStore    = (*Store)(nil)
+	_ store.CommandStore = (*Store)(nil)
+)
+
+const zoneColumns = `id, name, device, relay_device, field, target, hysteresis, mode, enabled, override, override_until, relay, changed_at`
+
+func scanZone(row pgx.Row) (store.Zone, error) {
+	var z store.Zone
+	err := row.Scan(&z.Id, &z.Name, &z.Device, &z.RelayDevice, &z.Field, &z.Target, &z.Hysteresis, &z.Mode, &z.Enabled,
+		&z.Override, &z.OverrideUntil, &z.Relay, &z.ChangedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return z, store.ErrNotFound
+	}
+	return z, err
+}
+
+func (s *Store) ListZones(ctx context.Context) ([]store.Zone, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.Query(ctx, `SELECT `+zoneColumns+` FROM zones ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	zones := make([]store.Zone, 0)
+	for rows.Next() {
+		z, err := scanZone(rows)
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, z)
+	}
+	return zones, rows.Err()
+}
+
+func (s *Store) GetZone(ctx context.Context, id int) (store.Zone, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return scanZone(s.db.QueryRow(ctx, `SELECT `+zoneColumns+` FROM zones WHERE id = $1`, id))
+}
+
+func (s *Store) CreateZone(ctx context.Context, z store.Zone) (store.Zone, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return scanZone(s.db.QueryRow(ctx, `
+		INSERT INTO zones (name, device, relay_device, field, target, hysteresis, mode, enabled)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING `+zoneColumns,
+		z.Name, z.Device, z.RelayDevice, z.Field, z.Target, z.Hysteresis, z.Mode, z.Enabled))
+}
+
+func (s *Store) UpdateZone(ctx context.Context, z store.Zone) (store.Zone, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return scanZone(s.db.QueryRow(ctx, `
+		UPDATE zones
+		SET name = $2, device = $3, relay_device = $4, field = $5, target = $6, hysteresis = $7, mode = $8, enabled = $9
+		WHERE id = $1
+		RETURNING `+zoneColumns,
+		z.Id, z.Name, z.Device, z.RelayDevice, z.Field, z.Target, z.Hysteresis, z.Mode, z.Enabled))
+}
+
+func (s *Store) DeleteZone(ctx context.Context, id int) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tag, err := s.db.Exec(ctx, `DELETE FROM zones WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+func (s *Store) SetZoneRelay(ctx context.Context, e store.ZoneEvent) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `UPDATE zones SET relay = $2, changed_at = $3 WHERE id = $1`, e.ZoneId, e.State == "on", e.Timestamp)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return store.ErrNotFound
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO zone_history (zone_id, kind, state, value, target, timestamp)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, e.ZoneId, store.ZoneEventRelay, e.State, e.Value, e.Target, e.Timestamp)
+		return err
+	})
+}
+
+func (s *Store) SetZoneOverride(ctx context.Context, id int, override *bool, until, now int64) (store.Zone, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	var z store.Zone
+	err := pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		state := "auto"
+		if override == nil {
+			until = 0
+		} else if *override {
+			state = "on"
+		} else {
+			state = "off"
+		}
+		var err error
+		z, err = scanZone(tx.QueryRow(ctx, `
+			UPDATE zones SET override = $2, override_until = $3 WHERE id = $1
+			RETURNING `+zoneColumns, id, override, until))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `
+			INSERT INTO zone_history (zone_id, kind, state, value, target, timestamp)
+			VALUES ($1, $2, $3, 0, $4, $5)
+		`, id, store.ZoneEventOverride, state, z.Target, now)
+		return err
+	})
+	return z, err
+}
+
+func (s *Store) ListZoneHistory(ctx context.Context, id int, limit, offset int) ([]store.ZoneEvent, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.Query(ctx, `
+		SELECT id, zone_id, kind, state, value, target, timestamp
+		FROM zone_history
+		WHERE zone_id = $1
+		ORDER BY timestamp DESC, id DESC
+		LIMIT $2 OFFSET $3
+	`, id, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]store.ZoneEvent, 0)
+	for rows.Next() {
+		var e store.ZoneEvent
+		if err := rows.Scan(&e.Id, &e.ZoneId, &e.Kind, &e.State, &e.Value, &e.Target, &e.Timestamp); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *Store) GetAwayMode(ctx context.Context) (*store.AwayMode, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	var m store.AwayMode
+	err := s.db.QueryRow(ctx, `SELECT setpoint, since, until FROM away_mode WHERE id = 1`).Scan(&m.Setpoint, &m.Since, &m.Until)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *Store) SetAwayMode(ctx context.Context, m *store.AwayMode) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if m == nil {
+		_, err := s.db.Exec(ctx, `DELETE FROM away_mode`)
+		return err
+	}
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO away_mode (id, setpoint, since, until) VALUES (1, $1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET setpoint = EXCLUDED.setpoint, since = EXCLUDED.since, until = EXCLUDED.until
+	`, m.Setpoint, m.Since, m.Until)
+	return err
+}
+
+func (s *Store) EnqueueCommand(ctx context.Context, c store.Command) (store.Command, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	err := pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+			DELETE FROM device_commands WHERE device = $1 AND type = $2 AND acked_at IS NULL
+		`, c.Device, c.Type)
+		if err != nil {
+			return err
+		}
+		return tx.QueryRow(ctx, `
+			INSERT INTO device_commands (device, type, value, created_at)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id
+		`, c.Device, c.Type, c.Value, c.CreatedAt).Scan(&c.Id)
+	})
+	c.AckedAt = nil
+	return c, err
+}
+
+func (s *Store) PendingCommands(ctx context.Context, device string) ([]store.Command, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.Query(ctx, `
+		SELECT id, device, type, value, created_at, acked_at
+		FROM device_commands
+		WHERE device = $1 AND acked_at IS NULL
+		ORDER BY id
+	`, device)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	commands := make([]store.Command, 0)
+	for rows.Next() {
+		var c store.Command
+		if err := rows.Scan(&c.Id, &c.Device, &c.Type, &c.Value, &c.CreatedAt, &c.AckedAt); err != nil {
+			return nil, err
+		}
+		commands = append(commands, c)
+	}
+	return commands, rows.Err()
+}
+
+func (s *Store) AckCommand(ctx context.Context, device string, id int64, now int64) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tag, err := s.db.Exec(ctx, `
+		UPDATE device_commands SET acked_at = $3 WHERE id = $1 AND device = $2 AND acked_at IS NULL
+	`, id, device, now)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
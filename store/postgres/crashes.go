@@ -0,0 +1,54 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.CrashStore = (*Store)(nil)
+
+func (s *Store) AddCrashReport(ctx context.Context, c store.CrashReport) (store.CrashReport, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	err := s.db.QueryRow(ctx, `
+		INSERT INTO crash_reports (device, reason, exception, stack, firmware, at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`, c.Device, c.Reason, c.Exception, c.Stack, c.Firmware, c.At).Scan(&c.Id)
+	return c, err
+}
+
+func (s *Store) ListCrashReports(ctx context.Context, device string, limit int) ([]store.CrashReport, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.Query(ctx, `
+		SELECT id, device, reason, exception, stack, firmware, at
+		FROM crash_reports
+		WHERE device = $1
+		ORDER BY at DESC, id DESC
+		LIMIT $2
+	`, device, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := make([]store.CrashReport, 0)
+	for rows.Next() {
+		var c store.CrashReport
+		if err := rows.Scan(&c.Id, &c.Device, &c.Reason, &c.Exception, &c.Stack, &c.Firmware, &c.At); err != nil {
+			return nil, err
+		}
+		reports = append(reports, c)
+	}
+	return reports, rows.Err()
+}
+
+func (s *Store) CountCrashReports(ctx context.Context, device string, since int64) (int, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	var n int
+	err := s.db.QueryRow(ctx, `SELECT count(*) FROM crash_reports WHERE device = $1 AND at >= $2`, device, since).Scan(&n)
+	return n, err
+}
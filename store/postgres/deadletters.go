@@ -0,0 +1,92 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/jackc/pgx/v5"
+)
+
+var _ store.DeadLetterStore = (*Store)(nil)
+
+const deadLetterColumns = `id, rule_id, rule_name, channel, subject, text, ack_url, error, attempts, failed_at`
+
+func scanDeadLetter(row pgx.Row) (store.DeadLetter, error) {
+	var d store.DeadLetter
+	err := row.Scan(&d.Id, &d.RuleId, &d.RuleName, &d.Channel, &d.Subject, &d.Text, &d.AckURL, &d.Error, &d.Attempts, &d.FailedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return d, store.ErrNotFound
+	}
+	return d, err
+}
+
+func (s *Store) AddDeadLetter(ctx context.Context, d store.DeadLetter) (store.DeadLetter, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	err := s.db.QueryRow(ctx, `
+		INSERT INTO notification_dead_letters (rule_id, rule_name, channel, subject, text, ack_url, error, attempts, failed_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id
+	`, d.RuleId, d.RuleName, d.Channel, d.Subject, d.Text, d.AckURL, d.Error, d.Attempts, d.FailedAt).Scan(&d.Id)
+	return d, err
+}
+
+func (s *Store) ListDeadLetters(ctx context.Context, limit int) ([]store.DeadLetter, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.Query(ctx, `
+		SELECT `+deadLetterColumns+`
+		FROM notification_dead_letters
+		ORDER BY id DESC
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := make([]store.DeadLetter, 0)
+	for rows.Next() {
+		d, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, d)
+	}
+	return letters, rows.Err()
+}
+
+func (s *Store) GetDeadLetter(ctx context.Context, id int) (store.DeadLetter, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return scanDeadLetter(s.db.QueryRow(ctx, `SELECT `+deadLetterColumns+` FROM notification_dead_letters WHERE id = $1`, id))
+}
+
+func (s *Store) UpdateDeadLetter(ctx context.Context, d store.DeadLetter) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tag, err := s.db.Exec(ctx, `
+		UPDATE notification_dead_letters SET error = $2, attempts = $3, failed_at = $4 WHERE id = $1
+	`, d.Id, d.Error, d.Attempts, d.FailedAt)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+func (s *Store) DeleteDeadLetter(ctx context.Context, id int) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tag, err := s.db.Exec(ctx, `DELETE FROM notification_dead_letters WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
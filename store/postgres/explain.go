@@ -0,0 +1,67 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/jackc/pgx/v5"
+)
+
+var _ store.ExplainStore = (*Store)(nil)
+
+// ExplainReadings runs the very statement the listing would, with the same
+// parameters, under EXPLAIN (ANALYZE, BUFFERS). ANALYZE executes it, so it
+// runs in a read-only transaction that is rolled back.
+func (s *Store) ExplainReadings(ctx context.Context, q *store.ReadingQuery, half int64, limit, offset int) (store.QueryPlan, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+
+	var (
+		query string
+		args  []any
+	)
+	switch {
+	case half > 0:
+		query, args = smoothedQuery(limit, offset, half)
+	case q != nil:
+		var err error
+		if query, args, err = filteredQuery(*q, limit, offset); err != nil {
+			return store.QueryPlan{}, err
+		}
+	default:
+		query, args = listQuery(limit, offset)
+	}
+
+	tx, err := s.db.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return store.QueryPlan{}, fmt.Errorf("begin explain: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+	rows, err := tx.Query(ctx, `EXPLAIN (ANALYZE, BUFFERS) `+query, args...)
+	if err != nil {
+		return store.QueryPlan{}, err
+	}
+	plan, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return store.QueryPlan{}, err
+	}
+	return store.QueryPlan{Statement: dedent(query), Parameters: args, Plan: plan}, nil
+}
+
+// dedent removes the indentation common to the lines of a statement
+// written inline.
+func dedent(query string) string {
+	lines := strings.Split(strings.Trim(query, "\n\t "), "\n")
+	indent := -1
+	for _, line := range lines[1:] {
+		if n := len(line) - len(strings.TrimLeft(line, "\t")); n < len(line) && (indent < 0 || n < indent) {
+			indent = n
+		}
+	}
+	for i := 1; i < len(lines) && indent > 0; i++ {
+		lines[i] = lines[i][min(indent, len(lines[i])):]
+	}
+	return strings.Join(lines, "\n")
+}
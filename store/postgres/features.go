@@ -0,0 +1,77 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/jackc/pgx/v5"
+)
+
+var _ store.FeatureStore = (*Store)(nil)
+
+func (s *Store) FeatureFlags(ctx context.Context) (map[string]bool, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.Query(ctx, `SELECT name, value FROM feature_flags`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flags := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		var value bool
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		flags[name] = value
+	}
+	return flags, rows.Err()
+}
+
+func (s *Store) SetFeatureFlags(ctx context.Context, changes []store.FeatureChange) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		for _, c := range changes {
+			if _, err := tx.Exec(ctx, `
+				INSERT INTO feature_flags (name, value) VALUES ($1, $2)
+				ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value
+			`, c.Name, c.Value); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(ctx, `
+				INSERT INTO feature_flag_changes (name, value, actor, timestamp) VALUES ($1, $2, $3, $4)
+			`, c.Name, c.Value, c.Actor, c.At); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) ListFeatureChanges(ctx context.Context, limit int) ([]store.FeatureChange, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.Query(ctx, `
+		SELECT id, name, value, actor, timestamp
+		FROM feature_flag_changes
+		ORDER BY timestamp DESC, id DESC
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := make([]store.FeatureChange, 0)
+	for rows.Next() {
+		var c store.FeatureChange
+		if err := rows.Scan(&c.Id, &c.Name, &c.Value, &c.Actor, &c.At); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
@@ -0,0 +1,40 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.FirmwareStore = (*Store)(nil)
+
+func (s *Store) SetDeviceFirmware(ctx context.Context, device, version string, at int64) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO device_firmware (device, version, since) VALUES ($1, $2, $3)
+		ON CONFLICT (device) DO UPDATE SET version = EXCLUDED.version, since = EXCLUDED.since
+		WHERE device_firmware.version <> EXCLUDED.version
+	`, device, version, at)
+	return err
+}
+
+func (s *Store) DeviceFirmware(ctx context.Context) ([]store.DeviceFirmware, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.Query(ctx, `SELECT device, version, since FROM device_firmware ORDER BY device`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	firmware := make([]store.DeviceFirmware, 0)
+	for rows.Next() {
+		var f store.DeviceFirmware
+		if err := rows.Scan(&f.Device, &f.Version, &f.Since); err != nil {
+			return nil, err
+		}
+		firmware = append(firmware, f)
+	}
+	return firmware, rows.Err()
+}
@@ -0,0 +1,83 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/jackc/pgx/v5"
+)
+
+var _ store.ImportStore = (*Store)(nil)
+
+// ImportReadings copies the readings into a temporary table and resolves
+// conflicts against readings in bulk. created_at is when a reading was
+// stored, so it is set to StoredAt for later imports keeping the newer.
+func (s *Store) ImportReadings(ctx context.Context, device string, readings []store.ImportReading, conflict string) (store.ImportResult, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return store.ImportResult{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `
+		CREATE TEMP TABLE import_readings (
+			temp_co DOUBLE PRECISION,
+			temp_room DOUBLE PRECISION,
+			humidity DOUBLE PRECISION,
+			timestamp BIGINT NOT NULL,
+			stored_at BIGINT
+		) ON COMMIT DROP
+	`); err != nil {
+		return store.ImportResult{}, fmt.Errorf("create import table: %w", err)
+	}
+	if _, err := tx.CopyFrom(ctx,
+		pgx.Identifier{"import_readings"},
+		[]string{"temp_co", "temp_room", "humidity", "timestamp", "stored_at"},
+		pgx.CopyFromSlice(len(readings), func(i int) ([]any, error) {
+			r := readings[i]
+			return []any{r.TempCo, r.TempRoom, r.Humidity, r.Timestamp, r.StoredAt}, nil
+		}),
+	); err != nil {
+		return store.ImportResult{}, fmt.Errorf("copy import readings: %w", err)
+	}
+	// created_at is a TIMESTAMP in the session's time zone, the way it
+	// defaults to NOW().
+	const storedAt = `COALESCE(to_timestamp(i.stored_at)::TIMESTAMP, LOCALTIMESTAMP)`
+	// imported readings are received now, whenever they were stored
+	const receivedAt = `EXTRACT(EPOCH FROM NOW())::BIGINT`
+
+	var result store.ImportResult
+	if conflict != store.ConflictSkip {
+		newer := ""
+		if conflict == store.ConflictKeepNewer {
+			newer = "AND " + storedAt + " > r.created_at"
+		}
+		if err := tx.QueryRow(ctx, `
+			WITH updated AS (
+				UPDATE readings r
+				SET temp_co = i.temp_co, temp_room = i.temp_room, humidity = i.humidity, created_at = `+storedAt+`, received_at = `+receivedAt+`
+				FROM import_readings i
+				WHERE r.device = $1 AND r.timestamp = i.timestamp `+newer+`
+				RETURNING r.timestamp
+			)
+			SELECT count(DISTINCT timestamp) FROM updated
+		`, device).Scan(&result.Overwritten); err != nil {
+			return store.ImportResult{}, fmt.Errorf("overwrite readings: %w", err)
+		}
+	}
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO readings (temp_co, temp_room, humidity, timestamp, device, created_at, received_at)
+		SELECT i.temp_co, i.temp_room, i.humidity, i.timestamp, $1, `+storedAt+`, `+receivedAt+`
+		FROM import_readings i
+		WHERE NOT EXISTS (SELECT 1 FROM readings r WHERE r.device = $1 AND r.timestamp = i.timestamp)
+	`, device)
+	if err != nil {
+		return store.ImportResult{}, fmt.Errorf("insert readings: %w", err)
+	}
+	result.Inserted = int(tag.RowsAffected())
+	result.Skipped = len(readings) - result.Inserted - result.Overwritten
+	return result, tx.Commit(ctx)
+}
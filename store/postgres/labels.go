@@ -0,0 +1,51 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/jackc/pgx/v5"
+)
+
+var _ store.LabelStore = (*Store)(nil)
+
+func (s *Store) DeviceLabels(ctx context.Context) (map[string]map[string]string, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.Query(ctx, `SELECT device, key, value FROM device_labels`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := make(map[string]map[string]string)
+	for rows.Next() {
+		var device, key, value string
+		if err := rows.Scan(&device, &key, &value); err != nil {
+			return nil, err
+		}
+		if labels[device] == nil {
+			labels[device] = make(map[string]string)
+		}
+		labels[device][key] = value
+	}
+	return labels, rows.Err()
+}
+
+func (s *Store) SetDeviceLabels(ctx context.Context, device string, labels map[string]string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM device_labels WHERE device = $1`, device); err != nil {
+			return err
+		}
+		for key, value := range labels {
+			if _, err := tx.Exec(ctx, `
+				INSERT INTO device_labels (device, key, value) VALUES ($1, $2, $3)
+			`, device, key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
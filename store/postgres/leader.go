@@ -0,0 +1,120 @@
+package postgres
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// leaderLockKey is the advisory lock held by the leader, "esp8266" in
+// ASCII.
+const leaderLockKey int64 = 0x65737038323636
+
+// DefaultLeaderInterval is how often a follower tries to take the lead and
+// the leader checks that it still holds it.
+const DefaultLeaderInterval = 5 * time.Second
+
+// Elector elects one of the replicas sharing a database to run the
+// background jobs. The leader holds a session advisory lock on a
+// connection of its own, so the lock is released when it stops or its
+// connection is lost, and a follower takes over within the interval. The
+// connection must reach PostgreSQL directly, as PgBouncer in transaction
+// pooling mode doesn't keep session locks.
+type Elector struct {
+	pool     *pgxpool.Pool
+	interval time.Duration
+	logger   *slog.Logger
+	leader   atomic.Bool
+}
+
+// NewElector elects among the replicas using s's database, checking every
+// interval.
+func NewElector(s *Store, interval time.Duration, logger *slog.Logger) *Elector {
+	if interval <= 0 {
+		interval = DefaultLeaderInterval
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Elector{pool: s.db, interval: interval, logger: logger}
+}
+
+// IsLeader reports whether this replica runs the background jobs.
+func (e *Elector) IsLeader() bool {
+	return e.leader.Load()
+}
+
+// Run runs jobs while this replica leads, each with a context cancelled
+// once it stops leading, until ctx is done.
+func (e *Elector) Run(ctx context.Context, jobs ...func(context.Context)) {
+	for {
+		if err := e.tryLead(ctx, jobs); err != nil && ctx.Err() == nil {
+			e.logger.Error("leader election failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(e.interval):
+		}
+	}
+}
+
+// tryLead takes the lock when it's free and then leads until the lock is
+// lost or ctx is done.
+func (e *Elector) tryLead(ctx context.Context, jobs []func(context.Context)) error {
+	conn, err := e.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	var locked bool
+	if err := conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, leaderLockKey).Scan(&locked); err != nil || !locked {
+		conn.Release()
+		return err
+	}
+
+	e.leader.Store(true)
+	e.logger.Info("leading the background jobs")
+	jobCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			job(jobCtx)
+		}()
+	}
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	var lost error
+	for lost == nil && ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+			pingCtx, cancelPing := context.WithTimeout(ctx, e.interval)
+			lost = conn.Ping(pingCtx)
+			cancelPing()
+		}
+	}
+	cancel()
+	wg.Wait()
+	e.leader.Store(false)
+
+	if lost != nil {
+		// the session and its lock may be gone, don't reuse the connection
+		conn.Conn().Close(context.Background())
+		conn.Release()
+		e.logger.Warn("lost the lead of the background jobs", "error", lost)
+		return nil
+	}
+	unlockCtx, cancelUnlock := context.WithTimeout(context.Background(), e.interval)
+	defer cancelUnlock()
+	_, err = conn.Exec(unlockCtx, `SELECT pg_advisory_unlock($1)`, leaderLockKey)
+	conn.Release()
+	e.logger.Info("stopped leading the background jobs")
+	return err
+}
@@ -0,0 +1,124 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/jackc/pgx/v5"
+)
+
+var _ store.LocationStore = (*Store)(nil)
+
+const locationColumns = `id, name, kind, parent_id,
+	ARRAY(SELECT device FROM location_devices WHERE location_id = locations.id ORDER BY device)`
+
+func scanLocation(row pgx.Row) (store.Location, error) {
+	var l store.Location
+	err := row.Scan(&l.Id, &l.Name, &l.Kind, &l.ParentId, &l.Devices)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return l, store.ErrNotFound
+	}
+	return l, err
+}
+
+func (s *Store) ListLocations(ctx context.Context) ([]store.Location, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.Query(ctx, `SELECT `+locationColumns+` FROM locations ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locations := make([]store.Location, 0)
+	for rows.Next() {
+		l, err := scanLocation(rows)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, l)
+	}
+	return locations, rows.Err()
+}
+
+func (s *Store) GetLocation(ctx context.Context, id int) (store.Location, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return scanLocation(s.db.QueryRow(ctx, `SELECT `+locationColumns+` FROM locations WHERE id = $1`, id))
+}
+
+// placeDevices replaces the devices placed in the location, moving them
+// from wherever they were placed before.
+func placeDevices(ctx context.Context, tx pgx.Tx, id int, devices []string) error {
+	if _, err := tx.Exec(ctx, `
+		DELETE FROM location_devices WHERE location_id = $1 OR device = ANY($2)
+	`, id, devices); err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO location_devices (device, location_id) VALUES ($1, $2)
+		`, device, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) CreateLocation(ctx context.Context, l store.Location) (store.Location, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	var created store.Location
+	err := pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		var id int
+		if err := tx.QueryRow(ctx, `
+			INSERT INTO locations (name, kind, parent_id) VALUES ($1, $2, $3) RETURNING id
+		`, l.Name, l.Kind, l.ParentId).Scan(&id); err != nil {
+			return err
+		}
+		if err := placeDevices(ctx, tx, id, l.Devices); err != nil {
+			return err
+		}
+		var err error
+		created, err = scanLocation(tx.QueryRow(ctx, `SELECT `+locationColumns+` FROM locations WHERE id = $1`, id))
+		return err
+	})
+	return created, err
+}
+
+func (s *Store) UpdateLocation(ctx context.Context, l store.Location) (store.Location, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	var updated store.Location
+	err := pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `
+			UPDATE locations SET name = $2, kind = $3, parent_id = $4 WHERE id = $1
+		`, l.Id, l.Name, l.Kind, l.ParentId)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return store.ErrNotFound
+		}
+		if err := placeDevices(ctx, tx, l.Id, l.Devices); err != nil {
+			return err
+		}
+		updated, err = scanLocation(tx.QueryRow(ctx, `SELECT `+locationColumns+` FROM locations WHERE id = $1`, l.Id))
+		return err
+	})
+	return updated, err
+}
+
+func (s *Store) DeleteLocation(ctx context.Context, id int) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tag, err := s.db.Exec(ctx, `DELETE FROM locations WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
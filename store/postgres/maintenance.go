@@ -0,0 +1,83 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/jackc/pgx/v5"
+)
+
+var _ store.MaintenanceStore = (*Store)(nil)
+
+// Maintain runs op on a table of the current schema, or on the whole
+// schema when table is empty. VACUUM can't run in a transaction, so every
+// statement runs on its own.
+func (s *Store) Maintain(ctx context.Context, op, table string) error {
+	target := ""
+	if table != "" {
+		var exists bool
+		if err := s.db.QueryRow(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM pg_tables WHERE schemaname = current_schema() AND tablename = $1
+				UNION ALL
+				SELECT 1 FROM pg_matviews WHERE schemaname = current_schema() AND matviewname = $1
+			)
+		`, table).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return store.ErrNotFound
+		}
+		target = pgx.Identifier{table}.Sanitize()
+	}
+
+	switch op {
+	case store.MaintenanceVacuum:
+		_, err := s.db.Exec(ctx, "VACUUM (ANALYZE) "+target)
+		return err
+	case store.MaintenanceAnalyze:
+		_, err := s.db.Exec(ctx, "ANALYZE "+target)
+		return err
+	case store.MaintenanceReindex:
+		if target == "" {
+			var schema string
+			if err := s.db.QueryRow(ctx, `SELECT current_schema()`).Scan(&schema); err != nil {
+				return err
+			}
+			_, err := s.db.Exec(ctx, "REINDEX SCHEMA "+pgx.Identifier{schema}.Sanitize())
+			return err
+		}
+		_, err := s.db.Exec(ctx, "REINDEX TABLE "+target)
+		return err
+	case store.MaintenanceRefresh:
+		return s.refreshViews(ctx, table)
+	}
+	return fmt.Errorf("unknown maintenance operation %q", op)
+}
+
+// refreshViews refreshes the materialized view table or, when it is empty,
+// every materialized view of the current schema.
+func (s *Store) refreshViews(ctx context.Context, table string) error {
+	rows, err := s.db.Query(ctx, `
+		SELECT matviewname FROM pg_matviews
+		WHERE schemaname = current_schema() AND ($1 = '' OR matviewname = $1)
+		ORDER BY matviewname
+	`, table)
+	if err != nil {
+		return err
+	}
+	views, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	if table != "" && len(views) == 0 {
+		return fmt.Errorf("%s is not a materialized view", table)
+	}
+	for _, v := range views {
+		if _, err := s.db.Exec(ctx, "REFRESH MATERIALIZED VIEW "+pgx.Identifier{v}.Sanitize()); err != nil {
+			return fmt.Errorf("refresh %s: %w", v, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,606 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// migrations are applied in order and must never be edited once released;
+// add a new entry instead.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create_readings",
+		up: `
+			CREATE TABLE IF NOT EXISTS readings (
+				id SERIAL PRIMARY KEY,
+				temp_co DOUBLE PRECISION,
+				temp_room DOUBLE PRECISION,
+				timestamp BIGINT,
+				created_at TIMESTAMP DEFAULT NOW()
+			)
+		`,
+		down: `
+			DROP TABLE IF EXISTS readings
+		`,
+	},
+	{
+		version: 2,
+		name:    "add_readings_humidity",
+		up: `
+			ALTER TABLE readings ADD COLUMN IF NOT EXISTS humidity DOUBLE PRECISION NOT NULL DEFAULT 0.0
+		`,
+		down: `
+			ALTER TABLE readings DROP COLUMN IF EXISTS humidity
+		`,
+	},
+	{
+		version: 3,
+		name:    "readings_not_null_defaults",
+		up: `
+			ALTER TABLE readings ALTER COLUMN temp_co SET DEFAULT 0.0;
+			ALTER TABLE readings ALTER COLUMN temp_co SET NOT NULL;
+			ALTER TABLE readings ALTER COLUMN temp_room SET DEFAULT 0.0;
+			ALTER TABLE readings ALTER COLUMN temp_room SET NOT NULL;
+			ALTER TABLE readings ALTER COLUMN timestamp SET DEFAULT 0;
+			ALTER TABLE readings ALTER COLUMN timestamp SET NOT NULL
+		`,
+		down: `
+			ALTER TABLE readings ALTER COLUMN temp_co DROP NOT NULL;
+			ALTER TABLE readings ALTER COLUMN temp_co DROP DEFAULT;
+			ALTER TABLE readings ALTER COLUMN temp_room DROP NOT NULL;
+			ALTER TABLE readings ALTER COLUMN temp_room DROP DEFAULT;
+			ALTER TABLE readings ALTER COLUMN timestamp DROP NOT NULL;
+			ALTER TABLE readings ALTER COLUMN timestamp DROP DEFAULT
+		`,
+	},
+	{
+		version: 4,
+		name:    "create_sync_state",
+		up: `
+			CREATE TABLE IF NOT EXISTS sync_state (
+				device TEXT PRIMARY KEY,
+				acked_seq BIGINT NOT NULL,
+				updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			)
+		`,
+		down: `
+			DROP TABLE IF EXISTS sync_state
+		`,
+	},
+	{
+		version: 5,
+		name:    "create_alerts",
+		up: `
+			CREATE TABLE IF NOT EXISTS alert_rules (
+				id SERIAL PRIMARY KEY,
+				name TEXT NOT NULL,
+				field TEXT NOT NULL,
+				op TEXT NOT NULL,
+				threshold DOUBLE PRECISION NOT NULL,
+				severity TEXT NOT NULL DEFAULT 'warning',
+				enabled BOOLEAN NOT NULL DEFAULT TRUE,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			);
+			CREATE TABLE IF NOT EXISTS alert_state (
+				rule_id INTEGER PRIMARY KEY REFERENCES alert_rules (id) ON DELETE CASCADE,
+				since BIGINT NOT NULL,
+				value DOUBLE PRECISION NOT NULL
+			);
+			CREATE TABLE IF NOT EXISTS alert_history (
+				id BIGSERIAL PRIMARY KEY,
+				rule_id INTEGER NOT NULL,
+				rule_name TEXT NOT NULL,
+				state TEXT NOT NULL,
+				value DOUBLE PRECISION NOT NULL,
+				timestamp BIGINT NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS alert_history_timestamp_idx ON alert_history (timestamp)
+		`,
+		down: `
+			DROP TABLE IF EXISTS alert_history;
+			DROP TABLE IF EXISTS alert_state;
+			DROP TABLE IF EXISTS alert_rules
+		`,
+	},
+	{
+		version: 6,
+		name:    "create_alert_silences",
+		up: `
+			CREATE TABLE IF NOT EXISTS alert_silences (
+				id SERIAL PRIMARY KEY,
+				matchers JSONB NOT NULL,
+				comment TEXT NOT NULL DEFAULT '',
+				starts_at BIGINT NOT NULL,
+				ends_at BIGINT NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS alert_silences_ends_at_idx ON alert_silences (ends_at)
+		`,
+		down: `
+			DROP TABLE IF EXISTS alert_silences
+		`,
+	},
+	{
+		version: 7,
+		name:    "add_alert_escalation",
+		up: `
+			ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS escalation JSONB NOT NULL DEFAULT '[]';
+			ALTER TABLE alert_state
+				ADD COLUMN IF NOT EXISTS fired_at BIGINT NOT NULL DEFAULT 0,
+				ADD COLUMN IF NOT EXISTS acked_at BIGINT,
+				ADD COLUMN IF NOT EXISTS notified INTEGER NOT NULL DEFAULT 0,
+				ADD COLUMN IF NOT EXISTS ack_token TEXT NOT NULL DEFAULT '';
+			CREATE INDEX IF NOT EXISTS alert_state_ack_token_idx ON alert_state (ack_token)
+		`,
+		down: `
+			DROP INDEX IF EXISTS alert_state_ack_token_idx;
+			ALTER TABLE alert_state
+				DROP COLUMN IF EXISTS ack_token,
+				DROP COLUMN IF EXISTS notified,
+				DROP COLUMN IF EXISTS acked_at,
+				DROP COLUMN IF EXISTS fired_at;
+			ALTER TABLE alert_rules DROP COLUMN IF EXISTS escalation
+		`,
+	},
+	{
+		version: 8,
+		name:    "add_alert_templates_and_device",
+		up: `
+			ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS templates JSONB NOT NULL DEFAULT '{}';
+			ALTER TABLE alert_state ADD COLUMN IF NOT EXISTS device TEXT NOT NULL DEFAULT ''
+		`,
+		down: `
+			ALTER TABLE alert_state DROP COLUMN IF EXISTS device;
+			ALTER TABLE alert_rules DROP COLUMN IF EXISTS templates
+		`,
+	},
+	{
+		version: 9,
+		name:    "create_zones_and_device_commands",
+		up: `
+			CREATE TABLE IF NOT EXISTS zones (
+				id SERIAL PRIMARY KEY,
+				name TEXT NOT NULL,
+				device TEXT NOT NULL DEFAULT '',
+				relay_device TEXT NOT NULL,
+				field TEXT NOT NULL,
+				target DOUBLE PRECISION NOT NULL,
+				hysteresis DOUBLE PRECISION NOT NULL,
+				mode TEXT NOT NULL,
+				enabled BOOLEAN NOT NULL DEFAULT TRUE,
+				override BOOLEAN,
+				override_until BIGINT NOT NULL DEFAULT 0,
+				relay BOOLEAN,
+				changed_at BIGINT NOT NULL DEFAULT 0
+			);
+			CREATE TABLE IF NOT EXISTS zone_history (
+				id BIGSERIAL PRIMARY KEY,
+				zone_id INTEGER NOT NULL,
+				kind TEXT NOT NULL,
+				state TEXT NOT NULL,
+				value DOUBLE PRECISION NOT NULL,
+				target DOUBLE PRECISION NOT NULL,
+				timestamp BIGINT NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS zone_history_zone_id_timestamp_idx ON zone_history (zone_id, timestamp);
+			CREATE TABLE IF NOT EXISTS device_commands (
+				id BIGSERIAL PRIMARY KEY,
+				device TEXT NOT NULL,
+				type TEXT NOT NULL,
+				value TEXT NOT NULL,
+				created_at BIGINT NOT NULL,
+				acked_at BIGINT
+			);
+			CREATE INDEX IF NOT EXISTS device_commands_pending_idx ON device_commands (device) WHERE acked_at IS NULL
+		`,
+		down: `
+			DROP TABLE IF EXISTS device_commands;
+			DROP TABLE IF EXISTS zone_history;
+			DROP TABLE IF EXISTS zones
+		`,
+	},
+	{
+		version: 10,
+		name:    "create_away_mode",
+		up: `
+			CREATE TABLE IF NOT EXISTS away_mode (
+				id INTEGER PRIMARY KEY CHECK (id = 1),
+				setpoint DOUBLE PRECISION NOT NULL,
+				since BIGINT NOT NULL,
+				until BIGINT NOT NULL
+			)
+		`,
+		down: `
+			DROP TABLE IF EXISTS away_mode
+		`,
+	},
+	{
+		version: 11,
+		name:    "create_outdoor_readings",
+		up: `
+			CREATE TABLE IF NOT EXISTS outdoor_readings (
+				timestamp BIGINT PRIMARY KEY,
+				temp DOUBLE PRECISION NOT NULL,
+				humidity DOUBLE PRECISION NOT NULL
+			)
+		`,
+		down: `
+			DROP TABLE IF EXISTS outdoor_readings
+		`,
+	},
+	{
+		version: 12,
+		name:    "create_readings_timestamp_idx",
+		up: `
+			CREATE INDEX IF NOT EXISTS readings_timestamp_idx ON readings (timestamp)
+		`,
+		down: `
+			DROP INDEX IF EXISTS readings_timestamp_idx
+		`,
+	},
+	{
+		version: 13,
+		name:    "add_readings_device_and_device_labels",
+		up: `
+			ALTER TABLE readings ADD COLUMN IF NOT EXISTS device TEXT NOT NULL DEFAULT '';
+			CREATE INDEX IF NOT EXISTS readings_device_timestamp_idx ON readings (device, timestamp);
+			CREATE TABLE IF NOT EXISTS device_labels (
+				device TEXT NOT NULL,
+				key TEXT NOT NULL,
+				value TEXT NOT NULL,
+				PRIMARY KEY (device, key)
+			)
+		`,
+		down: `
+			DROP TABLE IF EXISTS device_labels;
+			DROP INDEX IF EXISTS readings_device_timestamp_idx;
+			ALTER TABLE readings DROP COLUMN IF EXISTS device
+		`,
+	},
+	{
+		version: 14,
+		name:    "create_locations",
+		up: `
+			CREATE TABLE IF NOT EXISTS locations (
+				id SERIAL PRIMARY KEY,
+				name TEXT NOT NULL,
+				kind TEXT NOT NULL,
+				parent_id INTEGER REFERENCES locations (id) ON DELETE SET NULL
+			);
+			CREATE TABLE IF NOT EXISTS location_devices (
+				device TEXT PRIMARY KEY,
+				location_id INTEGER NOT NULL REFERENCES locations (id) ON DELETE CASCADE
+			)
+		`,
+		down: `
+			DROP TABLE IF EXISTS location_devices;
+			DROP TABLE IF EXISTS locations
+		`,
+	},
+	{
+		version: 15,
+		name:    "create_api_keys",
+		up: `
+			CREATE TABLE IF NOT EXISTS api_keys (
+				name TEXT PRIMARY KEY,
+				hash TEXT NOT NULL,
+				scopes TEXT[] NOT NULL,
+				created_at BIGINT NOT NULL
+			)
+		`,
+		down: `
+			DROP TABLE IF EXISTS api_keys
+		`,
+	},
+	{
+		version: 16,
+		name:    "create_feature_flags",
+		up: `
+			CREATE TABLE IF NOT EXISTS feature_flags (
+				name TEXT PRIMARY KEY,
+				value BOOLEAN NOT NULL
+			);
+			CREATE TABLE IF NOT EXISTS feature_flag_changes (
+				id BIGSERIAL PRIMARY KEY,
+				name TEXT NOT NULL,
+				value BOOLEAN NOT NULL,
+				actor TEXT NOT NULL,
+				timestamp BIGINT NOT NULL
+			)
+		`,
+		down: `
+			DROP TABLE IF EXISTS feature_flag_changes;
+			DROP TABLE IF EXISTS feature_flags
+		`,
+	},
+	{
+		version: 17,
+		name:    "create_notification_dead_letters",
+		up: `
+			CREATE TABLE IF NOT EXISTS notification_dead_letters (
+				id SERIAL PRIMARY KEY,
+				rule_id INTEGER NOT NULL,
+				rule_name TEXT NOT NULL,
+				channel TEXT NOT NULL,
+				subject TEXT NOT NULL,
+				text TEXT NOT NULL,
+				ack_url TEXT NOT NULL,
+				error TEXT NOT NULL,
+				attempts INTEGER NOT NULL,
+				failed_at BIGINT NOT NULL
+			)
+		`,
+		down: `
+			DROP TABLE IF EXISTS notification_dead_letters
+		`,
+	},
+	{
+		version: 18,
+		name:    "create_device_firmware",
+		up: `
+			CREATE TABLE IF NOT EXISTS device_firmware (
+				device TEXT PRIMARY KEY,
+				version TEXT NOT NULL,
+				since BIGINT NOT NULL
+			)
+		`,
+		down: `
+			DROP TABLE IF EXISTS device_firmware
+		`,
+	},
+	{
+		version: 19,
+		name:    "create_crash_reports",
+		up: `
+			CREATE TABLE IF NOT EXISTS crash_reports (
+				id BIGSERIAL PRIMARY KEY,
+				device TEXT NOT NULL,
+				reason TEXT NOT NULL,
+				exception INTEGER,
+				stack TEXT NOT NULL,
+				firmware TEXT NOT NULL,
+				at BIGINT NOT NULL
+			);
+			CREATE INDEX IF NOT EXISTS crash_reports_device_at_idx ON crash_reports (device, at)
+		`,
+		down: `
+			DROP TABLE IF EXISTS crash_reports
+		`,
+	},
+	{
+		version: 20,
+		name:    "add_readings_received_at",
+		up: `
+			ALTER TABLE readings ADD COLUMN IF NOT EXISTS received_at BIGINT;
+			-- created_at is when a reading was stored, in the session's
+			-- time zone, close enough for readings received before
+			UPDATE readings SET received_at = EXTRACT(EPOCH FROM created_at::TIMESTAMPTZ)::BIGINT
+			WHERE received_at IS NULL AND created_at IS NOT NULL;
+			CREATE INDEX IF NOT EXISTS readings_received_at_idx ON readings (received_at DESC NULLS LAST)
+		`,
+		down: `
+			DROP INDEX IF EXISTS readings_received_at_idx;
+			ALTER TABLE readings DROP COLUMN IF EXISTS received_at
+		`,
+	},
+	{
+		version: 21,
+		name:    "add_readings_quality",
+		up: `
+			ALTER TABLE readings ADD COLUMN IF NOT EXISTS quality TEXT NOT NULL DEFAULT 'ok'
+				CHECK (quality IN ('ok', 'suspect', 'interpolated', 'calibrated', 'anomalous'));
+			-- most readings are ok, only the flagged ones are worth indexing
+			CREATE INDEX IF NOT EXISTS readings_quality_idx ON readings (quality) WHERE quality <> 'ok'
+		`,
+		down: `
+			DROP INDEX IF EXISTS readings_quality_idx;
+			ALTER TABLE readings DROP COLUMN IF EXISTS quality
+		`,
+	},
+	{
+		version: 22,
+		name:    "add_api_keys_device",
+		up: `
+			ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS device TEXT NOT NULL DEFAULT ''
+		`,
+		down: `
+			ALTER TABLE api_keys DROP COLUMN IF EXISTS device
+		`,
+	},
+	{
+		version: 23,
+		name:    "add_api_keys_key_id",
+		up: `
+			ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS key_id TEXT NOT NULL DEFAULT '';
+			CREATE UNIQUE INDEX IF NOT EXISTS api_keys_key_id_idx ON api_keys (key_id) WHERE key_id <> ''
+		`,
+		down: `
+			DROP INDEX IF EXISTS api_keys_key_id_idx;
+			ALTER TABLE api_keys DROP COLUMN IF EXISTS key_id
+		`,
+	},
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+// migrationLockKey is the advisory lock serializing migrations, "migrate"
+// in ASCII.
+const migrationLockKey int64 = 0x6d696772617465
+
+// inMigrationLock runs fn in a transaction holding the migration lock, so
+// replicas starting at once apply every migration once rather than racing
+// on the DDL. It's a transaction lock, which works through PgBouncer too.
+func (s *Store) inMigrationLock(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	return pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLockKey); err != nil {
+			return fmt.Errorf("take migration lock: %w", err)
+		}
+		return fn(tx)
+	})
+}
+
+func (s *Store) ensureMigrationsTable(ctx context.Context) error {
+	return s.inMigrationLock(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+			CREATE TABLE IF NOT EXISTS schema_migrations (
+				version INTEGER PRIMARY KEY,
+				name TEXT NOT NULL,
+				applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			)
+		`)
+		return err
+	})
+}
+
+// isApplied reports whether the migration of version was applied, within
+// the migration lock.
+func isApplied(ctx context.Context, tx pgx.Tx, version int) (bool, error) {
+	var applied bool
+	err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, version).Scan(&applied)
+	return applied, err
+}
+
+func (s *Store) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	rows, err := s.db.Query(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// MigrationStatus lists every known migration and when it was applied.
+func (s *Store) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	if err := s.ensureMigrationsTable(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		st := MigrationStatus{Version: m.version, Name: m.name}
+		if t, ok := applied[m.version]; ok {
+			st.AppliedAt = &t
+		}
+		status = append(status, st)
+	}
+	return status, nil
+}
+
+// Migrate applies every pending migration.
+func (s *Store) Migrate(ctx context.Context) error {
+	return s.MigrateUp(ctx, nil)
+}
+
+// MigrateUp applies every pending migration. When dryRun is not nil the SQL
+// is written to it instead of being executed.
+func (s *Store) MigrateUp(ctx context.Context, dryRun io.Writer) error {
+	slog.Debug("Applying migrations")
+	if err := s.ensureMigrationsTable(ctx); err != nil {
+		return err
+	}
+	applied, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+	for version := range applied {
+		if version > latest {
+			// migrations only add, so the schema still suits this binary
+			slog.Warn("Database schema is newer than this binary", "version", version, "latest_known", latest)
+			break
+		}
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		if dryRun != nil {
+			fmt.Fprintf(dryRun, "-- %d %s (up)\n%s\n", m.version, m.name, m.up)
+			continue
+		}
+		err := s.inMigrationLock(ctx, func(tx pgx.Tx) error {
+			// another replica may have applied it while we waited
+			if done, err := isApplied(ctx, tx, m.version); err != nil || done {
+				return err
+			}
+			if _, err := tx.Exec(ctx, m.up); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.version, m.name)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.version, m.name, err)
+		}
+		slog.Debug("Migration applied", "version", m.version, "name", m.name)
+	}
+	slog.Debug("Migrations applied successfully")
+	return nil
+}
+
+// MigrateDown reverts the n most recently applied migrations. When dryRun is
+// not nil the SQL is written to it instead of being executed.
+func (s *Store) MigrateDown(ctx context.Context, n int, dryRun io.Writer) error {
+	if err := s.ensureMigrationsTable(ctx); err != nil {
+		return err
+	}
+	applied, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0 && n > 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		n--
+		if dryRun != nil {
+			fmt.Fprintf(dryRun, "-- %d %s (down)\n%s\n", m.version, m.name, m.down)
+			continue
+		}
+		err := s.inMigrationLock(ctx, func(tx pgx.Tx) error {
+			if done, err := isApplied(ctx, tx, m.version); err != nil || !done {
+				return err
+			}
+			if _, err := tx.Exec(ctx, m.down); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.version, m.name, err)
+		}
+		slog.Debug("Migration reverted", "version", m.version, "name", m.name)
+	}
+	return nil
+}
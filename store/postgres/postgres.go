@@ -0,0 +1,262 @@
+// Package postgres implements store.Store on top of PostgreSQL.
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DefaultTimeout is how long a store call may take by default.
+const DefaultTimeout = 5 * time.Second
+
+type Store struct {
+	db      *pgxpool.Pool
+	timeout time.Duration
+}
+
+var _ store.Store = (*Store)(nil)
+
+// New wraps an existing pool. Closing the store closes the pool.
+func New(db *pgxpool.Pool) *Store {
+	return &Store{db: db, timeout: DefaultTimeout}
+}
+
+// SetTimeout sets how long a store call may take before its context is
+// cancelled, so a stuck query gives its connection back to the pool; 0
+// disables the timeout. Maintenance and migrations are never timed out.
+func (s *Store) SetTimeout(d time.Duration) {
+	s.timeout = d
+}
+
+// withTimeout derives the context of a store call.
+func (s *Store) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, s.timeout)
+}
+
+// Open connects to connString and verifies the connection.
+func Open(ctx context.Context, connString string) (*Store, error) {
+	config, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, fmt.Errorf("parse database config: %w", err)
+	}
+	return OpenConfig(ctx, config)
+}
+
+// OpenConfig is like Open but takes a parsed pool config, e.g. with a
+// BeforeConnect hook injecting rotating credentials.
+func OpenConfig(ctx context.Context, config *pgxpool.Config) (*Store, error) {
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("create database pool: %w", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("ping database: %w", err)
+	}
+	return New(pool), nil
+}
+
+// Pool exposes the underlying connection pool.
+func (s *Store) Pool() *pgxpool.Pool {
+	return s.db
+}
+
+func (s *Store) Ping(ctx context.Context) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.db.Ping(ctx)
+}
+
+func (s *Store) Close() {
+	s.db.Close()
+}
+
+// Reset closes idle connections and marks the others to be closed once
+// released, so new connections pick up rotated credentials.
+func (s *Store) Reset() {
+	s.db.Reset()
+}
+
+const readingColumns = `id, temp_co, temp_room, humidity, timestamp, device, received_at, quality`
+
+func (s *Store) InsertReading(ctx context.Context, r store.TemperatureReading) (store.TemperatureReading, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	var tr store.TemperatureReading
+	err := s.db.QueryRow(ctx, `
+		INSERT INTO readings (temp_co, temp_room, humidity, timestamp, device, received_at, quality)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+readingColumns,
+		r.TempCo, r.TempRoom, r.Humidity, r.Timestamp, r.Device, r.ReceivedAt, store.QualityOf(r)).Scan(&tr.Id, &tr.TempCo, &tr.TempRoom, &tr.Humidity, &tr.Timestamp, &tr.Device, &tr.ReceivedAt, &tr.Quality)
+	return tr, err
+}
+
+func (s *Store) InsertReadings(ctx context.Context, rs []store.TemperatureReading) (int64, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return s.db.CopyFrom(ctx,
+		pgx.Identifier{"readings"},
+		[]string{"temp_co", "temp_room", "humidity", "timestamp", "device", "received_at", "quality"},
+		pgx.CopyFromSlice(len(rs), func(i int) ([]any, error) {
+			r := rs[i]
+			return []any{r.TempCo, r.TempRoom, r.Humidity, r.Timestamp, r.Device, r.ReceivedAt, store.QualityOf(r)}, nil
+		}),
+	)
+}
+
+func (s *Store) ListReadings(ctx context.Context, limit, offset int) ([]store.TemperatureReading, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	query, args := listQuery(limit, offset)
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanReadings(rows)
+}
+
+// listQuery is the statement of ListReadings.
+func listQuery(limit, offset int) (string, []any) {
+	return `
+		SELECT ` + readingColumns + `
+		FROM readings
+		ORDER BY timestamp DESC, id DESC
+		LIMIT $1 OFFSET $2
+	`, []any{limit, offset}
+}
+
+// scanReadings reads rows of readingColumns and closes them.
+func scanReadings(rows pgx.Rows) ([]store.TemperatureReading, error) {
+	defer rows.Close()
+	readings := make([]store.TemperatureReading, 0)
+	for rows.Next() {
+		var tr store.TemperatureReading
+		if err := rows.Scan(&tr.Id, &tr.TempCo, &tr.TempRoom, &tr.Humidity, &tr.Timestamp, &tr.Device, &tr.ReceivedAt, &tr.Quality); err != nil {
+			return nil, err
+		}
+		readings = append(readings, tr)
+	}
+	return readings, rows.Err()
+}
+
+var _ store.FilterStore = (*Store)(nil)
+
+// filterColumns and filterOps whitelist what reading filters may put in SQL;
+// values are always passed as parameters.
+var (
+	filterColumns = map[string]string{"tempCo": "temp_co", "tempRoom": "temp_room", "humidity": "humidity", "timestamp": "timestamp", "receivedAt": "received_at"}
+	filterOps     = map[string]string{"eq": "=", "ne": "<>", "gt": ">", "gte": ">=", "lt": "<", "lte": "<="}
+)
+
+func (s *Store) ListFilteredReadings(ctx context.Context, q store.ReadingQuery, limit, offset int) ([]store.TemperatureReading, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	query, args, err := filteredQuery(q, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanReadings(rows)
+}
+
+// filteredQuery is the statement of ListFilteredReadings.
+func filteredQuery(q store.ReadingQuery, limit, offset int) (string, []any, error) {
+	var (
+		where []string
+		args  = []any{limit, offset}
+	)
+	for _, f := range q.Filters {
+		column, ok := filterColumns[f.Field]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown filter field %q", f.Field)
+		}
+		op, ok := filterOps[f.Op]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown filter op %q", f.Op)
+		}
+		if f.Field == "timestamp" || f.Field == "receivedAt" {
+			// keeps readings_timestamp_idx and readings_received_at_idx usable
+			args = append(args, int64(f.Value))
+		} else {
+			args = append(args, f.Value)
+		}
+		where = append(where, fmt.Sprintf("%s %s $%d", column, op, len(args)))
+	}
+	if q.Devices != nil {
+		args = append(args, q.Devices)
+		where = append(where, fmt.Sprintf("device = ANY($%d)", len(args)))
+	}
+	if q.Qualities != nil {
+		args = append(args, q.Qualities)
+		where = append(where, fmt.Sprintf("quality = ANY($%d)", len(args)))
+	}
+	if q.After != nil {
+		if q.Order == store.OrderReceivedAt {
+			return "", nil, fmt.Errorf("a cursor needs order %q", store.OrderTimestamp)
+		}
+		// the bound on timestamp alone keeps readings_timestamp_idx usable
+		args = append(args, q.After.Timestamp, q.After.Id)
+		where = append(where, fmt.Sprintf("timestamp <= $%d AND (timestamp < $%d OR id < $%d)", len(args)-1, len(args)-1, len(args)))
+	}
+	query := `SELECT ` + readingColumns + ` FROM readings`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	order := ` ORDER BY timestamp DESC, id DESC`
+	if q.Order == store.OrderReceivedAt {
+		order = ` ORDER BY received_at DESC NULLS LAST, timestamp DESC, id DESC`
+	}
+	return query + order + ` LIMIT $1 OFFSET $2`, args, nil
+}
+
+var _ store.SmoothingStore = (*Store)(nil)
+
+// ListSmoothedReadings averages the neighbours of the page's readings only,
+// through readings_timestamp_idx, instead of a window over the whole table.
+// Readings are averaged with the same device's.
+func (s *Store) ListSmoothedReadings(ctx context.Context, limit, offset int, half int64) ([]store.TemperatureReading, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	query, args := smoothedQuery(limit, offset, half)
+	rows, err := s.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanReadings(rows)
+}
+
+// smoothedQuery is the statement of ListSmoothedReadings.
+func smoothedQuery(limit, offset int, half int64) (string, []any) {
+	return `
+		WITH page AS (
+			SELECT ` + readingColumns + `
+			FROM readings
+			ORDER BY timestamp DESC, id DESC
+			LIMIT $1 OFFSET $2
+		)
+		SELECT p.id,
+			COALESCE(AVG(r.temp_co), p.temp_co),
+			COALESCE(AVG(r.temp_room), p.temp_room),
+			COALESCE(AVG(r.humidity), p.humidity),
+			p.timestamp,
+			p.device,
+			p.received_at,
+			p.quality
+		FROM page p
+		LEFT JOIN readings r ON r.device = p.device AND r.timestamp BETWEEN p.timestamp - $3 AND p.timestamp + $3
+		GROUP BY p.id, p.temp_co, p.temp_room, p.humidity, p.timestamp, p.device, p.received_at, p.quality
+		ORDER BY p.timestamp DESC, p.id DESC
+	`, []any{limit, offset, half}
+}
@@ -0,0 +1,1023 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+func setupTestDB(t *testing.T) *pgxpool.Pool {
+	host := os.Getenv("APP_DB_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+	port := os.Getenv("APP_DB_PORT")
+	if port == "" {
+		port = "5432"
+	}
+	user := os.Getenv("APP_DB_USER")
+	if user == "" {
+		user = "user"
+	}
+	pass := os.Getenv("APP_DB_PASS")
+	if pass == "" {
+		pass = "pass"
+	}
+	adminConnStr := fmt.Sprintf("postgres://%s:%s@%s:%s/postgres?application_name=esp8266-web-test-admin",
+		user, pass, host, port)
+	adminConfig, err := pgxpool.ParseConfig(adminConnStr)
+	require.NoError(t, err)
+	adminPool, err := pgxpool.NewWithConfig(context.Background(), adminConfig)
+	require.NoError(t, err)
+	defer adminPool.Close()
+
+	testDBName := fmt.Sprintf("esp8266_test_%d", time.Now().UnixNano())
+	_, err = adminPool.Exec(context.Background(), "CREATE DATABASE "+testDBName)
+	require.NoError(t, err)
+
+	connStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?application_name=esp8266-web-test",
+		user, pass, host, port, testDBName)
+	config, err := pgxpool.ParseConfig(connStr)
+	require.NoError(t, err)
+	pool, err := pgxpool.NewWithConfig(context.Background(), config)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		pool.Close()
+		adminPool2, err := pgxpool.NewWithConfig(context.Background(), adminConfig)
+		if err == nil {
+			defer adminPool2.Close()
+			_, _ = adminPool2.Exec(context.Background(), "DROP DATABASE IF EXISTS "+testDBName)
+		}
+	})
+	return pool
+}
+
+func TestApplyMigrations(t *testing.T) {
+	db := setupTestDB(t)
+	s := New(db)
+	err := s.Migrate(context.Background())
+	assert.NoError(t, err)
+	var exists bool
+	err = db.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'readings')").Scan(&exists)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestConcurrentMigrations(t *testing.T) {
+	db := setupTestDB(t)
+	// replicas starting at once
+	errs := make(chan error, 3)
+	for range 3 {
+		go func() {
+			errs <- New(db).Migrate(context.Background())
+		}()
+	}
+	for range 3 {
+		assert.NoError(t, <-errs)
+	}
+	var count int
+	require.NoError(t, db.QueryRow(context.Background(), "SELECT count(*) FROM schema_migrations").Scan(&count))
+	assert.Equal(t, len(migrations), count)
+}
+
+func TestMigrationStatus(t *testing.T) {
+	db := setupTestDB(t)
+	s := New(db)
+
+	status, err := s.MigrationStatus(context.Background())
+	require.NoError(t, err)
+	require.Len(t, status, len(migrations))
+	for _, st := range status {
+		assert.Nil(t, st.AppliedAt)
+	}
+
+	require.NoError(t, s.Migrate(context.Background()))
+	status, err = s.MigrationStatus(context.Background())
+	require.NoError(t, err)
+	for _, st := range status {
+		assert.NotNil(t, st.AppliedAt)
+	}
+}
+
+func TestMigrateDown(t *testing.T) {
+	db := setupTestDB(t)
+	s := New(db)
+	require.NoError(t, s.Migrate(context.Background()))
+
+	require.NoError(t, s.MigrateDown(context.Background(), 2, nil))
+	var exists bool
+	err := db.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'readings' AND column_name = 'humidity')").Scan(&exists)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, s.MigrateDown(context.Background(), len(migrations), nil))
+	err = db.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'readings')").Scan(&exists)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, s.Migrate(context.Background()))
+	err = db.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'readings' AND column_name = 'humidity')").Scan(&exists)
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	db := setupTestDB(t)
+	s := New(db)
+
+	var buf bytes.Buffer
+	require.NoError(t, s.MigrateUp(context.Background(), &buf))
+	assert.Contains(t, buf.String(), "CREATE TABLE IF NOT EXISTS readings")
+
+	var exists bool
+	err := db.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'readings')").Scan(&exists)
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestInsertAndListReadings(t *testing.T) {
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(context.Background()))
+
+	older, newer := int64(1761388101), int64(1761388161)
+	tr, err := s.InsertReading(context.Background(), store.TemperatureReading{TempCo: 25.5, TempRoom: 22.0, Humidity: 60.0, Timestamp: &older})
+	require.NoError(t, err)
+	assert.NotZero(t, tr.Id)
+	assert.Equal(t, 25.5, tr.TempCo)
+
+	n, err := s.InsertReadings(context.Background(), []store.TemperatureReading{{TempCo: 26.0, TempRoom: 23.0, Humidity: 55.0, Timestamp: &newer}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	readings, err := s.ListReadings(context.Background(), 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 2)
+	assert.Equal(t, newer, *readings[0].Timestamp)
+	assert.Equal(t, older, *readings[1].Timestamp)
+}
+
+func TestTimeout(t *testing.T) {
+	pool := setupTestDB(t)
+	s := New(pool)
+	ctx := context.Background()
+	require.NoError(t, s.Migrate(ctx))
+
+	tx, err := pool.Begin(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, "LOCK TABLE readings IN ACCESS EXCLUSIVE MODE")
+	require.NoError(t, err)
+
+	s.SetTimeout(100 * time.Millisecond)
+	_, err = s.ListReadings(ctx, 10, 0)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestSlowQueryTracer(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil)).With("request_id", "abc")
+	ctx := slogctx.NewCtx(context.Background(), logger)
+
+	tracer := &SlowQueryTracer{Threshold: time.Hour}
+	qctx := tracer.TraceQueryStart(ctx, nil, pgx.TraceQueryStartData{SQL: "SELECT 1"})
+	tracer.TraceQueryEnd(qctx, nil, pgx.TraceQueryEndData{})
+	assert.Empty(t, buf.String())
+
+	tracer.Threshold = 0
+	from := int64(1761388101)
+	qctx = tracer.TraceQueryStart(ctx, nil, pgx.TraceQueryStartData{
+		SQL:  "\n\t\tSELECT id\n\t\tFROM readings\n\t\tWHERE device = $1 AND timestamp >= $2",
+		Args: []any{"attic", &from},
+	})
+	tracer.TraceQueryEnd(qctx, nil, pgx.TraceQueryEndData{})
+	assert.Contains(t, buf.String(), `"sql":"SELECT id FROM readings WHERE device = $1 AND timestamp >= $2"`)
+	assert.Contains(t, buf.String(), `"args":["\"attic\"","1761388101"]`)
+	assert.Contains(t, buf.String(), `"request_id":"abc"`)
+	assert.Equal(t, 1.0, testutil.ToFloat64(slowQueries.WithLabelValues("select")))
+
+	args := make([]any, 12)
+	for i := range args {
+		args[i] = strings.Repeat("x", i*5)
+	}
+	summary := summarizeArgs(args)
+	assert.Len(t, summary, 11)
+	assert.Equal(t, `"`+strings.Repeat("x", 39)+"…", summary[9])
+	assert.Equal(t, "(2 more)", summary[10])
+}
+
+func TestSyncReadings(t *testing.T) {
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(context.Background()))
+
+	ts := int64(1761388101)
+	reading := func(seq int64) store.SyncReading {
+		return store.SyncReading{Seq: seq, TemperatureReading: store.TemperatureReading{TempCo: 40, TempRoom: 21, Humidity: 50, Timestamp: &ts}}
+	}
+
+	result, err := s.SyncReadings(context.Background(), "boiler", []store.SyncReading{reading(1), reading(2)})
+	require.NoError(t, err)
+	assert.Equal(t, store.SyncResult{AckedSeq: 2, Inserted: 2}, result)
+
+	result, err = s.SyncReadings(context.Background(), "boiler", []store.SyncReading{reading(2), reading(3)})
+	require.NoError(t, err)
+	assert.Equal(t, store.SyncResult{AckedSeq: 3, Inserted: 1, PrevAckedSeq: 2}, result)
+
+	readings, err := s.ListReadings(context.Background(), 10, 0)
+	require.NoError(t, err)
+	assert.Len(t, readings, 3)
+}
+
+func TestReplaceReadings(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+	ts := func(v int64) *int64 { return &v }
+	_, err := s.InsertReadings(ctx, []store.TemperatureReading{
+		{TempCo: 20, Device: "attic", Timestamp: ts(100)},
+		{TempCo: 20, Device: "attic", Timestamp: ts(200)},
+		{TempCo: 20, Device: "attic", Timestamp: ts(300)},
+		{TempCo: 20, Device: "boiler", Timestamp: ts(200)},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, s.ReplaceReadings(ctx, "attic", 150, 300, []store.TemperatureReading{
+		{TempCo: 30, Timestamp: ts(150)},
+		{TempCo: 31, Timestamp: ts(250), Quality: store.QualitySuspect},
+	}))
+	readings, err := s.ListFilteredReadings(ctx, store.ReadingQuery{Devices: []string{"attic"}}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 4)
+	assert.Equal(t, []float64{20, 31, 30, 20}, []float64{readings[0].TempCo, readings[1].TempCo, readings[2].TempCo, readings[3].TempCo})
+	assert.Equal(t, store.QualitySuspect, readings[1].Quality)
+
+	// other devices' readings in the range are kept
+	readings, err = s.ListFilteredReadings(ctx, store.ReadingQuery{Devices: []string{"boiler"}}, 10, 0)
+	require.NoError(t, err)
+	assert.Len(t, readings, 1)
+}
+
+func TestAlerts(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	rule, err := s.CreateAlertRule(ctx, store.AlertRule{Name: "humid", Field: "humidity", Op: "gt", Threshold: 80, Severity: "warning", Enabled: true})
+	require.NoError(t, err)
+
+	_, err = s.GetAlertRule(ctx, rule.Id+1)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	require.NoError(t, s.FireAlert(ctx, store.Alert{RuleId: rule.Id, Since: 100, Value: 90}))
+	require.NoError(t, s.FireAlert(ctx, store.Alert{RuleId: rule.Id, Since: 200, Value: 95}))
+	firing, err := s.ListFiringAlerts(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []store.Alert{{RuleId: rule.Id, RuleName: "humid", Severity: "warning", Since: 100, Value: 90}}, firing)
+
+	require.NoError(t, s.ResolveAlert(ctx, rule.Id, 70, 300))
+	history, err := s.ListAlertHistory(ctx, store.AlertHistoryFilter{RuleId: rule.Id, From: 200, Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, store.AlertResolved, history[0].State)
+
+	require.NoError(t, s.DeleteAlertRule(ctx, rule.Id))
+	history, err = s.ListAlertHistory(ctx, store.AlertHistoryFilter{Limit: 10})
+	require.NoError(t, err)
+	assert.Len(t, history, 2)
+}
+
+func TestSilences(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	silence, err := s.CreateSilence(ctx, store.Silence{Matchers: []store.SilenceMatcher{{Name: "rule", Value: "humid.*", IsRegex: true}}, Comment: "weekend", StartsAt: 100, EndsAt: 300})
+	require.NoError(t, err)
+
+	active, err := s.ListActiveSilences(ctx, 150)
+	require.NoError(t, err)
+	assert.Equal(t, []store.Silence{silence}, active)
+
+	require.NoError(t, s.ExpireSilence(ctx, silence.Id, 200))
+	active, err = s.ListActiveSilences(ctx, 200)
+	require.NoError(t, err)
+	assert.Empty(t, active)
+}
+
+func TestAckAlert(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	rule, err := s.CreateAlertRule(ctx, store.AlertRule{Name: "humid", Field: "humidity", Op: "gt", Threshold: 80, Severity: "warning", Enabled: true,
+		Escalation: []store.EscalationStep{{Channel: "telegram"}, {Channel: "sms", AfterSeconds: 1800}}})
+	require.NoError(t, err)
+	assert.Len(t, rule.Escalation, 2)
+	require.NoError(t, s.FireAlert(ctx, store.Alert{RuleId: rule.Id, Since: 100, Value: 90, FiredAt: 110, AckToken: "token"}))
+	require.NoError(t, s.SetAlertNotified(ctx, rule.Id, 1))
+
+	_, err = s.AckAlert(ctx, "other", 200)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	a, err := s.AckAlert(ctx, "token", 200)
+	require.NoError(t, err)
+	require.NotNil(t, a.AckedAt)
+	assert.Equal(t, int64(200), *a.AckedAt)
+	assert.Equal(t, 1, a.Notified)
+
+	a, err = s.AckAlert(ctx, "token", 300)
+	require.NoError(t, err)
+	assert.Equal(t, int64(200), *a.AckedAt)
+
+	history, err := s.ListAlertHistory(ctx, store.AlertHistoryFilter{State: store.AlertAcknowledged, Limit: 10})
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+}
+
+func TestZones(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	z, err := s.CreateZone(ctx, store.Zone{Name: "living room", Device: "attic", RelayDevice: "boiler", Field: "tempRoom", Target: 21, Hysteresis: 0.5, Mode: "heat", Enabled: true})
+	require.NoError(t, err)
+	assert.Nil(t, z.Relay)
+
+	on := true
+	z, err = s.SetZoneOverride(ctx, z.Id, &on, 500, 100)
+	require.NoError(t, err)
+	require.NotNil(t, z.Override)
+	assert.True(t, *z.Override)
+	require.NoError(t, s.SetZoneRelay(ctx, store.ZoneEvent{ZoneId: z.Id, State: "on", Value: 20, Target: 21, Timestamp: 110}))
+
+	// settings updates keep the override and relay state
+	z.Target = 22
+	z.Override, z.Relay = nil, nil
+	z, err = s.UpdateZone(ctx, z)
+	require.NoError(t, err)
+	assert.Equal(t, 22.0, z.Target)
+	require.NotNil(t, z.Override)
+	require.NotNil(t, z.Relay)
+	assert.True(t, *z.Relay)
+	assert.Equal(t, int64(110), z.ChangedAt)
+
+	z, err = s.SetZoneOverride(ctx, z.Id, nil, 500, 120)
+	require.NoError(t, err)
+	assert.Nil(t, z.Override)
+	assert.Zero(t, z.OverrideUntil)
+
+	history, err := s.ListZoneHistory(ctx, z.Id, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	assert.Equal(t, store.ZoneEventOverride, history[0].Kind)
+	assert.Equal(t, "auto", history[0].State)
+	assert.Equal(t, store.ZoneEventRelay, history[1].Kind)
+	assert.Equal(t, 20.0, history[1].Value)
+
+	require.NoError(t, s.DeleteZone(ctx, z.Id))
+	_, err = s.GetZone(ctx, z.Id)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	assert.ErrorIs(t, s.SetZoneRelay(ctx, store.ZoneEvent{ZoneId: z.Id, State: "off"}), store.ErrNotFound)
+}
+
+func TestCommands(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	_, err := s.EnqueueCommand(ctx, store.Command{Device: "boiler", Type: "relay", Value: "on", CreatedAt: 100})
+	require.NoError(t, err)
+	_, err = s.EnqueueCommand(ctx, store.Command{Device: "boiler", Type: "led", Value: "blink", CreatedAt: 100})
+	require.NoError(t, err)
+	// supersedes the pending relay command
+	off, err := s.EnqueueCommand(ctx, store.Command{Device: "boiler", Type: "relay", Value: "off", CreatedAt: 110})
+	require.NoError(t, err)
+
+	pending, err := s.PendingCommands(ctx, "boiler")
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, "led", pending[0].Type)
+	assert.Equal(t, off.Id, pending[1].Id)
+
+	assert.ErrorIs(t, s.AckCommand(ctx, "attic", off.Id, 120), store.ErrNotFound)
+	require.NoError(t, s.AckCommand(ctx, "boiler", off.Id, 120))
+	assert.ErrorIs(t, s.AckCommand(ctx, "boiler", off.Id, 130), store.ErrNotFound)
+
+	pending, err = s.PendingCommands(ctx, "boiler")
+	require.NoError(t, err)
+	assert.Len(t, pending, 1)
+}
+
+func TestAwayMode(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	m, err := s.GetAwayMode(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, m)
+
+	require.NoError(t, s.SetAwayMode(ctx, &store.AwayMode{Setpoint: 7, Since: 100, Until: 200}))
+	require.NoError(t, s.SetAwayMode(ctx, &store.AwayMode{Setpoint: 8, Since: 100, Until: 300}))
+	m, err = s.GetAwayMode(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, &store.AwayMode{Setpoint: 8, Since: 100, Until: 300}, m)
+
+	require.NoError(t, s.SetAwayMode(ctx, nil))
+	m, err = s.GetAwayMode(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, m)
+}
+
+func TestOutdoorReadings(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	require.NoError(t, s.InsertOutdoorReading(ctx, store.OutdoorReading{Temp: 5, Humidity: 80, Timestamp: 100}))
+	require.NoError(t, s.InsertOutdoorReading(ctx, store.OutdoorReading{Temp: 6, Humidity: 75, Timestamp: 200}))
+	require.NoError(t, s.InsertOutdoorReading(ctx, store.OutdoorReading{Temp: 6.5, Humidity: 70, Timestamp: 200}))
+	require.NoError(t, s.InsertOutdoorReading(ctx, store.OutdoorReading{Temp: 7, Humidity: 65, Timestamp: 300}))
+
+	readings, err := s.ListOutdoorReadings(ctx, 100, 200)
+	require.NoError(t, err)
+	assert.Equal(t, []store.OutdoorReading{{Temp: 6.5, Humidity: 70, Timestamp: 200}, {Temp: 5, Humidity: 80, Timestamp: 100}}, readings)
+}
+
+func TestListSmoothedReadings(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	var rs []store.TemperatureReading
+	for i, co := range []float64{40, 43, 40, 49, 40} {
+		ts := int64(1761388000 + i*60)
+		rs = append(rs, store.TemperatureReading{TempCo: co, TempRoom: 21, Humidity: 50, Timestamp: &ts})
+	}
+	_, err := s.InsertReadings(ctx, rs)
+	require.NoError(t, err)
+
+	// a 2 minute window averages every reading with its neighbours
+	readings, err := s.ListSmoothedReadings(ctx, 3, 1, 60)
+	require.NoError(t, err)
+	require.Len(t, readings, 3)
+	assert.Equal(t, []float64{43, 44, 41}, []float64{readings[0].TempCo, readings[1].TempCo, readings[2].TempCo})
+	assert.Equal(t, int64(1761388180), *readings[0].Timestamp)
+	assert.Equal(t, 21.0, readings[0].TempRoom)
+
+	// the unsmoothed readings are kept
+	readings, err = s.ListReadings(ctx, 1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 49.0, readings[0].TempCo)
+}
+
+func TestListFilteredReadings(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	var rs []store.TemperatureReading
+	for i, co := range []float64{40, 55, 60, 52, 45} {
+		ts := int64(1761388000 + i*60)
+		rs = append(rs, store.TemperatureReading{TempCo: co, TempRoom: 16 + float64(i), Humidity: 50, Timestamp: &ts})
+	}
+	_, err := s.InsertReadings(ctx, rs)
+	require.NoError(t, err)
+
+	filters := []store.ReadingFilter{{Field: "tempCo", Op: "gte", Value: 52}, {Field: "tempRoom", Op: "lt", Value: 19}}
+	readings, err := s.ListFilteredReadings(ctx, store.ReadingQuery{Filters: filters}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 2)
+	assert.Equal(t, []float64{60, 55}, []float64{readings[0].TempCo, readings[1].TempCo})
+
+	readings, err = s.ListFilteredReadings(ctx, store.ReadingQuery{Filters: filters}, 10, 1)
+	require.NoError(t, err)
+	require.Len(t, readings, 1)
+	assert.Equal(t, 55.0, readings[0].TempCo)
+
+	readings, err = s.ListFilteredReadings(ctx, store.ReadingQuery{Filters: []store.ReadingFilter{{Field: "timestamp", Op: "gt", Value: 1761388180}}}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 1)
+	assert.Equal(t, 45.0, readings[0].TempCo)
+
+	readings, err = s.ListFilteredReadings(ctx, store.ReadingQuery{}, 10, 0)
+	require.NoError(t, err)
+	assert.Len(t, readings, 5)
+}
+
+func TestReadingCursor(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	// readings as old as each other are paged through by id
+	var rs []store.TemperatureReading
+	for i := range 5 {
+		ts := int64(1761388000 + i/3*60)
+		rs = append(rs, store.TemperatureReading{TempCo: float64(40 + i), Timestamp: &ts})
+	}
+	_, err := s.InsertReadings(ctx, rs)
+	require.NoError(t, err)
+
+	var (
+		q   store.ReadingQuery
+		got []float64
+	)
+	for {
+		page, err := s.ListFilteredReadings(ctx, q, 2, 0)
+		require.NoError(t, err)
+		for _, r := range page {
+			got = append(got, r.TempCo)
+		}
+		if len(page) < 2 {
+			break
+		}
+		after := store.CursorAfter(page[len(page)-1])
+		q.After = &after
+	}
+	assert.Equal(t, []float64{44, 43, 42, 41, 40}, got)
+
+	_, err = s.ListFilteredReadings(ctx, store.ReadingQuery{Order: store.OrderReceivedAt, After: q.After}, 2, 0)
+	assert.Error(t, err)
+}
+
+func TestReceivedAtOrder(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	// a backlog measured before, but received after, the live reading
+	live, backlog, received := int64(1761388600), int64(1761388000), int64(1761388700)
+	liveReceived := live
+	_, err := s.InsertReading(ctx, store.TemperatureReading{TempCo: 40, Timestamp: &live, ReceivedAt: &liveReceived})
+	require.NoError(t, err)
+	_, err = s.InsertReading(ctx, store.TemperatureReading{TempCo: 50, Timestamp: &backlog, ReceivedAt: &received})
+	require.NoError(t, err)
+	old := int64(1761387000)
+	_, err = s.InsertReading(ctx, store.TemperatureReading{TempCo: 60, Timestamp: &old})
+	require.NoError(t, err)
+
+	readings, err := s.ListFilteredReadings(ctx, store.ReadingQuery{}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 3)
+	assert.Equal(t, []float64{40, 50, 60}, []float64{readings[0].TempCo, readings[1].TempCo, readings[2].TempCo})
+	assert.Equal(t, received, *readings[1].ReceivedAt)
+
+	readings, err = s.ListFilteredReadings(ctx, store.ReadingQuery{Order: store.OrderReceivedAt}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 3)
+	assert.Equal(t, []float64{50, 40, 60}, []float64{readings[0].TempCo, readings[1].TempCo, readings[2].TempCo})
+	assert.Nil(t, readings[2].ReceivedAt)
+
+	readings, err = s.ListFilteredReadings(ctx, store.ReadingQuery{Filters: []store.ReadingFilter{{Field: "receivedAt", Op: "gt", Value: float64(live)}}}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 1)
+	assert.Equal(t, 50.0, readings[0].TempCo)
+}
+
+func TestReadingQuality(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	ts := int64(1761388000)
+	ok, err := s.InsertReading(ctx, store.TemperatureReading{TempCo: 40, Timestamp: &ts})
+	require.NoError(t, err)
+	assert.Equal(t, store.QualityOK, ok.Quality)
+	_, err = s.InsertReadings(ctx, []store.TemperatureReading{{TempCo: 85, Timestamp: &ts, Quality: store.QualitySuspect}})
+	require.NoError(t, err)
+
+	require.NoError(t, s.SetReadingQuality(ctx, ok.Id, store.QualityCalibrated))
+	assert.ErrorIs(t, s.SetReadingQuality(ctx, ok.Id+100, store.QualityOK), store.ErrNotFound)
+
+	readings, err := s.ListFilteredReadings(ctx, store.ReadingQuery{Qualities: []string{store.QualityOK, store.QualityCalibrated}}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 1)
+	assert.Equal(t, ok.Id, readings[0].Id)
+	assert.Equal(t, store.QualityCalibrated, readings[0].Quality)
+
+	readings, err = s.ListFilteredReadings(ctx, store.ReadingQuery{Qualities: []string{store.QualitySuspect}}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 1)
+	assert.Equal(t, 85.0, readings[0].TempCo)
+}
+
+func TestDeviceLabels(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	labels, err := s.DeviceLabels(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, labels)
+
+	require.NoError(t, s.SetDeviceLabels(ctx, "attic", map[string]string{"floor": "2", "type": "room"}))
+	require.NoError(t, s.SetDeviceLabels(ctx, "boiler", map[string]string{"floor": "0"}))
+	require.NoError(t, s.SetDeviceLabels(ctx, "boiler", map[string]string{"floor": "0", "type": "boiler"}))
+	require.NoError(t, s.SetDeviceLabels(ctx, "garage", map[string]string{"floor": "0"}))
+	require.NoError(t, s.SetDeviceLabels(ctx, "garage", nil))
+	labels, err = s.DeviceLabels(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{
+		"attic":  {"floor": "2", "type": "room"},
+		"boiler": {"floor": "0", "type": "boiler"},
+	}, labels)
+
+	// readings keep their device and can be selected by it
+	ts := int64(1761388000)
+	_, err = s.InsertReading(ctx, store.TemperatureReading{TempCo: 60, Timestamp: &ts, Device: "boiler"})
+	require.NoError(t, err)
+	_, err = s.InsertReadings(ctx, []store.TemperatureReading{{TempRoom: 19, Timestamp: &ts, Device: "attic"}, {TempRoom: 21, Timestamp: &ts}})
+	require.NoError(t, err)
+	readings, err := s.ListFilteredReadings(ctx, store.ReadingQuery{Devices: []string{"attic", "boiler"}}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 2)
+	assert.ElementsMatch(t, []string{"attic", "boiler"}, []string{readings[0].Device, readings[1].Device})
+	readings, err = s.ListFilteredReadings(ctx, store.ReadingQuery{Devices: []string{}}, 10, 0)
+	require.NoError(t, err)
+	assert.Empty(t, readings)
+}
+
+func TestLocations(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	locations, err := s.ListLocations(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, locations)
+
+	house, err := s.CreateLocation(ctx, store.Location{Name: "Home", Kind: store.LocationHouse, Devices: []string{}})
+	require.NoError(t, err)
+	floor, err := s.CreateLocation(ctx, store.Location{Name: "Ground", Kind: store.LocationFloor, ParentId: &house.Id, Devices: []string{"hall"}})
+	require.NoError(t, err)
+	room, err := s.CreateLocation(ctx, store.Location{Name: "Kitchen", Kind: store.LocationRoom, ParentId: &floor.Id, Devices: []string{"kitchen"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"hall"}, floor.Devices)
+
+	// placing a device elsewhere moves it
+	room.Devices = []string{"hall", "kitchen"}
+	_, err = s.UpdateLocation(ctx, room)
+	require.NoError(t, err)
+	got, err := s.GetLocation(ctx, floor.Id)
+	require.NoError(t, err)
+	assert.Empty(t, got.Devices)
+	got, err = s.GetLocation(ctx, room.Id)
+	require.NoError(t, err)
+	assert.Equal(t, store.Location{Id: room.Id, Name: "Kitchen", Kind: store.LocationRoom, ParentId: &floor.Id, Devices: []string{"hall", "kitchen"}}, got)
+
+	_, err = s.UpdateLocation(ctx, store.Location{Id: 999, Name: "Nowhere", Kind: store.LocationRoom})
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	// deleting a location makes its children top-level
+	require.NoError(t, s.DeleteLocation(ctx, floor.Id))
+	got, err = s.GetLocation(ctx, room.Id)
+	require.NoError(t, err)
+	assert.Nil(t, got.ParentId)
+	_, err = s.GetLocation(ctx, floor.Id)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	assert.ErrorIs(t, s.DeleteLocation(ctx, floor.Id), store.ErrNotFound)
+
+	locations, err = s.ListLocations(ctx)
+	require.NoError(t, err)
+	require.Len(t, locations, 2)
+	assert.Equal(t, house.Id, locations[0].Id)
+	assert.Equal(t, room.Id, locations[1].Id)
+}
+
+// queryRows collects a query result.
+type queryRows struct {
+	columns []string
+	rows    [][]any
+}
+
+func (q *queryRows) Columns(names []string) error {
+	q.columns = names
+	return nil
+}
+
+func (q *queryRows) Row(values []any) error {
+	q.rows = append(q.rows, values)
+	return nil
+}
+
+func TestQuerier(t *testing.T) {
+	ctx := context.Background()
+	pool := setupTestDB(t)
+	s := New(pool)
+	require.NoError(t, s.Migrate(ctx))
+	_, err := s.InsertReading(ctx, store.TemperatureReading{TempCo: 20, TempRoom: 21, Humidity: 40})
+	require.NoError(t, err)
+	q := NewQuerier(pool)
+
+	var res queryRows
+	require.NoError(t, q.Query(ctx, "SELECT temp_co, humidity FROM readings", time.Second, &res))
+	assert.Equal(t, []string{"temp_co", "humidity"}, res.columns)
+	require.Len(t, res.rows, 1)
+
+	var qe *store.QueryError
+	for _, sql := range []string{
+		"DELETE FROM readings",
+		"WITH d AS (DELETE FROM readings RETURNING id) SELECT * FROM d",
+		"SELECT 1; DELETE FROM readings",
+		"SELECT pg_sleep(1)",
+		"SELECT nope FROM readings",
+	} {
+		err := q.Query(ctx, sql, 100*time.Millisecond, &queryRows{})
+		assert.ErrorAs(t, err, &qe, sql)
+	}
+
+	readings, err := s.ListReadings(ctx, 10, 0)
+	require.NoError(t, err)
+	assert.Len(t, readings, 1)
+}
+
+func TestStorageStatus(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+	ts1, ts2 := int64(100), int64(300)
+	_, err := s.InsertReadings(ctx, []store.TemperatureReading{
+		{TempCo: 20, Device: "attic", Timestamp: &ts1},
+		{TempCo: 21, Device: "attic", Timestamp: &ts2},
+		{TempCo: 22},
+	})
+	require.NoError(t, err)
+
+	status, err := s.StorageStatus(ctx)
+	require.NoError(t, err)
+	assert.Positive(t, status.DatabaseBytes)
+	var tables []string
+	for _, tbl := range status.Tables {
+		tables = append(tables, tbl.Name)
+	}
+	assert.Contains(t, tables, "readings")
+	assert.Equal(t, []store.DeviceStorage{
+		{Device: "", Count: 1},
+		{Device: "attic", Count: 2, Oldest: &ts1, Newest: &ts2},
+	}, status.Devices)
+}
+
+func TestMaintain(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	for _, op := range store.MaintenanceOps {
+		assert.NoError(t, s.Maintain(ctx, op, ""), op)
+	}
+	assert.NoError(t, s.Maintain(ctx, store.MaintenanceVacuum, "readings"))
+	assert.NoError(t, s.Maintain(ctx, store.MaintenanceReindex, "readings"))
+	assert.ErrorIs(t, s.Maintain(ctx, store.MaintenanceAnalyze, "nope"), store.ErrNotFound)
+	assert.Error(t, s.Maintain(ctx, store.MaintenanceRefresh, "readings"))
+}
+
+func TestExplainReadings(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	plan, err := s.ExplainReadings(ctx, nil, 0, 10, 0)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(plan.Statement, "SELECT "), plan.Statement)
+	assert.Equal(t, []any{10, 0}, plan.Parameters)
+	require.NotEmpty(t, plan.Plan)
+	assert.Contains(t, plan.Plan[0], "actual time=")
+	assert.Contains(t, strings.Join(plan.Plan, "\n"), "Execution Time")
+
+	plan, err = s.ExplainReadings(ctx, &store.ReadingQuery{Devices: []string{"attic"}}, 0, 10, 0)
+	require.NoError(t, err)
+	assert.Contains(t, plan.Statement, "device = ANY($3)")
+
+	plan, err = s.ExplainReadings(ctx, nil, 300, 10, 0)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(plan.Statement, "WITH page AS"), plan.Statement)
+
+	_, err = s.ExplainReadings(ctx, &store.ReadingQuery{Filters: []store.ReadingFilter{{Field: "id", Op: "eq"}}}, 0, 10, 0)
+	assert.Error(t, err)
+}
+
+func TestImportReadings(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+	ts := func(v int64) *int64 { return &v }
+	_, err := s.InsertReadings(ctx, []store.TemperatureReading{
+		{TempCo: 20, Device: "attic", Timestamp: ts(100)},
+		{TempCo: 20, Device: "attic", Timestamp: ts(200)},
+	})
+	require.NoError(t, err)
+
+	result, err := s.ImportReadings(ctx, "attic", []store.ImportReading{
+		{TemperatureReading: store.TemperatureReading{TempCo: 30, Timestamp: ts(100)}},
+		{TemperatureReading: store.TemperatureReading{TempCo: 30, Timestamp: ts(300)}},
+	}, store.ConflictSkip)
+	require.NoError(t, err)
+	assert.Equal(t, store.ImportResult{Inserted: 1, Skipped: 1}, result)
+
+	result, err = s.ImportReadings(ctx, "attic", []store.ImportReading{
+		{TemperatureReading: store.TemperatureReading{TempCo: 31, Timestamp: ts(100)}},
+	}, store.ConflictOverwrite)
+	require.NoError(t, err)
+	assert.Equal(t, store.ImportResult{Overwritten: 1}, result)
+
+	result, err = s.ImportReadings(ctx, "attic", []store.ImportReading{
+		{TemperatureReading: store.TemperatureReading{TempCo: 32, Timestamp: ts(100)}, StoredAt: ts(1)},
+		{TemperatureReading: store.TemperatureReading{TempCo: 32, Timestamp: ts(200)}, StoredAt: ts(4102444800)},
+	}, store.ConflictKeepNewer)
+	require.NoError(t, err)
+	assert.Equal(t, store.ImportResult{Overwritten: 1, Skipped: 1}, result)
+
+	readings, err := s.ListReadings(ctx, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, readings, 3)
+	assert.Equal(t, []float64{30, 32, 31}, []float64{readings[0].TempCo, readings[1].TempCo, readings[2].TempCo})
+}
+
+func TestElector(t *testing.T) {
+	s := New(setupTestDB(t))
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	a, b := NewElector(s, 50*time.Millisecond, logger), NewElector(s, 50*time.Millisecond, logger)
+
+	var running atomic.Int32
+	job := func(ctx context.Context) {
+		running.Add(1)
+		<-ctx.Done()
+		running.Add(-1)
+	}
+	ctxA, cancelA := context.WithCancel(context.Background())
+	doneA := make(chan struct{})
+	go func() {
+		a.Run(ctxA, job)
+		close(doneA)
+	}()
+	require.Eventually(t, a.IsLeader, time.Second, 10*time.Millisecond)
+
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	go b.Run(ctxB, job)
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, b.IsLeader())
+	assert.Equal(t, int32(1), running.Load())
+
+	// the follower takes over once the leader stops
+	cancelA()
+	<-doneA
+	require.Eventually(t, b.IsLeader, time.Second, 10*time.Millisecond)
+	assert.False(t, a.IsLeader())
+	assert.Eventually(t, func() bool { return running.Load() == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	keys, err := s.ListAPIKeys(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	grafana := store.APIKey{Name: "grafana", Hash: "$2a$10$hash", Scopes: []string{"read"}, CreatedAt: 1761388000}
+	require.NoError(t, s.CreateAPIKey(ctx, store.APIKey{Name: "attic", Hash: "$2a$10$other", Scopes: []string{"write"}, Device: "attic", CreatedAt: 1761388000}))
+	require.NoError(t, s.CreateAPIKey(ctx, grafana))
+	assert.ErrorIs(t, s.CreateAPIKey(ctx, grafana), store.ErrExists)
+
+	keys, err = s.ListAPIKeys(ctx)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, "attic", keys[0].Name)
+	assert.Equal(t, "attic", keys[0].Device)
+	assert.Equal(t, grafana, keys[1])
+
+	require.NoError(t, s.DeleteAPIKey(ctx, "attic"))
+	assert.ErrorIs(t, s.DeleteAPIKey(ctx, "attic"), store.ErrNotFound)
+	keys, err = s.ListAPIKeys(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []store.APIKey{grafana}, keys)
+}
+
+func TestFeatureFlags(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	flags, err := s.FeatureFlags(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, flags)
+
+	require.NoError(t, s.SetFeatureFlags(ctx, []store.FeatureChange{
+		{Name: "alerts", Value: false, Actor: "ops", At: 1761388000},
+		{Name: "read_only", Value: true, Actor: "ops", At: 1761388000},
+	}))
+	require.NoError(t, s.SetFeatureFlags(ctx, []store.FeatureChange{{Name: "read_only", Value: false, Actor: "secret-key", At: 1761388060}}))
+
+	flags, err = s.FeatureFlags(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"alerts": false, "read_only": false}, flags)
+
+	changes, err := s.ListFeatureChanges(ctx, 2)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	assert.Equal(t, store.FeatureChange{Id: changes[0].Id, Name: "read_only", Value: false, Actor: "secret-key", At: 1761388060}, changes[0])
+	assert.Equal(t, "read_only", changes[1].Name)
+	assert.Greater(t, changes[0].Id, changes[1].Id)
+}
+
+func TestDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	letters, err := s.ListDeadLetters(ctx, 10)
+	require.NoError(t, err)
+	assert.Empty(t, letters)
+
+	first, err := s.AddDeadLetter(ctx, store.DeadLetter{RuleId: 1, RuleName: "boiler hot", Channel: "telegram", Subject: "[critical] boiler hot firing", Text: "tempCo is 75", Error: "timeout", Attempts: 1, FailedAt: 1761388000})
+	require.NoError(t, err)
+	second, err := s.AddDeadLetter(ctx, store.DeadLetter{RuleId: 1, RuleName: "boiler hot", Channel: "email", Subject: "[critical] boiler hot firing", AckURL: "https://temp.example.com/alerts/ack/abc", Error: "dial tcp: connection refused", Attempts: 1, FailedAt: 1761388060})
+	require.NoError(t, err)
+
+	letters, err = s.ListDeadLetters(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []store.DeadLetter{second, first}, letters)
+
+	first.Error, first.Attempts, first.FailedAt = "unexpected status 502", 2, 1761388120
+	require.NoError(t, s.UpdateDeadLetter(ctx, first))
+	got, err := s.GetDeadLetter(ctx, first.Id)
+	require.NoError(t, err)
+	assert.Equal(t, first, got)
+
+	require.NoError(t, s.DeleteDeadLetter(ctx, first.Id))
+	assert.ErrorIs(t, s.DeleteDeadLetter(ctx, first.Id), store.ErrNotFound)
+	_, err = s.GetDeadLetter(ctx, first.Id)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	assert.ErrorIs(t, s.UpdateDeadLetter(ctx, first), store.ErrNotFound)
+}
+
+func TestDeviceFirmware(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	firmware, err := s.DeviceFirmware(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, firmware)
+
+	require.NoError(t, s.SetDeviceFirmware(ctx, "attic", "1.2.0", 1761388000))
+	require.NoError(t, s.SetDeviceFirmware(ctx, "attic", "1.2.0", 1761388060))
+	require.NoError(t, s.SetDeviceFirmware(ctx, "garage", "1.1.3", 1761388000))
+	require.NoError(t, s.SetDeviceFirmware(ctx, "garage", "1.2.0", 1761388120))
+
+	firmware, err = s.DeviceFirmware(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []store.DeviceFirmware{
+		{Device: "attic", Version: "1.2.0", Since: 1761388000},
+		{Device: "garage", Version: "1.2.0", Since: 1761388120},
+	}, firmware)
+}
+
+func TestCrashReports(t *testing.T) {
+	ctx := context.Background()
+	s := New(setupTestDB(t))
+	require.NoError(t, s.Migrate(ctx))
+
+	exception := 29
+	first, err := s.AddCrashReport(ctx, store.CrashReport{Device: "attic", Reason: "Exception", Exception: &exception, Stack: ">>>stack>>>\n3ffffdc0:  40201c4d 00000000\n<<<stack<<<", Firmware: "1.2.0", At: 1761388000})
+	require.NoError(t, err)
+	second, err := s.AddCrashReport(ctx, store.CrashReport{Device: "attic", Reason: "Hardware Watchdog", At: 1761388060})
+	require.NoError(t, err)
+	_, err = s.AddCrashReport(ctx, store.CrashReport{Device: "garage", Reason: "Software Watchdog", At: 1761388060})
+	require.NoError(t, err)
+
+	reports, err := s.ListCrashReports(ctx, "attic", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []store.CrashReport{second, first}, reports)
+	reports, err = s.ListCrashReports(ctx, "attic", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []store.CrashReport{second}, reports)
+	reports, err = s.ListCrashReports(ctx, "cellar", 10)
+	require.NoError(t, err)
+	assert.Empty(t, reports)
+
+	n, err := s.CountCrashReports(ctx, "attic", 1761388060)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = s.CountCrashReports(ctx, "attic", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
@@ -0,0 +1,22 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.QualityStore = (*Store)(nil)
+
+func (s *Store) SetReadingQuality(ctx context.Context, id int, quality string) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	tag, err := s.db.Exec(ctx, `UPDATE readings SET quality = $2 WHERE id = $1`, id, quality)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
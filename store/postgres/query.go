@@ -0,0 +1,112 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Querier runs ad-hoc queries on a pool of its own. The pool must connect
+// as a restricted role, e.g. one only granted SELECT on the tables, as
+// that's what keeps a query from reading or calling anything else; every
+// query also runs in a read-only transaction.
+type Querier struct {
+	db *pgxpool.Pool
+}
+
+var _ store.Querier = (*Querier)(nil)
+
+// NewQuerier wraps an existing pool. Closing the querier closes the pool.
+func NewQuerier(db *pgxpool.Pool) *Querier {
+	return &Querier{db: db}
+}
+
+// OpenQuerier connects with config and verifies the connection.
+func OpenQuerier(ctx context.Context, config *pgxpool.Config) (*Querier, error) {
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("create query database pool: %w", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("ping query database: %w", err)
+	}
+	return NewQuerier(pool), nil
+}
+
+func (q *Querier) Close() {
+	q.db.Close()
+}
+
+// Query runs sql in a read-only transaction that is always rolled back. The
+// statement_timeout cancels it on the server, the context deadline covers
+// the time spent streaming rows too.
+func (q *Querier) Query(ctx context.Context, sql string, timeout time.Duration, res store.QueryResult) error {
+	if err := store.CheckQuery(sql); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	tx, err := q.db.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return fmt.Errorf("begin query: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+	if _, err := tx.Exec(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", timeout.Milliseconds())); err != nil {
+		return fmt.Errorf("set statement timeout: %w", err)
+	}
+
+	// The extended protocol pgx uses rejects multiple statements.
+	rows, err := tx.Query(ctx, sql)
+	if err != nil {
+		return queryError(err)
+	}
+	defer rows.Close()
+	next := rows.Next()
+	if !next {
+		if err := rows.Err(); err != nil {
+			return queryError(err)
+		}
+	}
+	fields := rows.FieldDescriptions()
+	columns := make([]string, len(fields))
+	for i, f := range fields {
+		columns[i] = f.Name
+	}
+	if err := res.Columns(columns); err != nil {
+		return err
+	}
+	for ; next; next = rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return queryError(err)
+		}
+		if err := res.Row(values); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return queryError(err)
+	}
+	return nil
+}
+
+// queryError turns errors reported by the database and the timeout into
+// *store.QueryError, leaving connection errors as they are.
+func queryError(err error) error {
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.As(err, &pgErr):
+		return &store.QueryError{Msg: pgErr.Message}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &store.QueryError{Msg: "query timed out"}
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.StatusStore = (*Store)(nil)
+
+// StorageStatus reports the sizes of the tables in the current schema and
+// the readings per device.
+func (s *Store) StorageStatus(ctx context.Context) (store.StorageStatus, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	status := store.StorageStatus{Tables: []store.TableSize{}, Devices: []store.DeviceStorage{}}
+	if err := s.db.QueryRow(ctx, `SELECT pg_database_size(current_database())`).Scan(&status.DatabaseBytes); err != nil {
+		return store.StorageStatus{}, err
+	}
+
+	// reltuples is -1 for tables never vacuumed or analyzed.
+	rows, err := s.db.Query(ctx, `
+		SELECT c.relname, GREATEST(c.reltuples, 0)::BIGINT, pg_table_size(c.oid), pg_indexes_size(c.oid)
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p') AND n.nspname = current_schema()
+		ORDER BY pg_total_relation_size(c.oid) DESC, c.relname
+	`)
+	if err != nil {
+		return store.StorageStatus{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t store.TableSize
+		if err := rows.Scan(&t.Name, &t.Rows, &t.TableBytes, &t.IndexBytes); err != nil {
+			return store.StorageStatus{}, err
+		}
+		status.Tables = append(status.Tables, t)
+	}
+	if err := rows.Err(); err != nil {
+		return store.StorageStatus{}, err
+	}
+
+	rows, err = s.db.Query(ctx, `
+		SELECT device, count(*), min(timestamp), max(timestamp)
+		FROM readings
+		GROUP BY device
+		ORDER BY device
+	`)
+	if err != nil {
+		return store.StorageStatus{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d store.DeviceStorage
+		if err := rows.Scan(&d.Device, &d.Count, &d.Oldest, &d.Newest); err != nil {
+			return store.StorageStatus{}, err
+		}
+		status.Devices = append(status.Devices, d)
+	}
+	return status, rows.Err()
+}
@@ -0,0 +1,88 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/jackc/pgx/v5"
+)
+
+var _ store.SyncStore = (*Store)(nil)
+
+func (s *Store) SyncReadings(ctx context.Context, device string, readings []store.SyncReading) (store.SyncResult, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	var result store.SyncResult
+	err := pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		// lock the device row so concurrent uploads from the same device
+		// can't both store the same sequence numbers
+		_, err := tx.Exec(ctx, `
+			INSERT INTO sync_state (device, acked_seq) VALUES ($1, 0)
+			ON CONFLICT (device) DO NOTHING
+		`, device)
+		if err != nil {
+			return err
+		}
+		if err := tx.QueryRow(ctx, `
+			SELECT acked_seq FROM sync_state WHERE device = $1 FOR UPDATE
+		`, device).Scan(&result.AckedSeq); err != nil {
+			return err
+		}
+		result.PrevAckedSeq = result.AckedSeq
+
+		fresh := make([]store.SyncReading, 0, len(readings))
+		acked := result.AckedSeq
+		for _, r := range readings {
+			if r.Seq > result.AckedSeq {
+				fresh = append(fresh, r)
+				acked = max(acked, r.Seq)
+			}
+		}
+		if len(fresh) == 0 {
+			return nil
+		}
+
+		_, err = tx.CopyFrom(ctx,
+			pgx.Identifier{"readings"},
+			[]string{"temp_co", "temp_room", "humidity", "timestamp", "device", "received_at", "quality"},
+			pgx.CopyFromSlice(len(fresh), func(i int) ([]any, error) {
+				r := fresh[i]
+				return []any{r.TempCo, r.TempRoom, r.Humidity, r.Timestamp, device, r.ReceivedAt, store.QualityOf(r.TemperatureReading)}, nil
+			}),
+		)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `
+			UPDATE sync_state SET acked_seq = $2, updated_at = NOW() WHERE device = $1
+		`, device, acked); err != nil {
+			return err
+		}
+		result.AckedSeq, result.Inserted = acked, len(fresh)
+		return nil
+	})
+	return result, err
+}
+
+var _ store.ReplaceStore = (*Store)(nil)
+
+func (s *Store) ReplaceReadings(ctx context.Context, device string, from, to int64, readings []store.TemperatureReading) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	return pgx.BeginFunc(ctx, s.db, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `
+			DELETE FROM readings WHERE device = $1 AND timestamp >= $2 AND timestamp < $3
+		`, device, from, to); err != nil {
+			return err
+		}
+		_, err := tx.CopyFrom(ctx,
+			pgx.Identifier{"readings"},
+			[]string{"temp_co", "temp_room", "humidity", "timestamp", "device", "received_at", "quality"},
+			pgx.CopyFromSlice(len(readings), func(i int) ([]any, error) {
+				r := readings[i]
+				return []any{r.TempCo, r.TempRoom, r.Humidity, r.Timestamp, device, r.ReceivedAt, store.QualityOf(r)}, nil
+			}),
+		)
+		return err
+	})
+}
@@ -0,0 +1,161 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	slogctx "github.com/veqryn/slog-context"
+)
+
+// DefaultSlowQueryThreshold is how long a statement may take before it is
+// logged as slow.
+const DefaultSlowQueryThreshold = 500 * time.Millisecond
+
+const (
+	maxLoggedSQL  = 500
+	maxLoggedArgs = 10
+	maxLoggedArg  = 40
+)
+
+var slowQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "esp8266_db_slow_queries_total",
+	Help: "PostgreSQL statements slower than the slow query threshold, by operation.",
+}, []string{"operation"})
+
+// operations bound the operation label.
+var operations = []string{"select", "insert", "update", "delete", "with", "copy"}
+
+// SlowQueryTracer logs the statements taking longer than Threshold with the
+// logger of their context, which carries the request id for statements run
+// by a request. Set it as the pgx.ConnConfig.Tracer.
+type SlowQueryTracer struct {
+	Threshold time.Duration
+}
+
+var (
+	_ pgx.QueryTracer    = (*SlowQueryTracer)(nil)
+	_ pgx.CopyFromTracer = (*SlowQueryTracer)(nil)
+)
+
+type traceKey struct{}
+
+type traceStart struct {
+	at   time.Time
+	sql  string
+	args []any
+}
+
+func (t *SlowQueryTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, traceKey{}, traceStart{at: time.Now(), sql: data.SQL, args: data.Args})
+}
+
+func (t *SlowQueryTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	t.end(ctx, data.Err)
+}
+
+func (t *SlowQueryTracer) TraceCopyFromStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromStartData) context.Context {
+	sql := fmt.Sprintf("COPY %s (%s) FROM STDIN", data.TableName.Sanitize(), strings.Join(data.ColumnNames, ", "))
+	return context.WithValue(ctx, traceKey{}, traceStart{at: time.Now(), sql: sql})
+}
+
+func (t *SlowQueryTracer) TraceCopyFromEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	t.end(ctx, data.Err)
+}
+
+func (t *SlowQueryTracer) end(ctx context.Context, err error) {
+	start, ok := ctx.Value(traceKey{}).(traceStart)
+	if !ok {
+		return
+	}
+	duration := time.Since(start.at)
+	if duration < t.Threshold {
+		return
+	}
+	sql := compactSQL(start.sql)
+	slowQueries.WithLabelValues(operation(sql)).Inc()
+	attrs := []any{
+		slog.String("sql", sql),
+		slog.Any("args", summarizeArgs(start.args)),
+		slog.Duration("duration", duration),
+	}
+	if err != nil {
+		attrs = append(attrs, "error", err)
+	}
+	slogctx.FromCtx(ctx).Warn("slow query", attrs...)
+}
+
+// compactSQL collapses the whitespace of the indented statements here and
+// cuts long ones short.
+func compactSQL(sql string) string {
+	sql = strings.Join(strings.Fields(sql), " ")
+	if len(sql) > maxLoggedSQL {
+		sql = sql[:maxLoggedSQL] + "…"
+	}
+	return sql
+}
+
+func operation(sql string) string {
+	word, _, _ := strings.Cut(sql, " ")
+	word = strings.ToLower(word)
+	for _, op := range operations {
+		if word == op {
+			return op
+		}
+	}
+	return "other"
+}
+
+// summarizeArgs renders the first few arguments, cutting long ones short,
+// so a COPY-sized argument list doesn't flood the log.
+func summarizeArgs(args []any) []string {
+	summary := make([]string, 0, min(len(args), maxLoggedArgs+1))
+	for i, arg := range args {
+		if i == maxLoggedArgs {
+			summary = append(summary, fmt.Sprintf("(%d more)", len(args)-maxLoggedArgs))
+			break
+		}
+		var s string
+		switch v := arg.(type) {
+		case string:
+			s = fmt.Sprintf("%q", v)
+		case []byte:
+			s = fmt.Sprintf("(%d bytes)", len(v))
+		default:
+			s = fmt.Sprint(deref(arg))
+		}
+		if len(s) > maxLoggedArg {
+			s = s[:maxLoggedArg] + "…"
+		}
+		summary = append(summary, s)
+	}
+	return summary
+}
+
+// deref shows pointer arguments, e.g. optional timestamps, by their value.
+func deref(arg any) any {
+	switch v := arg.(type) {
+	case *int64:
+		if v != nil {
+			return *v
+		}
+	case *float64:
+		if v != nil {
+			return *v
+		}
+	case *string:
+		if v != nil {
+			return *v
+		}
+	case *time.Time:
+		if v != nil {
+			return *v
+		}
+	}
+	return arg
+}
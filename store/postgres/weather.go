@@ -0,0 +1,44 @@
+package postgres
+
+import (
+	"context"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+var _ store.WeatherStore = (*Store)(nil)
+
+func (s *Store) InsertOutdoorReading(ctx context.Context, r store.OutdoorReading) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	_, err := s.db.Exec(ctx, `
+		INSERT INTO outdoor_readings (timestamp, temp, humidity) VALUES ($1, $2, $3)
+		ON CONFLICT (timestamp) DO UPDATE SET temp = EXCLUDED.temp, humidity = EXCLUDED.humidity
+	`, r.Timestamp, r.Temp, r.Humidity)
+	return err
+}
+
+func (s *Store) ListOutdoorReadings(ctx context.Context, from, to int64) ([]store.OutdoorReading, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	rows, err := s.db.Query(ctx, `
+		SELECT timestamp, temp, humidity
+		FROM outdoor_readings
+		WHERE timestamp BETWEEN $1 AND $2
+		ORDER BY timestamp DESC
+	`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	readings := make([]store.OutdoorReading, 0)
+	for rows.Next() {
+		var r store.OutdoorReading
+		if err := rows.Scan(&r.Timestamp, &r.Temp, &r.Humidity); err != nil {
+			return nil, err
+		}
+		readings = append(readings, r)
+	}
+	return readings, rows.Err()
+}
@@ -0,0 +1,893 @@
+// Package store defines the storage interface the HTTP server is built on.
+package store
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type TemperatureReading struct {
+	Id        int     `json:"id"`
+	TempCo    float64 `json:"tempCo"`
+	TempRoom  float64 `json:"tempRoom"`
+	Humidity  float64 `json:"humidity"`
+	Timestamp *int64  `json:"timestamp"`
+	// Device sent the reading, empty when it isn't known.
+	Device string `json:"device,omitempty"`
+	// ReceivedAt is when the server received the reading, while Timestamp
+	// is when it was measured; they differ for backlogs uploaded late. Nil
+	// when the store doesn't keep it.
+	ReceivedAt *int64 `json:"receivedAt,omitempty"`
+	// Quality flags the reading, one of Qualities. Stores keeping it return
+	// QualityOK for readings stored without one; empty when the store
+	// doesn't keep it.
+	Quality string `json:"quality,omitempty"`
+}
+
+// Qualities of a reading: QualityOK, unless validation found its values
+// implausible, anomaly detection found it out of line with the device's
+// previous reading, or a correction filled it in or recalibrated it.
+const (
+	QualityOK           = "ok"
+	QualitySuspect      = "suspect"
+	QualityInterpolated = "interpolated"
+	QualityCalibrated   = "calibrated"
+	QualityAnomalous    = "anomalous"
+)
+
+var Qualities = []string{QualityOK, QualitySuspect, QualityInterpolated, QualityCalibrated, QualityAnomalous}
+
+// QualityOf returns r's quality, QualityOK when it has none.
+func QualityOf(r TemperatureReading) string {
+	if r.Quality == "" {
+		return QualityOK
+	}
+	return r.Quality
+}
+
+// Store persists temperature readings.
+type Store interface {
+	// InsertReading stores r and returns it as persisted, with Id set.
+	InsertReading(ctx context.Context, r TemperatureReading) (TemperatureReading, error)
+	// InsertReadings stores rs in bulk and returns the number of rows written.
+	InsertReadings(ctx context.Context, rs []TemperatureReading) (int64, error)
+	// ListReadings returns readings ordered by timestamp, newest first.
+	ListReadings(ctx context.Context, limit, offset int) ([]TemperatureReading, error)
+	Ping(ctx context.Context) error
+	Close()
+}
+
+// SyncReading is a reading tagged with the device's local sequence number.
+type SyncReading struct {
+	Seq int64
+	TemperatureReading
+}
+
+type SyncResult struct {
+	// AckedSeq is the highest sequence number stored for the device.
+	AckedSeq int64
+	// Inserted is how many of the submitted readings were new.
+	Inserted int
+	// PrevAckedSeq is the acknowledged sequence before the upload; the
+	// readings above it were the new ones.
+	PrevAckedSeq int64
+}
+
+// SyncStore is implemented by stores supporting the offline sync protocol.
+type SyncStore interface {
+	// SyncReadings atomically stores the readings whose Seq is above the
+	// device's acknowledged sequence and advances it to the highest Seq
+	// stored. Readings at or below it are duplicates of earlier uploads.
+	SyncReadings(ctx context.Context, device string, readings []SyncReading) (SyncResult, error)
+}
+
+// Import conflict strategies, for an imported reading of a device and
+// timestamp that is already stored.
+const (
+	// ConflictSkip keeps the stored reading.
+	ConflictSkip = "skip"
+	// ConflictOverwrite replaces the stored reading's values.
+	ConflictOverwrite = "overwrite"
+	// ConflictKeepNewer keeps whichever reading was stored later, by
+	// StoredAt.
+	ConflictKeepNewer = "keep-newer"
+)
+
+// ConflictStrategies lists the import conflict strategies.
+var ConflictStrategies = []string{ConflictSkip, ConflictOverwrite, ConflictKeepNewer}
+
+// ImportReading is a historic reading, e.g. from another instance's
+// export. Its Timestamp is required.
+type ImportReading struct {
+	TemperatureReading
+	// StoredAt is when the source stored the reading, unix seconds. It is
+	// required by ConflictKeepNewer; nil means now.
+	StoredAt *int64
+}
+
+type ImportResult struct {
+	Inserted    int `json:"inserted"`
+	Overwritten int `json:"overwritten"`
+	// Skipped are the readings that lost their conflict.
+	Skipped int `json:"skipped"`
+}
+
+// ImportStore is implemented by stores importing historic readings.
+type ImportStore interface {
+	// ImportReadings atomically stores the readings of device, resolving
+	// readings whose timestamp is already stored for the device with
+	// conflict, one of ConflictStrategies. Every reading's timestamp must
+	// be unique.
+	ImportReadings(ctx context.Context, device string, readings []ImportReading, conflict string) (ImportResult, error)
+}
+
+// ReplaceStore is implemented by stores that can be the upstream of an edge
+// instance, whose copy of a device's readings replaces theirs range by
+// range.
+type ReplaceStore interface {
+	// ReplaceReadings atomically replaces the readings of device stamped in
+	// [from, to) with readings, which must be stamped within it.
+	ReplaceReadings(ctx context.Context, device string, from, to int64, readings []TemperatureReading) error
+}
+
+// ReadingDigest summarizes the readings of a device stamped in [From,
+// From+width) of some width, so two copies of them can be compared without
+// transferring them.
+type ReadingDigest struct {
+	From  int64 `json:"from"`
+	Count int   `json:"count"`
+	// Hash is the hex SHA-256 of the readings' timestamps, values and
+	// quality, in order.
+	Hash string `json:"hash"`
+}
+
+// DigestReadings returns the digests of the buckets of width seconds,
+// aligned to multiples of it, that readings are stamped in, ordered by
+// From. Readings without a timestamp are left out.
+func DigestReadings(readings []TemperatureReading, width int64) []ReadingDigest {
+	buckets := make(map[int64][]TemperatureReading)
+	for _, r := range readings {
+		if r.Timestamp != nil {
+			from := *r.Timestamp - mod(*r.Timestamp, width)
+			buckets[from] = append(buckets[from], r)
+		}
+	}
+	digests := make([]ReadingDigest, 0, len(buckets))
+	for _, from := range slices.Sorted(maps.Keys(buckets)) {
+		digests = append(digests, Digest(from, buckets[from]))
+	}
+	return digests
+}
+
+// Digest returns the digest of readings, stamped in the bucket starting at
+// from. The order they are listed in doesn't matter.
+func Digest(from int64, readings []TemperatureReading) ReadingDigest {
+	type line struct {
+		ts   int64
+		text string
+	}
+	lines := make([]line, 0, len(readings))
+	for _, r := range readings {
+		if r.Timestamp == nil {
+			continue
+		}
+		lines = append(lines, line{*r.Timestamp, fmt.Sprintf("%d %s %s %s %s\n", *r.Timestamp,
+			strconv.FormatFloat(r.TempCo, 'g', -1, 64), strconv.FormatFloat(r.TempRoom, 'g', -1, 64),
+			strconv.FormatFloat(r.Humidity, 'g', -1, 64), QualityOf(r))})
+	}
+	slices.SortFunc(lines, func(a, b line) int { return cmp.Or(cmp.Compare(a.ts, b.ts), strings.Compare(a.text, b.text)) })
+	h := sha256.New()
+	for _, l := range lines {
+		h.Write([]byte(l.text))
+	}
+	return ReadingDigest{From: from, Count: len(lines), Hash: hex.EncodeToString(h.Sum(nil))}
+}
+
+// mod is the remainder of a divided by b, never negative.
+func mod(a, b int64) int64 {
+	return ((a % b) + b) % b
+}
+
+// ReadingFilter matches readings whose Field, tempCo, tempRoom, humidity,
+// timestamp or receivedAt, compares with Op, one of FilterOps, against
+// Value.
+type ReadingFilter struct {
+	Field string
+	Op    string
+	Value float64
+}
+
+// FilterFields and FilterOps are what a ReadingFilter may use.
+var (
+	FilterFields = []string{"tempCo", "tempRoom", "humidity", "timestamp", "receivedAt"}
+	FilterOps    = []string{"eq", "ne", "gt", "gte", "lt", "lte"}
+)
+
+// Matches reports whether r matches f. Unknown fields and ops match
+// nothing.
+func (f ReadingFilter) Matches(r TemperatureReading) bool {
+	var v float64
+	switch f.Field {
+	case "tempCo":
+		v = r.TempCo
+	case "tempRoom":
+		v = r.TempRoom
+	case "humidity":
+		v = r.Humidity
+	case "timestamp":
+		if r.Timestamp == nil {
+			return false
+		}
+		v = float64(*r.Timestamp)
+	case "receivedAt":
+		if r.ReceivedAt == nil {
+			return false
+		}
+		v = float64(*r.ReceivedAt)
+	default:
+		return false
+	}
+	switch f.Op {
+	case "eq":
+		return v == f.Value
+	case "ne":
+		return v != f.Value
+	case "gt":
+		return v > f.Value
+	case "gte":
+		return v >= f.Value
+	case "lt":
+		return v < f.Value
+	case "lte":
+		return v <= f.Value
+	}
+	return false
+}
+
+// Orders readings may be listed in, newest first: by measurement time,
+// the default, or by receive time, readings without one last.
+const (
+	OrderTimestamp  = "timestamp"
+	OrderReceivedAt = "receivedAt"
+)
+
+// ReadingQuery selects the readings matching every filter and, unless
+// Devices is nil, sent by one of Devices and, unless Qualities is nil, of
+// one of Qualities.
+type ReadingQuery struct {
+	Filters   []ReadingFilter
+	Devices   []string
+	Qualities []string
+	// Order is OrderTimestamp, the default when empty, or OrderReceivedAt.
+	Order string
+	// After, when set, selects the readings listed after it in
+	// OrderTimestamp only, for paging through them with offset 0 instead
+	// of an offset growing with every page.
+	After *ReadingCursor
+}
+
+// ReadingCursor is where a listing in OrderTimestamp, newest first and
+// then by descending Id, left off: the readings after it are older, or as
+// old with a lower Id. Readings without a timestamp, listed first, aren't
+// after any cursor.
+type ReadingCursor struct {
+	Timestamp int64
+	Id        int
+}
+
+// CursorAfter returns the cursor to list the readings after r with. After
+// a reading without a timestamp, it is before every reading with one, so
+// the rest of those without a timestamp are skipped.
+func CursorAfter(r TemperatureReading) ReadingCursor {
+	if r.Timestamp == nil {
+		return ReadingCursor{Timestamp: math.MaxInt64, Id: math.MaxInt32}
+	}
+	return ReadingCursor{Timestamp: *r.Timestamp, Id: r.Id}
+}
+
+// Before reports whether r is listed after c.
+func (c ReadingCursor) Before(r TemperatureReading) bool {
+	return r.Timestamp != nil && (*r.Timestamp < c.Timestamp || *r.Timestamp == c.Timestamp && r.Id < c.Id)
+}
+
+// Matches reports whether r is selected by q.
+func (q ReadingQuery) Matches(r TemperatureReading) bool {
+	if q.After != nil && !q.After.Before(r) {
+		return false
+	}
+	if q.Devices != nil && !slices.Contains(q.Devices, r.Device) {
+		return false
+	}
+	if q.Qualities != nil && !slices.Contains(q.Qualities, QualityOf(r)) {
+		return false
+	}
+	for _, f := range q.Filters {
+		if !f.Matches(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterStore is implemented by stores filtering readings as they are read.
+type FilterStore interface {
+	// ListFilteredReadings is ListReadings of the readings selected by q.
+	ListFilteredReadings(ctx context.Context, q ReadingQuery, limit, offset int) ([]TemperatureReading, error)
+}
+
+// LabelStore is implemented by stores keeping key-value labels of
+// devices, e.g. floor=1, for selecting readings by label.
+type LabelStore interface {
+	// DeviceLabels returns the labels of every labelled device.
+	DeviceLabels(ctx context.Context) (map[string]map[string]string, error)
+	// SetDeviceLabels replaces the device's labels; no labels unlabel it.
+	SetDeviceLabels(ctx context.Context, device string, labels map[string]string) error
+}
+
+// SmoothingStore is implemented by stores smoothing readings as they are
+// read.
+type SmoothingStore interface {
+	// ListSmoothedReadings is ListReadings with the values of every reading
+	// replaced by the mean of the same device's readings stamped within
+	// half seconds either side of it, a centered rolling mean over 2*half
+	// seconds.
+	// Readings without a timestamp keep their values.
+	ListSmoothedReadings(ctx context.Context, limit, offset int, half int64) ([]TemperatureReading, error)
+}
+
+// ErrNotFound is returned when a looked up record doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// AlertRule fires when Field compared with Op against Threshold holds for an
+// incoming reading.
+type AlertRule struct {
+	Id        int     `json:"id"`
+	Name      string  `json:"name"`
+	Field     string  `json:"field"`
+	Op        string  `json:"op"`
+	Threshold float64 `json:"threshold"`
+	Severity  string  `json:"severity"`
+	Enabled   bool    `json:"enabled"`
+	// Escalation lists who to notify while the alert stays unacknowledged.
+	Escalation []EscalationStep `json:"escalation"`
+	// Templates override the notification text of this rule, keyed by
+	// channel name or "default" for every channel.
+	Templates map[string]string `json:"templates"`
+}
+
+// EscalationStep notifies Channel once the alert has been firing for
+// AfterSeconds without being acknowledged.
+type EscalationStep struct {
+	Channel      string `json:"channel"`
+	AfterSeconds int64  `json:"afterSeconds"`
+}
+
+// Alert is a currently firing rule.
+type Alert struct {
+	RuleId   int    `json:"ruleId"`
+	RuleName string `json:"ruleName"`
+	Severity string `json:"severity"`
+	// Since is the unix timestamp of the reading that started it.
+	Since int64 `json:"since"`
+	// Value is the reading value that started it.
+	Value float64 `json:"value"`
+	// Device sent the reading that started it, when known.
+	Device string `json:"device,omitempty"`
+	// Silenced is set when an active silence matches the alert.
+	Silenced bool `json:"silenced"`
+	// FiredAt is the server time the alert started firing, escalation
+	// steps are counted from it.
+	FiredAt int64 `json:"firedAt"`
+	// AckedAt is set once the alert is acknowledged, which stops escalation.
+	AckedAt *int64 `json:"ackedAt"`
+	// Notified is how many escalation steps have been notified.
+	Notified int `json:"notified"`
+	// AckToken authorizes the acknowledge link sent in notifications.
+	AckToken string `json:"-"`
+}
+
+const (
+	AlertFiring       = "firing"
+	AlertAcknowledged = "acknowledged"
+	AlertResolved     = "resolved"
+)
+
+// AlertEvent is a firing, acknowledged or resolved transition in the alert
+// history.
+type AlertEvent struct {
+	Id        int64   `json:"id"`
+	RuleId    int     `json:"ruleId"`
+	RuleName  string  `json:"ruleName"`
+	State     string  `json:"state"`
+	Value     float64 `json:"value"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+// AlertHistoryFilter selects alert events; zero fields don't filter.
+type AlertHistoryFilter struct {
+	RuleId int
+	State  string
+	From   int64
+	To     int64
+	Limit  int
+	Offset int
+}
+
+// AlertStore is implemented by stores supporting alerting.
+type AlertStore interface {
+	ListAlertRules(ctx context.Context) ([]AlertRule, error)
+	GetAlertRule(ctx context.Context, id int) (AlertRule, error)
+	CreateAlertRule(ctx context.Context, r AlertRule) (AlertRule, error)
+	UpdateAlertRule(ctx context.Context, r AlertRule) (AlertRule, error)
+	// DeleteAlertRule removes the rule and its firing state; its history
+	// is kept.
+	DeleteAlertRule(ctx context.Context, id int) error
+
+	ListFiringAlerts(ctx context.Context) ([]Alert, error)
+	// FireAlert marks the rule as firing and records the transition.
+	FireAlert(ctx context.Context, a Alert) error
+	// ResolveAlert clears the rule's firing state and records the
+	// transition.
+	ResolveAlert(ctx context.Context, ruleId int, value float64, timestamp int64) error
+	// AckAlert acknowledges the firing alert with the ack token at now and
+	// records the transition. Acknowledging twice keeps the first time.
+	AckAlert(ctx context.Context, token string, now int64) (Alert, error)
+	// SetAlertNotified records how many escalation steps of the firing
+	// alert have been notified.
+	SetAlertNotified(ctx context.Context, ruleId int, notified int) error
+	// ListAlertHistory returns matching events, newest first.
+	ListAlertHistory(ctx context.Context, f AlertHistoryFilter) ([]AlertEvent, error)
+
+	CreateSilence(ctx context.Context, s Silence) (Silence, error)
+	// ListActiveSilences returns the silences that haven't ended by now,
+	// ending soonest first.
+	ListActiveSilences(ctx context.Context, now int64) ([]Silence, error)
+	// ExpireSilence ends an active silence at now.
+	ExpireSilence(ctx context.Context, id int, now int64) error
+}
+
+// SilenceMatcher matches an alert label, "rule" or "severity", against Value.
+// Regex values must match the whole label.
+type SilenceMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+}
+
+// Silence mutes the alerts matched by all of its matchers between StartsAt
+// and EndsAt, unix timestamps. Muted alerts still fire and are recorded.
+type Silence struct {
+	Id       int              `json:"id"`
+	Matchers []SilenceMatcher `json:"matchers"`
+	Comment  string           `json:"comment"`
+	StartsAt int64            `json:"startsAt"`
+	EndsAt   int64            `json:"endsAt"`
+}
+
+// Command is an instruction queued for a device, which polls for it and
+// acknowledges it once carried out.
+type Command struct {
+	Id     int64  `json:"id"`
+	Device string `json:"device"`
+	// Type says what to act on, e.g. "relay", and Value how, e.g. "on".
+	Type      string `json:"type"`
+	Value     string `json:"value"`
+	CreatedAt int64  `json:"createdAt"`
+	AckedAt   *int64 `json:"ackedAt"`
+}
+
+// CommandStore is implemented by stores supporting the device command queue.
+type CommandStore interface {
+	// EnqueueCommand queues c. It supersedes the device's pending commands
+	// of the same type, which are dropped.
+	EnqueueCommand(ctx context.Context, c Command) (Command, error)
+	// PendingCommands returns the device's unacknowledged commands, oldest
+	// first.
+	PendingCommands(ctx context.Context, device string) ([]Command, error)
+	// AckCommand acknowledges a pending command of the device at now.
+	AckCommand(ctx context.Context, device string, id int64, now int64) error
+}
+
+// Zone switches the relay of RelayDevice to keep Field of Device's readings
+// within Hysteresis of Target.
+type Zone struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+	// Device sends the readings the zone follows, empty for readings sent
+	// without a device.
+	Device string `json:"device"`
+	// RelayDevice receives the relay commands.
+	RelayDevice string  `json:"relayDevice"`
+	Field       string  `json:"field"`
+	Target      float64 `json:"target"`
+	Hysteresis  float64 `json:"hysteresis"`
+	// Mode is "heat", relay on below the band, or "cool", on above it.
+	Mode    string `json:"mode"`
+	Enabled bool   `json:"enabled"`
+
+	// Override, when set, forces the relay on or off until OverrideUntil,
+	// or until cleared when it is 0.
+	Override      *bool `json:"override"`
+	OverrideUntil int64 `json:"overrideUntil"`
+	// Relay is the last commanded state, nil before the first command.
+	Relay *bool `json:"relay"`
+	// ChangedAt is when Relay was last commanded.
+	ChangedAt int64 `json:"changedAt"`
+}
+
+const (
+	// ZoneEventRelay is a relay command, State "on" or "off".
+	ZoneEventRelay = "relay"
+	// ZoneEventOverride is a manual override, State "on", "off" or "auto"
+	// once cleared.
+	ZoneEventOverride = "override"
+)
+
+// ZoneEvent is a transition in a zone's history.
+type ZoneEvent struct {
+	Id     int64  `json:"id"`
+	ZoneId int    `json:"zoneId"`
+	Kind   string `json:"kind"`
+	State  string `json:"state"`
+	// Value is the reading value that caused a relay command.
+	Value     float64 `json:"value"`
+	Target    float64 `json:"target"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+// ZoneStore is implemented by stores supporting thermostat zones.
+type ZoneStore interface {
+	ListZones(ctx context.Context) ([]Zone, error)
+	GetZone(ctx context.Context, id int) (Zone, error)
+	CreateZone(ctx context.Context, z Zone) (Zone, error)
+	// UpdateZone replaces the zone's settings; its override and relay
+	// state are kept.
+	UpdateZone(ctx context.Context, z Zone) (Zone, error)
+	// DeleteZone removes the zone; its history is kept.
+	DeleteZone(ctx context.Context, id int) error
+	// SetZoneRelay records a relay command, e.State, and the transition.
+	SetZoneRelay(ctx context.Context, e ZoneEvent) error
+	// SetZoneOverride sets or, with a nil override, clears the zone's
+	// override and records the transition at now.
+	SetZoneOverride(ctx context.Context, id int, override *bool, until, now int64) (Zone, error)
+	// ListZoneHistory returns the zone's events, newest first.
+	ListZoneHistory(ctx context.Context, id int, limit, offset int) ([]ZoneEvent, error)
+
+	// GetAwayMode returns the away mode, nil when it isn't set.
+	GetAwayMode(ctx context.Context) (*AwayMode, error)
+	// SetAwayMode sets or, with nil, clears the away mode.
+	SetAwayMode(ctx context.Context, m *AwayMode) error
+}
+
+// AwayMode holds heating zones at a frost-protection Setpoint from Since
+// until Until, unix timestamps, while the house is left cold on purpose.
+type AwayMode struct {
+	Setpoint float64 `json:"setpoint"`
+	Since    int64   `json:"since"`
+	Until    int64   `json:"until"`
+}
+
+// OutdoorReading is the weather at the configured location, fetched from a
+// weather service for comparison with the indoor readings.
+type OutdoorReading struct {
+	Temp     float64 `json:"temp"`
+	Humidity float64 `json:"humidity"`
+	// Timestamp is when the service observed the weather, not when it was
+	// fetched.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// WeatherStore is implemented by stores keeping outdoor readings.
+type WeatherStore interface {
+	// InsertOutdoorReading stores r, replacing a reading with the same
+	// timestamp.
+	InsertOutdoorReading(ctx context.Context, r OutdoorReading) error
+	// ListOutdoorReadings returns the readings with timestamps in
+	// [from, to], newest first.
+	ListOutdoorReadings(ctx context.Context, from, to int64) ([]OutdoorReading, error)
+}
+
+// Location kinds, outermost first. A location's parent must be of an
+// earlier kind.
+const (
+	LocationHouse = "house"
+	LocationFloor = "floor"
+	LocationRoom  = "room"
+)
+
+// LocationKinds lists the location kinds, outermost first.
+var LocationKinds = []string{LocationHouse, LocationFloor, LocationRoom}
+
+// Location is a house, floor or room that devices are placed in.
+type Location struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	// ParentId is the enclosing location, nil for a top-level one.
+	ParentId *int `json:"parentId"`
+	// Devices are placed directly in the location, not in a descendant.
+	Devices []string `json:"devices"`
+}
+
+// LocationStore is implemented by stores keeping the location hierarchy.
+// A device is placed in at most one location; placing it in another moves
+// it.
+type LocationStore interface {
+	// ListLocations returns every location, ordered by id.
+	ListLocations(ctx context.Context) ([]Location, error)
+	GetLocation(ctx context.Context, id int) (Location, error)
+	CreateLocation(ctx context.Context, l Location) (Location, error)
+	// UpdateLocation replaces the location, including its devices.
+	UpdateLocation(ctx context.Context, l Location) (Location, error)
+	// DeleteLocation removes the location; its devices are unplaced and
+	// its children become top-level.
+	DeleteLocation(ctx context.Context, id int) error
+}
+
+// TableSize is the disk usage of a table.
+type TableSize struct {
+	Name string `json:"name"`
+	// Rows is the planner's estimate, as counting every row is slow.
+	Rows       int64 `json:"rows"`
+	TableBytes int64 `json:"tableBytes"`
+	IndexBytes int64 `json:"indexBytes"`
+}
+
+// DeviceStorage summarizes the stored readings of a device.
+type DeviceStorage struct {
+	// Device is empty for readings without a known device.
+	Device string `json:"device"`
+	Count  int64  `json:"count"`
+	// Oldest and Newest are the timestamp range, nil when no reading has
+	// one.
+	Oldest *int64 `json:"oldest"`
+	Newest *int64 `json:"newest"`
+}
+
+// StorageStatus is how much a store holds.
+type StorageStatus struct {
+	// DatabaseBytes is the total size on disk, 0 when it isn't known.
+	DatabaseBytes int64 `json:"databaseBytes"`
+	// Tables are ordered largest first.
+	Tables []TableSize `json:"tables"`
+	// Devices are ordered by name.
+	Devices []DeviceStorage `json:"devices"`
+}
+
+// StatusStore is implemented by stores reporting their disk usage.
+type StatusStore interface {
+	StorageStatus(ctx context.Context) (StorageStatus, error)
+}
+
+// FeatureChange is a feature flag set at runtime, recorded for auditing.
+type FeatureChange struct {
+	Id    int64  `json:"id"`
+	Name  string `json:"name"`
+	Value bool   `json:"value"`
+	// Actor is the name of the key that made the change.
+	Actor string `json:"actor"`
+	// At is a Unix timestamp.
+	At int64 `json:"at"`
+}
+
+// FeatureStore is implemented by stores keeping the feature flags, so
+// replicas sharing the store share them.
+type FeatureStore interface {
+	// FeatureFlags returns the flags ever set, by name.
+	FeatureFlags(ctx context.Context) (map[string]bool, error)
+	// SetFeatureFlags atomically sets the flags and records the changes.
+	SetFeatureFlags(ctx context.Context, changes []FeatureChange) error
+	// ListFeatureChanges returns the recorded changes, newest first.
+	ListFeatureChanges(ctx context.Context, limit int) ([]FeatureChange, error)
+}
+
+// ErrExists is returned when a record to create is already stored.
+var ErrExists = errors.New("already exists")
+
+// APIKey is a scoped key stored as its bcrypt hash, so only whoever it was
+// issued to knows the key.
+type APIKey struct {
+	Name string
+	// ID is the public prefix of the key, "<ID>.<secret>", which finds
+	// the hash of its secret without comparing every hash. Keys imported
+	// from a config file have none, and are stored hashed whole.
+	ID     string
+	Hash   string
+	Scopes []string
+	// Device is the device a provisioned key is bound to, empty for a key
+	// not bound to one.
+	Device string
+	// CreatedAt is a Unix timestamp.
+	CreatedAt int64
+}
+
+// APIKeyStore is implemented by stores keeping hashed API keys.
+type APIKeyStore interface {
+	// ListAPIKeys returns every key, ordered by name.
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	// CreateAPIKey stores k, or returns ErrExists when a key of the same
+	// name is stored.
+	CreateAPIKey(ctx context.Context, k APIKey) error
+	DeleteAPIKey(ctx context.Context, name string) error
+}
+
+// Maintenance operations.
+const (
+	MaintenanceVacuum  = "vacuum"
+	MaintenanceAnalyze = "analyze"
+	MaintenanceReindex = "reindex"
+	// MaintenanceRefresh refreshes materialized views.
+	MaintenanceRefresh = "refresh"
+)
+
+// MaintenanceOps lists the maintenance operations.
+var MaintenanceOps = []string{MaintenanceVacuum, MaintenanceAnalyze, MaintenanceReindex, MaintenanceRefresh}
+
+// MaintenanceStore is implemented by stores that can be maintained on
+// demand.
+type MaintenanceStore interface {
+	// Maintain runs op, one of MaintenanceOps, on table or, when table is
+	// empty, on every table. An unknown table is ErrNotFound.
+	Maintain(ctx context.Context, op, table string) error
+}
+
+// QueryResult receives the result of an ad-hoc query.
+type QueryResult interface {
+	// Columns is called once with the column names, before any row.
+	Columns(names []string) error
+	Row(values []any) error
+}
+
+// Querier runs ad-hoc, read-only SQL for analysis.
+type Querier interface {
+	// Query runs the single statement sql, which must pass CheckQuery,
+	// cancelling it after timeout. Errors caused by the statement itself,
+	// e.g. a syntax error, a missing privilege or the timeout, are
+	// *QueryError; nothing is passed to res before the first row is
+	// available, so they are reported before any result is written.
+	Query(ctx context.Context, sql string, timeout time.Duration, res QueryResult) error
+}
+
+// QueryError is an ad-hoc query rejected by the store or the database.
+type QueryError struct {
+	Msg string
+}
+
+func (e *QueryError) Error() string {
+	return e.Msg
+}
+
+// queryKeywords are the statements CheckQuery accepts.
+var queryKeywords = []string{"select", "with", "table", "values"}
+
+// CheckQuery rejects anything but a SELECT, WITH, TABLE or VALUES
+// statement. It is a first line of defence only: a Querier must run the
+// statement read-only as a restricted role, as e.g. WITH allows
+// data-modifying statements, and reject multiple statements.
+func CheckQuery(sql string) error {
+	sql = strings.TrimSpace(sql)
+	if sql == "" {
+		return &QueryError{Msg: "query is empty"}
+	}
+	keyword := sql
+	if end := strings.IndexFunc(sql, func(r rune) bool { return !unicode.IsLetter(r) }); end >= 0 {
+		keyword = sql[:end]
+	}
+	if !slices.Contains(queryKeywords, strings.ToLower(keyword)) {
+		return &QueryError{Msg: fmt.Sprintf("only %s statements are allowed", strings.ToUpper(strings.Join(queryKeywords, ", ")))}
+	}
+	return nil
+}
+
+// QueryPlan is how the database ran a statement.
+type QueryPlan struct {
+	Statement  string `json:"statement"`
+	Parameters []any  `json:"parameters"`
+	// Plan is the output of EXPLAIN (ANALYZE, BUFFERS), a line each.
+	Plan []string `json:"plan"`
+}
+
+// ExplainStore is implemented by stores that can show how they run the
+// statements listing readings, e.g. to check they use the indexes.
+type ExplainStore interface {
+	// ExplainReadings runs the statement listing a page of readings: that of
+	// ListSmoothedReadings when half isn't 0, of ListFilteredReadings with q
+	// when q isn't nil and of ListReadings otherwise. It returns the plan
+	// with the actual timings and buffer usage; nothing is changed.
+	ExplainReadings(ctx context.Context, q *ReadingQuery, half int64, limit, offset int) (QueryPlan, error)
+}
+
+// DeadLetter is an alert notification that failed to send, kept to be
+// inspected and replayed.
+type DeadLetter struct {
+	Id       int    `json:"id"`
+	RuleId   int    `json:"ruleId"`
+	RuleName string `json:"ruleName"`
+	Channel  string `json:"channel"`
+	Subject  string `json:"subject"`
+	Text     string `json:"text"`
+	AckURL   string `json:"ackUrl,omitempty"`
+	// Error is why the last attempt failed.
+	Error string `json:"error"`
+	// Attempts counts the sends, replays included.
+	Attempts int `json:"attempts"`
+	// FailedAt is when the last attempt failed.
+	FailedAt int64 `json:"failedAt"`
+}
+
+// DeadLetterStore is implemented by stores keeping the notifications that
+// failed to send.
+type DeadLetterStore interface {
+	AddDeadLetter(ctx context.Context, d DeadLetter) (DeadLetter, error)
+	// ListDeadLetters returns the dead letters, newest first.
+	ListDeadLetters(ctx context.Context, limit int) ([]DeadLetter, error)
+	GetDeadLetter(ctx context.Context, id int) (DeadLetter, error)
+	// UpdateDeadLetter records another failed attempt of d.
+	UpdateDeadLetter(ctx context.Context, d DeadLetter) error
+	DeleteDeadLetter(ctx context.Context, id int) error
+}
+
+// DeviceFirmware is the firmware version a device last reported.
+type DeviceFirmware struct {
+	Device  string `json:"device"`
+	Version string `json:"version"`
+	// Since is when the device first reported Version.
+	Since int64 `json:"since"`
+}
+
+// FirmwareStore is implemented by stores keeping the firmware version of
+// every device.
+type FirmwareStore interface {
+	// SetDeviceFirmware records that device runs version at at, keeping
+	// Since when the version didn't change.
+	SetDeviceFirmware(ctx context.Context, device, version string, at int64) error
+	// DeviceFirmware returns the version of every device that reported
+	// one, ordered by device.
+	DeviceFirmware(ctx context.Context) ([]DeviceFirmware, error)
+}
+
+// CrashReport is what a device reported about its last restart, e.g. the
+// ESP8266 reset reason and exception.
+type CrashReport struct {
+	Id     int64  `json:"id"`
+	Device string `json:"device"`
+	// Reason is the reset reason, e.g. "Exception" or "Hardware Watchdog".
+	Reason string `json:"reason"`
+	// Exception is the exception cause (EXCCAUSE) of exception resets.
+	Exception *int `json:"exception"`
+	// Stack is the stack dump, empty when there is none.
+	Stack string `json:"stack"`
+	// Firmware is the version that crashed, when reported.
+	Firmware string `json:"firmware,omitempty"`
+	// At is when the report was received.
+	At int64 `json:"at"`
+}
+
+// CrashStore is implemented by stores keeping device crash reports.
+type CrashStore interface {
+	AddCrashReport(ctx context.Context, c CrashReport) (CrashReport, error)
+	// ListCrashReports returns the device's reports, newest first.
+	ListCrashReports(ctx context.Context, device string, limit int) ([]CrashReport, error)
+	// CountCrashReports counts the device's reports received since the
+	// unix time.
+	CountCrashReports(ctx context.Context, device string, since int64) (int, error)
+}
+
+// QualityStore is implemented by stores keeping the quality flag of every
+// reading, for corrections to flag the readings they touched.
+type QualityStore interface {
+	// SetReadingQuality flags the reading with id, one of Qualities. An
+	// unknown reading is ErrNotFound.
+	SetReadingQuality(ctx context.Context, id int, quality string) error
+}
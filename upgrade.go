@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// A zero-downtime upgrade hands the listening sockets over to a new process
+// started from the (replaced) executable, the HTTP one and those of the
+// other protocols served, see sockets. Connections arriving meanwhile
+// wait in the socket's backlog rather than being refused, and the old
+// process finishes the requests it is serving before it exits.
+const (
+	// upgradeEnv marks a process started by an upgrade; it inherits the
+	// listener as fd 3 and reports readiness on the pipe at fd 4.
+	upgradeEnv        = "APP_UPGRADE"
+	upgradeListenerFd = 3
+	upgradeReadyFd    = 4
+	// upgradeSocketsEnv lists the other sockets it inherits, by
+	// socketKey, as the fds from upgradeSocketsFd on.
+	upgradeSocketsEnv = "APP_UPGRADE_SOCKETS"
+	upgradeSocketsFd  = 5
+	// upgradeTimeout is how long the new process may take to get ready.
+	upgradeTimeout = time.Minute
+)
+
+// inheritedListener returns the listener handed over by the process that
+// started this one in an upgrade, and a func telling it this one is ready,
+// or nils when this process wasn't started by an upgrade.
+func inheritedListener() (net.Listener, func() error, error) {
+	if os.Getenv(upgradeEnv) == "" {
+		return nil, nil, nil
+	}
+	os.Unsetenv(upgradeEnv)
+	f := os.NewFile(upgradeListenerFd, "upgrade-listener")
+	ln, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("inherit listener: %w", err)
+	}
+	pipe := os.NewFile(upgradeReadyFd, "upgrade-ready")
+	ready := func() error {
+		defer pipe.Close()
+		_, err := pipe.Write([]byte{1})
+		return err
+	}
+	return ln, ready, nil
+}
+
+// filer is a socket that can be handed over.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// sockets opens the sockets served besides the HTTP listener, e.g. Modbus
+// TCP or StatsD, taking over those handed over by an upgrade instead of
+// binding their addresses again while the old process still holds them.
+// The sockets it opened are handed over in the next upgrade.
+type sockets struct {
+	// inherited are the sockets handed over by socketKey, until taken.
+	inherited map[string]*os.File
+	keys      []string
+	opened    []filer
+}
+
+// socketKey identifies a socket by how it was configured, which an
+// upgrade keeps as it passes the same arguments on.
+func socketKey(network, addr string) string {
+	return network + "/" + addr
+}
+
+// inheritedSockets returns the sockets handed over by the process that
+// started this one in an upgrade, empty when it wasn't.
+func inheritedSockets() *sockets {
+	s := &sockets{inherited: make(map[string]*os.File)}
+	env := os.Getenv(upgradeSocketsEnv)
+	os.Unsetenv(upgradeSocketsEnv)
+	if env == "" {
+		return s
+	}
+	for i, key := range strings.Split(env, ",") {
+		s.inherited[key] = os.NewFile(uintptr(upgradeSocketsFd+i), "upgrade-"+key)
+	}
+	return s
+}
+
+// Listen is net.Listen, taking over an inherited listener of addr.
+func (s *sockets) Listen(network, addr string) (net.Listener, error) {
+	key := socketKey(network, addr)
+	var ln net.Listener
+	var err error
+	if f, ok := s.inherited[key]; ok {
+		delete(s.inherited, key)
+		ln, err = net.FileListener(f)
+		f.Close()
+	} else {
+		ln, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.add(key, ln)
+	return ln, nil
+}
+
+// ListenPacket is net.ListenPacket, taking over an inherited socket of
+// addr.
+func (s *sockets) ListenPacket(network, addr string) (net.PacketConn, error) {
+	key := socketKey(network, addr)
+	var conn net.PacketConn
+	var err error
+	if f, ok := s.inherited[key]; ok {
+		delete(s.inherited, key)
+		conn, err = net.FilePacketConn(f)
+		f.Close()
+	} else {
+		conn, err = net.ListenPacket(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.add(key, conn)
+	return conn, nil
+}
+
+func (s *sockets) add(key string, socket any) {
+	if f, ok := socket.(filer); ok {
+		s.keys = append(s.keys, key)
+		s.opened = append(s.opened, f)
+	}
+}
+
+// closeUnused closes the inherited sockets no longer configured, so their
+// addresses are released once the old process exits.
+func (s *sockets) closeUnused() {
+	for key, f := range s.inherited {
+		f.Close()
+		delete(s.inherited, key)
+	}
+}
+
+// files returns the sockets opened to hand over, with their keys, which
+// the caller closes.
+func (s *sockets) files() ([]string, []*os.File, error) {
+	files := make([]*os.File, 0, len(s.opened))
+	for _, socket := range s.opened {
+		f, err := socket.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, err
+		}
+		files = append(files, f)
+	}
+	return s.keys, files, nil
+}
+
+// upgrade starts the executable again with the same arguments, handing it
+// ln and socks, and returns once it is ready to serve. The caller then
+// shuts down.
+func upgrade(ln net.Listener, socks *sockets) (pid int, err error) {
+	lnFiler, ok := ln.(filer)
+	if !ok {
+		return 0, errors.New("upgrade: listener can't be handed over")
+	}
+	lnFile, err := lnFiler.File()
+	if err != nil {
+		return 0, fmt.Errorf("upgrade: %w", err)
+	}
+	defer lnFile.Close()
+	keys, files, err := socks.files()
+	if err != nil {
+		return 0, fmt.Errorf("upgrade: %w", err)
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, fmt.Errorf("upgrade: %w", err)
+	}
+	defer r.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		w.Close()
+		return 0, fmt.Errorf("upgrade: %w", err)
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), upgradeEnv+"=1", upgradeSocketsEnv+"="+strings.Join(keys, ","))
+	cmd.ExtraFiles = append([]*os.File{lnFile, w}, files...)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return 0, fmt.Errorf("upgrade: start %s: %w", exe, err)
+	}
+
+	// the new process writes a byte once ready, or exits closing the pipe
+	readyc := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		readyc <- err
+	}()
+	select {
+	case err := <-readyc:
+		if err != nil {
+			cmd.Wait()
+			return 0, fmt.Errorf("upgrade: new process exited before it was ready: %s", cmd.ProcessState)
+		}
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, fmt.Errorf("upgrade: new process not ready within %s", upgradeTimeout)
+	}
+	pid = cmd.Process.Pid
+	// it outlives this process
+	return pid, cmd.Process.Release()
+}
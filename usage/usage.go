@@ -0,0 +1,116 @@
+// Package usage estimates how long the boiler ran per day, for correlating
+// with gas bills. Runtime comes from the relay commands of a thermostat zone
+// or, without one, from the CO temperature: the boiler counts as running
+// while the CO circuit is at or above a threshold.
+package usage
+
+import (
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+const (
+	// DefaultThreshold is the CO temperature the boiler counts as running
+	// at; an idle circuit cools down to near room temperature.
+	DefaultThreshold = 35.0
+	// DefaultMaxGap is the longest gap between readings counted as
+	// runtime; a longer one means the device was offline.
+	DefaultMaxGap = 30 * time.Minute
+)
+
+// Interval is a span of runtime, unix timestamps.
+type Interval struct {
+	Start, End int64
+}
+
+// Day is the runtime of one calendar day.
+type Day struct {
+	Date         string  `json:"date"`
+	RuntimeHours float64 `json:"runtimeHours"`
+	// EnergyKWh is RuntimeHours at the boiler's rated power, 0 when the
+	// power isn't known.
+	EnergyKWh float64 `json:"energyKWh"`
+}
+
+// ReadingIntervals returns the runtime in readings, oldest first: the time
+// from every reading with tempCo at or above threshold to the next one, if
+// it came within maxGap. Readings without a timestamp are skipped.
+func ReadingIntervals(readings []store.TemperatureReading, threshold float64, maxGap time.Duration) []Interval {
+	var (
+		intervals []Interval
+		prev      *store.TemperatureReading
+	)
+	for i := range readings {
+		r := &readings[i]
+		if r.Timestamp == nil {
+			continue
+		}
+		if prev != nil && prev.TempCo >= threshold && *r.Timestamp-*prev.Timestamp <= int64(maxGap/time.Second) {
+			intervals = appendInterval(intervals, Interval{*prev.Timestamp, *r.Timestamp})
+		}
+		prev = r
+	}
+	return intervals
+}
+
+// RelayIntervals returns the runtime in a zone's events, oldest first:
+// from every relay "on" to the next "off", or to end while still on.
+func RelayIntervals(events []store.ZoneEvent, end int64) []Interval {
+	var (
+		intervals []Interval
+		on        bool
+		since     int64
+	)
+	for _, e := range events {
+		if e.Kind != store.ZoneEventRelay {
+			continue
+		}
+		switch {
+		case e.State == "on" && !on:
+			on, since = true, e.Timestamp
+		case e.State == "off" && on:
+			on = false
+			intervals = appendInterval(intervals, Interval{since, e.Timestamp})
+		}
+	}
+	if on && end > since {
+		intervals = appendInterval(intervals, Interval{since, end})
+	}
+	return intervals
+}
+
+// appendInterval merges iv into the last interval when they touch.
+func appendInterval(intervals []Interval, iv Interval) []Interval {
+	if n := len(intervals); n > 0 && intervals[n-1].End >= iv.Start {
+		intervals[n-1].End = max(intervals[n-1].End, iv.End)
+		return intervals
+	}
+	return append(intervals, iv)
+}
+
+// Daily splits intervals, clipped to [from, to), into the calendar days of
+// loc, oldest first. Days without runtime are included. power is the
+// boiler's rated power in kW, 0 when unknown.
+func Daily(intervals []Interval, from, to int64, loc *time.Location, power float64) []Day {
+	days := make([]Day, 0)
+	if to <= from {
+		return days
+	}
+	start := time.Unix(from, 0).In(loc)
+	day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+	for day.Unix() < to {
+		next := day.AddDate(0, 0, 1)
+		lo, hi := max(day.Unix(), from), min(next.Unix(), to)
+		var seconds int64
+		for _, iv := range intervals {
+			if s, e := max(iv.Start, lo), min(iv.End, hi); e > s {
+				seconds += e - s
+			}
+		}
+		hours := float64(seconds) / 3600
+		days = append(days, Day{Date: day.Format(time.DateOnly), RuntimeHours: hours, EnergyKWh: hours * power})
+		day = next
+	}
+	return days
+}
@@ -0,0 +1,59 @@
+package usage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func ts(v int64) *int64 { return &v }
+
+func TestReadingIntervals(t *testing.T) {
+	readings := []store.TemperatureReading{
+		{TempCo: 20, Timestamp: ts(0)},
+		{TempCo: 50, Timestamp: ts(600)},
+		{TempCo: 60},
+		{TempCo: 55, Timestamp: ts(1200)},
+		{TempCo: 30, Timestamp: ts(1800)},
+		{TempCo: 40, Timestamp: ts(2400)},
+		// the device was offline
+		{TempCo: 40, Timestamp: ts(2400 + 3600)},
+	}
+	assert.Equal(t, []Interval{{600, 1800}}, ReadingIntervals(readings, DefaultThreshold, DefaultMaxGap))
+	assert.Nil(t, ReadingIntervals(readings[:1], DefaultThreshold, DefaultMaxGap))
+}
+
+func TestRelayIntervals(t *testing.T) {
+	events := []store.ZoneEvent{
+		{Kind: store.ZoneEventRelay, State: "on", Timestamp: 100},
+		{Kind: store.ZoneEventOverride, State: "off", Timestamp: 150},
+		{Kind: store.ZoneEventRelay, State: "off", Timestamp: 200},
+		{Kind: store.ZoneEventRelay, State: "off", Timestamp: 250},
+		{Kind: store.ZoneEventRelay, State: "on", Timestamp: 300},
+	}
+	assert.Equal(t, []Interval{{100, 200}, {300, 1000}}, RelayIntervals(events, 1000))
+	assert.Equal(t, []Interval{{100, 200}}, RelayIntervals(events[:4], 1000))
+}
+
+func TestDaily(t *testing.T) {
+	loc := time.FixedZone("CET", 3600)
+	midnight := time.Date(2025, 10, 25, 0, 0, 0, 0, loc).Unix()
+	intervals := []Interval{
+		// 23:00 to 01:00 counts an hour on each day
+		{midnight - 3600, midnight + 3600},
+		{midnight + 12*3600, midnight + 13*3600 + 1800},
+	}
+	days := Daily(intervals, midnight-12*3600, midnight+2*86400, loc, 24)
+	assert.Equal(t, []Day{
+		{Date: "2025-10-24", RuntimeHours: 1, EnergyKWh: 24},
+		{Date: "2025-10-25", RuntimeHours: 2.5, EnergyKWh: 60},
+		{Date: "2025-10-26", RuntimeHours: 0, EnergyKWh: 0},
+	}, days)
+
+	// clipped to the range
+	days = Daily(intervals, midnight, midnight+3600/2, loc, 0)
+	assert.Equal(t, []Day{{Date: "2025-10-25", RuntimeHours: 0.5}}, days)
+	assert.Empty(t, Daily(intervals, midnight, midnight, loc, 0))
+}
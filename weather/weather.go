@@ -0,0 +1,137 @@
+// Package weather fetches the outdoor temperature and humidity of the
+// configured location from OpenWeatherMap and stores them next to the
+// indoor readings.
+package weather
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bartosz121/esp8266-web/store"
+)
+
+const (
+	DefaultBaseURL = "https://api.openweathermap.org"
+	// DefaultInterval keeps well within the free plan's call limit;
+	// OpenWeatherMap updates its observations about every 10 minutes.
+	DefaultInterval = 10 * time.Minute
+)
+
+type Config struct {
+	APIKey string
+	// Lat and Lon locate the weather, in degrees.
+	Lat, Lon float64
+	// Interval between fetches, defaults to DefaultInterval.
+	Interval time.Duration
+	// BaseURL defaults to DefaultBaseURL.
+	BaseURL string
+	Client  *http.Client
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// Fetcher periodically stores the current outdoor weather.
+type Fetcher struct {
+	cfg    Config
+	store  store.WeatherStore
+	client *http.Client
+	logger *slog.Logger
+}
+
+func New(st store.WeatherStore, cfg Config) *Fetcher {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = DefaultBaseURL
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+	client := cfg.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &Fetcher{cfg: cfg, store: st, client: client, logger: cfg.Logger}
+}
+
+// Run stores the weather right away and then every interval until ctx is
+// done. Failures are logged and retried on the next tick.
+func (f *Fetcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(f.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := f.Update(ctx); err != nil && ctx.Err() == nil {
+			f.logger.Error("failed to update outdoor weather", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Update fetches the current weather and stores it.
+func (f *Fetcher) Update(ctx context.Context) error {
+	r, err := f.Fetch(ctx)
+	if err != nil {
+		return err
+	}
+	if err := f.store.InsertOutdoorReading(ctx, r); err != nil {
+		return fmt.Errorf("weather: store: %w", err)
+	}
+	f.logger.Debug("stored outdoor weather", "temp", r.Temp, "humidity", r.Humidity, "timestamp", r.Timestamp)
+	return nil
+}
+
+// Fetch returns the current weather at the configured location.
+func (f *Fetcher) Fetch(ctx context.Context) (store.OutdoorReading, error) {
+	q := url.Values{
+		"lat":   {strconv.FormatFloat(f.cfg.Lat, 'f', -1, 64)},
+		"lon":   {strconv.FormatFloat(f.cfg.Lon, 'f', -1, 64)},
+		"appid": {f.cfg.APIKey},
+		"units": {"metric"},
+	}
+	u := strings.TrimRight(f.cfg.BaseURL, "/") + "/data/2.5/weather?" + q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return store.OutdoorReading{}, err
+	}
+	res, err := f.client.Do(req)
+	if err != nil {
+		// the error contains the URL and with it the API key
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return store.OutdoorReading{}, fmt.Errorf("weather: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return store.OutdoorReading{}, fmt.Errorf("weather: unexpected status %s", res.Status)
+	}
+
+	var resp struct {
+		Dt   int64 `json:"dt"`
+		Main *struct {
+			Temp     float64 `json:"temp"`
+			Humidity float64 `json:"humidity"`
+		} `json:"main"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return store.OutdoorReading{}, fmt.Errorf("weather: decode response: %w", err)
+	}
+	if resp.Main == nil || resp.Dt == 0 {
+		return store.OutdoorReading{}, errors.New("weather: response without observation")
+	}
+	return store.OutdoorReading{Temp: resp.Main.Temp, Humidity: resp.Main.Humidity, Timestamp: resp.Dt}, nil
+}
@@ -0,0 +1,39 @@
+package weather
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bartosz121/esp8266-web/store"
+	"github.com/bartosz121/esp8266-web/store/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetcher(t *testing.T) {
+	var query map[string]string
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/data/2.5/weather", r.URL.Path)
+		q := r.URL.Query()
+		query = map[string]string{"lat": q.Get("lat"), "lon": q.Get("lon"), "appid": q.Get("appid"), "units": q.Get("units")}
+		w.WriteHeader(status)
+		w.Write([]byte(`{"coord":{"lon":21.01,"lat":52.23},"main":{"temp":4.5,"feels_like":1.2,"humidity":87},"dt":1761388161}`))
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	st := memory.New()
+	f := New(st, Config{APIKey: "key", Lat: 52.23, Lon: 21.01, BaseURL: srv.URL})
+	require.NoError(t, f.Update(ctx))
+	assert.Equal(t, map[string]string{"lat": "52.23", "lon": "21.01", "appid": "key", "units": "metric"}, query)
+
+	readings, err := st.ListOutdoorReadings(ctx, 0, 1761388161)
+	require.NoError(t, err)
+	assert.Equal(t, []store.OutdoorReading{{Temp: 4.5, Humidity: 87, Timestamp: 1761388161}}, readings)
+
+	status = http.StatusUnauthorized
+	assert.ErrorContains(t, f.Update(ctx), "401")
+}